@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidAccessLog = fmt.Errorf("invalid access log")
+
+// How long an access log line may sit in a file's buffer before it's written.
+var accessLogFlush = time.Second
+
+// The time format of the common and combined formats.
+const commonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// An AccessEntry is one request in an access log. Its fields are the ones
+// available to an access log template.
+type AccessEntry struct {
+	Time time.Time
+	ID   string
+	// the service the request was for, and the Host it was sent to
+	Service string
+	Host    string
+
+	Method    string
+	URI       string
+	Proto     string
+	Referer   string
+	UserAgent string
+
+	// ClientIP is the address the request came from, and ForwardedFor its
+	// X-Forwarded-For header.
+	ClientIP     string
+	ForwardedFor string
+
+	Status   int
+	Duration time.Duration
+	// the body bytes written to the client, and read from it
+	BytesSent     int64
+	BytesReceived int64
+
+	// the backend that answered, or failed last, and all those tried
+	Backend   string
+	Attempted []string
+
+	// who produced the response, and why shuttle answered it, if it did
+	Origin string
+	Reason string
+	Error  string
+
+	Directive string
+	Tags      string
+}
+
+// Fill in an entry's fields from the request.
+func newAccessEntry(req *http.Request) *AccessEntry {
+	return &AccessEntry{
+		Time:         time.Now(),
+		ID:           requestID(req),
+		Host:         req.Host,
+		Method:       req.Method,
+		URI:          req.RequestURI,
+		Proto:        req.Proto,
+		Referer:      req.Referer(),
+		UserAgent:    req.UserAgent(),
+		ClientIP:     normalizeClientAddr(req.RemoteAddr).Host(),
+		ForwardedFor: normalizeAddrList(req.Header.Get("X-Forwarded-For")),
+	}
+}
+
+// An accessLog writes entries in one format to one destination.
+type accessLog struct {
+	format string
+	tmpl   *template.Template
+	out    *logFile
+}
+
+// Parse a format, which is one of the named formats or a template. A
+// template is tried on an empty entry, so fields that don't exist are found
+// before anything is logged.
+func parseAccessFormat(format string) (*template.Template, error) {
+	switch format {
+	case "", client.AccessLogCommon, client.AccessLogCombined:
+		return nil, nil
+	}
+	tmpl, err := template.New("access_log").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAccessLog, err)
+	}
+	if err := tmpl.Execute(ioutil.Discard, &AccessEntry{}); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAccessLog, err)
+	}
+	return tmpl, nil
+}
+
+// Check an access log's format, and that its file can be opened.
+func validAccessLog(cfg *client.AccessLogConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if _, err := parseAccessFormat(cfg.Format); err != nil {
+		return err
+	}
+	switch cfg.Path {
+	case "", client.AccessLogStdout, client.AccessLogSyslog:
+		return nil
+	}
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidAccessLog, err)
+	}
+	return f.Close()
+}
+
+// Open an access log, or return nil if there's no destination. The log
+// shares the destination with any others open for the same path, and must
+// be closed.
+func newAccessLog(cfg *client.AccessLogConfig) (*accessLog, error) {
+	if cfg == nil || cfg.Path == "" {
+		return nil, nil
+	}
+	tmpl, err := parseAccessFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	out, err := logFiles.open(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAccessLog, err)
+	}
+
+	l := &accessLog{
+		format: cfg.Format,
+		tmpl:   tmpl,
+		out:    out,
+	}
+	if l.format == "" {
+		l.format = client.DefaultAccessLogFormat
+	}
+	return l, nil
+}
+
+func (l *accessLog) close() {
+	if l != nil {
+		l.out.release()
+	}
+}
+
+// Render an entry as a line in the log's format.
+func (l *accessLog) render(e *AccessEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	if l.tmpl != nil {
+		if err := l.tmpl.Execute(&buf, e); err != nil {
+			return nil, err
+		}
+		if b := buf.Bytes(); len(b) == 0 || b[len(b)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), nil
+	}
+
+	size := "-"
+	if e.BytesSent > 0 {
+		size = strconv.FormatInt(e.BytesSent, 10)
+	}
+	fmt.Fprintf(&buf, "%s - - [%s] %q %d %s", e.ClientIP, e.Time.Format(commonLogTime),
+		e.Method+" "+e.URI+" "+e.Proto, e.Status, size)
+	if l.format == client.AccessLogCombined {
+		fmt.Fprintf(&buf, " %q %q", e.Referer, e.UserAgent)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+func (l *accessLog) write(e *AccessEntry) {
+	line, err := l.render(e)
+	if err != nil {
+		log.Errorf("ERROR: access log %s: %s", l.out.path, err)
+		return
+	}
+	l.out.write(line)
+}
+
+// The access log for requests to services without their own, which may be
+// nil.
+var globalAccessLog atomic.Value
+
+func setGlobalAccessLog(l *accessLog) {
+	old, _ := globalAccessLog.Load().(*accessLog)
+	globalAccessLog.Store(l)
+	old.close()
+}
+
+func getGlobalAccessLog() *accessLog {
+	l, _ := globalAccessLog.Load().(*accessLog)
+	return l
+}
+
+// A logFile is an access log destination, shared by the logs open for the
+// same path. Lines written to a file or stdout are buffered, and flushed
+// within accessLogFlush.
+type logFile struct {
+	sync.Mutex
+	path string
+	refs int
+
+	file   *os.File
+	w      *bufio.Writer
+	sys    *syslog.Writer
+	queued bool
+}
+
+// The open log files, by path.
+type logFileSet struct {
+	sync.Mutex
+	files map[string]*logFile
+}
+
+var logFiles = &logFileSet{files: make(map[string]*logFile)}
+
+func (s *logFileSet) open(path string) (*logFile, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if f := s.files[path]; f != nil {
+		f.refs++
+		return f, nil
+	}
+
+	f := &logFile{path: path, refs: 1}
+	switch path {
+	case client.AccessLogStdout:
+		f.w = bufio.NewWriter(os.Stdout)
+	case client.AccessLogSyslog:
+		sys, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "shuttle")
+		if err != nil {
+			return nil, err
+		}
+		f.sys = sys
+	default:
+		if err := f.openFile(); err != nil {
+			return nil, err
+		}
+	}
+	s.files[path] = f
+	return f, nil
+}
+
+// Reopen every log file, so a file that was moved away is created again.
+func (s *logFileSet) reopen() {
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range s.files {
+		f.reopen()
+	}
+}
+
+// Write out everything buffered.
+func (s *logFileSet) flush() {
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range s.files {
+		f.flush()
+	}
+}
+
+// logFile *must* be locked, or not yet shared.
+func (f *logFile) openFile() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	if f.w == nil {
+		f.w = bufio.NewWriter(file)
+	} else {
+		f.w.Reset(file)
+	}
+	return nil
+}
+
+func (f *logFile) write(line []byte) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.sys != nil {
+		f.sys.Info(string(bytes.TrimSuffix(line, []byte("\n"))))
+		return
+	}
+	if f.w == nil {
+		// closed, or failed to reopen
+		return
+	}
+	f.w.Write(line)
+	if !f.queued {
+		f.queued = true
+		time.AfterFunc(accessLogFlush, f.flush)
+	}
+}
+
+func (f *logFile) flush() {
+	f.Lock()
+	defer f.Unlock()
+	f.flushLocked()
+}
+
+// logFile *must* be locked.
+func (f *logFile) flushLocked() {
+	f.queued = false
+	if f.w == nil {
+		return
+	}
+	if err := f.w.Flush(); err != nil {
+		log.Errorf("ERROR: access log %s: %s", f.path, err)
+		// drop what can't be written, rather than failing every write
+		f.w.Reset(f.writer())
+	}
+}
+
+// The destination of the buffered writer.
+// logFile *must* be locked.
+func (f *logFile) writer() io.Writer {
+	if f.file != nil {
+		return f.file
+	}
+	return os.Stdout
+}
+
+func (f *logFile) reopen() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.flushLocked()
+	if f.sys != nil || f.path == client.AccessLogStdout {
+		return
+	}
+	// a file that failed to reopen before is tried again
+	if f.file != nil {
+		f.file.Close()
+	}
+	if err := f.openFile(); err != nil {
+		log.Errorf("ERROR: reopening access log %s: %s", f.path, err)
+		f.file, f.w = nil, nil
+		return
+	}
+	log.Printf("Reopened access log %s", f.path)
+}
+
+// Drop a reference to the file, closing it once there are none left.
+func (f *logFile) release() {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+
+	f.refs--
+	if f.refs > 0 {
+		return
+	}
+	delete(logFiles.files, f.path)
+
+	f.Lock()
+	defer f.Unlock()
+	f.flushLocked()
+	switch {
+	case f.file != nil:
+		f.file.Close()
+	case f.sys != nil:
+		f.sys.Close()
+	}
+	f.file, f.w, f.sys = nil, nil, nil
+}
+
+var reopenOnSignal sync.Once
+
+// Reopen the access log files on SIGUSR1, after they've been rotated.
+func handleReopenSignal() {
+	reopenOnSignal.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		goTask("signals", "", func() {
+			for range sigs {
+				logFiles.reopen()
+			}
+		})
+	})
+}
+
+// Replace the service's access log. The new log is opened before the old one
+// is closed, so a file they share stays open.
+// Service *must* be locked, or not yet started.
+func (s *Service) setAccessLog(cfg *client.AccessLogConfig) error {
+	l, err := newAccessLog(cfg)
+	if err != nil {
+		return err
+	}
+	s.accessLog.close()
+	s.accessLog, s.accessLogCfg = l, cfg
+	return nil
+}
+
+// The access log for the service's requests, which is the global one if it
+// doesn't have its own.
+func (s *Service) accessLogger() *accessLog {
+	s.Lock()
+	l := s.accessLog
+	s.Unlock()
+	if l == nil {
+		return getGlobalAccessLog()
+	}
+	return l
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidClientNet = fmt.Errorf("invalid client network")
+
+// How often a service with LogDenied logs the clients it refused.
+var deniedReportInterval = time.Second
+
+// clientACL is a service's AllowedCIDRs and DeniedCIDRs, parsed, along with
+// the config they came from. It's replaced whole when they change, so the
+// proxies read it without the service's lock.
+type clientACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	log   bool
+
+	allowCfg []string
+	denyCfg  []string
+}
+
+func newClientACL(cfg client.ServiceConfig) (*clientACL, error) {
+	allow, err := parseNets(cfg.AllowedCIDRs, ErrInvalidClientNet)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNets(cfg.DeniedCIDRs, ErrInvalidClientNet)
+	if err != nil {
+		return nil, err
+	}
+	return &clientACL{
+		allow:    allow,
+		deny:     deny,
+		log:      cfg.LogDenied,
+		allowCfg: cfg.AllowedCIDRs,
+		denyCfg:  cfg.DeniedCIDRs,
+	}, nil
+}
+
+// Report whether a client may connect. A client without an IP, like one on a
+// unix socket, is only refused by an allow list.
+func (a *clientACL) allowed(addr clientAddr) bool {
+	if addr.In(a.deny) {
+		return false
+	}
+	return len(a.allow) == 0 || addr.In(a.allow)
+}
+
+func (s *Service) setClientACL(acl *clientACL) {
+	s.clientACL.Store(acl)
+}
+
+func (s *Service) getClientACL() *clientACL {
+	acl, _ := s.clientACL.Load().(*clientACL)
+	return acl
+}
+
+// Check a client against the service's lists, counting it if it's refused.
+func (s *Service) clientAllowed(addr clientAddr) bool {
+	acl := s.getClientACL()
+	if acl == nil || acl.allowed(addr) {
+		return true
+	}
+
+	atomic.AddInt64(&s.ClientDenied, 1)
+	if acl.log {
+		s.reportDenied(addr)
+	}
+	return false
+}
+
+// Log a refused client, along with the number refused since the last report,
+// at most once per deniedReportInterval.
+func (s *Service) reportDenied(addr clientAddr) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.deniedUnreported++
+	now := time.Now()
+	if now.Sub(s.deniedReported) < deniedReportInterval {
+		return
+	}
+	log.With(log.Fields{"service": s.Name, "client": addr.Host(), "denied": s.deniedUnreported}).Warnf("WARN: denied %s access to %s, %d clients denied since the last report", addr.Host(), s.Name, s.deniedUnreported)
+	s.deniedReported = now
+	s.deniedUnreported = 0
+}
+
+// The address an HTTP request is checked by. When the peer is in
+// TrustedNetworks, it's the last address in X-Forwarded-For that isn't, or
+// the first if they all are. Otherwise it's the peer's address, since anyone
+// could have written the header.
+func (s *Service) requestClientAddr(r *http.Request) clientAddr {
+	peer := normalizeClientAddr(r.RemoteAddr)
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		return peer
+	}
+
+	s.Lock()
+	nets := s.trustedNets
+	s.Unlock()
+	if !peer.In(nets) {
+		return peer
+	}
+
+	addrs := strings.Split(strings.Join(forwarded, ","), ",")
+	var addr clientAddr
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr = normalizeClientAddr(strings.TrimSpace(addrs[i]))
+		if addr.IP == nil {
+			// a forged or mangled list can't be trusted any further
+			return peer
+		}
+		if !addr.In(nets) {
+			break
+		}
+	}
+	return addr
+}
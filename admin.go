@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
@@ -15,15 +21,180 @@ import (
 	"github.com/gorilla/mux"
 )
 
+// Respond with an error from the Registry. A missing service or backend is
+// always a 404, with a suggestion for any similar names, since names are case
+// sensitive. Errors with a status of their own use it, and anything else uses
+// the given status code.
+func apiError(w http.ResponseWriter, r *http.Request, err error, code int) {
+	vars := mux.Vars(r)
+	msg := err.Error()
+	if status := errorStatus(err); status != 0 {
+		code = status
+	}
+
+	var similar []string
+	switch err {
+	case ErrNoService:
+		if to := Registry.RenamedTo(vars["service"]); to != "" && len(scopedNames(r, []string{to})) > 0 {
+			http.Error(w, fmt.Sprintf("%s, renamed to: %s", msg, to), http.StatusNotFound)
+			return
+		}
+		similar = scopedNames(r, Registry.SimilarServices(vars["service"]))
+	case ErrNoBackend:
+		similar = Registry.SimilarBackends(vars["service"], vars["backend"])
+	default:
+		http.Error(w, msg, code)
+		return
+	}
+
+	if len(similar) > 0 {
+		msg = fmt.Sprintf("%s, did you mean: %s", msg, strings.Join(similar, ", "))
+	}
+	http.Error(w, msg, http.StatusNotFound)
+}
+
+// The status code for an error from the Registry, or 0 if it has none of its
+// own. The errors for a config of several services only have a status if
+// they all agree.
+func errorStatus(err error) int {
+	if multi, ok := err.(*multiError); ok {
+		status := 0
+		for i, e := range multi.errors {
+			s := errorStatus(e)
+			if i > 0 && s != status {
+				return 0
+			}
+			status = s
+		}
+		return status
+	}
+
+	var listenErr *ListenError
+	switch {
+	case errors.As(err, &listenErr):
+		return http.StatusInternalServerError
+	case errors.Is(err, ErrNoService), errors.Is(err, ErrNoBackend):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateService), errors.Is(err, ErrDuplicateBackend),
+		errors.Is(err, ErrInvalidServiceUpdate), errors.Is(err, ErrDuplicateVHost),
+		errors.Is(err, ErrMoveListener):
+		return http.StatusConflict
+	case errors.Is(err, ErrBackendModified):
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+// Trailing slashes are ignored, so that "/service/" and "/service" are
+// routed the same way.
+func trimSlash(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 {
+			r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Parse the tag filter from any tag query parameters.
+func tagQuery(w http.ResponseWriter, r *http.Request) (tagFilter, bool) {
+	r.ParseForm()
+	filter, err := parseTagFilter(r.Form["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return filter, true
+}
+
 func getConfig(w http.ResponseWriter, r *http.Request) {
-	w.Write(marshal(Registry.Config()))
+	filter, ok := tagQuery(w, r)
+	if !ok {
+		return
+	}
+
+	if r.FormValue("wait") == "true" {
+		waitConfig(w, r, filter)
+		return
+	}
+
+	cfg := Registry.Config()
+	w.Header().Set(client.ConfigHashHeader, configHash(cfg))
+	w.Write(marshal(redactConfig(filterConfig(cfg, filter))))
+}
+
+// Directive secrets are shown as redactedSecret in the configs served by the
+// API, and only kept in the config files and the state config.
+const redactedSecret = "REDACTED"
+
+// Return a copy of the config with its services' secrets redacted.
+func redactConfig(cfg client.Config) client.Config {
+	if cfg.Services != nil {
+		services := make([]client.ServiceConfig, len(cfg.Services))
+		for i, svc := range cfg.Services {
+			services[i] = redactService(svc)
+		}
+		cfg.Services = services
+	}
+	return cfg
+}
+
+func redactService(svc client.ServiceConfig) client.ServiceConfig {
+	if len(svc.DirectiveSecrets) > 0 {
+		secrets := make([]string, len(svc.DirectiveSecrets))
+		for i := range secrets {
+			secrets[i] = redactedSecret
+		}
+		svc.DirectiveSecrets = secrets
+	}
+	return svc
+}
+
+// Keep only the services whose tags match the filter, if there is one.
+func filterConfig(cfg client.Config, filter tagFilter) client.Config {
+	if len(filter) > 0 {
+		services := []client.ServiceConfig{}
+		for _, svc := range cfg.Services {
+			if filter.match(svc.Tags) {
+				services = append(services, svc)
+			}
+		}
+		cfg.Services = services
+	}
+	return cfg
+}
+
+func getRouterConfig(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(Registry.RouterConfig()))
 }
 
 func getStats(w http.ResponseWriter, r *http.Request) {
-	if len(Registry.Config().Services) == 0 {
+	filter, ok := tagQuery(w, r)
+	if !ok {
+		return
+	}
+
+	cfg := Registry.Config()
+	setStatsHeaders(w, cfg)
+	if len(cfg.Services) == 0 {
 		w.WriteHeader(503)
 	}
-	w.Write(marshal(Registry.Stats()))
+
+	stats := Registry.Stats()
+	scope := statsScope(r)
+	if len(filter) > 0 || scope != nil {
+		matched := []ServiceStat{}
+		for _, stat := range stats {
+			if filter.match(stat.Tags) && (scope == nil || scope.allows(stat.Name)) {
+				matched = append(matched, stat)
+			}
+		}
+		stats = matched
+	}
+	w.Write(marshal(stats))
 }
 
 func getServiceStats(w http.ResponseWriter, r *http.Request) {
@@ -31,23 +202,103 @@ func getServiceStats(w http.ResponseWriter, r *http.Request) {
 
 	serviceStats, err := Registry.ServiceStats(vars["service"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		apiError(w, r, err, http.StatusNotFound)
 		return
 	}
 
 	w.Write(marshal(serviceStats))
 }
 
+// Compare the backends chosen by the service's balancer with those its shadow
+// balancer would have chosen.
+func getBalanceCompare(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	cmp, err := Registry.BalanceCompare(vars["service"])
+	if err != nil {
+		apiError(w, r, err, http.StatusNotFound)
+		return
+	}
+	w.Write(marshal(cmp))
+}
+
+// Set the weights of several backends at once, from a map of backend names
+// to weights, where "*" sets the weight of any backends not named.
+func putWeights(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var weights map[string]int
+	if err := json.Unmarshal(body, &weights); err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	current, err := Registry.SetWeights(vars["service"], weights)
+	if err != nil {
+		apiError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	js, _ := json.Marshal(weights)
+	log.Printf("AUDIT: weights set on %s from %s: %s", vars["service"], normalizeClientAddr(r.RemoteAddr), js)
+
+	goTask("state_write", "", writeStateConfig)
+	w.Write(marshal(current))
+}
+
+// Rename a service, keeping its listener, backends, stats and health state.
+func postRename(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var rename client.ServiceRename
+	if err := json.Unmarshal(body, &rename); err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = Registry.RenameService(vars["service"], rename.Name)
+	if err != nil {
+		apiError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	log.Printf("AUDIT: service %s renamed to %s from %s", vars["service"], rename.Name, normalizeClientAddr(r.RemoteAddr))
+
+	goTask("state_write", "", writeStateConfig)
+	svcCfg, err := Registry.ServiceConfig(rename.Name)
+	if err != nil {
+		apiError(w, r, err, http.StatusNotFound)
+		return
+	}
+	w.Write(marshal(redactService(svcCfg)))
+}
+
 func getServiceConfig(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	serviceStats, err := Registry.ServiceConfig(vars["service"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		apiError(w, r, err, http.StatusNotFound)
 		return
 	}
 
-	w.Write(marshal(serviceStats))
+	w.Write(marshal(redactService(serviceStats)))
 }
 
 // Update the global config
@@ -69,10 +320,20 @@ func postConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := Registry.UpdateConfig(cfg); err != nil {
+	// a dry run only validates the config
+	apply := Registry.UpdateConfig
+	if r.FormValue("dry_run") == "true" {
+		apply = Registry.ValidateConfig
+	}
+	if err := apply(cfg); err != nil {
 		log.Errorln(err)
-		// TODO: differentiate between ServerError and BadRequest
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		status := errorStatus(err)
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(marshal(configErrors(err)))
 		return
 	}
 }
@@ -113,23 +374,40 @@ func postService(w http.ResponseWriter, r *http.Request) {
 	//FIXME: this doesn't return an error for an empty or broken service
 	if err != nil {
 		log.Error(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		apiError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	w.Write(marshal(Registry.Config()))
+	w.Write(marshal(redactConfig(Registry.Config())))
 }
 
+// Remove a service, stopping it at once, or with drain=true letting its open
+// connections finish first.
 func deleteService(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	err := Registry.RemoveService(vars["service"])
+	var err error
+	if r.FormValue("drain") == "true" {
+		_, err = Registry.DrainService(vars["service"])
+	} else {
+		err = Registry.RemoveService(vars["service"])
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		apiError(w, r, err, http.StatusNotFound)
 		return
 	}
-	go writeStateConfig()
-	w.Write(marshal(Registry.Config()))
+	goTask("state_write", "", writeStateConfig)
+	w.Write(marshal(redactConfig(Registry.Config())))
+}
+
+// Remove every service, and return the names of those removed. The state
+// config is written before responding, so a restart right after won't bring
+// the services back.
+func deleteConfig(w http.ResponseWriter, r *http.Request) {
+	removed := Registry.RemoveServices()
+	log.Printf("Removed all services: %s", strings.Join(removed, ", "))
+	writeStateConfig()
+	w.Write(marshal(removed))
 }
 
 func getBackendStats(w http.ResponseWriter, r *http.Request) {
@@ -139,25 +417,60 @@ func getBackendStats(w http.ResponseWriter, r *http.Request) {
 
 	backend, err := Registry.BackendStats(serviceName, backendName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		apiError(w, r, err, http.StatusNotFound)
 		return
 	}
 
 	w.Write(marshal(backend))
 }
 
+// Return the config, stats and health check state of a backend, with the
+// ETag of its config for a later PATCH.
 func getBackend(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	serviceName := vars["service"]
 	backendName := vars["backend"]
 
-	backend, err := Registry.BackendStats(serviceName, backendName)
+	info, etag, err := Registry.BackendInfo(serviceName, backendName)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		apiError(w, r, err, http.StatusNotFound)
 		return
 	}
 
-	w.Write(marshal(backend))
+	w.Header().Set("ETag", etag)
+	w.Write(marshal(info))
+}
+
+// Update only the fields of a backend's config that are in the request. If
+// there's an If-Match header, the change is rejected if the backend has been
+// modified since it was read.
+func patchBackend(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serviceName := vars["service"]
+	backendName := vars["backend"]
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var patch client.BackendPatch
+	if err := json.Unmarshal(body, &patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = Registry.PatchBackend(serviceName, backendName, patch, r.Header.Get("If-Match"))
+	if err != nil {
+		apiError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	goTask("state_write", "", writeStateConfig)
+	getBackend(w, r)
 }
 
 func postBackend(w http.ResponseWriter, r *http.Request) {
@@ -183,12 +496,12 @@ func postBackend(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := Registry.AddBackend(serviceName, backendCfg); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		apiError(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	go writeStateConfig()
-	w.Write(marshal(Registry.Config()))
+	goTask("state_write", "", writeStateConfig)
+	w.Write(marshal(redactConfig(Registry.Config())))
 }
 
 func deleteBackend(w http.ResponseWriter, r *http.Request) {
@@ -197,57 +510,571 @@ func deleteBackend(w http.ResponseWriter, r *http.Request) {
 	serviceName := vars["service"]
 	backendName := vars["backend"]
 
-	if err := Registry.RemoveBackend(serviceName, backendName); err != nil {
+	var err error
+	if r.FormValue("drain") == "true" {
+		err = Registry.DrainBackend(serviceName, backendName)
+	} else {
+		err = Registry.RemoveBackend(serviceName, backendName)
+	}
+	if err != nil {
+		apiError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	goTask("state_write", "", writeStateConfig)
+	w.Write(marshal(redactConfig(Registry.Config())))
+}
+
+func getBackendChecks(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	checks, err := Registry.BackendChecks(vars["service"], vars["backend"])
+	if err != nil {
+		apiError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	w.Write(marshal(checks))
+}
+
+// Run a health check immediately, and return the result.
+// The check only counts towards the backend's rise and fall if count=true.
+func postBackendCheck(w http.ResponseWriter, r *http.Request) {
+	runBackendCheck(w, r, r.FormValue("count") == "true")
+}
+
+// Run a health check immediately that counts towards the backend's rise and
+// fall like a scheduled one, and return the result.
+func postBackendForceCheck(w http.ResponseWriter, r *http.Request) {
+	runBackendCheck(w, r, true)
+}
+
+func runBackendCheck(w http.ResponseWriter, r *http.Request, count bool) {
+	vars := mux.Vars(r)
+
+	result, err := Registry.CheckBackend(vars["service"], vars["backend"], count)
+	switch err {
+	case nil:
+	case ErrNoCheckAddr:
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
+	default:
+		apiError(w, r, err, http.StatusNotFound)
+		return
 	}
 
-	go writeStateConfig()
-	w.Write(marshal(Registry.Config()))
+	w.Write(marshal(result))
 }
 
-func addHandlers() {
+// Update the readiness published by a backend, and return its stats.
+func postBackendReady(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var ready client.ReadyConfig
+	if err := json.Unmarshal(body, &ready); err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = Registry.SetBackendReady(vars["service"], vars["backend"], ready, normalizeClientAddr(r.RemoteAddr).String())
+	if err != nil {
+		apiError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	getBackend(w, r)
+}
+
+// Take a backend out of rotation for maintenance, or return it. The state is
+// saved with the backend's config.
+func putBackendState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var state client.AdminStateConfig
+	if err := json.Unmarshal(body, &state); err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = Registry.SetBackendAdminState(vars["service"], vars["backend"], state.State)
+	if err != nil {
+		apiError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	log.Printf("AUDIT: backend %s/%s set %s from %s", vars["service"], vars["backend"], state.State, normalizeClientAddr(r.RemoteAddr))
+
+	goTask("state_write", "", writeStateConfig)
+	getBackend(w, r)
+}
+
+// Start a payload capture on a backend.
+// Every capture is logged, since it may record sensitive data.
+func postCapture(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	serviceName := vars["service"]
+	backendName := vars["backend"]
+
+	if !enableCapture {
+		http.Error(w, ErrCaptureDisabled.Error(), http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	captureCfg := client.CaptureConfig{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &captureCfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := Registry.StartCapture(serviceName, backendName, captureCfg); err != nil {
+		apiError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("AUDIT: capture started on %s/%s from %s: %s",
+		serviceName, backendName, normalizeClientAddr(r.RemoteAddr), body)
+
+	dump, _ := Registry.Capture(serviceName, backendName)
+	w.Write(marshal(dump))
+}
+
+// Return the current or last capture for a backend, as json or with
+// format=hex as a text dump.
+func getCapture(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	dump, err := Registry.Capture(vars["service"], vars["backend"])
+	if err != nil {
+		apiError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	if r.FormValue("format") == "hex" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(dump.Hex())
+		return
+	}
+
+	w.Write(marshal(dump))
+}
+
+func deleteCapture(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if err := Registry.StopCapture(vars["service"], vars["backend"]); err != nil {
+		apiError(w, r, err, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("AUDIT: capture stopped on %s/%s from %s", vars["service"], vars["backend"], normalizeClientAddr(r.RemoteAddr))
+
+	dump, _ := Registry.Capture(vars["service"], vars["backend"])
+	w.Write(marshal(dump))
+}
+
+// Return the billing totals for a service, or all services.
+// The from and to parameters are RFC3339 times, and default to the start of
+// the current month and now.
+func getBilling(w http.ResponseWriter, r *http.Request) {
+	if billing == nil {
+		http.Error(w, ErrBillingDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+
+	var err error
+	if v := r.FormValue("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := billing.Report(r.FormValue("service"), from, to)
+	if err != nil {
+		log.Errorf("ERROR: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(marshal(report))
+}
+
+// Return the source IPs and markers for health checks, so firewall automation
+// can allow them.
+func getCheckInfo(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(Registry.CheckSources()))
+}
+
+// Report the host-wide health check budget, and how much of it is in use.
+func getChecks(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(checks.Status()))
+}
+
+// Report whether shuttle is running normally, or the progress of startup or
+// a shutdown. If any component failed to start, shuttle is degraded.
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	health := client.Health{
+		Status:     "ok",
+		Stage:      shutdown.Stage(),
+		Active:     Registry.ActiveConns(),
+		Listeners:  Registry.ListenStates(),
+		Tasks:      tasks.total(),
+		TaskPanics: tasks.panicked(),
+	}
+	if limit := tasks.limits().total; limit > 0 {
+		health.TasksHigh = health.Tasks > int64(limit)
+	}
+	health.Empty = scopedNames(r, Registry.EmptyServices())
+
+	state := stateWriteStatus()
+	health.StateFailures = state.Failures
+	health.StateError = state.LastError
+	health.AdminUnauthorized = atomic.LoadInt64(&adminUnauthorized)
+
+	unhealthy := Registry.UnhealthyServices()
+
+	if scope := statsScope(r); scope != nil {
+		for name := range health.Listeners {
+			if !scope.allows(name) {
+				delete(health.Listeners, name)
+			}
+		}
+		for _, svc := range unhealthy {
+			if scope.allows(svc.Name) {
+				health.Unhealthy = append(health.Unhealthy, svc)
+			}
+		}
+	} else {
+		health.Unhealthy = unhealthy
+	}
+
+	if mainServer != nil {
+		health.Failed = mainServer.Failed()
+		select {
+		case <-mainServer.Ready():
+			if len(health.Failed) > 0 {
+				health.Status = "degraded"
+			}
+		default:
+			health.Status = "starting"
+		}
+	}
+
+	// changes are being rejected until the state can be written
+	if state.Readonly && health.Status == "ok" {
+		health.Status = "degraded"
+	}
+
+	if len(unhealthy) > 0 && health.Status == "ok" {
+		health.Status = "unhealthy"
+	}
+
+	if health.Stage != "" {
+		health.Status = ErrShuttingDown.Error()
+	}
+
+	if health.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	w.Write(marshal(health))
+}
+
+// Report the live internal objects, to find leaks.
+func getObjects(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(Registry.ObjectCounts()))
+}
+
+func getTasks(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(tasks.report()))
+}
+
+// Report whether the state config is being written.
+func getState(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(stateWriteStatus()))
+}
+
+// Report the busiest hosts that requests were sent for, but that matched no
+// vhost, limited to the top n.
+func getUnknownHosts(w http.ResponseWriter, r *http.Request) {
+	top := defaultUnknownHostsTop
+	if v := r.FormValue("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid top", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	w.Write(marshal(unknownVHosts.stats(top)))
+}
+
+// Run the readiness checks for a virtual host. The report is returned with a
+// 503 if any check failed, so it can gate a DNS change directly.
+func getVHostReady(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	days := client.DefaultCertMinDays
+	if v := r.FormValue("cert_min_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid cert_min_days", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+
+	// the report names every service routing the vhost
+	if scope := statsScope(r); scope != nil {
+		services := Registry.vhostServiceNames(vars["host"])
+		if len(services) == 0 || len(scopedNames(r, services)) < len(services) {
+			http.Error(w, ErrAdminForbidden.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	report := Registry.VHostReady(vars["host"], time.Duration(days)*24*time.Hour)
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(marshal(report))
+}
+
+// Wrap a handler that modifies the config, so that it's rejected once we've
+// started shutting down, or while the state config can't be written under the
+// readonly policy.
+func mutating(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !shutdown.BeginMutation() {
+			http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer shutdown.EndMutation()
+
+		if stateWriteStatus().Readonly {
+			http.Error(w, ErrStateReadonly.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		h(w, r)
+		evaluateOverlays()
+		configChanges.notify()
+	}
+}
+
+func newAdminHandler() http.Handler {
 	r := mux.NewRouter()
-	r.HandleFunc("/", getStats).Methods("GET")
-	r.HandleFunc("/", postConfig).Methods("PUT", "POST")
+	r.HandleFunc("/", getStats).Methods("GET").Name("stats_all")
+	r.HandleFunc("/", mutating(postConfig)).Methods("PUT", "POST")
 	r.HandleFunc("/_config", getConfig).Methods("GET")
-	r.HandleFunc("/_config", postConfig).Methods("PUT", "POST")
-	r.HandleFunc("/_stats", getStats).Methods("GET")
-	r.HandleFunc("/{service}", getServiceStats).Methods("GET")
+	r.HandleFunc("/_config", mutating(postConfig)).Methods("PUT", "POST")
+	r.HandleFunc("/_config", mutating(deleteConfig)).Methods("DELETE")
+	r.HandleFunc("/_stats", getStats).Methods("GET").Name("stats")
+	r.HandleFunc("/_metrics", getMetrics).Methods("GET").Name("metrics")
+	r.HandleFunc("/_version", getVersion).Methods("GET").Name("version")
+	r.HandleFunc("/_router", getRouterConfig).Methods("GET")
+	r.HandleFunc("/_health", getHealth).Methods("GET").Name("health")
+	r.HandleFunc("/_state", getState).Methods("GET")
+	r.HandleFunc("/_billing", getBilling).Methods("GET")
+	r.HandleFunc("/_checkinfo", getCheckInfo).Methods("GET")
+	r.HandleFunc("/_checks", getChecks).Methods("GET")
+	r.HandleFunc("/_vhosts/unknown", getUnknownHosts).Methods("GET")
+	r.HandleFunc("/_vhosts/{host}/ready", getVHostReady).Methods("GET").Name("vhost_ready")
+	r.HandleFunc("/_debug/objects", getObjects).Methods("GET")
+	r.HandleFunc("/_debug/tasks", getTasks).Methods("GET")
+	r.HandleFunc("/_overlays", getOverlays).Methods("GET")
+	r.HandleFunc("/_takeover", getTakeover).Methods("GET")
+	r.HandleFunc("/_takeover", postTakeover).Methods("POST")
+	r.HandleFunc("/_logs/stream", getLogStream).Methods("GET").Name("logs_stream")
+	r.HandleFunc("/_events", getEvents).Methods("GET").Name("events")
+	r.HandleFunc("/{service}", getServiceStats).Methods("GET").Name("service")
 	r.HandleFunc("/{service}/_config", getServiceConfig).Methods("GET")
-	r.HandleFunc("/{service}/_stats", getServiceStats).Methods("GET")
-	r.HandleFunc("/{service}", postService).Methods("PUT", "POST")
-	r.HandleFunc("/{service}", deleteService).Methods("DELETE")
+	r.HandleFunc("/{service}/_stats", getServiceStats).Methods("GET").Name("service_stats")
+	r.HandleFunc("/{service}/_balance_compare", getBalanceCompare).Methods("GET")
+	r.HandleFunc("/{service}/_weights", mutating(putWeights)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/_rename", mutating(postRename)).Methods("POST")
+	r.HandleFunc("/{service}", mutating(postService)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}", mutating(deleteService)).Methods("DELETE")
 	r.HandleFunc("/{service}/{backend}", getBackend).Methods("GET")
-	r.HandleFunc("/{service}/{backend}", postBackend).Methods("PUT", "POST")
-	r.HandleFunc("/{service}/{backend}", deleteBackend).Methods("DELETE")
-	http.Handle("/", r)
+	r.HandleFunc("/{service}/{backend}", mutating(postBackend)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/{backend}", mutating(patchBackend)).Methods("PATCH")
+	r.HandleFunc("/{service}/{backend}", mutating(deleteBackend)).Methods("DELETE")
+	r.HandleFunc("/{service}/{backend}/checks", getBackendChecks).Methods("GET")
+	r.HandleFunc("/{service}/{backend}/checks", postBackendCheck).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/check", postBackendForceCheck).Methods("POST")
+	r.HandleFunc("/{service}/{backend}/ready", mutating(postBackendReady)).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/{backend}/state", mutating(putBackendState)).Methods("PUT")
+	r.HandleFunc("/{service}/{backend}/capture", getCapture).Methods("GET")
+	r.HandleFunc("/{service}/{backend}/capture", postCapture).Methods("PUT", "POST")
+	r.HandleFunc("/{service}/{backend}/capture", deleteCapture).Methods("DELETE")
+	return trimSlash(authorizeAdmin(r))
 }
 
-func startAdminHTTPServer(wg *sync.WaitGroup) {
-	defer wg.Done()
-	addHandlers()
-	log.Println("Admin server listening on", adminListenAddr)
+// The admin server of the running shuttle
+var adminServer *AdminServer
 
-	netw := "tcp"
+// AdminServer serves the admin API on a tcp address, or a unix socket if the
+// address is an absolute path.
+type AdminServer struct {
+	sync.Mutex
+	Addr string
+
+	server   *http.Server
+	listener net.Listener
+	ready    chan struct{}
+	done     chan struct{}
+}
 
-	if strings.HasPrefix(adminListenAddr, "/") {
+func NewAdminServer(addr string) *AdminServer {
+	return &AdminServer{
+		Addr:   addr,
+		server: &http.Server{Handler: newAdminHandler()},
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start listening, and serve the admin API in the background.
+func (a *AdminServer) Start(ctx context.Context) error {
+	listener, err := a.listen()
+	if err != nil {
+		return err
+	}
+
+	a.Lock()
+	a.listener = listener
+	a.Unlock()
+
+	log.Println("Admin server listening on", listener.Addr())
+	close(a.ready)
+
+	goTask("admin_server", "", func() {
+		defer close(a.done)
+		a.server.Serve(listener)
+	})
+	return nil
+}
+
+// Adopt the listener inherited for the admin address, or create it.
+func (a *AdminServer) listen() (net.Listener, error) {
+	netw := "tcp"
+	if strings.HasPrefix(a.Addr, "/") {
 		netw = "unix"
+	}
+
+	if f, ok := defaultListenerFactory.(*inheritedListeners); ok {
+		// An inherited socket isn't removed when it's closed, since the
+		// parent still serves on it if this shuttle fails to start. The next
+		// start removes it if it's left behind.
+		if l := f.stream(a.Addr); l != nil {
+			return l, nil
+		}
+	}
 
+	if netw == "unix" {
 		// remove our old socket if we left it lying around
-		if stats, err := os.Stat(adminListenAddr); err == nil {
+		if stats, err := os.Stat(a.Addr); err == nil {
 			if stats.Mode()&os.ModeSocket != 0 {
-				os.Remove(adminListenAddr)
+				os.Remove(a.Addr)
 			}
 		}
+	}
+	return net.Listen(netw, a.Addr)
+}
 
-		defer os.Remove(adminListenAddr)
+// A duplicate of the admin listening socket.
+func (a *AdminServer) listenerFile() (*os.File, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if f, ok := a.listener.(filer); ok {
+		return f.File()
 	}
+	return nil, ErrNoListenerFile
+}
 
-	listener, err := net.Listen(netw, adminListenAddr)
-	if err != nil {
-		log.Fatalln(err)
+// Stop accepting admin connections, leaving the socket to the shuttle that
+// was handed the listener. Open connections are left to finish.
+func (a *AdminServer) handOffListener() {
+	a.Lock()
+	defer a.Unlock()
+
+	if ul, ok := a.listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	if a.listener != nil {
+		a.listener.Close()
+	}
+}
+
+// Ready is closed once the admin listener is ready.
+func (a *AdminServer) Ready() <-chan struct{} {
+	return a.ready
+}
+
+// Stop closes the listener and all connections, and removes the unix socket.
+func (a *AdminServer) Stop(ctx context.Context) error {
+	a.Lock()
+	listener := a.listener
+	a.Unlock()
+
+	if listener == nil {
+		return nil
 	}
 
-	http.Serve(listener, nil)
+	// closing a unix listener removes the socket
+	a.server.Close()
+
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The address the admin server is listening on.
+func (a *AdminServer) ListenAddr() net.Addr {
+	a.Lock()
+	defer a.Unlock()
+	if a.listener == nil {
+		return nil
+	}
+	return a.listener.Addr()
 }
@@ -1,24 +1,48 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 	. "gopkg.in/check.v1"
+	"gopkg.in/yaml.v3"
 )
 
 type HTTPSuite struct {
 	servers        []*testServer
 	backendServers []*testHTTPServer
 	httpSvr        *httptest.Server
+	httpsRouter    *HostRouter
 	httpAddr       string
 	httpPort       string
 	httpsAddr      string
@@ -32,18 +56,18 @@ func (s *HTTPSuite) SetUpSuite(c *C) {
 		svcs:   make(map[string]*Service),
 		vhosts: make(map[string]*VirtualHost),
 	}
+	unknownVHosts = newUnknownHosts(unknownHostCache, unknownHostCounts)
 
-	addHandlers()
-	s.httpSvr = httptest.NewServer(nil)
+	s.httpSvr = httptest.NewServer(newAdminHandler())
 
 	httpServer := &http.Server{
 		Addr: "127.0.0.1:0",
 	}
 
 	httpRouter = NewHostRouter(httpServer)
-	httpReady := make(chan bool)
-	go httpRouter.Start(httpReady)
-	<-httpReady
+	if err := httpRouter.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
 
 	// now build an HTTPS server
 	tlsCfg, err := loadCerts("./testdata")
@@ -60,9 +84,10 @@ func (s *HTTPSuite) SetUpSuite(c *C) {
 	httpsRouter := NewHostRouter(httpsServer)
 	httpsRouter.Scheme = "https"
 
-	httpsReady := make(chan bool)
-	go httpsRouter.Start(httpsReady)
-	<-httpsReady
+	if err := httpsRouter.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
+	s.httpsRouter = httpsRouter
 
 	// assign the test router's addr to the glolbal
 	s.httpAddr = httpRouter.listener.Addr().String()
@@ -73,7 +98,8 @@ func (s *HTTPSuite) SetUpSuite(c *C) {
 
 func (s *HTTPSuite) TearDownSuite(c *C) {
 	s.httpSvr.Close()
-	httpRouter.Stop()
+	httpRouter.Stop(context.Background())
+	s.httpsRouter.Stop(context.Background())
 }
 
 func (s *HTTPSuite) SetUpTest(c *C) {
@@ -112,6 +138,12 @@ func (s *HTTPSuite) TearDownTest(c *C) {
 	Registry.cfg.ClientTimeout = 0
 	Registry.cfg.ServerTimeout = 0
 	Registry.cfg.DialTimeout = 0
+	Registry.cfg.TimeoutPolicy = ""
+	Registry.cfg.MaxHeaderBytes = 0
+	Registry.cfg.UnknownSNI = ""
+	Registry.cfg.HealthServices = nil
+	Registry.cfg.HealthMinUpPercent = 0
+	Registry.health = nil
 
 	for _, s := range s.backendServers {
 		s.Close()
@@ -312,6 +344,159 @@ func (s *HTTPSuite) TestAddRemoveVHosts(c *C) {
 	}
 }
 
+// Requests for a host with no vhost are answered from the cache after the
+// first miss, until a vhost is registered, and the busiest are reported.
+func (s *HTTPSuite) TestUnknownHosts(c *C) {
+	// forget the misses of earlier tests
+	unknownVHosts = newUnknownHosts(unknownHostCache, unknownHostCounts)
+
+	get := func(host string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	// the first miss takes the full path, and is given a request ID
+	resp := get("gone-vhost")
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(resp.Header.Get("X-Request-Id"), Not(Equals), "")
+
+	// the next is answered from the cache
+	resp = get("gone-vhost")
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(resp.Header.Get("X-Request-Id"), Equals, "")
+
+	// registering the vhost takes effect at once
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"gone-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "gone-vhost", s.backendServers[0].addr, 200, c)
+
+	for host, n := range map[string]int{"a-vhost": 4, "b-vhost": 3, "c-vhost": 1} {
+		for i := 0; i < n; i++ {
+			get(host)
+		}
+	}
+
+	resp, err := http.Get(s.httpSvr.URL + "/_vhosts/unknown?top=2")
+	if err != nil {
+		c.Fatal(err)
+	}
+	var stats UnknownHostStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Cached, Equals, 3)
+	c.Assert(stats.Hosts, DeepEquals, []UnknownHost{{"a-vhost", 4}, {"b-vhost", 3}})
+
+	resp, err = http.Get(s.httpSvr.URL + "/_vhosts/unknown?top=none")
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+}
+
+// Virtual hosts are registered and matched in their canonical form, whatever
+// the case, trailing dots or encoding of the names used.
+func (s *HTTPSuite) TestCanonicalVHosts(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostCase",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"Mixed-Case.test", "BÜcher.example", "xn--mnchen-3ya.test."},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("VHostCase")
+
+	// the canonical names are stored and reported
+	cfg, _ := Registry.ServiceConfig("VHostCase")
+	c.Assert(cfg.VirtualHosts, DeepEquals, []string{"mixed-case.test", "xn--bcher-kva.example", "xn--mnchen-3ya.test"})
+
+	for _, host := range []string{"mixed-case.test", "MIXED-CASE.test.", "xn--bcher-kva.example", "xn--mnchen-3ya.test"} {
+		checkHTTP("http://"+s.httpAddr+"/addr", host, s.backendServers[0].addr, 200, c)
+	}
+	// Go's client sends U-labels as punycode, so try them directly
+	c.Assert(Registry.GetVHostService("Bücher.example"), Equals, svc)
+	c.Assert(Registry.GetVHostService("MÜNCHEN.test."), Equals, svc)
+
+	// updates with other forms of the same names change nothing
+	svcCfg.VirtualHosts = []string{"MIXED-CASE.test.", "xn--bcher-kva.example", "münchen.test"}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	cfg, _ = Registry.ServiceConfig("VHostCase")
+	c.Assert(cfg.VirtualHosts, DeepEquals, []string{"mixed-case.test", "xn--bcher-kva.example", "xn--mnchen-3ya.test"})
+
+	// malformed and colliding names are rejected, through the API too
+	svcCfg.VirtualHosts = []string{"mixed-case.test:80"}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidVHost.Error()+`.*names can't include a port`)
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	svcCfg.VirtualHosts = []string{"bücher.example", "xn--bcher-kva.example"}
+	err := shuttle.UpdateService(&svcCfg)
+	c.Assert(err, ErrorMatches, `.*409 Conflict: .*`+ErrDuplicateVHost.Error()+`.*`)
+	checkHTTP("http://"+s.httpAddr+"/addr", "mixed-case.test", s.backendServers[0].addr, 200, c)
+}
+
+// Wildcard vhosts route the hosts under them, after any exact vhost, and
+// removing one leaves the exact vhosts it covers in place.
+func (s *HTTPSuite) TestWildcardVHosts(c *C) {
+	exact := client.ServiceConfig{
+		Name:         "VHostExact",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"www.tenant.test"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	wild := client.ServiceConfig{
+		Name:         "VHostWild",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"*.Tenant.test", "**.tenant.test", "*.Bücher.test"},
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.backendServers[1].addr},
+		},
+	}
+	c.Assert(Registry.AddService(exact), IsNil)
+	c.Assert(Registry.AddService(wild), IsNil)
+	svc := Registry.GetService("VHostWild")
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "www.tenant.test", s.backendServers[0].addr, 200, c)
+	for _, host := range []string{"a.tenant.test", "A.TENANT.TEST.", "a.b.tenant.test", "www.xn--bcher-kva.test:80"} {
+		checkHTTP("http://"+s.httpAddr+"/addr", host, s.backendServers[1].addr, 200, c)
+	}
+	c.Assert(Registry.GetVHostService("WWW.Bücher.test"), Equals, svc)
+	c.Assert(Registry.GetVHostService("tenant.test"), IsNil)
+
+	// requests are counted under the wildcard they matched
+	stats := svc.Stats().VHostStats
+	c.Assert(stats["*.tenant.test"].Requests, Equals, int64(2))
+	c.Assert(stats["**.tenant.test"].Requests, Equals, int64(1))
+	c.Assert(stats["*.xn--bcher-kva.test"].Requests, Equals, int64(1))
+
+	// without the wildcards only the exact vhost is left
+	wild.VirtualHosts = []string{"*.bücher.test"}
+	c.Assert(Registry.UpdateService(wild), IsNil)
+	checkHTTP("http://"+s.httpAddr+"/addr", "www.tenant.test", s.backendServers[0].addr, 200, c)
+	c.Assert(Registry.GetVHostService("a.tenant.test"), IsNil)
+}
+
 // Add multiple services under the same VirtualHost
 // Each proxy request should round-robin through the two of them
 func (s *HTTPSuite) TestMultiServiceVHost(c *C) {
@@ -513,6 +698,129 @@ func (s *HTTPSuite) TestErrorPage(c *C) {
 	c.Assert(resp.Header.Get("Last-Modified"), Equals, errServer.addr)
 }
 
+// Error pages with a condition are only substituted for backend responses
+// whose body meets it.
+func (s *HTTPSuite) TestErrorPageConditions(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.FormValue("code"))
+		size, _ := strconv.Atoi(r.FormValue("size"))
+		w.WriteHeader(code)
+		// an unknown length, so the body has to be read
+		if r.FormValue("stream") != "" {
+			w.(http.Flusher).Flush()
+		}
+		io.WriteString(w, r.FormValue("body"))
+		io.WriteString(w, strings.Repeat("x", size))
+	}))
+	defer backend.Close()
+
+	errServer := s.backendServers[1]
+	svcCfg := client.ServiceConfig{
+		Name:         "Conditional",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"conditional-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: strings.TrimPrefix(backend.URL, "http://")},
+		},
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error?code=503": {500, 502, 503, 504},
+		},
+		ErrorPageConditions: map[int]client.ErrorPageCondition{
+			500: {Body: client.ErrorBodyMatches, Pattern: "nginx|Internal Server Error", Bytes: 64},
+			502: {Body: client.ErrorBodyEmpty},
+			503: {Body: client.ErrorBodySmaller, Bytes: 16},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(query string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/?"+query, nil)
+		req.Host = "conditional-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		return resp.StatusCode, string(body)
+	}
+
+	// the error page is fetched in the background
+	for i := 0; ; i++ {
+		if _, body := get("code=504"); body == errServer.addr || i == 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	payload := `{"error":"quota exceeded","retry":false}`
+	padded := payload + strings.Repeat(" ", 64) + "nginx"
+	for _, t := range []struct {
+		query string
+		body  string
+	}{
+		{"code=502", errServer.addr},
+		{"code=502&stream=1", errServer.addr},
+		{"code=502&body=" + url.QueryEscape(payload), payload},
+		{"code=503&body=oops", errServer.addr},
+		{"code=503&body=oops&stream=1", errServer.addr},
+		{"code=503&body=" + url.QueryEscape(payload), payload},
+		{"code=503&stream=1&body=" + url.QueryEscape(payload), payload},
+		{"code=500&stream=1&body=" + url.QueryEscape("<center>nginx</center>"), errServer.addr},
+		{"code=500&stream=1&body=" + url.QueryEscape(payload), payload},
+		// the pattern is only looked for in the first 64 bytes
+		{"code=500&stream=1&size=64&body=nginx", errServer.addr},
+		{"code=500&stream=1&body=" + url.QueryEscape(padded), padded},
+	} {
+		code, body := get(t.query)
+		c.Assert(code >= 500, Equals, true, Commentf("%s", t.query))
+		c.Assert(body, Equals, t.body, Commentf("%s", t.query))
+	}
+
+	// a large error response is passed through whole
+	code, body := get("code=500&stream=1&size=1048576")
+	c.Assert(code, Equals, 500)
+	c.Assert(body, Equals, strings.Repeat("x", 1<<20))
+
+	stats, err := Registry.ServiceStats("Conditional")
+	c.Assert(err, IsNil)
+	c.Assert(stats.ErrorConditions, HasLen, 3)
+	for _, stat := range stats.ErrorConditions {
+		switch stat.Status {
+		case 500:
+			c.Assert([]int64{stat.Substituted, stat.Passed}, DeepEquals, []int64{2, 3})
+		case 502:
+			c.Assert([]int64{stat.Substituted, stat.Passed}, DeepEquals, []int64{2, 1})
+		case 503:
+			c.Assert([]int64{stat.Substituted, stat.Passed}, DeepEquals, []int64{2, 2})
+		}
+	}
+
+	// the conditions round trip through the config API
+	resp, err := http.Get(s.httpSvr.URL + "/Conditional/_config")
+	c.Assert(err, IsNil)
+	var cfg client.ServiceConfig
+	c.Assert(json.NewDecoder(resp.Body).Decode(&cfg), IsNil)
+	resp.Body.Close()
+	c.Assert(cfg.ErrorPageConditions, DeepEquals, svcCfg.ErrorPageConditions)
+
+	for _, cond := range []client.ErrorPageCondition{
+		{Body: "ugly"},
+		{Body: client.ErrorBodySmaller},
+		{Body: client.ErrorBodyMatches},
+		{Body: client.ErrorBodyMatches, Pattern: "("},
+		{Body: client.ErrorBodyMatches, Pattern: "x", Bytes: client.MaxErrorPeekBytes + 1},
+		{Body: client.ErrorBodyEmpty, Pattern: "x"},
+	} {
+		svcCfg.ErrorPageConditions = map[int]client.ErrorPageCondition{502: cond}
+		err := Registry.UpdateService(svcCfg)
+		c.Assert(err, ErrorMatches, ErrInvalidErrorCondition.Error()+".*", Commentf("%v", cond))
+	}
+}
+
 func (s *HTTPSuite) TestUpdateServiceDefaults(c *C) {
 	svcCfg := client.ServiceConfig{
 		Name: "TestService",
@@ -568,6 +876,208 @@ func (s *HTTPSuite) TestUpdateServiceDefaults(c *C) {
 	}
 }
 
+// Change the ClientTimeout through the API, and make sure the running listener
+// uses the new value for new connections.
+func (s *HTTPSuite) TestUpdateClientTimeout(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:          "TestService",
+		Addr:          "127.0.0.1:9000",
+		ClientTimeout: 5000,
+		Backends: []client.BackendConfig{
+			{Name: "Backend1", Addr: s.servers[0].addr},
+		},
+	}
+
+	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/TestService", bytes.NewReader(svcCfg.Marshal()))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+
+	svcCfg.ClientTimeout = 200
+	req, _ = http.NewRequest("PUT", s.httpSvr.URL+"/TestService", bytes.NewReader(svcCfg.Marshal()))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the new value should be reported in the service config
+	resp, err = http.Get(s.httpSvr.URL + "/TestService/_config")
+	if err != nil {
+		c.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	liveCfg := client.ServiceConfig{}
+	if err := json.Unmarshal(body, &liveCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(liveCfg.ClientTimeout, Equals, 200)
+
+	// an idle client should be disconnected after the new timeout, well
+	// before the original 5s.
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 64))
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+// Every admin endpoint should route the same way with or without a trailing
+// slash. Names are case sensitive, but a 404 suggests near-matches.
+func (s *HTTPSuite) TestRoutingTable(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "Route-Svc",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "Route-Backend", Addr: s.servers[0].addr, CheckAddr: s.servers[0].addr},
+		},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	backendDef := `{"address": "127.0.0.1:9001"}`
+
+	routes := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		msg    string
+	}{
+		{"GET", "/", "", 200, ""},
+		{"GET", "/_config", "", 200, ""},
+		{"GET", "/_config/", "", 200, ""},
+		{"GET", "/_stats/", "", 200, ""},
+		{"GET", "/_health/", "", 200, ""},
+		{"GET", "/Route-Svc", "", 200, ""},
+		{"GET", "/Route-Svc/", "", 200, ""},
+		{"GET", "/Route-Svc//", "", 200, ""},
+		{"GET", "/Route-Svc/_config/", "", 200, ""},
+		{"GET", "/Route-Svc/_stats/", "", 200, ""},
+		{"GET", "/route-svc", "", 404, "did you mean: Route-Svc"},
+		{"GET", "/route-svc/", "", 404, "did you mean: Route-Svc"},
+		{"GET", "/Route-Svx/_config", "", 404, "did you mean: Route-Svc"},
+		{"GET", "/Route%2DSvc", "", 200, ""},
+		{"GET", "/Route-Svc/Route-Backend", "", 200, ""},
+		{"GET", "/Route-Svc/Route-Backend/", "", 200, ""},
+		{"GET", "/Route-Svc/route-backend", "", 404, "did you mean: Route-Backend"},
+		{"GET", "/Route-Svc/Route-Backend/checks/", "", 200, ""},
+		{"GET", "/Route-Svc/route-backend/checks", "", 404, "did you mean: Route-Backend"},
+		{"GET", "/Route-Svc/route-backend/capture", "", 404, "did you mean: Route-Backend"},
+		{"DELETE", "/route-svc/Route-Backend", "", 404, "did you mean: Route-Svc"},
+		{"DELETE", "/Route-Svc/route-backend/", "", 404, "did you mean: Route-Backend"},
+		{"PUT", "/route-svc/New-Backend", backendDef, 404, "did you mean: Route-Svc"},
+		{"PUT", "/_Route-Svc", `{"address": "127.0.0.1:9002"}`, 400, "reserved"},
+		{"PUT", "/Route-Svc/_backend", backendDef, 400, "reserved"},
+		{"PUT", "/Route-Svc/bad%20name", backendDef, 400, "invalid name"},
+		{"PUT", "/Route-Svc/odd%3Fname/", backendDef, 200, ""},
+		{"GET", "/Route-Svc/odd%3Fname", "", 200, ""},
+		{"DELETE", "/Route-Svc/odd%3Fname/", "", 200, ""},
+	}
+
+	for _, route := range routes {
+		req, _ := http.NewRequest(route.method, s.httpSvr.URL+route.path, bytes.NewReader([]byte(route.body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		c.Assert(resp.StatusCode, Equals, route.status, Commentf("%s %s: %s", route.method, route.path, body))
+		c.Assert(strings.Contains(string(body), route.msg), Equals, true, Commentf("%s %s: %s", route.method, route.path, body))
+	}
+
+	// names that need escaping work through the client package
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	oddName := "odd?name#100%"
+	err := shuttle.UpdateBackend("Route-Svc", &client.BackendConfig{Name: oddName, Addr: "127.0.0.1:9001"})
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	if _, err := Registry.BackendStats("Route-Svc", oddName); err != nil {
+		c.Fatal(err)
+	}
+
+	if err := shuttle.RemoveBackend("Route-Svc", oddName); err != nil {
+		c.Fatal(err)
+	}
+}
+
+// The client decodes the stats the server marshals into the same types.
+func (s *HTTPSuite) TestClientStats(c *C) {
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+
+	// no services is a 503, but not an error
+	stats, err := shuttle.GetStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 0)
+
+	svcCfg := client.ServiceConfig{
+		Name:         "StatsClient",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"stats-client.test"},
+		Tags:         map[string]string{"team": "web"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "stats-client.test", s.backendServers[0].addr, 200, c)
+
+	stats, err = shuttle.GetStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 1)
+	stat, err := shuttle.GetServiceStats("StatsClient")
+	c.Assert(err, IsNil)
+	want, err := Registry.ServiceStats("StatsClient")
+	c.Assert(err, IsNil)
+
+	for _, got := range []client.ServiceStat{stats[0], *stat} {
+		c.Assert(got.Name, Equals, want.Name)
+		c.Assert(got.Tags, DeepEquals, want.Tags)
+		c.Assert(got.HTTPConns, Equals, want.HTTPConns)
+		c.Assert(got.VHostStats, DeepEquals, want.VHostStats)
+		c.Assert(got.VHostStats["stats-client.test"].Status2xx, Equals, int64(1))
+		c.Assert(got.Backends, HasLen, 1)
+		c.Assert(got.Backends[0].Name, Equals, "b0")
+		c.Assert(got.Backends[0].State, Equals, want.Backends[0].State)
+		c.Assert(got.Backends[0].DialTime, DeepEquals, want.Backends[0].DialTime)
+	}
+
+	// errors include the server's message
+	_, err = shuttle.GetServiceStats("NoStats")
+	apiErr, ok := err.(*client.APIError)
+	c.Assert(ok, Equals, true)
+	c.Assert(apiErr.NotFound(), Equals, true)
+	c.Assert(apiErr.Message, Matches, ErrNoService.Error()+".*")
+
+	// the context variants are limited by the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stats, err = shuttle.GetStatsContext(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 1)
+	cancel()
+	_, err = shuttle.GetServiceStatsContext(ctx, "StatsClient")
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+}
+
 // Set some global defaults, and check that a new service inherits them all
 func (s *HTTPSuite) TestGlobalDefaults(c *C) {
 	globalCfg := client.Config{
@@ -715,6 +1225,177 @@ func (s *HTTPSuite) TestHTTPSRedirect(c *C) {
 	c.Assert(resp.StatusCode, Equals, http.StatusOK)
 }
 
+// A virtual host's own HTTPS redirect setting wins over the service's and
+// the global one, exempt paths are never redirected, and both change
+// without restarting the router.
+func (s *HTTPSuite) TestVHostHTTPSRedirect(c *C) {
+	Registry.Lock()
+	Registry.cfg.HTTPSRedirect = true
+	Registry.Unlock()
+	defer func() {
+		Registry.Lock()
+		Registry.cfg.HTTPSRedirect = false
+		Registry.Unlock()
+	}()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostRedirect",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"secure.test", "legacy.test", "*.wild.test"},
+		VirtualHostHTTPSRedirect: map[string]bool{
+			"LEGACY.test.": false,
+		},
+		HTTPSRedirectExempt: []string{"/.well-known/acme-challenge/"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	svc := Registry.GetService("VHostRedirect")
+
+	httpClient := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(host, path string) int {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		req.Host = host
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the global setting is the default
+	c.Assert(get("secure.test", "/addr"), Equals, http.StatusMovedPermanently)
+	c.Assert(get("a.wild.test", "/addr"), Equals, http.StatusMovedPermanently)
+	c.Assert(get("legacy.test", "/addr"), Equals, http.StatusOK)
+	// the exempt path isn't redirected, and the backend doesn't serve it
+	c.Assert(get("secure.test", "/.well-known/acme-challenge/token"), Equals, http.StatusNotFound)
+	c.Assert(get("secure.test", "/.well-known/other"), Equals, http.StatusMovedPermanently)
+
+	cfg := svc.Config()
+	c.Assert(cfg.VirtualHostHTTPSRedirect, DeepEquals, map[string]bool{"LEGACY.test.": false})
+	c.Assert(cfg.HTTPSRedirectExempt, DeepEquals, []string{"/.well-known/acme-challenge/"})
+
+	// a wildcard vhost can be turned off, and the legacy host on
+	svcCfg.VirtualHostHTTPSRedirect = map[string]bool{
+		"*.wild.test": false,
+		"legacy.test": true,
+	}
+	svcCfg.HTTPSRedirectExempt = []string{}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(Registry.GetService("VHostRedirect"), Equals, svc)
+
+	c.Assert(get("a.wild.test", "/addr"), Equals, http.StatusOK)
+	c.Assert(get("legacy.test", "/addr"), Equals, http.StatusMovedPermanently)
+	c.Assert(get("secure.test", "/.well-known/acme-challenge/token"), Equals, http.StatusMovedPermanently)
+
+	svcCfg.HTTPSRedirectExempt = []string{"well-known"}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidHTTPSRedirect.Error()+".*")
+	svcCfg.HTTPSRedirectExempt = nil
+	svcCfg.VirtualHostHTTPSRedirect = map[string]bool{"legacy.test": true, "Legacy.Test": false}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidHTTPSRedirect.Error()+".*listed twice")
+}
+
+// Virtual hosts with their own certificates are served them by SNI, and
+// requests over TLS aren't redirected to HTTPS.
+func (s *HTTPSuite) TestSNICertificates(c *C) {
+	dir := c.MkDir()
+	oneCert, oneKey := testCertPEM(c, "sni1.test")
+	twoCert, twoKey := testCertPEM(c, "sni2.test")
+	c.Assert(ioutil.WriteFile(dir+"/sni2.pem", twoCert, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/sni2.key", twoKey, 0600), IsNil)
+
+	svcCfg := client.ServiceConfig{
+		Name:          "SNITest",
+		Addr:          "127.0.0.1:9000",
+		HTTPSRedirect: true,
+		VirtualHosts:  []string{"sni1.test", "sni2.test", "nocert.test"},
+		VirtualHostCerts: map[string]client.VirtualHostCert{
+			"SNI1.test": {CertPEM: string(oneCert), KeyPEM: string(oneKey)},
+			"sni2.test": {Cert: dir + "/sni2.pem", Key: dir + "/sni2.key"},
+		},
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.backendServers[0].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+
+	// Request host over TLS, verifying the certificate against roots if
+	// they're given, and return the response status and the certificate
+	// presented.
+	get := func(host string, roots []byte) (int, *x509.Certificate, error) {
+		tlsCfg := &tls.Config{ServerName: host, InsecureSkipVerify: roots == nil}
+		if roots != nil {
+			tlsCfg.RootCAs = x509.NewCertPool()
+			tlsCfg.RootCAs.AppendCertsFromPEM(roots)
+		}
+		conn, err := tls.Dial("tcp", s.httpsAddr, tlsCfg)
+		if err != nil {
+			return 0, nil, err
+		}
+		defer conn.Close()
+
+		req, _ := http.NewRequest("GET", "https://"+host+"/addr", nil)
+		c.Assert(req.Write(conn), IsNil)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode, conn.ConnectionState().PeerCertificates[0], nil
+	}
+
+	code, _, err := get("sni1.test", oneCert)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, http.StatusOK)
+	code, _, err = get("sni2.test", twoCert)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, http.StatusOK)
+
+	// a vhost without a certificate gets the router's default
+	code, cert, err := get("nocert.test", nil)
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(cert.Subject.CommonName, Not(Equals), "sni1.test")
+	c.Assert(cert.Subject.CommonName, Not(Equals), "sni2.test")
+
+	// or fails the handshake, if unknown names are rejected
+	c.Assert(Registry.UpdateConfig(client.Config{UnknownSNI: client.UnknownSNIReject}), IsNil)
+	_, _, err = get("nocert.test", nil)
+	c.Assert(err, NotNil)
+	_, _, err = get("sni1.test", oneCert)
+	c.Assert(err, IsNil)
+	c.Assert(Registry.UpdateConfig(client.Config{UnknownSNI: "sometimes"}), ErrorMatches, "invalid unknown_sni.*")
+
+	// replacing a certificate takes effect for the next handshake
+	newCert, newKey := testCertPEM(c, "sni1.test")
+	updateCfg := Registry.GetService(svcCfg.Name).Config()
+	updateCfg.VirtualHostCerts = map[string]client.VirtualHostCert{
+		"sni1.test": {CertPEM: string(newCert), KeyPEM: string(newKey)},
+	}
+	c.Assert(Registry.UpdateService(updateCfg), IsNil)
+	_, _, err = get("sni1.test", oneCert)
+	c.Assert(err, NotNil)
+	_, _, err = get("sni1.test", newCert)
+	c.Assert(err, IsNil)
+	// and one removed leaves the name unknown
+	_, _, err = get("sni2.test", twoCert)
+	c.Assert(err, NotNil)
+
+	// certificates must be for the service's own virtual hosts
+	updateCfg.VirtualHostCerts = map[string]client.VirtualHostCert{
+		"other.test": {CertPEM: string(newCert), KeyPEM: string(newKey)},
+	}
+	err = Registry.UpdateService(updateCfg)
+	c.Assert(errors.Is(err, ErrInvalidTLS), Equals, true)
+	_, _, err = get("sni1.test", newCert)
+	c.Assert(err, IsNil)
+}
+
 func (s *HTTPSuite) TestMaintenanceMode(c *C) {
 	mainServer := s.backendServers[0]
 	errServer := s.backendServers[1]
@@ -766,3 +1447,5510 @@ func (s *HTTPSuite) TestMaintenanceMode(c *C) {
 
 	checkHTTP("https://vhost1.test:"+s.httpsPort+"/addr", "vhost1.test", errServer.addr, 503, c)
 }
+
+// Readiness and maintenance mode both take a backend out of service, and the
+// most restrictive wins.
+func (s *HTTPSuite) TestBackendReadyMaintenance(c *C) {
+	srv := s.backendServers[0]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest1",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv.addr},
+		},
+		MaintenanceMode: true,
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 503, c)
+
+	ready := client.ReadyConfig{Ready: true}
+	if err := Registry.SetBackendReady("VHostTest1", "b0", ready, "test"); err != nil {
+		c.Fatal(err)
+	}
+
+	// a ready backend doesn't override maintenance mode
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 503, c)
+
+	svcCfg.MaintenanceMode = false
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", srv.addr, 200, c)
+
+	ready.Ready = false
+	if err := Registry.SetBackendReady("VHostTest1", "b0", ready, "test"); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 502, c)
+
+	// the readiness survives a service update
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", "", 502, c)
+}
+
+// A backend set down through the API is left out of the vhost's endpoints,
+// and stays down through a service update and a reload of the state config.
+func (s *HTTPSuite) TestBackendAdminState(c *C) {
+	srv0 := s.backendServers[0]
+	srv1 := s.backendServers[1]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "AdminState",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"admin-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv0.addr},
+			{Name: "b1", Addr: srv1.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	tmp, err := ioutil.TempFile("", "shuttle-state")
+	if err != nil {
+		c.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	configMutex.Lock()
+	defer func(state, def string) {
+		configMutex.Lock()
+		stateConfig, defaultConfig = state, def
+		configMutex.Unlock()
+	}(stateConfig, defaultConfig)
+	stateConfig, defaultConfig = tmp.Name(), ""
+	configMutex.Unlock()
+
+	setState := func(backend, state string) *http.Response {
+		req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/AdminState/"+backend+"/state",
+			strings.NewReader(`{"state": "`+state+`"}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := setState("b0", client.AdminStateDown)
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	var info BackendInfo
+	c.Assert(json.NewDecoder(resp.Body).Decode(&info), IsNil)
+	resp.Body.Close()
+	c.Assert(info.Stats.AdminState, Equals, client.AdminStateDown)
+	c.Assert(info.Stats.DownReason, Equals, DownAdmin)
+	c.Assert(info.Config.AdminState, Equals, client.AdminStateDown)
+
+	resp = setState("b0", "sideways")
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	resp = setState("b9", client.AdminStateDown)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	for i := 0; i < 4; i++ {
+		checkHTTP("http://"+s.httpAddr+"/addr", "admin-vhost", srv1.addr, 200, c)
+	}
+
+	// an update that doesn't set the state keeps it
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.GetService("AdminState").get("b0").AdminDown(), Equals, true)
+
+	// and so does reloading the saved config
+	writeStateConfig()
+	if err := Registry.RemoveService("AdminState"); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(loadConfig(), IsNil)
+	svc := Registry.GetService("AdminState")
+	c.Assert(svc, NotNil)
+	c.Assert(svc.get("b0").AdminDown(), Equals, true)
+	c.Assert(svc.get("b1").AdminDown(), Equals, false)
+	checkHTTP("http://"+s.httpAddr+"/addr", "admin-vhost", srv1.addr, 200, c)
+
+	resp = setState("b0", client.AdminStateUp)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(svc.get("b0").AdminDown(), Equals, false)
+}
+
+// Clearing the config stops every service, removes their vhosts, and saves
+// an empty state config.
+func (s *HTTPSuite) TestClearConfig(c *C) {
+	tmp, err := ioutil.TempFile("", "shuttle-state")
+	if err != nil {
+		c.Fatal(err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	configMutex.Lock()
+	defer func(state, def string) {
+		configMutex.Lock()
+		stateConfig, defaultConfig = state, def
+		configMutex.Unlock()
+	}(stateConfig, defaultConfig)
+	stateConfig, defaultConfig = tmp.Name(), ""
+	configMutex.Unlock()
+
+	addrs := []string{"127.0.0.1:9000", "127.0.0.1:9001"}
+	for i, name := range []string{"Clear-B", "Clear-A"} {
+		svcCfg := client.ServiceConfig{
+			Name:         name,
+			Addr:         addrs[i],
+			VirtualHosts: []string{strings.ToLower(name) + ".test"},
+			Backends: []client.BackendConfig{
+				{Name: "b0", Addr: s.backendServers[0].addr},
+			},
+		}
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+	writeStateConfig()
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	removed, err := shuttle.ClearConfig()
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{"Clear-A", "Clear-B"})
+
+	c.Assert(Registry.Config().Services, HasLen, 0)
+	c.Assert(Registry.VHostsLen(), Equals, 0)
+	for _, addr := range addrs {
+		_, err := net.Dial("tcp", addr)
+		c.Assert(err, NotNil)
+	}
+	c.Assert(Registry.GetVHostService("clear-a.test"), IsNil)
+
+	var saved client.Config
+	js, err := ioutil.ReadFile(tmp.Name())
+	c.Assert(err, IsNil)
+	c.Assert(json.Unmarshal(js, &saved), IsNil)
+	c.Assert(saved.Services, HasLen, 0)
+
+	removed, err = shuttle.ClearConfig()
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+
+	// a service added while clearing is either removed, or left running
+	// in the registry, but never left listening without being registered
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			cfg := client.Config{Services: []client.ServiceConfig{{
+				Name:     "Clear-Race",
+				Addr:     addrs[0],
+				Backends: []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}},
+			}}}
+			Registry.UpdateConfig(cfg)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		_, err := shuttle.ClearConfig()
+		c.Assert(err, IsNil)
+	}
+	wg.Wait()
+
+	if Registry.GetService("Clear-Race") == nil {
+		_, err := net.Dial("tcp", addrs[0])
+		c.Assert(err, NotNil)
+	}
+}
+
+// The metrics are the same stats as the JSON API, in the Prometheus text
+// format.
+func (s *HTTPSuite) TestMetrics(c *C) {
+	srv0 := s.backendServers[0]
+	srv1 := s.backendServers[1]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "Metrics",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"metrics-vhost"},
+		Tags:         map[string]string{"team": "payments", "cost.center": "eu-1"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv0.addr, Tags: map[string]string{"team": "edge", "rack": "r1"}},
+			{Name: "b1", Addr: srv1.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "metrics-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	}
+	c.Assert(Registry.SetBackendAdminState("Metrics", "b1", client.AdminStateDown), IsNil)
+
+	resp, err := http.Get(s.httpSvr.URL + "/_metrics")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), Matches, "text/plain; version=0.0.4.*")
+
+	parser := expfmt.NewTextParser(model.UTF8Validation)
+	families, err := parser.TextToMetricFamilies(resp.Body)
+	c.Assert(err, IsNil)
+
+	stats := Registry.GetService("Metrics").Stats()
+
+	// the value of a metric with the given labels, ignoring its tags
+	value := func(name string, kind dto.MetricType, labels map[string]string) float64 {
+		family := families[name]
+		c.Assert(family, NotNil, Commentf(name))
+		c.Assert(family.GetType(), Equals, kind, Commentf(name))
+	next:
+		for _, m := range family.Metric {
+			for _, l := range m.Label {
+				if !strings.HasPrefix(l.GetName(), "tag_") && labels[l.GetName()] != l.GetValue() {
+					continue next
+				}
+			}
+			switch kind {
+			case dto.MetricType_COUNTER:
+				return m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				return m.GetGauge().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+		c.Fatalf("no %s for %v", name, labels)
+		return 0
+	}
+
+	svc := map[string]string{"service": "Metrics"}
+	c.Assert(value("shuttle_service_http_connections_total", dto.MetricType_COUNTER, svc), Equals, float64(4))
+	c.Assert(value("shuttle_service_http_connections_total", dto.MetricType_COUNTER, svc), Equals, float64(stats.HTTPConns))
+	c.Assert(value("shuttle_service_sent_bytes_total", dto.MetricType_COUNTER, svc), Equals, float64(stats.Sent))
+	c.Assert(value("shuttle_service_received_bytes_total", dto.MetricType_COUNTER, svc), Equals, float64(stats.Rcvd))
+	c.Assert(value("shuttle_service_http_errors_total", dto.MetricType_COUNTER, svc), Equals, float64(0))
+	c.Assert(value("shuttle_service_http_active", dto.MetricType_GAUGE, svc), Equals, float64(stats.HTTPActive))
+	c.Assert(value("shuttle_service_active_connections", dto.MetricType_GAUGE, svc), Equals, float64(0))
+
+	var conns float64
+	for _, b := range stats.Backends {
+		labels := map[string]string{"service": "Metrics", "backend": b.Name}
+		c.Assert(value("shuttle_backend_sent_bytes_total", dto.MetricType_COUNTER, labels), Equals, float64(b.Sent))
+		c.Assert(value("shuttle_backend_received_bytes_total", dto.MetricType_COUNTER, labels), Equals, float64(b.Rcvd))
+		c.Assert(value("shuttle_backend_http_active", dto.MetricType_GAUGE, labels), Equals, float64(b.HTTPActive))
+		c.Assert(value("shuttle_backend_dial_seconds", dto.MetricType_HISTOGRAM, labels), Equals, float64(b.DialTime.Count))
+		if b.DialLatency != nil {
+			c.Assert(value("shuttle_backend_dial_latency_max_seconds", dto.MetricType_GAUGE, labels), Equals, b.DialLatency.Max/1000)
+		}
+		conns += value("shuttle_backend_connections_total", dto.MetricType_COUNTER, labels)
+	}
+	c.Assert(conns > 0, Equals, true)
+	c.Assert(value("shuttle_backend_up", dto.MetricType_GAUGE, map[string]string{"service": "Metrics", "backend": "b0"}), Equals, float64(1))
+	c.Assert(value("shuttle_backend_up", dto.MetricType_GAUGE, map[string]string{"service": "Metrics", "backend": "b1"}), Equals, float64(0))
+
+	// the labels of every metric of a family
+	labels := func(name string) []map[string]string {
+		all := []map[string]string{}
+		for _, m := range families[name].Metric {
+			labels := map[string]string{}
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			all = append(all, labels)
+		}
+		return all
+	}
+
+	c.Assert(labels("shuttle_service_sent_bytes_total"), DeepEquals, []map[string]string{
+		{"service": "Metrics", "tag_team": "payments", "tag_cost_center": "eu-1"},
+	})
+	c.Assert(labels("shuttle_backend_up"), DeepEquals, []map[string]string{
+		{"service": "Metrics", "backend": "b0", "tag_team": "edge", "tag_cost_center": "eu-1", "tag_rack": "r1"},
+		{"service": "Metrics", "backend": "b1", "tag_team": "payments", "tag_cost_center": "eu-1"},
+	})
+}
+
+func (s *HTTPSuite) TestVersion(c *C) {
+	getVersion := func() VersionInfo {
+		resp, err := http.Get(s.httpSvr.URL + "/_version")
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		var info VersionInfo
+		c.Assert(json.NewDecoder(resp.Body).Decode(&info), IsNil)
+		return info
+	}
+
+	info := getVersion()
+	c.Assert(info.Version, Equals, buildVersion)
+	c.Assert(info.GoVersion, Equals, runtime.Version())
+	c.Assert(info.Goroutines > 0, Equals, true)
+	c.Assert(info.Uptime >= 0, Equals, true)
+	c.Assert(info.ConfigHash, Equals, configHash(Registry.Config()))
+
+	svcCfg := client.ServiceConfig{
+		Name: "Version",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+			{Name: "b1", Addr: s.backendServers[1].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	changed := getVersion()
+	c.Assert(changed.ConfigHash, Not(Equals), info.ConfigHash)
+
+	// the stats carry the same hash
+	resp, err := http.Get(s.httpSvr.URL + "/_stats")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.Header.Get("X-Shuttle-Config-Hash"), Equals, changed.ConfigHash)
+	c.Assert(resp.Header.Get("X-Shuttle-Uptime"), Not(Equals), "")
+}
+
+// A config request with wait=true is answered once the config's hash
+// differs from the client's, and WatchConfig sends each new config once.
+func (s *HTTPSuite) TestWatchConfig(c *C) {
+	get := func(query string) *http.Response {
+		resp, err := http.Get(s.httpSvr.URL + "/_config?" + query)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	hash := configHash(Registry.Config())
+	resp := get("")
+	c.Assert(resp.Header.Get(client.ConfigHashHeader), Equals, hash)
+
+	resp = get("wait=true&timeout=50&hash=" + hash)
+	c.Assert(resp.StatusCode, Equals, http.StatusNotModified)
+	c.Assert(resp.Header.Get(client.ConfigHashHeader), Equals, hash)
+
+	resp = get("wait=true&timeout=5000&hash=stale")
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get(client.ConfigHashHeader), Equals, hash)
+
+	resp = get("wait=true&timeout=soon&hash=" + hash)
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	configs, err := shuttle.WatchConfig(ctx)
+	c.Assert(err, IsNil)
+
+	svcCfg := client.ServiceConfig{
+		Name: "Watched",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	c.Assert(shuttle.UpdateService(&svcCfg), IsNil)
+
+	select {
+	case cfg := <-configs:
+		c.Assert(len(cfg.Services), Equals, len(Registry.Config().Services))
+		found := false
+		for _, svc := range cfg.Services {
+			found = found || svc.Name == "Watched"
+		}
+		c.Assert(found, Equals, true)
+	case <-time.After(5 * time.Second):
+		c.Fatal("no config after the update")
+	}
+
+	select {
+	case <-configs:
+		c.Fatal("config sent without a change")
+	case <-time.After(2 * configWaitInterval):
+	}
+
+	cancel()
+	select {
+	case _, ok := <-configs:
+		c.Assert(ok, Equals, false)
+	case <-time.After(5 * time.Second):
+		c.Fatal("watch didn't stop")
+	}
+}
+
+// Requests are counted for the virtual host they were sent to.
+func (s *HTTPSuite) TestVHostStats(c *C) {
+	srv := s.backendServers[0]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostStats",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"vhost-a.test", "vhost-b.test"},
+		Redirects: []client.RedirectConfig{
+			{Host: "vhost-b.test", PathPrefix: "/old", Target: "https://vhost-b.test/new"},
+		},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	do := func(method, host, path, body string) int {
+		req, _ := http.NewRequest(method, "http://"+s.httpAddr+path, strings.NewReader(body))
+		req.Host = host
+		if body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// names match regardless of case and port
+	c.Assert(do("GET", "vhost-a.test", "/addr", ""), Equals, http.StatusOK)
+	c.Assert(do("GET", "VHOST-A.test:80", "/addr", ""), Equals, http.StatusOK)
+	c.Assert(do("POST", "vhost-a.test", "/error", "code=503"), Equals, http.StatusServiceUnavailable)
+	c.Assert(do("GET", "vhost-b.test", "/error?code=404", ""), Equals, http.StatusNotFound)
+	c.Assert(do("GET", "vhost-b.test", "/old", ""), Equals, http.StatusMovedPermanently)
+
+	stats := Registry.GetService("VHostStats").Stats()
+	c.Assert(stats.VHostStats, DeepEquals, map[string]VHostStat{
+		"vhost-a.test": {
+			Requests:  3,
+			Status2xx: 2,
+			Status5xx: 1,
+			Rcvd:      int64(len("code=503")),
+			Sent:      int64(3 * len(srv.addr)),
+		},
+		"vhost-b.test": {
+			Requests:  2,
+			Status3xx: 1,
+			Status4xx: 1,
+			Sent:      int64(len(srv.addr)),
+		},
+	})
+
+	// the stats of a vhost still in use are kept when the vhosts change
+	svcCfg.VirtualHosts = []string{"vhost-a.test", "vhost-c.test"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	var all []ServiceStat
+	resp, err := http.Get(s.httpSvr.URL + "/_stats")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+	c.Assert(json.NewDecoder(resp.Body).Decode(&all), IsNil)
+	c.Assert(all, HasLen, 1)
+	c.Assert(all[0].VHostStats, HasLen, 2)
+	c.Assert(all[0].VHostStats["vhost-a.test"], DeepEquals, stats.VHostStats["vhost-a.test"])
+	c.Assert(all[0].VHostStats["vhost-c.test"], DeepEquals, VHostStat{})
+}
+
+// Least connections balancing weighs backends by their HTTP connections, so
+// new requests avoid a backend tied up with slow ones.
+func (s *HTTPSuite) TestLeastConnHTTP(c *C) {
+	fast := s.backendServers[0]
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+	slowAddr := slow.Listener.Addr().String()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "LeastConnHTTP",
+		Addr:         "127.0.0.1:9000",
+		Balance:      client.LeastConn,
+		VirtualHosts: []string{"lc.test"},
+		Backends: []client.BackendConfig{
+			{Name: "slow", Addr: slowAddr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("LeastConnHTTP")
+
+	get := func(client *http.Client) (string, error) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "lc.test"
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// tie up the slow backend with concurrent requests
+	const slowRequests = 4
+	var wg sync.WaitGroup
+	for i := 0; i < slowRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := get(&http.Client{Transport: &http.Transport{}})
+			c.Check(err, IsNil)
+			c.Check(body, Equals, "slow")
+		}()
+	}
+	defer func() {
+		close(release)
+		wg.Wait()
+	}()
+
+	for i := 0; svc.get("slow").activeConns() < slowRequests; i++ {
+		if i > 200 {
+			c.Fatal("slow requests didn't connect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := Registry.AddBackend("LeastConnHTTP", client.BackendConfig{Name: "fast", Addr: fast.addr}); err != nil {
+		c.Fatal(err)
+	}
+
+	// new requests, one after the other or at once, go to the other backend
+	timeout := &http.Client{Timeout: 2 * time.Second}
+	for i := 0; i < 4; i++ {
+		body, err := get(timeout)
+		c.Assert(err, IsNil)
+		c.Assert(body, Equals, fast.addr)
+	}
+
+	var fastWG sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		fastWG.Add(1)
+		go func() {
+			defer fastWG.Done()
+			body, err := get(timeout)
+			c.Check(err, IsNil)
+			c.Check(body, Equals, fast.addr)
+		}()
+	}
+	fastWG.Wait()
+
+	stats := svc.Stats()
+	for _, b := range stats.Backends {
+		if b.Name == "slow" {
+			c.Assert(b.HTTPActive, Equals, int64(slowRequests))
+		}
+	}
+}
+
+// A backend at its connection limit is skipped, and once every backend is,
+// requests are queued until one has room, or turned away.
+func (s *HTTPSuite) TestBackendMaxConns(c *C) {
+	// each backend answers with its name once a release is sent for it
+	release := map[string]chan struct{}{
+		"b0": make(chan struct{}, 2),
+		"b1": make(chan struct{}, 2),
+	}
+	svcCfg := client.ServiceConfig{
+		Name:              "MaxConns",
+		Addr:              "127.0.0.1:9000",
+		VirtualHosts:      []string{"maxconns.test"},
+		BackendFullAction: client.BackendFullQueue,
+		QueueTimeout:      5000,
+	}
+	for _, name := range []string{"b0", "b1"} {
+		ch := release[name]
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-ch
+			io.WriteString(w, name)
+		}))
+		defer srv.Close()
+		svcCfg.Backends = append(svcCfg.Backends, client.BackendConfig{
+			Name:     name,
+			Addr:     srv.Listener.Addr().String(),
+			MaxConns: 1,
+		})
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("MaxConns")
+
+	type result struct {
+		status int
+		body   string
+	}
+	get := func(results chan result) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/", nil)
+		req.Host = "maxconns.test"
+		resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+		if err != nil {
+			c.Error(err)
+			results <- result{}
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		results <- result{resp.StatusCode, string(body)}
+	}
+	waitFor := func(what string, cond func() bool) {
+		for i := 0; !cond(); i++ {
+			if i > 200 {
+				c.Fatal(what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	inUse := func() bool {
+		return atomic.LoadInt64(&svc.get("b0").inUse) == 1 && atomic.LoadInt64(&svc.get("b1").inUse) == 1
+	}
+
+	// fill both backends, then a third request queues
+	results := make(chan result, 3)
+	go get(results)
+	go get(results)
+	waitFor("backends didn't fill", inUse)
+
+	go get(results)
+	waitFor("request wasn't queued", func() bool {
+		return atomic.LoadInt64(&svc.get("b0").LimitQueued) == 1
+	})
+	select {
+	case r := <-results:
+		c.Fatalf("request finished while the backends were full: %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// once b0 finishes one, the queued request takes its place
+	release["b0"] <- struct{}{}
+	release["b0"] <- struct{}{}
+	c.Assert(<-results, Equals, result{200, "b0"})
+	c.Assert(<-results, Equals, result{200, "b0"})
+	release["b1"] <- struct{}{}
+	c.Assert(<-results, Equals, result{200, "b1"})
+
+	for _, b := range svc.Stats().Backends {
+		c.Assert(b.MaxConns, Equals, int64(1))
+		c.Assert(b.LimitQueued, Equals, int64(1))
+		c.Assert(b.LimitRejected, Equals, int64(0))
+	}
+
+	// failing fast answers with a 503 while both are full
+	svcCfg.BackendFullAction = client.BackendFullFail
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	go get(results)
+	go get(results)
+	waitFor("backends didn't fill", inUse)
+
+	get(results)
+	c.Assert((<-results).status, Equals, http.StatusServiceUnavailable)
+	release["b0"] <- struct{}{}
+	release["b1"] <- struct{}{}
+	<-results
+	<-results
+
+	stats := svc.Stats()
+	c.Assert(stats.LocalResponses[reasonBackendsFull], Equals, int64(1))
+	for _, b := range stats.Backends {
+		c.Assert(b.LimitRejected, Equals, int64(1))
+	}
+	c.Assert(svc.Config().Backends[0].MaxConns, Equals, 1)
+
+	err := Registry.AddBackend("MaxConns", client.BackendConfig{Name: "b2", Addr: "127.0.0.1:9999", MaxConns: -1})
+	c.Assert(err, ErrorMatches, ErrInvalidBackendLimit.Error()+".*")
+	svcCfg.BackendFullAction = "wait"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidBackendLimit.Error()+".*")
+}
+
+// The retry policy decides which requests are tried on another backend when
+// the first refuses the connection.
+func (s *HTTPSuite) TestRetryPolicy(c *C) {
+	good := s.backendServers[0]
+	errServer := s.backendServers[1]
+
+	refusing := func() string {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.Fatal(err)
+		}
+		l.Close()
+		return l.Addr().String()
+	}
+
+	// least connections keeps the refusing backends first, since they never
+	// have a connection open
+	svcCfg := client.ServiceConfig{
+		Name:         "RetryPolicy",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"retry.test"},
+		Balance:      client.LeastConn,
+		RetryPolicy:  client.RetryIdempotent,
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error?code=502": {502},
+		},
+		Backends: []client.BackendConfig{
+			{Name: "refuse", Addr: refusing()},
+			{Name: "good", Addr: good.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("RetryPolicy")
+	for i := 0; len(svc.errorPages.Get(502).Body()) == 0; i++ {
+		if i > 100 {
+			c.Fatal("error page wasn't fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	do := func(method string) (int, string) {
+		req, _ := http.NewRequest(method, "http://"+s.httpAddr+"/addr", strings.NewReader("x=1"))
+		req.Host = "retry.test"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// idempotent requests are retried, others get the error page
+	code, body := do("GET")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, good.addr)
+	code, body = do("PUT")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, good.addr)
+	code, body = do("POST")
+	c.Assert(code, Equals, http.StatusBadGateway)
+	c.Assert(body, Equals, errServer.addr)
+
+	svcCfg.RetryPolicy = client.RetryNever
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	code, _ = do("GET")
+	c.Assert(code, Equals, http.StatusBadGateway)
+
+	svcCfg.RetryPolicy = client.RetryAlways
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	code, body = do("POST")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, good.addr)
+
+	// the retry count limits the backends tried after the first
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "refuse", Addr: svcCfg.Backends[0].Addr},
+		{Name: "refuse2", Addr: refusing()},
+		{Name: "good", Addr: good.addr},
+	}
+	svcCfg.RetryCount = 1
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	code, _ = do("GET")
+	c.Assert(code, Equals, http.StatusBadGateway)
+
+	svcCfg.RetryCount = 2
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	code, body = do("GET")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, good.addr)
+
+	cfg := svc.Config()
+	c.Assert(cfg.RetryPolicy, Equals, client.RetryAlways)
+	c.Assert(cfg.RetryCount, Equals, 2)
+
+	svcCfg.RetryPolicy = "sometimes"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, "invalid retry policy.*")
+	svcCfg.RetryPolicy = client.RetryNever
+	svcCfg.RetryCount = -1
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, "invalid retry policy.*")
+}
+
+// Requests over a client's rate are answered with the 429 error page, and
+// the limit can be lifted without restarting the service.
+func (s *HTTPSuite) TestRateLimit(c *C) {
+	okServer := s.backendServers[0]
+	errServer := s.backendServers[1]
+
+	svcCfg := client.ServiceConfig{
+		Name:              "RateLimit",
+		Addr:              "127.0.0.1:9000",
+		VirtualHosts:      []string{"limit.test"},
+		MaxConnsPerClient: 2,
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error?code=429": {429},
+		},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: okServer.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("RateLimit")
+	for i := 0; len(svc.errorPages.Get(429).Body()) == 0; i++ {
+		if i > 100 {
+			c.Fatal("error page wasn't fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "limit.test", okServer.addr, 200, c)
+	checkHTTP("http://"+s.httpAddr+"/addr", "limit.test", okServer.addr, 200, c)
+	checkHTTP("http://"+s.httpAddr+"/addr", "limit.test", errServer.addr, 429, c)
+
+	stats := svc.Stats()
+	c.Assert(stats.RateLimited, Equals, int64(1))
+	c.Assert(stats.LocalResponses[reasonRateLimited], Equals, int64(1))
+	c.Assert(stats.VHostStats["limit.test"].Status4xx, Equals, int64(1))
+	c.Assert(svc.Config().MaxConnsPerClient, Equals, 2)
+
+	svcCfg.MaxConnsPerClient = 0
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.GetService("RateLimit"), Equals, svc)
+	checkHTTP("http://"+s.httpAddr+"/addr", "limit.test", okServer.addr, 200, c)
+
+	svcCfg.MaxConnsPerSecond = -1
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidRateLimit.Error()+".*")
+}
+
+// Clients are refused by the service's allow and deny lists, checked by
+// their X-Forwarded-For address only where the forwarding headers are
+// trusted, and the lists are replaced without restarting the service.
+func (s *HTTPSuite) TestClientACL(c *C) {
+	srv := s.backendServers[0]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "ACL",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"acl.test"},
+		DeniedCIDRs:  []string{"127.0.0.1"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("ACL")
+
+	get := func(forwarded string) int {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "acl.test"
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	c.Assert(get(""), Equals, http.StatusForbidden)
+	stats := svc.Stats()
+	c.Assert(stats.ClientDenied, Equals, int64(1))
+	c.Assert(stats.LocalResponses[reasonClientDenied], Equals, int64(1))
+
+	// deny wins over allow
+	svcCfg.AllowedCIDRs = []string{"127.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(get(""), Equals, http.StatusForbidden)
+
+	svcCfg.DeniedCIDRs = []string{}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.GetService("ACL"), Equals, svc)
+	c.Assert(get(""), Equals, http.StatusOK)
+
+	// a forwarded client from a peer outside TrustedNetworks can't get
+	// around the lists
+	svcCfg.AllowedCIDRs = []string{"10.0.0.0/8"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(get("10.1.2.3"), Equals, http.StatusForbidden)
+
+	// the forwarded client is checked when the peer is trusted, skipping the
+	// proxies from TrustedNetworks
+	svcCfg.TrustedNetworks = []string{"127.0.0.1"}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(get("10.1.2.3"), Equals, http.StatusOK)
+	c.Assert(get("10.1.2.3, 127.0.0.1"), Equals, http.StatusOK)
+	c.Assert(get("10.1.2.3, 192.168.1.1"), Equals, http.StatusForbidden)
+	c.Assert(get(""), Equals, http.StatusForbidden)
+
+	// and ignored when they're stripped from untrusted clients
+	svcCfg.TrustedNetworks = []string{}
+	svcCfg.ForwardedHeaders = client.ForwardedStrip
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(get("10.1.2.3"), Equals, http.StatusForbidden)
+
+	cfg := svc.Config()
+	c.Assert(cfg.AllowedCIDRs, DeepEquals, []string{"10.0.0.0/8"})
+	c.Assert(cfg.DeniedCIDRs, DeepEquals, []string{})
+
+	svcCfg.DeniedCIDRs = []string{"10.0.0.0/33"}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, `invalid client network: "10.0.0.0/33"`)
+	c.Assert(svc.Config().DeniedCIDRs, DeepEquals, []string{})
+
+	req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/ACL", strings.NewReader(`{"allowed_cidrs": ["not-an-ip"]}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(svc.Config().AllowedCIDRs, DeepEquals, []string{"10.0.0.0/8"})
+}
+
+// A sticky cookie keeps a client on the backend that first answered it, for
+// as long as that backend can be used.
+func (s *HTTPSuite) TestStickyCookie(c *C) {
+	srv0 := s.backendServers[0]
+	srv1 := s.backendServers[1]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "Sticky",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"sticky.test"},
+		StickyCookie: "SRV",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv0.addr},
+			{Name: "b1", Addr: srv1.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	ids := map[string]string{
+		srv0.addr: stickyID("b0"),
+		srv1.addr: stickyID("b1"),
+	}
+
+	// the backend that answered, and the sticky cookie set, if any
+	get := func(cookie string) (string, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "sticky.test"
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "SRV", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+		set := ""
+		for _, ck := range resp.Cookies() {
+			if ck.Name == "SRV" {
+				set = ck.Value
+			}
+		}
+		return string(body), set
+	}
+
+	first, cookie := get("")
+	c.Assert(cookie, Equals, ids[first])
+	c.Assert(strings.Contains(cookie, first), Equals, false)
+
+	// round robin would alternate, but the cookie holds the backend
+	for i := 0; i < 4; i++ {
+		addr, set := get(cookie)
+		c.Assert(addr, Equals, first)
+		c.Assert(set, Equals, "")
+	}
+
+	// a cookie for no backend is balanced, and replaced
+	addr, set := get("unknown")
+	c.Assert(set, Equals, ids[addr])
+
+	// while the backend is down the client moves, and stays moved
+	firstName, otherName, other := "b0", "b1", srv1.addr
+	if first == srv1.addr {
+		firstName, otherName, other = "b1", "b0", srv0.addr
+	}
+	c.Assert(Registry.SetBackendAdminState("Sticky", firstName, client.AdminStateDown), IsNil)
+	addr, set = get(cookie)
+	c.Assert(addr, Equals, other)
+	c.Assert(set, Equals, ids[other])
+	cookie = set
+	c.Assert(Registry.SetBackendAdminState("Sticky", firstName, client.AdminStateUp), IsNil)
+	addr, set = get(cookie)
+	c.Assert(addr, Equals, other)
+	c.Assert(set, Equals, "")
+
+	// removing the backend rebalances its clients
+	c.Assert(Registry.RemoveBackend("Sticky", otherName), IsNil)
+	addr, set = get(cookie)
+	c.Assert(addr, Equals, first)
+	c.Assert(set, Equals, ids[first])
+
+	c.Assert(Registry.GetService("Sticky").Config().StickyCookie, Equals, "SRV")
+
+	svcCfg.StickyCookie = "bad name"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, "invalid sticky cookie.*")
+}
+
+// WebSocket handshakes are passed to the backend, and the upgraded
+// connection is relayed until either side closes it.
+func (s *HTTPSuite) TestWebSocket(c *C) {
+	// the backend switches to echoing each line back
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refuse" || r.Header.Get("Upgrade") != "websocket" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		buf.Flush()
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString(line)
+			buf.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "WebSocket",
+		Addr:          "127.0.0.1:9000",
+		VirtualHosts:  []string{"ws.test"},
+		ClientTimeout: 300,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: backend.Listener.Addr().String()},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("WebSocket")
+	b0 := svc.get("b0")
+
+	// send the handshake through the router, and read the response
+	dial := func(path string) (*net.TCPConn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", s.httpAddr)
+		c.Assert(err, IsNil)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: ws.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", path)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		c.Assert(err, IsNil)
+		conn.SetDeadline(time.Time{})
+		return conn.(*net.TCPConn), r, resp
+	}
+
+	conn, r, resp := dial("/echo")
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	c.Assert(resp.Header.Get("X-Backend"), Equals, b0.Addr)
+
+	for _, msg := range []string{"hello\n", "world\n"} {
+		_, err := io.WriteString(conn, msg)
+		c.Assert(err, IsNil)
+		echo, err := r.ReadString('\n')
+		c.Assert(err, IsNil)
+		c.Assert(echo, Equals, msg)
+	}
+	c.Assert(atomic.LoadInt64(&b0.HTTPActive), Equals, int64(1))
+
+	// the backend's close is relayed through the proxy
+	c.Assert(conn.CloseWrite(), IsNil)
+	_, err := r.ReadString('\n')
+	c.Assert(err, Equals, io.EOF)
+	conn.Close()
+
+	for i := 0; atomic.LoadInt64(&b0.HTTPActive) > 0; i++ {
+		if i > 100 {
+			c.Fatal("backend connection wasn't closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := svc.Stats()
+	c.Assert(stats.Backends[0].Sent > int64(len("hello\nworld\n")), Equals, true)
+	c.Assert(stats.Backends[0].Rcvd > int64(len("hello\nworld\n")), Equals, true)
+	c.Assert(stats.Sent, Equals, stats.Backends[0].Sent)
+
+	// an idle client is closed after the client timeout
+	conn, r, resp = dial("/echo")
+	defer conn.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusSwitchingProtocols)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = r.ReadString('\n')
+	c.Assert(err, NotNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true, Commentf("%v", err))
+
+	// a backend that doesn't switch protocols answers as usual
+	refused, _, resp := dial("/refuse")
+	defer refused.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *HTTPSuite) TestDirectiveSignature(c *C) {
+	d := client.Directive{
+		ID:      "test",
+		Expires: time.Now().Add(time.Minute).Unix(),
+		Backend: "b1",
+	}
+
+	token, err := client.SignDirective("secret", d)
+	c.Assert(err, IsNil)
+
+	// any of the secrets will validate the token
+	verified, err := client.VerifyDirective([]string{"new", "secret"}, token, time.Now())
+	c.Assert(err, IsNil)
+	c.Assert(*verified, Equals, d)
+
+	_, err = client.VerifyDirective([]string{"other"}, token, time.Now())
+	c.Assert(err, Equals, client.ErrDirectiveSignature)
+
+	_, err = client.VerifyDirective(nil, token, time.Now())
+	c.Assert(err, Equals, client.ErrDirectiveSignature)
+
+	// changing the payload breaks the signature
+	other, _ := client.SignDirective("secret", client.Directive{ID: "other", Expires: d.Expires})
+	tampered := strings.Split(other, ".")[0] + "." + strings.Split(token, ".")[1]
+	_, err = client.VerifyDirective([]string{"secret"}, tampered, time.Now())
+	c.Assert(err, Equals, client.ErrDirectiveSignature)
+
+	_, err = client.VerifyDirective([]string{"secret"}, "garbage", time.Now())
+	c.Assert(err, Equals, client.ErrDirectiveFormat)
+
+	_, err = client.VerifyDirective([]string{"secret"}, token, time.Now().Add(2*time.Minute))
+	c.Assert(err, Equals, client.ErrDirectiveExpired)
+
+	_, err = client.SignDirective("secret", client.Directive{ID: "forever"})
+	c.Assert(err, NotNil)
+}
+
+// make a request through the http router with a directive token
+func directiveGet(c *C, addr, path, token string) (int, string) {
+	req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	req.Host = "test-vhost"
+	req.Header.Set("X-Request-Id", "foo")
+	if token != "" {
+		req.Header.Set(client.DirectiveHeader, token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (s *HTTPSuite) TestDirectives(c *C) {
+	b0 := s.backendServers[0]
+	b1 := s.backendServers[1]
+	errServer := s.backendServers[2]
+
+	svcCfg := client.ServiceConfig{
+		Name:         "VHostTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: b0.addr},
+			{Name: "b1", Addr: b1.addr},
+		},
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error?code=400": []int{400},
+		},
+		DirectiveSecrets: []string{"secret"},
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	logged := captureLogs()
+	defer logged.stop()
+
+	expires := time.Now().Add(time.Minute).Unix()
+	sign := func(d client.Directive) string {
+		token, err := client.SignDirective("secret", d)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return token
+	}
+
+	// force the backend
+	token := sign(client.Directive{ID: "force", Expires: expires, Backend: "b1"})
+	for i := 0; i < 4; i++ {
+		_, body := directiveGet(c, s.httpAddr, "/addr", token)
+		c.Assert(body, Equals, b1.addr)
+	}
+	c.Assert(strings.Contains(logged.String(), "directive=force"), Equals, true)
+
+	// unsigned, badly signed, expired, or for another service are all ignored
+	bad, _ := client.SignDirective("wrong", client.Directive{ID: "bad", Expires: expires, Backend: "b1"})
+	tokens := []string{
+		strings.Split(token, ".")[0],
+		bad,
+		sign(client.Directive{ID: "expired", Expires: time.Now().Add(-time.Second).Unix(), Backend: "b1"}),
+		sign(client.Directive{ID: "other", Service: "other", Expires: expires, Backend: "b1"}),
+	}
+	seen := make(map[string]bool)
+	for _, t := range tokens {
+		_, body := directiveGet(c, s.httpAddr, "/addr", t)
+		seen[body] = true
+	}
+	c.Assert(seen[b0.addr], Equals, true)
+	c.Assert(strings.Contains(logged.String(), "directive=bad"), Equals, false)
+	c.Assert(strings.Contains(logged.String(), "directive=expired"), Equals, false)
+
+	stats, err := Registry.ServiceStats("VHostTest")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(stats.Directives, Equals, int64(4))
+	c.Assert(stats.DirectiveErrors, Equals, int64(4))
+
+	// the token is never passed on, and an unsigned request gets no overrides
+	_, body := directiveGet(c, s.httpAddr, "/headers", "")
+	headers := http.Header{}
+	c.Assert(json.Unmarshal([]byte(body), &headers), IsNil)
+	c.Assert(headers.Get("X-Shuttle-Trace"), Equals, "")
+	c.Assert(headers.Get("Cache-Control"), Equals, "")
+
+	// trace and cache bypass are sent to the backend
+	token = sign(client.Directive{ID: "trace", Expires: expires, Trace: true, NoCache: true})
+	_, body = directiveGet(c, s.httpAddr, "/headers", token)
+	headers = http.Header{}
+	c.Assert(json.Unmarshal([]byte(body), &headers), IsNil)
+	c.Assert(headers.Get(client.DirectiveHeader), Equals, "")
+	c.Assert(headers.Get("X-Shuttle-Trace"), Equals, "trace")
+	c.Assert(headers.Get("Cache-Control"), Equals, "no-cache")
+
+	// the cached error page is bypassed
+	token = sign(client.Directive{ID: "nocache", Expires: expires, NoCache: true, Backend: "b0"})
+	status, body := directiveGet(c, s.httpAddr, "/error", token)
+	c.Assert(status, Equals, 400)
+	c.Assert(body, Equals, b0.addr)
+
+	status, body = directiveGet(c, s.httpAddr, "/error", "")
+	c.Assert(status, Equals, 400)
+	c.Assert(body, Equals, errServer.addr)
+
+	// full logging includes the headers
+	c.Assert(strings.Contains(logged.String(), "request-headers"), Equals, false)
+	token = sign(client.Directive{ID: "full", Expires: expires, FullLog: true})
+	directiveGet(c, s.httpAddr, "/addr", token)
+	c.Assert(strings.Contains(logged.String(), "directive=full request-headers"), Equals, true)
+	c.Assert(strings.Contains(logged.String(), "directive=full response-headers"), Equals, true)
+
+	// the secrets aren't served by the API, but a config read from it can be
+	// applied again without losing them
+	for _, path := range []string{"/_config", "/VHostTest/_config"} {
+		resp, err := http.Get(s.httpSvr.URL + path)
+		c.Assert(err, IsNil)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(strings.Contains(string(body), `"secret"`), Equals, false, Commentf("%s", path))
+		c.Assert(strings.Contains(string(body), redactedSecret), Equals, true, Commentf("%s", path))
+	}
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	cfg, err := shuttle.GetConfig()
+	c.Assert(err, IsNil)
+	c.Assert(shuttle.UpdateConfig(cfg), IsNil)
+	c.Assert(Registry.GetService("VHostTest").Config().DirectiveSecrets, DeepEquals, []string{"secret"})
+	token = sign(client.Directive{ID: "again", Expires: expires, Backend: "b1"})
+	_, body = directiveGet(c, s.httpAddr, "/addr", token)
+	c.Assert(body, Equals, b1.addr)
+}
+
+// The check source IPs and markers are published for firewall automation.
+func (s *HTTPSuite) TestCheckInfo(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:             "CheckInfoTest",
+		Addr:             "127.0.0.1:9000",
+		CheckSourcePorts: "40000-40099",
+		CheckPreamble:    "SHUTTLE-CHECK",
+		CheckUserAgent:   "shuttle-check",
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.servers[0].addr, CheckAddr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	svcCfg = client.ServiceConfig{
+		Name: "UnmarkedTest",
+		Addr: "127.0.0.1:9001",
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	resp, err := http.Get(s.httpSvr.URL + "/_checkinfo")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	var info CheckSources
+	body, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(body, &info); err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(info.SourceIPs, DeepEquals, []string{"127.0.0.1"})
+	c.Assert(info.Services, DeepEquals, []CheckInfo{
+		{
+			Service:     "CheckInfoTest",
+			SourceIPs:   []string{"127.0.0.1"},
+			SourcePorts: "40000-40099",
+			Preamble:    true,
+			UserAgent:   "shuttle-check",
+		},
+		{
+			Service:   "UnmarkedTest",
+			SourceIPs: []string{},
+		},
+	})
+
+	svcCfg = client.ServiceConfig{
+		Name:             "InvalidPorts",
+		Addr:             "127.0.0.1:9002",
+		CheckSourcePorts: "40000-70000",
+	}
+	c.Assert(Registry.AddService(svcCfg), Equals, ErrInvalidPortRange)
+}
+
+// tag the request and response with the name of the chain
+func chainCallbacks(name string) CallbackChain {
+	return CallbackChain{
+		OnRequest: []ProxyCallback{func(pr *ProxyRequest) bool {
+			pr.ResponseWriter.Header().Set("X-Chain-Request", name)
+			return true
+		}},
+		OnResponse: []ProxyCallback{func(pr *ProxyRequest) bool {
+			pr.ResponseWriter.Header().Set("X-Chain-Response", name)
+			return true
+		}},
+	}
+}
+
+func (s *HTTPSuite) addCallbackService(c *C) *Service {
+	svcCfg := client.ServiceConfig{
+		Name: "CallbackTest",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	return Registry.GetService(svcCfg.Name)
+}
+
+// Requests run the whole of either the old or new callback chain while the
+// chain is being swapped.
+func (s *HTTPSuite) TestCallbackSwap(c *C) {
+	svc := s.addCallbackService(c)
+
+	stop := make(chan struct{})
+	swapped := make(chan bool)
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			name := fmt.Sprintf("chain-%d", i)
+			if i%2 == 0 {
+				svc.ReplaceCallbacks(chainCallbacks(name))
+				continue
+			}
+			svc.AmendCallbacks(func(chain *CallbackChain) {
+				*chain = chainCallbacks(name)
+			})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				req, _ := http.NewRequest("GET", "http://test-vhost/addr", nil)
+				w := httptest.NewRecorder()
+				svc.ServeHTTP(w, req)
+
+				c.Check(w.Code, Equals, http.StatusOK)
+				c.Check(w.Header().Get("X-Chain-Request"), Equals, w.Header().Get("X-Chain-Response"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	close(stop)
+	<-swapped
+}
+
+// A callback removed from the chain still runs for a request that started
+// before it was removed, and not for later requests.
+func (s *HTTPSuite) TestCallbackRemovedMidRequest(c *C) {
+	svc := s.addCallbackService(c)
+	base := *svc.Callbacks()
+
+	started := make(chan bool)
+	release := make(chan bool)
+	svc.AmendCallbacks(func(chain *CallbackChain) {
+		chain.OnRequest = append(chain.OnRequest, func(pr *ProxyRequest) bool {
+			started <- true
+			<-release
+			return true
+		})
+		chain.OnResponse = append(chain.OnResponse, func(pr *ProxyRequest) bool {
+			pr.ResponseWriter.Header().Set("X-Removed", "ran")
+			return true
+		})
+	})
+
+	w := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://test-vhost/addr", nil)
+		svc.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	<-started
+	svc.ReplaceCallbacks(base)
+	close(release)
+	<-done
+
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("X-Removed"), Equals, "ran")
+
+	req, _ := http.NewRequest("GET", "http://test-vhost/addr", nil)
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Header().Get("X-Removed"), Equals, "")
+}
+
+// make a request through the http router without following redirects, and
+// return the status and location
+func redirectGet(c *C, addr, host, path string) (int, string) {
+	req, err := http.NewRequest("GET", "http://"+addr+path, nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	req.Host = host
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+
+	return resp.StatusCode, resp.Header.Get("Location")
+}
+
+// A service with only redirects consolidates old hostnames.
+func (s *HTTPSuite) TestRedirects(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "RedirectTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"old.test", "www.retired.test"},
+		Redirects: []client.RedirectConfig{
+			{
+				Host:          "old.test",
+				Target:        "https://new.test{path}",
+				PreserveQuery: true,
+			},
+			{
+				Host:   "*.retired.test",
+				Target: "https://new.test/?from={host}",
+				Status: http.StatusFound,
+			},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	code, loc := redirectGet(c, s.httpAddr, "old.test", "/a/b?x=1")
+	c.Assert(code, Equals, http.StatusMovedPermanently)
+	c.Assert(loc, Equals, "https://new.test/a/b?x=1")
+
+	code, loc = redirectGet(c, s.httpAddr, "www.retired.test:80", "/a/b?x=1")
+	c.Assert(code, Equals, http.StatusFound)
+	c.Assert(loc, Equals, "https://new.test/?from=www.retired.test")
+
+	svc := Registry.GetService("RedirectTest")
+	stats := svc.Stats()
+	c.Assert(len(stats.Redirects), Equals, 2)
+	c.Assert(stats.Redirects[0].Count, Equals, int64(1))
+	c.Assert(stats.Redirects[1].Count, Equals, int64(1))
+	c.Assert(svc.Config().Redirects, DeepEquals, svcCfg.Redirects)
+
+	// a backend-less service doesn't make shuttle unhealthy
+	resp, err := http.Get(s.httpSvr.URL + "/_health")
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	// update the rules in place
+	svcCfg.Redirects = []client.RedirectConfig{
+		{Target: "https://newer.test{path}?{query}", Status: 308},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	code, loc = redirectGet(c, s.httpAddr, "old.test", "/a?x=1")
+	c.Assert(code, Equals, 308)
+	c.Assert(loc, Equals, "https://newer.test/a?x=1")
+	c.Assert(Registry.GetService("RedirectTest").Config().Redirects, DeepEquals, svcCfg.Redirects)
+}
+
+// Redirects take precedence over backends for the requests they match.
+func (s *HTTPSuite) TestRedirectPrecedence(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "RedirectTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"test-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.backendServers[0].addr},
+		},
+		Redirects: []client.RedirectConfig{
+			{
+				PathPrefix: "/legacy/",
+				Target:     "http://{host}/moved{path}",
+				Status:     http.StatusTemporaryRedirect,
+			},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	code, loc := redirectGet(c, s.httpAddr, "test-vhost", "/legacy/page")
+	c.Assert(code, Equals, http.StatusTemporaryRedirect)
+	c.Assert(loc, Equals, "http://test-vhost/moved/legacy/page")
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "test-vhost", s.backendServers[0].addr, 200, c)
+}
+
+func (s *HTTPSuite) TestInvalidRedirects(c *C) {
+	for _, r := range []client.RedirectConfig{
+		{Target: "https://{hots}/"},
+		{Target: "https://new.test/{path"},
+		{Target: "https://new.test/}"},
+		{Target: ""},
+		{Target: "https://new.test/", Status: 200},
+	} {
+		svcCfg := client.ServiceConfig{
+			Name:      "RedirectTest",
+			Addr:      "127.0.0.1:9000",
+			Redirects: []client.RedirectConfig{r},
+		}
+		c.Assert(Registry.AddService(svcCfg), NotNil, Commentf("%#v", r))
+	}
+}
+
+// Build the full set of components, listening on random ports.
+func lifecycleServer(policy string, svcCfg client.ServiceConfig) (*Server, *AdminServer, *HostRouter) {
+	srv := NewServer(policy)
+	admin := NewAdminServer("127.0.0.1:0")
+	router := newHTTPRouter("127.0.0.1:0")
+
+	srv.Add("config", newRegistryRunner(func() error {
+		return Registry.UpdateConfig(client.Config{
+			Services: []client.ServiceConfig{svcCfg},
+		})
+	}))
+	srv.Add("admin", admin)
+	srv.Add("http", router)
+	return srv, admin, router
+}
+
+func getHealthStatus(c *C, addr net.Addr) (int, string) {
+	resp, err := http.Get("http://" + addr.String() + "/_health")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		c.Fatal(err)
+	}
+	return resp.StatusCode, health.Status
+}
+
+// The full set of components can be started and stopped repeatedly in one
+// process, without leaking goroutines.
+func (s *HTTPSuite) TestServerLifecycle(c *C) {
+	defer func(m *Server) { mainServer = m }(mainServer)
+
+	svcCfg := client.ServiceConfig{
+		Name:         "LifecycleTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"lifecycle.test"},
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.backendServers[0].addr},
+		},
+	}
+
+	run := func() {
+		srv, admin, router := lifecycleServer(StartupExit, svcCfg)
+		mainServer = srv
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if err := srv.Start(ctx); err != nil {
+			c.Fatal(err)
+		}
+
+		select {
+		case <-srv.Ready():
+		case <-time.After(time.Second):
+			c.Fatal("server not ready")
+		}
+
+		code, status := getHealthStatus(c, admin.ListenAddr())
+		c.Assert(code, Equals, http.StatusOK)
+		c.Assert(status, Equals, "ok")
+
+		checkHTTP("http://"+router.listener.Addr().String()+"/addr", "lifecycle.test", s.backendServers[0].addr, 200, c)
+
+		// cancelling the context runs the shutdown sequence, and stops
+		// everything
+		cancel()
+		select {
+		case <-srv.Done():
+		case <-time.After(5 * time.Second):
+			c.Fatal("server not stopped")
+		}
+		c.Assert(srv.Shutdown.Completed(), DeepEquals, []string{"admin", "listeners", "drain", "flush"})
+		c.Assert(srv.Shutdown.Routers, DeepEquals, []*HostRouter{router})
+
+		c.Assert(Registry.GetService("LifecycleTest"), IsNil)
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	}
+
+	// the first run may start some long lived goroutines in the runtime
+	run()
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 5; i++ {
+		run()
+	}
+	checkGoroutines(c, baseline)
+}
+
+// A component failing to start stops the ones already started, unless the
+// policy is to degrade.
+func (s *HTTPSuite) TestServerStartupPolicy(c *C) {
+	defer func(m *Server) { mainServer = m }(mainServer)
+
+	svcCfg := client.ServiceConfig{
+		Name: "LifecycleTest",
+		Addr: "127.0.0.1:9000",
+	}
+
+	// the router's address is already in use
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer busy.Close()
+
+	srv, admin, router := lifecycleServer(StartupExit, svcCfg)
+	router.server.Addr = busy.Addr().String()
+
+	err = srv.Start(context.Background())
+	c.Assert(err, NotNil)
+	c.Assert(strings.HasPrefix(err.Error(), "http: "), Equals, true)
+	c.Assert(Registry.GetService("LifecycleTest"), IsNil)
+	<-srv.Done()
+
+	_, err = net.Dial("tcp", admin.ListenAddr().String())
+	c.Assert(err, NotNil)
+
+	srv, admin, router = lifecycleServer(StartupDegrade, svcCfg)
+	router.server.Addr = busy.Addr().String()
+	mainServer = srv
+
+	if err := srv.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+	<-srv.Ready()
+
+	c.Assert(srv.Failed(), DeepEquals, []string{"http"})
+	c.Assert(Registry.GetService("LifecycleTest"), NotNil)
+
+	code, status := getHealthStatus(c, admin.ListenAddr())
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(status, Equals, "degraded")
+
+	c.Assert(NewServer("retry").Start(context.Background()), Equals, ErrStartupPolicy)
+}
+
+// A single backend can be read and partially updated, without touching the
+// other fields or sibling backends.
+func (s *HTTPSuite) TestPatchBackend(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "PatchTest",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.servers[0].addr, CheckAddr: s.servers[0].addr, Weight: 2},
+			{Name: "b2", Addr: s.servers[1].addr, Weight: 3},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+
+	resp, err := http.Get(s.httpSvr.URL + "/PatchTest/b1")
+	if err != nil {
+		c.Fatal(err)
+	}
+	var info BackendInfo
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err := json.Unmarshal(body, &info); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(info.Config, DeepEquals, svcCfg.Backends[0])
+	c.Assert(info.Stats.Name, Equals, "b1")
+	c.Assert(info.Checks.CheckAddr, Equals, s.servers[0].addr)
+	etag := resp.Header.Get("ETag")
+	c.Assert(etag, Not(Equals), "")
+
+	cfg, tag, err := shuttle.GetBackend("PatchTest", "b1")
+	c.Assert(err, IsNil)
+	c.Assert(*cfg, DeepEquals, svcCfg.Backends[0])
+	c.Assert(tag, Equals, etag)
+
+	svc := Registry.GetService("PatchTest")
+	b1 := svc.get("b1")
+	atomic.StoreInt64(&b1.Conns, 7)
+
+	// only the weight changes, on the running backend
+	weight := 5
+	cfg, tag, err = shuttle.PatchBackend("PatchTest", "b1", &client.BackendPatch{Weight: &weight}, etag)
+	c.Assert(err, IsNil)
+	expected := svcCfg.Backends[0]
+	expected.Weight = 5
+	c.Assert(*cfg, DeepEquals, expected)
+	c.Assert(tag, Not(Equals), etag)
+
+	c.Assert(svc.get("b1"), Equals, b1)
+	c.Assert(atomic.LoadInt64(&b1.Conns), Equals, int64(7))
+	c.Assert(b1.Config(), DeepEquals, expected)
+	c.Assert(svc.get("b2").Config(), DeepEquals, svcCfg.Backends[1])
+
+	// so are the connection limit and check settings
+	maxConns, checkType := 3, client.CheckHTTP
+	cfg, _, err = shuttle.PatchBackend("PatchTest", "b1", &client.BackendPatch{MaxConns: &maxConns, CheckType: &checkType}, "")
+	c.Assert(err, IsNil)
+	c.Assert(svc.get("b1"), Equals, b1)
+	c.Assert(b1.full(), Equals, false)
+	c.Assert(cfg.MaxConns, Equals, 3)
+	c.Assert(cfg.CheckPath, Equals, client.DefaultCheckPath)
+	maxConns, checkType = 0, client.CheckTCP
+	cfg, _, err = shuttle.PatchBackend("PatchTest", "b1", &client.BackendPatch{MaxConns: &maxConns, CheckType: &checkType}, "")
+	c.Assert(err, IsNil)
+	c.Assert(*cfg, DeepEquals, expected)
+
+	// the old etag is stale
+	checkAddr := ""
+	_, _, err = shuttle.PatchBackend("PatchTest", "b1", &client.BackendPatch{CheckAddr: &checkAddr}, etag)
+	c.Assert(err, Equals, client.ErrBackendModified)
+	c.Assert(svc.get("b1").Config(), DeepEquals, expected)
+
+	// and without an etag the change is unconditional. A new check address
+	// replaces the backend.
+	cfg, _, err = shuttle.PatchBackend("PatchTest", "b1", &client.BackendPatch{CheckAddr: &checkAddr}, "")
+	c.Assert(err, IsNil)
+	expected.CheckAddr = ""
+	c.Assert(*cfg, DeepEquals, expected)
+	c.Assert(svc.get("b1"), Not(Equals), b1)
+
+	// validation is still enforced
+	for _, patch := range []string{
+		`{"weight": 0}`,
+		`{"weight": -1}`,
+		`{"address": "nowhere"}`,
+		`{"check_address": "nowhere"}`,
+		`{"network": "udp"}`,
+		`{"network": "ipx"}`,
+		`{"weight": "heavy"}`,
+	} {
+		req, _ := http.NewRequest("PATCH", s.httpSvr.URL+"/PatchTest/b1", strings.NewReader(patch))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest, Commentf(patch))
+	}
+	c.Assert(svc.get("b1").Config(), DeepEquals, expected)
+
+	for _, path := range []string{"/PatchTest/b3", "/NoService/b1"} {
+		req, _ := http.NewRequest("PATCH", s.httpSvr.URL+path, strings.NewReader(`{"weight": 1}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusNotFound, Commentf(path))
+	}
+
+	_, _, err = shuttle.GetBackend("PatchTest", "b3")
+	c.Assert(err, NotNil)
+}
+
+// Backends on a network the service can't use are rejected by the API and
+// reported when loading a config.
+func (s *HTTPSuite) TestBackendNetworkValidation(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "NetTest",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	send := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, s.httpSvr.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(msg)
+	}
+
+	code, msg := send("PUT", "/NetTest/b2", `{"address": "127.0.0.1:9001", "network": "udp"}`)
+	c.Assert(code, Equals, http.StatusBadRequest)
+	c.Assert(msg, Matches, `(?s).*"udp" backend on a "tcp" service.*`)
+
+	code, msg = send("PUT", "/NetTest", `{"backends": [{"name": "b3", "address": "127.0.0.1:9001", "network": "udp4"}]}`)
+	c.Assert(code, Equals, http.StatusBadRequest)
+	c.Assert(msg, Matches, `(?s).*backend b3: .*"udp4" backend on a "tcp" service.*`)
+
+	code, _ = send("PUT", "/NetTest/b4", `{"address": "/tmp/shuttle-b4.sock", "network": "unix"}`)
+	c.Assert(code, Equals, http.StatusBadRequest)
+
+	code, _ = send("PUT", "/NetTest/b5", `{"address": "127.0.0.1:9001", "network": "tcp6"}`)
+	c.Assert(code, Equals, http.StatusOK)
+
+	svc := Registry.GetService("NetTest")
+	c.Assert(svc.get("b2"), IsNil)
+	c.Assert(svc.get("b3"), IsNil)
+	c.Assert(svc.get("b4"), IsNil)
+	c.Assert(svc.get("b5").Network, Equals, "tcp6")
+
+	// unix backends are allowed once bridging is enabled
+	defer func(b bool) { bridgeUnix = b }(bridgeUnix)
+	bridgeUnix = true
+	code, _ = send("PUT", "/NetTest/b4", `{"address": "/tmp/shuttle-b4.sock", "network": "unix"}`)
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(svc.get("b4").Network, Equals, "unix")
+
+	// a config with a bad backend is reported by name
+	tmp, err := ioutil.TempFile("", "shuttle-state")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.WriteString(`{"services": [{"name": "NetLoad", "address": "127.0.0.1:9002", "network": "udp",
+		"backends": [{"name": "tcpBackend", "address": "127.0.0.1:9003", "network": "tcp"}]}]}`)
+	tmp.Close()
+
+	// the earlier updates may still be writing the state config
+	configMutex.Lock()
+	defer func(state, def string) {
+		configMutex.Lock()
+		stateConfig, defaultConfig = state, def
+		configMutex.Unlock()
+	}(stateConfig, defaultConfig)
+	stateConfig, defaultConfig = tmp.Name(), ""
+	configMutex.Unlock()
+
+	// the error is logged, and doesn't stop shuttle from starting
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("NetLoad"), IsNil)
+}
+
+// Two vhosts on the same router with different header limits.
+func (s *HTTPSuite) TestMaxHeaderBytes(c *C) {
+	okServer := s.backendServers[0]
+	errServer := s.backendServers[1]
+
+	if err := Registry.UpdateConfig(client.Config{MaxHeaderBytes: 64 << 10}); err != nil {
+		c.Fatal(err)
+	}
+
+	sso := client.ServiceConfig{
+		Name:           "SSO",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"sso-vhost"},
+		MaxHeaderBytes: 2 << 20,
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: okServer.addr},
+		},
+	}
+	tight := client.ServiceConfig{
+		Name:         "Tight",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"tight-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: okServer.addr},
+		},
+		ErrorPages: map[string][]int{
+			"http://" + errServer.addr + "/error?code=431": []int{431},
+		},
+	}
+	for _, cfg := range []client.ServiceConfig{sso, tight} {
+		if err := Registry.AddService(cfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	// the server allows the largest of the limits
+	c.Assert(httpRouter.MaxHeaderBytes(), Equals, 2<<20)
+
+	cookie := strings.Repeat("x", 1<<20)
+	get := func(host string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = host
+		req.Header.Set("Cookie", "session="+cookie)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := get("sso-vhost")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(body, Equals, okServer.addr)
+
+	code, body = get("tight-vhost")
+	c.Assert(code, Equals, http.StatusRequestHeaderFieldsTooLarge)
+	c.Assert(body, Equals, errServer.addr)
+
+	// small headers are still fine
+	cookie = strings.Repeat("x", 1<<10)
+	code, _ = get("tight-vhost")
+	c.Assert(code, Equals, http.StatusOK)
+
+	resp, err := http.Get(s.httpSvr.URL + "/_router")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer resp.Body.Close()
+	routerCfg := RouterConfig{}
+	if err := json.NewDecoder(resp.Body).Decode(&routerCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(routerCfg.MaxHeaderBytes, Equals, 64<<10)
+	c.Assert(routerCfg.ServerMaxHeaderBytes, Equals, 2<<20)
+	c.Assert(routerCfg.VirtualHosts["sso-vhost"], Equals, 2<<20)
+	c.Assert(routerCfg.VirtualHosts["tight-vhost"], Equals, 64<<10)
+
+	// lowering the limit applies to the next request
+	sso.MaxHeaderBytes = 16 << 10
+	if err := Registry.UpdateService(sso); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(httpRouter.MaxHeaderBytes(), Equals, 64<<10)
+
+	cookie = strings.Repeat("x", 32<<10)
+	code, _ = get("sso-vhost")
+	c.Assert(code, Equals, http.StatusRequestHeaderFieldsTooLarge)
+	code, _ = get("tight-vhost")
+	c.Assert(code, Equals, http.StatusOK)
+}
+
+// Responses shuttle makes itself are logged and counted by reason, apart from
+// the responses passed on from backends.
+func (s *HTTPSuite) TestLocalResponses(c *C) {
+	srv := s.backendServers[0]
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:           "Local",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"local-vhost"},
+		MaxHeaderBytes: 1024,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv.addr},
+		},
+		Redirects: []client.RedirectConfig{
+			{PathPrefix: "/old", Target: "https://new.test{path}"},
+		},
+	}
+	deadCfg := client.ServiceConfig{
+		Name:         "Dead",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"dead-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "d0", Addr: dead},
+		},
+	}
+	for _, cfg := range []client.ServiceConfig{svcCfg, deadCfg} {
+		if err := Registry.AddService(cfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	logged := captureLogs()
+	defer logged.stop()
+
+	// make a request, and return its status and access log entry
+	get := func(host, path string, header http.Header) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		id := "id=" + resp.Header.Get("X-Request-Id") + " "
+		for _, line := range strings.Split(logged.String(), "\n") {
+			if strings.Contains(line, id) && strings.Contains(line, " status=") {
+				return resp.StatusCode, line
+			}
+		}
+		c.Fatalf("no access log entry for %s", id)
+		return 0, ""
+	}
+
+	counts := func(name string) map[string]int64 {
+		stats, err := Registry.ServiceStats(name)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return stats.LocalResponses
+	}
+	none := map[string]int64{
+		reasonHTTPSRedirect:  0,
+		reasonMaintenance:    0,
+		reasonRedirect:       0,
+		reasonHeaderTooLarge: 0,
+		reasonNoBackends:     0,
+		reasonRateLimited:    0,
+		reasonClientDenied:   0,
+		reasonBackendsFull:   0,
+	}
+
+	// errors from the backend are the backend's
+	for _, code := range []int{404, 500} {
+		status, entry := get("local-vhost", fmt.Sprintf("/error?code=%d", code), nil)
+		c.Assert(status, Equals, code)
+		c.Assert(strings.Contains(entry, "backend="+srv.addr), Equals, true)
+		c.Assert(strings.Contains(entry, "origin=backend"), Equals, true)
+		c.Assert(strings.Contains(entry, "reason="), Equals, false)
+	}
+	c.Assert(counts("Local"), DeepEquals, none)
+
+	// a backend that can't be reached is a proxy error
+	status, entry := get("dead-vhost", "/addr", nil)
+	c.Assert(status, Equals, http.StatusBadGateway)
+	c.Assert(strings.Contains(entry, "origin=shuttle reason=proxy_error"), Equals, true)
+	stats, err := Registry.ServiceStats("Dead")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(stats.HTTPErrors, Equals, int64(1))
+	c.Assert(stats.LocalResponses, DeepEquals, none)
+
+	status, entry = get("local-vhost", "/old/page", nil)
+	c.Assert(status, Equals, http.StatusMovedPermanently)
+	c.Assert(strings.Contains(entry, "origin=shuttle reason=redirect"), Equals, true)
+
+	big := http.Header{"Cookie": {strings.Repeat("x", 2048)}}
+	status, entry = get("local-vhost", "/addr", big)
+	c.Assert(status, Equals, http.StatusRequestHeaderFieldsTooLarge)
+	c.Assert(strings.Contains(entry, "origin=shuttle reason=header_too_large"), Equals, true)
+
+	status, entry = get("unknown-vhost", "/addr", nil)
+	c.Assert(status, Equals, http.StatusNotFound)
+	c.Assert(strings.Contains(entry, "origin=shuttle reason=no_vhost"), Equals, true)
+
+	svcCfg.MaintenanceMode = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	status, entry = get("local-vhost", "/addr", nil)
+	c.Assert(status, Equals, http.StatusServiceUnavailable)
+	c.Assert(strings.Contains(entry, "origin=shuttle reason=maintenance"), Equals, true)
+
+	svcCfg.MaintenanceMode = false
+	svcCfg.HTTPSRedirect = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	status, entry = get("local-vhost", "/addr", nil)
+	c.Assert(status, Equals, http.StatusMovedPermanently)
+	c.Assert(strings.Contains(entry, "origin=shuttle reason=https_redirect"), Equals, true)
+
+	c.Assert(counts("Local"), DeepEquals, map[string]int64{
+		reasonHTTPSRedirect:  1,
+		reasonMaintenance:    1,
+		reasonRedirect:       1,
+		reasonHeaderTooLarge: 1,
+		reasonNoBackends:     0,
+		reasonRateLimited:    0,
+		reasonClientDenied:   0,
+		reasonBackendsFull:   0,
+	})
+
+	// the request headers are only logged when sampling
+	c.Assert(strings.Contains(logged.String(), "request-headers"), Equals, false)
+	defer atomic.StoreInt64(&localSample, 0)
+	atomic.StoreInt64(&localSample, 1)
+	get("local-vhost", "/addr", nil)
+	c.Assert(strings.Contains(logged.String(), "origin=shuttle reason=https_redirect sampled request-headers"), Equals, true)
+}
+
+// A vhost with no backends answers 503 when refusing, and the service is
+// reported as empty.
+func (s *HTTPSuite) TestNoBackendHTTP(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:            "Empty",
+		Addr:            "127.0.0.1:9000",
+		VirtualHosts:    []string{"empty-vhost"},
+		NoBackendAction: client.NoBackendRefuse,
+		ErrorPages: map[string][]int{
+			"http://" + s.backendServers[1].addr + "/error": {503},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(url, host string) (int, string) {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// the error page is fetched in the background
+	for i := 0; ; i++ {
+		code, body := get("http://"+s.httpAddr+"/addr", "empty-vhost")
+		c.Assert(code, Equals, http.StatusServiceUnavailable)
+		if body == s.backendServers[1].addr || i == 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats, err := Registry.ServiceStats("Empty")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(stats.Empty, Equals, true)
+	c.Assert(stats.NoBackends > 0, Equals, true)
+	c.Assert(stats.LocalResponses[reasonNoBackends], Equals, stats.NoBackends)
+
+	// listed, without making shuttle unhealthy
+	var health struct {
+		Status string   `json:"status"`
+		Empty  []string `json:"empty_services"`
+	}
+	code, body := get(s.httpSvr.URL+"/_health", "")
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(json.Unmarshal([]byte(body), &health), IsNil)
+	c.Assert(health.Empty, DeepEquals, []string{"Empty"})
+
+	// errors are proxy errors, as if every backend were down
+	svcCfg.NoBackendAction = client.NoBackendError
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	code, _ = get("http://"+s.httpAddr+"/addr", "empty-vhost")
+	c.Assert(code, Equals, http.StatusBadGateway)
+
+	svcCfg.Backends = []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	code, _ = get("http://"+s.httpAddr+"/addr", "empty-vhost")
+	c.Assert(code, Equals, http.StatusOK)
+	stats, _ = Registry.ServiceStats("Empty")
+	c.Assert(stats.Empty, Equals, false)
+
+	_, body = get(s.httpSvr.URL+"/_health", "")
+	c.Assert(strings.Contains(body, "empty_services"), Equals, false)
+
+	svcCfg.NoBackendAction = "drop"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidNoBackend.Error()+".*")
+}
+
+// Weights set together take effect on the same selection.
+func (s *HTTPSuite) TestSetWeights(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "WeightTest",
+		Addr: "127.0.0.1:9000",
+	}
+	names := []string{"b1", "b2", "b3", "b4"}
+	for i, name := range names {
+		svcCfg.Backends = append(svcCfg.Backends, client.BackendConfig{Name: name, Addr: s.servers[i].addr})
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("WeightTest")
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+
+	// sample the selections continuously while the weights are changed
+	done := make(chan error, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done <- shuttle.SetWeights("WeightTest", map[string]int{"*": 10, "b1": 1})
+	}()
+
+	var selected []string
+	after := -1
+	for after != 0 {
+		select {
+		case err := <-done:
+			c.Assert(err, IsNil)
+			after = 200
+		default:
+		}
+		if after > 0 {
+			after--
+		}
+		selected = append(selected, svc.next(nil)[0].Name)
+	}
+
+	// every selection follows the old weights up to a single point, and the
+	// new weights from there
+	oldWeights := names
+	var newWeights []string
+	for _, name := range names {
+		n := 10
+		if name == "b1" {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			newWeights = append(newWeights, name)
+		}
+	}
+
+	diverged := 0
+	for diverged < len(selected) && selected[diverged] == oldWeights[diverged%len(oldWeights)] {
+		diverged++
+	}
+
+	// the new weights start with a selection the old ones could have made
+	boundary := -1
+	for k := diverged - len(oldWeights); k <= diverged && boundary < 0; k++ {
+		if k < 0 {
+			continue
+		}
+		ok := true
+		for i := k; i < len(selected); i++ {
+			if selected[i] != newWeights[(i-k)%len(newWeights)] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			boundary = k
+		}
+	}
+	c.Assert(boundary >= 0 && boundary < len(selected)-200, Equals, true, Commentf("diverged at %d of %d", diverged, len(selected)))
+
+	for _, b := range svc.Config().Backends {
+		c.Assert(b.Weight, Equals, map[string]int{"b1": 1, "b2": 10, "b3": 10, "b4": 10}[b.Name])
+	}
+
+	// nothing changes unless every backend exists and every weight is valid
+	err := shuttle.SetWeights("WeightTest", map[string]int{"b1": 5, "b5": 5})
+	c.Assert(err, ErrorMatches, `.*404 Not Found: backend does not exist: b5`)
+	err = shuttle.SetWeights("WeightTest", map[string]int{"b1": 5, "*": 0})
+	c.Assert(err, ErrorMatches, `.*400 Bad Request: invalid weight for \*: 0`)
+	err = shuttle.SetWeights("NoService", map[string]int{"b1": 5})
+	c.Assert(err, ErrorMatches, `.*404 Not Found.*`)
+	c.Assert(svc.get("b1").Config().Weight, Equals, 1)
+}
+
+// Point the state config at an unwritable path mid-run, and check each
+// failure policy and its recovery.
+func (s *HTTPSuite) TestStateWriteFailure(c *C) {
+	dir, err := ioutil.TempDir("", "shuttle-state")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file can't be created under another file, even as root
+	notDir := dir + "/file"
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		c.Fatal(err)
+	}
+	bad := notDir + "/state.json"
+	fallback := dir + "/fallback.json"
+
+	setState := func(path, policy, fb string) {
+		configMutex.Lock()
+		stateConfig, statePolicy, stateFallback = path, policy, fb
+		configMutex.Unlock()
+	}
+
+	configMutex.Lock()
+	defer func(path, policy, fb string, retry time.Duration) {
+		setState(path, policy, fb)
+		configMutex.Lock()
+		stateRetryInterval = retry
+		configMutex.Unlock()
+	}(stateConfig, statePolicy, stateFallback, stateRetryInterval)
+	stateRetryInterval = time.Hour
+	configMutex.Unlock()
+
+	svcCfg := client.ServiceConfig{
+		Name: "StateSvc",
+		Addr: "127.0.0.1:9000",
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	send := func(method, path, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, s.httpSvr.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, msg
+	}
+
+	getState := func() StateStatus {
+		var status StateStatus
+		_, body := send("GET", "/_state", "")
+		if err := json.Unmarshal(body, &status); err != nil {
+			c.Fatal(err)
+		}
+		return status
+	}
+
+	type health struct {
+		Status        string `json:"status"`
+		StateFailures int    `json:"state_failures"`
+		StateError    string `json:"state_error"`
+	}
+	getHealth := func() (int, health) {
+		var h health
+		code, body := send("GET", "/_health", "")
+		if err := json.Unmarshal(body, &h); err != nil {
+			c.Fatal(err)
+		}
+		return code, h
+	}
+
+	addBackend := func(name string) int {
+		code, _ := send("PUT", "/StateSvc/"+name, `{"address": "127.0.0.1:9001"}`)
+		return code
+	}
+
+	// warn keeps accepting changes, and reports the failure
+	setState(bad, StateWarn, "")
+	c.Assert(addBackend("b1"), Equals, http.StatusOK)
+	writeStateConfig()
+
+	status := getState()
+	c.Assert(status.Failures > 0, Equals, true)
+	c.Assert(status.LastError, Matches, ".*not a directory")
+	c.Assert(status.FailingSince, NotNil)
+	c.Assert(status.Readonly, Equals, false)
+
+	code, h := getHealth()
+	c.Assert(code, Equals, http.StatusOK)
+	c.Assert(h.StateFailures, Equals, status.Failures)
+	c.Assert(h.StateError, Equals, status.LastError)
+	c.Assert(addBackend("b2"), Equals, http.StatusOK)
+
+	setState(dir+"/warn.json", StateWarn, "")
+	writeStateConfig()
+	status = getState()
+	c.Assert(status.Failures, Equals, 0)
+	c.Assert(status.LastError, Equals, "")
+	c.Assert(status.LastWrite, NotNil)
+	cfg, _ := ioutil.ReadFile(dir + "/warn.json")
+	c.Assert(strings.Contains(string(cfg), `"b2"`), Equals, true)
+
+	// readonly rejects changes until the retry succeeds
+	configMutex.Lock()
+	stateRetryInterval = 10 * time.Millisecond
+	configMutex.Unlock()
+	setState(bad, StateReadonly, "")
+	c.Assert(addBackend("b3"), Equals, http.StatusOK)
+	writeStateConfig()
+
+	c.Assert(addBackend("b4"), Equals, http.StatusInsufficientStorage)
+	c.Assert(getState().Readonly, Equals, true)
+	code, h = getHealth()
+	c.Assert(code, Equals, http.StatusServiceUnavailable)
+	c.Assert(h.Status, Equals, "degraded")
+	c.Assert(Registry.GetService("StateSvc").get("b4"), IsNil)
+
+	setState(dir+"/readonly.json", StateReadonly, "")
+
+	for i := 0; getState().Failures > 0; i++ {
+		if i > 100 {
+			c.Fatal("state writes didn't recover")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(addBackend("b4"), Equals, http.StatusOK)
+	code, _ = getHealth()
+	c.Assert(code, Equals, http.StatusOK)
+
+	configMutex.Lock()
+	stateRetryInterval = time.Hour
+	configMutex.Unlock()
+
+	// fallback-path writes to the fallback while the state can't be written
+	setState(bad, StateFallback, fallback)
+	c.Assert(addBackend("b5"), Equals, http.StatusOK)
+	writeStateConfig()
+
+	status = getState()
+	c.Assert(status.Failures > 0, Equals, true)
+	c.Assert(status.UsingFallback, Equals, true)
+	c.Assert(status.Readonly, Equals, false)
+	cfg, _ = ioutil.ReadFile(fallback)
+	c.Assert(strings.Contains(string(cfg), `"b5"`), Equals, true)
+	c.Assert(statePath(), Equals, fallback)
+	c.Assert(addBackend("b6"), Equals, http.StatusOK)
+
+	setState(dir+"/primary.json", StateFallback, fallback)
+	writeStateConfig()
+	status = getState()
+	c.Assert(status.Failures, Equals, 0)
+	c.Assert(status.UsingFallback, Equals, false)
+	cfg, _ = ioutil.ReadFile(dir + "/primary.json")
+	c.Assert(strings.Contains(string(cfg), `"b6"`), Equals, true)
+}
+
+// A state file cut short by a crash is recovered from its backup, which a
+// file that can't be parsed never replaces.
+func (s *HTTPSuite) TestStateFileRecovery(c *C) {
+	dir, err := ioutil.TempDir("", "shuttle-state")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/state.json"
+
+	configMutex.Lock()
+	defer func(state, def string) {
+		configMutex.Lock()
+		stateConfig, defaultConfig = state, def
+		configMutex.Unlock()
+	}(stateConfig, defaultConfig)
+	stateConfig, defaultConfig = path, ""
+	configMutex.Unlock()
+
+	svcCfg := client.ServiceConfig{
+		Name:     "RecoverSvc",
+		Addr:     "127.0.0.1:9000",
+		Backends: []client.BackendConfig{{Name: "b1", Addr: "127.0.0.1:9001"}},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	writeStateConfig()
+	_, err = os.Stat(path + ".bak")
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	if err := Registry.AddBackend("RecoverSvc", client.BackendConfig{Name: "b2", Addr: "127.0.0.1:9002"}); err != nil {
+		c.Fatal(err)
+	}
+	writeStateConfig()
+
+	// only the state file and its backup are left behind
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	c.Assert(names, DeepEquals, []string{"state.json", "state.json.bak"})
+
+	saved, err := ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(saved), `"b2"`), Equals, true)
+	backup, err := ioutil.ReadFile(path + ".bak")
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(backup), `"b1"`), Equals, true)
+	c.Assert(strings.Contains(string(backup), `"b2"`), Equals, false)
+
+	// a write cut short, as an in-place write could leave it
+	c.Assert(ioutil.WriteFile(path, saved[:len(saved)/2], 0644), IsNil)
+	c.Assert(Registry.RemoveService("RecoverSvc"), IsNil)
+
+	c.Assert(loadConfig(), IsNil)
+	svc := Registry.GetService("RecoverSvc")
+	c.Assert(svc, NotNil)
+	c.Assert(svc.get("b1"), NotNil)
+	c.Assert(svc.get("b2"), IsNil)
+
+	// saving again replaces the broken file, but keeps the good backup
+	writeStateConfig()
+	saved, err = ioutil.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(json.Valid(saved), Equals, true)
+	kept, err := ioutil.ReadFile(path + ".bak")
+	c.Assert(err, IsNil)
+	c.Assert(string(kept), Equals, string(backup))
+}
+
+// The state file is saved and loaded in the format of its extension, and the
+// loaded config is the one that was saved.
+func (s *HTTPSuite) TestStateFileFormats(c *C) {
+	dir, err := ioutil.TempDir("", "shuttle-state")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configMutex.Lock()
+	defer func(state, def string) {
+		configMutex.Lock()
+		stateConfig, defaultConfig = state, def
+		configMutex.Unlock()
+	}(stateConfig, defaultConfig)
+	configMutex.Unlock()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "FormatSvc",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"format-vhost"},
+		ErrorPageConditions: map[int]client.ErrorPageCondition{
+			503: {Body: client.ErrorBodyEmpty},
+		},
+		Tags: map[string]string{"team": "edge"},
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: "127.0.0.1:9001", Weight: 3},
+			{Name: "b2", Addr: "127.0.0.1:9002", CheckType: client.CheckHTTP, CheckPath: "/health"},
+		},
+	}
+
+	for _, name := range []string{"state.json", "state.yaml", "state.yml", "state.toml"} {
+		path := dir + "/" + name
+		configMutex.Lock()
+		stateConfig, defaultConfig = path, ""
+		configMutex.Unlock()
+
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+		saved := Registry.GetService("FormatSvc").Config()
+		writeStateConfig()
+
+		data, err := ioutil.ReadFile(path)
+		c.Assert(err, IsNil)
+		var decoded map[string]interface{}
+		switch configFormat(path) {
+		case FormatJSON:
+			c.Assert(json.Unmarshal(data, &decoded), IsNil)
+		case FormatYAML:
+			c.Assert(yaml.Unmarshal(data, &decoded), IsNil)
+			c.Assert(json.Valid(data), Equals, false)
+		case FormatTOML:
+			_, err := toml.Decode(string(data), &decoded)
+			c.Assert(err, IsNil)
+		}
+		c.Assert(decoded["services"], NotNil, Commentf("%s: %s", name, data))
+
+		c.Assert(Registry.RemoveService("FormatSvc"), IsNil)
+		c.Assert(loadConfig(), IsNil)
+		svc := Registry.GetService("FormatSvc")
+		c.Assert(svc, NotNil, Commentf(name))
+		c.Assert(svc.Config(), DeepEquals, saved, Commentf(name))
+		c.Assert(Registry.RemoveService("FormatSvc"), IsNil)
+	}
+}
+
+// Fields a config doesn't have are logged by name, rather than silently
+// ignored.
+func (s *HTTPSuite) TestConfigUnknownFields(c *C) {
+	dir, err := ioutil.TempDir("", "shuttle-config")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/shuttle.yaml"
+	err = ioutil.WriteFile(path, []byte(`
+check_intervall: 1000
+services:
+  - name: YAMLSvc
+    address: 127.0.0.1:9000
+    backends:
+      - name: b1
+        address: 127.0.0.1:9001
+        wieght: 2
+`), 0644)
+	c.Assert(err, IsNil)
+
+	configMutex.Lock()
+	defer func(state, def string) {
+		configMutex.Lock()
+		stateConfig, defaultConfig = state, def
+		configMutex.Unlock()
+	}(stateConfig, defaultConfig)
+	stateConfig, defaultConfig = "", path
+	configMutex.Unlock()
+
+	logged := captureLogs()
+	defer logged.stop()
+
+	c.Assert(loadConfig(), IsNil)
+	svc := Registry.GetService("YAMLSvc")
+	c.Assert(svc, NotNil)
+	c.Assert(svc.get("b1"), NotNil)
+	c.Assert(logged.String(), Matches, `(?s).*WARN: .*shuttle.yaml: ignoring unknown config fields: check_intervall, services\[0\]\.backends\[0\]\.wieght\n.*`)
+
+	// a broken file is an error, not an empty config
+	c.Assert(ioutil.WriteFile(path, []byte("services: [\n"), 0644), IsNil)
+	c.Assert(loadConfig(), ErrorMatches, ".*shuttle.yaml: "+ErrConfigSyntax.Error()+".*")
+}
+
+// Deadlines and retry budgets from trusted clients, capped by the service's
+// own timeout and backends.
+func (s *HTTPSuite) TestRequestLimits(c *C) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ms, _ := strconv.Atoi(r.URL.Query().Get("ms"))
+		select {
+		case <-time.After(time.Duration(ms) * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+
+	// addresses nothing is listening on
+	var dead []client.BackendConfig
+	for i := 0; i < 3; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			c.Fatal(err)
+		}
+		dead = append(dead, client.BackendConfig{Name: fmt.Sprintf("d%d", i), Addr: l.Addr().String()})
+		l.Close()
+	}
+
+	svcs := []client.ServiceConfig{
+		{
+			Name:            "Slow",
+			Addr:            "127.0.0.1:9000",
+			VirtualHosts:    []string{"slow-vhost"},
+			RequestTimeout:  500,
+			TrustedNetworks: []string{"127.0.0.1"},
+			Backends: []client.BackendConfig{
+				{Name: "b0", Addr: strings.TrimPrefix(slow.URL, "http://")},
+			},
+		},
+		{
+			Name:            "Dead",
+			Addr:            "127.0.0.1:9001",
+			VirtualHosts:    []string{"dead-vhost"},
+			TrustedNetworks: []string{"10.0.0.0/8", "127.0.0.0/8"},
+			Backends:        dead,
+		},
+	}
+	for _, cfg := range svcs {
+		if err := Registry.AddService(cfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	get := func(host, path string, headers map[string]string) *http.Response {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		req.Host = host
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	// the caller's deadline is honored
+	resp := get("slow-vhost", "/?ms=1000", map[string]string{RequestTimeoutHeader: "100"})
+	c.Assert(resp.StatusCode, Equals, http.StatusGatewayTimeout)
+	c.Assert(resp.Header.Get(DeadlineHeader), Equals, "100")
+	c.Assert(resp.Header.Get(AttemptsHeader), Equals, "1")
+
+	// but capped by the service's
+	resp = get("slow-vhost", "/?ms=200", map[string]string{RequestTimeoutHeader: "5000"})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get(DeadlineHeader), Equals, "500")
+	resp = get("slow-vhost", "/?ms=1000", map[string]string{RequestTimeoutHeader: "5000"})
+	c.Assert(resp.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	// invalid values are ignored
+	resp = get("slow-vhost", "/?ms=200", map[string]string{RequestTimeoutHeader: "-1"})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get(DeadlineHeader), Equals, "500")
+
+	// every backend is tried without a budget
+	resp = get("dead-vhost", "/", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(resp.Header.Get(AttemptsHeader), Equals, "3")
+
+	// a budget larger than the backends changes nothing
+	resp = get("dead-vhost", "/", map[string]string{RetryBudgetHeader: "5"})
+	c.Assert(resp.Header.Get(AttemptsHeader), Equals, "3")
+	c.Assert(Registry.GetService("Dead").Stats().RetryBudgetExhausted, Equals, int64(0))
+
+	resp = get("dead-vhost", "/", map[string]string{RetryBudgetHeader: "2"})
+	c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(resp.Header.Get(AttemptsHeader), Equals, "2")
+	c.Assert(Registry.GetService("Dead").Stats().RetryBudgetExhausted, Equals, int64(1))
+
+	// the headers are ignored from untrusted clients
+	for _, cfg := range svcs {
+		cfg.TrustedNetworks = []string{"10.0.0.0/8"}
+		if err := Registry.UpdateService(cfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	resp = get("slow-vhost", "/?ms=200", map[string]string{RequestTimeoutHeader: "100"})
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+	c.Assert(resp.Header.Get(DeadlineHeader), Equals, "")
+	c.Assert(resp.Header.Get(AttemptsHeader), Equals, "")
+	resp = get("slow-vhost", "/?ms=1000", nil)
+	c.Assert(resp.StatusCode, Equals, http.StatusGatewayTimeout)
+
+	resp = get("dead-vhost", "/", map[string]string{RetryBudgetHeader: "1"})
+	c.Assert(resp.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(resp.Header.Get(AttemptsHeader), Equals, "")
+	c.Assert(Registry.GetService("Dead").Stats().RetryBudgetExhausted, Equals, int64(1))
+
+	svcs[0].TrustedNetworks = []string{"10.0.0.0/33"}
+	err := Registry.UpdateService(svcs[0])
+	c.Assert(err, ErrorMatches, `invalid trusted network: "10.0.0.0/33"`)
+	c.Assert(Registry.GetService("Slow").Config().TrustedNetworks, DeepEquals, []string{"10.0.0.0/8"})
+}
+
+// Removing a service with drain=true lets the requests in progress finish,
+// while new requests for its vhosts aren't routed.
+func (s *HTTPSuite) TestDrainService(c *C) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "Drain",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"drain-vhost"},
+		DrainTimeout: 5000,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: strings.TrimPrefix(backend.URL, "http://")},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	get := func() (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/", nil)
+		req.Host = "drain-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	type result struct {
+		status int
+		body   string
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, body := get()
+		inFlight <- result{resp.StatusCode, body}
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	stream, err := shuttle.Events(ctx, "Drain")
+	c.Assert(err, IsNil)
+
+	c.Assert(shuttle.DrainService("Drain"), IsNil)
+	c.Assert(Registry.GetService("Drain"), IsNil)
+	c.Assert(shuttle.DrainService("Drain"), NotNil)
+
+	resp, _ := get()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(svc.ActiveConns(), Equals, 1)
+
+	close(release)
+	res := <-inFlight
+	c.Assert(res.status, Equals, http.StatusOK)
+	c.Assert(res.body, Equals, "done")
+
+	// the service is only reported removed once it has stopped
+	for {
+		select {
+		case e := <-stream:
+			if e.Type != client.EventServiceRemoved {
+				continue
+			}
+			c.Assert(svc.ActiveConns(), Equals, 0)
+			return
+		case <-time.After(2 * time.Second):
+			c.Fatal("drained service wasn't removed")
+		}
+	}
+}
+
+// Removing a backend with drain=true lets its requests in progress finish,
+// while new requests go to the other backends.
+func (s *HTTPSuite) TestDrainBackend(c *C) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	}))
+	defer slow.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "DrainBackend",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"drain-backend-vhost"},
+		DrainTimeout: 5000,
+		Backends: []client.BackendConfig{
+			{Name: "slow", Addr: strings.TrimPrefix(slow.URL, "http://")},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	get := func() (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "drain-backend-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	inFlight := make(chan string, 1)
+	go func() {
+		_, body := get()
+		inFlight <- body
+	}()
+	<-started
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	c.Assert(shuttle.UpdateBackend("DrainBackend", &client.BackendConfig{Name: "b0", Addr: s.backendServers[0].addr}), IsNil)
+	c.Assert(shuttle.DrainBackend("DrainBackend", "slow"), IsNil)
+	c.Assert(shuttle.DrainBackend("DrainBackend", "slow"), NotNil)
+
+	stats := svc.Stats()
+	c.Assert(stats.Backends, HasLen, 2)
+	c.Assert(stats.Backends[1].Name, Equals, "slow")
+	c.Assert(stats.Backends[1].State, Equals, StateDraining)
+	c.Assert(stats.Backends[1].HTTPActive, Equals, int64(1))
+
+	_, body := get()
+	c.Assert(body, Equals, s.backendServers[0].addr)
+
+	close(release)
+	c.Assert(<-inFlight, Equals, "done")
+	for i := 0; len(svc.Stats().Backends) > 1; i++ {
+		if i == 100 {
+			c.Fatal("drained backend wasn't stopped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A TLS backend is sent https requests, and its certificate is only accepted
+// once its CA is trusted.
+func (s *HTTPSuite) TestTLSBackend(c *C) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Assert(r.TLS, NotNil)
+		w.Write([]byte("tls"))
+	}))
+	defer backend.Close()
+
+	caFile, err := ioutil.TempFile("", "shuttle-ca")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	caFile.Close()
+
+	backendCfg := client.BackendConfig{
+		Name: "tls",
+		Addr: strings.TrimPrefix(backend.URL, "https://"),
+		TLS:  &client.BackendTLSConfig{},
+	}
+	svcCfg := client.ServiceConfig{
+		Name:         "TLSBackend",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"tls-backend-vhost"},
+		Backends:     []client.BackendConfig{backendCfg},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func() (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/", nil)
+		req.Host = "tls-backend-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	// the test server's certificate isn't signed by a trusted CA
+	status, _ := get()
+	c.Assert(status, Equals, http.StatusBadGateway)
+	stats, err := Registry.BackendStats("TLSBackend", "tls")
+	c.Assert(err, IsNil)
+	c.Assert(stats.TLS, Equals, true)
+	c.Assert(stats.TLSErrors, Equals, int64(1))
+	c.Assert(stats.Errors, Equals, int64(1))
+	c.Assert(stats.LastTLSError, Matches, ".*certificate.*")
+
+	backendCfg.TLS = &client.BackendTLSConfig{CACert: caFile.Name()}
+	c.Assert(Registry.AddBackend("TLSBackend", backendCfg), IsNil)
+	status, body := get()
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "tls")
+	c.Assert(Registry.GetService("TLSBackend").Config().Backends[0].TLS, DeepEquals, backendCfg.TLS)
+
+	// or verification is skipped
+	backendCfg.TLS = &client.BackendTLSConfig{InsecureSkipVerify: true}
+	c.Assert(Registry.AddBackend("TLSBackend", backendCfg), IsNil)
+	status, body = get()
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(body, Equals, "tls")
+
+	backendCfg.TLS = &client.BackendTLSConfig{CACert: "/missing/ca.pem"}
+	c.Assert(Registry.AddBackend("TLSBackend", backendCfg), ErrorMatches, "invalid tls config for tls: .*")
+	backendCfg.TLS = &client.BackendTLSConfig{}
+	backendCfg.Network = "udp"
+	c.Assert(errors.Is(validBackendsTLS(client.ServiceConfig{Network: "udp", Backends: []client.BackendConfig{backendCfg}}), ErrInvalidTLS), Equals, true)
+}
+
+// Requests matching a route only go to its backends, unless none of them is
+// up, and the routes can be updated with the service.
+func (s *HTTPSuite) TestRoutes(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "Routes",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"routes-vhost"},
+		Routes: []client.RouteConfig{
+			{Header: "X-Canary", HeaderValue: "true", Backends: []string{"canary"}},
+			{Cookie: "beta", Method: "GET", Backends: []string{"canary"}},
+			{PathPrefix: "/", Backends: []string{"b0", "b1"}},
+		},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+			{Name: "b1", Addr: s.backendServers[1].addr},
+			{Name: "canary", Addr: s.backendServers[2].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+	canary := s.backendServers[2].addr
+
+	get := func(header, cookie string) string {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+		req.Host = "routes-vhost"
+		if header != "" {
+			req.Header.Set("X-Canary", header)
+		}
+		if cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "beta", Value: cookie})
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		return string(body)
+	}
+
+	for i := 0; i < 4; i++ {
+		c.Assert(get("true", ""), Equals, canary)
+		c.Assert(get("", "1"), Equals, canary)
+		c.Assert(get("false", ""), Not(Equals), canary)
+	}
+
+	stats := svc.Stats()
+	c.Assert(stats.Routes, HasLen, 3)
+	c.Assert(stats.Routes[0].Count, Equals, int64(4))
+	c.Assert(stats.Routes[1].Count, Equals, int64(4))
+	c.Assert(stats.Routes[2].Count, Equals, int64(4))
+
+	// with the canary down, its requests go to any backend that's up
+	c.Assert(Registry.SetBackendAdminState("Routes", "canary", client.AdminStateDown), IsNil)
+	c.Assert(get("true", ""), Not(Equals), canary)
+	stats = svc.Stats()
+	c.Assert(stats.Routes[0].Count, Equals, int64(5))
+	c.Assert(stats.Routes[0].Fallbacks, Equals, int64(1))
+	c.Assert(Registry.SetBackendAdminState("Routes", "canary", client.AdminStateUp), IsNil)
+
+	// a change to the routes replaces them, and their counts
+	svcCfg.Routes = svcCfg.Routes[:1]
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(svc.Config().Routes, DeepEquals, svcCfg.Routes)
+	c.Assert(svc.Stats().Routes[0].Count, Equals, int64(0))
+
+	svcCfg.Routes = []client.RouteConfig{{Backends: []string{"canary"}}}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, "invalid route 0: no header, cookie, path_prefix or method to match")
+	svcCfg.Routes = []client.RouteConfig{{PathPrefix: "beta", Backends: []string{"canary"}}}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, "invalid route 0: path_prefix .* must start with /")
+}
+
+// /_health requires each service with backends, or only the critical ones,
+// to have enough backends up, and lists those that don't.
+func (s *HTTPSuite) TestHealthBackends(c *C) {
+	defer func(ttl time.Duration) { healthSnapshotTTL = ttl }(healthSnapshotTTL)
+	healthSnapshotTTL = 0
+
+	for i, name := range []string{"HealthA", "HealthB"} {
+		svcCfg := client.ServiceConfig{
+			Name: name,
+			Addr: fmt.Sprintf("127.0.0.1:%d", 2010+i),
+			Backends: []client.BackendConfig{
+				{Name: "b0", Addr: s.servers[0].addr},
+				{Name: "b1", Addr: s.servers[1].addr},
+				{Name: "b2", Addr: s.servers[2].addr},
+			},
+		}
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+	// an empty service isn't required
+	if err := Registry.AddService(client.ServiceConfig{Name: "HealthEmpty", Addr: "127.0.0.1:2012"}); err != nil {
+		c.Fatal(err)
+	}
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	health, err := shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Status, Equals, "ok")
+	c.Assert(health.Unhealthy, HasLen, 0)
+
+	setState := func(svc, backend, state string) {
+		if err := Registry.SetBackendAdminState(svc, backend, state); err != nil {
+			c.Fatal(err)
+		}
+	}
+	setState("HealthB", "b0", client.AdminStateDown)
+	setState("HealthB", "b1", client.AdminStateDown)
+
+	// one backend up is enough by default
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Status, Equals, "ok")
+
+	setState("HealthB", "b2", client.AdminStateDown)
+	resp, err := http.Get(s.httpSvr.URL + "/_health")
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Status, Equals, "unhealthy")
+	c.Assert(health.Unhealthy, DeepEquals, []client.ServiceHealth{
+		{Name: "HealthB", Up: 0, Backends: 3, Down: []string{"b0", "b1", "b2"}},
+	})
+
+	// only the critical services count, and they need half their backends
+	cfg := client.Config{HealthServices: []string{"HealthA"}, HealthMinUpPercent: 50}
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Status, Equals, "ok")
+
+	setState("HealthA", "b1", client.AdminStateDown)
+	setState("HealthA", "b2", client.AdminStateDown)
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Status, Equals, "unhealthy")
+	c.Assert(health.Unhealthy, DeepEquals, []client.ServiceHealth{
+		{Name: "HealthA", Up: 1, Backends: 3, Down: []string{"b1", "b2"}},
+	})
+
+	// a critical service that only redirects needs no backends, and isn't
+	// reported empty
+	redirectCfg := client.ServiceConfig{
+		Name:      "HealthRedirect",
+		Addr:      "127.0.0.1:2013",
+		Redirects: []client.RedirectConfig{{Target: "https://example.com{path}"}},
+	}
+	c.Assert(Registry.AddService(redirectCfg), IsNil)
+	cfg = client.Config{HealthServices: []string{"HealthRedirect"}}
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Status, Equals, "ok")
+	c.Assert(health.Unhealthy, HasLen, 0)
+	c.Assert(health.Empty, DeepEquals, []string{"HealthEmpty"})
+
+	// a missing critical service is unhealthy
+	cfg = client.Config{HealthServices: []string{"HealthMissing"}}
+	c.Assert(Registry.UpdateConfig(cfg), IsNil)
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Unhealthy, DeepEquals, []client.ServiceHealth{
+		{Name: "HealthMissing", Up: 0, Backends: 0, Down: []string{}},
+	})
+
+	// the snapshot is reused until it expires
+	healthSnapshotTTL = time.Hour
+	c.Assert(Registry.UpdateConfig(client.Config{HealthServices: []string{}}), IsNil)
+	health, err = shuttle.Health()
+	c.Assert(err, IsNil)
+	c.Assert(health.Unhealthy[0].Name, Equals, "HealthMissing")
+
+	c.Assert(Registry.UpdateConfig(client.Config{HealthMinUpPercent: 101}), ErrorMatches, ErrInvalidHealth.Error()+".*")
+}
+
+// A request that takes longer than the service's MaxRequestTime gets a 504,
+// or is cut off if its response has started, unless it's a stream that's
+// allowed.
+func (s *HTTPSuite) TestMaxRequestTime(c *C) {
+	drip := func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 20; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			w.Write([]byte("."))
+			w.(http.Flusher).Flush()
+		}
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			drip(w, r)
+		default:
+			drip(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:           "MaxTime",
+		Addr:           "127.0.0.1:9000",
+		VirtualHosts:   []string{"max-time-vhost"},
+		MaxRequestTime: 200,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: strings.TrimPrefix(backend.URL, "http://")},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		req.Host = "max-time-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	start := time.Now()
+	status, _ := get("/slow")
+	c.Assert(status, Equals, http.StatusGatewayTimeout)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(svc.Stats().MaxRequestTimeExceeded, Equals, int64(1))
+
+	// the drip started the response, so it's cut short
+	start = time.Now()
+	status, body := get("/drip")
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(len(body) < 20, Equals, true)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(svc.Stats().MaxRequestTimeExceeded, Equals, int64(2))
+
+	// an event stream is too, unless streams are allowed
+	_, body = get("/events")
+	c.Assert(len(body) < 20, Equals, true)
+	svcCfg.AllowStreaming = true
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	_, body = get("/events")
+	c.Assert(body, Equals, strings.Repeat(".", 20))
+	_, body = get("/drip")
+	c.Assert(len(body) < 20, Equals, true)
+	c.Assert(svc.Stats().MaxRequestTimeExceeded, Equals, int64(4))
+}
+
+// A client is trusted, and forwarded, the same way whether its address is
+// IPv4-mapped or not, and link-local addresses keep their zone.
+func (s *HTTPSuite) TestClientAddrNormalization(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:            "AddrSvc",
+		Addr:            "127.0.0.1:9000",
+		VirtualHosts:    []string{"addr-vhost"},
+		TrustedNetworks: []string{"10.0.0.0/8", "fe80::/10"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	for _, t := range []struct {
+		remoteAddr, prior string
+		trusted           bool
+		forwarded         string
+	}{
+		{"10.0.0.5:5555", "", true, "10.0.0.5"},
+		{"[::ffff:10.0.0.5]:5555", "", true, "10.0.0.5"},
+		{"[::ffff:192.168.0.1]:5555", "", false, "192.168.0.1"},
+		{"[fe80::1%eth0]:5555", "", true, "fe80::1%eth0"},
+		{"[::ffff:10.0.0.5]:5555", "::ffff:172.16.0.1", true, "172.16.0.1, 10.0.0.5"},
+	} {
+		comment := Commentf("%s", t.remoteAddr)
+		req, _ := http.NewRequest("GET", "http://addr-vhost/headers", nil)
+		req.RemoteAddr = t.remoteAddr
+		req.RequestURI = "/headers"
+		if t.prior != "" {
+			req.Header.Set("X-Forwarded-For", t.prior)
+		}
+
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, http.StatusOK, comment)
+		c.Assert(w.Header().Get(AttemptsHeader) != "", Equals, t.trusted, comment)
+
+		var headers http.Header
+		if err := json.Unmarshal(w.Body.Bytes(), &headers); err != nil {
+			c.Fatal(err)
+		}
+		c.Assert(headers.Get("X-Forwarded-For"), Equals, t.forwarded, comment)
+	}
+}
+
+// Forwarding headers from a client are passed on and added to by default, and
+// stripped from untrusted clients when the service strips them.
+func (s *HTTPSuite) TestForwardedHeaders(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:            "FwdSvc",
+		Addr:            "127.0.0.1:9000",
+		VirtualHosts:    []string{"fwd-vhost"},
+		TrustedNetworks: []string{"10.0.0.0/8"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	// send a request through the service, returning the headers the backend
+	// saw
+	proxy := func(remoteAddr string, sent http.Header) http.Header {
+		req, _ := http.NewRequest("GET", "http://fwd-vhost/headers", nil)
+		req.RemoteAddr = remoteAddr
+		req.RequestURI = "/headers"
+		for key, vals := range sent {
+			req.Header[key] = vals
+		}
+
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, http.StatusOK)
+
+		var headers http.Header
+		if err := json.Unmarshal(w.Body.Bytes(), &headers); err != nil {
+			c.Fatal(err)
+		}
+		return headers
+	}
+	forwarded := func(h http.Header) []string {
+		return []string{
+			h.Get("X-Forwarded-For"),
+			h.Get("X-Real-IP"),
+			h.Get("X-Forwarded-Proto"),
+			h.Get("X-Forwarded-Host"),
+		}
+	}
+	spoofed := http.Header{
+		"X-Forwarded-For":   {"6.6.6.6"},
+		"X-Real-Ip":         {"6.6.6.6"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"evil.test"},
+		"Forwarded":         {"for=6.6.6.6"},
+	}
+
+	// the first proxy describes the client, and a second chains on to it
+	first := proxy("192.168.0.1:5555", nil)
+	c.Assert(forwarded(first), DeepEquals, []string{"192.168.0.1", "192.168.0.1", "http", "fwd-vhost"})
+
+	chained := http.Header{}
+	for _, h := range forwardingHeaders {
+		if v := first.Get(h); v != "" {
+			chained.Set(h, v)
+		}
+	}
+	second := proxy("10.0.0.5:5555", chained)
+	c.Assert(forwarded(second), DeepEquals, []string{"192.168.0.1, 10.0.0.5", "192.168.0.1", "http", "fwd-vhost"})
+
+	// by default, even an untrusted client's headers are passed on
+	c.Assert(forwarded(proxy("192.168.0.1:5555", spoofed)), DeepEquals,
+		[]string{"6.6.6.6, 192.168.0.1", "6.6.6.6", "https", "evil.test"})
+
+	svcCfg.ForwardedHeaders = client.ForwardedStrip
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svc.Config().ForwardedHeaders, Equals, client.ForwardedStrip)
+
+	// a malicious client's headers are replaced
+	headers := proxy("192.168.0.1:5555", spoofed)
+	c.Assert(forwarded(headers), DeepEquals, []string{"192.168.0.1", "192.168.0.1", "http", "fwd-vhost"})
+	c.Assert(headers.Get("Forwarded"), Equals, "")
+
+	// while a trusted proxy's are still chained
+	second = proxy("10.0.0.5:5555", chained)
+	c.Assert(forwarded(second), DeepEquals, []string{"192.168.0.1, 10.0.0.5", "192.168.0.1", "http", "fwd-vhost"})
+
+	// and a spoofed X-Forwarded-Proto doesn't avoid the HTTPS redirect
+	svcCfg.HTTPSRedirect = true
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "http://fwd-vhost/headers", nil)
+	req.RemoteAddr = "192.168.0.1:5555"
+	req.RequestURI = "/headers"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+	c.Assert(w.Code, Equals, http.StatusMovedPermanently)
+
+	svcCfg.ForwardedHeaders = "ignore"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidForwarded.Error()+".*")
+}
+
+// A service's requests go to its own access log, and requests to services
+// without one go to the global access log.
+func (s *HTTPSuite) TestAccessLog(c *C) {
+	srv := s.backendServers[0]
+	dir := c.MkDir()
+	svcLog := filepath.Join(dir, "service.log")
+	globalLog := filepath.Join(dir, "global.log")
+
+	svcCfg := client.ServiceConfig{
+		Name:         "AccessLogSvc",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"access.test"},
+		AccessLog: &client.AccessLogConfig{
+			Path:   svcLog,
+			Format: "{{.Service}} {{.Host}} {{.Method}} {{.URI}} {{.Status}} {{.Backend}} {{.BytesSent}}",
+		},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	otherCfg := client.ServiceConfig{
+		Name:            "NoAccessLogSvc",
+		Addr:            "127.0.0.1:9001",
+		VirtualHosts:    []string{"other.test"},
+		MaintenanceMode: true,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: srv.addr},
+		},
+	}
+	if err := Registry.AddService(otherCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.UpdateConfig(client.Config{AccessLog: &client.AccessLogConfig{Path: globalLog, Format: client.AccessLogCommon}}), IsNil)
+	defer Registry.UpdateConfig(client.Config{AccessLog: &client.AccessLogConfig{}})
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "access.test", srv.addr, 200, c)
+	req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+	req.Host = "other.test"
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	logFiles.flush()
+
+	data, err := ioutil.ReadFile(svcLog)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, fmt.Sprintf("AccessLogSvc access.test GET /addr 200 %s %d\n", srv.addr, len(srv.addr)))
+
+	data, err = ioutil.ReadFile(globalLog)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), `"GET /addr HTTP/1.1" 503`), Equals, true, Commentf("%s", data))
+	c.Assert(strings.Count(string(data), "\n"), Equals, 1)
+
+	c.Assert(Registry.GetService("AccessLogSvc").Config().AccessLog, DeepEquals, svcCfg.AccessLog)
+	c.Assert(Registry.Config().AccessLog.Path, Equals, globalLog)
+	c.Assert(Registry.UpdateConfig(client.Config{AccessLog: &client.AccessLogConfig{}}), IsNil)
+	c.Assert(Registry.Config().AccessLog, IsNil)
+	c.Assert(getGlobalAccessLog(), IsNil)
+
+	svcCfg.AccessLog = &client.AccessLogConfig{Path: svcLog, Format: "{{.Nope}}"}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidAccessLog.Error()+".*")
+}
+
+func (s *HTTPSuite) TestVHostReady(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "ReadySvc",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"ready-vhost", "bare-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	emptyCfg := client.ServiceConfig{
+		Name:         "EmptySvc",
+		Addr:         "127.0.0.1:9001",
+		VirtualHosts: []string{"empty-vhost"},
+	}
+	if err := Registry.AddService(emptyCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+
+	// check that only the named check failed, or that all passed
+	checkReady := func(host string, days int, failed string) {
+		comment := Commentf("%s: %s", host, failed)
+		report, err := shuttle.VHostReady(host, days)
+		c.Assert(err, IsNil, comment)
+		c.Assert(report.Host, Equals, host, comment)
+		c.Assert(report.Ready, Equals, failed == "", comment)
+		c.Assert(report.Checks, HasLen, 5, comment)
+		for _, check := range report.Checks {
+			c.Assert(check.OK, Equals, check.Name != failed, Commentf("%s: %s", host, check.Detail))
+		}
+	}
+
+	checkReady("ready-vhost", 0, "")
+
+	// the probe is answered by the router, and never reaches the backend
+	svc := Registry.GetService("ReadySvc")
+	c.Assert(svc.Stats().HTTPConns, Equals, int64(0))
+
+	// a probe without our token is proxied, without the header
+	req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/headers", nil)
+	req.Host = "ready-vhost"
+	req.Header.Set(ProbeHeader, "bogus")
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	var headers http.Header
+	err = json.NewDecoder(resp.Body).Decode(&headers)
+	resp.Body.Close()
+	c.Assert(err, IsNil)
+	c.Assert(headers.Get(ProbeHeader), Equals, "")
+
+	checkReady("empty-vhost", 0, client.ReadyBackends)
+
+	// an unknown vhost fails routing, which fails the other checks too
+	report, err := shuttle.VHostReady("missing-vhost", 0)
+	c.Assert(err, IsNil)
+	c.Assert(report.Ready, Equals, false)
+	c.Assert(report.Checks[0].Name, Equals, client.ReadyRouting)
+	c.Assert(report.Checks[0].OK, Equals, false)
+
+	// a second service claiming the vhost
+	otherCfg := svcCfg
+	otherCfg.Name = "OtherSvc"
+	otherCfg.Addr = "127.0.0.1:9002"
+	otherCfg.VirtualHosts = []string{"ready-vhost"}
+	if err := Registry.AddService(otherCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkReady("ready-vhost", 0, client.ReadyOwner)
+	if err := Registry.RemoveService("OtherSvc"); err != nil {
+		c.Fatal(err)
+	}
+
+	cert, err := testCert("ready-vhost", 30*24*time.Hour)
+	if err != nil {
+		c.Fatal(err)
+	}
+	httpsRouter = NewHostRouter(&http.Server{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer func() { httpsRouter = nil }()
+
+	checkReady("ready-vhost", 0, "")
+	checkReady("ready-vhost", 60, client.ReadyCertificate)
+	checkReady("bare-vhost", 0, client.ReadyCertificate)
+
+	// nothing to send the probe through
+	defer func(h *HostRouter) { httpRouter = h }(httpRouter)
+	httpRouter, httpsRouter = nil, nil
+	checkReady("ready-vhost", 0, client.ReadySelfRequest)
+}
+
+func (s *HTTPSuite) TestTags(c *C) {
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+
+	payments := client.ServiceConfig{
+		Name:         "Payments",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"payments-vhost"},
+		Tags:         map[string]string{"team": "payments", "env": "prod"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr, Tags: map[string]string{"rack": "r1"}},
+		},
+	}
+	search := client.ServiceConfig{
+		Name: "Search",
+		Addr: "127.0.0.1:9001",
+		Tags: map[string]string{"team": "search", "env": "prod"},
+	}
+	plain := client.ServiceConfig{
+		Name: "Plain",
+		Addr: "127.0.0.1:9002",
+	}
+	for _, svcCfg := range []client.ServiceConfig{payments, search, plain} {
+		if err := shuttle.UpdateService(&svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	bad := plain
+	bad.Name = "Bad"
+	bad.Addr = "127.0.0.1:9003"
+	bad.Tags = map[string]string{"team name": "x"}
+	c.Assert(shuttle.UpdateService(&bad), NotNil)
+
+	// the tags round trip through the config
+	cfg, err := shuttle.GetConfig()
+	if err != nil {
+		c.Fatal(err)
+	}
+	for _, svcCfg := range cfg.Services {
+		if svcCfg.Name == "Payments" {
+			c.Assert(svcCfg.Tags, DeepEquals, payments.Tags)
+			c.Assert(svcCfg.Backends[0].Tags, DeepEquals, payments.Backends[0].Tags)
+		}
+	}
+
+	names := func(path, query string) []string {
+		resp, err := http.Get(s.httpSvr.URL + path + "?" + query)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var found []string
+		if path == "/_config" {
+			cfg := client.Config{}
+			c.Assert(json.NewDecoder(resp.Body).Decode(&cfg), IsNil)
+			for _, svc := range cfg.Services {
+				found = append(found, svc.Name)
+			}
+		} else {
+			var stats []ServiceStat
+			c.Assert(json.NewDecoder(resp.Body).Decode(&stats), IsNil)
+			for _, svc := range stats {
+				found = append(found, svc.Name)
+			}
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	for _, path := range []string{"/_stats", "/_config"} {
+		c.Assert(names(path, "tag=team:payments"), DeepEquals, []string{"Payments"})
+		c.Assert(names(path, "tag=env:prod"), DeepEquals, []string{"Payments", "Search"})
+		c.Assert(names(path, "tag=env:prod&tag=team:search"), DeepEquals, []string{"Search"})
+		c.Assert(names(path, "tag=team"), DeepEquals, []string{"Payments", "Search"})
+		c.Assert(names(path, "tag=env:dev"), IsNil)
+		c.Assert(names(path, ""), DeepEquals, []string{"Payments", "Plain", "Search"})
+
+		resp, err := http.Get(s.httpSvr.URL + path + "?tag=:payments")
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+	}
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "payments-vhost", s.backendServers[0].addr, 200, c)
+
+	svc := Registry.GetService("Payments")
+	backend := svc.get("b0")
+	before := svc.Stats()
+	c.Assert(before.Tags, DeepEquals, payments.Tags)
+	c.Assert(before.Backends[0].Tags, DeepEquals, payments.Backends[0].Tags)
+	c.Assert(before.Backends[0].Conns, Equals, int64(1))
+
+	// changing the tags doesn't replace the service or backend, or reset
+	// their counters
+	payments.Tags = map[string]string{"team": "payments", "env": "staging"}
+	payments.Backends[0].Tags = map[string]string{"rack": "r2"}
+	if err := shuttle.UpdateService(&payments); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(Registry.GetService("Payments"), Equals, svc)
+	c.Assert(svc.get("b0"), Equals, backend)
+
+	after := svc.Stats()
+	c.Assert(after.Tags, DeepEquals, payments.Tags)
+	c.Assert(after.Backends[0].Tags, DeepEquals, payments.Backends[0].Tags)
+	c.Assert(after.HTTPConns, Equals, before.HTTPConns)
+	c.Assert(after.Backends[0].Conns, Equals, before.Backends[0].Conns)
+
+	// a patch changes the backend's tags in place too
+	_, _, err = shuttle.PatchBackend("Payments", "b0", &client.BackendPatch{Tags: map[string]string{"rack": "r3"}}, "")
+	c.Assert(err, IsNil)
+	c.Assert(svc.get("b0"), Equals, backend)
+	c.Assert(svc.Stats().Backends[0].Tags, DeepEquals, map[string]string{"rack": "r3"})
+
+	c.Assert(names("/_stats", "tag=env:staging"), DeepEquals, []string{"Payments"})
+}
+
+func (s *HTTPSuite) TestTagLogs(c *C) {
+	logged := captureLogs()
+	defer logged.stop()
+
+	payments := client.ServiceConfig{
+		Name:         "Payments",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"payments-vhost"},
+		Tags:         map[string]string{"team": "payments", "env": "prod"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	search := client.ServiceConfig{
+		Name:                    "Search",
+		Addr:                    "127.0.0.1:9001",
+		Tags:                    map[string]string{"team": "search", "env": "prod"},
+		DeferListenUntilHealthy: true,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr},
+		},
+	}
+	for _, svcCfg := range []client.ServiceConfig{payments, search} {
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	// the deferred service logs an event once it's listening
+	for i := 0; Registry.GetService("Search").ListenState() != ListenListening; i++ {
+		if i > 100 {
+			c.Fatal("Search isn't listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "payments-vhost", s.backendServers[0].addr, 200, c)
+
+	// the access line is logged once the response is written
+	for i := 0; !strings.Contains(logged.String(), "url=payments-vhost/addr"); i++ {
+		if i > 100 {
+			c.Fatal("request wasn't logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	out := logged.String()
+	c.Assert(strings.Contains(out, "EVENT: Search is listening on 127.0.0.1:9001, 1 backends available tags=env:prod,team:search"), Equals, true)
+	c.Assert(strings.Contains(out, "url=payments-vhost/addr"), Equals, true)
+	c.Assert(strings.Contains(out, "tags=env:prod,team:payments"), Equals, true)
+}
+
+// Access log entries are streamed to the admin API as they're logged, filtered
+// by the server.
+func (s *HTTPSuite) TestLogStream(c *C) {
+	defer func(n int) { maxLogStreams = n }(maxLogStreams)
+	maxLogStreams = 2
+
+	for _, svcCfg := range []client.ServiceConfig{
+		{
+			Name:         "Logged",
+			Addr:         "127.0.0.1:9000",
+			VirtualHosts: []string{"logged-vhost"},
+			Backends:     []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}},
+		},
+		{
+			Name:            "Refusing",
+			Addr:            "127.0.0.1:9001",
+			VirtualHosts:    []string{"refusing-vhost"},
+			NoBackendAction: client.NoBackendRefuse,
+		},
+	} {
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admin := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	failed, err := admin.TailLogs(ctx, client.LogFilter{Status: "5xx"})
+	c.Assert(err, IsNil)
+	logged, err := admin.TailLogs(ctx, client.LogFilter{Service: "Logged"})
+	c.Assert(err, IsNil)
+
+	_, err = admin.TailLogs(ctx, client.LogFilter{})
+	c.Assert(err, ErrorMatches, ".*"+ErrTooManyStreams.Error()+".*")
+	resp, err := http.Get(s.httpSvr.URL + "/_logs/stream?status=9xx")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	checkHTTP("http://"+s.httpAddr+"/addr", "logged-vhost", s.backendServers[0].addr, 200, c)
+	req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/addr", nil)
+	req.Host = "refusing-vhost"
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+
+	next := func(entries <-chan client.LogEntry) client.LogEntry {
+		select {
+		case e := <-entries:
+			return e
+		case <-time.After(time.Second):
+			c.Fatal("no log entry streamed")
+		}
+		return client.LogEntry{}
+	}
+
+	e := next(logged)
+	c.Assert(e.Type, Equals, client.LogAccess)
+	c.Assert(e.Service, Equals, "Logged")
+	c.Assert(e.Backend, Equals, "b0")
+	c.Assert(e.BackendAddr, Equals, s.backendServers[0].addr)
+	c.Assert(e.Status, Equals, http.StatusOK)
+	c.Assert(e.URL, Equals, "logged-vhost/addr")
+
+	e = next(failed)
+	c.Assert(e.Service, Equals, "Refusing")
+	c.Assert(e.Status, Equals, http.StatusServiceUnavailable)
+	c.Assert(e.Origin, Equals, originShuttle)
+	c.Assert(e.Reason, Equals, reasonNoBackends)
+
+	// the streams end with the request
+	cancel()
+	for i := 0; logTap.active(); i++ {
+		if i > 100 {
+			c.Fatal("log streams still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Services and backends coming and going, and backends changing state, are
+// streamed to every subscriber they match.
+func (s *HTTPSuite) TestEvents(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admin := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	all, err := admin.Events(ctx, "")
+	c.Assert(err, IsNil)
+	watched, err := admin.Events(ctx, "Watched")
+	c.Assert(err, IsNil)
+
+	next := func(stream <-chan client.Event) client.Event {
+		select {
+		case e := <-stream:
+			return e
+		case <-time.After(2 * time.Second):
+			c.Fatal("no event streamed")
+		}
+		return client.Event{}
+	}
+
+	err = Registry.AddService(client.ServiceConfig{Name: "Other", Addr: "127.0.0.1:9001"})
+	c.Assert(err, IsNil)
+	e := next(all)
+	c.Assert(e.Type, Equals, client.EventServiceAdded)
+	c.Assert(e.Service, Equals, "Other")
+
+	// the backend's checks fail, so it goes down after the first one
+	err = Registry.AddService(client.ServiceConfig{
+		Name:          "Watched",
+		Addr:          "127.0.0.1:9000",
+		CheckInterval: 50,
+		Fall:          1,
+		Tags:          map[string]string{"team": "payments"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr, CheckAddr: "127.0.0.1:1", Tags: map[string]string{"rack": "r1"}},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	for _, stream := range []<-chan client.Event{all, watched} {
+		e = next(stream)
+		c.Assert(e.Type, Equals, client.EventServiceAdded)
+		c.Assert(e.Service, Equals, "Watched")
+		c.Assert(e.ServiceTags, DeepEquals, map[string]string{"team": "payments"})
+
+		e = next(stream)
+		c.Assert(e.Type, Equals, client.EventBackendAdded)
+		c.Assert(e.Backend, Equals, "b0")
+		c.Assert(e.NewState, Equals, StateUp)
+		c.Assert(e.ServiceTags, DeepEquals, map[string]string{"team": "payments"})
+		c.Assert(e.BackendTags, DeepEquals, map[string]string{"rack": "r1"})
+
+		e = next(stream)
+		c.Assert(e.Type, Equals, client.EventBackendState)
+		c.Assert(e.Service, Equals, "Watched")
+		c.Assert(e.Backend, Equals, "b0")
+		c.Assert(e.OldState, Equals, StateUp)
+		c.Assert(e.NewState, Equals, StateDown)
+		c.Assert(e.Failures, Equals, 1)
+		c.Assert(e.Time.IsZero(), Equals, false)
+	}
+
+	c.Assert(Registry.RemoveService("Watched"), IsNil)
+	for _, stream := range []<-chan client.Event{all, watched} {
+		e = next(stream)
+		c.Assert(e.Type, Equals, client.EventBackendRemoved)
+		c.Assert(e.OldState, Equals, StateDown)
+		e = next(stream)
+		c.Assert(e.Type, Equals, client.EventServiceRemoved)
+		c.Assert(e.Service, Equals, "Watched")
+		c.Assert(e.ServiceTags, DeepEquals, map[string]string{"team": "payments"})
+	}
+
+	// disconnecting removes the subscribers
+	cancel()
+	for i := 0; atomic.LoadInt32(&events.open) > 0; i++ {
+		if i > 100 {
+			c.Fatal("event subscribers still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Each service reads, generates and propagates request IDs its own way, and
+// the response, the backend and the access log all see the same ID.
+func (s *HTTPSuite) TestRequestIDs(c *C) {
+	backend := []client.BackendConfig{{Name: "b0", Addr: s.backendServers[0].addr}}
+	for _, svcCfg := range []client.ServiceConfig{
+		{
+			Name:                "Trusted",
+			Addr:                "127.0.0.1:9000",
+			VirtualHosts:        []string{"trusted-ids"},
+			Backends:            backend,
+			TrustedNetworks:     []string{"127.0.0.1"},
+			RequestIDHeader:     "x-correlation-id",
+			RequestIDCopyHeader: "X-Backend-Trace",
+			RequestIDInbound:    client.RequestIDTrust,
+			RequestIDFormat:     client.RequestIDULID,
+		},
+		{
+			Name:             "Untrusted",
+			Addr:             "127.0.0.1:9001",
+			VirtualHosts:     []string{"untrusted-ids"},
+			Backends:         backend,
+			TrustedNetworks:  []string{"10.0.0.0/8"},
+			RequestIDInbound: client.RequestIDTrust,
+			RequestIDFormat:  client.RequestIDUUIDv7,
+		},
+		{
+			Name:             "Generated",
+			Addr:             "127.0.0.1:9002",
+			VirtualHosts:     []string{"generated-ids"},
+			Backends:         backend,
+			RequestIDInbound: client.RequestIDGenerate,
+		},
+	} {
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	admin := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	logged, err := admin.TailLogs(ctx, client.LogFilter{})
+	c.Assert(err, IsNil)
+
+	// send a request with an inbound ID, and return the ID in the response,
+	// the headers the backend saw, and the ID in the access log
+	send := func(host, header, inbound string) (string, http.Header, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/headers", nil)
+		req.Host = host
+		if inbound != "" {
+			req.Header.Set(header, inbound)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+
+		var seen http.Header
+		c.Assert(json.NewDecoder(resp.Body).Decode(&seen), IsNil)
+
+		var e client.LogEntry
+		select {
+		case e = <-logged:
+		case <-time.After(time.Second):
+			c.Fatal("no access log entry")
+		}
+		return resp.Header.Get(header), seen, e.ID
+	}
+
+	id, seen, logID := send("trusted-ids", "X-Correlation-Id", "edge-123")
+	c.Assert(id, Equals, "edge-123")
+	c.Assert(seen.Get("X-Correlation-Id"), Equals, id)
+	c.Assert(seen.Get("X-Backend-Trace"), Equals, id)
+	c.Assert(logID, Equals, id)
+
+	// an ID that would corrupt the log isn't trusted
+	id, _, _ = send("trusted-ids", "X-Correlation-Id", strings.Repeat("x", 200))
+	c.Assert(id, Matches, "[0-9A-HJKMNP-TV-Z]{26}\\.x{200}")
+
+	id, seen, logID = send("trusted-ids", "X-Correlation-Id", "")
+	c.Assert(id, Matches, "[0-9A-HJKMNP-TV-Z]{26}")
+	c.Assert(seen.Get("X-Backend-Trace"), Equals, id)
+	c.Assert(logID, Equals, id)
+
+	// an untrusted client's ID is chained after a new one
+	id, seen, logID = send("untrusted-ids", "X-Request-Id", "edge-123")
+	c.Assert(id, Matches, "[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\\.edge-123")
+	c.Assert(seen.Get("X-Request-Id"), Equals, id)
+	c.Assert(logID, Equals, id)
+
+	id, seen, logID = send("generated-ids", "X-Request-Id", "edge-123")
+	c.Assert(id, Matches, "[0-9a-f]{16}")
+	c.Assert(seen.Get("X-Request-Id"), Equals, id)
+	c.Assert(logID, Equals, id)
+
+	cfg := Registry.GetService("Trusted").Config()
+	c.Assert(cfg.RequestIDHeader, Equals, "X-Correlation-Id")
+	c.Assert(cfg.RequestIDFormat, Equals, client.RequestIDULID)
+	c.Assert(Registry.GetService("Generated").Config().RequestIDFormat, Equals, "")
+}
+
+// Servers replaced by SetMaxHeaderBytes are dropped once their connections
+// are done.
+func (s *HTTPSuite) TestRetiredServers(c *C) {
+	r := NewHostRouter(&http.Server{Addr: "127.0.0.1:0"})
+	if err := r.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
+	defer r.Stop(context.Background())
+
+	// hold a keepalive connection open on the first server
+	resp, err := http.Get("http://" + r.Addr().String() + "/")
+	c.Assert(err, IsNil)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	for i := 0; i < 100; i++ {
+		r.SetMaxHeaderBytes(64<<10 + i)
+	}
+
+	for i := 0; r.retiredLen() > 0; i++ {
+		if i > 200 {
+			c.Fatalf("%d servers still retired", r.retiredLen())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(r.MaxHeaderBytes(), Equals, 64<<10+99)
+}
+
+// Rename a service under load, and check the old name's hint during and
+// after the grace period.
+func (s *HTTPSuite) TestRenameService(c *C) {
+	defer func(d time.Duration) { renameGrace = d }(renameGrace)
+
+	svcCfg := client.ServiceConfig{
+		Name:         "RenameOld",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"rename-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+			{Name: "b1", Addr: s.backendServers[1].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("RenameOld")
+
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+
+	// keep requests running through the router and the service's listener
+	stop := make(chan struct{})
+	var failed, sent int64
+	var wg sync.WaitGroup
+	for _, url := range []string{"http://" + s.httpAddr + "/addr", "http://127.0.0.1:9000/addr"} {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			httpClient := &http.Client{Transport: &http.Transport{}}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req, _ := http.NewRequest("GET", url, nil)
+				req.Host = "rename-vhost"
+				resp, err := httpClient.Do(req)
+				if err == nil {
+					ioutil.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+				if err != nil || resp.StatusCode != http.StatusOK {
+					atomic.AddInt64(&failed, 1)
+				}
+				atomic.AddInt64(&sent, 1)
+			}
+		}(url)
+	}
+
+	for atomic.LoadInt64(&sent) < 50 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(shuttle.RenameService("RenameOld", "RenameNew"), IsNil)
+	for n := atomic.LoadInt64(&sent); atomic.LoadInt64(&sent) < n+50; {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	c.Assert(atomic.LoadInt64(&failed), Equals, int64(0))
+
+	// the same service, with its stats, under the new name only
+	c.Assert(Registry.GetService("RenameOld"), IsNil)
+	c.Assert(Registry.GetService("RenameNew"), Equals, svc)
+	stats, err := Registry.ServiceStats("RenameNew")
+	c.Assert(err, IsNil)
+	c.Assert(stats.Name, Equals, "RenameNew")
+	c.Assert(stats.HTTPConns > 0, Equals, true)
+	c.Assert(Registry.GetVHostService("rename-vhost"), Equals, svc)
+
+	// the old name points to the new one
+	resp, err := http.Get(s.httpSvr.URL + "/RenameOld")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(string(body), Equals, "service does not exist, renamed to: RenameNew\n")
+
+	// conflicts and invalid names change nothing
+	other := client.ServiceConfig{Name: "RenameOther", Addr: "127.0.0.1:9001"}
+	if err := Registry.AddService(other); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(shuttle.RenameService("RenameNew", "RenameOther"), Equals, client.ErrServiceExists)
+	c.Assert(shuttle.RenameService("RenameNew", "_rename"), ErrorMatches, `.*400 Bad Request: invalid name "_rename".*`)
+	c.Assert(shuttle.RenameService("RenameOld", "RenameAgain"), ErrorMatches, `.*404 Not Found: service does not exist, renamed to: RenameNew`)
+	c.Assert(Registry.GetService("RenameNew"), Equals, svc)
+
+	// renaming again updates the old hints, until the grace period expires
+	renameGrace = 50 * time.Millisecond
+	c.Assert(shuttle.RenameService("RenameNew", "RenameLast"), IsNil)
+	c.Assert(Registry.RenamedTo("RenameOld"), Equals, "RenameLast")
+	c.Assert(Registry.RenamedTo("RenameNew"), Equals, "RenameLast")
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(Registry.RenamedTo("RenameNew"), Equals, "")
+
+	resp, err = http.Get(s.httpSvr.URL + "/RenameNew")
+	c.Assert(err, IsNil)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(strings.Contains(string(body), "renamed"), Equals, false)
+
+	// a new service with an old name replaces its hint
+	c.Assert(Registry.AddService(client.ServiceConfig{Name: "RenameOld", Addr: "127.0.0.1:9002"}), IsNil)
+	c.Assert(Registry.RenamedTo("RenameOld"), Equals, "")
+}
+
+// memStore is an in-memory StateStore. Each value is tagged with whether we
+// saved it, so the watch only applies values written by others. Like a watch
+// from the index that was read, values already loaded aren't applied.
+type memStore struct {
+	sync.Mutex
+	value   []byte
+	ours    bool
+	err     error
+	version int
+	seen    int
+	changed chan struct{}
+}
+
+func newMemStore() *memStore {
+	return &memStore{changed: make(chan struct{})}
+}
+
+func (m *memStore) Load() ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	if m.value == nil {
+		return nil, fmt.Errorf("no value")
+	}
+	m.seen = m.version
+	return m.value, nil
+}
+
+func (m *memStore) Save(cfg []byte) error {
+	return m.put(cfg, true)
+}
+
+func (m *memStore) put(cfg []byte, ours bool) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.value, m.ours = cfg, ours
+	m.version++
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return nil
+}
+
+// fail every call with err until it's nil again
+func (m *memStore) fail(err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.err = err
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *memStore) Watch(stop <-chan struct{}, apply func([]byte)) error {
+	for {
+		m.Lock()
+		changed, err := m.changed, m.err
+		value, external := m.value, m.version > m.seen && !m.ours
+		m.seen = m.version
+		m.Unlock()
+
+		if err != nil {
+			return err
+		}
+		if external {
+			apply(value)
+			continue
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-changed:
+		}
+	}
+}
+
+func (m *memStore) String() string {
+	return "mem"
+}
+
+// Save, load and watch the state config in a remote store, and degrade like
+// the state file when it fails.
+func (s *HTTPSuite) TestStateStore(c *C) {
+	setStore := func(store StateStore, policy string, retry time.Duration) {
+		configMutex.Lock()
+		remoteState, statePolicy, stateRetryInterval = store, policy, retry
+		configMutex.Unlock()
+	}
+	configMutex.Lock()
+	defer setStore(remoteState, statePolicy, stateRetryInterval)
+	configMutex.Unlock()
+
+	mem := newMemStore()
+	setStore(mem, StateReadonly, time.Hour)
+
+	getState := func() StateStatus {
+		var status StateStatus
+		resp, err := http.Get(s.httpSvr.URL + "/_state")
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+		return status
+	}
+	addBackend := func(name string) int {
+		req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/StoreSvc/"+name, strings.NewReader(`{"address": "127.0.0.1:9001"}`))
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	external := func(svcCfg client.ServiceConfig) {
+		cfg := client.Config{Services: []client.ServiceConfig{svcCfg}}
+		c.Assert(mem.put(cfg.Marshal(), false), IsNil)
+	}
+
+	// saves go to the store
+	c.Assert(Registry.AddService(client.ServiceConfig{Name: "StoreSvc", Addr: "127.0.0.1:9000"}), IsNil)
+	writeStateConfig()
+	saved, err := mem.Load()
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(saved), `"StoreSvc"`), Equals, true)
+	c.Assert(getState().Path, Equals, "mem")
+
+	// and are loaded at startup
+	external(client.ServiceConfig{Name: "StoreLoaded", Addr: "127.0.0.1:9002"})
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("StoreLoaded"), NotNil)
+
+	// wait for the loaded config to be saved back with both services
+	for i := 0; ; i++ {
+		mem.Lock()
+		done := mem.ours && strings.Contains(string(mem.value), `"StoreLoaded"`)
+		mem.Unlock()
+		if done {
+			break
+		}
+		if i > 100 {
+			c.Fatal("loaded config wasn't saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// external changes are applied, but not our own saves
+	var applied int64
+	w := newStateWatcher(mem)
+	w.apply = func(cfg []byte) {
+		atomic.AddInt64(&applied, 1)
+		applyStateConfig(cfg)
+	}
+	c.Assert(w.Start(context.Background()), IsNil)
+	defer w.Stop(context.Background())
+
+	external(client.ServiceConfig{
+		Name:     "StoreSvc",
+		Addr:     "127.0.0.1:9000",
+		Backends: []client.BackendConfig{{Name: "b1", Addr: "127.0.0.1:9001"}},
+	})
+	for i := 0; Registry.GetService("StoreSvc").get("b1") == nil; i++ {
+		if i > 100 {
+			c.Fatal("external change wasn't applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(getState().Watching, Equals, true)
+
+	c.Assert(addBackend("b2"), Equals, http.StatusOK)
+	writeStateConfig()
+	saved, _ = mem.Load()
+	c.Assert(strings.Contains(string(saved), `"b2"`), Equals, true)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(atomic.LoadInt64(&applied), Equals, int64(1))
+
+	// a failing store is reported, and makes the config readonly
+	configMutex.Lock()
+	stateRetryInterval = 10 * time.Millisecond
+	configMutex.Unlock()
+	mem.fail(fmt.Errorf("store unavailable"))
+	c.Assert(addBackend("b3"), Equals, http.StatusOK)
+	writeStateConfig()
+	c.Assert(addBackend("b4"), Equals, http.StatusInsufficientStorage)
+
+	for i := 0; getState().Watching; i++ {
+		if i > 100 {
+			c.Fatal("watch didn't fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := getState()
+	c.Assert(status.Readonly, Equals, true)
+	c.Assert(status.LastError, Equals, "store unavailable")
+	c.Assert(status.WatchError, Equals, "store unavailable")
+	c.Assert(status.WatchFailures > 0, Equals, true)
+
+	// and both recover once it's back
+	mem.fail(nil)
+	for i := 0; !getState().Watching || getState().Readonly; i++ {
+		if i > 100 {
+			c.Fatal("watch didn't restart")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(addBackend("b4"), Equals, http.StatusOK)
+}
+
+// A state config from a newer shuttle stops the config from loading unless
+// the policy is best-effort, and saves are always the current schema.
+func (s *HTTPSuite) TestStateSchema(c *C) {
+	configMutex.Lock()
+	defer func(store StateStore, newer string) {
+		configMutex.Lock()
+		remoteState, stateNewer = store, newer
+		configMutex.Unlock()
+	}(remoteState, stateNewer)
+	mem := newMemStore()
+	remoteState = mem
+	configMutex.Unlock()
+
+	newer := `{"schema_version": 99, "services": [{"name": "Newer", "address": "127.0.0.1:9000", "tier": "gold"}]}`
+	c.Assert(mem.put([]byte(newer), false), IsNil)
+
+	err := loadConfig()
+	c.Assert(err, ErrorMatches, "mem: "+ErrStateNewer.Error()+": .*")
+	c.Assert(Registry.GetService("Newer"), IsNil)
+
+	configMutex.Lock()
+	stateNewer = StateNewerBestEffort
+	configMutex.Unlock()
+	c.Assert(loadConfig(), IsNil)
+	c.Assert(Registry.GetService("Newer"), NotNil)
+
+	writeStateConfig()
+	saved, err := mem.Load()
+	c.Assert(err, IsNil)
+	var cfg client.Config
+	c.Assert(json.Unmarshal(saved, &cfg), IsNil)
+	c.Assert(cfg.SchemaVersion, Equals, stateSchema())
+	c.Assert(cfg.Services[0].Name, Equals, "Newer")
+}
+
+// Every admin endpoint needs a token once tokens are configured, and a
+// read-stats token only reaches the stats of its own services.
+func (s *HTTPSuite) TestAdminTokens(c *C) {
+	hash := func(token string) string {
+		sum := sha256.Sum256([]byte(token))
+		return hex.EncodeToString(sum[:])
+	}
+	auth, err := newAdminTokens([]AdminToken{
+		{Name: "ops", SHA256: hash("admin-secret"), Permission: PermAdmin},
+		{Name: "dashboard", SHA256: hash("stats-secret"), Permission: PermReadStats, Services: []string{"team-*"}},
+	})
+	c.Assert(err, IsNil)
+	defer func(capture bool) { adminAuth, enableCapture = nil, capture }(enableCapture)
+	adminAuth = auth
+	// so captures aren't refused regardless of the token
+	enableCapture = true
+
+	for i, name := range []string{"team-a", "other"} {
+		svcCfg := client.ServiceConfig{
+			Name:         name,
+			Addr:         fmt.Sprintf("127.0.0.1:%d", 9000+i),
+			VirtualHosts: []string{name + ".example.com"},
+			Backends: []client.BackendConfig{
+				{Name: "b1", Addr: s.backendServers[i].addr},
+			},
+		}
+		if err := Registry.AddService(svcCfg); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	const (
+		allowed = 0
+		denied  = http.StatusForbidden
+	)
+	endpoints := []struct {
+		method, path string
+		stats        int
+	}{
+		{"GET", "/", allowed},
+		{"GET", "/_stats", allowed},
+		{"GET", "/_health", allowed},
+		{"GET", "/team-a", allowed},
+		{"GET", "/team-a/_stats", allowed},
+		{"GET", "/_vhosts/team-a.example.com/ready", allowed},
+		{"GET", "/other", denied},
+		{"GET", "/other/_stats", denied},
+		{"GET", "/_vhosts/other.example.com/ready", denied},
+		{"GET", "/_config", denied},
+		{"GET", "/_router", denied},
+		{"GET", "/_state", denied},
+		{"GET", "/_billing", denied},
+		{"GET", "/_checkinfo", denied},
+		{"GET", "/_debug/objects", denied},
+		{"GET", "/team-a/_config", denied},
+		{"GET", "/team-a/_balance_compare", denied},
+		{"GET", "/team-a/b1", denied},
+		{"GET", "/team-a/b1/checks", denied},
+		// the mutations are on a service that doesn't exist, so they fail
+		// harmlessly when they're allowed
+		{"POST", "/_config", denied},
+		{"PUT", "/team-zzz", denied},
+		{"DELETE", "/team-zzz", denied},
+		{"POST", "/team-zzz/_weights", denied},
+		{"POST", "/team-zzz/_rename", denied},
+		{"PUT", "/team-zzz/b1", denied},
+		{"PATCH", "/team-zzz/b1", denied},
+		{"DELETE", "/team-zzz/b1", denied},
+		{"POST", "/team-zzz/b1/ready", denied},
+		{"POST", "/team-zzz/b1/checks", denied},
+		{"POST", "/team-zzz/b1/check", denied},
+		{"POST", "/team-zzz/b1/capture", denied},
+	}
+
+	do := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, s.httpSvr.URL+path, strings.NewReader("{}"))
+		if err != nil {
+			c.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, e := range endpoints {
+		comment := Commentf("%s %s", e.method, e.path)
+		for _, token := range []string{"", "wrong"} {
+			resp := do(e.method, e.path, token)
+			resp.Body.Close()
+			c.Assert(resp.StatusCode, Equals, http.StatusUnauthorized, comment)
+		}
+
+		resp := do(e.method, e.path, "admin-secret")
+		resp.Body.Close()
+		c.Assert(resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden, Equals, true, comment)
+
+		resp = do(e.method, e.path, "stats-secret")
+		resp.Body.Close()
+		if e.stats == denied {
+			c.Assert(resp.StatusCode, Equals, http.StatusForbidden, comment)
+		} else {
+			c.Assert(resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden, Equals, true, comment)
+		}
+	}
+
+	// the stats only include the token's services
+	resp := do("GET", "/_stats", "stats-secret")
+	var stats []ServiceStat
+	c.Assert(json.NewDecoder(resp.Body).Decode(&stats), IsNil)
+	resp.Body.Close()
+	c.Assert(len(stats), Equals, 1)
+	c.Assert(stats[0].Name, Equals, "team-a")
+
+	resp = do("GET", "/_stats", "admin-secret")
+	c.Assert(json.NewDecoder(resp.Body).Decode(&stats), IsNil)
+	resp.Body.Close()
+	c.Assert(len(stats), Equals, 2)
+
+	// the client sends its token, and a read-stats token can't read configs
+	cl := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	cl.SetToken("stats-secret")
+	_, err = cl.GetConfig()
+	c.Assert(err, NotNil)
+	cl.SetToken("admin-secret")
+	_, err = cl.GetConfig()
+	c.Assert(err, IsNil)
+
+	// validations are cached until they expire
+	delete(auth.tokens, hash("stats-secret"))
+	c.Assert(auth.validate("stats-secret"), NotNil)
+	e := auth.cache["stats-secret"]
+	e.expires = time.Now()
+	auth.cache["stats-secret"] = e
+	c.Assert(auth.validate("stats-secret"), IsNil)
+
+	_, err = newAdminTokens([]AdminToken{{Name: "bad", SHA256: hash("x"), Permission: "write"}})
+	c.Assert(err, ErrorMatches, ".*"+ErrTokenPermission.Error())
+	_, err = newAdminTokens([]AdminToken{{Name: "bad", SHA256: "abc", Permission: PermAdmin}})
+	c.Assert(err, ErrorMatches, "token bad: invalid sha256")
+}
+
+// The shared credentials are required for changes, and for reads too if
+// they're protected, and nothing is changed in read-only mode.
+func (s *HTTPSuite) TestAdminCredentials(c *C) {
+	creds, err := newAdminCredentials("write-secret", "ops:pass", false)
+	c.Assert(err, IsNil)
+	defer func() { adminCreds, adminReadOnly = nil, false }()
+	adminCreds = creds
+
+	do := func(method, path string, auth func(*http.Request)) int {
+		req, err := http.NewRequest(method, s.httpSvr.URL+path, nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		if auth != nil {
+			auth(req)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+	unauthorized := atomic.LoadInt64(&adminUnauthorized)
+
+	// reads are open, and changes need either credential. The service doesn't
+	// exist, so an authorized delete fails harmlessly.
+	c.Assert(do("GET", "/_config", nil), Equals, http.StatusOK)
+	for _, auth := range []func(*http.Request){nil, bearer("wrong"), basic("ops", "wrong"), basic("wrong", "pass")} {
+		c.Assert(do("DELETE", "/nosuch", auth), Equals, http.StatusUnauthorized)
+	}
+	c.Assert(do("DELETE", "/nosuch", bearer("write-secret")), Equals, http.StatusNotFound)
+	c.Assert(do("DELETE", "/nosuch", basic("ops", "pass")), Equals, http.StatusNotFound)
+	c.Assert(atomic.LoadInt64(&adminUnauthorized), Equals, unauthorized+4)
+
+	svcCfg := client.ServiceConfig{
+		Name: "creds",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b1", Addr: s.backendServers[0].addr},
+		},
+	}
+	cl := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	err = cl.UpdateService(&svcCfg)
+	c.Assert(err, FitsTypeOf, &client.APIError{})
+	c.Assert(err.(*client.APIError).StatusCode, Equals, http.StatusUnauthorized)
+	cl.SetBasicAuth("ops", "pass")
+	c.Assert(cl.UpdateService(&svcCfg), IsNil)
+
+	// the refusals are counted in the health
+	resp, err := http.Get(s.httpSvr.URL + "/_health")
+	c.Assert(err, IsNil)
+	var health client.Health
+	c.Assert(json.NewDecoder(resp.Body).Decode(&health), IsNil)
+	resp.Body.Close()
+	c.Assert(health.AdminUnauthorized, Equals, unauthorized+5)
+
+	// protected reads
+	creds.reads = true
+	c.Assert(do("GET", "/_config", nil), Equals, http.StatusUnauthorized)
+	c.Assert(do("GET", "/_config", bearer("write-secret")), Equals, http.StatusOK)
+	c.Assert(do("GET", "/_config", basic("ops", "pass")), Equals, http.StatusOK)
+
+	// read-only refuses every change, whatever the credentials
+	adminReadOnly = true
+	c.Assert(do("DELETE", "/creds", bearer("write-secret")), Equals, http.StatusForbidden)
+	c.Assert(do("DELETE", "/creds", nil), Equals, http.StatusUnauthorized)
+	svcCfg.ClientTimeout = 1000
+	err = cl.UpdateService(&svcCfg)
+	c.Assert(err, FitsTypeOf, &client.APIError{})
+	c.Assert(err.(*client.APIError).StatusCode, Equals, http.StatusForbidden)
+	for _, route := range []struct{ method, path string }{
+		{"POST", "/creds/b1/checks"},
+		{"POST", "/creds/b1/check"},
+		{"PUT", "/creds/b1/capture"},
+		{"POST", "/creds/b1/capture"},
+		{"DELETE", "/creds/b1/capture"},
+		{"POST", "/_takeover"},
+	} {
+		c.Assert(do(route.method, route.path, bearer("write-secret")), Equals, http.StatusForbidden, Commentf("%s %s", route.method, route.path))
+	}
+	c.Assert(do("GET", "/creds", bearer("write-secret")), Equals, http.StatusOK)
+	c.Assert(do("GET", "/creds/b1/checks", bearer("write-secret")), Equals, http.StatusOK)
+
+	_, err = newAdminCredentials("", "", true)
+	c.Assert(err, ErrorMatches, ErrAdminCredentials.Error()+".*")
+	_, err = newAdminCredentials("", "ops", false)
+	c.Assert(err, ErrorMatches, ErrAdminCredentials.Error()+".*")
+	creds, err = newAdminCredentials("", "", false)
+	c.Assert(err, IsNil)
+	c.Assert(creds, IsNil)
+}
+
+func (s *HTTPSuite) TestTakeoverAdmin(c *C) {
+	defer resetTakeover()
+
+	resp, err := http.Get(s.httpSvr.URL + "/_takeover")
+	c.Assert(err, IsNil)
+	var status TakeoverStatus
+	c.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+	resp.Body.Close()
+	c.Assert(status.State, Equals, TakeoverNone)
+
+	// only over the unix socket, where the descriptors can be sent
+	req, _ := http.NewRequest("POST", s.httpSvr.URL+"/_takeover", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", takeoverUpgrade)
+	resp, err = http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusBadRequest)
+
+	dir, err := ioutil.TempDir("", "shuttle-takeover")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	admin := NewAdminServer(filepath.Join(dir, "admin.sock"))
+	c.Assert(admin.Start(context.Background()), IsNil)
+	defer admin.Stop(context.Background())
+
+	conn, err := dialTakeover(admin.Addr)
+	c.Assert(err, IsNil)
+	msg, _, err := takeoverCall(conn, takeoverMsg{Op: "hello"})
+	c.Assert(err, IsNil)
+	c.Assert(msg.Op, Equals, "inventory")
+	c.Assert(msg.Config, NotNil)
+	c.Assert(msg.Listeners, DeepEquals, []TakeoverListener{
+		{Kind: "router", Name: "http", Network: "tcp", Addr: "127.0.0.1:0"},
+	})
+
+	// a second takeover is refused while the first is running
+	_, err = dialTakeover(admin.Addr)
+	c.Assert(err, ErrorMatches, "(?s).*409 Conflict.*")
+
+	conn.Close()
+	for i := 0; takeoverStatus().State == TakeoverRunning && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	status = takeoverStatus()
+	c.Assert(status.Role, Equals, "source")
+	c.Assert(status.State, Equals, TakeoverFailed)
+	c.Assert(status.Listeners["router:http"], Equals, HandoffKept)
+}
+
+// A config with an invalid service is rejected as a whole, with json errors
+// naming the service and field, and a dry run only validates it.
+func (s *HTTPSuite) TestConfigErrors(c *C) {
+	put := func(query string, cfg client.Config) (int, ConfigErrors) {
+		req, _ := http.NewRequest("PUT", s.httpSvr.URL+"/_config"+query, bytes.NewReader(cfg.Marshal()))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var errs ConfigErrors
+		if resp.StatusCode != http.StatusOK {
+			c.Assert(resp.Header.Get("Content-Type"), Equals, "application/json")
+			c.Assert(json.NewDecoder(resp.Body).Decode(&errs), IsNil)
+		}
+		return resp.StatusCode, errs
+	}
+
+	valid := client.ServiceConfig{
+		Name: "ConfigValid",
+		Addr: "127.0.0.1:9000",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	invalid := []struct {
+		svc   client.ServiceConfig
+		field string
+		err   error
+	}{
+		{
+			client.ServiceConfig{Name: "ConfigInvalid", Addr: "127.0.0.1:9001", Balance: "RANDOM"},
+			"balance", ErrInvalidBalance,
+		},
+		{
+			client.ServiceConfig{Name: "ConfigInvalid", Addr: "127.0.0.1:9001", Backends: []client.BackendConfig{
+				{Name: "b0", Addr: s.backendServers[0].addr, Weight: -1},
+			}},
+			"backends", ErrInvalidWeight,
+		},
+		{
+			client.ServiceConfig{Name: "ConfigInvalid", Addr: "127.0.0.1:9001", Backends: []client.BackendConfig{
+				{Name: "b0", Addr: s.backendServers[0].addr, Network: "udp"},
+			}},
+			"backends", ErrNetworkMismatch,
+		},
+	}
+
+	for _, t := range invalid {
+		cfg := client.Config{Services: []client.ServiceConfig{valid, t.svc}}
+		for _, query := range []string{"", "?dry_run=true"} {
+			status, errs := put(query, cfg)
+			c.Assert(status, Equals, http.StatusBadRequest)
+			c.Assert(errs.Errors, HasLen, 1)
+			c.Assert(errs.Errors[0].Service, Equals, "ConfigInvalid")
+			c.Assert(errs.Errors[0].Field, Equals, t.field, Commentf("%s", t.err))
+			c.Assert(errs.Errors[0].Error, Matches, ".*"+t.err.Error()+".*")
+			c.Assert(Registry.GetService("ConfigValid"), IsNil)
+		}
+	}
+
+	// a valid dry run changes nothing either
+	cfg := client.Config{Services: []client.ServiceConfig{valid}}
+	status, _ := put("?dry_run=true", cfg)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(Registry.GetService("ConfigValid"), IsNil)
+
+	status, _ = put("", cfg)
+	c.Assert(status, Equals, http.StatusOK)
+	c.Assert(Registry.GetService("ConfigValid"), NotNil)
+}
+
+// Each failed change is answered with a status that tells why, and the client
+// returns it as an *APIError.
+func (s *HTTPSuite) TestMutationErrors(c *C) {
+	shuttle := client.NewClient(strings.TrimPrefix(s.httpSvr.URL, "http://"))
+	svcCfg := client.ServiceConfig{Name: "ErrService", Addr: "127.0.0.1:9000"}
+	c.Assert(shuttle.UpdateService(&svcCfg), IsNil)
+
+	status := func(err error) int {
+		apiErr, ok := err.(*client.APIError)
+		c.Assert(ok, Equals, true, Commentf("%v", err))
+		return apiErr.StatusCode
+	}
+
+	// the address is already bound
+	err := shuttle.UpdateService(&client.ServiceConfig{Name: "ErrTaken", Addr: svcCfg.Addr})
+	c.Assert(status(err), Equals, http.StatusInternalServerError)
+	c.Assert(err, ErrorMatches, `.*cannot listen for ErrTaken on 127.0.0.1:9000.*`)
+
+	// a service can't move to an address that's taken, or to another network
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer taken.Close()
+	err = shuttle.UpdateService(&client.ServiceConfig{Name: "ErrService", Addr: taken.Addr().String()})
+	c.Assert(status(err), Equals, http.StatusConflict)
+	c.Assert(err.(*client.APIError).Conflict(), Equals, true)
+	c.Assert(err, ErrorMatches, `.*cannot listen for ErrService on `+taken.Addr().String()+`.*`)
+	err = shuttle.UpdateService(&client.ServiceConfig{Name: "ErrService", Addr: svcCfg.Addr, Network: "udp"})
+	c.Assert(status(err), Equals, http.StatusConflict)
+
+	// invalid configs
+	err = shuttle.UpdateService(&client.ServiceConfig{Name: "ErrService", Addr: svcCfg.Addr, Balance: "RANDOM"})
+	c.Assert(status(err), Equals, http.StatusBadRequest)
+	c.Assert(err.(*client.APIError).Invalid(), Equals, true)
+	err = shuttle.UpdateConfig(&client.Config{Balance: "RANDOM"})
+	c.Assert(status(err), Equals, http.StatusBadRequest)
+	err = shuttle.UpdateBackend("ErrService", &client.BackendConfig{Name: "udp", Addr: "127.0.0.1:9002", Network: "udp"})
+	c.Assert(status(err), Equals, http.StatusBadRequest)
+	c.Assert(err, ErrorMatches, ".*"+ErrNetworkMismatch.Error()+".*")
+
+	// missing services and backends
+	err = shuttle.RemoveService("ErrMissing")
+	c.Assert(status(err), Equals, http.StatusNotFound)
+	c.Assert(err.(*client.APIError).NotFound(), Equals, true)
+	err = shuttle.RemoveBackend("ErrService", "missing")
+	c.Assert(status(err), Equals, http.StatusNotFound)
+	err = shuttle.UpdateBackend("ErrMissing", &client.BackendConfig{Name: "b", Addr: "127.0.0.1:9002"})
+	c.Assert(status(err), Equals, http.StatusNotFound)
+	err = shuttle.SetWeights("ErrService", map[string]int{"missing": 1})
+	c.Assert(status(err), Equals, http.StatusNotFound)
+	_, _, err = shuttle.PatchBackend("ErrService", "missing", &client.BackendPatch{}, "")
+	c.Assert(status(err), Equals, http.StatusNotFound)
+
+	// nothing was changed by the failures
+	cfg, err := Registry.ServiceConfig("ErrService")
+	c.Assert(err, IsNil)
+	c.Assert(cfg.Addr, Equals, svcCfg.Addr)
+	c.Assert(cfg.Balance, Equals, client.RoundRobin)
+	c.Assert(cfg.Backends, HasLen, 0)
+	c.Assert(Registry.GetService("ErrTaken"), IsNil)
+}
+
+func (s *HTTPSuite) TestSendProxyProtocol(c *C) {
+	backend, err := NewProxyHeaderServer("127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer backend.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:              "ProxyProtoSvc",
+		Addr:              "127.0.0.1:9000",
+		VirtualHosts:      []string{"pp-vhost"},
+		SendProxyProtocol: "v1",
+		Backends: []client.BackendConfig{
+			{Name: "pp", Addr: backend.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	get := func(remoteAddr string, local net.Addr) {
+		req, _ := http.NewRequest("GET", "http://pp-vhost/", nil)
+		req.RemoteAddr = remoteAddr
+		req.RequestURI = "/"
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, req)
+		c.Assert(w.Code, Equals, http.StatusOK)
+		c.Assert(w.Body.String(), Equals, "ok")
+	}
+
+	// each request has a connection of its own, with its client's header
+	get("[2001:db8::1]:5555", &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 80})
+	c.Assert(string(backend.next(c)), Equals, "PROXY TCP6 2001:db8::1 2001:db8::2 5555 80\r\n")
+	get("[::ffff:10.0.0.1]:6666", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80})
+	c.Assert(string(backend.next(c)), Equals, "PROXY TCP4 10.0.0.1 10.0.0.2 6666 80\r\n")
+
+	svcCfg.SendProxyProtocol = "v2"
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	get("10.0.0.1:5555", &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80})
+	c.Assert(string(backend.next(c)), Equals, string(proxyV2Signature)+"\x21\x11\x00\x0c"+
+		"\x0a\x00\x00\x01\x0a\x00\x00\x02\x15\xb3\x00\x50")
+
+	// a listener without addresses gets an UNKNOWN header
+	get("@", &net.UnixAddr{Name: "/tmp/shuttle.sock", Net: "unix"})
+	c.Assert(string(backend.next(c)), Equals, string(proxyV2Signature)+"\x21\x00\x00\x00")
+}
+
+// A dialer that calls hook before dialing, and fails the dial if it returns
+// an error.
+type hookDialer struct {
+	DialerFactory
+	hook func(addr string) error
+}
+
+func (d hookDialer) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	if err := d.hook(addr); err != nil {
+		return nil, err
+	}
+	return d.DialerFactory.Dial(network, addr, timeout)
+}
+
+func (s *HTTPSuite) TestPickerRetries(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:            "PickerSvc",
+		Addr:            "127.0.0.1:9000",
+		VirtualHosts:    []string{"picker-vhost"},
+		TrustedNetworks: []string{"10.0.0.0/8"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+			{Name: "b1", Addr: s.backendServers[1].addr},
+			{Name: "b2", Addr: s.backendServers[2].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	// b1 is removed while the dial to b0 is failing
+	svc.DialerFactory = hookDialer{
+		DialerFactory: defaultDialerFactory,
+		hook: func(addr string) error {
+			if addr != s.backendServers[0].addr {
+				return nil
+			}
+			if err := Registry.RemoveBackend(svcCfg.Name, "b1"); err != nil {
+				c.Error(err)
+			}
+			return fmt.Errorf("dial timed out")
+		},
+	}
+
+	var attempted []string
+	svc.AmendCallbacks(func(chain *CallbackChain) {
+		chain.OnResponse = append(chain.OnResponse, func(pr *ProxyRequest) bool {
+			attempted = pr.Attempted
+			return true
+		})
+	})
+
+	req, _ := http.NewRequest("GET", "http://picker-vhost/addr", nil)
+	req.RemoteAddr = "10.0.0.1:5555"
+	req.RequestURI = "/addr"
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, req)
+
+	// the removed backend didn't cost an attempt
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(w.Body.String(), Equals, s.backendServers[2].addr)
+	c.Assert(w.Header().Get(AttemptsHeader), Equals, "2")
+	c.Assert(attempted, DeepEquals, []string{s.backendServers[0].addr, s.backendServers[2].addr})
+
+	// a backend added mid-request is balanced in, and none is returned twice
+	svc.DialerFactory = defaultDialerFactory
+	p := svc.NewPicker(nil)
+	first, ok := p.Next()
+	c.Assert(ok, Equals, true)
+	if err := Registry.AddBackend(svcCfg.Name, client.BackendConfig{Name: "b3", Addr: s.backendServers[3].addr}); err != nil {
+		c.Fatal(err)
+	}
+
+	seen := map[string]bool{first: true}
+	for addr, ok := p.Next(); ok; addr, ok = p.Next() {
+		c.Assert(seen[addr], Equals, false, Commentf("%s returned twice", addr))
+		seen[addr] = true
+	}
+	c.Assert(seen, DeepEquals, map[string]bool{
+		s.backendServers[0].addr: true,
+		s.backendServers[2].addr: true,
+		s.backendServers[3].addr: true,
+	})
+}
+
+// The HTTP transport's idle connections to a backend are counted in its
+// stats, and closed when it's marked down or removed.
+func (s *HTTPSuite) TestIdleConns(c *C) {
+	closed := make(chan struct{}, 10)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:                "IdleConns",
+		Addr:                "127.0.0.1:9000",
+		VirtualHosts:        []string{"idle-vhost"},
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     60000,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: strings.TrimPrefix(backend.URL, "http://")},
+		},
+	}
+
+	invalid := svcCfg
+	invalid.MaxIdleConns = -1
+	c.Assert(Registry.AddService(invalid), Equals, ErrInvalidIdleConns)
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	cfg := svc.Config()
+	c.Assert(cfg.MaxIdleConnsPerHost, Equals, 2)
+	c.Assert(cfg.MaxIdleConns, Equals, 0)
+	c.Assert(cfg.IdleConnTimeout, Equals, 60000)
+
+	get := func() {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+"/", nil)
+		req.Host = "idle-vhost"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.Assert(string(body), Equals, "ok")
+	}
+	waitIdle := func(idle int64) {
+		for i := 0; ; i++ {
+			stats := svc.Stats()
+			if len(stats.Backends) == 1 && stats.Backends[0].HTTPIdle == idle {
+				return
+			}
+			if i == 100 {
+				c.Fatalf("backend doesn't have %d idle connections", idle)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitClosed := func() {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			c.Fatal("idle connection wasn't closed")
+		}
+	}
+
+	get()
+	waitIdle(1)
+
+	// a backend marked down has its idle connections closed
+	c.Assert(Registry.SetBackendAdminState(svcCfg.Name, "b0", client.AdminStateDown), IsNil)
+	waitClosed()
+	waitIdle(0)
+
+	c.Assert(Registry.SetBackendAdminState(svcCfg.Name, "b0", client.AdminStateUp), IsNil)
+	get()
+	waitIdle(1)
+
+	// as does a removed one
+	c.Assert(Registry.RemoveBackend(svcCfg.Name, "b0"), IsNil)
+	waitClosed()
+}
+
+// Header rules rewrite requests and responses for the service and each of
+// its virtual hosts, before an error page is substituted.
+func (s *HTTPSuite) TestHeaderRules(c *C) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal-Auth", "secret")
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/error" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Tenant"), r.Header.Get("X-Client"), r.Header.Get("X-Debug"))
+	}))
+	defer backend.Close()
+
+	errPages := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<h1>unavailable</h1>"))
+	}))
+	defer errPages.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "Headers",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"tenant-a.test", "tenant-b.test"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: strings.TrimPrefix(backend.URL, "http://")},
+		},
+		ErrorPages: map[string][]int{
+			errPages.URL + "/": {503},
+		},
+		Headers: &client.HeaderConfig{
+			RequestRemove: []string{"x-debug"},
+			ResponseSet: map[string]string{
+				"strict-transport-security": "max-age=31536000",
+				"CONTENT-TYPE":              "text/plain; charset=utf-8",
+			},
+			ResponseRemove: []string{"x-INTERNAL-auth"},
+		},
+		VirtualHostHeaders: map[string]client.HeaderConfig{
+			"Tenant-A.test": {
+				RequestSet: map[string]string{
+					"x-tenant": "a",
+					"X-Client": "$remote_addr for $host",
+				},
+			},
+		},
+	}
+
+	invalid := svcCfg
+	invalid.Headers = &client.HeaderConfig{RequestSet: map[string]string{"Connection": "close"}}
+	c.Assert(Registry.AddService(invalid), ErrorMatches, ErrInvalidHeaders.Error()+".*")
+	invalid.Headers = &client.HeaderConfig{ResponseRemove: []string{"bad header"}}
+	c.Assert(Registry.AddService(invalid), ErrorMatches, ErrInvalidHeaders.Error()+".*")
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	get := func(host, path string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", "http://"+s.httpAddr+path, nil)
+		req.Host = host
+		req.Header.Set("X-Debug", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	resp, body := get("tenant-a.test:9000", "/")
+	c.Assert(body, Equals, "a|127.0.0.1 for tenant-a.test|")
+	c.Assert(resp.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Assert(resp.Header.Get("X-Internal-Auth"), Equals, "")
+
+	resp, body = get("tenant-b.test", "/")
+	c.Assert(body, Equals, "||")
+	c.Assert(resp.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+
+	// the error page keeps its own content type, and still gets the rest
+	for i := 0; ; i++ {
+		if resp, body = get("tenant-b.test", "/error"); body != "" || i == 50 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(resp.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(body, Equals, "<h1>unavailable</h1>")
+	c.Assert(resp.Header.Get("Content-Type"), Equals, "text/html")
+	c.Assert(resp.Header.Get("Strict-Transport-Security"), Equals, "max-age=31536000")
+	c.Assert(resp.Header.Get("X-Internal-Auth"), Equals, "")
+
+	// the rules are updated live, and an empty config clears them
+	svcCfg.Headers = &client.HeaderConfig{}
+	svcCfg.VirtualHostHeaders = map[string]client.HeaderConfig{
+		"*.test": {RequestSet: map[string]string{"X-Tenant": "any"}},
+	}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	cfg := Registry.GetService("Headers").Config()
+	c.Assert(cfg.Headers, DeepEquals, &client.HeaderConfig{})
+	c.Assert(cfg.VirtualHostHeaders, DeepEquals, svcCfg.VirtualHostHeaders)
+
+	resp, body = get("tenant-b.test", "/")
+	c.Assert(body, Equals, "any||1")
+	c.Assert(resp.Header.Get("Strict-Transport-Security"), Equals, "")
+	c.Assert(resp.Header.Get("X-Internal-Auth"), Equals, "secret")
+}
+
+// POST /{service}/{backend}/check runs a check at once that counts like a
+// scheduled one, so a recovered backend is marked up without waiting for
+// the interval.
+func (s *HTTPSuite) TestForceCheck(c *C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	checkAddr := l.Addr().String()
+	l.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "ForceCheck",
+		Addr:          "127.0.0.1:9000",
+		CheckInterval: 60000,
+		Rise:          2,
+		Fall:          1,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr, CheckAddr: checkAddr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+	b := svc.get("b0")
+
+	check := func() CheckResult {
+		resp, err := http.Post(s.httpSvr.URL+"/ForceCheck/b0/check", "", nil)
+		c.Assert(err, IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusOK)
+		var result CheckResult
+		c.Assert(json.NewDecoder(resp.Body).Decode(&result), IsNil)
+		c.Assert(result.Counted, Equals, true)
+		return result
+	}
+
+	c.Assert(check().OK, Equals, false)
+	c.Assert(b.Up(), Equals, false)
+
+	l, err = net.Listen("tcp", checkAddr)
+	if err != nil {
+		c.Skip("check address was taken: " + err.Error())
+	}
+	defer l.Close()
+
+	c.Assert(check().OK, Equals, true)
+	c.Assert(b.Up(), Equals, false)
+	c.Assert(check().OK, Equals, true)
+	c.Assert(b.Up(), Equals, true)
+
+	resp, err := http.Post(s.httpSvr.URL+"/ForceCheck/missing/check", "", nil)
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+}
+
+// In the JSON format, the operational logs and the access lines written to
+// the main log are an object per line with structured fields.
+func (s *HTTPSuite) TestJSONLogs(c *C) {
+	logged := captureLogs()
+	defer logged.stop()
+	defer log.SetFormat(log.DefaultLogger.Format())
+	c.Assert(log.SetFormat("yaml"), NotNil)
+	c.Assert(log.SetFormat(log.FormatJSON), IsNil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:         "JSONLogs",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"json-logs-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "json-logs-vhost", s.backendServers[0].addr, 200, c)
+
+	svcCfg.Backends = []client.BackendConfig{{Name: "dead", Addr: deadAddr}}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	checkHTTP("http://"+s.httpAddr+"/addr", "json-logs-vhost", "", 502, c)
+
+	// requests are logged once their response is written
+	for i := 0; strings.Count(logged.String(), `"msg":"request"`) < 2; i++ {
+		if i == 100 {
+			c.Fatal("requests weren't logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// find the first line with each message
+	lines := make(map[string]map[string]interface{})
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		var fields map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(line), &fields), IsNil, Commentf("%s", line))
+		for _, key := range []string{"level", "ts", "msg"} {
+			c.Assert(fields[key], NotNil, Commentf("%s", line))
+		}
+		_, err := time.Parse(time.RFC3339, fields["ts"].(string))
+		c.Assert(err, IsNil)
+
+		msg := fields["msg"].(string)
+		switch {
+		case strings.HasPrefix(msg, "Adding tcp backend b0"):
+			msg = "added"
+		case strings.HasPrefix(msg, "connecting to backend"):
+			msg = "dial error"
+		}
+		if lines[msg] == nil {
+			lines[msg] = fields
+		}
+	}
+
+	added := lines["added"]
+	c.Assert(added, NotNil)
+	c.Assert(added["level"], Equals, "info")
+	c.Assert(added["service"], Equals, "JSONLogs")
+	c.Assert(added["backend"], Equals, "b0")
+	c.Assert(added["addr"], Equals, s.backendServers[0].addr)
+
+	dialErr := lines["dial error"]
+	c.Assert(dialErr, NotNil)
+	c.Assert(dialErr["level"], Equals, "error")
+	c.Assert(dialErr["service"], Equals, "JSONLogs")
+	c.Assert(dialErr["backend"], Equals, "dead")
+	c.Assert(dialErr["addr"], Equals, deadAddr)
+	c.Assert(dialErr["err"], Matches, ".*refused.*")
+
+	request := lines["request"]
+	c.Assert(request, NotNil)
+	c.Assert(request["level"], Equals, "info")
+	c.Assert(request["service"], Equals, "JSONLogs")
+	c.Assert(request["vhost"], Equals, "json-logs-vhost")
+	c.Assert(request["method"], Equals, "GET")
+	c.Assert(request["status"], Equals, float64(200))
+	c.Assert(request["addr"], Equals, s.backendServers[0].addr)
+}
+
+// An HTTP capture records the heads of each request and response, and only
+// the start of their bodies. Negative limits are refused.
+func (s *HTTPSuite) TestHTTPCapture(c *C) {
+	defer func(capture bool) { enableCapture = capture }(enableCapture)
+	enableCapture = true
+
+	svcCfg := client.ServiceConfig{
+		Name:         "CaptureTest",
+		Addr:         "127.0.0.1:9000",
+		VirtualHosts: []string{"capture-vhost"},
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.backendServers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	for _, limit := range []string{"duration", "max_bytes", "max_sessions", "max_body_bytes"} {
+		body := fmt.Sprintf(`{"%s": -1}`, limit)
+		resp, err := http.Post(s.httpSvr.URL+"/CaptureTest/b0/capture", "application/json", strings.NewReader(body))
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, Equals, http.StatusBadRequest, Commentf(limit))
+	}
+
+	resp, err := http.Post(s.httpSvr.URL+"/CaptureTest/b0/capture", "application/json", strings.NewReader(`{"max_body_bytes": 4}`))
+	if err != nil {
+		c.Fatal(err)
+	}
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusOK)
+
+	req, err := http.NewRequest("POST", "http://"+s.httpAddr+"/addr", strings.NewReader("0123456789"))
+	if err != nil {
+		c.Fatal(err)
+	}
+	req.Host = "capture-vhost"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		c.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(string(body), Equals, s.backendServers[0].addr)
+
+	dump, err := Registry.Capture("CaptureTest", "b0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(dump.Active, Equals, true)
+	c.Assert(len(dump.Sessions), Equals, 1)
+	c.Assert(dump.Sessions[0].Client, Matches, `127\.0\.0\.1:.*`)
+
+	// the request body is sent alongside the response, so only the order in
+	// each direction is known
+	var request, response []string
+	for _, r := range dump.Sessions[0].Records {
+		switch r.Direction {
+		case client.CaptureRequest:
+			request = append(request, string(r.Data))
+		case client.CaptureResponse:
+			response = append(response, string(r.Data))
+		}
+	}
+	c.Assert(len(request), Equals, 2)
+	c.Assert(request[0], Matches, `(?s)POST /addr HTTP/1\.1\r\nHost: capture-vhost\r\n.*\r\n\r\n`)
+	c.Assert(request[1], Equals, "0123")
+	c.Assert(len(response), Equals, 2)
+	c.Assert(response[0], Matches, `(?s)HTTP/1\.1 200 OK\r\n.*\r\n\r\n`)
+	c.Assert(response[1], Equals, s.backendServers[0].addr[:4])
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidAddr = fmt.Errorf("invalid address")
+
+// ValidateConfig checks a config before any of it is applied: the global
+// settings, and each service's name, address, network and balancing. Every
+// service is checked, and their errors are returned together. Whether a
+// service can bind its address is only known once it's applied.
+func (s *ServiceRegistry) ValidateConfig(cfg client.Config) error {
+	errs := &multiError{}
+	if err := validGlobals(cfg); err != nil {
+		errs.Add(err)
+	}
+
+	names := make(map[string]bool, len(cfg.Services))
+	for _, svcCfg := range cfg.Services {
+		if err := s.validServiceConfig(svcCfg, names); err != nil {
+			errs.Add(err)
+		}
+	}
+
+	if errs.Len() == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Check the global settings of a config.
+func validGlobals(cfg client.Config) error {
+	if err := validBalance(cfg.Balance); err != nil {
+		return err
+	}
+	if err := validBalance(cfg.ShadowBalance); err != nil {
+		return err
+	}
+	if cfg.MaxHeaderBytes < 0 {
+		return ErrInvalidHeaderMax
+	}
+	if err := validOverlays(cfg.Overlays); err != nil {
+		return err
+	}
+	if err := validUnknownSNI(cfg.UnknownSNI); err != nil {
+		return err
+	}
+	if err := validHealth(cfg); err != nil {
+		return err
+	}
+	return validAccessLog(cfg.AccessLog)
+}
+
+// Check one of the services of a config, whose name is added to names so it
+// can only appear once. The network of a running service can't change
+// family, and an address that isn't set keeps the current one.
+func (s *ServiceRegistry) validServiceConfig(svcCfg client.ServiceConfig, names map[string]bool) error {
+	invalid := func(field string, err error) error {
+		return &ServiceError{Service: svcCfg.Name, Field: field, Err: err}
+	}
+
+	if err := validName(svcCfg.Name); err != nil {
+		return invalid("name", err)
+	}
+	if names[svcCfg.Name] {
+		return invalid("name", fmt.Errorf("invalid name %q: used more than once in the config", svcCfg.Name))
+	}
+	names[svcCfg.Name] = true
+
+	network := svcCfg.Network
+	if current, err := s.ServiceConfig(svcCfg.Name); err == nil {
+		if network == "" {
+			network = current.Network
+		} else if networkFamily(network) != networkFamily(current.Network) {
+			return invalid("network", fmt.Errorf("%w: can't change from %s to %s", ErrInvalidServiceUpdate, current.Network, network))
+		}
+	}
+	if network == "" {
+		network = client.DefaultNet
+	}
+	if networkFamily(network) == "" {
+		return invalid("network", fmt.Errorf("%w: %q service", ErrInvalidNetwork, network))
+	}
+
+	if err := validServiceAddr(network, svcCfg.Addr); err != nil {
+		return invalid("address", err)
+	}
+	if err := validBalance(svcCfg.Balance); err != nil {
+		return invalid("balance", err)
+	}
+	if err := validBalance(svcCfg.ShadowBalance); err != nil {
+		return invalid("shadow_balance", err)
+	}
+
+	withNetwork := svcCfg
+	withNetwork.Network = network
+	if err := validNetworks(&withNetwork); err != nil {
+		return invalid("backends", err)
+	}
+	if err := validWeights(svcCfg); err != nil {
+		return invalid("backends", err)
+	}
+	return nil
+}
+
+// Check that a service's address can be listened on. A tcp or udp address
+// needs a port, which can't be the admin API's.
+func validServiceAddr(network, addr string) error {
+	if addr == "" || networkFamily(network) == "unix" {
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w %q: %s", ErrInvalidAddr, addr, err)
+	}
+	if _, err := net.LookupPort(network, port); err != nil {
+		return fmt.Errorf("%w %q: %s", ErrInvalidAddr, addr, err)
+	}
+	if networkFamily(network) == "tcp" {
+		adminPort := adminListenAddr[strings.Index(adminListenAddr, ":")+1:]
+		if adminPort != "" && port == adminPort {
+			return fmt.Errorf("%w %q: port %s already bound by shuttle", ErrInvalidAddr, addr, port)
+		}
+	}
+	return nil
+}
+
+// configUndo reverses the changes made while applying a config, most recent
+// first.
+type configUndo []func()
+
+func (u *configUndo) add(f func()) {
+	*u = append(*u, f)
+}
+
+func (u configUndo) run() {
+	for i := len(u) - 1; i >= 0; i-- {
+		u[i]()
+	}
+}
+
+// Add or update one of the services of a config, recording how to reverse
+// it. An update is recorded first, since a failed one may have changed part
+// of the service.
+func (s *ServiceRegistry) applyService(svcCfg client.ServiceConfig, undo *configUndo) error {
+	current, err := s.ServiceConfig(svcCfg.Name)
+	if err != nil {
+		if err := s.AddService(svcCfg); err != nil {
+			return err
+		}
+		undo.add(func() {
+			if err := s.RemoveService(svcCfg.Name); err != nil {
+				log.Errorf("ERROR: rolling back service %s: %s", svcCfg.Name, err)
+			}
+		})
+		return nil
+	}
+
+	undo.add(func() {
+		if err := s.UpdateService(current); err != nil {
+			log.Errorf("ERROR: rolling back service %s: %s", svcCfg.Name, err)
+		}
+	})
+	return s.UpdateService(svcCfg)
+}
+
+// The config field an error applying a service is about, if it's known.
+func serviceErrorField(err error) string {
+	var listenErr *ListenError
+	switch {
+	case errors.As(err, &listenErr), errors.Is(err, ErrMoveListener):
+		return "address"
+	case errors.Is(err, ErrInvalidBalance):
+		return "balance"
+	case errors.Is(err, ErrInvalidVHost), errors.Is(err, ErrDuplicateVHost):
+		return "virtual_hosts"
+	case errors.Is(err, ErrNetworkMismatch), errors.Is(err, ErrInvalidBackend),
+		errors.Is(err, ErrInvalidWeight), errors.Is(err, ErrInvalidAdminState):
+		return "backends"
+	}
+	return ""
+}
+
+// ConfigError is the json form of an error in a config that wasn't applied,
+// naming the service and field at fault when they're known.
+type ConfigError struct {
+	Service string `json:"service,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Error   string `json:"error"`
+}
+
+// The json errors of a config that wasn't applied.
+type ConfigErrors struct {
+	Errors []ConfigError `json:"errors"`
+}
+
+func configErrors(err error) ConfigErrors {
+	errs := []error{err}
+	if multi, ok := err.(*multiError); ok {
+		errs = multi.errors
+	}
+
+	resp := ConfigErrors{Errors: []ConfigError{}}
+	for _, err := range errs {
+		var svcErr *ServiceError
+		if errors.As(err, &svcErr) {
+			resp.Errors = append(resp.Errors, ConfigError{Service: svcErr.Service, Field: svcErr.Field, Error: svcErr.Err.Error()})
+			continue
+		}
+		resp.Errors = append(resp.Errors, ConfigError{Error: err.Error()})
+	}
+	return resp
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/litl/shuttle/log"
+)
+
+// Admin token permissions. An admin token can use the whole API. A read-stats
+// token can only read the stats and health of the services matching its
+// patterns, for dashboards that shouldn't see configs or other services.
+const (
+	PermAdmin     = "admin"
+	PermReadStats = "read-stats"
+)
+
+var (
+	ErrAdminUnauthorized = fmt.Errorf("missing or invalid admin token")
+	ErrAdminForbidden    = fmt.Errorf("token not permitted for this request")
+	ErrTokenPermission   = fmt.Errorf("token permission must be admin or read-stats")
+	ErrAdminCredentials  = fmt.Errorf("invalid admin credentials")
+	ErrAdminReadOnly     = fmt.Errorf("admin API is read-only")
+)
+
+// How long a token validation is cached, and the most tokens cached at once.
+var (
+	tokenCacheTTL  = 10 * time.Second
+	tokenCacheSize = 1024
+)
+
+// The admin routes a read-stats token may use. Routes with a service are
+// further limited to the token's services.
+var statsRoutes = map[string]bool{
+	"stats":         true,
+	"stats_all":     true,
+	"metrics":       true,
+	"version":       true,
+	"service_stats": true,
+	"service":       true,
+	"health":        true,
+	"vhost_ready":   true,
+	"logs_stream":   true,
+	"events":        true,
+}
+
+// AdminToken is an entry in the admin tokens file. Only the token's SHA-256
+// is kept, so the file doesn't hold the tokens themselves.
+type AdminToken struct {
+	Name       string `json:"name"`
+	SHA256     string `json:"sha256"`
+	Permission string `json:"permission"`
+	// service name patterns for a read-stats token, as matched by path.Match
+	Services []string `json:"services,omitempty"`
+}
+
+// Report whether the token may see the named service.
+func (t *AdminToken) allows(service string) bool {
+	if t.Permission == PermAdmin {
+		return true
+	}
+	for _, pattern := range t.Services {
+		if ok, _ := path.Match(pattern, service); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenCacheEntry struct {
+	token   *AdminToken
+	expires time.Time
+}
+
+// adminTokens validates the bearer tokens for the admin API. Validation
+// results, including failures, are cached briefly so frequent pollers cost
+// a map lookup per request.
+type adminTokens struct {
+	sync.Mutex
+	// tokens by their hex SHA-256
+	tokens map[string]*AdminToken
+	cache  map[string]tokenCacheEntry
+}
+
+// The admin tokens, or nil if the admin API doesn't require one.
+var adminAuth *adminTokens
+
+func newAdminTokens(tokens []AdminToken) (*adminTokens, error) {
+	a := &adminTokens{
+		tokens: make(map[string]*AdminToken),
+		cache:  make(map[string]tokenCacheEntry),
+	}
+	for i := range tokens {
+		t := &tokens[i]
+		switch t.Permission {
+		case PermAdmin, PermReadStats:
+		default:
+			return nil, fmt.Errorf("token %s: %w", t.Name, ErrTokenPermission)
+		}
+		for _, pattern := range t.Services {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("token %s: invalid service pattern %q", t.Name, pattern)
+			}
+		}
+
+		hash := strings.ToLower(t.SHA256)
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("token %s: invalid sha256", t.Name)
+		}
+		a.tokens[hash] = t
+	}
+	return a, nil
+}
+
+// Load the admin tokens file, a JSON list of tokens.
+func loadAdminTokens(file string) (*adminTokens, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []AdminToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	return newAdminTokens(tokens)
+}
+
+// Return the token for a bearer token presented to the API, or nil if it's
+// not valid.
+func (a *adminTokens) validate(bearer string) *AdminToken {
+	now := time.Now()
+
+	a.Lock()
+	defer a.Unlock()
+
+	if e, ok := a.cache[bearer]; ok && now.Before(e.expires) {
+		return e.token
+	}
+
+	sum := sha256.Sum256([]byte(bearer))
+	token := a.tokens[hex.EncodeToString(sum[:])]
+
+	// bound the cache against clients sending many bad tokens
+	if len(a.cache) >= tokenCacheSize {
+		a.cache = make(map[string]tokenCacheEntry)
+	}
+	a.cache[bearer] = tokenCacheEntry{token: token, expires: now.Add(tokenCacheTTL)}
+	return token
+}
+
+// adminCredentials are the shared token and basic-auth credentials for the
+// admin API, which can use the whole API like an admin token. Unless reads is
+// set, or there are admin tokens too, they're only needed for changes.
+type adminCredentials struct {
+	token    string
+	user     string
+	password string
+	reads    bool
+}
+
+// The shared admin credentials, or nil if there are none.
+var adminCreds *adminCredentials
+
+// Reject every change to the config through the admin API, for a shuttle
+// configured only by its files.
+var adminReadOnly bool
+
+// The admin requests refused for missing or invalid credentials, used
+// atomically.
+var adminUnauthorized int64
+
+// Parse the shared credentials from the flags. basicAuth is "user:password".
+// Returns nil if neither is set.
+func newAdminCredentials(token, basicAuth string, reads bool) (*adminCredentials, error) {
+	if token == "" && basicAuth == "" {
+		if reads {
+			return nil, fmt.Errorf("%w: protecting reads requires a token or basic auth", ErrAdminCredentials)
+		}
+		return nil, nil
+	}
+
+	creds := &adminCredentials{token: token, reads: reads}
+	if basicAuth != "" {
+		parts := strings.SplitN(basicAuth, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%w: basic auth must be user:password", ErrAdminCredentials)
+		}
+		creds.user, creds.password = parts[0], parts[1]
+	}
+	return creds, nil
+}
+
+// Report whether a request carries the shared token or basic-auth
+// credentials.
+func (c *adminCredentials) valid(r *http.Request) bool {
+	if user, password, ok := r.BasicAuth(); ok {
+		return c.user != "" && equalSecret(user, c.user) && equalSecret(password, c.password)
+	}
+	header := r.Header.Get("Authorization")
+	if c.token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return equalSecret(strings.TrimPrefix(header, "Bearer "), c.token)
+}
+
+// Compare secrets in constant time, so the time taken doesn't tell how much
+// of a guess was right.
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Report whether a request can change anything, so needs credentials when
+// only changes are protected.
+func adminWrite(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return false
+	}
+	return true
+}
+
+// Refuse a request without valid credentials, counting and logging it.
+func unauthorizedAdmin(w http.ResponseWriter, r *http.Request, challenge string) {
+	atomic.AddInt64(&adminUnauthorized, 1)
+	log.With(log.Fields{"client": r.RemoteAddr, "method": r.Method, "path": r.URL.Path}).Warnf("WARN: unauthorized admin request from %s: %s %s", r.RemoteAddr, r.Method, r.URL.Path)
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, ErrAdminUnauthorized.Error(), http.StatusUnauthorized)
+}
+
+type statsScopeKey struct{}
+
+// The read-stats token a request was authorized with, or nil if it can see
+// every service.
+func statsScope(r *http.Request) *AdminToken {
+	t, _ := r.Context().Value(statsScopeKey{}).(*AdminToken)
+	return t
+}
+
+// Require a valid token for every admin request once tokens are configured.
+// A read-stats token is rejected on any route but the stats routes, and on
+// services it doesn't cover. Stats handlers filter what they return to the
+// token's services. The shared credentials are accepted in place of an admin
+// token, and are required for changes even without tokens. Once authorized,
+// a request that could change anything is refused in read-only mode.
+func authorizeAdmin(router *mux.Router) http.Handler {
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		if adminReadOnly && adminWrite(r) {
+			http.Error(w, ErrAdminReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, creds := adminAuth, adminCreds
+		if creds != nil && creds.valid(r) {
+			serve(w, r)
+			return
+		}
+
+		challenge := "Bearer"
+		if creds != nil && creds.user != "" {
+			challenge = `Basic realm="shuttle"`
+		}
+		if auth == nil {
+			if creds != nil && (creds.reads || adminWrite(r)) {
+				unauthorizedAdmin(w, r, challenge)
+				return
+			}
+			serve(w, r)
+			return
+		}
+
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		token := auth.validate(bearer)
+		if bearer == "" || token == nil {
+			unauthorizedAdmin(w, r, challenge)
+			return
+		}
+
+		if token.Permission == PermReadStats {
+			var match mux.RouteMatch
+			if !router.Match(r, &match) || !statsRoutes[match.Route.GetName()] {
+				http.Error(w, ErrAdminForbidden.Error(), http.StatusForbidden)
+				return
+			}
+			if svc, ok := match.Vars["service"]; ok && !token.allows(svc) {
+				http.Error(w, ErrAdminForbidden.Error(), http.StatusForbidden)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), statsScopeKey{}, token))
+		}
+
+		serve(w, r)
+	})
+}
+
+// Keep only the names the request's token may see.
+func scopedNames(r *http.Request, names []string) []string {
+	scope := statsScope(r)
+	if scope == nil {
+		return names
+	}
+	allowed := []string{}
+	for _, name := range names {
+		if scope.allows(name) {
+			allowed = append(allowed, name)
+		}
+	}
+	return allowed
+}
+
+// The names of the services routing a virtual host.
+func (s *ServiceRegistry) vhostServiceNames(host string) []string {
+	host = requestVHost(host)
+
+	s.Lock()
+	defer s.Unlock()
+
+	var names []string
+	if vhost := s.lookupVHost(host); vhost != nil {
+		for _, svc := range vhost.Services() {
+			names = append(names, svc.Name)
+		}
+	}
+	return names
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,12 +31,24 @@ type Backend struct {
 	Conns      int64
 	Active     int64
 	HTTPActive int64
+	HTTPIdle   int64
 	Network    string
+	Tags       map[string]string
+
+	// datagrams sent to a UDP backend
+	Datagrams int64
+	// the time taken by each attempt to connect a client to the backend, and
+	// by the recent attempts and health checks
+	dialTime     histogram
+	dialLatency  latencyWindow
+	checkLatency latencyWindow
+	// the send queue of a UDP backend, replaced when its size changes
+	udpQueue atomic.Value
 
 	// these are loaded from the service, so a backend doesn't need to access
 	// the service struct at all.
 	dialTimeout   time.Duration
-	rwTimeout     time.Duration
+	rwTimeout     *liveTimeout
 	checkInterval time.Duration
 	rise          int
 	riseCount     int
@@ -38,39 +57,203 @@ type Backend struct {
 	fallCount     int
 	checkFail     int
 
+	// fixed size history of check results, and the total number recorded
+	checkHistory [checkHistoryLen]CheckResult
+	checkCount   int
+	nextCheck    time.Time
+
+	// Checks back off once the backend has been down for backoffAfter,
+	// doubling the interval up to backoffMax. downSince is when the backend
+	// was marked down, or when the backoff was last reset, and interval is
+	// the current time between checks.
+	backoffAfter time.Duration
+	backoffMax   time.Duration
+	downSince    time.Time
+	interval     time.Duration
+
+	// the fraction each wait for a check is randomly varied by either way
+	checkJitter float64
+
+	// the clock for scheduling checks, replaced in tests
+	now func() time.Time
+
 	startCheck sync.Once
 	// stop the health-check loop
 	stopCheck chan interface{}
+	// reschedule the next check after the backoff is reset
+	wakeCheck chan struct{}
+
+	// The type of health check, and for http checks the path requested and
+	// the time allowed for the response after connecting. udp checks send
+	// checkPayload, and allow the same time for the response.
+	CheckType    string
+	CheckPath    string
+	checkTimeout time.Duration
+	checkPayload []byte
+
+	// the name and tags of the backend's service for its events, set once
+	// it's added
+	service     string
+	serviceTags map[string]string
 
 	// so we only need to ResolveUDPAddr once
-	udpAddr *net.UDPAddr
-}
-
-// The json stats we return for the backend
-type BackendStat struct {
-	Name       string `json:"name"`
-	Addr       string `json:"address"`
-	CheckAddr  string `json:"check_address"`
-	Up         bool   `json:"up"`
-	Weight     int    `json:"weight"`
-	Sent       int64  `json:"sent"`
-	Rcvd       int64  `json:"received"`
-	Errors     int64  `json:"errors"`
-	Conns      int64  `json:"connections"`
-	Active     int64  `json:"active"`
-	HTTPActive int64  `json:"http_active"`
-	CheckOK    int    `json:"check_success"`
-	CheckFail  int    `json:"check_fail"`
+	udpAddr net.Addr
+
+	// used for health checks, loaded from the service
+	dialer DialerFactory
+
+	// Markers so backends can tell health checks from proxied traffic,
+	// loaded from the service. checkPort is the next port to try within
+	// checkPorts.
+	checkPorts     portRange
+	checkPort      int
+	checkPreamble  []byte
+	checkUserAgent string
+
+	// The running payload capture, checked on every new connection.
+	capture atomic.Value
+	// the most recent capture, kept after it's stopped for retrieval
+	lastCapture *capture
+
+	// Readiness published by the backend itself. A backend that isn't ready
+	// is out of rotation regardless of its health checks, until it's ready
+	// again or readyUntil has passed.
+	notReady     bool
+	readySource  string
+	readyUntil   time.Time
+	readinessTTL time.Duration
+	drainTimer   *time.Timer
+
+	// Set through the API to take the backend out of rotation for
+	// maintenance. The health checks continue, but the backend stays down
+	// until it's set up again.
+	adminDown bool
+
+	// Set once the backend is removed or replaced, while its connections
+	// drain.
+	removed bool
+
+	// the value of a service's sticky cookie for this backend
+	stickyID string
+
+	// open connections to this backend, so they can be closed after draining
+	conns map[*shuttleConn]bool
+
+	// the connections for a multiplexed service, loaded from the service
+	mux *muxPool
+
+	// The effective state, and when it last changed, updated along with
+	// anything it's derived from. maintenance is loaded from the service.
+	// checkFailingSince is the first failure of the current streak of failed
+	// checks.
+	state             string
+	stateChanged      time.Time
+	maintenance       bool
+	checkFailingSince time.Time
+
+	// A backend that comes back up after being down is warmed up over
+	// slowStart, from rampStart, which is zero once it's done. rampCredit is
+	// the fraction of a turn it's owed by round robin, and wasUp is set once
+	// it has been up at all.
+	slowStart  time.Duration
+	rampStart  time.Time
+	rampCredit float64
+	wasUp      bool
+
+	// signalled when the state changes, if the service is watching its
+	// backends' availability
+	availableChanged chan struct{}
+
+	// The most TCP connections and HTTP requests the backend is sent at once,
+	// or 0 for no limit, and the number in progress. LimitQueued and
+	// LimitRejected count the connections and requests queued or turned away
+	// while every backend was at its limit.
+	maxConns      int64
+	inUse         int64
+	LimitQueued   int64
+	LimitRejected int64
+
+	// The interface connections are bound to, from the backend's config or
+	// else its service's, with its addresses and when they last changed.
+	// bound holds the same for dialing without the lock.
+	BindInterface string
+	bindInterface string
+	iface         ifaceAddrs
+	ifaceChanged  time.Time
+	bound         atomic.Value
+
+	// Connections are made over TLS when tlsConfig is set, built from
+	// tlsSettings. TLSErrors counts the failed handshakes, and is used
+	// atomically.
+	tlsSettings  *client.BackendTLSConfig
+	tlsConfig    *tls.Config
+	TLSErrors    int64
+	lastTLSError string
+}
+
+// The states reported for a backend. A backend is down when it's failing its
+// health checks or was set down through the API, draining when it published
+// that it isn't ready or was removed while connections are open, and in
+// maintenance when it's otherwise up but its service is in maintenance mode.
+const (
+	StateUp          = "up"
+	StateDown        = "down"
+	StateDraining    = "draining"
+	StateMaintenance = "maintenance"
+)
+
+// The number of health check results kept for each backend
+const checkHistoryLen = 50
+
+// The result of a single health check
+type CheckResult struct {
+	Time time.Time `json:"time"`
+	// Duration in nanoseconds
+	Duration time.Duration `json:"duration"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	// the response status of an http check
+	Status int `json:"status,omitempty"`
+	// Counted is false for on-demand checks that didn't affect the
+	// rise/fall counts.
+	Counted bool `json:"counted"`
+}
+
+// The json health check state we return for the backend
+type BackendChecks struct {
+	Name      string        `json:"name"`
+	CheckAddr string        `json:"check_address"`
+	Up        bool          `json:"up"`
+	Interval  int           `json:"check_interval"`
+	NextCheck time.Time     `json:"next_check"`
+	Rise      int           `json:"rise"`
+	Fall      int           `json:"fall"`
+	RiseCount int           `json:"rise_count"`
+	FallCount int           `json:"fall_count"`
+	History   []CheckResult `json:"history"`
+
+	// EffectiveInterval is the current interval in milliseconds, including
+	// any backoff.
+	EffectiveInterval int `json:"effective_interval"`
 }
 
 func NewBackend(cfg client.BackendConfig) *Backend {
 	b := &Backend{
-		Name:      cfg.Name,
-		Addr:      cfg.Addr,
-		CheckAddr: cfg.CheckAddr,
-		Weight:    cfg.Weight,
-		Network:   cfg.Network,
-		stopCheck: make(chan interface{}),
+		Name:          cfg.Name,
+		Addr:          cfg.Addr,
+		CheckAddr:     cfg.CheckAddr,
+		Weight:        cfg.Weight,
+		Network:       cfg.Network,
+		Tags:          cfg.Tags,
+		stopCheck:     make(chan interface{}),
+		BindInterface: cfg.BindInterface,
+		wakeCheck:     make(chan struct{}, 1),
+		conns:         make(map[*shuttleConn]bool),
+		now:           time.Now,
+		adminDown:     cfg.AdminState == client.AdminStateDown,
+		stickyID:      stickyID(cfg.Name),
+		maxConns:      int64(cfg.MaxConns),
+		slowStart:     time.Duration(cfg.SlowStart) * time.Millisecond,
 	}
 
 	// don't want a weight of 0
@@ -82,29 +265,95 @@ func NewBackend(cfg client.BackendConfig) *Backend {
 		b.Network = "tcp"
 	}
 
+	b.setCheck(cfg)
+
+	if cfg.TLS != nil {
+		tlsSettings := *cfg.TLS
+		b.tlsSettings = &tlsSettings
+		tlsConfig, err := backendTLSConfig(cfg)
+		if err != nil {
+			log.With(log.Fields{"service": b.service, "backend": b.Name, "err": err}).Errorf("ERROR: %s", err.Error())
+		}
+		b.tlsConfig = tlsConfig
+	}
+
 	switch b.Network {
 	case "udp", "udp4", "udp6":
-		var err error
-		b.udpAddr, err = net.ResolveUDPAddr(b.Network, b.Addr)
+		udpAddr, err := net.ResolveUDPAddr(b.Network, b.Addr)
 		if err != nil {
-			log.Errorf("ERROR: %s", err.Error())
+			log.With(log.Fields{"service": b.service, "backend": b.Name, "addr": b.Addr, "err": err}).Errorf("ERROR: %s", err.Error())
 			b.up = false
+		} else {
+			b.udpAddr = udpAddr
 		}
 	}
 
+	b.updateState(b.now())
 	return b
 }
 
+// Derive the state from the health checks, readiness and maintenance mode,
+// recording the time if it changed.
+// Backend *must* be locked.
+func (b *Backend) updateState(at time.Time) {
+	state := StateUp
+	switch {
+	case b.removed:
+		state = StateDraining
+	case b.adminDown || !b.up || b.iface.err != nil:
+		state = StateDown
+	case b.notReady:
+		state = StateDraining
+	case b.maintenance:
+		state = StateMaintenance
+	}
+
+	if state == b.state {
+		return
+	}
+	if b.state != "" {
+		log.With(log.Fields{"service": b.service, "backend": b.Name}).Debugf("Backend %s is %s, was %s", b.Name, state, b.state)
+		b.publishEvent(client.EventBackendState, b.state, state, at)
+	}
+	if state == StateUp {
+		b.rampUp(b.state, at)
+	}
+	b.state = state
+	b.stateChanged = at
+
+	// don't reuse pooled HTTP connections to a backend that's down
+	if state == StateDown {
+		if closed := b.closeIdleConns(); closed > 0 {
+			log.With(log.Fields{"service": b.service, "backend": b.Name}).Debugf("Closed %d idle connections to %s", closed, b.Name)
+		}
+	}
+
+	if b.availableChanged != nil {
+		select {
+		case b.availableChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Set whether the backend's service is in maintenance mode.
+// Backend *must* be locked.
+func (b *Backend) setMaintenance(maintenance bool) {
+	b.maintenance = maintenance
+	b.updateState(b.now())
+}
+
 // Copy the backend state into a BackendStat struct.
 func (b *Backend) Stats() BackendStat {
 	b.Lock()
 	defer b.Unlock()
 
+	ready := b.readyLocked()
 	stats := BackendStat{
 		Name:       b.Name,
 		Addr:       b.Addr,
 		CheckAddr:  b.CheckAddr,
-		Up:         b.up,
+		Up:         b.up && b.iface.err == nil && ready && !b.adminDown && !b.removed,
 		Weight:     b.Weight,
 		Sent:       atomic.LoadInt64(&b.Sent),
 		Rcvd:       atomic.LoadInt64(&b.Rcvd),
@@ -112,20 +361,267 @@ func (b *Backend) Stats() BackendStat {
 		Conns:      atomic.LoadInt64(&b.Conns),
 		Active:     atomic.LoadInt64(&b.Active),
 		HTTPActive: atomic.LoadInt64(&b.HTTPActive),
+		HTTPIdle:   atomic.LoadInt64(&b.HTTPIdle),
+		Datagrams:  atomic.LoadInt64(&b.Datagrams),
 		CheckOK:    b.checkOK,
 		CheckFail:  b.checkFail,
+
+		MaxConns:      atomic.LoadInt64(&b.maxConns),
+		LimitQueued:   atomic.LoadInt64(&b.LimitQueued),
+		LimitRejected: atomic.LoadInt64(&b.LimitRejected),
+
+		Ready:       ready,
+		ReadySource: b.readySource,
+		AdminState:  client.AdminStateUp,
+		Removed:     b.removed,
+
+		TLS:          b.tlsSettings != nil,
+		TLSErrors:    atomic.LoadInt64(&b.TLSErrors),
+		LastTLSError: b.lastTLSError,
+
+		Tags: b.Tags,
+	}
+
+	if b.checkCount > 0 {
+		last := b.checkHistory[(b.checkCount-1)%checkHistoryLen]
+		stats.LastCheckStatus = last.Status
+		stats.LastCheckError = last.Error
 	}
 
+	if !ready && !b.readyUntil.IsZero() {
+		stats.ReadyTTL = int(b.readyUntil.Sub(time.Now()) / time.Millisecond)
+	}
+
+	if b.mux != nil {
+		stats.Mux = b.mux.stats()
+	}
+
+	stats.EffectiveWeight = float64(b.Weight) * b.slowStartFactorLocked()
+
+	stats.State = b.state
+	stats.StateChangedAt = b.stateChanged
+	stats.StateDuration = int64(b.now().Sub(b.stateChanged) / time.Millisecond)
+	stats.CheckPassing = b.checkFailingSince.IsZero()
+	if !stats.CheckPassing {
+		failingSince := b.checkFailingSince
+		stats.CheckFailingSince = &failingSince
+	}
+
+	switch {
+	case b.adminDown:
+		stats.AdminState = client.AdminStateDown
+		stats.DownReason = DownAdmin
+	case b.iface.err != nil:
+		stats.DownReason = DownInterfaceUnavailable
+	case !b.up:
+		stats.DownReason = DownCheckFailed
+	}
+	if b.bindInterface != "" {
+		stats.Interface = b.iface.stat(b.bindInterface, b.ifaceChanged)
+	}
+	stats.DialTime = b.dialTime.stat()
+	stats.DialLatency = b.dialLatency.stat()
+	stats.CheckLatency = b.checkLatency.stat()
+
 	return stats
 }
 
+// muxPool returns the backend's mux connections, or nil if the service isn't
+// multiplexed.
+func (b *Backend) muxPool() *muxPool {
+	b.Lock()
+	defer b.Unlock()
+	return b.mux
+}
+
+// Replace the mux connections. The old connections are closed once their
+// requests finish.
+// Backend *must* be locked.
+func (b *Backend) setMuxPool(pool *muxPool) {
+	if b.mux != nil {
+		b.mux.retire()
+	}
+	b.mux = pool
+}
+
+// The connections open to the backend, whether proxied TCP connections or
+// the HTTP transport's.
+func (b *Backend) activeConns() int64 {
+	return atomic.LoadInt64(&b.Active) + atomic.LoadInt64(&b.HTTPActive)
+}
+
+// Up reports whether the backend can take new connections. Both the health
+// checks and the backend's own readiness must agree, and it mustn't have been
+// set down through the API or removed.
 func (b *Backend) Up() bool {
 	b.Lock()
-	up := b.up
+	up := b.up && b.iface.err == nil && b.readyLocked() && !b.adminDown && !b.removed
 	b.Unlock()
 	return up
 }
 
+// AdminDown reports whether the backend was set down through the API.
+func (b *Backend) AdminDown() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.adminDown
+}
+
+// SetAdminDown takes the backend out of rotation, or returns it. Connections
+// that are already open are left alone. A backend returning to rotation must
+// pass rise health checks first, unless it has none.
+func (b *Backend) SetAdminDown(down bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	if down == b.adminDown {
+		return
+	}
+	b.adminDown = down
+	if down {
+		log.With(log.Fields{"service": b.service, "backend": b.Name}).Printf("Backend %s set down", b.Name)
+	} else {
+		log.With(log.Fields{"service": b.service, "backend": b.Name}).Printf("Backend %s set up", b.Name)
+		if b.CheckAddr != "" {
+			b.up = false
+			b.riseCount = 0
+			b.downSince = b.now()
+			b.resetBackoff()
+		}
+	}
+	b.updateState(b.now())
+}
+
+// Ready reports whether the backend is accepting connections, according to
+// the readiness it published.
+func (b *Backend) Ready() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.readyLocked()
+}
+
+// SetReady records the readiness published by the backend. A backend that
+// isn't ready is taken out of rotation immediately. If drain is set, any
+// connections still open after the drain period are closed.
+func (b *Backend) SetReady(ready bool, source string, drain time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.readySource = source
+	b.resetBackoff()
+	if b.drainTimer != nil {
+		b.drainTimer.Stop()
+		b.drainTimer = nil
+	}
+
+	if ready {
+		log.With(log.Fields{"service": b.service, "backend": b.Name}).Printf("Backend %s is ready", b.Name)
+		b.notReady = false
+		b.readyUntil = time.Time{}
+		b.updateState(b.now())
+		return
+	}
+
+	log.With(log.Fields{"service": b.service, "backend": b.Name}).Printf("Backend %s is not ready", b.Name)
+	b.notReady = true
+	b.readyUntil = time.Time{}
+	b.updateState(b.now())
+	if b.readinessTTL > 0 {
+		b.readyUntil = time.Now().Add(b.readinessTTL)
+	}
+
+	if drain > 0 {
+		b.drainTimer = time.AfterFunc(drain, func() {
+			b.Lock()
+			defer b.Unlock()
+			if b.readyLocked() {
+				return
+			}
+			log.With(log.Fields{"service": b.service, "backend": b.Name}).Printf("Closing %d connections to backend %s after draining", len(b.conns), b.Name)
+			for c := range b.conns {
+				c.Conn.Close()
+			}
+		})
+	}
+}
+
+// Check the published readiness, expiring it once the TTL has passed so the
+// health checks are back in control.
+// Backend *must* be locked.
+func (b *Backend) readyLocked() bool {
+	if !b.notReady {
+		return true
+	}
+
+	if !b.readyUntil.IsZero() && !time.Now().Before(b.readyUntil) {
+		log.With(log.Fields{"service": b.service, "backend": b.Name}).Printf("Readiness expired for backend %s", b.Name)
+		b.notReady = false
+		b.updateState(b.readyUntil)
+		b.readyUntil = time.Time{}
+		return true
+	}
+	return false
+}
+
+// track an open connection to this backend
+func (b *Backend) track(c *shuttleConn) {
+	c.backend = b
+	b.Lock()
+	b.conns[c] = true
+	b.Unlock()
+}
+
+func (b *Backend) untrack(c *shuttleConn) {
+	b.Lock()
+	delete(b.conns, c)
+	b.Unlock()
+}
+
+// Set the health check type, path, timeout and payload from the config,
+// filling in the defaults.
+// Backend *must* be locked, unless it hasn't started.
+func (b *Backend) setCheck(cfg client.BackendConfig) {
+	b.CheckType, b.CheckPath = cfg.CheckType, cfg.CheckPath
+	b.checkTimeout, b.checkPayload = 0, nil
+
+	if b.CheckType == "" {
+		b.CheckType = client.CheckTCP
+	}
+	if b.CheckType == client.CheckHTTP && b.CheckPath == "" {
+		b.CheckPath = client.DefaultCheckPath
+	}
+	if b.CheckType == client.CheckHTTP || b.CheckType == client.CheckUDP {
+		b.checkTimeout = time.Duration(cfg.CheckTimeout) * time.Millisecond
+		if b.checkTimeout == 0 {
+			b.checkTimeout = client.DefaultCheckTimeout * time.Millisecond
+		}
+	}
+	if b.CheckType == client.CheckUDP {
+		b.checkPayload = []byte(cfg.CheckPayload)
+	}
+}
+
+// Report whether a patched config can be applied to the running backend. A
+// new address, network, check address or TLS config makes it another
+// backend, which has to replace this one.
+func (b *Backend) patchable(cfg client.BackendConfig) bool {
+	current, cfg := b.Config().SetDefaults(), cfg.SetDefaults()
+	return cfg.Addr == current.Addr && cfg.Network == current.Network &&
+		cfg.CheckAddr == current.CheckAddr && reflect.DeepEqual(cfg.TLS, current.TLS)
+}
+
+// Apply a patched config to the running backend, keeping its connections,
+// counters, check history and state.
+func (b *Backend) patch(cfg client.BackendConfig) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.Weight = cfg.Weight
+	b.Tags = cfg.Tags
+	atomic.StoreInt64(&b.maxConns, int64(cfg.MaxConns))
+	b.setCheck(cfg)
+}
+
 // Return the struct for marshaling into a json config
 func (b *Backend) Config() client.BackendConfig {
 	b.Lock()
@@ -136,6 +632,35 @@ func (b *Backend) Config() client.BackendConfig {
 		Addr:      b.Addr,
 		CheckAddr: b.CheckAddr,
 		Weight:    b.Weight,
+		Tags:      b.Tags,
+
+		BindInterface: b.BindInterface,
+		MaxConns:      int(atomic.LoadInt64(&b.maxConns)),
+		SlowStart:     int(b.slowStart / time.Millisecond),
+	}
+
+	if b.tlsSettings != nil {
+		tlsSettings := *b.tlsSettings
+		cfg.TLS = &tlsSettings
+	}
+
+	if b.adminDown {
+		cfg.AdminState = client.AdminStateDown
+	}
+
+	if b.Network != client.DefaultNet {
+		cfg.Network = b.Network
+	}
+
+	switch b.CheckType {
+	case client.CheckHTTP:
+		cfg.CheckType = b.CheckType
+		cfg.CheckPath = b.CheckPath
+		cfg.CheckTimeout = int(b.checkTimeout / time.Millisecond)
+	case client.CheckUDP:
+		cfg.CheckType = b.CheckType
+		cfg.CheckTimeout = int(b.checkTimeout / time.Millisecond)
+		cfg.CheckPayload = string(b.checkPayload)
 	}
 
 	return cfg
@@ -147,67 +672,441 @@ func (b *Backend) String() string {
 }
 
 func (b *Backend) Start() {
-	go b.startCheck.Do(b.healthCheck)
+	b.Lock()
+	b.publishEvent(client.EventBackendAdded, "", b.state, b.now())
+	owner := b.taskOwner()
+	b.Unlock()
+	goTask("health_check", owner, func() { b.startCheck.Do(b.healthCheck) })
+}
+
+// The owner of the backend's tasks, "service/backend".
+// Backend *must* be locked.
+func (b *Backend) taskOwner() string {
+	return b.service + "/" + b.Name
 }
 
 func (b *Backend) Stop() {
+	b.Lock()
+	b.publishEvent(client.EventBackendRemoved, b.state, "", b.now())
+	b.Unlock()
 	close(b.stopCheck)
+	if q := b.sendQueue(); q != nil {
+		q.close()
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.lastCapture != nil {
+		b.lastCapture.Stop("backend removed")
+	}
+	b.setMuxPool(nil)
+	b.setBindInterface("")
+}
+
+// activeCapture returns the running capture for this backend, or nil.
+func (b *Backend) activeCapture() *capture {
+	c, _ := b.capture.Load().(*capture)
+	return c
+}
+
+// Start capturing the payload of new connections to this backend.
+func (b *Backend) StartCapture(service string, cfg client.CaptureConfig) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.activeCapture() != nil {
+		return ErrCaptureActive
+	}
+
+	c := newCapture(service, b.Name, cfg, func() {
+		b.capture.Store((*capture)(nil))
+	})
+	b.lastCapture = c
+	b.capture.Store(c)
+	return nil
+}
+
+func (b *Backend) StopCapture() error {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.lastCapture == nil {
+		return ErrNoCapture
+	}
+	b.lastCapture.Stop("stopped")
+	return nil
+}
+
+// Capture returns the data from the current or last capture.
+func (b *Backend) Capture() (CaptureDump, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.lastCapture == nil {
+		return CaptureDump{}, ErrNoCapture
+	}
+	return b.lastCapture.Dump(), nil
+}
+
+// Record the time taken by an attempt to connect a client, whether or not it
+// succeeded.
+func (b *Backend) observeDial(d time.Duration) {
+	b.dialTime.observe(d)
+	b.dialLatency.observe(d)
 }
 
 func (b *Backend) check() {
 	if b.CheckAddr == "" {
 		return
 	}
+	b.runCheck(true)
+}
+
+// Run a single health check and record the result. If count is false, the
+// result is recorded in the history, but doesn't change the rise and fall
+// counts or the backend state.
+func (b *Backend) runCheck(count bool) CheckResult {
+	result := CheckResult{
+		Time:    time.Now(),
+		OK:      true,
+		Counted: count,
+	}
+
+	dialer := b.dialer
+	if dialer == nil {
+		dialer = defaultDialerFactory
+	}
 
-	up := true
-	if c, e := net.DialTimeout("tcp", b.CheckAddr, b.dialTimeout); e == nil {
-		c.(*net.TCPConn).SetLinger(0)
+	b.Lock()
+	ports, preamble, userAgent := b.checkPorts, b.checkPreamble, b.checkUserAgent
+	checkType, checkPath := b.CheckType, b.CheckPath
+	checkTimeout, payload := b.checkTimeout, b.checkPayload
+	b.Unlock()
+
+	network := "tcp"
+	switch {
+	case checkType == client.CheckUDP:
+		network = "udp"
+	case b.Network == "unix":
+		// CheckAddr is a socket path, and there are no source ports
+		network = "unix"
+		ports = portRange{}
+	}
+
+	c, e := b.dialCheck(dialer, network, ports)
+	if e == nil {
+		// a udp check's payload is its own marker
+		if len(preamble) > 0 && network != "udp" {
+			if b.dialTimeout > 0 {
+				c.SetWriteDeadline(time.Now().Add(b.dialTimeout))
+			}
+			_, e = c.Write(preamble)
+		}
+		if e == nil && checkType == client.CheckHTTP {
+			c.SetDeadline(result.Time.Add(b.dialTimeout + checkTimeout))
+			check := c
+			if b.tlsConfig != nil {
+				// the handshake is made along with the request
+				check = tls.Client(c, b.tlsConfig)
+			}
+			result.Status, e = b.httpCheck(check, checkPath, userAgent)
+		}
+		if e == nil && checkType == client.CheckUDP {
+			c.SetDeadline(result.Time.Add(b.dialTimeout + checkTimeout))
+			e = udpCheck(c, payload)
+		}
+		if tc, ok := c.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
 		c.Close()
-	} else {
-		log.Debug("Check error:", e)
-		up = false
 	}
+	if e != nil {
+		log.With(log.Fields{"service": b.service, "backend": b.Name, "addr": b.CheckAddr, "err": e}).Debug("Check error:", e)
+		result.OK = false
+		result.Error = e.Error()
+	}
+	result.Duration = time.Since(result.Time)
+	b.checkLatency.observe(result.Duration)
 
 	b.Lock()
 	defer b.Unlock()
+
+	b.checkHistory[b.checkCount%checkHistoryLen] = result
+	b.checkCount++
+
+	if count {
+		b.countCheck(result.OK)
+	}
+	if result.OK {
+		b.resetBackoff()
+	}
+	return result
+}
+
+// Dial a health check, from the check source ports if they're set. Ports
+// already in use, possibly by checks to other backends, are skipped.
+func (b *Backend) dialCheck(dialer DialerFactory, network string, ports portRange) (net.Conn, error) {
+	if !ports.isSet() {
+		return b.dial(dialer, network, b.CheckAddr, b.dialTimeout)
+	}
+
+	var err error
+	for i := 0; i < ports.size(); i++ {
+		b.Lock()
+		port := ports.low + b.checkPort%ports.size()
+		b.checkPort++
+		b.Unlock()
+
+		var c net.Conn
+		c, err = b.dialFrom(dialer, network, port, b.CheckAddr, b.dialTimeout)
+		if err == nil || !addrInUse(err) {
+			return c, err
+		}
+	}
+	return nil, err
+}
+
+// Send an http health check for path on a connected check conn, returning the
+// status. Anything but a 2xx or 3xx response is an error. The check only
+// identifies itself if it has a userAgent.
+func (b *Backend) httpCheck(c net.Conn, path, userAgent string) (int, error) {
+	host := b.CheckAddr
+	if b.Network == "unix" {
+		host = "localhost"
+	}
+	req, err := http.NewRequest("GET", "http://"+host+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Close = true
+	// an empty User-Agent isn't sent at all
+	req.Header.Set("User-Agent", userAgent)
+	if userAgent != "" {
+		req.Header.Set("X-Shuttle-Service", b.service)
+	}
+
+	if err := req.Write(c); err != nil {
+		return 0, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return resp.StatusCode, fmt.Errorf("check returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Send a udp check's payload on a connected check socket. With a payload, the
+// check passes on any response. Without one, it passes unless the read
+// reports CheckAddr unreachable before the deadline.
+func udpCheck(c net.Conn, payload []byte) error {
+	if _, err := c.Write(payload); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 512)
+	_, err := c.Read(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() && len(payload) == 0 {
+		return nil
+	}
+	return err
+}
+
+// Update the rise and fall counts, marking the backend up or down.
+// Backend *must* be locked.
+func (b *Backend) countCheck(up bool) {
 	if up {
-		log.Debugf("Check OK for %s/%s", b.Name, b.CheckAddr)
+		log.With(log.Fields{"service": b.service, "backend": b.Name, "addr": b.CheckAddr}).Debugf("Check OK for %s/%s", b.Name, b.CheckAddr)
 		b.fallCount = 0
+		b.checkFailingSince = time.Time{}
 		b.riseCount++
 		b.checkOK++
 		if b.riseCount >= b.rise {
 			if !b.up {
-				log.Debugf("Marking backend %s Up", b.Name)
+				log.With(log.Fields{"service": b.service, "backend": b.Name}).Debugf("Marking backend %s Up", b.Name)
 			}
 			b.up = true
+			b.downSince = time.Time{}
 		}
 	} else {
-		log.Debugf("Check failed for %s/%s", b.Name, b.CheckAddr)
+		log.With(log.Fields{"service": b.service, "backend": b.Name, "addr": b.CheckAddr}).Debugf("Check failed for %s/%s", b.Name, b.CheckAddr)
 		b.riseCount = 0
+		if b.fallCount == 0 {
+			b.checkFailingSince = b.now()
+		}
 		b.fallCount++
 		b.checkFail++
 		if b.fallCount >= b.fall {
 			if b.up {
-				log.Debugf("Marking backend %s Down", b.Name)
+				log.With(log.Fields{"service": b.service, "backend": b.Name}).Debugf("Marking backend %s Down", b.Name)
+				b.downSince = b.now()
 			}
 			b.up = false
 		}
 	}
+	b.updateState(b.now())
 }
 
 // Periodically check the status of this backend
 func (b *Backend) healthCheck() {
-	t := time.NewTicker(b.checkInterval)
+	t := time.NewTimer(b.scheduleCheck())
 	for {
 		select {
 		case <-b.stopCheck:
-			log.Debug("Stopping backend", b.Name)
+			log.With(log.Fields{"service": b.service, "backend": b.Name}).Debug("Stopping backend", b.Name)
 			t.Stop()
 			return
+		case <-b.wakeCheck:
+			t.Stop()
+			t = time.NewTimer(b.scheduleCheck())
 		case <-t.C:
+			if !b.awaitCheckBudget() {
+				log.With(log.Fields{"service": b.service, "backend": b.Name}).Debug("Stopping backend", b.Name)
+				return
+			}
 			b.check()
+			t.Reset(b.scheduleCheck())
+		}
+	}
+}
+
+// Record when the next health check will run, and return the time until
+// then.
+func (b *Backend) scheduleCheck() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.interval = b.nextInterval()
+	wait := b.interval
+	if b.checkJitter > 0 {
+		wait += time.Duration((rand.Float64()*2 - 1) * b.checkJitter * float64(wait))
+	}
+	b.nextCheck = b.now().Add(wait)
+	return wait
+}
+
+// The time until the next check. Once the backend has been down for
+// backoffAfter, each interval is double the last, up to backoffMax.
+//
+// A backend that recovers is noticed by the next check, at most backoffMax
+// later, and the first successful check resets the backoff. The worst case
+// for marking the backend up is backoffMax + (rise-1) * checkInterval.
+// Backend *must* be locked.
+func (b *Backend) nextInterval() time.Duration {
+	if b.backoffAfter <= 0 || b.up || b.downSince.IsZero() ||
+		b.now().Sub(b.downSince) < b.backoffAfter {
+		return b.checkInterval
+	}
+
+	interval := b.interval * 2
+	if interval < b.checkInterval {
+		interval = b.checkInterval
+	}
+	if interval > b.backoffMax {
+		interval = b.backoffMax
+	}
+	return interval
+}
+
+// ResetBackoff returns to the normal check interval after an intervention
+// through the API.
+func (b *Backend) ResetBackoff() {
+	b.Lock()
+	defer b.Unlock()
+	b.resetBackoff()
+}
+
+// Return to the normal check interval. A backend that is still down starts
+// backing off again after backoffAfter.
+// Backend *must* be locked.
+func (b *Backend) resetBackoff() {
+	if !b.downSince.IsZero() {
+		b.downSince = b.now()
+	}
+	if b.interval <= b.checkInterval {
+		return
+	}
+
+	log.With(log.Fields{"service": b.service, "backend": b.Name}).Debugf("Resetting check backoff for %s", b.Name)
+	b.interval = b.checkInterval
+	select {
+	case b.wakeCheck <- struct{}{}:
+	default:
+	}
+}
+
+// Return the health check state and history, oldest result first.
+func (b *Backend) Checks() BackendChecks {
+	b.Lock()
+	defer b.Unlock()
+
+	checks := BackendChecks{
+		Name:      b.Name,
+		CheckAddr: b.CheckAddr,
+		Up:        b.up,
+		Interval:  int(b.checkInterval / time.Millisecond),
+		Rise:      b.rise,
+		Fall:      b.fall,
+		RiseCount: b.riseCount,
+		FallCount: b.fallCount,
+		History:   []CheckResult{},
+	}
+
+	if b.CheckAddr != "" {
+		checks.NextCheck = b.nextCheck
+	}
+	checks.EffectiveInterval = checks.Interval
+	if b.interval > 0 {
+		checks.EffectiveInterval = int(b.interval / time.Millisecond)
+	}
+
+	first := b.checkCount - checkHistoryLen
+	if first < 0 {
+		first = 0
+	}
+	for i := first; i < b.checkCount; i++ {
+		checks.History = append(checks.History, b.checkHistory[i%checkHistoryLen])
+	}
+
+	return checks
+}
+
+// A summary of the backend's recent health check results.
+type BackendHistory struct {
+	Checks    int        `json:"checks"`
+	Failed    int        `json:"failed"`
+	LastOK    *time.Time `json:"last_ok,omitempty"`
+	LastFail  *time.Time `json:"last_fail,omitempty"`
+	DownSince *time.Time `json:"down_since,omitempty"`
+}
+
+func (b *Backend) History() BackendHistory {
+	checks := b.Checks()
+
+	h := BackendHistory{Checks: len(checks.History)}
+	for i := range checks.History {
+		r := &checks.History[i]
+		if r.OK {
+			h.LastOK = &r.Time
+		} else {
+			h.Failed++
+			h.LastFail = &r.Time
 		}
 	}
+
+	b.Lock()
+	if !b.downSince.IsZero() {
+		downSince := b.downSince
+		h.DownSince = &downSince
+	}
+	b.Unlock()
+
+	return h
 }
 
 // use to identify embedded TCPConns
@@ -216,8 +1115,9 @@ type closeReader interface {
 }
 
 func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
+	cliAddr := normalizeClientAddr(cliConn.RemoteAddr().String()).String()
 	log.Debugf("Initiating proxy: %s/%s-%s/%s",
-		cliConn.RemoteAddr(),
+		cliAddr,
 		cliConn.LocalAddr(),
 		srvConn.LocalAddr(),
 		srvConn.RemoteAddr(),
@@ -227,13 +1127,16 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	// but all updates will be done atomically.
 
 	bConn := &shuttleConn{
-		TCPConn:   srvConn.(*net.TCPConn),
-		rwTimeout: b.rwTimeout,
-		read:      &b.Rcvd,
-		written:   &b.Sent,
+		Conn:        srvConn,
+		rwTimeout:   b.rwTimeout.Get(),
+		liveTimeout: b.rwTimeout,
+		read:        &b.Rcvd,
+		written:     &b.Sent,
 	}
-	// TODO: No way to force shutdown. Do we need it, or should we always just
-	// let a connection run out?
+	if c := b.activeCapture(); c != nil {
+		bConn.capture = c.newSession(cliAddr, b.Addr)
+	}
+	b.track(bConn)
 
 	atomic.AddInt64(&b.Conns, 1)
 	atomic.AddInt64(&b.Active, 1)
@@ -243,8 +1146,8 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	backendClosed := make(chan bool, 1)
 	clientClosed := make(chan bool, 1)
 
-	go broker(bConn, cliConn, clientClosed, &b.Sent, &b.Errors)
-	go broker(cliConn, bConn, backendClosed, &b.Rcvd, &b.Errors)
+	tcpBrokerTasks.goTask(func() { broker(bConn, cliConn, clientClosed, &b.Sent, &b.Errors) })
+	tcpBrokerTasks.goTask(func() { broker(cliConn, bConn, backendClosed, &b.Rcvd, &b.Errors) })
 
 	// wait for one half of the proxy to exit, then trigger a shutdown of the
 	// other half by calling CloseRead(). This will break the read loop in the
@@ -252,10 +1155,12 @@ func (b *Backend) Proxy(srvConn, cliConn net.Conn) {
 	var waitFor chan bool
 	select {
 	case <-clientClosed:
-		log.Debugf("Client %s/%s closed connection", cliConn.RemoteAddr(), cliConn.LocalAddr())
+		log.Debugf("Client %s/%s closed connection", cliAddr, cliConn.LocalAddr())
 		// the client closed first, so any more packets here are invalid, and
 		// we can SetLinger(0) to recycle the port faster.
-		bConn.TCPConn.SetLinger(0)
+		if tc, ok := srvConn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
 		bConn.CloseRead()
 		waitFor = backendClosed
 	case <-backendClosed:
@@ -282,43 +1187,170 @@ func broker(dst, src net.Conn, srcClosed chan bool, written, errors *int64) {
 	srcClosed <- true
 }
 
+// liveTimeout is a read/write timeout shared between a Service and its
+// connections, so that it can be changed while the service is running.
+// New connections always pick up the current value. Existing connections only
+// see a change if rearm is set, otherwise they keep the timeout they started
+// with.
+type liveTimeout struct {
+	// both accessed atomically
+	timeout int64
+	rearm   int32
+}
+
+func newLiveTimeout(timeout time.Duration) *liveTimeout {
+	return &liveTimeout{timeout: int64(timeout)}
+}
+
+// Get returns the current timeout. A nil *liveTimeout has no timeout.
+func (t *liveTimeout) Get() time.Duration {
+	if t == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&t.timeout))
+}
+
+func (t *liveTimeout) Set(timeout time.Duration) {
+	atomic.StoreInt64(&t.timeout, int64(timeout))
+}
+
+// Rearm reports whether existing connections should use the current timeout
+// on their next read or write.
+func (t *liveTimeout) Rearm() bool {
+	if t == nil {
+		return false
+	}
+	return atomic.LoadInt32(&t.rearm) == 1
+}
+
+func (t *liveTimeout) SetRearm(rearm bool) {
+	var v int32
+	if rearm {
+		v = 1
+	}
+	atomic.StoreInt32(&t.rearm, v)
+}
+
 // A net.Conn that sets a deadline for every read or write operation.
 // This will allow the server to close connections that are broken at the
 // network level.
 type shuttleConn struct {
-	*net.TCPConn
+	// Only the net.Conn methods are promoted, so io.Copy can't use the
+	// ReadFrom or WriteTo of a *net.TCPConn to bypass our Read and Write,
+	// along with their deadlines and stats.
+	net.Conn
 	rwTimeout time.Duration
 
+	// the service's timeout, used in place of rwTimeout when re-arming is
+	// enabled.
+	liveTimeout *liveTimeout
+
 	// count bytes read and written through this connection
 	written *int64
 	read    *int64
 
 	// decrement when closed
 	connected *int64
+
+	// the count of the HTTP transport's idle connections, and whether this
+	// one is idle, as described in httpidle.go
+	idle      *int64
+	idleState int64
+
+	// record the payload of a backend connection
+	capture *captureSession
+
+	// the listener that accepted this connection, if any
+	listener *timeoutListener
+
+	// the backend this connection was made to, if any
+	backend *Backend
+
+	// Deadlines set explicitly, in unix nanoseconds, which the timeouts for
+	// each read or write can't extend. The http.Server sets a read deadline
+	// in the past to stop its background read, which must not be lost.
+	readDeadline  int64
+	writeDeadline int64
+}
+
+func deadlineNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (c *shuttleConn) SetDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.readDeadline, deadlineNano(t))
+	atomic.StoreInt64(&c.writeDeadline, deadlineNano(t))
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *shuttleConn) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.readDeadline, deadlineNano(t))
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *shuttleConn) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&c.writeDeadline, deadlineNano(t))
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Set the deadline for the next operation to the timeout from now, or the
+// explicit deadline if that's earlier. If the explicit deadline changes while
+// we're setting ours, we set it again so it isn't overwritten.
+func (c *shuttleConn) setOpDeadline(timeout time.Duration, explicit *int64, set func(time.Time) error) error {
+	for {
+		current := atomic.LoadInt64(explicit)
+		deadline := time.Now().Add(timeout)
+		if current != 0 && current < deadline.UnixNano() {
+			deadline = time.Unix(0, current)
+		}
+		if err := set(deadline); err != nil {
+			return err
+		}
+		if atomic.LoadInt64(explicit) == current {
+			return nil
+		}
+	}
+}
+
+// timeout returns the deadline to use for the next read or write.
+func (c *shuttleConn) timeout() time.Duration {
+	if c.liveTimeout.Rearm() {
+		return c.liveTimeout.Get()
+	}
+	return c.rwTimeout
 }
 
 func (c *shuttleConn) Read(b []byte) (int, error) {
-	if c.rwTimeout > 0 {
-		err := c.TCPConn.SetReadDeadline(time.Now().Add(c.rwTimeout))
+	if timeout := c.timeout(); timeout > 0 {
+		err := c.setOpDeadline(timeout, &c.readDeadline, c.Conn.SetReadDeadline)
 		if err != nil {
 			return 0, err
 		}
 	}
-	n, err := c.TCPConn.Read(b)
+	n, err := c.Conn.Read(b)
 	atomic.AddInt64(c.read, int64(n))
+	if c.capture != nil && n > 0 {
+		c.capture.record(client.CaptureResponse, b[:n])
+	}
 	return n, err
 }
 
 func (c *shuttleConn) Write(b []byte) (int, error) {
-	if c.rwTimeout > 0 {
-		err := c.TCPConn.SetWriteDeadline(time.Now().Add(c.rwTimeout))
+	if timeout := c.timeout(); timeout > 0 {
+		err := c.setOpDeadline(timeout, &c.writeDeadline, c.Conn.SetWriteDeadline)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	n, err := c.TCPConn.Write(b)
+	n, err := c.Conn.Write(b)
 	atomic.AddInt64(c.written, int64(n))
+	if c.capture != nil && n > 0 {
+		c.capture.record(client.CaptureRequest, b[:n])
+	}
 	return n, err
 }
 
@@ -326,10 +1358,21 @@ func (c *shuttleConn) Close() error {
 	if c.connected != nil {
 		atomic.AddInt64(c.connected, -1)
 	}
-	return c.TCPConn.Close()
+	c.closeIdle()
+	if c.listener != nil {
+		c.listener.remove(c)
+	}
+	if c.backend != nil {
+		c.backend.untrack(c)
+	}
+	return c.Conn.Close()
 }
 
-// Empty function to override the ReadFrom in *net.TCPConn
-// io.Copy will attempt to use ReadFrom when it can, but there's no bennefit
-// for a TCPConn->TCPConn, and it prevents us from collecting Read/Write stats.
-func (c *shuttleConn) ReadFrom() {}
+// CloseRead shuts down the reading side of the connection, if the underlying
+// connection supports it.
+func (c *shuttleConn) CloseRead() error {
+	if cr, ok := c.Conn.(closeReader); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidBackendLimit = fmt.Errorf("invalid backend limit")
+
+// How often a queued connection checks whether a backend has room.
+var capacityPoll = 10 * time.Millisecond
+
+// Check a backend's connection limit, which is off when 0.
+func validMaxConns(cfg client.BackendConfig) error {
+	if cfg.MaxConns < 0 {
+		return fmt.Errorf("%w for %s: negative max conns", ErrInvalidBackendLimit, cfg.Name)
+	}
+	if cfg.MaxConns > 0 && networkFamily(cfg.Network) == "udp" {
+		return fmt.Errorf("%w for %s: %q backend", ErrInvalidBackendLimit, cfg.Name, cfg.Network)
+	}
+	return nil
+}
+
+// Check what a service does once its backends are full, and the limits of
+// its backends.
+func validBackendLimits(cfg client.ServiceConfig) error {
+	switch cfg.BackendFullAction {
+	case "", client.BackendFullFail, client.BackendFullQueue:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidBackendLimit, cfg.BackendFullAction)
+	}
+	if cfg.QueueTimeout < 0 {
+		return fmt.Errorf("%w: negative queue timeout", ErrInvalidBackendLimit)
+	}
+	for _, b := range cfg.Backends {
+		if err := validMaxConns(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set what happens to connections once every backend is at its limit.
+// Service *must* be locked, or not yet started.
+func (s *Service) setBackendFullAction(cfg client.ServiceConfig) {
+	s.BackendFullAction = cfg.BackendFullAction
+	if s.BackendFullAction == "" {
+		s.BackendFullAction = client.DefaultBackendFullAction
+	}
+	s.QueueTimeout = time.Duration(cfg.QueueTimeout) * time.Millisecond
+	if s.BackendFullAction == client.BackendFullQueue && s.QueueTimeout == 0 {
+		s.QueueTimeout = client.DefaultQueueTimeout * time.Millisecond
+	}
+}
+
+// Take one of the backend's connection slots, reporting false if it's at its
+// limit. Every slot taken must be released.
+func (b *Backend) acquire() bool {
+	max := atomic.LoadInt64(&b.maxConns)
+	if max == 0 {
+		atomic.AddInt64(&b.inUse, 1)
+		return true
+	}
+	for {
+		n := atomic.LoadInt64(&b.inUse)
+		if n >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.inUse, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (b *Backend) release() {
+	atomic.AddInt64(&b.inUse, -1)
+}
+
+// Report whether the backend is at its connection limit.
+func (b *Backend) full() bool {
+	max := atomic.LoadInt64(&b.maxConns)
+	return max > 0 && atomic.LoadInt64(&b.inUse) >= max
+}
+
+// Return the backends at their limit if none of the backends a new
+// connection could go to has room, or nil if one does. A service's only
+// backend is counted even while it's down, as it is by the balancer.
+func (s *Service) backendsFull() []*Backend {
+	s.Lock()
+	defer s.Unlock()
+
+	var full []*Backend
+	for _, b := range s.Backends {
+		if len(s.Backends) > 1 && !b.Up() {
+			continue
+		}
+		if !b.full() {
+			return nil
+		}
+		full = append(full, b)
+	}
+	return full
+}
+
+// Check that a backend has room for a new connection or request, queueing it
+// until one does if the service queues. Returns false if the connection
+// should be turned away. The connections queued or turned away are counted
+// on each backend that was at its limit.
+func (s *Service) awaitCapacity() bool {
+	full := s.backendsFull()
+	if full == nil {
+		return true
+	}
+
+	s.Lock()
+	action, timeout := s.BackendFullAction, s.QueueTimeout
+	s.Unlock()
+
+	if action == client.BackendFullQueue {
+		for _, b := range full {
+			atomic.AddInt64(&b.LimitQueued, 1)
+		}
+		deadline := time.Now().Add(timeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(capacityPoll)
+			if full = s.backendsFull(); full == nil {
+				return true
+			}
+		}
+	}
+
+	for _, b := range full {
+		atomic.AddInt64(&b.LimitRejected, 1)
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// Check a backend's TLS settings, and build the config its connections are
+// made with. The config is nil if TLS isn't configured.
+func backendTLSConfig(cfg client.BackendConfig) (*tls.Config, error) {
+	if cfg.TLS == nil {
+		return nil, nil
+	}
+	if networkFamily(cfg.Network) == "udp" {
+		return nil, fmt.Errorf("%w for %s: %q backend", ErrInvalidTLS, cfg.Name, cfg.Network)
+	}
+
+	tlsCfg := &tls.Config{
+		ServerName:         cfg.TLS.ServerName,
+		InsecureSkipVerify: cfg.TLS.InsecureSkipVerify,
+	}
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName = "localhost"
+		if cfg.Network != "unix" {
+			host, _, err := net.SplitHostPort(cfg.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("%w for %s: %s", ErrInvalidTLS, cfg.Name, err)
+			}
+			tlsCfg.ServerName = host
+		}
+	}
+
+	if cfg.TLS.CACert != "" {
+		data, err := ioutil.ReadFile(cfg.TLS.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s: %s", ErrInvalidTLS, cfg.Name, err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%w for %s: no certificates in %s", ErrInvalidTLS, cfg.Name, cfg.TLS.CACert)
+		}
+	}
+	return tlsCfg, nil
+}
+
+func validBackendsTLS(cfg client.ServiceConfig) error {
+	for _, b := range cfg.Backends {
+		if b.Network == "" {
+			b.Network = defaultBackendNetwork(cfg.Network)
+		}
+		if _, err := backendTLSConfig(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start TLS on a connection to the backend, if it's configured, completing
+// the handshake within timeout. A failed handshake is counted in TLSErrors;
+// the conn is left for the caller to close.
+func (b *Backend) startTLS(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if b.tlsConfig == nil {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, b.tlsConfig)
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		log.Errorf("ERROR: TLS handshake with backend %s/%s: %s", b.service, b.Name, err)
+		atomic.AddInt64(&b.TLSErrors, 1)
+		b.Lock()
+		b.lastTLSError = err.Error()
+		b.Unlock()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// The scheme of the HTTP requests sent to the backend at addr.
+func (s *Service) backendScheme(addr string) string {
+	if b := s.backendAt(addr); b != nil && b.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -1,104 +1,244 @@
 package main
 
 import (
+	"fmt"
+	"hash/fnv"
+	"net"
 	"sort"
 	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
 )
 
-// Balancing functions return a slice of all known available backends, in
-// priority order.  This way the service can cycle through backends if the
-// initial connections fails.
+// Balancers return a slice of all known available backends, in priority
+// order.  This way the service can cycle through backends if the initial
+// connections fails.
+//
+// A balancer is called with the service locked, and with the Up state of each
+// backend read once for the call, so that a shadow balancer sees exactly the
+// same state as the active one. clientIP is the IP of the client the backend
+// is for, or nil if it isn't known.
+//
+// balanceUDP chooses the backend for a single datagram, or nil if none is up.
+// It's on the per-datagram path, so rather than allocating it keeps what it
+// precomputes until ver, the version of the backends, changes.
+type balancer interface {
+	balance(backends []*Backend, up []bool, clientIP net.IP) []*Backend
+	balanceUDP(backends []*Backend, ver uint64, clientIP net.IP) *Backend
+}
 
-// RR is always weighted.
-// we don't reduce the weight, we just distribute exactly "Weight" calls in
-// a row
-func (s *Service) roundRobin() []*Backend {
+var ErrInvalidBalance = fmt.Errorf("invalid balancing algorithm")
+
+// Create the balancer for a config value, defaulting to RoundRobin.
+func newBalancer(name string) balancer {
+	switch name {
+	case client.LeastConn:
+		return &leastConn{}
+	case client.IPHash:
+		return &ipHash{}
+	case client.RoundRobin, "":
+	default:
+		log.Warnf("invalid balancing algorithm '%s'", name)
+	}
+	return &roundRobin{}
+}
+
+func validBalance(name string) error {
+	switch name {
+	case "", client.RoundRobin, client.LeastConn, client.IPHash:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidBalance, name)
+}
+
+// Return the backends in priority order for a new connection or request from
+// clientIP, recording the choice of the shadow balancer if there is one.
+func (s *Service) next(clientIP net.IP) []*Backend {
+	_, balanced := s.balanced(clientIP, true)
+	return balanced
+}
+
+// Balance the backends for clientIP, and return the version of the backends
+// they were balanced from. The shadow balancer's choice is only recorded if
+// observe is set.
+func (s *Service) balanced(clientIP net.IP, observe bool) (uint64, []*Backend) {
 	s.Lock()
 	defer s.Unlock()
 
-	count := len(s.Backends)
-	switch count {
+	var balanced []*Backend
+	switch count := len(s.Backends); count {
 	case 0:
-		return nil
+		return s.backendsVer, nil
 	case 1:
-		// fast track for the single backend case
-		return s.Backends[0:1]
+		// fast track for the single backend case, which is used even if it's
+		// down, unless the backend itself asked not to be or it was set down
+		// through the API.
+		if !s.Backends[0].Ready() || s.Backends[0].AdminDown() {
+			return s.backendsVer, nil
+		}
+		balanced = s.Backends[0:1]
+		if s.shadow != nil && observe {
+			s.shadow.observe(balanced, balanced)
+		}
+	default:
+		up := make([]bool, count)
+		for i, b := range s.Backends {
+			up[i] = b.Up()
+		}
+
+		balanced = s.balancer.balance(s.Backends, up, clientIP)
+		if s.shadow != nil && observe {
+			s.shadow.observe(balanced, s.shadow.balancer.balance(s.Backends, up, clientIP))
+		}
 	}
+	return s.backendsVer, balanced
+}
+
+// RR is always weighted.
+// we don't reduce the weight, we just distribute exactly "Weight" calls in
+// a row, except to a backend that's warming up, which only takes its share
+// of its turns.
+type roundRobin struct {
+	// the last backend we used and the number of times we used it
+	lastBackend int
+	lastCount   int
+	// the turns of the last backend, if it's warming up
+	lastTurns int
+
+	// for UDP, the index of each backend repeated Weight times in a row, the
+	// version of the backends it was built for, and the next position in it
+	sched    []int
+	schedVer uint64
+	pos      int
+}
+
+func (rr *roundRobin) balance(backends []*Backend, up []bool, _ net.IP) []*Backend {
+	count := len(backends)
 
 	// we may be out of range if we lost a backend since last connections
-	if s.lastBackend >= count {
-		s.lastBackend = 0
-		s.lastCount = 0
+	if rr.lastBackend >= count {
+		rr.lastBackend = 0
+		rr.lastCount = 0
 	}
 
-	// if our backend was over-weight, but we can't find another, use this
-	var reuse *Backend
+	// if our backend was over-weight, but we can't find another, use this,
+	// or failing that a backend warming up that had no turns to take
+	var reuse, warming *Backend
 
 	var balanced []*Backend
-	// Find the next Up backend to call
-	for i := 0; i < count; i++ {
-		backend := s.Backends[s.lastBackend]
+	// Find the next Up backend to call, coming back around to the first
+	// with a fresh count
+	for i := 0; i <= count; i++ {
+		backend := backends[rr.lastBackend]
+
+		if up[rr.lastBackend] {
+			limit := int(backend.Weight)
+			if factor := backend.slowStartFactor(); factor < 1 {
+				if rr.lastCount == 0 {
+					rr.lastTurns = backend.slowStartTurns(limit, factor)
+				}
+				limit = rr.lastTurns
+			}
 
-		if backend.Up() {
-			if s.lastCount >= int(backend.Weight) {
+			if rr.lastCount >= limit {
 				// used too many times, but save it just in case
-				reuse = backend
-				s.lastBackend = (s.lastBackend + 1) % count
-				s.lastCount = 0
+				if limit > 0 {
+					reuse = backend
+				} else {
+					warming = backend
+				}
+				rr.lastBackend = (rr.lastBackend + 1) % count
+				rr.lastCount = 0
 				continue
 			}
 
-			s.lastCount++
+			rr.lastCount++
 			balanced = append(balanced, backend)
 
 			break
 		}
 
-		s.lastBackend = (s.lastBackend + 1) % count
+		rr.lastBackend = (rr.lastBackend + 1) % count
 	}
 
 	if len(balanced) == 0 {
-		if reuse != nil {
+		switch {
+		case reuse != nil:
 			balanced = append(balanced, reuse)
-		} else {
+		case warming != nil:
+			balanced = append(balanced, warming)
+		default:
 			return nil
 		}
 	}
 
 	// Now add the rest of the available backends in order, in case the first
 	// connect fails
-	lastBackend := s.lastBackend
+	lastBackend := rr.lastBackend
 	for i := 0; i < count-1; i++ {
 		lastBackend = (lastBackend + 1) % count
-		backend := s.Backends[lastBackend]
-		if backend.Up() {
-			balanced = append(balanced, backend)
+		if up[lastBackend] {
+			balanced = append(balanced, backends[lastBackend])
 		}
 	}
 
 	return balanced
 }
 
-// LC returns the backend with the least number of active connections
-func (s *Service) leastConn() []*Backend {
-	s.Lock()
-	defer s.Unlock()
+func (rr *roundRobin) balanceUDP(backends []*Backend, ver uint64, _ net.IP) *Backend {
+	if rr.sched == nil || rr.schedVer != ver {
+		rr.sched = rr.sched[:0]
+		for i, b := range backends {
+			for w := 0; w < b.Weight || w == 0; w++ {
+				rr.sched = append(rr.sched, i)
+			}
+		}
+		rr.schedVer = ver
+	}
 
-	count := len(s.Backends)
-	switch count {
-	case 0:
-		return nil
-	case 1:
-		// fast track for the single backend case
-		return s.Backends[0:1]
+	// skip over the backends that are down, and the turns a backend that's
+	// warming up isn't taking, unless there's no other
+	var warming *Backend
+	for i := 0; i < len(rr.sched); i++ {
+		rr.pos %= len(rr.sched)
+		backend := backends[rr.sched[rr.pos]]
+		rr.pos++
+		if !backend.Up() {
+			continue
+		}
+		if factor := backend.slowStartFactor(); factor < 1 && backend.slowStartTurns(1, factor) == 0 {
+			warming = backend
+			continue
+		}
+		return backend
 	}
+	return warming
+}
+
+// LC returns the backend with the least number of active connections
+// LC orders the backends by their open connections, counting both the TCP
+// connections proxied to them and the HTTP transport's connections, so
+// services balancing HTTP requests are weighed by load too.
+//
+// UDP has no connections, so datagrams go to the backend that was sent the
+// fewest recently for its weight.
+//
+// A backend warming up counts as more loaded than it is, by the inverse of
+// the fraction of its weight it's at, so it isn't sent everything at first
+// for having nothing.
+type leastConn struct {
+	udp udpLoad
+}
 
+func (*leastConn) balance(backends []*Backend, up []bool, _ net.IP) []*Backend {
 	// return the backends in the order of least connections
 	var balanced []*Backend
 
 	// Accumulate all backends that are currently Up
-	for _, b := range s.Backends {
-		if b.Up() {
+	for i, b := range backends {
+		if up[i] {
 			balanced = append(balanced, b)
 		}
 	}
@@ -107,72 +247,462 @@ func (s *Service) leastConn() []*Backend {
 		return nil
 	}
 
-	sort.Sort(ByActive(balanced))
+	loads := make([]float64, len(balanced))
+	warming := false
+	for i, b := range balanced {
+		loads[i] = float64(b.activeConns())
+		if factor := b.slowStartFactor(); factor < 1 {
+			loads[i] = (loads[i] + 1) / factor
+			warming = true
+		}
+	}
+	if warming {
+		sort.Sort(byLoad{balanced, loads})
+	} else {
+		sort.Sort(ByActive(balanced))
+	}
 
 	return balanced
 }
 
-// Simple, but still weighted, RR for UDP where we don't don't have active
-// connections or connection failures.
-func (s *Service) udpRoundRobin() *Backend {
-	s.Lock()
-	defer s.Unlock()
+func (lc *leastConn) balanceUDP(backends []*Backend, ver uint64, _ net.IP) *Backend {
+	lc.udp.update(len(backends), ver, time.Now())
 
-	count := len(s.Backends)
-	switch count {
-	case 0:
+	best := -1
+	var bestLoad float64
+	for i, b := range backends {
+		if !b.Up() {
+			continue
+		}
+		weight := b.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		load := lc.udp.load(i) / float64(weight)
+		if factor := b.slowStartFactor(); factor < 1 {
+			load = (load + 1) / factor
+		}
+		if best < 0 || load < bestLoad {
+			best, bestLoad = i, load
+		}
+	}
+	if best < 0 {
 		return nil
-	case 1:
-		// fast track for the single backend case
-		return s.Backends[0]
 	}
+	lc.udp.cur[best]++
+	return backends[best]
+}
 
-	// we may be out of range if we lost a backend since last connections
-	if s.lastBackend >= count {
-		s.lastBackend = 0
-		s.lastCount = 0
+// The length of the windows that UDP load is counted over.
+var udpLoadInterval = time.Second
+
+// udpLoad counts the datagrams sent to each backend in the current and the
+// previous udpLoadInterval.
+type udpLoad struct {
+	ver   uint64
+	start time.Time
+	// the fraction of the previous window still counted
+	prevPart  float64
+	cur, prev []int64
+}
+
+// Start counting again when the backends change, and move on to a new window
+// when the current one is over.
+func (l *udpLoad) update(count int, ver uint64, now time.Time) {
+	if l.cur == nil || l.ver != ver || len(l.cur) != count {
+		l.ver = ver
+		l.start = now
+		l.cur = make([]int64, count)
+		l.prev = make([]int64, count)
 	}
 
-	// if our backend was over-weight, but we can't find another, use this
-	var backend, reuse *Backend
+	elapsed := now.Sub(l.start)
+	if elapsed >= udpLoadInterval {
+		for i := range l.cur {
+			// nothing was sent in the last window if it's over too
+			l.prev[i] = l.cur[i]
+			if elapsed >= 2*udpLoadInterval {
+				l.prev[i] = 0
+			}
+			l.cur[i] = 0
+		}
+		l.start = now
+		elapsed = 0
+	}
+	l.prevPart = 1 - float64(elapsed)/float64(udpLoadInterval)
+}
+
+// The datagrams sent to backend i over the last udpLoadInterval, counting
+// the part of the previous window that's within it.
+func (l *udpLoad) load(i int) float64 {
+	return float64(l.cur[i]) + float64(l.prev[i])*l.prevPart
+}
 
-	// Find the next Up backend to call
-	for i := 0; i < count; i++ {
-		backend = s.Backends[s.lastBackend]
+// The points on the hash ring for each unit of a backend's weight
+const hashReplicas = 100
 
-		if backend.Up() {
-			if s.lastCount >= int(backend.Weight) {
-				// used too many times, but save it just in case
-				reuse = backend
-				s.lastBackend = (s.lastBackend + 1) % count
-				s.lastCount = 0
-				continue
-			}
+type hashPoint struct {
+	hash    uint64
+	backend int
+}
 
-			s.lastCount++
-			break
+// HASH places every backend on a ring at points hashed from its name, and
+// each client IP at a point of its own. A client's backend is the first one
+// up after its point, so it stays the same across connections, and a backend
+// going down or being added only moves the clients between it and the
+// backend before it. Clients with no IP are balanced round robin.
+type ipHash struct {
+	ring []hashPoint
+
+	// the backends and weights the ring was built for
+	backends []*Backend
+	weights  []int
+
+	fallback roundRobin
+}
+
+func (h *ipHash) balance(backends []*Backend, up []bool, clientIP net.IP) []*Backend {
+	if clientIP == nil {
+		return h.fallback.balance(backends, up, nil)
+	}
+	h.update(backends)
+
+	count := 0
+	for _, u := range up {
+		if u {
+			count++
 		}
+	}
+	if count == 0 {
+		return nil
+	}
 
-		s.lastBackend = (s.lastBackend + 1) % count
+	// an IPv4 client hashes the same however its address is held
+	if ip4 := clientIP.To4(); ip4 != nil {
+		clientIP = ip4
 	}
 
-	if backend != nil {
-		return backend
+	// walk the ring from the client, taking each backend that's up the first
+	// time it's seen, so the rest are in failover order
+	key := hashKey(clientIP)
+	start := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= key })
+
+	seen := make([]bool, len(backends))
+	balanced := make([]*Backend, 0, count)
+	for i := 0; i < len(h.ring) && len(balanced) < count; i++ {
+		p := h.ring[(start+i)%len(h.ring)]
+		if seen[p.backend] || !up[p.backend] {
+			continue
+		}
+		seen[p.backend] = true
+		balanced = append(balanced, backends[p.backend])
+	}
+	return balanced
+}
+
+func (h *ipHash) balanceUDP(backends []*Backend, ver uint64, clientIP net.IP) *Backend {
+	if clientIP == nil {
+		return h.fallback.balanceUDP(backends, ver, nil)
+	}
+	h.update(backends)
+
+	if ip4 := clientIP.To4(); ip4 != nil {
+		clientIP = ip4
 	}
+	key := hashKey(clientIP)
+	start := sort.Search(len(h.ring), func(i int) bool { return h.ring[i].hash >= key })
 
-	if reuse != nil {
-		return reuse
+	// the first backend up after the client's point
+	for i := 0; i < len(h.ring); i++ {
+		if b := backends[h.ring[(start+i)%len(h.ring)].backend]; b.Up() {
+			return b
+		}
+	}
+	return nil
+}
+
+// Rebuild the ring if the backends or their weights have changed.
+func (h *ipHash) update(backends []*Backend) {
+	changed := len(backends) != len(h.backends)
+	for i := 0; !changed && i < len(backends); i++ {
+		changed = backends[i] != h.backends[i] || backends[i].Weight != h.weights[i]
+	}
+	if !changed {
+		return
+	}
+
+	h.backends = append(h.backends[:0], backends...)
+	h.weights = h.weights[:0]
+	h.ring = h.ring[:0]
+	for i, b := range backends {
+		h.weights = append(h.weights, b.Weight)
+
+		weight := b.Weight
+		if weight < 1 {
+			weight = 1
+		}
+		for r := 0; r < weight*hashReplicas; r++ {
+			h.ring = append(h.ring, hashPoint{
+				hash:    hashKey([]byte(fmt.Sprintf("%s-%d", b.Name, r))),
+				backend: i,
+			})
+		}
+	}
+	sort.Slice(h.ring, func(i, j int) bool { return h.ring[i].hash < h.ring[j].hash })
+}
+
+// Hash a key onto the ring. FNV spreads similar keys poorly, so its sum is
+// mixed with the finalizer from SplitMix64.
+func hashKey(key []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(key)
+	x := f.Sum64()
+
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Check the backends' weights. A weight of 0 is the default of 1, but a
+// negative weight is an error rather than a backend that's never chosen.
+func validWeight(cfg client.BackendConfig) error {
+	if cfg.Weight < 0 {
+		return fmt.Errorf("%w for %s: %d", ErrInvalidWeight, cfg.Name, cfg.Weight)
 	}
+	return nil
+}
 
+func validWeights(cfg client.ServiceConfig) error {
+	for _, b := range cfg.Backends {
+		if err := validWeight(b); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// SetWeights changes the weights of the named backends, and of any others to
+// the "*" weight if there is one, as a single update. The next backend chosen
+// uses all the new weights. Nothing is changed if any backend doesn't exist
+// or any weight is invalid. Returns the weights of all the backends.
+func (s *Service) SetWeights(weights map[string]int) (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for name, weight := range weights {
+		if weight < 1 {
+			return nil, fmt.Errorf("%w for %s: %d", ErrInvalidWeight, name, weight)
+		}
+		if name == "*" {
+			continue
+		}
+
+		found := false
+		for _, b := range s.Backends {
+			if b.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrNoBackend, name)
+		}
+	}
+
+	def, hasDefault := weights["*"]
+	current := make(map[string]int)
+	for _, b := range s.Backends {
+		weight, ok := weights[b.Name]
+		if !ok && hasDefault {
+			weight, ok = def, true
+		}
+
+		b.Lock()
+		if ok {
+			b.Weight = weight
+		}
+		current[b.Name] = b.Weight
+		b.Unlock()
+	}
+
+	// start the new distribution from the beginning
+	s.balancer = newBalancer(s.Balance)
+	return current, nil
+}
+
+// shadowBalancer runs a second balancing algorithm alongside the active one,
+// counting the backends it would have chosen without acting on its choice.
+// The counts are protected by the service lock.
+type shadowBalancer struct {
+	name     string
+	balancer balancer
+	since    time.Time
+
+	total    int64
+	diverged int64
+	actual   map[string]int64
+	shadow   map[string]int64
+}
+
+func newShadowBalancer(name string) *shadowBalancer {
+	return &shadowBalancer{
+		name:     name,
+		balancer: newBalancer(name),
+		since:    time.Now(),
+		actual:   make(map[string]int64),
+		shadow:   make(map[string]int64),
+	}
+}
+
+// Count the first choice of each balancer.
+func (s *shadowBalancer) observe(actual, shadow []*Backend) {
+	s.total++
+
+	var actualName, shadowName string
+	if len(actual) > 0 {
+		actualName = actual[0].Name
+		s.actual[actualName]++
+	}
+	if len(shadow) > 0 {
+		shadowName = shadow[0].Name
+		s.shadow[shadowName]++
+	}
+	if actualName != shadowName {
+		s.diverged++
+	}
+}
+
+// Drop the counts for a removed backend.
+func (s *shadowBalancer) forget(name string) {
+	delete(s.actual, name)
+	delete(s.shadow, name)
+}
+
+// The comparison of the active and shadow balancers, returned by the API.
+// Divergence is the percentage of choices where the balancers differed.
+type BalanceCompare struct {
+	Active     string                  `json:"active"`
+	Shadow     string                  `json:"shadow"`
+	Since      time.Time               `json:"since"`
+	Total      int64                   `json:"total"`
+	Diverged   int64                   `json:"diverged"`
+	Divergence float64                 `json:"divergence_pct"`
+	Backends   []BalanceCompareBackend `json:"backends"`
+}
+
+type BalanceCompareBackend struct {
+	Name   string `json:"name"`
+	Actual int64  `json:"actual"`
+	Shadow int64  `json:"would_have_chosen"`
+}
+
+var ErrNoShadowBalance = fmt.Errorf("service has no shadow balancer")
+
+// Compare the choices of the active and shadow balancers.
+func (s *Service) BalanceCompare() (BalanceCompare, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shadow == nil {
+		return BalanceCompare{}, ErrNoShadowBalance
+	}
+
+	cmp := BalanceCompare{
+		Active:   s.Balance,
+		Shadow:   s.shadow.name,
+		Since:    s.shadow.since,
+		Total:    s.shadow.total,
+		Diverged: s.shadow.diverged,
+		Backends: []BalanceCompareBackend{},
+	}
+	if cmp.Active == "" {
+		cmp.Active = client.RoundRobin
+	}
+	if cmp.Total > 0 {
+		cmp.Divergence = float64(cmp.Diverged) * 100 / float64(cmp.Total)
+	}
+
+	for _, b := range s.Backends {
+		cmp.Backends = append(cmp.Backends, BalanceCompareBackend{
+			Name:   b.Name,
+			Actual: s.shadow.actual[b.Name],
+			Shadow: s.shadow.shadow[b.Name],
+		})
+	}
+	return cmp, nil
+}
+
+// Choose the backend for a datagram from clientIP, which may be nil, with the
+// service's balancer. Datagrams don't fail over, so only one backend is
+// needed, and it's chosen without allocating.
+func (s *Service) udpNext(clientIP net.IP) *Backend {
+	s.Lock()
+	defer s.Unlock()
+
+	var backend *Backend
+	switch count := len(s.Backends); count {
+	case 0:
+		// datagrams are never held, whatever the NoBackendAction
+		atomic.AddInt64(&s.NoBackends, 1)
+		return nil
+	case 1:
+		// fast track for the single backend case
+		if s.Backends[0].Up() {
+			backend = s.Backends[0]
+		}
+	default:
+		backend = s.balancer.balanceUDP(s.Backends, s.backendsVer, clientIP)
+	}
+
+	if backend == nil {
+		s.udpBackendsDown()
+	}
+	return backend
+}
+
+// How often datagrams dropped while every UDP backend is down are reported.
+var udpDownReportInterval = time.Second
+
+// Count a datagram dropped because every backend is down. Rather than an
+// error for each, an error is counted and logged at most once per
+// udpDownReportInterval.
+// Service *must* be locked.
+func (s *Service) udpBackendsDown() {
+	atomic.AddInt64(&s.UDPBackendsDown, 1)
+	s.udpDownUnreported++
+
+	now := time.Now()
+	if now.Sub(s.udpDownReported) < udpDownReportInterval {
+		return
+	}
+	atomic.AddInt64(&s.Errors, 1)
+	log.Errorf("ERROR: every backend for %s is down, dropped %d datagrams", s.Name, s.udpDownUnreported)
+	s.udpDownReported = now
+	s.udpDownUnreported = 0
+}
+
 type ByActive []*Backend
 
 func (s ByActive) Len() int      { return len(s) }
 func (s ByActive) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 func (s ByActive) Less(i, j int) bool {
-	iActive := atomic.LoadInt64(&(s[i].Active))
-	jActive := atomic.LoadInt64(&(s[j].Active))
-	return iActive < jActive
+	return s[i].activeConns() < s[j].activeConns()
+}
+
+// byLoad orders backends by the loads read for them.
+type byLoad struct {
+	backends []*Backend
+	loads    []float64
+}
+
+func (s byLoad) Len() int { return len(s.backends) }
+func (s byLoad) Swap(i, j int) {
+	s.backends[i], s.backends[j] = s.backends[j], s.backends[i]
+	s.loads[i], s.loads[j] = s.loads[j], s.loads[i]
+}
+func (s byLoad) Less(i, j int) bool {
+	return s.loads[i] < s.loads[j]
 }
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+const (
+	// The record holding the totals for all services. This also records when
+	// shuttle was running, so we can find any gaps in the billing data.
+	billingTotal = "_total"
+
+	// How often the byte counters are sampled
+	billingInterval = time.Minute
+
+	// The writes to the billing file and checkpoint queued at once
+	billingQueueSize = 16
+)
+
+// How long shutdown waits for billing records to be written
+var billingFlushTimeout = 10 * time.Second
+
+var (
+	ErrBillingDisabled = fmt.Errorf("billing is disabled")
+
+	// The running billing accumulator, if enabled
+	billing *billingAccumulator
+)
+
+// A BillingRecord holds the bytes transferred by a service during one UTC
+// hour. A restart may leave more than one record for the same hour.
+type BillingRecord struct {
+	Hour    time.Time `json:"hour"`
+	Service string    `json:"service"`
+	// the period actually covered by this record
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	In    int64     `json:"in"`
+	Out   int64     `json:"out"`
+}
+
+// The billing totals for a single service
+type BillingTotal struct {
+	Service string `json:"service"`
+	In      int64  `json:"in"`
+	Out     int64  `json:"out"`
+	Hours   int    `json:"hours"`
+}
+
+// A period where shuttle wasn't running
+type BillingGap struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// The json billing report
+type BillingReport struct {
+	From     time.Time      `json:"from"`
+	To       time.Time      `json:"to"`
+	Services []BillingTotal `json:"services"`
+	Gaps     []BillingGap   `json:"gaps"`
+}
+
+// A sample of the cumulative byte counters for a single source of traffic
+// within a service.
+type billingSample struct {
+	Service string
+	Key     string
+	In      int64
+	Out     int64
+}
+
+// Collect the byte counters for every backend, and the service level UDP
+// counters. Counters are kept per backend so that removing one doesn't look
+// like a reset of the whole service.
+func registryBillingSamples() []billingSample {
+	var samples []billingSample
+	for _, svc := range Registry.Stats() {
+		var beIn, beOut int64
+		for _, b := range svc.Backends {
+			samples = append(samples, billingSample{
+				Service: svc.Name,
+				Key:     svc.Name + "/" + b.Name,
+				In:      b.Rcvd,
+				Out:     b.Sent,
+			})
+			beIn += b.Rcvd
+			beOut += b.Sent
+		}
+
+		// What's left is counted by the service itself
+		samples = append(samples, billingSample{
+			Service: svc.Name,
+			Key:     svc.Name,
+			In:      svc.Rcvd - beIn,
+			Out:     svc.Sent - beOut,
+		})
+	}
+	return samples
+}
+
+// Start the billing accumulator if a billing file was given.
+func startBilling() {
+	if billingPath == "" {
+		return
+	}
+
+	var err error
+	billing, err = newBillingAccumulator(billingPath, billingRetention)
+	if err != nil {
+		log.Fatalf("ERROR: billing: %s", err)
+	}
+	billing.Start()
+}
+
+// billingAccumulator keeps hourly byte totals for each service in an
+// append-only file. Totals are computed from the change in the byte counters,
+// so they're unaffected by counters being reset. The hour in progress is
+// checkpointed to a separate file on every sample, so at most one sample
+// interval is lost if shuttle exits uncleanly. Files are written through the
+// billing persistence stream, so a stalled disk never holds up sampling.
+type billingAccumulator struct {
+	sync.Mutex
+
+	path string
+	// records older than this are removed from the file. Zero keeps
+	// everything.
+	retention time.Duration
+	interval  time.Duration
+
+	// replaceable for tests
+	now    func() time.Time
+	source func() []billingSample
+
+	last    map[string]billingSample
+	hour    time.Time
+	current map[string]*BillingRecord
+
+	// Records of past hours that aren't in the billing file yet, and whether
+	// a write of them or a checkpoint is queued. Billing writes are never
+	// dropped: one the stream refuses is tried again on the next sample.
+	unwritten        []BillingRecord
+	flushing         bool
+	checkpointQueued bool
+	writes           *persistStream
+
+	// held while the files are written, so a report never sees a record
+	// both in the billing file and unwritten
+	fileMu sync.Mutex
+
+	stop chan bool
+	done chan bool
+}
+
+func newBillingAccumulator(path string, retention time.Duration) (*billingAccumulator, error) {
+	b := &billingAccumulator{
+		path:      path,
+		retention: retention,
+		interval:  billingInterval,
+		now:       time.Now,
+		source:    registryBillingSamples,
+		last:      make(map[string]billingSample),
+		current:   make(map[string]*BillingRecord),
+		writes:    persistence.stream("billing", PersistAlarm, billingQueueSize, billingFlushTimeout),
+	}
+
+	if err := b.recover(); err != nil {
+		return nil, err
+	}
+	if err := b.compact(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *billingAccumulator) checkpointPath() string {
+	return b.path + ".current"
+}
+
+// Append any checkpointed records from an unclean exit to the billing file.
+func (b *billingAccumulator) recover() error {
+	data, err := ioutil.ReadFile(b.checkpointPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []BillingRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		log.Warnf("Discarding invalid billing checkpoint: %s", err)
+	} else if err := appendRecords(b.path, records); err != nil {
+		return err
+	}
+
+	log.Printf("Recovered %d billing records", len(records))
+	return os.Remove(b.checkpointPath())
+}
+
+// Start sampling the byte counters.
+func (b *billingAccumulator) Start() {
+	b.stop = make(chan bool)
+	b.done = make(chan bool)
+
+	goTask("billing_sampler", "", func() {
+		defer close(b.done)
+		t := time.NewTicker(b.interval)
+		defer t.Stop()
+
+		b.sample()
+		for {
+			select {
+			case <-b.stop:
+				return
+			case <-t.C:
+				b.sample()
+			}
+		}
+	})
+}
+
+// Stop sampling, and write out the hour in progress, waiting up to the
+// billing stream's deadline.
+func (b *billingAccumulator) Stop() {
+	if b.stop != nil {
+		close(b.stop)
+		<-b.done
+		b.stop = nil
+	}
+
+	b.sample()
+
+	b.Lock()
+	b.rotate()
+	b.Unlock()
+	b.writes.flush()
+}
+
+// Add the change in byte counters since the last sample to the current hour.
+func (b *billingAccumulator) sample() {
+	samples := b.source()
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := b.now().UTC()
+	hour := now.Truncate(time.Hour)
+
+	// Records are keyed by the UTC hour, and the clock going backwards
+	// never moves us back to an hour we've already written.
+	if hour.After(b.hour) {
+		b.rotate()
+		b.hour = hour
+	}
+
+	b.record(billingTotal, now, 0, 0)
+
+	seen := make(map[string]bool)
+	for _, s := range samples {
+		seen[s.Key] = true
+		last := b.last[s.Key]
+		b.last[s.Key] = s
+
+		in, out := s.In-last.In, s.Out-last.Out
+		// the counter was reset, so it's all new traffic
+		if in < 0 {
+			in = s.In
+		}
+		if out < 0 {
+			out = s.Out
+		}
+
+		b.record(s.Service, now, in, out)
+		b.record(billingTotal, now, in, out)
+	}
+
+	for key := range b.last {
+		if !seen[key] {
+			delete(b.last, key)
+		}
+	}
+
+	b.flush()
+	b.queueCheckpoint()
+}
+
+// Move the last samples of a renamed service to its new name, so its counters
+// continue rather than looking like new traffic.
+func (b *billingAccumulator) rename(service, newName string) {
+	b.Lock()
+	defer b.Unlock()
+
+	for key, s := range b.last {
+		if s.Service != service {
+			continue
+		}
+		delete(b.last, key)
+		s.Service = newName
+		s.Key = newName + strings.TrimPrefix(key, service)
+		b.last[s.Key] = s
+	}
+}
+
+// billingAccumulator *must* be locked.
+func (b *billingAccumulator) record(service string, now time.Time, in, out int64) {
+	r := b.current[service]
+	if r == nil {
+		r = &BillingRecord{
+			Hour:    b.hour,
+			Service: service,
+			Start:   now,
+		}
+		b.current[service] = r
+	}
+	r.End = now
+	r.In += in
+	r.Out += out
+}
+
+// End the current hour, queueing its records to be written to the billing
+// file.
+// billingAccumulator *must* be locked.
+func (b *billingAccumulator) rotate() {
+	if len(b.current) == 0 {
+		return
+	}
+
+	b.unwritten = append(b.unwritten, b.currentRecords()...)
+	b.current = make(map[string]*BillingRecord)
+	b.flush()
+}
+
+// Queue a write of the unwritten records, unless one is already queued.
+// billingAccumulator *must* be locked.
+func (b *billingAccumulator) flush() {
+	if b.flushing || len(b.unwritten) == 0 {
+		return
+	}
+
+	records := append([]BillingRecord(nil), b.unwritten...)
+	if b.writes.enqueue(func() error { return b.writeRecords(records) }) == nil {
+		b.flushing = true
+	}
+}
+
+// Append records to the billing file, replace the checkpoint with what's
+// still unwritten, and compact the file. Any records left unwritten meanwhile
+// are queued next.
+func (b *billingAccumulator) writeRecords(records []BillingRecord) error {
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+
+	err := appendRecords(b.path, records)
+
+	b.Lock()
+	b.flushing = false
+	if err == nil {
+		b.unwritten = b.unwritten[len(records):]
+		b.flush()
+	}
+	pending := b.checkpointRecords()
+	b.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if err := b.saveCheckpoint(pending); err != nil {
+		return err
+	}
+	return b.compact()
+}
+
+// The records that aren't in the billing file, oldest first.
+// billingAccumulator *must* be locked.
+func (b *billingAccumulator) checkpointRecords() []BillingRecord {
+	return append(append([]BillingRecord(nil), b.unwritten...), b.currentRecords()...)
+}
+
+// billingAccumulator *must* be locked.
+func (b *billingAccumulator) currentRecords() []BillingRecord {
+	records := make([]BillingRecord, 0, len(b.current))
+	for _, r := range b.current {
+		records = append(records, *r)
+	}
+	sort.Sort(billingRecords(records))
+	return records
+}
+
+func appendRecords(path string, records []BillingRecord) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// Queue a checkpoint, unless one is already queued. The checkpoint is taken
+// when it's written, so a refused one is covered by the next.
+// billingAccumulator *must* be locked.
+func (b *billingAccumulator) queueCheckpoint() {
+	if b.checkpointQueued {
+		return
+	}
+	if b.writes.enqueue(b.writeCheckpoint) == nil {
+		b.checkpointQueued = true
+	}
+}
+
+func (b *billingAccumulator) writeCheckpoint() error {
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+
+	b.Lock()
+	b.checkpointQueued = false
+	records := b.checkpointRecords()
+	// any records refused while the disk was stalled follow the checkpoint
+	b.flush()
+	b.Unlock()
+
+	return b.saveCheckpoint(records)
+}
+
+// Save the records that aren't in the billing file, so they can be recovered
+// after an unclean exit.
+// billingAccumulator's fileMu *must* be locked.
+func (b *billingAccumulator) saveCheckpoint(records []BillingRecord) error {
+	if len(records) == 0 {
+		if err := os.Remove(b.checkpointPath()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	js, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	tmp := b.checkpointPath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.checkpointPath())
+}
+
+func (b *billingAccumulator) readRecords() ([]BillingRecord, error) {
+	f, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []BillingRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r BillingRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warnf("Skipping invalid billing record: %s", err)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// Remove records older than the retention period from the billing file.
+func (b *billingAccumulator) compact() error {
+	if b.retention == 0 {
+		return nil
+	}
+
+	records, err := b.readRecords()
+	if err != nil {
+		return err
+	}
+
+	cutoff := b.now().UTC().Add(-b.retention)
+	keep := records[:0]
+	for _, r := range records {
+		if r.Hour.Add(time.Hour).After(cutoff) {
+			keep = append(keep, r)
+		}
+	}
+
+	if len(keep) == len(records) {
+		return nil
+	}
+
+	log.Printf("Compacting billing records: removing %d", len(records)-len(keep))
+
+	tmp := b.path + ".tmp"
+	os.Remove(tmp)
+	if err := appendRecords(tmp, keep); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// Report the totals for the hours from the start of the hour containing from,
+// up until to. An empty service reports all services.
+// Any periods longer than two sample intervals with no records are reported
+// as gaps.
+func (b *billingAccumulator) Report(service string, from, to time.Time) (BillingReport, error) {
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+	b.Lock()
+	defer b.Unlock()
+
+	from = from.UTC().Truncate(time.Hour)
+	to = to.UTC()
+
+	report := BillingReport{
+		From:     from,
+		To:       to,
+		Services: []BillingTotal{},
+		Gaps:     []BillingGap{},
+	}
+
+	records, err := b.readRecords()
+	if err != nil {
+		return report, err
+	}
+	records = append(records, b.checkpointRecords()...)
+	sort.Sort(billingRecords(records))
+
+	totals := make(map[string]*BillingTotal)
+	hours := make(map[string]map[time.Time]bool)
+
+	// the coverage from the _total records
+	var covered []BillingRecord
+
+	for _, r := range records {
+		if r.Hour.Before(from) || !r.Hour.Before(to) {
+			continue
+		}
+
+		if r.Service == billingTotal {
+			covered = append(covered, r)
+			continue
+		}
+
+		if service != "" && r.Service != service {
+			continue
+		}
+
+		t := totals[r.Service]
+		if t == nil {
+			t = &BillingTotal{Service: r.Service}
+			totals[r.Service] = t
+			hours[r.Service] = make(map[time.Time]bool)
+		}
+		t.In += r.In
+		t.Out += r.Out
+		hours[r.Service][r.Hour] = true
+	}
+
+	for name, t := range totals {
+		t.Hours = len(hours[name])
+		report.Services = append(report.Services, *t)
+	}
+	sort.Sort(billingTotals(report.Services))
+
+	report.Gaps = billingGaps(covered, from, to, 2*b.interval)
+	return report, nil
+}
+
+// Find the gaps longer than maxGap in the coverage of the records, which must
+// be sorted by Start.
+func billingGaps(records []BillingRecord, from, to time.Time, maxGap time.Duration) []BillingGap {
+	gaps := []BillingGap{}
+
+	last := from
+	for _, r := range records {
+		if r.Start.Sub(last) > maxGap {
+			gaps = append(gaps, BillingGap{Start: last, End: r.Start})
+		}
+		if r.End.After(last) {
+			last = r.End
+		}
+	}
+
+	if to.Sub(last) > maxGap {
+		gaps = append(gaps, BillingGap{Start: last, End: to})
+	}
+	return gaps
+}
+
+type billingRecords []BillingRecord
+
+func (p billingRecords) Len() int      { return len(p) }
+func (p billingRecords) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p billingRecords) Less(i, j int) bool {
+	if p[i].Start.Equal(p[j].Start) {
+		return p[i].Service < p[j].Service
+	}
+	return p[i].Start.Before(p[j].Start)
+}
+
+type billingTotals []BillingTotal
+
+func (p billingTotals) Len() int           { return len(p) }
+func (p billingTotals) Less(i, j int) bool { return p[i].Service < p[j].Service }
+func (p billingTotals) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var (
+	ErrNoCapture       = fmt.Errorf("no capture for backend")
+	ErrCaptureActive   = fmt.Errorf("capture already running")
+	ErrInvalidCapture  = fmt.Errorf("invalid capture direction")
+	ErrCaptureLimit    = fmt.Errorf("invalid capture limit")
+	ErrCaptureDisabled = fmt.Errorf("capture is disabled")
+)
+
+// Check the capture limits. None may be negative; a zero limit is replaced by
+// its default.
+func validCapture(cfg client.CaptureConfig) error {
+	switch cfg.Direction {
+	case "", client.CaptureBoth, client.CaptureRequest, client.CaptureResponse:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidCapture, cfg.Direction)
+	}
+
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"duration", cfg.Duration},
+		{"max_bytes", cfg.MaxBytes},
+		{"max_sessions", cfg.MaxSessions},
+		{"max_body_bytes", cfg.MaxBodyBytes},
+	}
+	for _, l := range limits {
+		if l.value < 0 {
+			return fmt.Errorf("%w: %s %d", ErrCaptureLimit, l.name, l.value)
+		}
+	}
+	return nil
+}
+
+// The json dump of a capture
+type CaptureDump struct {
+	Service  string               `json:"service"`
+	Backend  string               `json:"backend"`
+	Config   client.CaptureConfig `json:"config"`
+	Active   bool                 `json:"active"`
+	Started  time.Time            `json:"started"`
+	Stopped  time.Time            `json:"stopped"`
+	Reason   string               `json:"reason,omitempty"`
+	Bytes    int                  `json:"bytes"`
+	Sessions []CaptureSession     `json:"sessions"`
+}
+
+// A single connection to the backend, or for an HTTP service a single
+// request. An HTTP session records the request and response heads, and only
+// the first MaxBodyBytes of each body.
+type CaptureSession struct {
+	Client  string          `json:"client,omitempty"`
+	Backend string          `json:"backend"`
+	Started time.Time       `json:"started"`
+	Records []CaptureRecord `json:"records"`
+}
+
+// Data from a single read or write
+type CaptureRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	Data      []byte    `json:"data"`
+}
+
+// A capture records the payload of new connections to a single backend, so
+// that a misbehaving server can be debugged without a packet capture on the
+// host.
+type capture struct {
+	sync.Mutex
+	dump CaptureDump
+
+	// new sessions are no longer accepted
+	detached bool
+	// detach the capture from its backend
+	detach func()
+
+	timer *time.Timer
+}
+
+func newCapture(service, backend string, cfg client.CaptureConfig, detach func()) *capture {
+	c := &capture{
+		dump: CaptureDump{
+			Service: service,
+			Backend: backend,
+			Config:  cfg,
+			Active:  true,
+			Started: time.Now(),
+		},
+		detach: detach,
+	}
+
+	c.timer = time.AfterFunc(time.Duration(cfg.Duration)*time.Millisecond, func() {
+		c.Stop("duration")
+	})
+	return c
+}
+
+// Start recording a new connection.
+// Returns nil if the capture isn't accepting any more sessions.
+func (c *capture) newSession(cliAddr, srvAddr string) *captureSession {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.detached {
+		return nil
+	}
+
+	c.dump.Sessions = append(c.dump.Sessions, CaptureSession{
+		Client:  cliAddr,
+		Backend: srvAddr,
+		Started: time.Now(),
+	})
+
+	session := &captureSession{
+		capture: c,
+		index:   len(c.dump.Sessions) - 1,
+	}
+
+	// keep recording the sessions we have, but don't take any more.
+	if len(c.dump.Sessions) >= c.dump.Config.MaxSessions {
+		c.detachLocked()
+	}
+
+	return session
+}
+
+func (c *capture) record(index int, direction string, p []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.dump.Active {
+		return
+	}
+
+	cfg := c.dump.Config
+	if cfg.Direction != client.CaptureBoth && cfg.Direction != direction {
+		return
+	}
+
+	remaining := cfg.MaxBytes - c.dump.Bytes
+	if remaining <= 0 {
+		c.stopLocked("max bytes")
+		return
+	}
+	if len(p) > remaining {
+		p = p[:remaining]
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	session := &c.dump.Sessions[index]
+	session.Records = append(session.Records, CaptureRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Data:      data,
+	})
+
+	c.dump.Bytes += len(data)
+	if c.dump.Bytes >= cfg.MaxBytes {
+		c.stopLocked("max bytes")
+	}
+}
+
+// Stop the capture, recording the reason in the dump.
+func (c *capture) Stop(reason string) {
+	c.Lock()
+	defer c.Unlock()
+	c.stopLocked(reason)
+}
+
+func (c *capture) stopLocked(reason string) {
+	if !c.dump.Active {
+		return
+	}
+
+	c.timer.Stop()
+	c.detachLocked()
+
+	c.dump.Active = false
+	c.dump.Stopped = time.Now()
+	c.dump.Reason = reason
+
+	log.Printf("Capture stopped for %s/%s: %s, %d sessions, %d bytes",
+		c.dump.Service, c.dump.Backend, reason, len(c.dump.Sessions), c.dump.Bytes)
+
+	if c.dump.Config.Path != "" {
+		path, js := c.dump.Config.Path, marshal(c.dumpLocked())
+		goTask("capture_save", c.dump.Service+"/"+c.dump.Backend, func() { c.save(path, js) })
+	}
+}
+
+func (c *capture) detachLocked() {
+	if c.detached {
+		return
+	}
+	c.detached = true
+	c.detach()
+}
+
+func (c *capture) save(path string, js []byte) {
+	if err := ioutil.WriteFile(path, js, 0600); err != nil {
+		log.Errorf("ERROR: saving capture to %s: %s", path, err)
+		return
+	}
+	log.Printf("Capture saved to %s", path)
+}
+
+// Dump returns a copy of everything recorded so far.
+func (c *capture) Dump() CaptureDump {
+	c.Lock()
+	defer c.Unlock()
+	return c.dumpLocked()
+}
+
+func (c *capture) dumpLocked() CaptureDump {
+	dump := c.dump
+	dump.Sessions = make([]CaptureSession, len(c.dump.Sessions))
+	for i, s := range c.dump.Sessions {
+		s.Records = append([]CaptureRecord(nil), s.Records...)
+		dump.Sessions[i] = s
+	}
+	return dump
+}
+
+// Format the dump as annotated hex, similar to `tcpdump -X`.
+func (d CaptureDump) Hex() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "capture %s/%s started=%s active=%t bytes=%d\n",
+		d.Service, d.Backend, d.Started.Format(time.RFC3339Nano), d.Active, d.Bytes)
+
+	for i, s := range d.Sessions {
+		fmt.Fprintf(&buf, "\nsession %d client=%s backend=%s\n", i, s.Client, s.Backend)
+		for _, r := range s.Records {
+			fmt.Fprintf(&buf, "%s %s %d bytes\n", r.Time.Format(time.RFC3339Nano), r.Direction, len(r.Data))
+			buf.WriteString(hex.Dump(r.Data))
+		}
+	}
+	return buf.Bytes()
+}
+
+// A handle for recording a single connection into a capture.
+type captureSession struct {
+	capture *capture
+	index   int
+}
+
+func (s *captureSession) record(direction string, p []byte) {
+	s.capture.record(s.index, direction, p)
+}
+
+// Record the head of an HTTP request to the backend, and wrap its body to
+// record the start of that too.
+func (s *captureSession) recordRequest(req *http.Request) {
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/%d.%d\r\n", req.Method, req.URL.RequestURI(), req.ProtoMajor, req.ProtoMinor)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(&head, "Host: %s\r\n", host)
+	req.Header.Write(&head)
+	head.WriteString("\r\n")
+	s.record(client.CaptureRequest, head.Bytes())
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = s.body(client.CaptureRequest, req.Body)
+	}
+}
+
+// Record the head of the backend's response, and wrap its body to record the
+// start of that too.
+func (s *captureSession) recordResponse(res *http.Response) {
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/%d.%d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.Status)
+	res.Header.Write(&head)
+	head.WriteString("\r\n")
+	s.record(client.CaptureResponse, head.Bytes())
+
+	if res.Body != nil && res.Body != http.NoBody {
+		res.Body = s.body(client.CaptureResponse, res.Body)
+	}
+}
+
+func (s *captureSession) body(direction string, body io.ReadCloser) io.ReadCloser {
+	s.capture.Lock()
+	limit := s.capture.dump.Config.MaxBodyBytes
+	s.capture.Unlock()
+
+	return &captureBody{
+		ReadCloser: body,
+		session:    s,
+		direction:  direction,
+		remaining:  limit,
+	}
+}
+
+// A body that records the first bytes read from it.
+type captureBody struct {
+	io.ReadCloser
+	session   *captureSession
+	direction string
+	remaining int
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && b.remaining > 0 {
+		m := n
+		if m > b.remaining {
+			m = b.remaining
+		}
+		b.remaining -= m
+		b.session.record(b.direction, p[:m])
+	}
+	return n, err
+}
+
+// A picker that knows the backend it last returned can start a capture
+// session for the request sent to it.
+type capturePicker interface {
+	captureSession(cliAddr string) *captureSession
+}
+
+// Start a capture session for a request to the backend the picker last
+// returned, or return nil if it isn't being captured.
+func pickerCapture(picker BackendPicker, cliAddr string) *captureSession {
+	cp, ok := picker.(capturePicker)
+	if !ok {
+		return nil
+	}
+	return cp.captureSession(cliAddr)
+}
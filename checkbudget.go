@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidCheckBudget = fmt.Errorf("invalid check budget")
+	ErrInvalidCheckJitter = fmt.Errorf("invalid check jitter")
+)
+
+// The most a service's check jitter can vary its backends' check intervals,
+// as a percentage.
+const maxCheckJitter = 50
+
+// The host-wide limits on health checks, in checks per second, with 0 for no
+// limit, and the jitter added to each check as a fraction of its interval.
+var (
+	checkRate     float64
+	checkDestRate float64
+	checkJitter   float64
+)
+
+// The health checks of every backend on this host.
+var checks = newCheckBudget(time.Now)
+
+// checkBudget spaces out the health checks of every backend, so that no more
+// than rate are sent each second, and no more than destRate to any one
+// address, however many services check it. A check over the budget is
+// delayed until there's room, but never by more than its own interval, so
+// every backend is still checked at least every two intervals. A check that
+// would have to wait longer is sent at that bound, and counted as an overrun.
+type checkBudget struct {
+	sync.Mutex
+
+	rate     float64
+	destRate float64
+	jitter   float64
+
+	// the clock and the source of jitter, replaced in tests
+	now    func() time.Time
+	random func() float64
+
+	// the next time a check can be sent, and the same for each destination
+	next   time.Time
+	dests  map[string]*checkDest
+	pruned time.Time
+
+	// the times checks were or will be sent, from the last second on
+	recent []time.Time
+
+	dispatched int64
+	delayed    int64
+	overruns   int64
+	maxDelay   time.Duration
+}
+
+type checkDest struct {
+	next   time.Time
+	recent []time.Time
+}
+
+func newCheckBudget(now func() time.Time) *checkBudget {
+	return &checkBudget{
+		now:    now,
+		random: rand.Float64,
+		dests:  make(map[string]*checkDest),
+	}
+}
+
+// Set the limits, keeping the counts.
+func (c *checkBudget) configure(rate, destRate, jitter float64) error {
+	if rate < 0 || destRate < 0 {
+		return fmt.Errorf("%w: negative rate", ErrInvalidCheckBudget)
+	}
+	if jitter < 0 || jitter > 1 {
+		return fmt.Errorf("%w: jitter must be from 0 to 1", ErrInvalidCheckBudget)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.rate, c.destRate, c.jitter = rate, destRate, jitter
+	return nil
+}
+
+// Reserve the next time a check of dest can be sent, and return the time to
+// wait until then.
+func (c *checkBudget) reserve(dest string, interval time.Duration) time.Duration {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.now()
+	slot := now
+	if c.jitter > 0 {
+		slot = slot.Add(time.Duration(c.random() * c.jitter * float64(interval)))
+	}
+	d := c.dests[dest]
+	if d == nil {
+		d = &checkDest{}
+		c.dests[dest] = d
+	}
+
+	limited := false
+	if c.rate > 0 && c.next.After(slot) {
+		slot, limited = c.next, true
+	}
+	if c.destRate > 0 && d.next.After(slot) {
+		slot, limited = d.next, true
+	}
+
+	if bound := now.Add(interval); slot.After(bound) {
+		c.overruns++
+		slot = bound
+	}
+
+	if c.rate > 0 {
+		c.next = later(c.next, slot.Add(perSecond(c.rate)))
+	}
+	if c.destRate > 0 {
+		d.next = later(d.next, slot.Add(perSecond(c.destRate)))
+	}
+
+	c.recent = append(trimRecent(c.recent, now), slot)
+	d.recent = append(trimRecent(d.recent, now), slot)
+	c.prune(now)
+
+	delay := slot.Sub(now)
+	c.dispatched++
+	if limited {
+		c.delayed++
+		if delay > c.maxDelay {
+			c.maxDelay = delay
+		}
+	}
+	return delay
+}
+
+// Forget the destinations with nothing sent in the last second or reserved,
+// once a second.
+// checkBudget *must* be locked.
+func (c *checkBudget) prune(now time.Time) {
+	if now.Sub(c.pruned) < time.Second {
+		return
+	}
+	c.pruned = now
+
+	for dest, d := range c.dests {
+		d.recent = trimRecent(d.recent, now)
+		if len(d.recent) == 0 && !d.next.After(now) {
+			delete(c.dests, dest)
+		}
+	}
+}
+
+// Wait until the check budget has room for the backend's next check. Returns
+// false if the backend was stopped meanwhile.
+func (b *Backend) awaitCheckBudget() bool {
+	b.Lock()
+	addr, interval := b.CheckAddr, b.interval
+	b.Unlock()
+
+	if addr == "" {
+		return true
+	}
+	delay := checks.reserve(addr, interval)
+	if delay <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-b.stopCheck:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// The fraction by which the service's backends vary their check intervals.
+// Service *must* be locked.
+func (s *Service) checkJitter() float64 {
+	if s.CheckJitter <= 0 {
+		return 0
+	}
+	return float64(s.CheckJitter) / 100
+}
+
+func perSecond(rate float64) time.Duration {
+	return time.Duration(float64(time.Second) / rate)
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// Drop the times more than a second before now, in place. Jitter and
+// overruns can reserve times out of order.
+func trimRecent(times []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-time.Second)
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// Count the times in the second up to now.
+func countRecent(times []time.Time, now time.Time) int {
+	cutoff := now.Add(-time.Second)
+	n := 0
+	for _, t := range times {
+		if t.After(cutoff) && !t.After(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// CheckBudgetStatus reports the limits on health checks and how close they
+// are. Utilization is the checks sent in the last second as a percentage of
+// each limit, for the busiest destination in the case of DestUtilization.
+type CheckBudgetStatus struct {
+	Rate     float64 `json:"rate"`
+	DestRate float64 `json:"destination_rate"`
+	Jitter   float64 `json:"jitter"`
+
+	LastSecond      int     `json:"checks_last_second"`
+	Utilization     float64 `json:"utilization_pct"`
+	DestUtilization float64 `json:"destination_utilization_pct"`
+	Destinations    int     `json:"destinations"`
+
+	Dispatched int64 `json:"dispatched"`
+	Delayed    int64 `json:"delayed"`
+	Overruns   int64 `json:"overruns"`
+	MaxDelay   int64 `json:"max_delay_ms"`
+}
+
+func (c *checkBudget) Status() CheckBudgetStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.now()
+	status := CheckBudgetStatus{
+		Rate:         c.rate,
+		DestRate:     c.destRate,
+		Jitter:       c.jitter,
+		LastSecond:   countRecent(c.recent, now),
+		Destinations: len(c.dests),
+		Dispatched:   c.dispatched,
+		Delayed:      c.delayed,
+		Overruns:     c.overruns,
+		MaxDelay:     int64(c.maxDelay / time.Millisecond),
+	}
+	if c.rate > 0 {
+		status.Utilization = float64(status.LastSecond) * 100 / c.rate
+	}
+	if c.destRate > 0 {
+		for _, d := range c.dests {
+			util := float64(countRecent(d.recent, now)) * 100 / c.destRate
+			if util > status.DestUtilization {
+				status.DestUtilization = util
+			}
+		}
+	}
+	return status
+}
@@ -2,20 +2,81 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 )
 
+// ErrBackendModified is returned by PatchBackend when the backend has changed
+// since its ETag was read.
+var ErrBackendModified = errors.New("backend was modified")
+
+// ErrServiceExists is returned by RenameService when the new name is already
+// in use.
+var ErrServiceExists = errors.New("service already exists")
+
+// APIError is an error response to a change made through the admin API. The
+// status tells why the change failed: 404 if the service or backend doesn't
+// exist, 409 if it conflicts with one that does, 400 if the config is
+// invalid, and 500 if the server couldn't apply it, such as when a service
+// can't bind its address.
+type APIError struct {
+	Op         string
+	StatusCode int
+	Status     string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s: %s", e.Op, e.Status)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Op, e.Status, e.Message)
+}
+
+// NotFound reports whether the service or backend doesn't exist.
+func (e *APIError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// Conflict reports whether the change conflicts with an existing service or
+// backend.
+func (e *APIError) Conflict() bool {
+	return e.StatusCode == http.StatusConflict
+}
+
+// Invalid reports whether the config was rejected.
+func (e *APIError) Invalid() bool {
+	return e.StatusCode == http.StatusBadRequest
+}
+
+// Return an *APIError for a failed response, with the message from its body.
+func responseError(resp *http.Response, format string, args ...interface{}) error {
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return &APIError{
+		Op:         fmt.Sprintf(format, args...),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Message:    string(bytes.TrimSpace(msg)),
+	}
+}
+
 // Client is an http client for communicating with the shuttle server api
 type Client struct {
 	httpClient *http.Client
 	addr       string
 }
 
+// escape a service or backend name for use as a path segment
+func escapeName(name string) string {
+	return (&url.URL{Path: name}).EscapedPath()
+}
+
 // An http client for communicating with the shuttle server.
 func NewClient(addr string) *Client {
 	return &Client{
@@ -24,6 +85,31 @@ func NewClient(addr string) *Client {
 	}
 }
 
+// SetToken sends token as the bearer token on every request, for a server
+// started with admin tokens.
+func (c *Client) SetToken(token string) {
+	c.httpClient.Transport = authTransport{authorization: "Bearer " + token, next: http.DefaultTransport}
+}
+
+// SetBasicAuth sends user and password on every request, for a server started
+// with admin basic-auth credentials.
+func (c *Client) SetBasicAuth(user, password string) {
+	creds := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	c.httpClient.Transport = authTransport{authorization: "Basic " + creds, next: http.DefaultTransport}
+}
+
+type authTransport struct {
+	authorization string
+	next          http.RoundTripper
+}
+
+func (t authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper mustn't modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", t.authorization)
+	return t.next.RoundTrip(req)
+}
+
 // GetConfig retrieves the configuration for a running shuttle server.
 func (c *Client) GetConfig() (*Config, error) {
 
@@ -70,7 +156,7 @@ func (c *Client) UpdateConfig(config *Config) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to update shuttle config: %s", resp.Status)
+		return responseError(resp, "failed to update shuttle config")
 	}
 	return nil
 }
@@ -83,7 +169,7 @@ func (c *Client) UpdateService(service *ServiceConfig) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s", c.addr, service.Name), "application/json",
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s", c.addr, escapeName(service.Name)), "application/json",
 		bytes.NewBuffer(js))
 	if err != nil {
 		return err
@@ -91,14 +177,50 @@ func (c *Client) UpdateService(service *ServiceConfig) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to update shuttle service '%s': %s", service.Name, resp.Status)
+		return responseError(resp, "failed to update shuttle service '%s'", service.Name)
 	}
 	return nil
 }
 
 // RemoveService removes a service and its backends from a running shuttle server.
 func (c *Client) RemoveService(service string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s", c.addr, service), nil)
+	return c.removeService(service, "")
+}
+
+// DrainService removes a service from a running shuttle server, refusing new
+// connections at once, but letting open connections finish for up to the
+// service's DrainTimeout before they're closed.
+func (c *Client) DrainService(service string) error {
+	return c.removeService(service, "?drain=true")
+}
+
+// ClearConfig removes every service from a running shuttle server, and
+// returns the names of the services removed.
+func (c *Client) ClearConfig() ([]string, error) {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/_config", c.addr), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, "failed to clear shuttle config")
+	}
+
+	var removed []string
+	if err := json.NewDecoder(resp.Body).Decode(&removed); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (c *Client) removeService(service, query string) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s%s", c.addr, escapeName(service), query), nil)
 	if err != nil {
 		return err
 	}
@@ -110,7 +232,32 @@ func (c *Client) RemoveService(service string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("failed to remove shuttle service '%s': %s", service, resp.Status))
+		return responseError(resp, "failed to remove shuttle service '%s'", service)
+	}
+	return nil
+}
+
+// RenameService gives a service a new name on a running shuttle server,
+// without interrupting its connections.
+func (c *Client) RenameService(service, newName string) error {
+	js, err := json.Marshal(&ServiceRename{Name: newName})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/_rename", c.addr, escapeName(service)), "application/json",
+		bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		return ErrServiceExists
+	default:
+		return responseError(resp, "failed to rename shuttle service '%s'", service)
 	}
 	return nil
 }
@@ -123,7 +270,7 @@ func (c *Client) UpdateBackend(service string, backend *BackendConfig) error {
 		return err
 	}
 
-	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/%s", c.addr, service, backend.Name), "application/json",
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/%s", c.addr, escapeName(service), escapeName(backend.Name)), "application/json",
 		bytes.NewBuffer(js))
 	if err != nil {
 		return err
@@ -131,18 +278,181 @@ func (c *Client) UpdateBackend(service string, backend *BackendConfig) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to update shuttle backend '%s/%s': %s", service, backend.Name, resp.Status)
+		return responseError(resp, "failed to update shuttle backend '%s/%s'", service, backend.Name)
+	}
+	return nil
+}
+
+// SetWeights sets the weights of several of a service's backends in a single
+// update. The weight for "*" applies to any backends not named. If any
+// backend doesn't exist, no weights are changed.
+func (c *Client) SetWeights(service string, weights map[string]int) error {
+
+	js, err := json.Marshal(weights)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s/_weights", c.addr, escapeName(service)), bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, "failed to set weights for shuttle service '%s'", service)
 	}
 	return nil
 }
 
-// RemoveBackend removes a backend from its service on a running shuttle server.
+// GetBackend retrieves a single backend's config from a running shuttle
+// server, along with the ETag to use for a conditional PatchBackend.
+func (c *Client) GetBackend(service, backend string) (*BackendConfig, string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/%s/%s", c.addr, escapeName(service), escapeName(backend)), nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("failed to get shuttle backend '%s/%s': %s", service, backend, resp.Status)
+	}
+	return decodeBackend(resp)
+}
+
+// PatchBackend updates only the fields that are set in the patch. If etag
+// isn't empty and the backend has changed since it was read,
+// ErrBackendModified is returned. The new config and ETag are returned on
+// success.
+func (c *Client) PatchBackend(service, backend string, patch *BackendPatch, etag string) (*BackendConfig, string, error) {
+	js, err := json.Marshal(patch)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req, err := http.NewRequest("PATCH", fmt.Sprintf("http://%s/%s/%s", c.addr, escapeName(service), escapeName(backend)),
+		bytes.NewBuffer(js))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return nil, "", ErrBackendModified
+	default:
+		return nil, "", responseError(resp, "failed to patch shuttle backend '%s/%s'", service, backend)
+	}
+	return decodeBackend(resp)
+}
+
+// decode the config and ETag from a single backend response
+func decodeBackend(resp *http.Response) (*BackendConfig, string, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	info := struct {
+		Config BackendConfig `json:"config"`
+	}{}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, "", err
+	}
+	return &info.Config, resp.Header.Get("ETag"), nil
+}
+
+// RemoveBackend removes a backend from its service on a running shuttle
+// server, closing its open connections.
 func (c *Client) RemoveBackend(service, backend string) error {
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s/%s", c.addr, service, backend), nil)
+	return c.removeBackend(service, backend, "")
+}
+
+// DrainBackend removes a backend from its service on a running shuttle
+// server. It's out of rotation at once, but its open connections have up to
+// the service's DrainTimeout to finish before they're closed.
+func (c *Client) DrainBackend(service, backend string) error {
+	return c.removeBackend(service, backend, "?drain=true")
+}
+
+func (c *Client) removeBackend(service, backend, query string) error {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("http://%s/%s/%s%s", c.addr, escapeName(service), escapeName(backend), query), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, "failed to remove shuttle backend '%s/%s'", service, backend)
+	}
+	return nil
+}
+
+// SetReady publishes the readiness of a backend on a running shuttle server.
+// A backend that isn't ready is removed from rotation until it's ready again,
+// or the service's ReadinessTTL expires.
+func (c *Client) SetReady(service, backend string, ready *ReadyConfig) error {
+
+	js, err := json.Marshal(ready)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Post(fmt.Sprintf("http://%s/%s/%s/ready", c.addr, escapeName(service), escapeName(backend)), "application/json",
+		bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp, "failed to set readiness for shuttle backend '%s/%s'", service, backend)
+	}
+	return nil
+}
+
+// SetAdminState takes a backend out of rotation for maintenance with
+// AdminStateDown, or returns it with AdminStateUp. Its health checks continue
+// while it's down.
+func (c *Client) SetAdminState(service, backend, state string) error {
+	js, err := json.Marshal(AdminStateConfig{State: state})
 	if err != nil {
 		return err
 	}
 
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s/%s/state", c.addr, escapeName(service), escapeName(backend)),
+		bytes.NewBuffer(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return err
@@ -150,7 +460,35 @@ func (c *Client) RemoveBackend(service, backend string) error {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.New(fmt.Sprintf("failed to remove shuttle backend '%s/%s': %s", service, backend, resp.Status))
+		return responseError(resp, "failed to set state of shuttle backend '%s/%s'", service, backend)
 	}
 	return nil
 }
+
+// VHostReady runs the readiness checks for a virtual host on a running
+// shuttle server. A certificate for the host must remain valid for at least
+// certMinDays, or DefaultCertMinDays if that's 0. The report is returned
+// whether or not the vhost is ready.
+func (c *Client) VHostReady(host string, certMinDays int) (*VHostReadiness, error) {
+	u := fmt.Sprintf("http://%s/_vhosts/%s/ready", c.addr, escapeName(host))
+	if certMinDays > 0 {
+		u += fmt.Sprintf("?cert_min_days=%d", certMinDays)
+	}
+
+	resp, err := c.httpClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("failed to check readiness of vhost '%s': %s: %s", host, resp.Status, bytes.TrimSpace(msg))
+	}
+
+	report := &VHostReadiness{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
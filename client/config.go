@@ -4,12 +4,14 @@ import (
 	"encoding/json"
 	"reflect"
 	"sort"
+	"strings"
 )
 
 const (
 	// Balancing schemes
 	RoundRobin = "RR"
 	LeastConn  = "LC"
+	IPHash     = "HASH"
 
 	// Default timeout in milliseconds for clients and server connections
 	DefaultTimeout = 2000
@@ -17,9 +19,40 @@ const (
 	// Default interval in milliseconds between health checks
 	DefaultCheckInterval = 5000
 
+	// Health check types: a TCP connect, an HTTP GET that must return a 2xx
+	// or 3xx status, or a UDP probe
+	CheckTCP  = "tcp"
+	CheckHTTP = "http"
+	CheckUDP  = "udp"
+
+	// Administrative states of a backend. A backend set down is out of
+	// rotation until it's set up again, while its health checks continue.
+	AdminStateUp   = "up"
+	AdminStateDown = "down"
+
+	// Defaults for HTTP and UDP health checks: the path requested, and the
+	// time in milliseconds allowed for the response on top of the service's
+	// connect_timeout
+	DefaultCheckPath    = "/"
+	DefaultCheckTimeout = 2000
+
 	// Default network connections are TCP
 	DefaultNet = "tcp"
 
+	// Request ID formats: 16 random hex digits, or a UUIDv7 or ULID, which
+	// sort by the time they were generated
+	RequestIDHex    = "hex"
+	RequestIDUUIDv7 = "uuidv7"
+	RequestIDULID   = "ulid"
+
+	// What to do with a request ID sent by the client: put a new ID in front
+	// of it, use it as-is if the client is trusted, or ignore it
+	RequestIDChain    = "chain"
+	RequestIDTrust    = "trust"
+	RequestIDGenerate = "generate"
+
+	DefaultRequestIDHeader = "X-Request-Id"
+
 	// All RoundRobin backends are weighted, with a default of 1
 	DefaultWeight = 1
 
@@ -29,6 +62,147 @@ const (
 	// Default for Fall and Rise is 2
 	DefaultFall = 2
 	DefaultRise = 2
+
+	// Timeout policies, for applying a changed ClientTimeout or ServerTimeout
+	// to connections that are already established.
+	TimeoutKeep  = "keep"
+	TimeoutRearm = "rearm"
+
+	// Existing connections keep their original timeout by default
+	DefaultTimeoutPolicy = TimeoutKeep
+
+	// Actions for connections and requests to a service with no backends:
+	// refuse them outright, hold them until a backend is added, or fail them
+	// like any other proxy error.
+	NoBackendRefuse = "refuse"
+	NoBackendHold   = "hold"
+	NoBackendError  = "error"
+
+	DefaultNoBackendAction = NoBackendError
+
+	// Actions for connections and requests when every backend is at its
+	// MaxConns: fail them right away, or queue them until one has room.
+	BackendFullFail  = "fail"
+	BackendFullQueue = "queue"
+
+	DefaultBackendFullAction = BackendFullFail
+
+	// What's done with the forwarding headers a client sends, like
+	// X-Forwarded-For: pass them on, or remove them unless the client is
+	// trusted.
+	ForwardedTrust = "trust"
+	ForwardedStrip = "strip"
+
+	DefaultForwardedHeaders = ForwardedTrust
+
+	// Retry policies, for which HTTP requests are tried on another backend
+	// when connecting to one fails.
+	RetryAlways     = "always"
+	RetryIdempotent = "idempotent"
+	RetryNever      = "never"
+
+	DefaultRetryPolicy = RetryAlways
+
+	// Defaults for holding connections: the time in milliseconds to wait for
+	// a backend, and the number of connections and requests waiting at once
+	DefaultHoldTimeout = 5000
+	DefaultHoldQueue   = 128
+
+	// Default time in milliseconds to queue a connection for a backend with
+	// room under its MaxConns
+	DefaultQueueTimeout = 5000
+
+	// Default time in milliseconds to wait for connections to drain on
+	// shutdown
+	DefaultShutdownTimeout = 10000
+
+	// Default time in milliseconds to wait for connections to drain when a
+	// service is removed with draining
+	DefaultDrainTimeout = 10000
+
+	// Default number of idle HTTP connections kept to each backend, and time
+	// in milliseconds they're kept
+	DefaultMaxIdleConnsPerHost = 10
+	DefaultIdleConnTimeout     = 90000
+
+	// Default time in milliseconds before a backend that declared itself not
+	// ready is returned to the control of its health checks
+	DefaultReadinessTTL = 300000
+
+	// Default limit in milliseconds for the check interval of a backend that
+	// has been down long enough to back off
+	DefaultCheckBackoffMax = 60000
+
+	// Default random variation in each backend's check interval, as a
+	// percentage either way
+	DefaultCheckJitter = 10
+
+	// Default size in bytes of the buffer for reading UDP datagrams
+	DefaultUDPBufferSize = 65536
+
+	// Default time in milliseconds before a UDP client's flow is idle
+	DefaultFlowIdleTimeout = 30000
+
+	// Default number of datagrams queued for each UDP backend
+	DefaultUDPQueueSize = 1024
+
+	// Default number of workers reading a UDP service's datagrams
+	DefaultUDPWorkers = 1
+
+	// Default time in milliseconds before an idle UDP session is closed, and
+	// the number of sessions a UDP service keeps open
+	DefaultUDPIdleTimeout = 30000
+	DefaultUDPMaxSessions = 4096
+
+	// Defaults for multiplexed services: the number of requests in flight on
+	// each backend connection, and the largest request or response in bytes
+	DefaultMuxMaxStreams = 128
+	DefaultMuxMaxMessage = 1 << 20
+
+	// PROXY protocol versions a service can send to its backends
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+
+	// What the HTTPS router does for a TLS client asking for a name it has
+	// no certificate for: present its default certificate, or fail the
+	// handshake
+	UnknownSNIDefault = "default"
+	UnknownSNIReject  = "reject"
+
+	// Access log formats, besides a template, and the destinations that
+	// aren't files
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogStdout   = "stdout"
+	AccessLogSyslog   = "syslog"
+
+	DefaultAccessLogFormat = AccessLogCommon
+
+	// The number of background tasks running at once, including those for
+	// each connection, above which a warning is logged and published
+	DefaultTaskWarnThreshold = 20000
+
+	// Default limit in bytes for the request line and headers of requests to
+	// a virtual host
+	DefaultMaxHeaderBytes = 1 << 20
+
+	// Defaults for services that defer listening: the number of backends
+	// that must be up, and the time in milliseconds availability can be
+	// below that before the listener is withdrawn
+	DefaultMinAvailable  = 1
+	DefaultWithdrawGrace = 5000
+
+	// Conditions on a backend's response body for substituting an error
+	// page: that it's empty, smaller than a number of bytes, or matches a
+	// pattern within its first bytes
+	ErrorBodyEmpty   = "empty"
+	ErrorBodySmaller = "smaller"
+	ErrorBodyMatches = "matches"
+
+	// The bytes of a response body read to match an error page pattern by
+	// default, and at most
+	DefaultErrorPeekBytes = 4096
+	MaxErrorPeekBytes     = 64 * 1024
 )
 
 var (
@@ -41,9 +215,13 @@ var (
 // Config is the global configuration for all Services.
 // Defaults set here can be overridden by individual services.
 type Config struct {
+	// SchemaVersion is the version of the state config's format. It's set
+	// when shuttle saves its state, and ignored by the admin API.
+	SchemaVersion int `json:"schema_version,omitempty"`
+
 	// Balance method
-	// Valid values are "RR" for RoundRobin, the default, and "LC" for
-	// LeastConnected.
+	// Valid values are "RR" for RoundRobin, the default, "LC" for
+	// LeastConnected, and "HASH" to keep each client IP on the same backend.
 	Balance string `json:"balance,omitempty"`
 
 	// CheckInterval is in time in milliseconds between service health checks.
@@ -69,11 +247,61 @@ type Config struct {
 	// backend service, including name resolution.
 	DialTimeout int `json:"connect_timeout"`
 
+	// TimeoutPolicy determines how a change to ClientTimeout or ServerTimeout
+	// affects existing connections. Valid values are "keep", the default,
+	// which leaves existing connections with their original timeout, and
+	// "rearm", which applies the new timeout on the next read or write.
+	TimeoutPolicy string `json:"timeout_policy,omitempty"`
+
+	// ShutdownTimeout is the maximum time in milliseconds to wait for client
+	// connections to finish when shuttle is stopped, before they are closed.
+	ShutdownTimeout int `json:"shutdown_timeout,omitempty"`
+
 	// HTTPSRedirect when set to true, redirects non-https request to https on
 	// all services. The request may either have Scheme set to 'https',  or
 	// have an "X-Forwarded-Proto: https" header.
 	HTTPSRedirect bool `json:"https-redirect"`
 
+	// MaxHeaderBytes is the limit in bytes for the request line and headers
+	// of requests to virtual hosts whose service doesn't set its own.
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
+
+	// ShadowBalance is the default ShadowBalance for new services.
+	ShadowBalance string `json:"shadow_balance,omitempty"`
+
+	// TaskWarnThreshold is the number of background tasks running at once,
+	// including those for each connection, above which a warning is logged
+	// and a tasks_high event is published. TaskWarnThresholds sets the same
+	// for the tasks of one name, like "health_check" or "tcp_conn". A
+	// threshold of -1 is off.
+	TaskWarnThreshold  int            `json:"task_warn_threshold,omitempty"`
+	TaskWarnThresholds map[string]int `json:"task_warn_thresholds,omitempty"`
+
+	// UnknownSNI is what the HTTPS router does for TLS clients asking for a
+	// name that no virtual host or certificate in its directory matches:
+	// "default" presents its first certificate, and "reject" fails the
+	// handshake. Clients that send no name always get the first
+	// certificate.
+	UnknownSNI string `json:"unknown_sni,omitempty"`
+
+	// AccessLog is where requests to services without their own access log
+	// are logged. Without one, they're logged to the main log.
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+
+	// HealthServices are the critical services /_health requires to have
+	// backends up. Without any, every service with backends is required. An
+	// empty list requires every service again.
+	HealthServices []string `json:"health_services,omitempty"`
+
+	// HealthMinUpPercent is the percentage of a required service's backends
+	// that must be up for /_health to report ok. The default, 0, needs only
+	// one.
+	HealthMinUpPercent int `json:"health_min_up_percent,omitempty"`
+
+	// Overlays are partial service configs applied on a schedule. An empty
+	// list removes them all.
+	Overlays []OverlayConfig `json:"overlays,omitempty"`
+
 	// Services is a slice of ServiceConfig for each service. A service
 	// corresponds to one listening connection, and a number of backends to
 	// proxy.
@@ -98,20 +326,85 @@ type BackendConfig struct {
 	// Used for reference and for the HTTP API.
 	Name string `json:"name"`
 
-	// Addr must in the form ip:port
+	// Addr must in the form ip:port, or a socket path for a unix backend.
 	Addr string `json:"address"`
 
-	// Network must be "tcp" or "udp".
+	// Network must be "tcp", "udp" or "unix".
 	// Default is "tcp"
 	Network string `json:"network,omitempty"`
 
-	// CheckAddr must be in the form ip:port.
+	// CheckAddr must be in the form ip:port, or a socket path for a unix
+	// backend.
 	// A TCP connect is performed against this address to determine server
 	// availability. If this is empty, no checks will be performed.
 	CheckAddr string `json:"check_address"`
 
-	// Weight is always used for RoundRobin balancing. Default is 1
+	// CheckType is "tcp", "http" or "udp". An http check sends a GET for
+	// CheckPath to CheckAddr, and only counts a 2xx or 3xx response as a
+	// success. The response must arrive within CheckTimeout milliseconds of
+	// connecting. Default is "tcp", with a path of "/" and a timeout of 2000
+	// for http.
+	CheckType    string `json:"check_type,omitempty"`
+	CheckPath    string `json:"check_path,omitempty"`
+	CheckTimeout int    `json:"check_timeout,omitempty"`
+
+	// CheckPayload is the datagram a udp check sends to CheckAddr, which must
+	// answer with any datagram within CheckTimeout. Without a payload, an
+	// empty datagram is sent, and the check only fails if CheckAddr is
+	// reported unreachable.
+	CheckPayload string `json:"check_payload,omitempty"`
+
+	// Weight is always used for RoundRobin balancing: a backend is chosen
+	// Weight times in a row before the next. HASH balancing gives a backend
+	// a share of clients in proportion to its Weight. Default is 1, and a
+	// negative weight is invalid.
 	Weight int `json:"weight"`
+
+	// BindInterface is the network interface, like "wg0", that connections
+	// and health checks to the backend are sent from, overriding the
+	// service's.
+	BindInterface string `json:"bind_interface,omitempty"`
+
+	// Tags are reported in the backend's stats. Changing them doesn't replace
+	// the backend.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// AdminState is "down" to take the backend out of rotation, while its
+	// health checks continue. An update that leaves it empty keeps the
+	// backend's current state. Changing it doesn't replace the backend.
+	// Default is "up".
+	AdminState string `json:"admin_state,omitempty"`
+
+	// MaxConns is the most TCP connections and HTTP requests the backend is
+	// sent at once. A backend at its limit is skipped, and the service's
+	// BackendFullAction decides what happens once every backend is. Default
+	// is 0, for no limit.
+	MaxConns int `json:"max_conns,omitempty"`
+
+	// SlowStart is the time in milliseconds a backend is warmed up for once
+	// it comes back up after being down. Its share of connections and
+	// datagrams ramps up from a tenth of its Weight to all of it over that
+	// time. Default is 0, for no warm-up.
+	SlowStart int `json:"slow_start,omitempty"`
+
+	// TLS, if set, connects to the backend over TLS. HTTP requests are sent
+	// as https, and so are http health checks. Not valid for a udp backend.
+	TLS *BackendTLSConfig `json:"tls,omitempty"`
+}
+
+// BackendTLSConfig verifies the certificate of a backend connected over TLS.
+type BackendTLSConfig struct {
+	// CACert is the path to a PEM file of the certificates that may sign
+	// the backend's. Default is the system's roots.
+	CACert string `json:"ca_cert,omitempty"`
+
+	// ServerName is the name sent for SNI and verified in the backend's
+	// certificate. Default is the host of the backend's address, or
+	// "localhost" for a unix backend.
+	ServerName string `json:"server_name,omitempty"`
+
+	// InsecureSkipVerify accepts any certificate the backend presents.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
 }
 
 // return a copy of the BackendConfig with default values set
@@ -122,13 +415,30 @@ func (b BackendConfig) SetDefaults() BackendConfig {
 	if b.Network == "" {
 		b.Network = DefaultNet
 	}
+	if b.CheckType == "" {
+		b.CheckType = CheckTCP
+	}
+	if b.CheckType == CheckHTTP && b.CheckPath == "" {
+		b.CheckPath = DefaultCheckPath
+	}
+	if b.CheckType == CheckHTTP || b.CheckType == CheckUDP {
+		if b.CheckTimeout == 0 {
+			b.CheckTimeout = DefaultCheckTimeout
+		}
+	}
+	if len(b.Tags) == 0 {
+		b.Tags = nil
+	}
+	if b.AdminState == "" {
+		b.AdminState = AdminStateUp
+	}
 	return b
 }
 
 func (b BackendConfig) Equal(other BackendConfig) bool {
 	b = b.SetDefaults()
 	other = other.SetDefaults()
-	return b == other
+	return reflect.DeepEqual(b, other)
 }
 
 func (b *BackendConfig) Marshal() []byte {
@@ -140,6 +450,66 @@ func (b *BackendConfig) String() string {
 	return string(b.Marshal())
 }
 
+// BackendPatch is a partial BackendConfig. Only the fields that are set are
+// applied to the backend; the name can't be changed.
+type BackendPatch struct {
+	Addr      *string `json:"address,omitempty"`
+	Network   *string `json:"network,omitempty"`
+	CheckAddr *string `json:"check_address,omitempty"`
+	Weight    *int    `json:"weight,omitempty"`
+
+	CheckType    *string `json:"check_type,omitempty"`
+	CheckPath    *string `json:"check_path,omitempty"`
+	CheckTimeout *int    `json:"check_timeout,omitempty"`
+	CheckPayload *string `json:"check_payload,omitempty"`
+	MaxConns     *int    `json:"max_conns,omitempty"`
+
+	// TLS replaces all of the backend's TLS settings if it's set.
+	TLS *BackendTLSConfig `json:"tls,omitempty"`
+
+	// Tags replace all of the backend's tags if they're not nil, so an empty
+	// map removes them.
+	Tags map[string]string `json:"tags"`
+}
+
+// Apply returns a copy of the BackendConfig with the patched fields set.
+func (p BackendPatch) Apply(b BackendConfig) BackendConfig {
+	if p.Addr != nil {
+		b.Addr = *p.Addr
+	}
+	if p.Network != nil {
+		b.Network = *p.Network
+	}
+	if p.CheckAddr != nil {
+		b.CheckAddr = *p.CheckAddr
+	}
+	if p.Weight != nil {
+		b.Weight = *p.Weight
+	}
+	if p.CheckType != nil {
+		b.CheckType = *p.CheckType
+	}
+	if p.CheckPath != nil {
+		b.CheckPath = *p.CheckPath
+	}
+	if p.CheckTimeout != nil {
+		b.CheckTimeout = *p.CheckTimeout
+	}
+	if p.CheckPayload != nil {
+		b.CheckPayload = *p.CheckPayload
+	}
+	if p.MaxConns != nil {
+		b.MaxConns = *p.MaxConns
+	}
+	if p.TLS != nil {
+		b.TLS = p.TLS
+	}
+	if p.Tags != nil {
+		b.Tags = p.Tags
+	}
+	return b
+}
+
 // keep things sorted for easy viewing and comparison
 type backendSlice []BackendConfig
 
@@ -160,16 +530,21 @@ type ServiceConfig struct {
 	Name string `json:"name"`
 
 	// Addr is the listening address for this service. Must be in the form
-	// "ip:addr"
+	// "ip:addr", or the path of the socket for a unix service.
 	Addr string `json:"address"`
 
-	// Network must be "tcp" or "udp".
+	// Network must be "tcp", "udp" or "unix".
 	// Default is "tcp"
 	Network string `json:"network,omitempty"`
 
+	// SocketMode is the permissions of a unix service's socket in octal,
+	// like "0660", set whenever the socket is bound. The umask decides them
+	// when it's empty.
+	SocketMode string `json:"socket_mode,omitempty"`
+
 	// Balance method
-	// Valid values are "RR" for RoundRobin, the default, and "LC" for
-	// LeastConnected.
+	// Valid values are "RR" for RoundRobin, the default, "LC" for
+	// LeastConnected, and "HASH" to keep each client IP on the same backend.
 	Balance string `json:"balance,omitempty"`
 
 	// CheckInterval is in time in milliseconds between service health checks.
@@ -194,27 +569,399 @@ type ServiceConfig struct {
 	// backend service, including name resolution.
 	DialTimeout int `json:"connect_timeout"`
 
+	// TimeoutPolicy determines how a change to ClientTimeout or ServerTimeout
+	// affects existing connections. Valid values are "keep", the default,
+	// and "rearm".
+	TimeoutPolicy string `json:"timeout_policy,omitempty"`
+
+	// ReadinessTTL is the maximum time in milliseconds a backend is kept out
+	// of rotation after declaring itself not ready. Once it expires, the
+	// health checks decide if the backend is up again.
+	ReadinessTTL int `json:"readiness_ttl,omitempty"`
+
+	// CheckBackoff is the time in milliseconds a backend must be down before
+	// its health checks back off, doubling the interval after each check up
+	// to CheckBackoffMax. The first successful check returns to the normal
+	// interval, so a recovered backend may take up to
+	// CheckBackoffMax + (Rise-1) * CheckInterval to be marked up. Checks
+	// don't back off if this isn't set.
+	CheckBackoff    int `json:"check_backoff,omitempty"`
+	CheckBackoffMax int `json:"check_backoff_max,omitempty"`
+
+	// CheckJitter is the percentage by which each wait for a backend's next
+	// health check is randomly shortened or lengthened, so the backends
+	// aren't all checked at once. The default is 10, and -1 turns it off.
+	CheckJitter int `json:"check_jitter,omitempty"`
+
 	// HTTPSRedirect when set to true, redirects non-https request to https. The
 	// request may either have Scheme set to 'https',  or have an
 	// "X-Forwarded-Proto: https" header.
 	HTTPSRedirect bool `json:"https-redirect"`
 
+	// VirtualHostHTTPSRedirect overrides HTTPSRedirect for some of the
+	// service's virtual hosts, so a legacy host can stay on plain HTTP while
+	// the rest are redirected, whatever the global setting. Requests whose
+	// path starts with one of HTTPSRedirectExempt, like
+	// "/.well-known/acme-challenge/", are never redirected.
+	VirtualHostHTTPSRedirect map[string]bool `json:"virtual_host_https_redirect,omitempty"`
+	HTTPSRedirectExempt      []string        `json:"https_redirect_exempt,omitempty"`
+
 	// Virtualhosts is a set of virtual hostnames for which this service should
 	// handle HTTP requests.
 	VirtualHosts []string `json:"virtual_hosts,omitempty"`
 
+	// VirtualHostCerts are the certificates the HTTPS router presents to
+	// clients asking for each of the service's virtual hosts by SNI. Hosts
+	// without one are served a certificate from the router's certificate
+	// directory.
+	VirtualHostCerts map[string]VirtualHostCert `json:"virtual_host_certs,omitempty"`
+
 	// ErrorPages are responses to be returned for HTTP error codes. Each page
 	// is defined by a URL mapped and is mapped to a list of error codes that
 	// should return the content at the URL. Error pages are retrieved ahead of
 	// time if possible, and cached.
 	ErrorPages map[string][]int `json:"error_pages,omitempty"`
 
+	// ErrorPageConditions limit the error pages for some status codes to
+	// backend responses whose body meets a condition, so an application's
+	// own meaningful error is passed through. Other codes are always
+	// substituted.
+	ErrorPageConditions map[int]ErrorPageCondition `json:"error_page_conditions,omitempty"`
+
 	// Backends is a list of all servers handling connections for this service.
 	Backends []BackendConfig `json:"backends,omitempty"`
 
 	// Maintenance mode is a flag to return 503 status codes to clients
 	// without visiting backends.
 	MaintenanceMode bool `json:"maintenance_mode"`
+
+	// DirectiveSecrets are the shared secrets for validating signed request
+	// directives. A directive signed with any of the secrets is accepted, so
+	// a new secret can be added before the old one is removed.
+	DirectiveSecrets []string `json:"directive_secrets,omitempty"`
+
+	// CheckSourcePorts is a range of local ports, like "40000-40099", that
+	// health checks are sent from, so backend firewalls can tell them apart
+	// from proxied traffic. Checks use any port if this isn't set.
+	CheckSourcePorts string `json:"check_source_ports,omitempty"`
+
+	// BindInterface is the network interface, like "wg0", that connections,
+	// datagrams and health checks to the backends are sent from. Its address
+	// is looked up as it changes, and backends are down while it has none.
+	BindInterface string `json:"bind_interface,omitempty"`
+
+	// CheckPreamble is sent on each health check connection once it's
+	// established, for backends that can recognize it.
+	CheckPreamble string `json:"check_preamble,omitempty"`
+
+	// CheckUserAgent is the User-Agent of http health checks, which then
+	// also name the service in an X-Shuttle-Service header. Checks send no
+	// User-Agent if this isn't set.
+	CheckUserAgent string `json:"check_user_agent,omitempty"`
+
+	// UDPBufferSize is the size in bytes of the buffer for reading datagrams.
+	// Larger datagrams are truncated, and counted in the service stats.
+	UDPBufferSize int `json:"udp_buffer_size,omitempty"`
+
+	// MaxDatagramSize drops and counts datagrams larger than this many bytes,
+	// including any that were truncated, instead of forwarding them.
+	MaxDatagramSize int `json:"max_datagram_size,omitempty"`
+
+	// UDPDontFragment sets the DF bit on datagrams sent to backends, where the
+	// platform allows, so datagrams larger than the path MTU fail and are
+	// counted instead of being fragmented.
+	UDPDontFragment bool `json:"udp_dont_fragment,omitempty"`
+
+	// FlowIdleTimeout is the time in milliseconds after a UDP client's last
+	// datagram that its flow is no longer counted as active.
+	FlowIdleTimeout int `json:"flow_idle_timeout,omitempty"`
+
+	// UDPQueueSize is the number of datagrams queued to be sent to each
+	// backend of a UDP service. Datagrams for a backend with a full queue
+	// are dropped and counted.
+	UDPQueueSize int `json:"udp_queue_size,omitempty"`
+
+	// UDPWorkers is the number of goroutines reading a UDP service's
+	// datagrams, which on linux each read batches of them at once. More
+	// workers forward more datagrams at once, up to about GOMAXPROCS, but
+	// datagrams from one client may then reach its backend out of order.
+	UDPWorkers int `json:"udp_workers,omitempty"`
+
+	// UDPIdleTimeout is the time in milliseconds after the last datagram in
+	// either direction that a UDP session is closed. Replies from a backend
+	// reach the client only while its session is open. UDPMaxSessions limits
+	// the sessions open at once; datagrams that would open another are
+	// dropped and counted.
+	UDPIdleTimeout int `json:"udp_idle_timeout,omitempty"`
+	UDPMaxSessions int `json:"udp_max_sessions,omitempty"`
+
+	// MuxConns enables multiplexing for a TCP service. Client requests are
+	// sent over this many connections to each backend, using the shuttle-mux
+	// framing described in mux.go. Clients are proxied 1:1 when this is 0.
+	MuxConns int `json:"mux_conns,omitempty"`
+
+	// MuxMaxStreams is the number of requests in flight on each backend
+	// connection. Further requests wait for a stream to finish.
+	MuxMaxStreams int `json:"mux_max_streams,omitempty"`
+
+	// MuxMaxMessage is the largest request or response in bytes.
+	MuxMaxMessage int `json:"mux_max_message,omitempty"`
+
+	// SendProxyProtocol writes a PROXY protocol header, "v1" or "v2", on
+	// each new backend connection, so the backend sees the client's address
+	// and the address it connected to. It isn't sent when empty. HTTP
+	// connections to backends aren't reused while it's set, since each
+	// header belongs to one client.
+	SendProxyProtocol string `json:"send_proxy_protocol,omitempty"`
+
+	// AcceptProxyProtocol expects each client connection to a TCP service
+	// to start with a v1 or v2 PROXY protocol header, as sent by a load
+	// balancer in front of shuttle. The header is removed, and the client
+	// address it gives is used for balancing and logging. Connections
+	// without a valid header are closed.
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol,omitempty"`
+
+	// TLSCert and TLSKey are the paths of the PEM certificate and key a TCP
+	// service terminates TLS with. Either may be given inline as TLSCertPEM
+	// or TLSKeyPEM instead. Client connections are plain TCP when none are
+	// set. Changing them replaces the certificate for new connections
+	// without closing the listener.
+	TLSCert    string `json:"tls_cert,omitempty"`
+	TLSKey     string `json:"tls_key,omitempty"`
+	TLSCertPEM string `json:"tls_cert_pem,omitempty"`
+	TLSKeyPEM  string `json:"tls_key_pem,omitempty"`
+
+	// MaxHeaderBytes is the limit in bytes for the request line and headers
+	// of requests to the service's virtual hosts. Larger requests are
+	// rejected with a 431. The global limit applies when this is 0.
+	MaxHeaderBytes int `json:"max_header_bytes,omitempty"`
+
+	// ShadowBalance runs a second balancing algorithm alongside Balance,
+	// which records the backends it would have chosen without affecting
+	// routing, for comparing the algorithms. It's off when empty.
+	ShadowBalance string `json:"shadow_balance,omitempty"`
+
+	// StickyCookie is the name of a cookie that keeps each HTTP client on
+	// the same backend. The first response sets it to an opaque ID of the
+	// backend, and later requests with it go to that backend while it's up.
+	// Requests are balanced as usual when it's empty.
+	StickyCookie string `json:"sticky_cookie,omitempty"`
+
+	// MaxConnsPerSecond limits the rate of new connections to a TCP service,
+	// and of HTTP requests to its virtual hosts. MaxConnsPerClient limits the
+	// rate from each client IP. Connections over a limit are closed at once,
+	// and requests are answered with a 429. Both are off when 0.
+	MaxConnsPerSecond int `json:"max_conns_per_second,omitempty"`
+	MaxConnsPerClient int `json:"max_conns_per_client,omitempty"`
+
+	// Redirects are checked in order for each HTTP request, before a backend
+	// is chosen. A service may have redirects and no backends at all.
+	Redirects []RedirectConfig `json:"redirects,omitempty"`
+
+	// Routes are checked in order for each HTTP request, and the first that
+	// matches restricts the request to its backends. Requests that match no
+	// route, or whose route has no backend up, go to any of the backends.
+	Routes []RouteConfig `json:"routes,omitempty"`
+
+	// Headers rewrites the headers of HTTP requests on their way to the
+	// backends, and of the responses on their way back. VirtualHostHeaders
+	// are applied after them for the requests to each virtual host.
+	Headers            *HeaderConfig           `json:"headers,omitempty"`
+	VirtualHostHeaders map[string]HeaderConfig `json:"virtual_host_headers,omitempty"`
+
+	// RequestTimeout is the maximum time in milliseconds for proxying an HTTP
+	// request, including any attempts on other backends and reading the
+	// response. Requests aren't limited if this is 0.
+	RequestTimeout int `json:"request_timeout,omitempty"`
+
+	// MaxRequestTime is the longest in milliseconds that a TCP connection,
+	// or an HTTP request including its response and any upgraded
+	// connection, may last however active it is. An HTTP request past it
+	// before the response starts is answered with a 504, and anything else
+	// is closed. AllowStreaming exempts upgraded connections, like
+	// WebSockets, and text/event-stream responses. Nothing is limited if
+	// this is 0.
+	MaxRequestTime int  `json:"max_request_time,omitempty"`
+	AllowStreaming bool `json:"allow_streaming,omitempty"`
+
+	// RetryPolicy is which HTTP requests are tried on another backend when
+	// connecting to a backend fails: "always", the default, "idempotent" for
+	// GET, HEAD, OPTIONS, PUT and DELETE requests whose body hasn't been
+	// read, or "never". RetryCount is the most backends a request is retried
+	// on after the first, with no limit if it's 0.
+	RetryPolicy string `json:"retry_policy,omitempty"`
+	RetryCount  int    `json:"retry_count,omitempty"`
+
+	// TrustedNetworks are the addresses and CIDR ranges of clients whose
+	// X-Request-Timeout-Ms and X-Retry-Budget headers are honored. The
+	// headers are ignored from any other client.
+	TrustedNetworks []string `json:"trusted_networks,omitempty"`
+
+	// ForwardedHeaders is what's done with the X-Forwarded-For,
+	// X-Forwarded-Proto, X-Forwarded-Host, X-Real-IP and Forwarded headers a
+	// client sends. "trust", the default, passes them on, with the client's
+	// address added to X-Forwarded-For. "strip" removes them unless the
+	// client is from TrustedNetworks, so an internet-facing service can't be
+	// sent spoofed ones.
+	ForwardedHeaders string `json:"forwarded_headers,omitempty"`
+
+	// AllowedCIDRs and DeniedCIDRs are the addresses and CIDR ranges of the
+	// clients the service accepts and refuses. A denied client is refused
+	// even if it's also allowed, and every client that isn't denied is
+	// allowed if AllowedCIDRs is empty. HTTP clients are checked by their
+	// X-Forwarded-For address where ForwardedHeaders trusts it. LogDenied
+	// logs the refused clients, at most once a second.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+	DeniedCIDRs  []string `json:"denied_cidrs,omitempty"`
+	LogDenied    bool     `json:"log_denied,omitempty"`
+
+	// AccessLog is where the service's HTTP requests are logged, instead of
+	// the global access log. One with an empty Path uses the global log.
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+
+	// RequestIDHeader is the header a request's ID is read from, and sent to
+	// the backend and back to the client in. Default is X-Request-Id.
+	// RequestIDCopyHeader is another header the ID is copied into for
+	// backends that expect a different name.
+	RequestIDHeader     string `json:"request_id_header,omitempty"`
+	RequestIDCopyHeader string `json:"request_id_copy_header,omitempty"`
+
+	// RequestIDInbound is what's done with an ID sent by the client. "chain",
+	// the default, generates an ID followed by "." and the client's. "trust"
+	// uses the client's ID as-is if it's from TrustedNetworks, and chains it
+	// otherwise. "generate" ignores it.
+	RequestIDInbound string `json:"request_id_inbound,omitempty"`
+
+	// RequestIDFormat is how IDs are generated: "hex", the default, "uuidv7",
+	// or "ulid".
+	RequestIDFormat string `json:"request_id_format,omitempty"`
+
+	// DeferListenUntilHealthy binds the service's listener only once
+	// MinAvailable backends are up, so that an upstream balancer can fail
+	// over instead of connecting to a service that can only fail. Backends
+	// with a CheckAddr start down until they pass their checks. The listener
+	// is closed, leaving open connections to drain, once availability has
+	// been below MinAvailable for WithdrawGrace milliseconds, and bound again
+	// when it recovers.
+	DeferListenUntilHealthy bool `json:"defer_listen_until_healthy,omitempty"`
+	MinAvailable            int  `json:"min_available,omitempty"`
+	WithdrawGrace           int  `json:"withdraw_grace,omitempty"`
+
+	// NoBackendAction is what happens to connections and requests while the
+	// service has no backends at all. "refuse" closes a TCP listener until a
+	// backend is added and answers HTTP requests with a 503, "hold" waits up
+	// to HoldTimeout milliseconds for a backend, with at most HoldQueue
+	// waiting, and "error", the default, fails them as if the backends were
+	// down.
+	NoBackendAction string `json:"no_backend_action,omitempty"`
+	HoldTimeout     int    `json:"hold_timeout,omitempty"`
+	HoldQueue       int    `json:"hold_queue,omitempty"`
+
+	// BackendFullAction is what happens to connections and requests when
+	// every backend is at its MaxConns. "fail", the default, closes the
+	// connection or answers the request with a 503, and "queue" waits up to
+	// QueueTimeout milliseconds for a backend to have room.
+	BackendFullAction string `json:"backend_full_action,omitempty"`
+	QueueTimeout      int    `json:"queue_timeout,omitempty"`
+
+	// DrainTimeout is the time in milliseconds that open connections have to
+	// finish when the service is removed with draining, before they're
+	// closed. New connections are refused while it drains.
+	DrainTimeout int `json:"drain_timeout,omitempty"`
+
+	// MaxIdleConnsPerHost and MaxIdleConns limit the idle connections the
+	// HTTP proxy keeps open to each backend, and to all of them, for later
+	// requests to reuse. IdleConnTimeout is the time in milliseconds an idle
+	// connection is kept. The defaults are 10 per backend, no overall limit,
+	// and 90000.
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host,omitempty"`
+	MaxIdleConns        int `json:"max_idle_conns,omitempty"`
+	IdleConnTimeout     int `json:"idle_conn_timeout,omitempty"`
+
+	// Tags are reported in the service's stats, access logs and events, and
+	// can be used to filter the stats and config. Changing them doesn't
+	// restart the service.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// VirtualHostCert is the PEM certificate and key for a virtual host, each
+// either the path of a file, or inline.
+type VirtualHostCert struct {
+	Cert    string `json:"cert,omitempty"`
+	Key     string `json:"key,omitempty"`
+	CertPEM string `json:"cert_pem,omitempty"`
+	KeyPEM  string `json:"key_pem,omitempty"`
+}
+
+// RedirectConfig redirects matching HTTP requests instead of proxying them.
+type RedirectConfig struct {
+	// Host matches the request's host, ignoring the port. A leading "*."
+	// matches any subdomain. Any host matches if this isn't set.
+	Host string `json:"host,omitempty"`
+
+	// PathPrefix optionally restricts the redirect to paths with this
+	// prefix.
+	PathPrefix string `json:"path_prefix,omitempty"`
+
+	// Target is the redirect location. {host}, {path} and {query} are
+	// replaced with the request's host, path, and raw query string.
+	Target string `json:"target"`
+
+	// Status is one of 301, 302, 307 or 308, and defaults to 301.
+	Status int `json:"status,omitempty"`
+
+	// PreserveQuery appends the request's query string to the target.
+	PreserveQuery bool `json:"preserve_query,omitempty"`
+}
+
+// RouteConfig sends matching HTTP requests to some of a service's backends.
+// A route matches when all of the conditions that are set do, and at least
+// one must be.
+type RouteConfig struct {
+	// Header matches requests with the header, and with one of its values
+	// equal to HeaderValue if that's set.
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"header_value,omitempty"`
+
+	// Cookie matches requests with the cookie, and with the value
+	// CookieValue if that's set.
+	Cookie      string `json:"cookie,omitempty"`
+	CookieValue string `json:"cookie_value,omitempty"`
+
+	// PathPrefix matches paths with the prefix, and Method the request's
+	// method.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Method     string `json:"method,omitempty"`
+
+	// Backends are the names of the backends matching requests are
+	// restricted to.
+	Backends []string `json:"backends"`
+}
+
+// HeaderConfig sets and removes HTTP headers, which are named without regard
+// to case. Headers are removed before the others are set. A value may
+// contain $host, the request's host without its port, and $remote_addr, the
+// client's IP address.
+type HeaderConfig struct {
+	RequestSet     map[string]string `json:"request_set,omitempty"`
+	RequestRemove  []string          `json:"request_remove,omitempty"`
+	ResponseSet    map[string]string `json:"response_set,omitempty"`
+	ResponseRemove []string          `json:"response_remove,omitempty"`
+}
+
+// ErrorPageCondition decides from the start of a backend's response body
+// whether its error page is substituted.
+type ErrorPageCondition struct {
+	// Body is "empty", "smaller", or "matches".
+	Body string `json:"body"`
+
+	// Bytes is the size a body must be smaller than, or the bytes a pattern
+	// is matched within, which defaults to 4096. No more than Bytes are
+	// held back from the client to decide, and at most 65536.
+	Bytes int `json:"bytes,omitempty"`
+
+	// Pattern is the regular expression a matching body contains.
+	Pattern string `json:"pattern,omitempty"`
 }
 
 // Return a copy  of ServiceConfig with any unset fields to their default
@@ -235,6 +982,86 @@ func (s ServiceConfig) SetDefaults() ServiceConfig {
 	if s.Network == "" {
 		s.Network = DefaultNet
 	}
+	if s.TimeoutPolicy == "" {
+		s.TimeoutPolicy = DefaultTimeoutPolicy
+	}
+	if s.ReadinessTTL == 0 {
+		s.ReadinessTTL = DefaultReadinessTTL
+	}
+	if s.CheckBackoffMax == 0 {
+		s.CheckBackoffMax = DefaultCheckBackoffMax
+	}
+	if s.CheckJitter == 0 {
+		s.CheckJitter = DefaultCheckJitter
+	}
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = DefaultDrainTimeout
+	}
+	if s.MaxIdleConnsPerHost == 0 {
+		s.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if s.IdleConnTimeout == 0 {
+		s.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if s.UDPBufferSize == 0 {
+		s.UDPBufferSize = DefaultUDPBufferSize
+	}
+	if strings.HasPrefix(s.Network, "udp") {
+		if s.FlowIdleTimeout == 0 {
+			s.FlowIdleTimeout = DefaultFlowIdleTimeout
+		}
+		if s.UDPQueueSize == 0 {
+			s.UDPQueueSize = DefaultUDPQueueSize
+		}
+		if s.UDPWorkers == 0 {
+			s.UDPWorkers = DefaultUDPWorkers
+		}
+		if s.UDPIdleTimeout == 0 {
+			s.UDPIdleTimeout = DefaultUDPIdleTimeout
+		}
+		if s.UDPMaxSessions == 0 {
+			s.UDPMaxSessions = DefaultUDPMaxSessions
+		}
+	}
+	if s.MuxConns > 0 {
+		if s.MuxMaxStreams == 0 {
+			s.MuxMaxStreams = DefaultMuxMaxStreams
+		}
+		if s.MuxMaxMessage == 0 {
+			s.MuxMaxMessage = DefaultMuxMaxMessage
+		}
+	}
+	if s.DeferListenUntilHealthy {
+		if s.MinAvailable == 0 {
+			s.MinAvailable = DefaultMinAvailable
+		}
+		if s.WithdrawGrace == 0 {
+			s.WithdrawGrace = DefaultWithdrawGrace
+		}
+	}
+	if s.NoBackendAction == "" {
+		s.NoBackendAction = DefaultNoBackendAction
+	}
+	if s.RetryPolicy == "" {
+		s.RetryPolicy = DefaultRetryPolicy
+	}
+	if s.NoBackendAction == NoBackendHold {
+		if s.HoldTimeout == 0 {
+			s.HoldTimeout = DefaultHoldTimeout
+		}
+		if s.HoldQueue == 0 {
+			s.HoldQueue = DefaultHoldQueue
+		}
+	}
+	if s.BackendFullAction == "" {
+		s.BackendFullAction = DefaultBackendFullAction
+	}
+	if s.ForwardedHeaders == "" {
+		s.ForwardedHeaders = DefaultForwardedHeaders
+	}
+	if s.BackendFullAction == BackendFullQueue && s.QueueTimeout == 0 {
+		s.QueueTimeout = DefaultQueueTimeout
+	}
 	return s
 }
 
@@ -324,6 +1151,111 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 	if cfg.DialTimeout != 0 {
 		new.DialTimeout = cfg.DialTimeout
 	}
+	if cfg.TimeoutPolicy != "" {
+		new.TimeoutPolicy = cfg.TimeoutPolicy
+	}
+	if cfg.ReadinessTTL != 0 {
+		new.ReadinessTTL = cfg.ReadinessTTL
+	}
+	if cfg.CheckBackoff != 0 {
+		new.CheckBackoff = cfg.CheckBackoff
+	}
+	if cfg.CheckBackoffMax != 0 {
+		new.CheckBackoffMax = cfg.CheckBackoffMax
+	}
+	if cfg.CheckJitter != 0 {
+		new.CheckJitter = cfg.CheckJitter
+	}
+	if cfg.UDPBufferSize != 0 {
+		new.UDPBufferSize = cfg.UDPBufferSize
+	}
+	if cfg.MaxDatagramSize != 0 {
+		new.MaxDatagramSize = cfg.MaxDatagramSize
+	}
+	if cfg.FlowIdleTimeout != 0 {
+		new.FlowIdleTimeout = cfg.FlowIdleTimeout
+	}
+	if cfg.UDPQueueSize != 0 {
+		new.UDPQueueSize = cfg.UDPQueueSize
+	}
+	if cfg.UDPWorkers != 0 {
+		new.UDPWorkers = cfg.UDPWorkers
+	}
+	if cfg.UDPIdleTimeout != 0 {
+		new.UDPIdleTimeout = cfg.UDPIdleTimeout
+	}
+	if cfg.UDPMaxSessions != 0 {
+		new.UDPMaxSessions = cfg.UDPMaxSessions
+	}
+	if cfg.CheckSourcePorts != "" {
+		new.CheckSourcePorts = cfg.CheckSourcePorts
+	}
+	if cfg.BindInterface != "" {
+		new.BindInterface = cfg.BindInterface
+	}
+	if cfg.MuxConns != 0 {
+		new.MuxConns = cfg.MuxConns
+	}
+	if cfg.MuxMaxStreams != 0 {
+		new.MuxMaxStreams = cfg.MuxMaxStreams
+	}
+	if cfg.MuxMaxMessage != 0 {
+		new.MuxMaxMessage = cfg.MuxMaxMessage
+	}
+	if cfg.MaxHeaderBytes != 0 {
+		new.MaxHeaderBytes = cfg.MaxHeaderBytes
+	}
+	if cfg.CheckPreamble != "" {
+		new.CheckPreamble = cfg.CheckPreamble
+	}
+	if cfg.CheckUserAgent != "" {
+		new.CheckUserAgent = cfg.CheckUserAgent
+	}
+	if cfg.RequestTimeout != 0 {
+		new.RequestTimeout = cfg.RequestTimeout
+	}
+	if cfg.MaxRequestTime != 0 {
+		new.MaxRequestTime = cfg.MaxRequestTime
+	}
+	if cfg.RetryPolicy != "" {
+		new.RetryPolicy = cfg.RetryPolicy
+	}
+	if cfg.RetryCount != 0 {
+		new.RetryCount = cfg.RetryCount
+	}
+	if cfg.MinAvailable != 0 {
+		new.MinAvailable = cfg.MinAvailable
+	}
+	if cfg.WithdrawGrace != 0 {
+		new.WithdrawGrace = cfg.WithdrawGrace
+	}
+	if cfg.NoBackendAction != "" {
+		new.NoBackendAction = cfg.NoBackendAction
+	}
+	if cfg.HoldTimeout != 0 {
+		new.HoldTimeout = cfg.HoldTimeout
+	}
+	if cfg.HoldQueue != 0 {
+		new.HoldQueue = cfg.HoldQueue
+	}
+	if cfg.BackendFullAction != "" {
+		new.BackendFullAction = cfg.BackendFullAction
+	}
+	if cfg.QueueTimeout != 0 {
+		new.QueueTimeout = cfg.QueueTimeout
+	}
+	if cfg.DrainTimeout != 0 {
+		new.DrainTimeout = cfg.DrainTimeout
+	}
+	if cfg.MaxIdleConnsPerHost != 0 {
+		new.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	}
+	if cfg.MaxIdleConns != 0 {
+		new.MaxIdleConns = cfg.MaxIdleConns
+	}
+	if cfg.IdleConnTimeout != 0 {
+		new.IdleConnTimeout = cfg.IdleConnTimeout
+	}
 
 	if cfg.VirtualHosts != nil {
 		new.VirtualHosts = cfg.VirtualHosts
@@ -333,12 +1265,246 @@ func (s ServiceConfig) Merge(cfg ServiceConfig) ServiceConfig {
 		new.ErrorPages = cfg.ErrorPages
 	}
 
+	if cfg.ErrorPageConditions != nil {
+		new.ErrorPageConditions = cfg.ErrorPageConditions
+	}
+
 	if cfg.Backends != nil {
 		new.Backends = cfg.Backends
 	}
 
+	if cfg.DirectiveSecrets != nil {
+		new.DirectiveSecrets = cfg.DirectiveSecrets
+	}
+
+	if cfg.VirtualHostCerts != nil {
+		new.VirtualHostCerts = cfg.VirtualHostCerts
+	}
+	if cfg.Redirects != nil {
+		new.Redirects = cfg.Redirects
+	}
+	if cfg.Routes != nil {
+		new.Routes = cfg.Routes
+	}
+	if cfg.Headers != nil {
+		new.Headers = cfg.Headers
+	}
+	if cfg.VirtualHostHeaders != nil {
+		new.VirtualHostHeaders = cfg.VirtualHostHeaders
+	}
+	if cfg.VirtualHostHTTPSRedirect != nil {
+		new.VirtualHostHTTPSRedirect = cfg.VirtualHostHTTPSRedirect
+	}
+	if cfg.HTTPSRedirectExempt != nil {
+		new.HTTPSRedirectExempt = cfg.HTTPSRedirectExempt
+	}
+
+	if cfg.TrustedNetworks != nil {
+		new.TrustedNetworks = cfg.TrustedNetworks
+	}
+	if cfg.ForwardedHeaders != "" {
+		new.ForwardedHeaders = cfg.ForwardedHeaders
+	}
+	if cfg.AllowedCIDRs != nil {
+		new.AllowedCIDRs = cfg.AllowedCIDRs
+	}
+	if cfg.DeniedCIDRs != nil {
+		new.DeniedCIDRs = cfg.DeniedCIDRs
+	}
+	if cfg.AccessLog != nil {
+		new.AccessLog = cfg.AccessLog
+	}
+
+	if cfg.RequestIDHeader != "" {
+		new.RequestIDHeader = cfg.RequestIDHeader
+	}
+	if cfg.RequestIDCopyHeader != "" {
+		new.RequestIDCopyHeader = cfg.RequestIDCopyHeader
+	}
+	if cfg.RequestIDInbound != "" {
+		new.RequestIDInbound = cfg.RequestIDInbound
+	}
+	if cfg.RequestIDFormat != "" {
+		new.RequestIDFormat = cfg.RequestIDFormat
+	}
+
+	if cfg.Tags != nil {
+		new.Tags = cfg.Tags
+	}
+
 	new.HTTPSRedirect = cfg.HTTPSRedirect
 	new.MaintenanceMode = cfg.MaintenanceMode
+	new.ShadowBalance = cfg.ShadowBalance
+	new.StickyCookie = cfg.StickyCookie
+	new.SocketMode = cfg.SocketMode
+	new.MaxConnsPerSecond = cfg.MaxConnsPerSecond
+	new.MaxConnsPerClient = cfg.MaxConnsPerClient
+	new.LogDenied = cfg.LogDenied
+	new.SendProxyProtocol = cfg.SendProxyProtocol
+	new.AcceptProxyProtocol = cfg.AcceptProxyProtocol
+	new.TLSCert = cfg.TLSCert
+	new.TLSKey = cfg.TLSKey
+	new.TLSCertPEM = cfg.TLSCertPEM
+	new.TLSKeyPEM = cfg.TLSKeyPEM
+	new.UDPDontFragment = cfg.UDPDontFragment
+	new.DeferListenUntilHealthy = cfg.DeferListenUntilHealthy
+	new.AllowStreaming = cfg.AllowStreaming
 
 	return new
 }
+
+// AccessLogConfig is a destination and format for an access log.
+type AccessLogConfig struct {
+	// Path is the file the log is appended to, or "stdout" or "syslog".
+	// Files are reopened on SIGUSR1, so they can be rotated.
+	Path string `json:"path"`
+
+	// Format is "common" or "combined", for the Apache formats of the same
+	// names, or a text/template rendered with each request's fields, like
+	// "{{.Host}} {{.Status}} {{.Duration}}". Default is "common".
+	Format string `json:"format,omitempty"`
+}
+
+// OverlayConfig changes some settings of services for a while, starting at
+// each time matched by its schedule. The settings are returned to their
+// previous values when it ends.
+type OverlayConfig struct {
+	Name string `json:"name"`
+
+	// Schedule is a cron expression of minute, hour, day of month, month and
+	// day of week, in shuttle's local time, e.g. "0 22 * * 1-5".
+	Schedule string `json:"schedule"`
+
+	// Duration is the time in milliseconds the overlay is active after each
+	// start.
+	Duration int `json:"duration"`
+
+	// Priority decides which of several active overlays sets a value, the
+	// highest first.
+	Priority int `json:"priority,omitempty"`
+
+	Services []ServiceOverlay `json:"services"`
+}
+
+// ServiceOverlay is the part of a service's config set by an overlay. Only the
+// fields that are set are changed.
+type ServiceOverlay struct {
+	Service string `json:"service"`
+
+	// Weights of the named backends
+	Weights map[string]int `json:"weights,omitempty"`
+
+	MaintenanceMode *bool `json:"maintenance_mode,omitempty"`
+}
+
+// ReadyConfig is published by a backend to take itself out of rotation, or to
+// return to it.
+type ReadyConfig struct {
+	Ready bool `json:"ready"`
+
+	// Drain is the time in milliseconds to allow existing connections to
+	// finish when a backend isn't ready, before they are closed. Connections
+	// are left open if this isn't set.
+	Drain int `json:"drain_ms,omitempty"`
+}
+
+// AdminStateConfig takes a backend out of rotation for maintenance, or returns
+// it, with a State of "down" or "up".
+type AdminStateConfig struct {
+	State string `json:"state"`
+}
+
+// ServiceRename gives a service a new name. The old name reports the new one
+// for a grace period after the rename.
+type ServiceRename struct {
+	Name string `json:"name"`
+}
+
+// VHostReadiness reports whether a virtual host is ready for traffic, such as
+// before pointing DNS at shuttle. Ready is only true if every check passed.
+type VHostReadiness struct {
+	Host   string           `json:"host"`
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// ReadinessCheck is a single item of a VHostReadiness report.
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	// VHostReadiness checks
+	ReadyRouting     = "routing"
+	ReadyBackends    = "backends"
+	ReadyCertificate = "certificate"
+	ReadyOwner       = "owner"
+	ReadySelfRequest = "self_request"
+
+	// The number of days a certificate must remain valid for a vhost to be
+	// ready, unless another minimum is requested.
+	DefaultCertMinDays = 7
+)
+
+// CaptureConfig starts a payload capture on a single backend, for debugging.
+// Only connections made to the backend after the capture starts are recorded,
+// and the capture stops as soon as any limit is reached.
+type CaptureConfig struct {
+	// Duration is the maximum length of the capture in milliseconds.
+	Duration int `json:"duration"`
+
+	// MaxBytes is the maximum number of payload bytes to record.
+	MaxBytes int `json:"max_bytes"`
+
+	// MaxSessions is the maximum number of connections to record. Each
+	// request to an HTTP service is a session of its own.
+	MaxSessions int `json:"max_sessions"`
+
+	// MaxBodyBytes is the number of bytes recorded from the start of each
+	// request and response body to an HTTP backend, after their heads.
+	MaxBodyBytes int `json:"max_body_bytes"`
+
+	// Direction selects which half of the stream to record.
+	// Valid values are "both", the default, "request" for data sent to the
+	// backend, and "response" for data received from the backend.
+	Direction string `json:"direction,omitempty"`
+
+	// Path is an optional file to write the capture to once it has stopped.
+	// Captured data is only kept in memory if this isn't set.
+	Path string `json:"path,omitempty"`
+}
+
+const (
+	// Capture directions
+	CaptureBoth     = "both"
+	CaptureRequest  = "request"
+	CaptureResponse = "response"
+
+	// Default capture limits
+	DefaultCaptureDuration     = 60000
+	DefaultCaptureMaxBytes     = 1 << 20
+	DefaultCaptureMaxSessions  = 10
+	DefaultCaptureMaxBodyBytes = 1024
+)
+
+// Return a copy of the CaptureConfig with default values set
+func (c CaptureConfig) SetDefaults() CaptureConfig {
+	if c.Duration == 0 {
+		c.Duration = DefaultCaptureDuration
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = DefaultCaptureMaxBytes
+	}
+	if c.MaxSessions == 0 {
+		c.MaxSessions = DefaultCaptureMaxSessions
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = DefaultCaptureMaxBodyBytes
+	}
+	if c.Direction == "" {
+		c.Direction = CaptureBoth
+	}
+	return c
+}
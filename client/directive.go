@@ -0,0 +1,127 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// DirectiveHeader is the request header carrying a signed directive.
+const DirectiveHeader = "X-Shuttle-Directive"
+
+var (
+	ErrDirectiveFormat    = errors.New("invalid directive format")
+	ErrDirectiveSignature = errors.New("invalid directive signature")
+	ErrDirectiveExpired   = errors.New("directive expired")
+)
+
+// A Directive overrides how shuttle handles a single HTTP request. Directives
+// are signed with a secret shared with the service, so that only trusted
+// tooling can create them.
+type Directive struct {
+	// ID identifies the directive in the access log. A random ID is assigned
+	// when signing if this is empty.
+	ID string `json:"id"`
+
+	// Service restricts the directive to a single service, if set.
+	Service string `json:"service,omitempty"`
+
+	// Expires is the unix time in seconds after which the directive is
+	// ignored.
+	Expires int64 `json:"exp"`
+
+	// Backend is the name of the backend to send the request to, regardless
+	// of balancing or health checks.
+	Backend string `json:"backend,omitempty"`
+
+	// NoCache bypasses cached error pages, and asks any upstream caches to
+	// revalidate.
+	NoCache bool `json:"no_cache,omitempty"`
+
+	// FullLog logs the request and response headers.
+	FullLog bool `json:"full_log,omitempty"`
+
+	// Trace asks the backend to trace the request, by setting the
+	// X-Shuttle-Trace header to the directive ID.
+	Trace bool `json:"trace,omitempty"`
+}
+
+func signDirective(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignDirective returns a token for the X-Shuttle-Directive header, in the
+// form base64(json).base64(hmac-sha256).
+func SignDirective(secret string, d Directive) (string, error) {
+	if secret == "" {
+		return "", errors.New("directive secret is empty")
+	}
+	if d.Expires == 0 {
+		return "", errors.New("directive must expire")
+	}
+
+	if d.ID == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return "", err
+		}
+		d.ID = hex.EncodeToString(id)
+	}
+
+	js, err := json.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(js)
+	return payload + "." + signDirective(secret, payload), nil
+}
+
+// VerifyDirective checks the token's signature against each of the secrets,
+// so that a secret can be rotated by adding the new one before removing the
+// old. The directive is returned if the signature matches and it hasn't
+// expired.
+func VerifyDirective(secrets []string, token string, now time.Time) (*Directive, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrDirectiveFormat
+	}
+	payload, sig := parts[0], parts[1]
+
+	valid := false
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		if hmac.Equal([]byte(sig), []byte(signDirective(secret, payload))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrDirectiveSignature
+	}
+
+	js, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrDirectiveFormat
+	}
+
+	d := &Directive{}
+	if err := json.Unmarshal(js, d); err != nil {
+		return nil, ErrDirectiveFormat
+	}
+
+	if now.Unix() >= d.Expires {
+		return nil, ErrDirectiveExpired
+	}
+	return d, nil
+}
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// The types of events: a backend changed state, a backend or service was
+// added or removed, more background tasks are running than the configured
+// threshold, the server finished its shutdown sequence, or the subscriber
+// was evicted for not keeping up, which is the last event of a stream.
+const (
+	EventBackendState   = "backend_state"
+	EventBackendAdded   = "backend_added"
+	EventBackendRemoved = "backend_removed"
+	EventServiceAdded   = "service_added"
+	EventServiceRemoved = "service_removed"
+	EventTasksHigh      = "tasks_high"
+	EventShutdown       = "shutdown"
+	EventEvicted        = "evicted"
+)
+
+// Event is a change to the services and backends of a shuttle server.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Service string    `json:"service,omitempty"`
+	Backend string    `json:"backend,omitempty"`
+
+	// The tags of the service, and of the backend for a backend's events.
+	ServiceTags map[string]string `json:"service_tags,omitempty"`
+	BackendTags map[string]string `json:"backend_tags,omitempty"`
+
+	// The backend's state before and after the event, one of up, down,
+	// draining or maintenance, and its consecutive failed health checks at
+	// the time. An added backend has no old state, and a removed backend no
+	// new state.
+	OldState string `json:"old_state,omitempty"`
+	NewState string `json:"new_state,omitempty"`
+	Failures int    `json:"failures"`
+
+	// The tasks running when a threshold was passed, and the threshold. Task
+	// is the name of the tasks, or empty for the total.
+	Task      string `json:"task,omitempty"`
+	Tasks     int    `json:"tasks,omitempty"`
+	Threshold int    `json:"threshold,omitempty"`
+
+	// Whether the shutdown closed connections that were still open at its
+	// timeout.
+	Forced bool `json:"forced,omitempty"`
+}
+
+// Events streams the events of a running shuttle server as they happen, for
+// every service or only the named one. The channel is closed when ctx is
+// done, the connection is lost, or the server evicts the subscriber, which
+// sends a last event of type EventEvicted.
+func (c *Client) Events(ctx context.Context, service string) (<-chan Event, error) {
+	q := url.Values{}
+	if service != "" {
+		q.Set("service", service)
+	}
+
+	body, err := c.openStream(ctx, "/_events", q.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream shuttle events: %s", err)
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		readStream(body, func(data []byte) bool {
+			var event Event
+			if err := json.Unmarshal(data, &event); err != nil {
+				return true
+			}
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return events, nil
+}
@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The types of log entries: an access log entry for an HTTP request, an
+// error or warning, or the last entry of a stream that was evicted for not
+// keeping up.
+const (
+	LogAccess  = "access"
+	LogError   = "error"
+	LogEvicted = "evicted"
+)
+
+// The levels of log entries, from most to least severe. Access log entries
+// are info.
+const (
+	LevelError = "error"
+	LevelWarn  = "warn"
+	LevelInfo  = "info"
+)
+
+// LogEntry is an entry streamed from a shuttle server's logs.
+type LogEntry struct {
+	Type  string    `json:"type"`
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+
+	// the message of an error or warning
+	Message string `json:"message,omitempty"`
+
+	// The request of an access log entry. Backend is the backend's name if
+	// it's still in the service, and BackendAddr is the address the request
+	// was sent to. Attempted is every backend address tried, in order.
+	// Duration is in milliseconds.
+	ID          string  `json:"id,omitempty"`
+	Service     string  `json:"service,omitempty"`
+	Backend     string  `json:"backend,omitempty"`
+	BackendAddr string  `json:"backend_address,omitempty"`
+	Method      string  `json:"method,omitempty"`
+	URL         string  `json:"url,omitempty"`
+	ClientIP    string  `json:"client_ip,omitempty"`
+	Status      int     `json:"status,omitempty"`
+	Duration    float64 `json:"duration_ms,omitempty"`
+	Error       string  `json:"error,omitempty"`
+	Origin      string  `json:"origin,omitempty"`
+	Reason      string  `json:"reason,omitempty"`
+	Directive   string  `json:"directive,omitempty"`
+	Tags        string  `json:"tags,omitempty"`
+
+	Attempted []string `json:"attempted,omitempty"`
+}
+
+// LogFilter selects the entries streamed by TailLogs. Empty fields match
+// everything.
+type LogFilter struct {
+	// Errors and warnings match a service or backend they mention.
+	Service string
+	Backend string
+
+	// Level is the least severe level streamed: error, warn, or info.
+	Level string
+
+	// Status is a class of access log status codes, like "5xx". Only access
+	// log entries match a status.
+	Status string
+}
+
+func (f LogFilter) query() string {
+	q := url.Values{}
+	for k, v := range map[string]string{
+		"service": f.Service,
+		"backend": f.Backend,
+		"level":   f.Level,
+		"status":  f.Status,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q.Encode()
+}
+
+// TailLogs streams the log entries matching filter from a running shuttle
+// server, as they're logged. The channel is closed when ctx is done, the
+// connection is lost, or the server evicts the stream, which sends a last
+// entry of type LogEvicted.
+func (c *Client) TailLogs(ctx context.Context, filter LogFilter) (<-chan LogEntry, error) {
+	body, err := c.openStream(ctx, "/_logs/stream", filter.query())
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream shuttle logs: %s", err)
+	}
+
+	entries := make(chan LogEntry)
+	go func() {
+		defer close(entries)
+		readStream(body, func(data []byte) bool {
+			var entry LogEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return true
+			}
+			select {
+			case entries <- entry:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return entries, nil
+}
+
+// Open a stream of server-sent events from the admin API.
+func (c *Client) openStream(ctx context.Context, path, query string) (io.ReadCloser, error) {
+	u := fmt.Sprintf("http://%s%s", c.addr, path)
+	if query != "" {
+		u += "?" + query
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream")
+
+	// the stream has no time limit, but keeps the token
+	stream := &http.Client{Transport: c.httpClient.Transport}
+	resp, err := stream.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp.Body, nil
+}
+
+// Pass the data of each event in a stream to send, until it returns false or
+// the stream ends, then close the stream.
+func readStream(body io.ReadCloser, send func(data []byte) bool) {
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if !send([]byte(line[len("data: "):])) {
+			return
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// The shuttle-mux framing
+//
+// A TCP service with mux_conns set multiplexes its clients over a few
+// connections to each backend, for strict request/response protocols.
+//
+// Clients send each request as a message: a 4 byte big-endian length,
+// followed by that many bytes of payload. A client must wait for the response
+// message before sending another request on the same connection.
+//
+// Shuttle sends each request to a backend as a frame: a 4 byte big-endian
+// length of the rest of the frame, a 4 byte big-endian stream ID, and the
+// payload. The backend must reply with exactly one frame with the same stream
+// ID for every request, in any order. The response payload is returned to the
+// client as a message.
+//
+// ServeMuxConn implements the backend side of the framing.
+
+var (
+	ErrMessageTooLarge = errors.New("mux message too large")
+	ErrShortFrame      = errors.New("mux frame too short")
+)
+
+// WriteMessage writes a length-prefixed message.
+func WriteMessage(w io.Writer, payload []byte) error {
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	copy(buf[4:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a length-prefixed message, of no more than max bytes.
+func ReadMessage(r io.Reader, max int) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:])
+	if int64(n) > int64(max) {
+		return nil, ErrMessageTooLarge
+	}
+
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// WriteMuxFrame writes a frame for stream id. The frame is written with a
+// single Write, so concurrent writers only need to serialize their calls.
+func WriteMuxFrame(w io.Writer, id uint32, payload []byte) error {
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(4+len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], id)
+	copy(buf[8:], payload)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadMuxFrame reads a frame, with a payload of no more than max bytes.
+func ReadMuxFrame(r io.Reader, max int) (uint32, []byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 4 {
+		return 0, nil, ErrShortFrame
+	}
+	if int64(n-4) > int64(max) {
+		return 0, nil, ErrMessageTooLarge
+	}
+
+	if _, err := io.ReadFull(r, hdr[4:]); err != nil {
+		return 0, nil, err
+	}
+	id := binary.BigEndian.Uint32(hdr[4:])
+
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return id, payload, nil
+}
+
+// A MuxHandler returns the response for a single request.
+type MuxHandler func(req []byte) []byte
+
+// ServeMuxConn serves the requests multiplexed over a connection from
+// shuttle, calling h for each request in its own goroutine. Requests of more
+// than max bytes are rejected. ServeMuxConn returns when the connection can't
+// be read, after the responses in progress are written.
+func ServeMuxConn(conn io.ReadWriter, h MuxHandler, max int) error {
+	var (
+		wg      sync.WaitGroup
+		writeMu sync.Mutex
+	)
+	defer wg.Wait()
+
+	for {
+		id, req, err := ReadMuxFrame(conn, max)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := h(req)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			WriteMuxFrame(conn, id, resp)
+		}()
+	}
+}
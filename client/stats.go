@@ -0,0 +1,441 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// GetStats retrieves the stats of every service on a running shuttle server.
+func (c *Client) GetStats() ([]ServiceStat, error) {
+	return c.allStats(context.Background(), c.httpClient)
+}
+
+// GetStatsContext is GetStats limited by ctx instead of the client's timeout.
+func (c *Client) GetStatsContext(ctx context.Context) ([]ServiceStat, error) {
+	return c.allStats(ctx, c.contextClient())
+}
+
+// GetServiceStats retrieves the stats of a single service on a running
+// shuttle server.
+func (c *Client) GetServiceStats(service string) (*ServiceStat, error) {
+	return c.serviceStats(context.Background(), c.httpClient, service)
+}
+
+// GetServiceStatsContext is GetServiceStats limited by ctx instead of the
+// client's timeout.
+func (c *Client) GetServiceStatsContext(ctx context.Context, service string) (*ServiceStat, error) {
+	return c.serviceStats(ctx, c.contextClient(), service)
+}
+
+// An http client without the client's timeout, for requests limited by their
+// context instead.
+func (c *Client) contextClient() *http.Client {
+	return &http.Client{Transport: c.httpClient.Transport}
+}
+
+func (c *Client) allStats(ctx context.Context, hc *http.Client) ([]ServiceStat, error) {
+	resp, err := c.getStats(ctx, hc, "/_stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// a server with no services answers with a 503, and no stats
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, responseError(resp, "failed to get shuttle stats")
+	}
+	stats := []ServiceStat{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (c *Client) serviceStats(ctx context.Context, hc *http.Client, service string) (*ServiceStat, error) {
+	resp, err := c.getStats(ctx, hc, "/"+escapeName(service)+"/_stats")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp, "failed to get stats of shuttle service '%s'", service)
+	}
+	stat := &ServiceStat{}
+	if err := json.NewDecoder(resp.Body).Decode(stat); err != nil {
+		return nil, err
+	}
+	return stat, nil
+}
+
+// Health retrieves the health of a running shuttle server, as its load
+// balancer sees it. The report is returned whether or not the server is
+// healthy.
+func (c *Client) Health() (*Health, error) {
+	resp, err := c.httpClient.Get(fmt.Sprintf("http://%s/_health", c.addr))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return nil, responseError(resp, "failed to get shuttle health")
+	}
+	health := &Health{}
+	if err := json.NewDecoder(resp.Body).Decode(health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+func (c *Client) getStats(ctx context.Context, hc *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s%s", c.addr, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	return hc.Do(req.WithContext(ctx))
+}
+
+// ServiceStat is the stats of a service, as returned by the admin API.
+type ServiceStat struct {
+	Name          string        `json:"name"`
+	Addr          string        `json:"address"`
+	VirtualHosts  []string      `json:"virtual_hosts"`
+	Backends      []BackendStat `json:"backends"`
+	Balance       string        `json:"balance"`
+	CheckInterval int           `json:"check_interval"`
+	Fall          int           `json:"fall"`
+	Rise          int           `json:"rise"`
+	ClientTimeout int           `json:"client_timeout"`
+	ServerTimeout int           `json:"server_timeout"`
+	DialTimeout   int           `json:"connect_timeout"`
+	Sent          int64         `json:"sent"`
+	Rcvd          int64         `json:"received"`
+	Errors        int64         `json:"errors"`
+	Conns         int64         `json:"connections"`
+	Active        int64         `json:"active"`
+	HTTPActive    int64         `json:"http_active"`
+	HTTPConns     int64         `json:"http_connections"`
+	HTTPErrors    int64         `json:"http_errors"`
+
+	// The client side of the service's own listener: the bytes read from and
+	// written to clients, which Rcvd and Sent count at the backends, the
+	// connections accepted, and the accepts that failed.
+	ClientBytesIn  int64 `json:"client_bytes_in"`
+	ClientBytesOut int64 `json:"client_bytes_out"`
+	Accepted       int64 `json:"accepted_connections"`
+	AcceptErrors   int64 `json:"accept_errors"`
+
+	Directives      int64 `json:"directives"`
+	DirectiveErrors int64 `json:"directive_errors"`
+
+	RetryBudgetExhausted int64 `json:"retry_budget_exhausted"`
+	RateLimited          int64 `json:"rate_limited"`
+	ClientDenied         int64 `json:"client_denied"`
+
+	// the requests and connections cut off at the service's MaxRequestTime
+	MaxRequestTimeExceeded int64 `json:"max_request_time_exceeded"`
+
+	// whether client connections are TLS, and the handshakes that failed
+	TLS                bool  `json:"tls,omitempty"`
+	TLSHandshakeErrors int64 `json:"tls_handshake_errors,omitempty"`
+
+	// The requests to each virtual host, by canonical name
+	VHostStats map[string]VHostStat `json:"virtual_host_stats"`
+
+	// Requests shuttle answered itself, by reason. HTTPErrors only counts
+	// requests that failed to get a response from a backend.
+	LocalResponses map[string]int64 `json:"local_responses"`
+
+	Redirects []RedirectStat `json:"redirects,omitempty"`
+
+	// The routes, and the requests each matched
+	Routes []RouteStat `json:"routes,omitempty"`
+
+	// The error page conditions, and the responses that met them or not
+	ErrorConditions []ErrorConditionStat `json:"error_page_conditions,omitempty"`
+
+	// the number of backends in each state
+	BackendStates map[string]int `json:"backend_states"`
+
+	UDPTruncated    int64 `json:"udp_truncated,omitempty"`
+	UDPOversize     int64 `json:"udp_oversize,omitempty"`
+	UDPMsgTooLong   int64 `json:"udp_msg_too_long,omitempty"`
+	UDPBackendsDown int64 `json:"udp_backends_down,omitempty"`
+	UDPDontFragment bool  `json:"udp_dont_fragment,omitempty"`
+
+	// Network tells TCP and UDP services apart. UDP services have no
+	// connections, so Conns, Active and the HTTP counts are always 0, and
+	// their traffic is reported in UDP instead.
+	Network string   `json:"network"`
+	UDP     *UDPStat `json:"udp,omitempty"`
+
+	// whether a service that defers listening is waiting, listening, or
+	// withdrawn
+	ListenState string `json:"listen_state,omitempty"`
+
+	// Empty is set while the service has no backends. NoBackends counts the
+	// connections, requests and datagrams that arrived meanwhile, Holding
+	// those waiting for a backend, and HoldDropped those that gave up
+	// waiting or found the hold queue full.
+	Empty       bool  `json:"empty"`
+	NoBackends  int64 `json:"no_backends"`
+	Holding     int   `json:"holding,omitempty"`
+	HoldDropped int64 `json:"hold_dropped,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// UDPStat reports the traffic of a UDP service. The unique clients and active
+// flows are estimates, within a few percent.
+type UDPStat struct {
+	DatagramsIn  int64 `json:"datagrams_in"`
+	DatagramsOut int64 `json:"datagrams_out"`
+
+	// distinct client addresses in the current window, and in the last
+	// complete one, which is ClientWindow milliseconds long
+	UniqueClients     int64 `json:"unique_clients"`
+	LastUniqueClients int64 `json:"last_unique_clients"`
+	ClientWindow      int   `json:"client_window"`
+
+	// clients that sent a datagram within the last FlowIdleTimeout
+	// milliseconds
+	ActiveFlows     int64 `json:"active_flows"`
+	FlowIdleTimeout int   `json:"flow_idle_timeout"`
+
+	// the datagrams sent to each backend
+	BackendDatagrams map[string]int64 `json:"backend_datagrams"`
+
+	// the send queue of each backend, and the datagrams dropped from all of
+	// them because they were full
+	QueueSize     int                     `json:"queue_size"`
+	BackendQueues map[string]UDPQueueStat `json:"backend_queues"`
+	QueueDropped  int64                   `json:"queue_dropped"`
+
+	// sessions open now, and at most, those opened and expired since the
+	// service started, the datagrams dropped because the table was full,
+	// and the replies relayed from backends to clients
+	Sessions        int   `json:"sessions"`
+	MaxSessions     int   `json:"max_sessions"`
+	SessionsOpened  int64 `json:"sessions_opened"`
+	SessionsExpired int64 `json:"sessions_expired"`
+	SessionsFull    int64 `json:"sessions_full"`
+	UDPIdleTimeout  int   `json:"udp_idle_timeout"`
+	Replies         int64 `json:"replies"`
+}
+
+// BackendStat is the stats of one of a service's backends.
+type BackendStat struct {
+	Name       string `json:"name"`
+	Addr       string `json:"address"`
+	CheckAddr  string `json:"check_address"`
+	Up         bool   `json:"up"`
+	Weight     int    `json:"weight"`
+	Sent       int64  `json:"sent"`
+	Rcvd       int64  `json:"received"`
+	Errors     int64  `json:"errors"`
+	Conns      int64  `json:"connections"`
+	Active     int64  `json:"active"`
+	HTTPActive int64  `json:"http_active"`
+	HTTPIdle   int64  `json:"http_idle"`
+	Datagrams  int64  `json:"datagrams,omitempty"`
+	CheckOK    int    `json:"check_success"`
+	CheckFail  int    `json:"check_fail"`
+	Ready      bool   `json:"ready"`
+	// where the last readiness update came from, and the time in
+	// milliseconds until a not-ready state expires.
+	ReadySource string `json:"ready_source,omitempty"`
+	ReadyTTL    int    `json:"ready_ttl,omitempty"`
+
+	// the connections of a multiplexed service
+	Mux []MuxStat `json:"mux,omitempty"`
+
+	// The effective state, when it changed, and the time in milliseconds
+	// since. CheckPassing is false from the first failed health check, even
+	// before the backend is marked down.
+	State             string     `json:"state"`
+	StateChangedAt    time.Time  `json:"state_changed_at"`
+	StateDuration     int64      `json:"state_duration_ms"`
+	CheckPassing      bool       `json:"check_ok"`
+	CheckFailingSince *time.Time `json:"check_failing_since,omitempty"`
+	// why a backend is down, admin, check_failed or interface_unavailable
+	DownReason string `json:"down_reason,omitempty"`
+	// the administrative state, up unless it was set down through the API
+	AdminState string `json:"admin_state"`
+	// set while a removed or replaced backend's connections drain
+	Removed bool `json:"removed,omitempty"`
+
+	// whether the backend is connected over TLS, and its failed handshakes,
+	// including certificates that couldn't be verified
+	TLS          bool   `json:"tls,omitempty"`
+	TLSErrors    int64  `json:"tls_errors"`
+	LastTLSError string `json:"last_tls_error,omitempty"`
+	// the HTTP status and the error of the last health check
+	LastCheckStatus int    `json:"last_check_status,omitempty"`
+	LastCheckError  string `json:"last_check_error,omitempty"`
+
+	// the weight the backend is balanced by, which is less than its Weight
+	// while it's warming up after coming back up
+	EffectiveWeight float64 `json:"effective_weight"`
+
+	// the connection limit, and the connections and requests queued or
+	// turned away while every backend was at its limit
+	MaxConns      int64 `json:"max_conns,omitempty"`
+	LimitQueued   int64 `json:"limit_queued"`
+	LimitRejected int64 `json:"limit_rejected"`
+
+	// the interface the backend's connections are bound to
+	Interface *InterfaceStat `json:"interface,omitempty"`
+
+	// the time taken to connect to the backend for clients, and by the
+	// recent connections and health checks
+	DialTime     *HistogramStat `json:"dial_time,omitempty"`
+	DialLatency  *LatencyStat   `json:"dial_latency_ms,omitempty"`
+	CheckLatency *LatencyStat   `json:"check_latency_ms,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// VHostStat counts the requests to one of a service's virtual hosts.
+type VHostStat struct {
+	Requests  int64 `json:"requests"`
+	Active    int64 `json:"active"`
+	Status2xx int64 `json:"2xx"`
+	Status3xx int64 `json:"3xx"`
+	Status4xx int64 `json:"4xx"`
+	Status5xx int64 `json:"5xx"`
+	Rcvd      int64 `json:"received"`
+	Sent      int64 `json:"sent"`
+}
+
+// RedirectStat counts the requests matching a redirect.
+type RedirectStat struct {
+	RedirectConfig
+	Count int64 `json:"count"`
+}
+
+// RouteStat counts the requests that matched a route. Fallbacks are those
+// sent to any backend because none of the route's was up.
+type RouteStat struct {
+	RouteConfig
+	Count     int64 `json:"count"`
+	Fallbacks int64 `json:"fallbacks"`
+}
+
+// ErrorConditionStat counts the responses meeting an error page condition,
+// or not.
+type ErrorConditionStat struct {
+	Status int `json:"status"`
+	ErrorPageCondition
+	Substituted int64 `json:"substituted"`
+	Passed      int64 `json:"passed"`
+}
+
+// UDPQueueStat reports the send queue of a UDP backend.
+type UDPQueueStat struct {
+	Queued  int   `json:"queued"`
+	Size    int   `json:"size"`
+	Dropped int64 `json:"dropped"`
+	// milliseconds the writer has spent blocked sending to the backend
+	Stall int64 `json:"stall_ms"`
+}
+
+// MuxStat is the stats of a multiplexed backend connection. Wait is the time in
+// milliseconds requests spent waiting for a free stream and their turn to
+// write, which is where head-of-line blocking shows up.
+type MuxStat struct {
+	Conn     int   `json:"conn"`
+	Streams  int64 `json:"streams"`
+	Queued   int64 `json:"queued"`
+	Requests int64 `json:"requests"`
+	Wait     int64 `json:"wait_ms"`
+	MaxWait  int64 `json:"max_wait_ms"`
+}
+
+// InterfaceStat reports the interface a backend is bound to.
+type InterfaceStat struct {
+	Name  string `json:"name"`
+	IPv4  string `json:"ipv4,omitempty"`
+	IPv6  string `json:"ipv6,omitempty"`
+	Error string `json:"error,omitempty"`
+	// when the addresses were last seen to change
+	Changed time.Time `json:"changed"`
+}
+
+// String lists the interface's addresses.
+func (s *InterfaceStat) String() string {
+	addrs := s.IPv4
+	if s.IPv6 != "" {
+		if addrs != "" {
+			addrs += ", "
+		}
+		addrs += s.IPv6
+	}
+	return addrs
+}
+
+// HistogramStat is a histogram of durations. Each bucket counts the observations up to its
+// bound, including those in the buckets before it.
+type HistogramStat struct {
+	Buckets []HistogramBucket `json:"buckets"`
+	Count   int64             `json:"count"`
+	// the total in seconds
+	Sum float64 `json:"sum"`
+}
+
+// HistogramBucket counts the observations up to LE seconds.
+type HistogramBucket struct {
+	LE    float64 `json:"le"`
+	Count int64   `json:"count"`
+}
+
+// LatencyStat is the latency over the most recent samples, in milliseconds.
+type LatencyStat struct {
+	Avg float64 `json:"avg"`
+	P95 float64 `json:"p95"`
+	Max float64 `json:"max"`
+	// the number of samples in the window
+	Samples int `json:"samples"`
+}
+
+// Health is the consolidated health of a shuttle server. Status is "ok" when
+// it should get traffic, and anything else is served with a 503.
+type Health struct {
+	Status string   `json:"status"`
+	Stage  string   `json:"stage,omitempty"`
+	Failed []string `json:"failed,omitempty"`
+	Active int      `json:"active"`
+
+	StateFailures int    `json:"state_failures,omitempty"`
+	StateError    string `json:"state_error,omitempty"`
+
+	// admin requests refused for missing or invalid credentials
+	AdminUnauthorized int64 `json:"admin_unauthorized,omitempty"`
+
+	// services waiting for healthy backends before listening
+	Listeners map[string]string `json:"listeners,omitempty"`
+
+	// services with no backends at all
+	Empty []string `json:"empty_services,omitempty"`
+
+	// required services without enough backends up
+	Unhealthy []ServiceHealth `json:"unhealthy_services,omitempty"`
+
+	// background tasks running, whether that's over the warning
+	// threshold, and the tasks that have panicked
+	Tasks      int64 `json:"tasks"`
+	TasksHigh  bool  `json:"tasks_high,omitempty"`
+	TaskPanics int64 `json:"task_panics,omitempty"`
+}
+
+// ServiceHealth is the backend availability of a service, and the names of
+// its backends that are down.
+type ServiceHealth struct {
+	Name     string   `json:"name"`
+	Up       int      `json:"up"`
+	Backends int      `json:"backends"`
+	Down     []string `json:"down"`
+}
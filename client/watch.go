@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ConfigHashHeader is the header the server reports the hash of its config
+// in, with the config and the stats.
+const ConfigHashHeader = "X-Shuttle-Config-Hash"
+
+// How long each of WatchConfig's requests waits for a change, and the
+// backoff between failed requests.
+var (
+	watchConfigWait       = 30 * time.Second
+	watchConfigBackoff    = time.Second
+	watchConfigBackoffMax = 30 * time.Second
+)
+
+// WatchConfig sends each new config of a running shuttle server on the
+// channel, as it changes. It returns once it has the hash of the current
+// config, so reading it with GetConfig afterwards misses no change. Failed
+// requests are retried with backoff, and the channel is closed when ctx is
+// done.
+func (c *Client) WatchConfig(ctx context.Context) (<-chan *Config, error) {
+	_, hash, err := c.waitConfig(ctx, "", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch shuttle config: %s", err)
+	}
+
+	configs := make(chan *Config)
+	go func() {
+		defer close(configs)
+
+		backoff := watchConfigBackoff
+		for {
+			cfg, newHash, err := c.waitConfig(ctx, hash, watchConfigWait)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return
+				}
+				backoff *= 2
+				if backoff > watchConfigBackoffMax {
+					backoff = watchConfigBackoffMax
+				}
+				continue
+			}
+			backoff = watchConfigBackoff
+
+			if cfg == nil {
+				// the wait timed out
+				continue
+			}
+			hash = newHash
+			select {
+			case configs <- cfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return configs, nil
+}
+
+// Get the config once its hash differs from hash, or at once if hash is
+// empty, along with the new hash. The config is nil if it didn't change
+// within wait.
+func (c *Client) waitConfig(ctx context.Context, hash string, wait time.Duration) (*Config, string, error) {
+	q := url.Values{}
+	if hash != "" {
+		q.Set("wait", "true")
+		q.Set("hash", hash)
+		q.Set("timeout", strconv.Itoa(int(wait/time.Millisecond)))
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/_config?%s", c.addr, q.Encode()), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+
+	// the request may wait the whole time, but keeps the token
+	waiting := &http.Client{Transport: c.httpClient.Transport, Timeout: wait + c.httpClient.Timeout}
+	resp, err := waiting.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, hash, nil
+	default:
+		return nil, "", responseError(resp, "watch config")
+	}
+
+	newHash := resp.Header.Get(ConfigHashHeader)
+	if newHash == "" {
+		return nil, "", fmt.Errorf("no %s from server", ConfigHashHeader)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(body, cfg); err != nil {
+		return nil, "", err
+	}
+	return cfg, newHash, nil
+}
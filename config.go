@@ -3,65 +3,302 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
-func loadConfig() {
-	for _, cfgPath := range []string{stateConfig, defaultConfig} {
-		if cfgPath == "" {
+// Load the state and default configs, migrating them to the current schema.
+// Config files may be JSON, YAML or TOML, by their extension. A state file
+// that can't be parsed is loaded from its backup instead. Missing or invalid
+// configs are skipped, and the first error parsing or migrating a config is
+// returned once both are loaded. Errors applying a config are only logged.
+func loadConfig() error {
+	var loadErr error
+	for _, store := range []StateStore{loadStore(), fileStore(defaultConfig)} {
+		if store == nil || store == fileStore("") {
 			continue
 		}
 
-		cfgData, err := ioutil.ReadFile(cfgPath)
-		if err != nil {
+		cfgData, err := store.Load()
+
+		// a state file that was cut short is replaced by its backup
+		if f, ok := store.(fileStore); ok && errors.Is(err, ErrConfigSyntax) {
+			if backup, bakErr := f.backup().Load(); bakErr == nil {
+				log.Errorf("ERROR: EVENT: state config %s can't be parsed, loading backup %s: %s", f, f.backup(), err)
+				store, cfgData, err = f.backup(), backup, nil
+			}
+		}
+
+		if err != nil && !errors.Is(err, ErrConfigSyntax) {
 			log.Warnln("Error reading config:", err)
 			continue
 		}
 
+		if err == nil {
+			cfgData, err = migrateState(cfgData, stateNewer)
+		}
+		if err != nil {
+			log.Errorf("ERROR: %s: %s", store, err)
+			if loadErr == nil {
+				loadErr = fmt.Errorf("%s: %s", store, err)
+			}
+			continue
+		}
+		warnUnknownFields(store, cfgData)
+
 		var cfg client.Config
 		err = json.Unmarshal(cfgData, &cfg)
 		if err != nil {
 			log.Warnln("Config error:", err)
 			continue
 		}
-		log.Debug("Loaded config from:", cfgPath)
+		log.Debug("Loaded config from:", store)
 
 		if err := Registry.UpdateConfig(cfg); err != nil {
 			log.Printf("Unable to load config: error: %s", err)
 		}
 	}
+	return loadErr
 }
 
-// protects the state config file
+// Policies for when the state config can't be written.
+const (
+	StateWarn     = "warn"
+	StateReadonly = "readonly"
+	StateFallback = "fallback-path"
+)
+
+var (
+	ErrStatePolicy   = fmt.Errorf("state failure policy must be warn, readonly or fallback-path")
+	ErrStateReadonly = fmt.Errorf("state config can't be written, changes are disabled")
+)
+
+// How often a failing state config write is retried.
+var stateRetryInterval = 10 * time.Second
+
+// StateStatus reports whether the state config is being persisted.
+type StateStatus struct {
+	// the state file, or the remote store
+	Path          string     `json:"path"`
+	Policy        string     `json:"policy"`
+	Fallback      string     `json:"fallback,omitempty"`
+	UsingFallback bool       `json:"using_fallback"`
+	Failures      int        `json:"failures"`
+	LastError     string     `json:"last_error,omitempty"`
+	FailingSince  *time.Time `json:"failing_since,omitempty"`
+	LastWrite     *time.Time `json:"last_write,omitempty"`
+	Readonly      bool       `json:"readonly"`
+
+	// whether changes written to the store by others are being applied
+	Watching      bool   `json:"watching"`
+	WatchFailures int    `json:"watch_failures,omitempty"`
+	WatchError    string `json:"watch_error,omitempty"`
+
+	// the queues of the streams writing billing records and other files
+	Persistence map[string]PersistStatus `json:"persistence,omitempty"`
+}
+
+// protects the state config store, and the write status below
 var configMutex sync.Mutex
 
+var (
+	// The remote store for the state config, which replaces the state file
+	// if it's set.
+	remoteState StateStore
+
+	stateFailures     int
+	stateLastErr      error
+	stateFailingSince time.Time
+	stateLastWrite    time.Time
+	stateUsedFallback bool
+	stateRetry        *time.Timer
+
+	stateWatching      bool
+	stateWatchFailures int
+	stateWatchErr      error
+)
+
+// Return the store the state config is saved to, or nil if it isn't saved.
+func stateStore() StateStore {
+	if remoteState != nil {
+		return remoteState
+	}
+	if stateConfig != "" {
+		return fileStore(stateConfig)
+	}
+	return nil
+}
+
+// Return the store to load the state from. With the fallback-path policy, the
+// fallback is used if the remote store can't be read, or if it was written
+// more recently than the state file.
+func loadStore() StateStore {
+	if remoteState == nil {
+		if path := statePath(); path != "" {
+			return fileStore(path)
+		}
+		return nil
+	}
+
+	if statePolicy == StateFallback && stateFallback != "" {
+		if _, err := remoteState.Load(); err != nil {
+			log.Warnf("Loading state from %s: %s", stateFallback, err)
+			return fileStore(stateFallback)
+		}
+	}
+	return remoteState
+}
+
+// Return the file to load the state from. With the fallback-path policy, the
+// fallback is used if it was written more recently than the state config.
+func statePath() string {
+	if statePolicy != StateFallback || stateFallback == "" {
+		return stateConfig
+	}
+
+	fb, err := os.Stat(stateFallback)
+	if err != nil {
+		return stateConfig
+	}
+
+	st, err := os.Stat(stateConfig)
+	if err != nil || fb.ModTime().After(st.ModTime()) {
+		return stateFallback
+	}
+	return stateConfig
+}
+
+func validStatePolicy(policy string) error {
+	switch policy {
+	case StateWarn, StateReadonly, StateFallback:
+		return nil
+	}
+	return ErrStatePolicy
+}
+
 func writeStateConfig() {
 	configMutex.Lock()
 	defer configMutex.Unlock()
 
-	if stateConfig == "" {
+	store := stateStore()
+	if store == nil {
 		log.Debug("No state file. Not saving changes")
 		return
 	}
 
-	cfg := marshal(Registry.Config())
+	current := Registry.Config()
+	current.SchemaVersion = stateSchema()
+	if scheduler != nil {
+		scheduler.baseline(&current)
+	}
+	cfg := marshal(current)
 	if len(cfg) == 0 {
 		return
 	}
 
-	lastCfg, _ := ioutil.ReadFile(stateConfig)
+	lastCfg, _ := store.Load()
 	if bytes.Equal(cfg, lastCfg) {
 		log.Println("No change in config")
+		if stateFailures > 0 {
+			stateWriteOK(false)
+		}
 		return
 	}
 
-	// We should probably write a temp file and mv for atomic update.
-	err := ioutil.WriteFile(stateConfig, cfg, 0644)
-	if err != nil {
-		log.Println("Error saving config state:", err)
+	err := store.Save(cfg)
+	if err == nil {
+		stateWriteOK(false)
+		return
+	}
+
+	log.Println("Error saving config state:", err)
+	stateWriteFailed(err)
+
+	if statePolicy == StateFallback && stateFallback != "" {
+		if err := fileStore(stateFallback).Save(cfg); err != nil {
+			log.Println("Error saving config state to fallback:", err)
+			return
+		}
+		stateWriteOK(true)
+	}
+}
+
+// Record a failed write of the state config, and keep retrying until one
+// succeeds. Must be called with the configMutex held.
+func stateWriteFailed(err error) {
+	if stateFailures == 0 {
+		stateFailingSince = time.Now()
+		log.Errorf("ERROR: EVENT: state config writes failing, policy %s: %s", statePolicy, err)
+	}
+	stateFailures++
+	stateLastErr = err
+
+	if stateRetry == nil {
+		stateRetry = time.AfterFunc(stateRetryInterval, func() {
+			configMutex.Lock()
+			stateRetry = nil
+			configMutex.Unlock()
+			writeStateConfig()
+		})
+	}
+}
+
+// Record a successful write, to the fallback path if fallback is set. Writes
+// to the fallback don't clear the failure, since the state config is still
+// stale. Must be called with the configMutex held.
+func stateWriteOK(fallback bool) {
+	stateLastWrite = time.Now()
+	stateUsedFallback = fallback
+	if fallback || stateFailures == 0 {
+		return
+	}
+
+	log.Printf("EVENT: state config writes recovered after %d failures", stateFailures)
+	stateFailures = 0
+	stateLastErr = nil
+	stateFailingSince = time.Time{}
+	if stateRetry != nil {
+		stateRetry.Stop()
+		stateRetry = nil
+	}
+}
+
+// Return the current state config write status.
+func stateWriteStatus() StateStatus {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	status := StateStatus{
+		Path:          stateConfig,
+		Policy:        statePolicy,
+		Fallback:      stateFallback,
+		UsingFallback: stateUsedFallback,
+		Failures:      stateFailures,
+		Readonly:      statePolicy == StateReadonly && stateFailures > 0,
+		Watching:      stateWatching,
+		WatchFailures: stateWatchFailures,
+		Persistence:   persistence.status(),
+	}
+	if store := stateStore(); store != nil {
+		status.Path = store.String()
+	}
+	if stateWatchErr != nil {
+		status.WatchError = stateWatchErr.Error()
+	}
+	if stateLastErr != nil {
+		status.LastError = stateLastErr.Error()
+		since := stateFailingSince
+		status.FailingSince = &since
+	}
+	if !stateLastWrite.IsZero() {
+		last := stateLastWrite
+		status.LastWrite = &last
 	}
+	return status
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, chosen by the file's extension. A file with any other
+// extension is JSON.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+var ErrConfigSyntax = fmt.Errorf("config can't be parsed")
+
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// Convert a config file to JSON, which configs are migrated and loaded as.
+// YAML and TOML configs use the same field names as JSON.
+func configToJSON(format string, data []byte) ([]byte, error) {
+	var cfg interface{}
+	switch format {
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrConfigSyntax, err)
+		}
+	case FormatTOML:
+		var m map[string]interface{}
+		if _, err := toml.Decode(string(data), &m); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrConfigSyntax, err)
+		}
+		cfg = m
+	default:
+		if _, err := decodeState(data); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrConfigSyntax, err)
+		}
+		return data, nil
+	}
+
+	js, err := json.Marshal(jsonValue(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrConfigSyntax, err)
+	}
+	return js, nil
+}
+
+// Convert a JSON config to the format of a config file.
+func configFromJSON(format string, data []byte) ([]byte, error) {
+	if format != FormatYAML && format != FormatTOML {
+		return data, nil
+	}
+
+	cfg, err := decodeState(data)
+	if err != nil {
+		return nil, err
+	}
+	v := fileValue(cfg)
+
+	if format == FormatYAML {
+		return yaml.Marshal(v)
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Convert a decoded YAML or TOML value to one that can be marshaled as JSON.
+// YAML keys, like the status codes of error_page_conditions, may be numbers.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = jsonValue(elem)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = jsonValue(elem)
+		}
+		return m
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = jsonValue(elem)
+		}
+		return v
+	case []map[string]interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = jsonValue(elem)
+		}
+		return list
+	}
+	return v
+}
+
+// Convert a decoded JSON value to one that can be marshaled as YAML or TOML.
+// Numbers are kept as integers where they can be, and nulls are dropped,
+// since TOML has no null and a missing field decodes the same way.
+func fileValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			if elem == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = fileValue(elem)
+		}
+		return v
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = fileValue(elem)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// Warn about the fields of a JSON config that aren't config fields, which are
+// otherwise ignored, such as a misspelled name.
+func warnUnknownFields(source fmt.Stringer, data []byte) {
+	raw, err := decodeState(data)
+	if err != nil {
+		return
+	}
+	if unknown := unknownFields(raw, reflect.TypeOf(client.Config{}), ""); len(unknown) > 0 {
+		log.Warnf("WARN: %s: ignoring unknown config fields: %s", source, strings.Join(unknown, ", "))
+	}
+}
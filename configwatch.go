@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+// How long a GET /_config?wait=true waits for the config to change, by
+// default and at most, and how often it checks for changes it wasn't told
+// about, like those applied by an overlay.
+var (
+	configWaitTimeout  = 30 * time.Second
+	configWaitMax      = 5 * time.Minute
+	configWaitInterval = time.Second
+)
+
+// configNotifier wakes the requests waiting for the config to change. Each
+// waits on the current channel, which notify closes and replaces.
+type configNotifier struct {
+	sync.Mutex
+	changed chan struct{}
+}
+
+var configChanges = &configNotifier{changed: make(chan struct{})}
+
+func (n *configNotifier) wait() <-chan struct{} {
+	n.Lock()
+	defer n.Unlock()
+	return n.changed
+}
+
+// Wake the waiting requests to compare the config's hash again. It may not
+// have changed.
+func (n *configNotifier) notify() {
+	n.Lock()
+	defer n.Unlock()
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// Answer once the hash of the config differs from the client's, with the new
+// config, or with a 304 once the timeout passes. The hash is always of the
+// whole config, even if the client only asked for some services' tags.
+func waitConfig(w http.ResponseWriter, r *http.Request, filter tagFilter) {
+	timeout := configWaitTimeout
+	if v := r.FormValue("timeout"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+		if timeout > configWaitMax {
+			timeout = configWaitMax
+		}
+	}
+	hash := r.FormValue("hash")
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(configWaitInterval)
+	defer recheck.Stop()
+
+	for {
+		// wait on the channel from before the hash, so no change is missed
+		changed := configChanges.wait()
+		cfg := Registry.Config()
+		current := configHash(cfg)
+		w.Header().Set(client.ConfigHashHeader, current)
+		if current != hash {
+			w.Write(marshal(redactConfig(filterConfig(cfg, filter))))
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-deadline.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
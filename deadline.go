@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// Request headers a trusted client uses to limit the time and the number of
+// backend attempts shuttle spends on its request, and the response headers
+// echoing the limits that were applied.
+const (
+	RequestTimeoutHeader = "X-Request-Timeout-Ms"
+	RetryBudgetHeader    = "X-Retry-Budget"
+
+	DeadlineHeader = "X-Shuttle-Deadline-Ms"
+	AttemptsHeader = "X-Shuttle-Attempts"
+)
+
+var (
+	ErrInvalidTrustedNet = fmt.Errorf("invalid trusted network")
+	ErrInvalidReqTimeout = fmt.Errorf("invalid request timeout")
+)
+
+// Parse the trusted networks of a service. A single address is trusted on
+// its own. Networks are normalized, so IPv4-mapped IPv6 networks match the
+// IPv4 clients they contain.
+func parseTrustedNets(cidrs []string) ([]*net.IPNet, error) {
+	return parseNets(cidrs, ErrInvalidTrustedNet)
+}
+
+// Parse a list of addresses and CIDR ranges, reporting any that's invalid
+// with errInvalid. A single address is a network of its own.
+func parseNets(cidrs []string, errInvalid error) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr := normalizeClientAddr(cidr)
+			if addr.IP == nil || addr.Port != "" {
+				return nil, fmt.Errorf("%s: %q", errInvalid, cidr)
+			}
+			bits := 8 * len(addr.IP)
+			nets = append(nets, &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q", errInvalid, cidr)
+		}
+		nets = append(nets, normalizeNet(ipNet))
+	}
+	return nets, nil
+}
+
+// Parse a positive integer header value, or return 0 if it's missing or
+// invalid.
+func positiveHeader(r *http.Request, name string) int {
+	val := r.Header.Get(name)
+	if val == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		log.Debugf("Ignoring %s: %q", name, val)
+		return 0
+	}
+	return n
+}
+
+// Return the deadline and the number of backend attempts allowed for a
+// request. The service's RequestTimeout applies to every request, and a
+// trusted client may shorten it with X-Request-Timeout-Ms, or limit the
+// backends tried with X-Retry-Budget. The headers are removed from the
+// request either way.
+func (s *Service) requestLimits(r *http.Request) (timeout time.Duration, budget int, trusted bool) {
+	s.Lock()
+	timeout = s.RequestTimeout
+	nets := s.trustedNets
+	s.Unlock()
+
+	callerTimeout := positiveHeader(r, RequestTimeoutHeader)
+	callerBudget := positiveHeader(r, RetryBudgetHeader)
+	r.Header.Del(RequestTimeoutHeader)
+	r.Header.Del(RetryBudgetHeader)
+
+	if !normalizeClientAddr(r.RemoteAddr).In(nets) {
+		return timeout, 0, false
+	}
+
+	if callerTimeout > 0 {
+		d := time.Duration(callerTimeout) * time.Millisecond
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+	return timeout, callerBudget, true
+}
+
+// Close both sides of a TCP connection once it has been open for maxTime,
+// however active it is, unless the returned stop is called first.
+func (s *Service) limitConn(maxTime time.Duration, srvConn, cliConn net.Conn) (stop func()) {
+	if maxTime <= 0 {
+		return func() {}
+	}
+
+	limit := time.AfterFunc(maxTime, func() {
+		log.Printf("Closing connection from %s to %s after %s", cliConn.RemoteAddr(), s.Name, maxTime)
+		atomic.AddInt64(&s.MaxRequestTimeExceeded, 1)
+		srvConn.Close()
+		cliConn.Close()
+	})
+	return func() { limit.Stop() }
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Set or clear the DF bit on datagrams sent from conn, by turning path MTU
+// discovery on or back to the default. With DF set, datagrams larger than the
+// path MTU fail with EMSGSIZE instead of being fragmented.
+func setDontFragment(conn net.PacketConn, df bool) error {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return ErrDontFragment
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	v4, v6 := syscall.IP_PMTUDISC_WANT, syscall.IPV6_PMTUDISC_WANT
+	if df {
+		v4, v6 = syscall.IP_PMTUDISC_DO, syscall.IPV6_PMTUDISC_DO
+	}
+
+	// an IPv6 socket may also be sending IPv4 datagrams
+	ipv6 := false
+	if addr, ok := uc.LocalAddr().(*net.UDPAddr); ok {
+		ipv6 = addr.IP.To4() == nil
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		err4 := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+		if !ipv6 {
+			sockErr = err4
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
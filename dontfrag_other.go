@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// Setting the DF bit is only supported on linux.
+func setDontFragment(conn net.PacketConn, df bool) error {
+	return ErrDontFragment
+}
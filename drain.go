@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidDrainTimeout = fmt.Errorf("invalid drain timeout")
+
+// How often a draining service checks for connections still open.
+var drainPoll = 50 * time.Millisecond
+
+// Service *must* be locked, or not yet started.
+func (s *Service) setDrainTimeout(cfg client.ServiceConfig) {
+	s.DrainTimeout = time.Duration(cfg.DrainTimeout) * time.Millisecond
+	if s.DrainTimeout == 0 {
+		s.DrainTimeout = client.DefaultDrainTimeout * time.Millisecond
+	}
+}
+
+// Stop the service gracefully: close the listener so new connections are
+// refused, wait up to DrainTimeout for the open connections and HTTP requests
+// to finish, then close whatever is left and stop the backends.
+// Returns the number of connections closed at the deadline.
+func (s *Service) drain() int {
+	s.CloseListener()
+
+	s.Lock()
+	timeout := s.DrainTimeout
+	s.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for s.ActiveConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+
+	closed := 0
+	if active := s.ActiveConns(); active > 0 {
+		log.Warnf("Drain timeout for %s with %d active connections", s.Name, active)
+		closed = s.CloseConns()
+	}
+	s.stop()
+	return closed
+}
+
+// Drain stops the backend gracefully once it's out of its service's
+// rotation: it waits up to timeout for the connections and HTTP requests in
+// progress to finish, then closes whatever is left open and stops the
+// backend. Idle HTTP connections are left to the service's transport.
+// Returns the number of connections closed while still in use.
+func (b *Backend) Drain(timeout time.Duration) int {
+	b.setRemoved()
+
+	deadline := time.Now().Add(timeout)
+	for b.busy() && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+
+	closed := 0
+	if b.busy() {
+		log.Warnf("Drain timeout for backend %s/%s with %d connections in use", b.service, b.Name, atomic.LoadInt64(&b.inUse))
+		closed = b.closeConns()
+	}
+	b.Stop()
+	return closed
+}
+
+// Mark the backend removed, so it's reported as draining and never chosen
+// again.
+func (b *Backend) setRemoved() {
+	b.Lock()
+	defer b.Unlock()
+	b.removed = true
+	b.updateState(b.now())
+}
+
+// Report whether the backend has connections or HTTP requests in progress.
+func (b *Backend) busy() bool {
+	return atomic.LoadInt64(&b.inUse) > 0
+}
+
+// Close the open connections to the backend.
+// Returns the number of connections closed.
+func (b *Backend) closeConns() int {
+	b.Lock()
+	defer b.Unlock()
+
+	for c := range b.conns {
+		c.Conn.Close()
+	}
+	return len(b.conns)
+}
+
+// Take a backend out of the service, stopping it once its connections
+// finish or timeout has passed. A backend with nothing in progress is
+// stopped at once, and the rest are reported with the service's backends
+// until they're stopped.
+// Service *must* be locked.
+func (s *Service) retire(b *Backend, timeout time.Duration) {
+	if timeout == 0 || !b.busy() {
+		b.Drain(0)
+		s.closeIdleConns()
+		return
+	}
+
+	// draining from now, not once the goroutine gets to it
+	b.setRemoved()
+	log.Printf("Draining backend %s/%s for up to %s", s.Name, b.Name, timeout)
+	s.drainingBackends = append(s.drainingBackends, b)
+	goTask("backend_drain", s.Name+"/"+b.Name, func() {
+		if closed := b.Drain(timeout); closed > 0 {
+			log.Printf("Backend %s/%s drained, %d connections closed", s.Name, b.Name, closed)
+		}
+
+		s.Lock()
+		defer s.Unlock()
+		for i, d := range s.drainingBackends {
+			if d == b {
+				s.drainingBackends = append(s.drainingBackends[:i], s.drainingBackends[i+1:]...)
+				break
+			}
+		}
+		s.closeIdleConns()
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync/atomic"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidErrorCondition = fmt.Errorf("invalid error page condition")
+
+// An errorCondition is a validated client.ErrorPageCondition, with counts of
+// the responses it substituted an error page for and passed through.
+type errorCondition struct {
+	client.ErrorPageCondition
+	pattern *regexp.Regexp
+
+	// Used atomically
+	Substituted int64
+	Passed      int64
+}
+
+func newErrorConditions(cfgs map[int]client.ErrorPageCondition) (map[int]*errorCondition, error) {
+	conds := make(map[int]*errorCondition)
+	for code, cfg := range cfgs {
+		cond, err := newErrorCondition(cfg)
+		if err == nil && (code < 100 || code > 599) {
+			err = fmt.Errorf("invalid status")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w for %d: %s", ErrInvalidErrorCondition, code, err)
+		}
+		conds[code] = cond
+	}
+	return conds, nil
+}
+
+func newErrorCondition(cfg client.ErrorPageCondition) (*errorCondition, error) {
+	if cfg.Bytes < 0 || cfg.Bytes > client.MaxErrorPeekBytes {
+		return nil, fmt.Errorf("bytes must be from 0 to %d", client.MaxErrorPeekBytes)
+	}
+	if cfg.Pattern != "" && cfg.Body != client.ErrorBodyMatches {
+		return nil, fmt.Errorf("pattern is only for %q", client.ErrorBodyMatches)
+	}
+
+	cond := &errorCondition{ErrorPageCondition: cfg}
+	switch cfg.Body {
+	case client.ErrorBodyEmpty:
+	case client.ErrorBodySmaller:
+		if cfg.Bytes == 0 {
+			return nil, fmt.Errorf("no bytes")
+		}
+	case client.ErrorBodyMatches:
+		if cfg.Pattern == "" {
+			return nil, fmt.Errorf("no pattern")
+		}
+		re, err := regexp.Compile(cfg.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		cond.pattern = re
+	default:
+		return nil, fmt.Errorf("unknown body %q", cfg.Body)
+	}
+	return cond, nil
+}
+
+// The most bytes of a body read to check the condition.
+func (c *errorCondition) peekBytes() int {
+	switch {
+	case c.Body == client.ErrorBodyEmpty:
+		return 1
+	case c.Bytes == 0:
+		return client.DefaultErrorPeekBytes
+	}
+	return c.Bytes
+}
+
+// Check whether a response meets the condition, so its error page should be
+// substituted. Any of the body that's read is put back to be sent to the
+// client if it isn't.
+func (c *errorCondition) check(resp *http.Response) bool {
+	met := c.eval(resp)
+	if met {
+		atomic.AddInt64(&c.Substituted, 1)
+	} else {
+		atomic.AddInt64(&c.Passed, 1)
+	}
+	return met
+}
+
+func (c *errorCondition) eval(resp *http.Response) bool {
+	// the length, if it's known, is enough to decide on the size
+	if resp.ContentLength >= 0 && c.Body != client.ErrorBodyMatches {
+		return resp.ContentLength < int64(c.peekBytes())
+	}
+
+	prefix, eof, err := peekBody(resp, c.peekBytes())
+	if err != nil {
+		return false
+	}
+
+	switch c.Body {
+	case client.ErrorBodyMatches:
+		return c.pattern.Match(prefix)
+	default:
+		return eof && len(prefix) < c.peekBytes()
+	}
+}
+
+func (c *errorCondition) stat(code int) ErrorConditionStat {
+	return ErrorConditionStat{
+		Status:             code,
+		ErrorPageCondition: c.ErrorPageCondition,
+		Substituted:        atomic.LoadInt64(&c.Substituted),
+		Passed:             atomic.LoadInt64(&c.Passed),
+	}
+}
+
+// peekedBody replays the start of a response body before the rest of it.
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Read no more than n bytes from the start of a response's body, and replace
+// the body so they're still sent on. eof is set if that was the whole body.
+func peekBody(resp *http.Response, n int) (prefix []byte, eof bool, err error) {
+	prefix = make([]byte, n)
+	read, err := io.ReadFull(resp.Body, prefix)
+	prefix = prefix[:read]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		eof, err = true, nil
+	}
+
+	resp.Body = &peekedBody{
+		Reader: io.MultiReader(bytes.NewReader(prefix), resp.Body),
+		Closer: resp.Body,
+	}
+	return prefix, eof, err
+}
+
+// Replace the conditions on substituting error pages.
+func (e *ErrorResponse) SetConditions(conds map[int]*errorCondition) {
+	e.Lock()
+	defer e.Unlock()
+	e.conditions = conds
+}
+
+// Check whether the error page for a backend's response should be
+// substituted, which it always is if its status has no condition.
+func (e *ErrorResponse) substitute(resp *http.Response) bool {
+	e.Lock()
+	cond := e.conditions[resp.StatusCode]
+	e.Unlock()
+
+	if cond == nil {
+		return true
+	}
+	return cond.check(resp)
+}
+
+// The stats of each condition, in order of status.
+func (e *ErrorResponse) conditionStats() []ErrorConditionStat {
+	e.Lock()
+	defer e.Unlock()
+
+	var stats []ErrorConditionStat
+	for code, cond := range e.conditions {
+		stats = append(stats, cond.stat(code))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Status < stats[j].Status })
+	return stats
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrTooManySubscribers = fmt.Errorf("too many event subscribers")
+
+// The most event subscribers at once, and the events buffered for each. A
+// subscriber that falls a full buffer behind is evicted, rather than holding
+// up the health checks publishing events.
+var (
+	maxEventSubscribers = 16
+	eventBuffer         = 128
+)
+
+type eventSub struct {
+	// only events for this service, if it's set
+	service string
+	// the read-stats token the subscriber connected with, if any, which
+	// limits it to the events of its services
+	scope  *AdminToken
+	events chan []byte
+	// closed when the subscriber is evicted
+	evicted chan struct{}
+}
+
+func (s *eventSub) matches(e *client.Event) bool {
+	if s.service != "" && e.Service != s.service {
+		return false
+	}
+	if s.scope != nil && !s.scope.allows(e.Service) {
+		return false
+	}
+	return true
+}
+
+// eventBus sends the events of the registry's services and backends to each
+// subscriber on the admin API. Publishing never blocks, so it's safe with a
+// backend or service locked.
+type eventBus struct {
+	sync.Mutex
+	subs map[*eventSub]bool
+	// the number of subscribers, checked before building an event, and the
+	// events sent and subscribers evicted so far. Used atomically.
+	open    int32
+	sent    int64
+	evicted int64
+}
+
+var events = &eventBus{subs: make(map[*eventSub]bool)}
+
+func (b *eventBus) subscribe(service string, scope *AdminToken) (*eventSub, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.subs) >= maxEventSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+
+	s := &eventSub{
+		service: service,
+		scope:   scope,
+		events:  make(chan []byte, eventBuffer),
+		evicted: make(chan struct{}),
+	}
+	b.subs[s] = true
+	atomic.AddInt32(&b.open, 1)
+	return s, nil
+}
+
+func (b *eventBus) unsubscribe(s *eventSub) {
+	b.Lock()
+	defer b.Unlock()
+	b.remove(s)
+}
+
+// eventBus *must* be locked.
+func (b *eventBus) remove(s *eventSub) {
+	if !b.subs[s] {
+		return
+	}
+	delete(b.subs, s)
+	atomic.AddInt32(&b.open, -1)
+}
+
+// Send an event to the subscribers it matches, evicting any that are full.
+func (b *eventBus) publish(e *client.Event) {
+	if atomic.LoadInt32(&b.open) == 0 {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	var js []byte
+	for s := range b.subs {
+		if !s.matches(e) {
+			continue
+		}
+		if js == nil {
+			js = marshalCompact(e)
+		}
+
+		select {
+		case s.events <- js:
+			atomic.AddInt64(&b.sent, 1)
+		default:
+			log.Printf("Evicting event subscriber %d events behind", len(s.events))
+			atomic.AddInt64(&b.evicted, 1)
+			b.remove(s)
+			close(s.evicted)
+		}
+	}
+}
+
+func (b *eventBus) service(typ, name string, tags map[string]string) {
+	b.publish(&client.Event{Type: typ, Time: time.Now(), Service: name, ServiceTags: tags})
+}
+
+// Publish an event for a backend once it belongs to a service, with its
+// state before and after.
+// Backend *must* be locked.
+func (b *Backend) publishEvent(typ, oldState, newState string, at time.Time) {
+	if b.service == "" {
+		return
+	}
+	events.publish(&client.Event{
+		Type:        typ,
+		Time:        at,
+		Service:     b.service,
+		Backend:     b.Name,
+		ServiceTags: b.serviceTags,
+		BackendTags: b.Tags,
+		OldState:    oldState,
+		NewState:    newState,
+		Failures:    b.fallCount,
+	})
+}
+
+// Stream the events of the registry as server-sent events, for every
+// service or the one in the service query, until the client goes away or
+// falls too far behind. A read-stats token only sees the events of its
+// services.
+func getEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := events.subscribe(r.URL.Query().Get("service"), statsScope(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer events.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case js := <-s.events:
+			fmt.Fprintf(w, "data: %s\n\n", js)
+			flusher.Flush()
+		case <-s.evicted:
+			evicted := &client.Event{Type: client.EventEvicted, Time: time.Now()}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", client.EventEvicted, marshalCompact(evicted))
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidForwarded = fmt.Errorf("invalid forwarded headers")
+
+// The headers an earlier proxy uses to describe the client.
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-IP",
+}
+
+func validForwarded(cfg client.ServiceConfig) error {
+	switch cfg.ForwardedHeaders {
+	case "", client.ForwardedTrust, client.ForwardedStrip:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidForwarded, cfg.ForwardedHeaders)
+}
+
+func forwardedMode(cfg client.ServiceConfig) string {
+	if cfg.ForwardedHeaders == "" {
+		return client.DefaultForwardedHeaders
+	}
+	return cfg.ForwardedHeaders
+}
+
+// Remove the forwarding headers a client sent, unless the service trusts
+// them, so neither the service nor its backends act on spoofed ones. A
+// request that arrived over TLS is marked as https either way, since the
+// service only sees the scheme in the header.
+func (s *Service) filterForwarded(r *http.Request) {
+	s.Lock()
+	strip, nets := s.ForwardedHeaders == client.ForwardedStrip, s.trustedNets
+	s.Unlock()
+
+	if strip && !normalizeClientAddr(r.RemoteAddr).In(nets) {
+		for _, h := range forwardingHeaders {
+			r.Header.Del(h)
+		}
+	}
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	}
+}
+
+// Describe the client to the backend. The client's address is added to
+// X-Forwarded-For, and X-Real-IP, X-Forwarded-Proto and X-Forwarded-Host are
+// set unless an earlier proxy already set them.
+func setForwardedHeaders(outreq *http.Request) {
+	addr := normalizeClientAddr(outreq.RemoteAddr)
+	if clientIP := forwardedFor(outreq); clientIP != "" {
+		outreq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	if outreq.Header.Get("X-Real-IP") == "" && addr.IP != nil {
+		outreq.Header.Set("X-Real-IP", addr.Host())
+	}
+	if outreq.Header.Get("X-Forwarded-Proto") == "" {
+		outreq.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if outreq.Header.Get("X-Forwarded-Host") == "" && outreq.Host != "" {
+		outreq.Header.Set("X-Forwarded-Host", outreq.Host)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidHeaders = fmt.Errorf("invalid header rules")
+
+// The substitutions made in the values headers are set to.
+const (
+	headerVarHost       = "$host"
+	headerVarRemoteAddr = "$remote_addr"
+)
+
+// headerRules are a validated client.HeaderConfig, with the header names
+// canonicalized.
+type headerRules struct {
+	requestSet     map[string]string
+	requestRemove  []string
+	responseSet    map[string]string
+	responseRemove []string
+}
+
+// A headerRewriter holds the header rules of a service and of each of its
+// virtual hosts, along with the config they came from.
+type headerRewriter struct {
+	service *headerRules
+	vhosts  map[string]*headerRules
+
+	cfg      *client.HeaderConfig
+	vhostCfg map[string]client.HeaderConfig
+}
+
+func newHeaderRewriter(cfg client.ServiceConfig) (*headerRewriter, error) {
+	h := &headerRewriter{
+		vhosts:   make(map[string]*headerRules),
+		cfg:      cfg.Headers,
+		vhostCfg: cfg.VirtualHostHeaders,
+	}
+
+	if cfg.Headers != nil {
+		rules, err := newHeaderRules(*cfg.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHeaders, err)
+		}
+		h.service = rules
+	}
+
+	for name, vhostCfg := range cfg.VirtualHostHeaders {
+		host, err := canonicalVHost(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHeaders, err)
+		}
+		if h.vhosts[host] != nil {
+			return nil, fmt.Errorf("%w: %q is listed twice", ErrInvalidHeaders, host)
+		}
+		rules, err := newHeaderRules(vhostCfg)
+		if err != nil {
+			return nil, fmt.Errorf("%w for %s: %s", ErrInvalidHeaders, host, err)
+		}
+		h.vhosts[host] = rules
+	}
+	return h, nil
+}
+
+func newHeaderRules(cfg client.HeaderConfig) (*headerRules, error) {
+	r := &headerRules{}
+
+	var err error
+	if r.requestSet, err = headerValues(cfg.RequestSet); err != nil {
+		return nil, err
+	}
+	if r.requestRemove, err = headerNames(cfg.RequestRemove); err != nil {
+		return nil, err
+	}
+	if r.responseSet, err = headerValues(cfg.ResponseSet); err != nil {
+		return nil, err
+	}
+	if r.responseRemove, err = headerNames(cfg.ResponseRemove); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func headerValues(values map[string]string) (map[string]string, error) {
+	set := make(map[string]string, len(values))
+	for name, value := range values {
+		key, err := headerName(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := set[key]; ok {
+			return nil, fmt.Errorf("header %q is set twice", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("invalid value for header %q", key)
+		}
+		set[key] = value
+	}
+	return set, nil
+}
+
+func headerNames(names []string) ([]string, error) {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, err := headerName(name)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Canonicalize a header name, refusing the hop-by-hop headers and Host,
+// which the proxy sets itself.
+func headerName(name string) (string, error) {
+	if name == "" || !validHeaderName(name) {
+		return "", fmt.Errorf("invalid header %q", name)
+	}
+	key := http.CanonicalHeaderKey(name)
+	if key == "Host" || containsString(hopHeaders, key) {
+		return "", fmt.Errorf("header %q can't be rewritten", key)
+	}
+	return key, nil
+}
+
+// The rules for a request, the service's followed by those of its virtual
+// host, or nil if there are none.
+func (h *headerRewriter) rules(r *http.Request) []*headerRules {
+	var rules []*headerRules
+	if h.service != nil {
+		rules = append(rules, h.service)
+	}
+	if len(h.vhosts) > 0 {
+		host := matchVHost(requestVHost(requestHost(r)), func(name string) bool { return h.vhosts[name] != nil })
+		if host != "" {
+			rules = append(rules, h.vhosts[host])
+		}
+	}
+	return rules
+}
+
+// Apply the header rules to a request to a backend. It's called from the
+// Director, so the headers are the proxy's copy of the client's.
+func (s *Service) rewriteRequest(req *http.Request) {
+	s.Lock()
+	headers := s.headers
+	s.Unlock()
+
+	for _, rules := range headers.rules(req) {
+		rewriteHeader(req.Header, rules.requestRemove, rules.requestSet, req)
+	}
+}
+
+// Apply the header rules to a proxied response before it's written. This
+// comes before the error pages, whose headers replace any set here.
+func (s *Service) rewriteResponse(pr *ProxyRequest) bool {
+	s.Lock()
+	headers := s.headers
+	s.Unlock()
+
+	for _, rules := range headers.rules(pr.Request) {
+		rewriteHeader(pr.ResponseWriter.Header(), rules.responseRemove, rules.responseSet, pr.Request)
+	}
+	return true
+}
+
+// Remove headers, then set the others, with the request's values
+// substituted.
+func rewriteHeader(header http.Header, remove []string, set map[string]string, r *http.Request) {
+	for _, key := range remove {
+		header.Del(key)
+	}
+	if len(set) == 0 {
+		return
+	}
+
+	var vars *strings.Replacer
+	for key, value := range set {
+		if strings.Contains(value, "$") {
+			if vars == nil {
+				vars = strings.NewReplacer(
+					headerVarHost, requestHost(r),
+					headerVarRemoteAddr, normalizeClientAddr(r.RemoteAddr).Host(),
+				)
+			}
+			value = vars.Replace(value)
+		}
+		header.Set(key, value)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidHealth = fmt.Errorf("invalid health requirement")
+
+// How long a snapshot of the backend states answers /_health. A load balancer
+// polling it often then doesn't contend with the proxies for the registry's
+// and services' locks.
+var healthSnapshotTTL = time.Second
+
+type healthSnapshot struct {
+	taken     time.Time
+	unhealthy []client.ServiceHealth
+}
+
+func validHealth(cfg client.Config) error {
+	if cfg.HealthMinUpPercent < 0 || cfg.HealthMinUpPercent > 100 {
+		return fmt.Errorf("%w: health_min_up_percent %d", ErrInvalidHealth, cfg.HealthMinUpPercent)
+	}
+	for _, name := range cfg.HealthServices {
+		if err := validName(name); err != nil {
+			return fmt.Errorf("%w: health_services: %s", ErrInvalidHealth, err)
+		}
+	}
+	return nil
+}
+
+// Return the required services that don't have enough backends up, from a
+// snapshot at most healthSnapshotTTL old.
+func (s *ServiceRegistry) UnhealthyServices() []client.ServiceHealth {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+
+	if s.health == nil || time.Since(s.health.taken) >= healthSnapshotTTL {
+		s.health = &healthSnapshot{
+			taken:     time.Now(),
+			unhealthy: s.unhealthyServices(),
+		}
+	}
+	return s.health.unhealthy
+}
+
+func (s *ServiceRegistry) unhealthyServices() []client.ServiceHealth {
+	s.Lock()
+	critical := append([]string(nil), s.cfg.HealthServices...)
+	minPercent := s.cfg.HealthMinUpPercent
+	svcs := make(map[string]*Service, len(s.svcs))
+	for name, svc := range s.svcs {
+		svcs[name] = svc
+	}
+	s.Unlock()
+
+	// critical services are required even if they're empty or missing, the
+	// rest only if they have backends. A service that only redirects never
+	// needs backends.
+	required := critical
+	if len(required) == 0 {
+		for name, svc := range svcs {
+			if !svc.Empty() {
+				required = append(required, name)
+			}
+		}
+	}
+	sort.Strings(required)
+
+	unhealthy := []client.ServiceHealth{}
+	for _, name := range required {
+		health := client.ServiceHealth{Name: name, Down: []string{}}
+		if svc := svcs[name]; svc != nil {
+			if svc.redirectOnly() {
+				continue
+			}
+			health = svc.backendHealth()
+			health.Name = name
+		}
+
+		need := (health.Backends*minPercent + 99) / 100
+		if need < 1 {
+			need = 1
+		}
+		if health.Up < need {
+			unhealthy = append(unhealthy, health)
+		}
+	}
+	return unhealthy
+}
+
+// Count the service's backends that are up, and list those that are down.
+func (s *Service) backendHealth() client.ServiceHealth {
+	s.Lock()
+	backends := append([]*Backend(nil), s.Backends...)
+	s.Unlock()
+
+	health := client.ServiceHealth{
+		Backends: len(backends),
+		Down:     []string{},
+	}
+	for _, b := range backends {
+		if b.Up() {
+			health.Up++
+		} else {
+			health.Down = append(health.Down, b.Name)
+		}
+	}
+	return health
+}
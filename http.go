@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
@@ -11,11 +12,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
 var (
-	httpRouter *HostRouter
+	httpRouter  *HostRouter
+	httpsRouter *HostRouter
+
+	errQueueClosed = fmt.Errorf("connection queue closed")
+	errNoCerts     = fmt.Errorf("no tls certificates loaded")
 )
 
 // This works along with the ServiceRegistry, and the individual Services to
@@ -32,13 +38,30 @@ type HostRouter struct {
 	// HTTP/HTTPS
 	Scheme string
 
+	// Directory to load certificates from for HTTPS, if the server doesn't
+	// already have a TLSConfig.
+	CertDir string
+
 	// track our listener so we can kill the server
 	listener net.Listener
+
+	// connections are passed from the listener to the current server through
+	// queue. Servers replaced by SetMaxHeaderBytes are kept in retired until
+	// their connections are closed.
+	queue   *connQueue
+	retired []*http.Server
+
+	// closed when the listener is ready, and when the server has exited
+	ready    chan struct{}
+	done     chan struct{}
+	stopping bool
 }
 
 func NewHostRouter(httpServer *http.Server) *HostRouter {
 	r := &HostRouter{
 		Scheme: "http",
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
 	}
 	httpServer.Handler = r
 	r.server = httpServer
@@ -46,14 +69,8 @@ func NewHostRouter(httpServer *http.Server) *HostRouter {
 }
 
 func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	reqId := req.Header.Get("X-Request-Id")
-	if reqId == "" {
-		reqId = genId()
-	} else {
-		reqId = genId() + "." + reqId
-	}
-	req.Header.Set("X-Request-Id", reqId)
-	w.Header().Add("X-Request-Id", reqId)
+	// measure the headers as they were sent, before we add to them
+	size := headerBytes(req)
 
 	var err error
 	host := req.Host
@@ -61,13 +78,36 @@ func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if strings.Contains(host, ":") {
 		host, _, err = net.SplitHostPort(req.Host)
 		if err != nil {
-			log.Warnf("%s", err)
+			log.With(log.Fields{"vhost": req.Host, "err": err}).Warnf("%s", err)
 		}
 	}
+	host = requestVHost(host)
+
+	// a host that just failed to match is answered without a lookup, until
+	// the vhosts change
+	gen := Registry.VHostGeneration()
+	if unknownVHosts.cached(host, gen) {
+		serveUnknownHost(w)
+		return
+	}
 
 	svc := Registry.GetVHostService(host)
+	if svc == nil {
+		unknownVHosts.miss(host, gen)
+	}
+	req = assignRequestID(svc, w, req)
 
 	if svc != nil && svc.httpProxy != nil {
+		if limit := svc.headerLimit(); size > limit {
+			log.With(log.Fields{"service": svc.Name, "vhost": host, "client": normalizeClientAddr(req.RemoteAddr).String()}).Warnf("WARN: %s: %d bytes of headers from %s exceeds %d", host, size, normalizeClientAddr(req.RemoteAddr), limit)
+			svc.serveError(w, req, http.StatusRequestHeaderFieldsTooLarge, reasonHeaderTooLarge, nil)
+			return
+		}
+
+		if serveProbe(w, req, svc) {
+			return
+		}
+
 		// The vhost has a service registered, give it to the proxy
 		svc.ServeHTTP(w, req)
 		return
@@ -76,25 +116,132 @@ func (r *HostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.noHostHandler(w, req)
 }
 
+// The size of the request line and header block, as the client serialized
+// them.
+func headerBytes(req *http.Request) int {
+	// "GET /path HTTP/1.1\r\n"
+	n := len(req.Method) + len(req.RequestURI) + len(req.Proto) + 4
+	if req.Host != "" {
+		n += len("Host: ") + len(req.Host) + 2
+	}
+	for key, vals := range req.Header {
+		for _, val := range vals {
+			n += len(key) + len(val) + 4
+		}
+	}
+	// the blank line ending the headers
+	return n + 2
+}
+
+// Set the limit for request headers enforced by the http.Server. A running
+// server can't be changed, so once the router has started a new server takes
+// over the listener, and the old one finishes serving the connections it has.
+func (r *HostRouter) SetMaxHeaderBytes(n int) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.maxHeaderBytes() == n {
+		return
+	}
+	if r.queue == nil {
+		r.server.MaxHeaderBytes = n
+		return
+	}
+
+	old, oldQueue := r.server, r.queue
+	r.retired = append(r.retired, old)
+	r.serve(&http.Server{
+		Addr:              old.Addr,
+		Handler:           old.Handler,
+		TLSConfig:         old.TLSConfig,
+		ReadTimeout:       old.ReadTimeout,
+		ReadHeaderTimeout: old.ReadHeaderTimeout,
+		WriteTimeout:      old.WriteTimeout,
+		IdleTimeout:       old.IdleTimeout,
+		MaxHeaderBytes:    n,
+		ErrorLog:          old.ErrorLog,
+	})
+	oldQueue.Close()
+	goTask("router_retire", r.Scheme, func() { r.retire(old) })
+}
+
+// Wait for a retired server to finish with its connections, then drop it.
+func (r *HostRouter) retire(srv *http.Server) {
+	srv.Shutdown(context.Background())
+
+	r.Lock()
+	defer r.Unlock()
+	for i, s := range r.retired {
+		if s == srv {
+			last := len(r.retired) - 1
+			copy(r.retired[i:], r.retired[i+1:])
+			r.retired[last] = nil
+			r.retired = r.retired[:last]
+			return
+		}
+	}
+}
+
+// The limit for request headers enforced by the http.Server.
+func (r *HostRouter) MaxHeaderBytes() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.maxHeaderBytes()
+}
+
+// HostRouter *must* be locked.
+func (r *HostRouter) maxHeaderBytes() int {
+	if r.server.MaxHeaderBytes > 0 {
+		return r.server.MaxHeaderBytes
+	}
+	return http.DefaultMaxHeaderBytes
+}
+
+// The address the router is listening on, or nil if it hasn't started.
+func (r *HostRouter) Addr() net.Addr {
+	r.Lock()
+	defer r.Unlock()
+	if r.listener == nil {
+		return nil
+	}
+	return r.listener.Addr()
+}
+
 func (r *HostRouter) noHostHandler(w http.ResponseWriter, req *http.Request) {
+	answeredLocally(nil, req, http.StatusNotFound, reasonNoHost, nil)
 	w.WriteHeader(http.StatusNotFound)
 	fmt.Fprintln(w, "Not found")
 }
 
 // TODO: collect more stats?
 
-// Start the HTTP Router frontend.
-// Takes a channel to notify when the listener is started
-// to safely synchronize tests.
-func (r *HostRouter) Start(ready chan bool) {
-	//FIXME: poor locking strategy
+// Start the HTTP Router frontend, and serve requests in the background.
+// Returns once the listener is ready. A HostRouter can only be started once.
+func (r *HostRouter) Start(ctx context.Context) error {
+	if r.Scheme == "https" && r.server.TLSConfig == nil {
+		tlsCfg, err := loadCerts(r.CertDir)
+		if err == errNoCerts {
+			// the virtual hosts may have their own
+			log.Warnf("WARN: no certificates in %s", r.CertDir)
+			tlsCfg, err = &tls.Config{NextProtos: []string{"http/1.1"}}, nil
+		}
+		if err != nil {
+			return err
+		}
+		r.server.TLSConfig = tlsCfg
+	}
+	if r.Scheme == "https" && r.server.TLSConfig.GetCertificate == nil {
+		tlsCfg := r.server.TLSConfig.Clone()
+		tlsCfg.GetCertificate = r.getCertificate
+		r.server.TLSConfig = tlsCfg
+	}
+
 	r.Lock()
 	var err error
-	r.listener, err = newTimeoutListener("tcp", r.server.Addr, 300*time.Second)
+	r.listener, err = newTimeoutListener(defaultListenerFactory, "tcp", r.server.Addr, newLiveTimeout(300*time.Second), &listenerStats{})
 	if err != nil {
-		log.Errorf("%s", err)
 		r.Unlock()
-		return
+		return err
 	}
 
 	listener := r.listener
@@ -102,36 +249,177 @@ func (r *HostRouter) Start(ready chan bool) {
 		listener = tls.NewListener(listener, r.server.TLSConfig)
 	}
 
+	r.serve(r.server)
 	r.Unlock()
 
-	log.Printf("%s server listening at %s", strings.ToUpper(r.Scheme), r.server.Addr)
-	if ready != nil {
-		close(ready)
+	log.With(log.Fields{"addr": r.listener.Addr().String()}).Printf("%s server listening at %s", strings.ToUpper(r.Scheme), r.listener.Addr())
+	close(r.ready)
+
+	goTask("router_accept", r.Scheme, func() { r.accept(listener) })
+	return nil
+}
+
+// Start srv serving the connections from a new queue.
+// HostRouter *must* be locked.
+func (r *HostRouter) serve(srv *http.Server) {
+	r.server = srv
+	queue := newConnQueue(r.listener.Addr())
+	r.queue = queue
+	goTask("router_serve", r.Scheme, func() { srv.Serve(queue) })
+}
+
+// Pass each connection from the listener to the current server.
+func (r *HostRouter) accept(listener net.Listener) {
+	defer close(r.done)
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay = 2*delay + 5*time.Millisecond; delay > time.Second {
+					delay = time.Second
+				}
+				log.With(log.Fields{"addr": r.Addr, "err": err}).Warnf("WARN: %s accept error: %s; retrying in %s", r.Scheme, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			r.Lock()
+			defer r.Unlock()
+			r.queue.Close()
+			if !r.stopping {
+				log.With(log.Fields{"addr": r.Addr, "err": err}).Errorf("%s", err)
+			}
+			return
+		}
+		delay = 0
+
+		// the queue may be closed by SetMaxHeaderBytes while we're waiting
+		for {
+			r.Lock()
+			q := r.queue
+			r.Unlock()
+			if q.push(conn) {
+				break
+			}
+		}
 	}
+}
 
-	// This will log a closed connection error every time we Stop
-	// but that's mostly a testing issue.
-	log.Errorf("%s", r.server.Serve(listener))
+// Ready is closed once the listener is ready.
+func (r *HostRouter) Ready() <-chan struct{} {
+	return r.ready
 }
 
-func (r *HostRouter) Stop() {
-	r.listener.Close()
+// Stop closes the listener and all client connections, and waits for the
+// server to exit.
+func (r *HostRouter) Stop(ctx context.Context) error {
+	r.Lock()
+	r.stopping = true
+	started := r.listener != nil
+	r.Unlock()
+
+	if !started {
+		return nil
+	}
+
+	r.CloseListener()
+	r.CloseConns()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop accepting new connections, and close idle keepalive connections once
+// their current request is done.
+func (r *HostRouter) CloseListener() {
+	r.Lock()
+	defer r.Unlock()
+
+	r.server.SetKeepAlivesEnabled(false)
+	for _, srv := range r.retired {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	if r.listener != nil {
+		r.listener.Close()
+	}
+}
+
+// Close all open client connections.
+// Returns the number of connections closed.
+func (r *HostRouter) CloseConns() int {
+	r.Lock()
+	defer r.Unlock()
+
+	if l, ok := r.listener.(*timeoutListener); ok {
+		return l.CloseConns()
+	}
+	return 0
+}
+
+// connQueue is a net.Listener for connections accepted from another
+// listener, so that the connections can be handed to a new http.Server
+// without closing the real listener.
+type connQueue struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnQueue(addr net.Addr) *connQueue {
+	return &connQueue{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Hand a connection to the server accepting from the queue. Returns false if
+// the queue was closed first.
+func (q *connQueue) push(conn net.Conn) bool {
+	select {
+	case q.conns <- conn:
+		return true
+	case <-q.closed:
+		return false
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.closed:
+		return nil, errQueueClosed
+	}
 }
 
-func startHTTPServer(wg *sync.WaitGroup) {
-	defer wg.Done()
+func (q *connQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.closed) })
+	return nil
+}
 
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
+
+// Create the HostRouter for the http address.
+func newHTTPRouter(addr string) *HostRouter {
 	//TODO: configure these timeouts somewhere
 	httpServer := &http.Server{
-		Addr:           httpAddr,
+		Addr:           addr,
 		ReadTimeout:    10 * time.Minute,
 		WriteTimeout:   10 * time.Minute,
-		MaxHeaderBytes: 1 << 20,
+		MaxHeaderBytes: client.DefaultMaxHeaderBytes,
 	}
 
-	httpRouter = NewHostRouter(httpServer)
-
-	httpRouter.Start(nil)
+	return NewHostRouter(httpServer)
 }
 
 // find certs in and is the named directory, and match them up by their base
@@ -180,7 +468,7 @@ func loadCerts(certDir string) (*tls.Config, error) {
 
 		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
 		if err != nil {
-			log.Error(err)
+			log.With(log.Fields{"err": err}).Error(err)
 			continue
 		}
 		tlsCfg.Certificates = append(tlsCfg.Certificates, cert)
@@ -188,7 +476,7 @@ func loadCerts(certDir string) (*tls.Config, error) {
 	}
 
 	if len(tlsCfg.Certificates) == 0 {
-		return nil, fmt.Errorf("no tls certificates loaded")
+		return nil, errNoCerts
 	}
 
 	tlsCfg.BuildNameToCertificate()
@@ -196,28 +484,21 @@ func loadCerts(certDir string) (*tls.Config, error) {
 	return tlsCfg, nil
 }
 
-func startHTTPSServer(wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	tlsCfg, err := loadCerts(certDir)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-
+// Create the HostRouter for the https address. The certificates are loaded
+// from certDir when it's started.
+func newHTTPSRouter(addr, certDir string) *HostRouter {
 	//TODO: configure these timeouts somewhere
 	httpsServer := &http.Server{
-		Addr:           httpsAddr,
+		Addr:           addr,
 		ReadTimeout:    10 * time.Minute,
 		WriteTimeout:   10 * time.Minute,
-		MaxHeaderBytes: 1 << 20,
-		TLSConfig:      tlsCfg,
+		MaxHeaderBytes: client.DefaultMaxHeaderBytes,
 	}
 
-	httpRouter = NewHostRouter(httpsServer)
-	httpRouter.Scheme = "https"
-
-	httpRouter.Start(nil)
+	r := NewHostRouter(httpsServer)
+	r.Scheme = "https"
+	r.CertDir = certDir
+	return r
 }
 
 type ErrorPage struct {
@@ -276,6 +557,9 @@ type ErrorResponse struct {
 	// map them by status for responses
 	pages map[int]*ErrorPage
 
+	// conditions on the backend's response for substituting some pages
+	conditions map[int]*errorCondition
+
 	// keep this handy to refresh the pages
 	client *http.Client
 }
@@ -328,7 +612,7 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 	log.Debugf("Fetching error page from %s", page.Location)
 	resp, err := e.client.Get(page.Location)
 	if err != nil {
-		log.Warnf("Could not fetch %s: %s", page.Location, err.Error())
+		log.With(log.Fields{"url": page.Location, "err": err}).Warnf("Could not fetch %s: %s", page.Location, err.Error())
 		return
 	}
 	defer resp.Body.Close()
@@ -342,7 +626,7 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Warnf("Server returned %d when fetching %s", resp.StatusCode, page.Location)
+		log.With(log.Fields{"url": page.Location}).Warnf("Server returned %d when fetching %s", resp.StatusCode, page.Location)
 		return
 	}
 
@@ -356,7 +640,7 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Warnf("Error reading response from %s: %s", page.Location, err.Error())
+		log.With(log.Fields{"url": page.Location, "err": err}).Warnf("Error reading response from %s: %s", page.Location, err.Error())
 		return
 	}
 
@@ -365,7 +649,7 @@ func (e *ErrorResponse) fetch(page *ErrorPage) {
 		page.SetBody(body)
 		return
 	}
-	log.Warnf("Empty response from %s", page.Location)
+	log.With(log.Fields{"url": page.Location}).Warnf("Empty response from %s", page.Location)
 }
 
 // This replaces all existing ErrorPages
@@ -384,57 +668,149 @@ func (e *ErrorResponse) Update(pages map[string][]int) {
 		for _, code := range codes {
 			e.pages[code] = page
 		}
-		go e.fetch(page)
+		goTask("error_page_fetch", page.Location, func() { e.fetch(page) })
 	}
 }
 
 func (e *ErrorResponse) CheckResponse(pr *ProxyRequest) bool {
+	// return the backend's own response, rather than the cached page
+	if pr.Directive != nil && pr.Directive.NoCache {
+		return true
+	}
 
 	errPage := e.Get(pr.Response.StatusCode)
-	if errPage != nil {
-		// load the cached headers
+	if errPage != nil && e.substitute(pr.Response) {
+		// load the cached headers, and drop the length of the backend's body
 		header := pr.ResponseWriter.Header()
+		header.Del("Content-Length")
 		for key, val := range errPage.Header() {
 			header[key] = val
 		}
 
 		pr.ResponseWriter.WriteHeader(pr.Response.StatusCode)
-		pr.ResponseWriter.Write(errPage.Body())
+		n, _ := pr.ResponseWriter.Write(errPage.Body())
+		pr.ResponseBytes = int64(n)
 		return false
 	}
 
 	return true
 }
 
-func logRequest(req *http.Request, statusCode int, backend string, proxyError error, duration time.Duration) {
-	id := req.Header.Get("X-Request-Id")
-	method := req.Method
-	url := req.Host + req.RequestURI
-	agent := req.UserAgent()
+// Write the access log entry for a request to the access log, or to the main
+// log if there isn't one, and stream it to any open log streams.
+func logRequest(e *AccessEntry, accessLog *accessLog) {
+	url := e.Host + e.URI
+	if accessLog != nil {
+		accessLog.write(e)
+	} else {
+		logAccessLine(e, url)
+	}
 
-	clientIP := req.Header.Get("X-Forwarded-For")
-	if clientIP == "" {
-		clientIP = req.RemoteAddr
+	if !logTap.active() {
+		return
 	}
+	logTap.access(&client.LogEntry{
+		Type:        client.LogAccess,
+		Time:        e.Time,
+		Level:       client.LevelInfo,
+		ID:          e.ID,
+		Service:     e.Service,
+		BackendAddr: e.Backend,
+		Method:      e.Method,
+		URL:         url,
+		ClientIP:    e.clientAddrs(),
+		Status:      e.Status,
+		Duration:    float64(e.Duration) / float64(time.Millisecond),
+		Origin:      e.Origin,
+		Reason:      e.Reason,
+		Tags:        e.Tags,
+		Attempted:   e.Attempted,
+		Error:       e.Error,
+		Directive:   e.Directive,
+	})
+}
 
-	errStr := fmt.Sprintf("%v", proxyError)
-	fmtStr := "id=%s method=%s client-ip=%s url=%s backend=%s status=%d duration=%s agent=%s, err=%s"
-	log.Printf(fmtStr, id, method, clientIP, url, backend, statusCode, duration, agent, errStr)
+// The client's address for the main log, which is the list of addresses it
+// was forwarded for, if it was.
+func (e *AccessEntry) clientAddrs() string {
+	if e.ForwardedFor != "" {
+		return e.ForwardedFor
+	}
+	return e.ClientIP
 }
 
-func logProxyRequest(pr *ProxyRequest) bool {
-	// TODO: we may to be able to switch this off
-	if pr == nil || pr.Request == nil {
-		return true
+// Write the access log entry to the main log. Only the backends tried, the
+// directive and the tags that were set are included.
+func logAccessLine(e *AccessEntry, url string) {
+	if log.DefaultLogger.Format() == log.FormatJSON {
+		log.With(e.logFields(url)).Print("request")
+		return
 	}
 
-	duration := pr.FinishTime.Sub(pr.StartTime)
+	errStr := e.Error
+	if errStr == "" {
+		errStr = "<nil>"
+	}
+	fmtStr := "id=%s method=%s client-ip=%s url=%s backend=%s status=%d duration=%s agent=%s, err=%s origin=%s"
+	args := []interface{}{e.ID, e.Method, e.clientAddrs(), url, e.Backend, e.Status, e.Duration, e.UserAgent, errStr, e.Origin}
+	if e.Reason != "" {
+		fmtStr += " reason=%s"
+		args = append(args, e.Reason)
+	}
+	// the backends tried are only listed if there was more than one
+	if len(e.Attempted) > 1 {
+		fmtStr += " attempted=%s"
+		args = append(args, strings.Join(e.Attempted, ","))
+	}
+	if e.Directive != "" {
+		fmtStr += " directive=%s"
+		args = append(args, e.Directive)
+	}
+	if e.Tags != "" {
+		fmtStr += " tags=%s"
+		args = append(args, e.Tags)
+	}
+	log.Printf(fmtStr, args...)
+}
+
+// The fields of the access log entry in the main log's JSON format.
+func (e *AccessEntry) logFields(url string) log.Fields {
+	fields := log.Fields{
+		"id":          e.ID,
+		"service":     e.Service,
+		"vhost":       e.Host,
+		"method":      e.Method,
+		"url":         url,
+		"client_ip":   e.clientAddrs(),
+		"addr":        e.Backend,
+		"status":      e.Status,
+		"duration_ms": float64(e.Duration) / float64(time.Millisecond),
+		"agent":       e.UserAgent,
+		"err":         e.Error,
+		"origin":      e.Origin,
+		"reason":      e.Reason,
+		"directive":   e.Directive,
+		"tags":        e.Tags,
+	}
+	if len(e.Attempted) > 1 {
+		fields["attempted"] = e.Attempted
+	}
+	return fields
+}
 
-	var backend string
-	if pr.Response != nil && pr.Response.Request != nil && pr.Response.Request.URL != nil {
-		backend = pr.Response.Request.URL.Host
+// Log a request the service proxied to the service's access log, once its
+// response has been written. A request stopped by an OnRequest callback has
+// no response, and isn't logged.
+func (s *Service) logProxyRequest(pr *ProxyRequest) {
+	if pr.Request == nil || pr.Response == nil {
+		return
 	}
 
-	logRequest(pr.Request, pr.Response.StatusCode, backend, pr.ProxyError, duration)
-	return true
+	logRequest(pr.AccessEntry(), s.accessLogger())
+
+	if d := pr.Directive; d != nil && d.FullLog {
+		id := requestID(pr.Request)
+		log.With(log.Fields{"service": s.Name, "id": id}).Printf("id=%s directive=%s request-headers=%v", id, d.ID, pr.Request.Header)
+		log.With(log.Fields{"service": s.Name, "id": id}).Printf("id=%s directive=%s response-headers=%v", id, d.ID, pr.Response.Header)
+	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidIdleConns = fmt.Errorf("invalid idle connection limits")
+
+func validIdleConns(cfg client.ServiceConfig) error {
+	if cfg.MaxIdleConnsPerHost < 0 || cfg.MaxIdleConns < 0 || cfg.IdleConnTimeout < 0 {
+		return ErrInvalidIdleConns
+	}
+	return nil
+}
+
+// Set the limits on the HTTP proxy's idle connections to the backends. The
+// transport is replaced when they change, and the old one's idle
+// connections closed, including those of requests still in progress once
+// they've had DrainTimeout to finish.
+// Service *must* be locked, or not yet started.
+func (s *Service) setIdleConns(cfg client.ServiceConfig) {
+	perHost, max := cfg.MaxIdleConnsPerHost, cfg.MaxIdleConns
+	if perHost == 0 {
+		perHost = client.DefaultMaxIdleConnsPerHost
+	}
+	timeout := time.Duration(cfg.IdleConnTimeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = client.DefaultIdleConnTimeout * time.Millisecond
+	}
+
+	old := s.proxyTransport
+	if old != nil && old.MaxIdleConnsPerHost == perHost && old.MaxIdleConns == max && old.IdleConnTimeout == timeout {
+		return
+	}
+
+	s.proxyTransport = &http.Transport{
+		DialContext:         s.DialContext,
+		DialTLSContext:      s.DialContext,
+		MaxIdleConnsPerHost: perHost,
+		MaxIdleConns:        max,
+		IdleConnTimeout:     timeout,
+	}
+	if old != nil {
+		log.Debugf("Replacing the HTTP transport for %s", s.Name)
+		old.CloseIdleConnections()
+		time.AfterFunc(s.DrainTimeout, old.CloseIdleConnections)
+	}
+}
+
+// Drop the idle HTTP connections to the backends, so none are left open to
+// a backend that's gone. Connections in use are left alone.
+// Service *must* be locked.
+func (s *Service) closeIdleConns() {
+	s.proxyTransport.CloseIdleConnections()
+}
+
+// Close the HTTP transport's idle connections to the backend, so none are
+// reused once it's down. The transport drops each from its pool when it sees
+// it's closed.
+// Backend *must* be locked.
+func (b *Backend) closeIdleConns() int {
+	closed := 0
+	for c := range b.conns {
+		if c.isIdle() {
+			c.Conn.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+// Trace which of the transport's connections are idle in its pool, for the
+// backends' stats.
+func traceIdleConns(req *http.Request) *http.Request {
+	var conn *shuttleConn
+	var use int64
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, _ = info.Conn.(*shuttleConn)
+			if conn != nil {
+				use = conn.gotConn()
+			}
+		},
+		PutIdleConn: func(err error) {
+			if err == nil && conn != nil {
+				conn.putIdle(use)
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// The idle state of a transport's connection is the number of times it's been
+// handed out, shifted left a bit, with the low bit set while it's idle. A
+// request only marks the connection idle if no other has had it since, so
+// a connection handed straight to a waiting request stays in use.
+const connClosedState = -2
+
+func (c *shuttleConn) gotConn() int64 {
+	if c.idle == nil {
+		return connClosedState
+	}
+	for {
+		state := atomic.LoadInt64(&c.idleState)
+		if state == connClosedState {
+			return state
+		}
+		use := (state>>1 + 1) << 1
+		if atomic.CompareAndSwapInt64(&c.idleState, state, use) {
+			if state&1 != 0 {
+				atomic.AddInt64(c.idle, -1)
+			}
+			return use
+		}
+	}
+}
+
+func (c *shuttleConn) putIdle(use int64) {
+	if c.idle != nil && use != connClosedState && atomic.CompareAndSwapInt64(&c.idleState, use, use|1) {
+		atomic.AddInt64(c.idle, 1)
+	}
+}
+
+func (c *shuttleConn) isIdle() bool {
+	return c.idle != nil && atomic.LoadInt64(&c.idleState)&1 != 0
+}
+
+// Stop counting a closed connection as idle.
+func (c *shuttleConn) closeIdle() {
+	if c.idle == nil {
+		return
+	}
+	if state := atomic.SwapInt64(&c.idleState, connClosedState); state != connClosedState && state&1 != 0 {
+		atomic.AddInt64(c.idle, -1)
+	}
+}
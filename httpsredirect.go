@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidHTTPSRedirect = fmt.Errorf("invalid https redirect")
+
+// httpsRedirects are the virtual hosts of a service that override its
+// HTTPSRedirect, by canonical name, and the path prefixes never redirected,
+// along with the config they came from.
+type httpsRedirects struct {
+	vhosts map[string]bool
+	exempt []string
+
+	vhostCfg map[string]bool
+}
+
+func newHTTPSRedirects(cfg client.ServiceConfig) (*httpsRedirects, error) {
+	h := &httpsRedirects{
+		vhosts:   make(map[string]bool, len(cfg.VirtualHostHTTPSRedirect)),
+		exempt:   cfg.HTTPSRedirectExempt,
+		vhostCfg: cfg.VirtualHostHTTPSRedirect,
+	}
+
+	for name, redirect := range cfg.VirtualHostHTTPSRedirect {
+		host, err := canonicalVHost(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHTTPSRedirect, err)
+		}
+		if _, ok := h.vhosts[host]; ok {
+			return nil, fmt.Errorf("%w: %q is listed twice", ErrInvalidHTTPSRedirect, host)
+		}
+		h.vhosts[host] = redirect
+	}
+
+	for _, prefix := range cfg.HTTPSRedirectExempt {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("%w: exempt path %q must start with /", ErrInvalidHTTPSRedirect, prefix)
+		}
+	}
+	return h, nil
+}
+
+// Report whether a request should be redirected to https. Its virtual host's
+// setting wins over the service's, and requests already made over https, or
+// to an exempt path, are left alone.
+func (s *Service) redirectHTTPS(r *http.Request) bool {
+	s.Lock()
+	redirect, redirects := s.HTTPSRedirect, s.httpsRedirects
+	s.Unlock()
+
+	if len(redirects.vhosts) > 0 {
+		host := matchVHost(requestVHost(requestHost(r)), func(name string) bool {
+			_, ok := redirects.vhosts[name]
+			return ok
+		})
+		if host != "" {
+			redirect = redirects.vhosts[host]
+		}
+	}
+	if !redirect || r.Header.Get("X-Forwarded-Proto") == "https" {
+		return false
+	}
+
+	for _, prefix := range redirects.exempt {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	return true
+}
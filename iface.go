@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// Why a backend is down
+const (
+	DownAdmin                = "admin"
+	DownCheckFailed          = "check_failed"
+	DownInterfaceUnavailable = "interface_unavailable"
+)
+
+var ErrNoInterfaceAddr = fmt.Errorf("interface has no usable address")
+
+// How often the interfaces backends bind to are checked for changes
+var interfacePollInterval = 5 * time.Second
+
+// An interfaceLister returns the addresses of a network interface.
+type interfaceLister func(name string) ([]net.Addr, error)
+
+// List the addresses of an interface on this host. An interface that's down
+// has no usable addresses.
+func netInterfaceAddrs(name string) ([]net.Addr, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if ifi.Flags&net.FlagUp == 0 {
+		return nil, fmt.Errorf("interface %s is down", name)
+	}
+	return ifi.Addrs()
+}
+
+// ifaceAddrs are the addresses an interface's connections are bound to, one
+// for each family, or the reason it can't be used.
+type ifaceAddrs struct {
+	v4, v6 net.IP
+	err    error
+}
+
+func (a ifaceAddrs) equal(other ifaceAddrs) bool {
+	if (a.err == nil) != (other.err == nil) {
+		return false
+	}
+	if a.err != nil {
+		return a.err.Error() == other.err.Error()
+	}
+	return a.v4.Equal(other.v4) && a.v6.Equal(other.v6)
+}
+
+// Look up the addresses to bind to on an interface. Link-local IPv6 addresses
+// need a zone to be used, so only global ones are chosen.
+func resolveInterface(list interfaceLister, name string) ifaceAddrs {
+	addrs, err := list(name)
+	if err != nil {
+		return ifaceAddrs{err: err}
+	}
+
+	var a ifaceAddrs
+	for _, addr := range addrs {
+		var ip net.IP
+		switch addr := addr.(type) {
+		case *net.IPNet:
+			ip = addr.IP
+		case *net.IPAddr:
+			ip = addr.IP
+		}
+		if ip == nil || ip.IsUnspecified() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			if a.v4 == nil {
+				a.v4 = ip4
+			}
+		} else if a.v6 == nil {
+			a.v6 = ip
+		}
+	}
+
+	if a.v4 == nil && a.v6 == nil {
+		a.err = fmt.Errorf("%s: %w", name, ErrNoInterfaceAddr)
+	}
+	return a
+}
+
+// The address to bind to for connections to addr, of the same family. A
+// hostname uses IPv4 if the interface has it.
+func (a ifaceAddrs) forDest(addr string) (net.IP, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip != nil && ip.To4() == nil:
+		if a.v6 != nil {
+			return a.v6, nil
+		}
+	case a.v4 != nil:
+		return a.v4, nil
+	case ip == nil && a.v6 != nil:
+		return a.v6, nil
+	}
+	return nil, fmt.Errorf("%w for %s", ErrNoInterfaceAddr, addr)
+}
+
+func (a ifaceAddrs) stat(name string, changed time.Time) *InterfaceStat {
+	stat := &InterfaceStat{Name: name, Changed: changed}
+	if a.v4 != nil {
+		stat.IPv4 = a.v4.String()
+	}
+	if a.v6 != nil {
+		stat.IPv6 = a.v6.String()
+	}
+	if a.err != nil {
+		stat.Error = a.err.Error()
+	}
+	return stat
+}
+
+type watchedInterface struct {
+	addrs    ifaceAddrs
+	changed  time.Time
+	backends map[*Backend]bool
+}
+
+// interfaceWatcher polls the interfaces backends are bound to while any are,
+// and tells the backends when an interface's addresses change.
+type interfaceWatcher struct {
+	sync.Mutex
+	list   interfaceLister
+	ifaces map[string]*watchedInterface
+	// closed to stop polling, once nothing is watched
+	stop chan struct{}
+}
+
+// The interfaces of this host, replaced in tests.
+var interfaces = newInterfaceWatcher(netInterfaceAddrs)
+
+func newInterfaceWatcher(list interfaceLister) *interfaceWatcher {
+	return &interfaceWatcher{
+		list:   list,
+		ifaces: make(map[string]*watchedInterface),
+	}
+}
+
+// Watch an interface for a backend, and return its current addresses.
+func (w *interfaceWatcher) watch(name string, b *Backend) (ifaceAddrs, time.Time) {
+	w.Lock()
+	defer w.Unlock()
+
+	iface := w.ifaces[name]
+	if iface == nil {
+		iface = &watchedInterface{
+			addrs:    resolveInterface(w.list, name),
+			changed:  time.Now(),
+			backends: make(map[*Backend]bool),
+		}
+		if iface.addrs.err != nil {
+			log.Warnf("WARN: interface unavailable: %s", iface.addrs.err)
+		}
+		w.ifaces[name] = iface
+	}
+	iface.backends[b] = true
+
+	if w.stop == nil {
+		w.stop = make(chan struct{})
+		stop := w.stop
+		goTask("interface_poll", "", func() { w.poll(stop) })
+	}
+	return iface.addrs, iface.changed
+}
+
+func (w *interfaceWatcher) unwatch(name string, b *Backend) {
+	w.Lock()
+	defer w.Unlock()
+
+	iface := w.ifaces[name]
+	if iface == nil {
+		return
+	}
+	delete(iface.backends, b)
+	if len(iface.backends) == 0 {
+		delete(w.ifaces, name)
+	}
+	if len(w.ifaces) == 0 && w.stop != nil {
+		close(w.stop)
+		w.stop = nil
+	}
+}
+
+func (w *interfaceWatcher) poll(stop chan struct{}) {
+	ticker := time.NewTicker(interfacePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.refresh()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Look up the addresses of the named interfaces, or all of them if none are
+// named, and update the backends of those that changed.
+func (w *interfaceWatcher) refresh(names ...string) {
+	type update struct {
+		name     string
+		addrs    ifaceAddrs
+		changed  time.Time
+		backends []*Backend
+	}
+	var updates []update
+
+	w.Lock()
+	if len(names) == 0 {
+		for name := range w.ifaces {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		iface := w.ifaces[name]
+		if iface == nil {
+			continue
+		}
+		addrs := resolveInterface(w.list, name)
+		if addrs.equal(iface.addrs) {
+			continue
+		}
+
+		if addrs.err != nil {
+			log.Warnf("WARN: interface unavailable: %s", addrs.err)
+		} else {
+			log.Printf("Interface %s addresses changed to %s", name, addrs.stat(name, time.Time{}))
+		}
+		iface.addrs = addrs
+		iface.changed = time.Now()
+
+		u := update{name: name, addrs: addrs, changed: iface.changed}
+		for b := range iface.backends {
+			u.backends = append(u.backends, b)
+		}
+		updates = append(updates, u)
+	}
+	w.Unlock()
+
+	for _, u := range updates {
+		for _, b := range u.backends {
+			b.setInterface(u.name, u.addrs, u.changed)
+		}
+	}
+}
+
+// ifaceBinding is the interface a backend's connections are bound to, and
+// its addresses. It's read without locking the backend, so connections can
+// be dialed from under other locks.
+type ifaceBinding struct {
+	name  string
+	addrs ifaceAddrs
+}
+
+func (b *Backend) binding() ifaceBinding {
+	bind, _ := b.bound.Load().(ifaceBinding)
+	return bind
+}
+
+// The interface the backend binds to, its own or else its service's.
+func (b *Backend) interfaceFor(service string) string {
+	if b.BindInterface != "" {
+		return b.BindInterface
+	}
+	return service
+}
+
+// Bind the backend's connections to an interface, or to none if name is
+// empty.
+// Backend *must* be locked.
+func (b *Backend) setBindInterface(name string) {
+	if name == b.bindInterface {
+		return
+	}
+	if b.bindInterface != "" {
+		interfaces.unwatch(b.bindInterface, b)
+	}
+
+	b.bindInterface = name
+	b.iface = ifaceAddrs{}
+	b.ifaceChanged = time.Time{}
+	if name != "" {
+		b.iface, b.ifaceChanged = interfaces.watch(name, b)
+	}
+	b.bound.Store(ifaceBinding{name: name, addrs: b.iface})
+	b.updateState(b.now())
+}
+
+// Record a change to the addresses of the backend's interface.
+func (b *Backend) setInterface(name string, addrs ifaceAddrs, changed time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	if name != b.bindInterface {
+		return
+	}
+	if addrs.err != nil && b.iface.err == nil {
+		log.Warnf("WARN: backend %s is down: %s", b.Name, DownInterfaceUnavailable)
+	}
+	b.iface = addrs
+	b.ifaceChanged = changed
+	b.bound.Store(ifaceBinding{name: name, addrs: addrs})
+	b.updateState(b.now())
+}
+
+// The local address to bind connections to addr to, or nil if the backend
+// isn't bound to an interface.
+func (b *Backend) bindIP(network, addr string) (net.IP, error) {
+	bind := b.binding()
+	if bind.name == "" || networkFamily(network) == "unix" {
+		return nil, nil
+	}
+	ip, err := bind.addrs.forDest(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", DownInterfaceUnavailable, err)
+	}
+	return ip, nil
+}
+
+// Dial addr on the backend, from its interface if it's bound to one. If the
+// interface's address has just gone, it's looked up again before giving up.
+func (b *Backend) dial(dialer DialerFactory, network, addr string, timeout time.Duration) (net.Conn, error) {
+	c, err := b.dialFrom(dialer, network, 0, addr, timeout)
+	if err != nil && addrNotAvail(err) {
+		if name := b.binding().name; name != "" {
+			interfaces.refresh(name)
+			c, err = b.dialFrom(dialer, network, 0, addr, timeout)
+		}
+	}
+	return c, err
+}
+
+// Dial addr on the backend from a local port, or any port if it's 0.
+func (b *Backend) dialFrom(dialer DialerFactory, network string, port int, addr string, timeout time.Duration) (net.Conn, error) {
+	ip, err := b.bindIP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ip != nil:
+		laddr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		return dialer.DialFrom(network, laddr, addr, timeout)
+	case port != 0:
+		laddr := net.JoinHostPort("", strconv.Itoa(port))
+		return dialer.DialFrom(network, laddr, addr, timeout)
+	}
+	return dialer.Dial(network, addr, timeout)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// The listener states of a service that defers listening until its backends
+// are healthy.
+const (
+	ListenWaiting   = "waiting"
+	ListenListening = "listening"
+	ListenWithdrawn = "withdrawn"
+)
+
+var ErrInvalidDeferListen = fmt.Errorf("invalid deferred listen config")
+
+// How long to wait before binding again, if binding the listener failed.
+var listenRetry = time.Second
+
+func validDeferListen(cfg client.ServiceConfig) error {
+	if cfg.MinAvailable < 0 || cfg.WithdrawGrace < 0 {
+		return fmt.Errorf("%w: negative value", ErrInvalidDeferListen)
+	}
+	return nil
+}
+
+// Service *must* be locked.
+func (s *Service) setDeferListenDefaults() {
+	if !s.DeferListen {
+		return
+	}
+	if s.MinAvailable == 0 {
+		s.MinAvailable = client.DefaultMinAvailable
+	}
+	if s.WithdrawGrace == 0 {
+		s.WithdrawGrace = client.DefaultWithdrawGrace * time.Millisecond
+	}
+}
+
+// Start or stop watching the backends' availability, to bind and withdraw
+// the listener. A service that stops deferring listens right away.
+// Service *must* be locked.
+func (s *Service) setDeferListen() {
+	if s.DeferListen {
+		if s.stopWatch != nil {
+			return
+		}
+		s.listenState = ListenWaiting
+		if s.listening {
+			s.listenState = ListenListening
+		}
+		s.stopWatch = make(chan struct{})
+		stop := s.stopWatch
+		goTask("availability_watch", s.Name, func() { s.watchAvailability(stop) })
+		return
+	}
+
+	if s.stopWatch != nil {
+		close(s.stopWatch)
+		s.stopWatch = nil
+	}
+	s.listenState = ""
+	if !s.listening {
+		if err := s.listen(); err != nil {
+			log.Errorf("ERROR: %s: %s", s.Name, err)
+		}
+	}
+}
+
+// ListenState returns whether a service that defers listening is waiting,
+// listening or withdrawn, or an empty string for any other service.
+func (s *Service) ListenState() string {
+	s.Lock()
+	defer s.Unlock()
+	if !s.DeferListen {
+		return ""
+	}
+	return s.listenState
+}
+
+// Wake the availability watcher, if there is one.
+func (s *Service) notifyAvailable() {
+	select {
+	case s.availableChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Bind or withdraw the listener whenever the backends' availability changes,
+// until stop is closed.
+func (s *Service) watchAvailability(stop chan struct{}) {
+	var below time.Time
+	for {
+		wait := s.checkAvailability(stop, &below)
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		select {
+		case <-stop:
+		case <-s.availableChanged:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// Bind the listener if enough backends are available, or withdraw it once
+// they've been unavailable for the grace period. below is when availability
+// dropped below the minimum. Returns the time until the listener should be
+// checked again, or 0 if it only needs checking when the backends change.
+func (s *Service) checkAvailability(stop chan struct{}, below *time.Time) time.Duration {
+	available := s.Available()
+
+	s.Lock()
+	defer s.Unlock()
+
+	// the watcher was stopped while we counted
+	select {
+	case <-stop:
+		return 0
+	default:
+	}
+
+	if available >= s.MinAvailable {
+		*below = time.Time{}
+		if s.listening {
+			return 0
+		}
+
+		if err := s.listen(); err != nil {
+			log.Errorf("ERROR: %s: %s", s.Name, err)
+			return listenRetry
+		}
+		log.Printf("EVENT: %s is listening on %s, %d backends available tags=%s", s.Name, s.Addr, available, formatTags(s.Tags))
+		s.listenState = ListenListening
+		return 0
+	}
+
+	if !s.listening {
+		return 0
+	}
+
+	now := time.Now()
+	if below.IsZero() {
+		*below = now
+	}
+	if wait := below.Add(s.WithdrawGrace).Sub(now); wait > 0 {
+		return wait
+	}
+
+	log.Printf("EVENT: %s withdrew its listener on %s, %d of %d backends available tags=%s", s.Name, s.Addr, available, s.MinAvailable, formatTags(s.Tags))
+	s.closeListener()
+	s.listenState = ListenWithdrawn
+	return 0
+}
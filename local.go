@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// The origin of an HTTP response in the access log: shuttle answered the
+// request itself, or passed on a backend's response.
+const (
+	originShuttle = "shuttle"
+	originBackend = "backend"
+)
+
+// The reasons shuttle answers a request without passing it to a backend.
+const (
+	reasonHTTPSRedirect  = "https_redirect"
+	reasonMaintenance    = "maintenance"
+	reasonRedirect       = "redirect"
+	reasonHeaderTooLarge = "header_too_large"
+	reasonNoHost         = "no_vhost"
+	reasonNoBackends     = "no_backends"
+	reasonRateLimited    = "rate_limited"
+	reasonClientDenied   = "client_denied"
+	reasonBackendsFull   = "backends_full"
+	// a backend couldn't be reached, or didn't respond in time
+	reasonProxyError = "proxy_error"
+	// a backend couldn't be reached, and the retry policy didn't allow
+	// trying another
+	reasonRetryRefused = "retry_refused"
+)
+
+// Each service counts its locally answered requests by reason. Requests for
+// an unknown vhost have no service, and are only logged.
+var localReasons = []string{
+	reasonHTTPSRedirect,
+	reasonMaintenance,
+	reasonRedirect,
+	reasonHeaderTooLarge,
+	reasonNoBackends,
+	reasonRateLimited,
+	reasonClientDenied,
+	reasonBackendsFull,
+}
+
+// Log the headers of 1 in every localSample locally answered requests, or
+// none if it's 0. Both are used atomically.
+var (
+	localSample int64
+	// the locally answered requests so far, for sampling
+	localAnswers int64
+)
+
+func newLocalCounts() map[string]*int64 {
+	counts := make(map[string]*int64, len(localReasons))
+	for _, reason := range localReasons {
+		counts[reason] = new(int64)
+	}
+	return counts
+}
+
+// Record a request that shuttle answered itself. Every locally answered
+// response goes through here before it's written, so the access log and the
+// service's counters agree. svc is nil if no service matched the request.
+func answeredLocally(svc *Service, r *http.Request, code int, reason string, directive *client.Directive) {
+	var name, tags string
+	if svc != nil {
+		name, tags = svc.Name, svc.tagLabels()
+		if n, ok := svc.localCounts[reason]; ok {
+			atomic.AddInt64(n, 1)
+		}
+		if c := svc.vhostCounters(svc.vhostName(requestVHost(requestHost(r)))); c != nil {
+			c.finish(code)
+		}
+	}
+
+	e := newAccessEntry(r)
+	e.Service, e.Tags = name, tags
+	e.Status, e.Origin, e.Reason = code, originShuttle, reason
+	if directive != nil {
+		e.Directive = directive.ID
+	}
+	accessLog := getGlobalAccessLog()
+	if svc != nil {
+		accessLog = svc.accessLogger()
+	}
+	logRequest(e, accessLog)
+
+	id := requestID(r)
+	if directive != nil && directive.FullLog {
+		log.Printf("id=%s directive=%s request-headers=%v", id, directive.ID, r.Header)
+		return
+	}
+	if n := atomic.LoadInt64(&localSample); n > 0 && atomic.AddInt64(&localAnswers, 1)%n == 0 {
+		log.Printf("id=%s origin=%s reason=%s sampled request-headers=%v", id, originShuttle, reason, r.Header)
+	}
+}
+
+// The number of locally answered requests by reason.
+func (s *Service) localStats() map[string]int64 {
+	stats := make(map[string]int64, len(s.localCounts))
+	for reason, n := range s.localCounts {
+		stats[reason] = atomic.LoadInt64(n)
+	}
+	return stats
+}
@@ -0,0 +1,172 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The time format of the JSON lines.
+const jsonTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var levelNames = map[int]string{
+	ERROR: "error",
+	INFO:  "info",
+	WARN:  "warn",
+	DEBUG: "debug",
+}
+
+// Fields are the structured fields of a log line, like the service or
+// backend it's about. An error is written as its message, and nil or empty
+// fields are left out.
+type Fields map[string]interface{}
+
+// An Entry logs lines with structured fields through the default logger.
+// The fields are part of each line in the JSON format, and left to the
+// message in the text format, so the text lines are the same as they would
+// be without them.
+type Entry struct {
+	fields Fields
+}
+
+func With(fields Fields) Entry {
+	return Entry{fields: fields}
+}
+
+func (e Entry) Debug(v ...interface{}) {
+	if DefaultLogger.Level < DEBUG {
+		return
+	}
+	DefaultLogger.output(DEBUG, fmt.Sprintln(v...), sprintln(v...), e.fields)
+}
+
+func (e Entry) Debugf(format string, v ...interface{}) {
+	if DefaultLogger.Level < DEBUG {
+		return
+	}
+	msg := fmt.Sprintf(format, v...)
+	DefaultLogger.output(DEBUG, msg, msg, e.fields)
+}
+
+func (e Entry) Error(v ...interface{}) {
+	DefaultLogger.output(ERROR, red(v...), fmt.Sprint(v...), e.fields)
+}
+
+func (e Entry) Errorf(format string, v ...interface{}) {
+	DefaultLogger.output(ERROR, redf(format, v...), fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e Entry) Errorln(v ...interface{}) {
+	DefaultLogger.output(ERROR, redln(v...), sprintln(v...), e.fields)
+}
+
+func (e Entry) Warn(v ...interface{}) {
+	DefaultLogger.output(WARN, yellow(v...), fmt.Sprint(v...), e.fields)
+}
+
+func (e Entry) Warnf(format string, v ...interface{}) {
+	DefaultLogger.output(WARN, yellowf(format, v...), fmt.Sprintf(format, v...), e.fields)
+}
+
+func (e Entry) Warnln(v ...interface{}) {
+	DefaultLogger.output(WARN, yellowln(v...), sprintln(v...), e.fields)
+}
+
+func (e Entry) Print(v ...interface{}) {
+	msg := fmt.Sprint(v...)
+	DefaultLogger.output(INFO, msg, msg, e.fields)
+}
+
+func (e Entry) Printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	DefaultLogger.output(INFO, msg, msg, e.fields)
+}
+
+func (e Entry) Println(v ...interface{}) {
+	DefaultLogger.output(INFO, fmt.Sprintln(v...), sprintln(v...), e.fields)
+}
+
+// Write a line in the logger's format: text, which may be colored, or the
+// plain msg with its fields. Errors and warnings are passed to the tap.
+func (l *Logger) output(level int, text, msg string, fields Fields) {
+	if l.Format() == FormatJSON {
+		l.json.Print(jsonLine(levelNames[level], msg, fields))
+	} else {
+		l.Print(text)
+	}
+
+	if level == ERROR || level == WARN {
+		if t := getTap(); t != nil {
+			t(level, msg)
+		}
+	}
+}
+
+func (l *Logger) fatal(text, msg string, fields Fields) {
+	if l.Format() == FormatJSON {
+		l.json.Fatal(jsonLine("fatal", msg, fields))
+	}
+	l.Fatal(text)
+}
+
+// Encode a line of the JSON format. The level is already in the line, so
+// the "ERROR: " or "WARN: " that starts many messages is dropped.
+func jsonLine(level, msg string, fields Fields) string {
+	switch level {
+	case levelNames[ERROR], "fatal":
+		msg = strings.TrimPrefix(msg, "ERROR: ")
+	case levelNames[WARN]:
+		msg = strings.TrimPrefix(msg, "WARN: ")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`{"level":`)
+	writeJSONValue(&buf, level)
+	buf.WriteString(`,"ts":`)
+	writeJSONValue(&buf, time.Now().UTC().Format(jsonTimeFormat))
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(&buf, msg)
+
+	keys := make([]string, 0, len(fields))
+	for key, v := range fields {
+		switch key {
+		case "level", "ts", "msg":
+			continue
+		}
+		if v == nil || v == "" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		buf.WriteByte(',')
+		writeJSONValue(&buf, key)
+		buf.WriteByte(':')
+		v := fields[key]
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		writeJSONValue(&buf, v)
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// Values that can't be encoded are written as strings. HTML isn't escaped,
+// so URLs and messages read as they were logged.
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	n := buf.Len()
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		buf.Truncate(n)
+		enc.Encode(fmt.Sprint(v))
+	}
+	// drop the newline the encoder ends with
+	buf.Truncate(buf.Len() - 1)
+}
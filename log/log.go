@@ -1,9 +1,12 @@
 package log
 
 import (
+	"fmt"
 	"io"
 	golog "log"
 	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/fatih/color"
 )
@@ -15,10 +18,24 @@ const (
 	DEBUG
 )
 
+// The formats of a Logger's lines: the text format is the message as it's
+// given, and the JSON format is an object per line with the message, its
+// level and time, and the structured fields of an Entry.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
 type Logger struct {
 	golog.Logger
 	Level  int
 	Prefix string
+
+	// FormatText or FormatJSON, which can be changed while logging
+	format atomic.Value
+
+	// the lines of the JSON format, which have no prefix or flags
+	json *golog.Logger
 }
 
 var (
@@ -34,45 +51,88 @@ func New(out io.Writer, prefix string, level int) *Logger {
 	l := &Logger{
 		Level:  level,
 		Prefix: prefix,
+		json:   golog.New(out, "", 0),
 	}
+	l.format.Store(FormatText)
 	l.Logger = *(golog.New(out, prefix, golog.LstdFlags))
 	return l
 }
 
 var DefaultLogger = New(os.Stderr, "", INFO)
 
+// SetOutput sets where the logger's lines are written, while other
+// goroutines may be logging.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.Logger.SetOutput(w)
+	l.json.SetOutput(w)
+}
+
+// SetFormat sets the format of the default logger.
+func SetFormat(format string) error {
+	switch format {
+	case FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	DefaultLogger.format.Store(format)
+	return nil
+}
+
+// Format returns the format of the logger's lines.
+func (l *Logger) Format() string {
+	format, _ := l.format.Load().(string)
+	return format
+}
+
+// A Tap receives each error and warning as it's logged, without the color
+// codes. Messages are only formatted for the tap while one is set.
+type Tap func(level int, msg string)
+
+var tap atomic.Value
+
+// SetTap sets the tap for errors and warnings, or removes it if t is nil.
+func SetTap(t Tap) {
+	tap.Store(t)
+}
+
+func getTap() Tap {
+	t, _ := tap.Load().(Tap)
+	return t
+}
+
 func (l *Logger) Debug(v ...interface{}) {
 	if l.Level < DEBUG {
 		return
 	}
-	l.Println(v...)
+	l.output(DEBUG, fmt.Sprintln(v...), sprintln(v...), nil)
 }
 
-func (l *Logger) Debugf(fmt string, v ...interface{}) {
+func (l *Logger) Debugf(format string, v ...interface{}) {
 	if l.Level < DEBUG {
 		return
 	}
-	l.Printf(fmt, v...)
+	msg := fmt.Sprintf(format, v...)
+	l.output(DEBUG, msg, msg, nil)
 }
 
 func (l *Logger) Write(p []byte) (n int, err error) {
 	if l.Level < DEBUG {
 		return
 	}
-	l.Print(string(p))
+	l.output(DEBUG, string(p), strings.TrimSuffix(string(p), "\n"), nil)
 	return len(p), nil
 }
 
-func Debug(v ...interface{})                 { DefaultLogger.Debug(v...) }
-func Debugf(format string, v ...interface{}) { DefaultLogger.Debugf(format, v...) }
+func Debug(v ...interface{})                 { Entry{}.Debug(v...) }
+func Debugf(format string, v ...interface{}) { Entry{}.Debugf(format, v...) }
 func Fatal(v ...interface{}) {
-	DefaultLogger.Fatal(red(v...))
+	DefaultLogger.fatal(red(v...), fmt.Sprint(v...), nil)
 }
 func Fatalf(format string, v ...interface{}) {
-	DefaultLogger.Fatal(redf(format, v...))
+	DefaultLogger.fatal(redf(format, v...), fmt.Sprintf(format, v...), nil)
 }
 func Fatalln(v ...interface{}) {
-	DefaultLogger.Fatal(redln(v...))
+	DefaultLogger.fatal(redln(v...), sprintln(v...), nil)
 }
 func Panic(v ...interface{}) {
 	DefaultLogger.Panic(red(v...))
@@ -84,26 +144,18 @@ func Panicln(v ...interface{}) {
 	DefaultLogger.Panic(redln(v...))
 }
 
-func Error(v ...interface{}) {
-	DefaultLogger.Print(red(v...))
-}
-func Errorf(format string, v ...interface{}) {
-	DefaultLogger.Print(redf(format, v...))
-}
-func Errorln(v ...interface{}) {
-	DefaultLogger.Print(redln(v...))
-}
+func Error(v ...interface{})                 { Entry{}.Error(v...) }
+func Errorf(format string, v ...interface{}) { Entry{}.Errorf(format, v...) }
+func Errorln(v ...interface{})               { Entry{}.Errorln(v...) }
 
-func Warn(v ...interface{}) {
-	DefaultLogger.Print(yellow(v...))
-}
-func Warnf(format string, v ...interface{}) {
-	DefaultLogger.Print(yellowf(format, v...))
-}
-func Warnln(v ...interface{}) {
-	DefaultLogger.Print(yellowln(v...))
-}
+func Warn(v ...interface{})                 { Entry{}.Warn(v...) }
+func Warnf(format string, v ...interface{}) { Entry{}.Warnf(format, v...) }
+func Warnln(v ...interface{})               { Entry{}.Warnln(v...) }
+
+func Print(v ...interface{})                 { Entry{}.Print(v...) }
+func Printf(format string, v ...interface{}) { Entry{}.Printf(format, v...) }
+func Println(v ...interface{})               { Entry{}.Println(v...) }
 
-func Print(v ...interface{})                 { DefaultLogger.Print(v...) }
-func Printf(format string, v ...interface{}) { DefaultLogger.Printf(format, v...) }
-func Println(v ...interface{})               { DefaultLogger.Println(v...) }
+func sprintln(v ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+}
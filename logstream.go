@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var (
+	ErrTooManyStreams   = fmt.Errorf("too many log streams")
+	ErrInvalidLogFilter = fmt.Errorf("invalid log filter")
+)
+
+// The most log streams open at once, and the entries buffered for each. A
+// stream that falls a full buffer behind is evicted, rather than holding up
+// the requests being logged.
+var (
+	maxLogStreams   = 8
+	logStreamBuffer = 256
+)
+
+// The severity of each level, most severe first.
+var logLevels = map[string]int{
+	client.LevelError: 0,
+	client.LevelWarn:  1,
+	client.LevelInfo:  2,
+}
+
+type logFilter struct {
+	service string
+	backend string
+	// the least severe level, and the status class from 1 to 5, or 0 for
+	// any status
+	level  int
+	status int
+}
+
+func parseLogFilter(q url.Values) (logFilter, error) {
+	f := logFilter{
+		service: q.Get("service"),
+		backend: q.Get("backend"),
+		level:   logLevels[client.LevelInfo],
+	}
+
+	if level := q.Get("level"); level != "" {
+		l, ok := logLevels[level]
+		if !ok {
+			return f, fmt.Errorf("%w: level %q", ErrInvalidLogFilter, level)
+		}
+		f.level = l
+	}
+
+	if status := q.Get("status"); status != "" {
+		class, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(status), "xx"))
+		if err != nil || class < 1 || class > 5 {
+			return f, fmt.Errorf("%w: status %q", ErrInvalidLogFilter, status)
+		}
+		f.status = class
+	}
+	return f, nil
+}
+
+// Errors and warnings have no fields to match, so they match a service or
+// backend named in the message.
+func (f logFilter) matches(e *client.LogEntry) bool {
+	if logLevels[e.Level] > f.level {
+		return false
+	}
+
+	if e.Type != client.LogAccess {
+		if f.status != 0 {
+			return false
+		}
+		return strings.Contains(e.Message, f.service) && strings.Contains(e.Message, f.backend)
+	}
+
+	if f.status != 0 && e.Status/100 != f.status {
+		return false
+	}
+	if f.service != "" && e.Service != f.service {
+		return false
+	}
+	if f.backend != "" && e.Backend != f.backend && e.BackendAddr != f.backend {
+		return false
+	}
+	return true
+}
+
+type logStream struct {
+	filter logFilter
+	// the read-stats token the stream was opened with, if any, which limits
+	// it to the access log of its services
+	scope   *AdminToken
+	entries chan []byte
+	// closed when the stream is evicted
+	evicted chan struct{}
+}
+
+func (s *logStream) matches(e *client.LogEntry) bool {
+	if s.scope != nil && (e.Service == "" || !s.scope.allows(e.Service)) {
+		return false
+	}
+	return s.filter.matches(e)
+}
+
+// logStreams taps the access log and the errors and warnings for the streams
+// open on the admin API. Entries are only built while a stream is open, and
+// each is encoded once for every stream it matches.
+type logStreams struct {
+	sync.Mutex
+	streams map[*logStream]bool
+	// the number of open streams, checked before building an entry, and the
+	// entries sent and streams evicted so far. Used atomically.
+	open    int32
+	sent    int64
+	evicted int64
+}
+
+var logTap = &logStreams{streams: make(map[*logStream]bool)}
+
+// Report whether any stream is open, so an entry should be built.
+func (l *logStreams) active() bool {
+	return atomic.LoadInt32(&l.open) > 0
+}
+
+func (l *logStreams) subscribe(filter logFilter, scope *AdminToken) (*logStream, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.streams) >= maxLogStreams {
+		return nil, ErrTooManyStreams
+	}
+
+	s := &logStream{
+		filter:  filter,
+		scope:   scope,
+		entries: make(chan []byte, logStreamBuffer),
+		evicted: make(chan struct{}),
+	}
+	l.streams[s] = true
+	if atomic.AddInt32(&l.open, 1) == 1 {
+		log.SetTap(l.tapLog)
+	}
+	return s, nil
+}
+
+func (l *logStreams) unsubscribe(s *logStream) {
+	l.Lock()
+	defer l.Unlock()
+	l.remove(s)
+}
+
+// logStreams *must* be locked.
+func (l *logStreams) remove(s *logStream) {
+	if !l.streams[s] {
+		return
+	}
+	delete(l.streams, s)
+	if atomic.AddInt32(&l.open, -1) == 0 {
+		log.SetTap(nil)
+	}
+}
+
+// Send an entry to the streams it matches, evicting any that are full. This
+// never logs an error or warning, which would come back through the tap.
+func (l *logStreams) publish(e *client.LogEntry) {
+	l.Lock()
+	defer l.Unlock()
+
+	var js []byte
+	for s := range l.streams {
+		if !s.matches(e) {
+			continue
+		}
+		if js == nil {
+			js = marshalCompact(e)
+		}
+
+		select {
+		case s.entries <- js:
+			atomic.AddInt64(&l.sent, 1)
+		default:
+			log.Printf("Evicting log stream %d entries behind", len(s.entries))
+			atomic.AddInt64(&l.evicted, 1)
+			l.remove(s)
+			close(s.evicted)
+		}
+	}
+}
+
+func marshalCompact(v interface{}) []byte {
+	js, _ := json.Marshal(v)
+	return js
+}
+
+// Stream an error or warning, as set by log.SetTap.
+func (l *logStreams) tapLog(level int, msg string) {
+	e := &client.LogEntry{
+		Type:    client.LogError,
+		Time:    time.Now(),
+		Level:   client.LevelError,
+		Message: msg,
+	}
+	if level == log.WARN {
+		e.Level = client.LevelWarn
+	}
+	l.publish(e)
+}
+
+// Stream an access log entry. The backend's name is looked up from the
+// address the request was sent to.
+func (l *logStreams) access(e *client.LogEntry) {
+	if e.Service != "" && e.BackendAddr != "" {
+		if svc := Registry.GetService(e.Service); svc != nil {
+			e.Backend = svc.backendName(e.BackendAddr)
+		}
+	}
+	l.publish(e)
+}
+
+// The name of the backend at addr, or an empty string.
+func (s *Service) backendName(addr string) string {
+	s.Lock()
+	defer s.Unlock()
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			return b.Name
+		}
+	}
+	return ""
+}
+
+// Stream the access log and errors as server-sent events, until the client
+// goes away or falls too far behind. A read-stats token only sees the access
+// log of its services.
+func getLogStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseLogFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s, err := logTap.subscribe(filter, statsScope(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer logTap.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case js := <-s.entries:
+			fmt.Fprintf(w, "data: %s\n\n", js)
+			flusher.Flush()
+		case <-s.evicted:
+			evicted := &client.LogEntry{Type: client.LogEvicted, Time: time.Now(), Level: client.LevelWarn}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", client.LogEvicted, marshalCompact(evicted))
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds in seconds of the backend dial time buckets
+var dialBuckets = [...]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// A histogram of durations in dialBuckets, updated atomically.
+type histogram struct {
+	// counts per bucket, with the last for those over the largest bound
+	counts [len(dialBuckets) + 1]int64
+	// the total of the durations in nanoseconds
+	sum int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	i := sort.SearchFloat64s(dialBuckets[:], secs)
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *histogram) stat() *HistogramStat {
+	stat := &HistogramStat{
+		Buckets: make([]HistogramBucket, len(dialBuckets)),
+		Sum:     time.Duration(atomic.LoadInt64(&h.sum)).Seconds(),
+	}
+	for i, le := range dialBuckets {
+		stat.Count += atomic.LoadInt64(&h.counts[i])
+		stat.Buckets[i] = HistogramBucket{LE: le, Count: stat.Count}
+	}
+	stat.Count += atomic.LoadInt64(&h.counts[len(dialBuckets)])
+	return stat
+}
+
+// The number of recent durations a latencyWindow keeps
+const latencySamples = 128
+
+// A latencyWindow keeps the most recent durations in a ring, written
+// atomically, so the latency reported follows the backend as it slows down
+// or recovers. A stat taken while samples are written may mix in a few from
+// before the newest, which doesn't matter at this size.
+type latencyWindow struct {
+	samples [latencySamples]int64
+	// the number of durations observed
+	count uint64
+}
+
+func (w *latencyWindow) observe(d time.Duration) {
+	i := atomic.AddUint64(&w.count, 1) - 1
+	atomic.StoreInt64(&w.samples[i%latencySamples], int64(d))
+}
+
+// Return the latency over the window, or nil if nothing was observed.
+func (w *latencyWindow) stat() *LatencyStat {
+	n := atomic.LoadUint64(&w.count)
+	if n == 0 {
+		return nil
+	}
+	if n > latencySamples {
+		n = latencySamples
+	}
+
+	samples := make([]int64, n)
+	var sum int64
+	for i := range samples {
+		samples[i] = atomic.LoadInt64(&w.samples[i])
+		sum += samples[i]
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+
+	ms := func(ns int64) float64 {
+		return float64(ns) / float64(time.Millisecond)
+	}
+	// the nearest rank
+	p95 := (len(samples)*95+99)/100 - 1
+	return &LatencyStat{
+		Avg:     ms(sum / int64(len(samples))),
+		P95:     ms(samples[p95]),
+		Max:     ms(samples[len(samples)-1]),
+		Samples: len(samples),
+	}
+}
+
+// A metric family of the service stats, and the value for each service.
+type serviceMetric struct {
+	name, kind, help string
+	value            func(ServiceStat) int64
+}
+
+// A metric family of the backend stats, and the value for each backend.
+type backendMetric struct {
+	name, kind, help string
+	value            func(BackendStat) int64
+}
+
+var serviceMetrics = []serviceMetric{
+	{"shuttle_service_sent_bytes_total", "counter", "Bytes sent by the service's connections.",
+		func(s ServiceStat) int64 { return s.Sent }},
+	{"shuttle_service_received_bytes_total", "counter", "Bytes received by the service's connections.",
+		func(s ServiceStat) int64 { return s.Rcvd }},
+	{"shuttle_service_errors_total", "counter", "Errors connecting and proxying to the service's backends.",
+		func(s ServiceStat) int64 { return s.Errors }},
+	{"shuttle_service_connections_total", "counter", "Connections made to the service's backends.",
+		func(s ServiceStat) int64 { return s.Conns }},
+	{"shuttle_service_rate_limited_total", "counter", "Connections and HTTP requests refused by the service's rate limits.",
+		func(s ServiceStat) int64 { return s.RateLimited }},
+	{"shuttle_service_active_connections", "gauge", "Connections open to the service's backends.",
+		func(s ServiceStat) int64 { return s.Active }},
+	{"shuttle_service_http_connections_total", "counter", "HTTP requests proxied by the service.",
+		func(s ServiceStat) int64 { return s.HTTPConns }},
+	{"shuttle_service_http_errors_total", "counter", "HTTP requests that got no response from a backend.",
+		func(s ServiceStat) int64 { return s.HTTPErrors }},
+	{"shuttle_service_http_active", "gauge", "HTTP connections open to the service's backends.",
+		func(s ServiceStat) int64 { return s.HTTPActive }},
+}
+
+var backendMetrics = []backendMetric{
+	{"shuttle_backend_sent_bytes_total", "counter", "Bytes sent to the backend.",
+		func(b BackendStat) int64 { return b.Sent }},
+	{"shuttle_backend_received_bytes_total", "counter", "Bytes received from the backend.",
+		func(b BackendStat) int64 { return b.Rcvd }},
+	{"shuttle_backend_errors_total", "counter", "Errors connecting and proxying to the backend.",
+		func(b BackendStat) int64 { return b.Errors }},
+	{"shuttle_backend_connections_total", "counter", "Connections made to the backend.",
+		func(b BackendStat) int64 { return b.Conns }},
+	{"shuttle_backend_active_connections", "gauge", "Connections open to the backend.",
+		func(b BackendStat) int64 { return b.Active }},
+	{"shuttle_backend_http_active", "gauge", "HTTP connections open to the backend.",
+		func(b BackendStat) int64 { return b.HTTPActive }},
+	{"shuttle_backend_up", "gauge", "Whether the backend is taking new connections.",
+		func(b BackendStat) int64 {
+			if b.Up {
+				return 1
+			}
+			return 0
+		}},
+}
+
+// A gauge family of one of a backend's recent latency stats, in seconds.
+type latencyMetric struct {
+	name, help string
+	value      func(BackendStat) *LatencyStat
+	stat       func(*LatencyStat) float64
+}
+
+var latencyMetrics = []latencyMetric{
+	{"shuttle_backend_dial_latency_avg_seconds", "Average time taken by the recent connections to the backend.",
+		func(b BackendStat) *LatencyStat { return b.DialLatency }, func(l *LatencyStat) float64 { return l.Avg }},
+	{"shuttle_backend_dial_latency_p95_seconds", "95th percentile time taken by the recent connections to the backend.",
+		func(b BackendStat) *LatencyStat { return b.DialLatency }, func(l *LatencyStat) float64 { return l.P95 }},
+	{"shuttle_backend_dial_latency_max_seconds", "Longest time taken by the recent connections to the backend.",
+		func(b BackendStat) *LatencyStat { return b.DialLatency }, func(l *LatencyStat) float64 { return l.Max }},
+	{"shuttle_backend_check_latency_avg_seconds", "Average time taken by the recent health checks of the backend.",
+		func(b BackendStat) *LatencyStat { return b.CheckLatency }, func(l *LatencyStat) float64 { return l.Avg }},
+	{"shuttle_backend_check_latency_p95_seconds", "95th percentile time taken by the recent health checks of the backend.",
+		func(b BackendStat) *LatencyStat { return b.CheckLatency }, func(l *LatencyStat) float64 { return l.P95 }},
+	{"shuttle_backend_check_latency_max_seconds", "Longest time taken by the recent health checks of the backend.",
+		func(b BackendStat) *LatencyStat { return b.CheckLatency }, func(l *LatencyStat) float64 { return l.Max }},
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write the service and backend stats in the Prometheus text format, with
+// the services sorted by name.
+func writeMetrics(w io.Writer, stats []ServiceStat) error {
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+
+	bw := bufio.NewWriter(w)
+	family := func(name, kind, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	for _, m := range serviceMetrics {
+		family(m.name, m.kind, m.help)
+		for _, s := range stats {
+			fmt.Fprintf(bw, "%s{%s} %d\n", m.name, serviceLabels(s), m.value(s))
+		}
+	}
+
+	for _, m := range backendMetrics {
+		family(m.name, m.kind, m.help)
+		for _, s := range stats {
+			for _, b := range s.Backends {
+				fmt.Fprintf(bw, "%s{%s} %d\n", m.name, backendLabels(s, b), m.value(b))
+			}
+		}
+	}
+
+	const dial = "shuttle_backend_dial_seconds"
+	family(dial, "histogram", "Time taken to connect to the backend, including failed attempts.")
+	for _, s := range stats {
+		for _, b := range s.Backends {
+			if b.DialTime == nil {
+				continue
+			}
+			labels := backendLabels(s, b)
+			for _, bucket := range b.DialTime.Buckets {
+				le := strconv.FormatFloat(bucket.LE, 'g', -1, 64)
+				fmt.Fprintf(bw, "%s_bucket{%s,le=\"%s\"} %d\n", dial, labels, le, bucket.Count)
+			}
+			fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", dial, labels, b.DialTime.Count)
+			fmt.Fprintf(bw, "%s_sum{%s} %s\n", dial, labels, strconv.FormatFloat(b.DialTime.Sum, 'g', -1, 64))
+			fmt.Fprintf(bw, "%s_count{%s} %d\n", dial, labels, b.DialTime.Count)
+		}
+	}
+
+	for _, m := range latencyMetrics {
+		family(m.name, "gauge", m.help)
+		for _, s := range stats {
+			for _, b := range s.Backends {
+				if l := m.value(b); l != nil {
+					secs := m.stat(l) / 1000
+					fmt.Fprintf(bw, "%s{%s} %s\n", m.name, backendLabels(s, b), strconv.FormatFloat(secs, 'g', -1, 64))
+				}
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Tag keys may contain '-' and '.', which label names can't.
+var tagLabelReplacer = strings.NewReplacer("-", "_", ".", "_")
+
+// Format tags as labels named tag_ and the key, sorted by key. Keys that end
+// up with the same label name after sanitizing keep only the first.
+func tagMetricLabels(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var labels strings.Builder
+	seen := map[string]bool{}
+	for _, k := range keys {
+		name := "tag_" + tagLabelReplacer.Replace(k)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		fmt.Fprintf(&labels, ",%s=\"%s\"", name, labelEscaper.Replace(tags[k]))
+	}
+	return labels.String()
+}
+
+func serviceLabels(s ServiceStat) string {
+	return fmt.Sprintf("service=\"%s\"%s", labelEscaper.Replace(s.Name), tagMetricLabels(s.Tags))
+}
+
+// A backend's labels have the service's tags, overridden by its own.
+func backendLabels(s ServiceStat, b BackendStat) string {
+	tags := make(map[string]string, len(s.Tags)+len(b.Tags))
+	for k, v := range s.Tags {
+		tags[k] = v
+	}
+	for k, v := range b.Tags {
+		tags[k] = v
+	}
+	return fmt.Sprintf("service=\"%s\",backend=\"%s\"%s", labelEscaper.Replace(s.Name), labelEscaper.Replace(b.Name), tagMetricLabels(tags))
+}
+
+// Serve the service and backend stats for Prometheus, limited to the services
+// the request's token may see.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := Registry.Stats()
+	if scope := statsScope(r); scope != nil {
+		allowed := []ServiceStat{}
+		for _, stat := range stats {
+			if scope.allows(stat.Name) {
+				allowed = append(allowed, stat)
+			}
+		}
+		stats = allowed
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, stats)
+}
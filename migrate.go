@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// Policies for a state config with a newer schema than this shuttle knows.
+const (
+	StateNewerRefuse     = "refuse"
+	StateNewerBestEffort = "best-effort"
+)
+
+var (
+	ErrStateNewerPolicy = fmt.Errorf("newer state policy must be refuse or best-effort")
+	ErrStateNewer       = fmt.Errorf("state config schema is newer than this shuttle")
+)
+
+// A stateMigration upgrades a decoded state config by one schema version.
+// Migrations must leave a config that's already upgraded unchanged.
+type stateMigration struct {
+	desc    string
+	migrate func(cfg map[string]interface{}) error
+}
+
+// The migrations from each schema version to the next, starting at version 0
+// for configs written before schema_version was saved. New versions are
+// added to the end, and existing migrations are never changed.
+var stateMigrations = []stateMigration{
+	{"save each backend's network", migrateBackendNetworks},
+}
+
+// The schema version of the state configs this shuttle writes.
+func stateSchema() int {
+	return len(stateMigrations)
+}
+
+func validStateNewer(policy string) error {
+	switch policy {
+	case StateNewerRefuse, StateNewerBestEffort:
+		return nil
+	}
+	return ErrStateNewerPolicy
+}
+
+// Upgrade a state config to the current schema, logging each migration
+// applied. A config from a newer schema is refused, or returned as it is to be
+// loaded as well as it can be with the best-effort policy.
+func migrateState(data []byte, newerPolicy string) ([]byte, error) {
+	cfg, err := decodeState(data)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if v, ok := cfg["schema_version"]; ok {
+		n, _ := v.(json.Number)
+		i, err := n.Int64()
+		if err != nil || i < 0 {
+			return nil, fmt.Errorf("invalid schema_version %v", v)
+		}
+		version = int(i)
+	}
+
+	switch {
+	case version > stateSchema():
+		if newerPolicy != StateNewerBestEffort {
+			return nil, fmt.Errorf("%w: version %d, this shuttle knows up to %d", ErrStateNewer, version, stateSchema())
+		}
+		log.Warnf("WARN: loading state config schema version %d, newer than %d", version, stateSchema())
+		return data, nil
+	case version == stateSchema():
+		return data, nil
+	}
+
+	for v := version; v < stateSchema(); v++ {
+		m := stateMigrations[v]
+		if err := m.migrate(cfg); err != nil {
+			return nil, fmt.Errorf("migrating state config to schema version %d: %s", v+1, err)
+		}
+		log.Printf("Migrated state config to schema version %d: %s", v+1, m.desc)
+	}
+	cfg["schema_version"] = stateSchema()
+	return marshal(cfg), nil
+}
+
+// Decode a state config generically, keeping numbers as they were written.
+func decodeState(data []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var cfg map[string]interface{}
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Return the fields of a decoded config that t has no field for, such as
+// services[0].backends[1].weight.
+func unknownFields(v interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" || f.PkgPath != "" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = f.Type
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			name := key
+			if path != "" {
+				name = path + "." + key
+			}
+			ft, ok := fields[key]
+			if !ok {
+				unknown = append(unknown, name)
+				continue
+			}
+			unknown = append(unknown, unknownFields(obj[key], ft, name)...)
+		}
+	case reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, elem := range list {
+			unknown = append(unknown, unknownFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return unknown
+}
+
+// Version 1: Backend networks weren't saved, and a backend without one now
+// uses its service's network family. Save the network each backend is using,
+// so a later change to the default can't change them.
+func migrateBackendNetworks(cfg map[string]interface{}) error {
+	services, _ := cfg["services"].([]interface{})
+	for _, s := range services {
+		svc, ok := s.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid service %v", s)
+		}
+		svcNet, _ := svc["network"].(string)
+
+		backends, _ := svc["backends"].([]interface{})
+		for _, b := range backends {
+			backend, ok := b.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("invalid backend %v", b)
+			}
+			if network, _ := backend["network"].(string); network == "" {
+				backend["network"] = defaultBackendNetwork(svcNet)
+			}
+		}
+	}
+	return nil
+}
+
+// Run the migrate-state command: upgrade a state config file to the current
+// schema without starting shuttle, and return the exit status.
+func migrateStateCommand(args []string) int {
+	fs := flag.NewFlagSet("migrate-state", flag.ContinueOnError)
+	from := fs.String("from", "", "state config to migrate")
+	to := fs.String("to", "", "file to write the migrated config to")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *from == "" || *to == "" {
+		fmt.Fprintln(os.Stderr, "usage: shuttle migrate-state --from file --to file")
+		return 2
+	}
+
+	if err := migrateStateFile(*from, *to); err != nil {
+		log.Errorf("ERROR: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// Migrate the state config in from, and write it to to. The migrated config
+// must also be one this shuttle can load.
+func migrateStateFile(from, to string) error {
+	data, err := fileStore(from).Load()
+	if err != nil {
+		return err
+	}
+
+	migrated, err := migrateState(data, StateNewerRefuse)
+	if err != nil {
+		return err
+	}
+
+	var cfg client.Config
+	if err := json.Unmarshal(migrated, &cfg); err != nil {
+		return fmt.Errorf("migrated config is invalid: %s", err)
+	}
+	warnUnknownFields(fileStore(from), migrated)
+
+	out, err := configFromJSON(configFormat(to), migrated)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(to, out, 0644)
+}
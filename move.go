@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/litl/shuttle/log"
+)
+
+var ErrMoveListener = fmt.Errorf("cannot move the service's listener")
+
+// Move the service's listener to addr, and to network if it isn't empty,
+// which must be in the same family. The new listener is bound and accepting
+// before the old one is closed, and the old one's open connections are left
+// to finish. If the new address can't be bound the old listener is kept.
+// Service *must* be locked.
+func (s *Service) moveListener(network, addr string) error {
+	if network == "" {
+		network = s.Network
+	}
+	if networkFamily(network) != networkFamily(s.Network) {
+		return fmt.Errorf("%w: can't change from %s to %s", ErrInvalidServiceUpdate, s.Network, network)
+	}
+
+	if !s.listening {
+		// bound on the new address whenever it listens
+		s.Addr, s.Network = addr, network
+		return nil
+	}
+
+	// bind first, and have listen adopt the listener
+	factory := newInheritedListeners(s.ListenerFactory)
+	if networkFamily(network) == "udp" {
+		c, err := s.ListenerFactory.ListenPacket(network, addr)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrMoveListener, &ListenError{Service: s.Name, Addr: addr, Err: err})
+		}
+		factory.packets[addr] = c
+	} else {
+		l, err := s.ListenerFactory.Listen(network, addr)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrMoveListener, &ListenError{Service: s.Name, Addr: addr, Err: err})
+		}
+		factory.streams[addr] = l
+	}
+
+	log.Printf("Moving %s from %s:%s to %s:%s", s.Name, s.Network, s.Addr, network, addr)
+	oldAddr, oldNetwork, owned := s.Addr, s.Network, s.socketOwned
+	oldTCP, oldUDP, oldClosed := s.tcpListener, s.udpListener, s.udpClosed
+
+	next := s.ListenerFactory
+	s.ListenerFactory = factory
+	s.Addr, s.Network = addr, network
+	err := s.listen()
+	s.ListenerFactory = next
+	if err != nil {
+		factory.taken(addr)
+		s.Addr, s.Network, s.socketOwned = oldAddr, oldNetwork, owned
+		return fmt.Errorf("%w: %s", ErrMoveListener, err)
+	}
+
+	switch networkFamily(oldNetwork) {
+	case "udp":
+		close(oldClosed)
+		if err := oldUDP.Close(); err != nil {
+			log.Println(err)
+		}
+		// the sessions reply through the old listener
+		s.udpSessions.closeAll()
+	default:
+		if err := oldTCP.Close(); err != nil {
+			log.Println(err)
+		}
+		if owned && oldNetwork == "unix" {
+			if err := os.Remove(oldAddr); err != nil && !os.IsNotExist(err) {
+				log.Warnf("WARN: removing %s's old socket: %s", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
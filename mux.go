@@ -0,0 +1,450 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var (
+	ErrInvalidMux = fmt.Errorf("invalid mux config")
+	ErrMuxClosed  = fmt.Errorf("mux connection closed")
+	ErrMuxTimeout = fmt.Errorf("mux request timed out")
+)
+
+// Check the mux settings of a service config.
+func validMux(cfg client.ServiceConfig) error {
+	if cfg.MuxConns < 0 || cfg.MuxMaxStreams < 0 || cfg.MuxMaxMessage < 0 {
+		return fmt.Errorf("%w: negative value", ErrInvalidMux)
+	}
+	if cfg.MuxConns > 0 && cfg.Network != "" && networkFamily(cfg.Network) != "tcp" {
+		return fmt.Errorf("%w: mux requires a tcp service", ErrInvalidMux)
+	}
+	return nil
+}
+
+// Fill in the mux defaults, if multiplexing is enabled.
+// Service *must* be locked.
+func (s *Service) setMuxDefaults() {
+	if s.MuxConns == 0 {
+		return
+	}
+	if s.MuxMaxStreams == 0 {
+		s.MuxMaxStreams = client.DefaultMuxMaxStreams
+	}
+	if s.MuxMaxMessage == 0 {
+		s.MuxMaxMessage = client.DefaultMuxMaxMessage
+	}
+}
+
+// Create the mux connections for a backend, or nil if the service isn't
+// multiplexed.
+// Service *must* be locked.
+func (s *Service) newMuxPool(b *Backend) *muxPool {
+	if s.MuxConns == 0 {
+		return nil
+	}
+	p := newMuxPool(b, s.DialerFactory, s.DialTimeout, s.MuxConns, s.MuxMaxStreams, s.MuxMaxMessage)
+	p.owner = s.Name + "/" + b.Name
+	return p
+}
+
+// muxPool holds the mux connections to a single backend. Connections are
+// dialed as they're needed, up to size, and requests go to the connection
+// with the fewest streams in use.
+type muxPool struct {
+	sync.Mutex
+
+	backend     *Backend
+	dialer      DialerFactory
+	dialTimeout time.Duration
+	// the owner of the connections' read loops
+	owner string
+
+	size       int
+	maxStreams int
+	maxMessage int
+
+	conns []*muxConn
+	// numbers the connections for the stats
+	nextConn int
+	retired  bool
+}
+
+func newMuxPool(b *Backend, dialer DialerFactory, dialTimeout time.Duration, size, maxStreams, maxMessage int) *muxPool {
+	return &muxPool{
+		backend:     b,
+		dialer:      dialer,
+		dialTimeout: dialTimeout,
+		size:        size,
+		maxStreams:  maxStreams,
+		maxMessage:  maxMessage,
+	}
+}
+
+// Send a request and wait for the response. Dial failures are returned as a
+// DialError, since the request was never sent and can be retried elsewhere.
+func (p *muxPool) roundTrip(req []byte, timeout time.Duration) ([]byte, error) {
+	c, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	return c.roundTrip(req, timeout)
+}
+
+// Return the least loaded connection, dialing a new one if none are idle and
+// there's room in the pool. The connection is reserved for one request.
+func (p *muxPool) get() (*muxConn, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.retired {
+		return nil, DialError{ErrMuxClosed}
+	}
+
+	var best *muxConn
+	for _, c := range p.conns {
+		if c.isClosed() {
+			continue
+		}
+		if best == nil || c.load() < best.load() {
+			best = c
+		}
+	}
+
+	if len(p.conns) < p.size && (best == nil || best.load() > 0) {
+		c, err := p.dial()
+		if err != nil {
+			if best == nil {
+				return nil, DialError{err}
+			}
+			log.Warnf("WARN: mux connection to %s: %s", p.backend.Name, err)
+		} else {
+			best = c
+		}
+	}
+
+	best.reserve()
+	return best, nil
+}
+
+// Pool *must* be locked.
+func (p *muxPool) dial() (*muxConn, error) {
+	// the interface isn't looked up again on failure with the pool locked,
+	// and is left to the interface watcher
+	start := time.Now()
+	conn, err := p.backend.dialFrom(p.dialer, p.backend.Network, 0, p.backend.Addr, p.dialTimeout)
+	p.backend.observeDial(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := p.backend.startTLS(conn, p.dialTimeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn = tlsConn
+
+	c := &muxConn{
+		pool:    p,
+		id:      p.nextConn,
+		conn:    conn,
+		slots:   make(chan struct{}, p.maxStreams),
+		pending: make(map[uint32]chan []byte),
+		closed:  make(chan struct{}),
+	}
+	p.nextConn++
+	p.conns = append(p.conns, c)
+	atomic.AddInt64(&p.backend.Conns, 1)
+	atomic.AddInt64(&p.backend.Active, 1)
+
+	log.Debugf("Opened mux connection %d to %s", c.id, p.backend.Name)
+	goTask("mux_read", p.owner, c.readLoop)
+	return c, nil
+}
+
+func (p *muxPool) remove(c *muxConn) {
+	p.Lock()
+	defer p.Unlock()
+	for i, pc := range p.conns {
+		if pc == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// Stop using the pool. Each connection is closed once the requests in
+// progress have finished.
+func (p *muxPool) retire() {
+	p.Lock()
+	p.retired = true
+	conns := p.conns
+	p.conns = nil
+	p.Unlock()
+
+	for _, c := range conns {
+		c.retire()
+	}
+}
+
+func (p *muxPool) stats() []MuxStat {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := []MuxStat{}
+	for _, c := range p.conns {
+		stats = append(stats, c.stat())
+	}
+	return stats
+}
+
+// A single multiplexed connection to a backend.
+type muxConn struct {
+	pool *muxPool
+	id   int
+	conn net.Conn
+
+	// a slot is held by each stream in flight
+	slots chan struct{}
+	// serializes the frames written
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	pending    map[uint32]chan []byte
+	nextStream uint32
+	// the requests that have reserved this connection
+	users   int
+	retired bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// stats, accessed atomically
+	streams  int64
+	queued   int64
+	requests int64
+	wait     int64
+	maxWait  int64
+}
+
+// The number of requests using the connection, or waiting to.
+func (c *muxConn) load() int64 {
+	return atomic.LoadInt64(&c.streams) + atomic.LoadInt64(&c.queued)
+}
+
+func (c *muxConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *muxConn) reserve() {
+	c.mu.Lock()
+	c.users++
+	c.mu.Unlock()
+	atomic.AddInt64(&c.queued, 1)
+}
+
+func (c *muxConn) release() {
+	c.mu.Lock()
+	c.users--
+	idle := c.retired && c.users == 0
+	c.mu.Unlock()
+
+	if idle {
+		c.close(nil)
+	}
+}
+
+func (c *muxConn) retire() {
+	c.mu.Lock()
+	c.retired = true
+	idle := c.users == 0
+	c.mu.Unlock()
+
+	if idle {
+		c.close(nil)
+	}
+}
+
+func (c *muxConn) roundTrip(req []byte, timeout time.Duration) ([]byte, error) {
+	defer c.release()
+	start := time.Now()
+
+	// wait for a free stream
+	select {
+	case c.slots <- struct{}{}:
+	case <-c.closed:
+		// never sent, so it can be retried
+		atomic.AddInt64(&c.queued, -1)
+		return nil, DialError{ErrMuxClosed}
+	}
+	defer func() { <-c.slots }()
+
+	respCh := make(chan []byte, 1)
+	c.mu.Lock()
+	id := c.nextStream
+	c.nextStream++
+	c.pending[id] = respCh
+	c.mu.Unlock()
+	defer c.finish(id)
+
+	c.writeMu.Lock()
+	atomic.AddInt64(&c.queued, -1)
+	atomic.AddInt64(&c.streams, 1)
+	defer atomic.AddInt64(&c.streams, -1)
+	c.recordWait(time.Since(start))
+
+	if timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	err := client.WriteMuxFrame(c.conn, id, req)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, err
+	}
+	atomic.AddInt64(&c.requests, 1)
+	atomic.AddInt64(&c.pool.backend.Sent, int64(len(req)))
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case resp := <-respCh:
+		return resp, nil
+	case <-c.closed:
+		return nil, ErrMuxClosed
+	case <-expired:
+		return nil, ErrMuxTimeout
+	}
+}
+
+// Forget a stream, so a late response is dropped.
+func (c *muxConn) finish(id uint32) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+func (c *muxConn) recordWait(d time.Duration) {
+	atomic.AddInt64(&c.wait, int64(d))
+	for {
+		max := atomic.LoadInt64(&c.maxWait)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&c.maxWait, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Deliver the responses to the streams waiting for them.
+func (c *muxConn) readLoop() {
+	for {
+		id, resp, err := client.ReadMuxFrame(c.conn, c.pool.maxMessage)
+		if err != nil {
+			c.close(err)
+			return
+		}
+		atomic.AddInt64(&c.pool.backend.Rcvd, int64(len(resp)))
+
+		c.mu.Lock()
+		respCh := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if respCh == nil {
+			log.Debugf("Dropped mux response for stream %d from %s", id, c.pool.backend.Name)
+			continue
+		}
+		respCh <- resp
+	}
+}
+
+// Close the connection, failing any streams in flight.
+func (c *muxConn) close(err error) {
+	c.closeOnce.Do(func() {
+		if err != nil {
+			log.Debugf("Closing mux connection %d to %s: %s", c.id, c.pool.backend.Name, err)
+		}
+
+		close(c.closed)
+		c.conn.Close()
+		c.pool.remove(c)
+		atomic.AddInt64(&c.pool.backend.Active, -1)
+	})
+}
+
+func (c *muxConn) stat() MuxStat {
+	return MuxStat{
+		Conn:     c.id,
+		Streams:  atomic.LoadInt64(&c.streams),
+		Queued:   atomic.LoadInt64(&c.queued),
+		Requests: atomic.LoadInt64(&c.requests),
+		Wait:     atomic.LoadInt64(&c.wait) / int64(time.Millisecond),
+		MaxWait:  atomic.LoadInt64(&c.maxWait) / int64(time.Millisecond),
+	}
+}
+
+// Proxy a multiplexed client's requests, one at a time. Each request can go
+// to a different backend.
+func (s *Service) serveMux(cliConn net.Conn, maxMessage int) {
+	defer cliConn.Close()
+	cliAddr := normalizeClientAddr(cliConn.RemoteAddr().String())
+
+	for {
+		req, err := client.ReadMessage(cliConn, maxMessage)
+		if err != nil {
+			if err == client.ErrMessageTooLarge {
+				log.Warnf("WARN: %s: request from %s: %s", s.Name, cliAddr, err)
+				atomic.AddInt64(&s.Errors, 1)
+			}
+			return
+		}
+
+		resp, err := s.muxRoundTrip(req, cliAddr.IP)
+		if err != nil {
+			log.Errorf("ERROR: %s: %s", s.Name, err)
+			return
+		}
+
+		if err := client.WriteMessage(cliConn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// Send a request to the first backend that can take it. A request is only
+// tried on another backend if it was never sent.
+func (s *Service) muxRoundTrip(req []byte, clientIP net.IP) ([]byte, error) {
+	for _, b := range s.next(clientIP) {
+		pool := b.muxPool()
+		if pool == nil {
+			continue
+		}
+
+		resp, err := pool.roundTrip(req, s.serverTimeout.Get())
+		if err != nil {
+			atomic.AddInt64(&b.Errors, 1)
+			if _, ok := err.(DialError); ok {
+				log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, b.Name, err)
+				continue
+			}
+			return nil, fmt.Errorf("backend %s: %s", b.Name, err)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no backend for %s", s.Name)
+}
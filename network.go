@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var (
+	ErrInvalidPortRange  = fmt.Errorf("invalid port range")
+	ErrDontFragment      = fmt.Errorf("don't fragment is not supported")
+	ErrInvalidNetwork    = fmt.Errorf("invalid network")
+	ErrNetworkMismatch   = fmt.Errorf("backend network doesn't match the service")
+	ErrInvalidSocketMode = fmt.Errorf("invalid socket_mode")
+)
+
+// The family of a network: "tcp", "udp" or "unix". Unknown networks return
+// an empty string.
+func networkFamily(network string) string {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return "tcp"
+	case "udp", "udp4", "udp6":
+		return "udp"
+	case "unix":
+		return "unix"
+	}
+	return ""
+}
+
+// The network for a backend that doesn't set one: tcp, or udp for a udp
+// service.
+func defaultBackendNetwork(svcNet string) string {
+	if networkFamily(svcNet) == "udp" {
+		return "udp"
+	}
+	return client.DefaultNet
+}
+
+// Check that a service on svcNet can proxy to a backend on backendNet.
+// Networks in the same family interoperate, so a tcp4 service can use a tcp6
+// backend. A tcp service can use a unix socket backend only when bridging is
+// enabled, while a unix socket service can use tcp or unix backends.
+func checkNetworks(svcNet, backendNet string, bridging bool) error {
+	svcFamily := networkFamily(svcNet)
+	if svcFamily == "" {
+		return fmt.Errorf("%w: %q service", ErrInvalidNetwork, svcNet)
+	}
+
+	backendFamily := networkFamily(backendNet)
+	switch {
+	case backendFamily == "":
+		return fmt.Errorf("%w: %q backend", ErrInvalidNetwork, backendNet)
+	case backendFamily == svcFamily:
+		return nil
+	case backendFamily == "unix" && svcFamily == "tcp" && bridging:
+		return nil
+	case backendFamily == "tcp" && svcFamily == "unix":
+		return nil
+	}
+	return fmt.Errorf("%w: %q backend on a %q service", ErrNetworkMismatch, backendNet, svcNet)
+}
+
+// Fill in the default networks for a service config and its backends, and
+// check that every backend can be used by the service. The backends are
+// copied, so the caller's slice isn't modified.
+func validNetworks(cfg *client.ServiceConfig) error {
+	if cfg.Network == "" {
+		cfg.Network = client.DefaultNet
+	}
+
+	backends := make([]client.BackendConfig, len(cfg.Backends))
+	for i, b := range cfg.Backends {
+		if b.Network == "" {
+			b.Network = defaultBackendNetwork(cfg.Network)
+		}
+		if err := checkNetworks(cfg.Network, b.Network, bridgeUnix); err != nil {
+			return fmt.Errorf("backend %s: %w", b.Name, err)
+		}
+		backends[i] = b
+	}
+
+	if cfg.Backends != nil {
+		cfg.Backends = backends
+	}
+	return nil
+}
+
+// ListenerFactory creates the listeners for a service, so that the network
+// can be replaced in tests.
+type ListenerFactory interface {
+	Listen(network, addr string) (net.Listener, error)
+	ListenPacket(network, addr string) (net.PacketConn, error)
+}
+
+// DialerFactory creates connections to backends, for both proxied
+// connections and health checks. DialFrom binds the connection to a local
+// address first, so health checks can come from a known source port.
+type DialerFactory interface {
+	Dial(network, addr string, timeout time.Duration) (net.Conn, error)
+	DialFrom(network, laddr, addr string, timeout time.Duration) (net.Conn, error)
+}
+
+// The factories assigned to new services and backends
+var (
+	defaultListenerFactory ListenerFactory = netListenerFactory{}
+	defaultDialerFactory   DialerFactory   = netDialerFactory{}
+)
+
+// Listen on real sockets
+type netListenerFactory struct{}
+
+func (netListenerFactory) Listen(network, addr string) (net.Listener, error) {
+	if network == "unix" {
+		return listenUnix(addr)
+	}
+
+	lAddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP(network, lAddr)
+}
+
+// Listen on a unix socket, replacing a stale socket file left by a process
+// that didn't remove it. The socket isn't removed when the listener is
+// closed, since it may have been handed to another process; the service
+// removes it when it stops.
+func listenUnix(path string) (net.Listener, error) {
+	removeStaleSocket(path)
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	return l, nil
+}
+
+// Remove the socket file at path if nothing is accepting connections on it.
+// Files that aren't sockets, and sockets in use, are left for the listen to
+// fail on.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	c, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		c.Close()
+		return
+	}
+	log.Printf("Removing stale unix socket %s", path)
+	os.Remove(path)
+}
+
+// Parse the permissions for a unix socket, given in octal like "0660". An
+// empty mode leaves the permissions to the umask.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidSocketMode, mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// Check the socket permissions of a service, which only a unix socket
+// service can have.
+func validSocketMode(cfg client.ServiceConfig) error {
+	if _, err := parseSocketMode(cfg.SocketMode); err != nil {
+		return err
+	}
+	if cfg.SocketMode != "" && networkFamily(cfg.Network) != "unix" {
+		return fmt.Errorf("%w: %q service", ErrInvalidSocketMode, cfg.Network)
+	}
+	return nil
+}
+
+func (netListenerFactory) ListenPacket(network, addr string) (net.PacketConn, error) {
+	lAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP(network, lAddr)
+}
+
+// Dial real sockets
+type netDialerFactory struct{}
+
+func (netDialerFactory) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return d.Dial(network, addr)
+}
+
+func (netDialerFactory) DialFrom(network, laddr, addr string, timeout time.Duration) (net.Conn, error) {
+	lAddr, err := net.ResolveTCPAddr(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: lAddr,
+	}
+	return d.Dial(network, addr)
+}
+
+// An inclusive range of local ports. The zero value is unset.
+type portRange struct {
+	low, high int
+}
+
+// Parse a range in the form "low-high", or a single port.
+func parsePortRange(s string) (portRange, error) {
+	var r portRange
+	if s == "" {
+		return r, nil
+	}
+
+	low, high := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		low, high = s[:i], s[i+1:]
+	}
+
+	var err error
+	if r.low, err = strconv.Atoi(strings.TrimSpace(low)); err != nil {
+		return r, ErrInvalidPortRange
+	}
+	if r.high, err = strconv.Atoi(strings.TrimSpace(high)); err != nil {
+		return r, ErrInvalidPortRange
+	}
+	if r.low <= 0 || r.high > 65535 || r.low > r.high {
+		return r, ErrInvalidPortRange
+	}
+	return r, nil
+}
+
+func (r portRange) isSet() bool {
+	return r.low > 0
+}
+
+func (r portRange) contains(port int) bool {
+	return r.isSet() && port >= r.low && port <= r.high
+}
+
+func (r portRange) size() int {
+	if !r.isSet() {
+		return 0
+	}
+	return r.high - r.low + 1
+}
+
+// Check if a dial failed because the local address is taken, by a listener
+// or by another connection to the same destination.
+func addrInUse(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "address already in use") ||
+		strings.Contains(msg, "cannot assign requested address")
+}
+
+// Check if a dial failed because the local IP it was bound to is no longer
+// on this host.
+func addrNotAvail(err error) bool {
+	return strings.Contains(err.Error(), "cannot assign requested address")
+}
+
+// Check if a write failed because the datagram was larger than the path MTU.
+func msgTooLong(err error) bool {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EMSGSIZE
+}
+
+// Find the local IP the kernel would use to reach addr. Connecting a UDP
+// socket only selects the route, and doesn't send anything.
+func routeSourceIP(addr string) (string, error) {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	host, _, err := net.SplitHostPort(c.LocalAddr().String())
+	return host, err
+}
+
+// clientAddr is a client address in its normalized form, so that a client is
+// recognized and reported the same way however its address arrived. An
+// IPv4-mapped IPv6 address is reduced to IPv4, and an IPv6 zone is kept
+// apart from the IP, so it doesn't prevent parsing.
+type clientAddr struct {
+	IP   net.IP
+	Zone string
+	Port string
+
+	// the address as given, if it isn't an IP
+	raw string
+}
+
+// Normalize a client address, with or without a port. This is the one place
+// client addresses are parsed, for logging as well as matching networks.
+func normalizeClientAddr(addr string) clientAddr {
+	a := clientAddr{raw: addr}
+
+	host := addr
+	if h, port, err := net.SplitHostPort(addr); err == nil {
+		host, a.Port = h, port
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, a.Zone = host[:i], host[i+1:]
+	}
+
+	a.IP = net.ParseIP(host)
+	if ip4 := a.IP.To4(); ip4 != nil {
+		// zones only apply to IPv6
+		a.IP = ip4
+		a.Zone = ""
+	}
+	return a
+}
+
+// The normalized host, without the port.
+func (a clientAddr) Host() string {
+	if a.IP == nil {
+		host, _, err := net.SplitHostPort(a.raw)
+		if err != nil {
+			return a.raw
+		}
+		return host
+	}
+	if a.Zone != "" {
+		return a.IP.String() + "%" + a.Zone
+	}
+	return a.IP.String()
+}
+
+// The normalized address, including the port if there was one.
+func (a clientAddr) String() string {
+	if a.IP == nil {
+		return a.raw
+	}
+	if a.Port == "" {
+		return a.Host()
+	}
+	return net.JoinHostPort(a.Host(), a.Port)
+}
+
+// Report whether the address is in any of the networks, which should be
+// normalized with normalizeNet.
+func (a clientAddr) In(nets []*net.IPNet) bool {
+	if a.IP == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize a network to match normalized client addresses: a network of
+// IPv4-mapped IPv6 addresses is reduced to IPv4.
+func normalizeNet(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	ip4 := n.IP.To4()
+	if bits != 8*net.IPv6len || ip4 == nil || ones < 96 {
+		return n
+	}
+	return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+}
+
+// Normalize each address in a comma separated list, like X-Forwarded-For.
+func normalizeAddrList(list string) string {
+	addrs := strings.Split(list, ",")
+	for i, addr := range addrs {
+		addrs[i] = normalizeClientAddr(strings.TrimSpace(addr)).String()
+	}
+	return strings.Join(addrs, ", ")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidNoBackend = fmt.Errorf("invalid no backend action")
+
+func validNoBackend(cfg client.ServiceConfig) error {
+	switch cfg.NoBackendAction {
+	case "", client.NoBackendRefuse, client.NoBackendHold, client.NoBackendError:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidNoBackend, cfg.NoBackendAction)
+	}
+	if cfg.HoldTimeout < 0 || cfg.HoldQueue < 0 {
+		return fmt.Errorf("%w: negative value", ErrInvalidNoBackend)
+	}
+	return nil
+}
+
+// Set what happens to connections while the service has no backends.
+// Service *must* be locked, or not yet started.
+func (s *Service) setNoBackendAction(cfg client.ServiceConfig) {
+	s.NoBackendAction = cfg.NoBackendAction
+	if s.NoBackendAction == "" {
+		s.NoBackendAction = client.DefaultNoBackendAction
+	}
+	s.HoldTimeout = time.Duration(cfg.HoldTimeout) * time.Millisecond
+	s.HoldQueue = cfg.HoldQueue
+	if s.NoBackendAction == client.NoBackendHold {
+		if s.HoldTimeout == 0 {
+			s.HoldTimeout = client.DefaultHoldTimeout * time.Millisecond
+		}
+		if s.HoldQueue == 0 {
+			s.HoldQueue = client.DefaultHoldQueue
+		}
+	}
+}
+
+// Wake anything held waiting for a backend, and close or bind the listener of
+// a service that refuses connections, after the backends changed.
+// Service *must* be locked.
+func (s *Service) backendsChanged() {
+	if len(s.Backends) > 0 && s.backendAdded != nil {
+		close(s.backendAdded)
+		s.backendAdded = nil
+	}
+
+	// a service that defers listening already withdraws its listener
+	refuse := s.NoBackendAction == client.NoBackendRefuse && len(s.Backends) == 0 &&
+		!s.DeferListen && networkFamily(s.Network) == "tcp"
+
+	switch {
+	case refuse && s.listening:
+		log.Printf("EVENT: %s has no backends, refusing connections on %s tags=%s", s.Name, s.Addr, formatTags(s.Tags))
+		s.closeListener()
+		s.refusing = true
+	case !refuse && s.refusing:
+		s.refusing = false
+		// the availability watcher binds the listener once it's deferred
+		if s.listening || s.DeferListen {
+			return
+		}
+		if err := s.listen(); err != nil {
+			log.Errorf("ERROR: %s: %s", s.Name, err)
+			return
+		}
+		log.Printf("EVENT: %s is accepting connections on %s tags=%s", s.Name, s.Addr, formatTags(s.Tags))
+	}
+}
+
+// Check that the service has a backend for a new connection or request,
+// holding it until one is added if the service holds connections. Returns an
+// empty string if there's a backend, or else NoBackendRefuse if the
+// connection should be refused, or NoBackendError if it should be passed on
+// to fail like any other.
+func (s *Service) awaitBackend() string {
+	s.Lock()
+	if len(s.Backends) > 0 {
+		s.Unlock()
+		return ""
+	}
+
+	atomic.AddInt64(&s.NoBackends, 1)
+	switch s.NoBackendAction {
+	case client.NoBackendHold:
+	case client.NoBackendRefuse:
+		s.Unlock()
+		return client.NoBackendRefuse
+	default:
+		s.Unlock()
+		return client.NoBackendError
+	}
+
+	if s.holding >= s.HoldQueue {
+		s.holdDropped++
+		s.Unlock()
+		log.Debugf("Hold queue for %s is full", s.Name)
+		return client.NoBackendRefuse
+	}
+
+	s.holding++
+	if s.backendAdded == nil {
+		s.backendAdded = make(chan struct{})
+	}
+	added := s.backendAdded
+	timer := time.NewTimer(s.HoldTimeout)
+	s.Unlock()
+
+	action := ""
+	select {
+	case <-added:
+		timer.Stop()
+	case <-timer.C:
+		action = client.NoBackendRefuse
+	}
+
+	s.Lock()
+	s.holding--
+	if action != "" {
+		s.holdDropped++
+	}
+	s.Unlock()
+	return action
+}
+
+// Report whether the service has no backends.
+func (s *Service) Empty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.Backends) == 0
+}
@@ -0,0 +1,73 @@
+package main
+
+// ObjectCounts are the live internal objects reachable from the registry and
+// the routers, so that anything left behind by adding and removing services,
+// backends and virtual hosts is visible.
+type ObjectCounts struct {
+	Services     int `json:"services"`
+	Backends     int `json:"backends"`
+	BackendConns int `json:"backend_conns"`
+	VirtualHosts int `json:"virtual_hosts"`
+	// services registered under all virtual hosts
+	VHostEntries int `json:"vhost_entries"`
+	// active and shadow balancers, and the backends counted by shadows
+	Balancers     int `json:"balancers"`
+	ShadowEntries int `json:"shadow_entries"`
+	Draining      int `json:"draining_listeners"`
+
+	Routers        int `json:"routers"`
+	RetiredServers int `json:"retired_servers"`
+}
+
+// Count the live objects in the registry and the routers.
+func (s *ServiceRegistry) ObjectCounts() ObjectCounts {
+	s.Lock()
+	defer s.Unlock()
+
+	counts := ObjectCounts{
+		Services:     len(s.svcs),
+		VirtualHosts: len(s.vhosts),
+	}
+	for _, vhost := range s.vhosts {
+		counts.VHostEntries += vhost.Len()
+	}
+	for _, service := range s.svcs {
+		service.countObjects(&counts)
+	}
+
+	for _, r := range []*HostRouter{httpRouter, httpsRouter} {
+		if r != nil {
+			counts.Routers++
+			counts.RetiredServers += r.retiredLen()
+		}
+	}
+	return counts
+}
+
+// Add the service's objects to counts.
+func (s *Service) countObjects(counts *ObjectCounts) {
+	s.Lock()
+	defer s.Unlock()
+
+	counts.Backends += len(s.Backends)
+	for _, b := range s.Backends {
+		b.Lock()
+		counts.BackendConns += len(b.conns)
+		b.Unlock()
+	}
+	if s.balancer != nil {
+		counts.Balancers++
+	}
+	if s.shadow != nil {
+		counts.Balancers++
+		counts.ShadowEntries += len(s.shadow.actual) + len(s.shadow.shadow)
+	}
+	counts.Draining += len(s.draining)
+}
+
+// The number of retired servers still finishing their connections.
+func (r *HostRouter) retiredLen() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.retired)
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// What happens to a manual change to a setting an overlay is controlling
+const (
+	// the change is applied, and the overlay stops controlling the setting
+	OverlayEditsWin = "win"
+	// the overlay's value is kept, and the change is applied when it ends
+	OverlayEditsDefer = "defer"
+)
+
+// The longest an overlay can be active for after each start
+const maxOverlayDuration = 7 * 24 * time.Hour
+
+var (
+	ErrOverlayEdits   = fmt.Errorf("overlay edits policy must be win or defer")
+	ErrInvalidOverlay = fmt.Errorf("invalid overlay")
+
+	// the policy for manual changes during an overlay
+	overlayEdits = OverlayEditsWin
+
+	// the scheduler for the running process, if any
+	scheduler *overlayScheduler
+)
+
+func validOverlayEdits(policy string) error {
+	switch policy {
+	case OverlayEditsWin, OverlayEditsDefer:
+		return nil
+	}
+	return ErrOverlayEdits
+}
+
+// A cronSchedule matches the minutes of a cron expression. Each field is a
+// bitset of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// as in cron, if both days are restricted either one can match
+	anyDOM, anyDOW bool
+}
+
+// Parse a 5 field cron expression. Each field is *, or a list of values and
+// ranges, optionally with a step, e.g. "*/15", "1-5" or "0,30".
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have 5 fields", spec)
+	}
+
+	c := &cronSchedule{
+		anyDOM: fields[2] == "*",
+		anyDOW: fields[4] == "*",
+	}
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		if *f.bits, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %s", spec, err)
+		}
+	}
+
+	// Sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				// "5/15" is every 15 from 5
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 ||
+		c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyDOM:
+		return dow
+	case c.anyDOW:
+		return dom
+	}
+	return dom || dow
+}
+
+// Return the start of the window of length d that t is in, if any.
+func (c *cronSchedule) activeSince(t time.Time, d time.Duration) (time.Time, bool) {
+	for start := t.Truncate(time.Minute); t.Sub(start) < d; start = start.Add(-time.Minute) {
+		if c.matches(start) {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Check the overlays in a config.
+func validOverlays(overlays []client.OverlayConfig) error {
+	names := make(map[string]bool)
+	for _, ov := range overlays {
+		if err := validName(ov.Name); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidOverlay, err)
+		}
+		if names[ov.Name] {
+			return fmt.Errorf("%w %s: duplicate name", ErrInvalidOverlay, ov.Name)
+		}
+		names[ov.Name] = true
+
+		if _, err := parseCron(ov.Schedule); err != nil {
+			return fmt.Errorf("%w %s: %s", ErrInvalidOverlay, ov.Name, err)
+		}
+		d := time.Duration(ov.Duration) * time.Millisecond
+		if d < time.Minute || d > maxOverlayDuration {
+			return fmt.Errorf("%w %s: duration must be from 1 minute to %s", ErrInvalidOverlay, ov.Name, maxOverlayDuration)
+		}
+
+		for _, p := range ov.Services {
+			if len(overlayFields(p)) == 0 {
+				return fmt.Errorf("%w %s: nothing set for service %q", ErrInvalidOverlay, ov.Name, p.Service)
+			}
+			for backend, weight := range p.Weights {
+				if weight < 1 {
+					return fmt.Errorf("%w %s: %w for %s: %d", ErrInvalidOverlay, ov.Name, ErrInvalidWeight, backend, weight)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// An overlaid setting is a field of a service: maintenance_mode, or
+// weights/<backend>. Values are ints, with bools as 0 or 1.
+type overlayKey struct {
+	service, field string
+}
+
+const (
+	fieldMaintenance   = "maintenance_mode"
+	fieldWeightsPrefix = "weights/"
+)
+
+// The fields set by an overlay on a service, and their values.
+func overlayFields(p client.ServiceOverlay) map[string]int {
+	fields := make(map[string]int)
+	for backend, weight := range p.Weights {
+		fields[fieldWeightsPrefix+backend] = weight
+	}
+	if p.MaintenanceMode != nil {
+		fields[fieldMaintenance] = 0
+		if *p.MaintenanceMode {
+			fields[fieldMaintenance] = 1
+		}
+	}
+	return fields
+}
+
+// The value of a field in a service's config, if it has the field.
+func overlayValue(cfg client.ServiceConfig, field string) (int, bool) {
+	if field == fieldMaintenance {
+		if cfg.MaintenanceMode {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	name := strings.TrimPrefix(field, fieldWeightsPrefix)
+	for _, b := range cfg.Backends {
+		if b.Name == name {
+			return b.Weight, true
+		}
+	}
+	return 0, false
+}
+
+// Set a field in a service's config.
+func setOverlayValue(cfg *client.ServiceConfig, field string, value int) {
+	if field == fieldMaintenance {
+		cfg.MaintenanceMode = value != 0
+		return
+	}
+
+	name := strings.TrimPrefix(field, fieldWeightsPrefix)
+	for i := range cfg.Backends {
+		if cfg.Backends[i].Name == name {
+			cfg.Backends[i].Weight = value
+		}
+	}
+}
+
+// OverlayField is a setting controlled by an overlay.
+type OverlayField struct {
+	Overlay string `json:"overlay"`
+	Value   int    `json:"value"`
+	// the value restored when the overlay ends
+	Baseline int `json:"baseline"`
+	// a manual change is waiting for the overlay to end
+	Deferred bool `json:"deferred,omitempty"`
+	// a manual change replaced the overlay's value for the rest of its window
+	Released bool `json:"released,omitempty"`
+}
+
+// OverlayStatus reports an overlay, and the settings it controls by service
+// and field while it's active.
+type OverlayStatus struct {
+	Name     string                             `json:"name"`
+	Schedule string                             `json:"schedule"`
+	Priority int                                `json:"priority"`
+	Active   bool                               `json:"active"`
+	Since    *time.Time                         `json:"since,omitempty"`
+	Until    *time.Time                         `json:"until,omitempty"`
+	Fields   map[string]map[string]OverlayField `json:"fields,omitempty"`
+}
+
+type overlayWindow struct {
+	since, until time.Time
+}
+
+// overlayScheduler applies the overlays in the registry's config while they're
+// active. The value each setting had before an overlay changed it is kept, and
+// restored when no active overlay sets it. Changes are made through the same
+// registry updates as the admin API, and audited as coming from the schedule.
+type overlayScheduler struct {
+	sync.Mutex
+	reg *ServiceRegistry
+
+	// the active overlays, and the settings they control
+	active map[string]overlayWindow
+	fields map[overlayKey]*OverlayField
+
+	// the clock, replaced in tests
+	now func() time.Time
+
+	ready chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newOverlayScheduler(reg *ServiceRegistry) *overlayScheduler {
+	return &overlayScheduler{
+		reg:    reg,
+		active: make(map[string]overlayWindow),
+		fields: make(map[overlayKey]*OverlayField),
+		now:    time.Now,
+		ready:  make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Apply the overlays now, and again at the start of every minute.
+func (o *overlayScheduler) Start(ctx context.Context) error {
+	o.evaluate()
+	close(o.ready)
+
+	goTask("overlay_scheduler", "", func() {
+		defer close(o.done)
+		for {
+			now := time.Now()
+			timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			select {
+			case <-timer.C:
+				o.evaluate()
+			case <-o.stop:
+				timer.Stop()
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Stop applying overlays. The settings are left as they are, and the state
+// config keeps the values they had before the overlays.
+func (o *overlayScheduler) Stop(ctx context.Context) error {
+	select {
+	case <-o.ready:
+	default:
+		return nil
+	}
+	close(o.stop)
+
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *overlayScheduler) Ready() <-chan struct{} {
+	return o.ready
+}
+
+type overlayWant struct {
+	overlay string
+	value   int
+}
+
+// Apply the overlays that are active, and restore the settings of those that
+// have ended.
+func (o *overlayScheduler) evaluate() {
+	o.Lock()
+	defer o.Unlock()
+
+	now := o.now()
+	overlays := o.reg.Overlays()
+	sort.Slice(overlays, func(i, j int) bool {
+		if overlays[i].Priority != overlays[j].Priority {
+			return overlays[i].Priority > overlays[j].Priority
+		}
+		return overlays[i].Name < overlays[j].Name
+	})
+
+	// each setting comes from the highest priority active overlay
+	active := make(map[string]overlayWindow)
+	want := make(map[overlayKey]overlayWant)
+	for _, ov := range overlays {
+		sched, err := parseCron(ov.Schedule)
+		if err != nil {
+			continue
+		}
+		d := time.Duration(ov.Duration) * time.Millisecond
+		since, ok := sched.activeSince(now, d)
+		if !ok {
+			continue
+		}
+		active[ov.Name] = overlayWindow{since, since.Add(d)}
+
+		for _, p := range ov.Services {
+			for field, value := range overlayFields(p) {
+				key := overlayKey{p.Service, field}
+				if _, ok := want[key]; !ok {
+					want[key] = overlayWant{ov.Name, value}
+				}
+			}
+		}
+	}
+
+	for name, w := range active {
+		if _, ok := o.active[name]; !ok {
+			log.Printf("AUDIT: overlay %s started by schedule, until %s", name, w.until.Format(time.RFC3339))
+		}
+	}
+	for name := range o.active {
+		if _, ok := active[name]; !ok {
+			log.Printf("AUDIT: overlay %s ended by schedule", name)
+		}
+	}
+	o.active = active
+
+	// the current configs of the services with overlaid settings
+	configs := make(map[string]client.ServiceConfig)
+	current := func(key overlayKey) (int, bool) {
+		cfg, ok := configs[key.service]
+		if !ok {
+			var err error
+			if cfg, err = o.reg.ServiceConfig(key.service); err != nil {
+				return 0, false
+			}
+			configs[key.service] = cfg
+		}
+		return overlayValue(cfg, key.field)
+	}
+
+	// whether the state config needs writing, since it keeps the baselines
+	dirty := false
+	changes := make(map[string]map[string]int)
+	reasons := make(map[overlayKey]string)
+	set := func(key overlayKey, value int, reason string) {
+		if changes[key.service] == nil {
+			changes[key.service] = make(map[string]int)
+		}
+		changes[key.service][key.field] = value
+		reasons[key] = reason
+	}
+
+	for key, f := range o.fields {
+		cur, ok := current(key)
+		if !ok {
+			// the service or backend was removed
+			delete(o.fields, key)
+			continue
+		}
+		w, wanted := want[key]
+
+		if !f.Released && cur != f.Value {
+			// changed by hand since the overlay set it
+			f.Baseline = cur
+			dirty = true
+			if overlayEdits == OverlayEditsDefer && wanted {
+				if !f.Deferred {
+					log.Printf("AUDIT: change to %s of %s deferred until overlay %s ends", key.field, key.service, f.Overlay)
+				}
+				f.Deferred = true
+			} else {
+				f.Released = true
+				f.Deferred = false
+			}
+		}
+
+		switch {
+		case !wanted:
+			if !f.Released && cur != f.Baseline {
+				set(key, f.Baseline, "overlay "+f.Overlay+" ended")
+			}
+			delete(o.fields, key)
+		case w.overlay != f.Overlay:
+			// another overlay has taken over the setting
+			f.Overlay, f.Value, f.Released = w.overlay, w.value, false
+			if cur != w.value {
+				set(key, w.value, "overlay "+w.overlay)
+			}
+		case !f.Released && (cur != w.value || f.Value != w.value):
+			f.Value = w.value
+			set(key, w.value, "overlay "+w.overlay)
+		}
+	}
+
+	for key, w := range want {
+		if _, ok := o.fields[key]; ok {
+			continue
+		}
+		cur, ok := current(key)
+		if !ok {
+			continue
+		}
+		o.fields[key] = &OverlayField{Overlay: w.overlay, Value: w.value, Baseline: cur}
+		if cur != w.value {
+			set(key, w.value, "overlay "+w.overlay)
+		}
+	}
+
+	if len(changes) == 0 {
+		if dirty {
+			goTask("state_write", "", writeStateConfig)
+		}
+		return
+	}
+	for svc, fields := range changes {
+		if err := o.apply(configs[svc], fields); err != nil {
+			log.Errorf("ERROR: overlay changes to %s: %s", svc, err)
+			continue
+		}
+		for field, value := range fields {
+			key := overlayKey{svc, field}
+			log.Printf("AUDIT: %s of %s set to %d by schedule: %s", field, svc, value, reasons[key])
+		}
+	}
+	goTask("state_write", "", writeStateConfig)
+}
+
+// Make the changes to a service's settings, with the same updates as the
+// admin API.
+func (o *overlayScheduler) apply(cfg client.ServiceConfig, fields map[string]int) error {
+	weights := make(map[string]int)
+	for field, value := range fields {
+		if name := strings.TrimPrefix(field, fieldWeightsPrefix); name != field {
+			weights[name] = value
+		}
+	}
+	if len(weights) > 0 {
+		if _, err := o.reg.SetWeights(cfg.Name, weights); err != nil {
+			return err
+		}
+	}
+
+	if value, ok := fields[fieldMaintenance]; ok {
+		svcCfg, err := o.reg.ServiceConfig(cfg.Name)
+		if err != nil {
+			return err
+		}
+		setOverlayValue(&svcCfg, fieldMaintenance, value)
+		return o.reg.UpdateService(svcCfg)
+	}
+	return nil
+}
+
+// Return the overlays in the config, and which are active.
+func (o *overlayScheduler) Status() []OverlayStatus {
+	overlays := o.reg.Overlays()
+
+	o.Lock()
+	defer o.Unlock()
+
+	status := []OverlayStatus{}
+	for _, ov := range overlays {
+		s := OverlayStatus{
+			Name:     ov.Name,
+			Schedule: ov.Schedule,
+			Priority: ov.Priority,
+		}
+		if w, ok := o.active[ov.Name]; ok {
+			s.Active = true
+			s.Since, s.Until = &w.since, &w.until
+		}
+		for key, f := range o.fields {
+			if f.Overlay != ov.Name {
+				continue
+			}
+			if s.Fields == nil {
+				s.Fields = make(map[string]map[string]OverlayField)
+			}
+			if s.Fields[key.service] == nil {
+				s.Fields[key.service] = make(map[string]OverlayField)
+			}
+			s.Fields[key.service][key.field] = *f
+		}
+		status = append(status, s)
+	}
+
+	sort.Slice(status, func(i, j int) bool {
+		return status[i].Name < status[j].Name
+	})
+	return status
+}
+
+// Replace the overlaid settings in cfg with the values they'll return to, so
+// the state config doesn't keep an overlay's values after it ends.
+func (o *overlayScheduler) baseline(cfg *client.Config) {
+	o.Lock()
+	defer o.Unlock()
+
+	for i := range cfg.Services {
+		svc := &cfg.Services[i]
+		for key, f := range o.fields {
+			if key.service == svc.Name && !f.Released {
+				setOverlayValue(svc, key.field, f.Baseline)
+			}
+		}
+	}
+}
+
+// Apply overlays straight away after a change to the config, so a new
+// overlay starts without waiting for the next minute, and a manual change to
+// an overlaid setting is handled by the edits policy.
+func evaluateOverlays() {
+	if s := scheduler; s != nil {
+		s.evaluate()
+	}
+}
+
+// Report the overlays, and those that are active.
+func getOverlays(w http.ResponseWriter, r *http.Request) {
+	if scheduler == nil {
+		w.Write(marshal([]OverlayStatus{}))
+		return
+	}
+	w.Write(marshal(scheduler.Status()))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// What a persistence stream does with a write when its queue is full: drop it
+// and count the drop, or refuse it and raise an alarm, so the caller keeps
+// the data to write again later.
+const (
+	PersistDrop  = "drop"
+	PersistAlarm = "alarm"
+)
+
+var (
+	ErrPersistDropped  = fmt.Errorf("persistence queue full, write dropped")
+	ErrPersistRefused  = fmt.Errorf("persistence queue full, write refused")
+	ErrPersistDeadline = fmt.Errorf("persistence flush deadline exceeded")
+)
+
+// The streams every write to local disk goes through, so that a stalled disk
+// holds up only the writes queued behind it, never the proxy or stats
+// collection.
+var persistence = &persistWriters{streams: make(map[string]*persistStream)}
+
+type persistWriters struct {
+	sync.Mutex
+	streams map[string]*persistStream
+}
+
+// Return the named stream, starting it with the policy, queue size and
+// shutdown flush deadline if it isn't running yet.
+func (p *persistWriters) stream(name, policy string, size int, deadline time.Duration) *persistStream {
+	p.Lock()
+	defer p.Unlock()
+
+	s := p.streams[name]
+	if s == nil {
+		s = newPersistStream(name, policy, size, deadline)
+		p.streams[name] = s
+	}
+	return s
+}
+
+// Flush every stream at once, each up to its own deadline, returning the
+// streams that didn't finish in time.
+func (p *persistWriters) flush() []string {
+	p.Lock()
+	streams := make([]*persistStream, 0, len(p.streams))
+	for _, s := range p.streams {
+		streams = append(streams, s)
+	}
+	p.Unlock()
+
+	var mu sync.Mutex
+	var late []string
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		s := s
+		goTask("persist_flush", s.name, func() {
+			defer wg.Done()
+			if err := s.flush(); err != nil {
+				mu.Lock()
+				late = append(late, s.name)
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	sort.Strings(late)
+	return late
+}
+
+func (p *persistWriters) status() map[string]PersistStatus {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.streams) == 0 {
+		return nil
+	}
+	status := make(map[string]PersistStatus, len(p.streams))
+	for name, s := range p.streams {
+		status[name] = s.status()
+	}
+	return status
+}
+
+type persistJob struct {
+	write  func() error
+	queued time.Time
+}
+
+// persistStream runs the writes queued for one kind of record in order, on
+// its own goroutine.
+type persistStream struct {
+	name     string
+	policy   string
+	deadline time.Duration
+	queue    chan persistJob
+
+	// Used atomically
+	Written int64
+	Dropped int64
+	Refused int64
+	Errors  int64
+
+	sync.Mutex
+	// writes queued or running, and closed each time that falls to 0
+	pending int
+	drained chan struct{}
+	alarm   bool
+	lastErr error
+	// when the last write finished, and how long after it was queued
+	lastFlush   time.Time
+	lastLatency time.Duration
+}
+
+func newPersistStream(name, policy string, size int, deadline time.Duration) *persistStream {
+	s := &persistStream{
+		name:     name,
+		policy:   policy,
+		deadline: deadline,
+		queue:    make(chan persistJob, size),
+		drained:  make(chan struct{}),
+	}
+	goTask("persist_stream", s.name, s.run)
+	return s
+}
+
+// Queue a write without waiting. A write that doesn't fit is dropped or
+// refused according to the stream's policy.
+func (s *persistStream) enqueue(write func() error) error {
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case s.queue <- persistJob{write: write, queued: time.Now()}:
+		s.pending++
+		return nil
+	default:
+	}
+
+	if s.policy == PersistDrop {
+		atomic.AddInt64(&s.Dropped, 1)
+		return ErrPersistDropped
+	}
+
+	atomic.AddInt64(&s.Refused, 1)
+	if !s.alarm {
+		s.alarm = true
+		log.Errorf("ERROR: EVENT: %s writes are stalled with %d queued, holding records in memory", s.name, len(s.queue))
+	}
+	return ErrPersistRefused
+}
+
+func (s *persistStream) run() {
+	for job := range s.queue {
+		err := job.write()
+		now := time.Now()
+
+		if err != nil {
+			atomic.AddInt64(&s.Errors, 1)
+			log.Errorf("ERROR: writing %s: %s", s.name, err)
+		} else {
+			atomic.AddInt64(&s.Written, 1)
+		}
+
+		s.Lock()
+		s.lastErr = err
+		s.lastFlush = now
+		s.lastLatency = now.Sub(job.queued)
+		s.pending--
+		if s.pending == 0 {
+			if s.alarm {
+				s.alarm = false
+				log.Printf("EVENT: %s writes recovered after %d refused", s.name, atomic.LoadInt64(&s.Refused))
+			}
+			close(s.drained)
+			s.drained = make(chan struct{})
+		}
+		s.Unlock()
+	}
+}
+
+// Wait up to the stream's deadline for everything queued to be written,
+// including anything queued meanwhile.
+func (s *persistStream) flush() error {
+	s.Lock()
+	if s.pending == 0 {
+		s.Unlock()
+		return nil
+	}
+	drained := s.drained
+	pending := s.pending
+	s.Unlock()
+
+	t := time.NewTimer(s.deadline)
+	defer t.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-t.C:
+		log.Errorf("ERROR: %s: %s with %d writes pending", s.name, ErrPersistDeadline, pending)
+		return ErrPersistDeadline
+	}
+}
+
+// PersistStatus reports the queue of a persistence stream. LastLatency is
+// the time in milliseconds from queueing the last write to finishing it.
+type PersistStatus struct {
+	Policy      string     `json:"policy"`
+	Depth       int        `json:"queue_depth"`
+	Capacity    int        `json:"queue_capacity"`
+	Written     int64      `json:"written"`
+	Dropped     int64      `json:"dropped"`
+	Refused     int64      `json:"refused"`
+	Errors      int64      `json:"errors"`
+	Alarm       bool       `json:"alarm"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFlush   *time.Time `json:"last_flush,omitempty"`
+	LastLatency float64    `json:"last_flush_latency_ms"`
+}
+
+func (s *persistStream) status() PersistStatus {
+	s.Lock()
+	defer s.Unlock()
+
+	status := PersistStatus{
+		Policy:      s.policy,
+		Depth:       len(s.queue),
+		Capacity:    cap(s.queue),
+		Written:     atomic.LoadInt64(&s.Written),
+		Dropped:     atomic.LoadInt64(&s.Dropped),
+		Refused:     atomic.LoadInt64(&s.Refused),
+		Errors:      atomic.LoadInt64(&s.Errors),
+		Alarm:       s.alarm,
+		LastLatency: float64(s.lastLatency) / float64(time.Millisecond),
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	if !s.lastFlush.IsZero() {
+		last := s.lastFlush
+		status.LastFlush = &last
+	}
+	return status
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net"
+)
+
+// A backendPicker hands out the backends for one request in balanced order.
+// The order is taken from the balancer when the picker is created, along with
+// the version of the service's backends it was balanced from. Each backend is
+// checked against the service before it's returned, so a retry loop that
+// spans slow dials doesn't spend attempts on backends that were removed or
+// went down in the meantime. If backends were added or removed, the rest of
+// the order is balanced again. No backend is returned twice.
+//
+// The picker takes a connection slot on each backend it returns, skipping
+// those at their limit, and holds it until Next is called again or the
+// request releases it.
+type backendPicker struct {
+	s        *Service
+	clientIP net.IP
+
+	version uint64
+	order   []*Backend
+	next    int
+
+	// the addresses already returned
+	tried map[string]bool
+
+	// A backend to try before the rest, and whether the rest still need to
+	// be balanced, which is put off until the preferred backend fails.
+	preferred  *Backend
+	unbalanced bool
+
+	// the backend whose slot is held
+	held *Backend
+
+	// the names of the only backends to return, if the request was routed
+	only map[string]bool
+}
+
+// NewPicker returns a picker for a request from clientIP, which may be nil.
+func (s *Service) NewPicker(clientIP net.IP) *backendPicker {
+	p := &backendPicker{
+		s:        s,
+		clientIP: clientIP,
+	}
+	p.balance(true)
+	return p
+}
+
+// Take the order from the balancer. Only the first balancing of a request is
+// recorded by a shadow balancer.
+func (p *backendPicker) balance(observe bool) {
+	p.version, p.order = p.s.balanced(p.clientIP, observe)
+	p.next = 0
+}
+
+// Next returns the address of the next backend to try, and false once there
+// are none left.
+func (p *backendPicker) Next() (string, bool) {
+	p.release()
+
+	if b := p.preferred; b != nil {
+		p.preferred = nil
+		if p.allowed(b) && p.s.usable(b) && b.acquire() {
+			p.held = b
+			p.tried = map[string]bool{b.Addr: true}
+			return b.Addr, true
+		}
+	}
+	if p.unbalanced {
+		p.unbalanced = false
+		p.balance(true)
+	}
+
+	for {
+		if p.s.backendsVersion() != p.version {
+			p.balance(false)
+		}
+		if p.next >= len(p.order) {
+			return "", false
+		}
+
+		b := p.order[p.next]
+		p.next++
+		if p.tried[b.Addr] || !p.allowed(b) || !p.s.usable(b) || !b.acquire() {
+			continue
+		}
+		p.held = b
+
+		if p.tried == nil {
+			p.tried = make(map[string]bool, len(p.order))
+		}
+		p.tried[b.Addr] = true
+		return b.Addr, true
+	}
+}
+
+// Whether the request's route allows the backend.
+func (p *backendPicker) allowed(b *Backend) bool {
+	return p.only == nil || p.only[b.Name]
+}
+
+// Start a capture session for a request to the backend last returned, if
+// it's being captured.
+func (p *backendPicker) captureSession(cliAddr string) *captureSession {
+	if p.held == nil {
+		return nil
+	}
+	if c := p.held.activeCapture(); c != nil {
+		return c.newSession(cliAddr, p.held.Addr)
+	}
+	return nil
+}
+
+// Release the slot held on the last backend returned.
+func (p *backendPicker) release() {
+	if p.held != nil {
+		p.held.release()
+		p.held = nil
+	}
+}
+
+// The version of the service's backends, which changes whenever one is added,
+// replaced, or removed.
+func (s *Service) backendsVersion() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.backendsVer
+}
+
+// Whether b is still one of the service's backends, and can take a request.
+// A service's only backend is used even while it's down, as it is by the
+// balancer, unless the backend asked not to be.
+func (s *Service) usable(b *Backend) bool {
+	s.Lock()
+	found := false
+	for _, sb := range s.Backends {
+		if sb == b {
+			found = true
+			break
+		}
+	}
+	only := len(s.Backends) == 1
+	s.Unlock()
+
+	switch {
+	case !found:
+		return false
+	case only:
+		return b.Ready() && !b.AdminDown()
+	}
+	return b.Up()
+}
+
+// A picker over a fixed list of addresses, for requests that weren't balanced
+// by a service.
+type addrPicker struct {
+	addrs []string
+	next  int
+}
+
+func (p *addrPicker) Next() (string, bool) {
+	if p.next >= len(p.addrs) {
+		return "", false
+	}
+	p.next++
+	return p.addrs[p.next-1], true
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/testnet"
 )
 
 var (
@@ -21,17 +27,18 @@ func setupBench(b *testing.B) {
 		svcs:   make(map[string]*Service),
 		vhosts: make(map[string]*VirtualHost),
 	}
+	unknownVHosts = newUnknownHosts(unknownHostCache, unknownHostCounts)
 
-	benchServer = httptest.NewServer(nil)
+	benchServer = httptest.NewServer(newAdminHandler())
 
 	httpServer := &http.Server{
 		Addr: httpAddr,
 	}
 
 	benchRouter = NewHostRouter(httpServer)
-	ready := make(chan bool)
-	go benchRouter.Start(ready)
-	<-ready
+	if err := benchRouter.Start(context.Background()); err != nil {
+		b.Fatal(err)
+	}
 
 	for i := 0; i < 4; i++ {
 		server, err := NewHTTPTestServer("127.0.0.1:0", b)
@@ -54,7 +61,7 @@ func tearDownBench(b *testing.B) {
 	}
 
 	benchServer.Close()
-	benchRouter.Stop()
+	benchRouter.Stop(context.Background())
 }
 
 // Make HTTP calls over the TCP proxy for comparison to ReverseProxy
@@ -204,3 +211,192 @@ func BenchmarkHTTPProxyKeepalive(b *testing.B) {
 	}
 
 }
+
+// Count the datagrams arriving at addr on the in-memory network.
+func countUDP(b *testing.B, n *testnet.Network, addr string) (*int64, func()) {
+	conn, err := n.ListenPacket("udp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	count := new(int64)
+	go func() {
+		buff := make([]byte, 1024)
+		for {
+			if _, _, err := conn.ReadFrom(buff); err != nil {
+				return
+			}
+			atomic.AddInt64(count, 1)
+		}
+	}()
+	return count, func() { conn.Close() }
+}
+
+// Forward datagrams to a slow and a fast backend, and report the rate the fast
+// one receives them. "coupled" sends each datagram before reading the next,
+// as forwarding did before backends had their own send queues.
+func BenchmarkUDPSlowBackend(b *testing.B) {
+	const delay = 100 * time.Microsecond
+
+	run := func(b *testing.B, forward func(n *testnet.Network, slow, fast string) func()) {
+		network := testnet.New()
+		slowCount, stopSlow := countUDP(b, network, "127.0.0.1:11111")
+		defer stopSlow()
+		fastCount, stopFast := countUDP(b, network, "127.0.0.1:11112")
+		defer stopFast()
+		network.SetWriteDelay("127.0.0.1:11111", delay)
+
+		send := forward(network, "127.0.0.1:11111", "127.0.0.1:11112")
+		conn, err := network.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+
+		start := time.Now()
+		b.ResetTimer()
+		for i := 0; i < 2*b.N; i++ {
+			conn.WriteTo([]byte("TEST"), testnet.Addr{Net: "udp", Address: "127.0.0.1:11110"})
+			send()
+		}
+		// wait until the fast backend has everything it will get
+		for last := int64(-1); ; time.Sleep(10 * time.Millisecond) {
+			n := atomic.LoadInt64(fastCount)
+			if n >= int64(b.N) || n == last {
+				break
+			}
+			last = n
+		}
+		b.StopTimer()
+
+		elapsed := time.Since(start).Seconds()
+		b.ReportMetric(float64(atomic.LoadInt64(fastCount))/elapsed, "fast-datagrams/s")
+		b.ReportMetric(float64(atomic.LoadInt64(slowCount))/elapsed, "slow-datagrams/s")
+	}
+
+	b.Run("queued", func(b *testing.B) {
+		run(b, func(n *testnet.Network, slow, fast string) func() {
+			svc := NewService(client.ServiceConfig{
+				Name:    "udp",
+				Addr:    "127.0.0.1:11110",
+				Network: "udp",
+				Backends: []client.BackendConfig{
+					{Name: "slow", Addr: slow, Network: "udp"},
+					{Name: "fast", Addr: fast, Network: "udp"},
+				},
+			})
+			svc.ListenerFactory = n
+			if err := svc.start(); err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(svc.stop)
+			return func() {}
+		})
+	})
+
+	b.Run("coupled", func(b *testing.B) {
+		run(b, func(n *testnet.Network, slow, fast string) func() {
+			l, err := n.ListenPacket("udp", "127.0.0.1:11110")
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { l.Close() })
+
+			backends := []testnet.Addr{{Net: "udp", Address: slow}, {Net: "udp", Address: fast}}
+			next := 0
+			buff := make([]byte, 1024)
+			// read and send each datagram in turn
+			return func() {
+				n, _, err := l.ReadFrom(buff)
+				if err != nil {
+					b.Fatal(err)
+				}
+				l.WriteTo(buff[:n], backends[next])
+				next = (next + 1) % len(backends)
+			}
+		})
+	})
+}
+
+// Forward datagrams from several clients over real sockets, and report the
+// rate the backend receives them. "single" reads one datagram at a time on
+// one worker, as forwarding did before batches and workers, and "batched"
+// reads batches on GOMAXPROCS workers.
+func BenchmarkUDPReaders(b *testing.B) {
+	const clients = 8
+
+	run := func(b *testing.B, workers, batch int) {
+		defer func(size int) { udpBatchSize = size }(udpBatchSize)
+		udpBatchSize = batch
+
+		backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer backend.Close()
+		received := new(int64)
+		go func() {
+			buff := make([]byte, 1024)
+			for {
+				if _, _, err := backend.ReadFrom(buff); err != nil {
+					return
+				}
+				atomic.AddInt64(received, 1)
+			}
+		}()
+
+		svc := NewService(client.ServiceConfig{
+			Name:       "udp",
+			Addr:       "127.0.0.1:11110",
+			Network:    "udp",
+			UDPWorkers: workers,
+			Backends: []client.BackendConfig{
+				{Name: "b0", Addr: backend.LocalAddr().String(), Network: "udp"},
+			},
+		})
+		if err := svc.start(); err != nil {
+			b.Fatal(err)
+		}
+		defer svc.stop()
+
+		var wg sync.WaitGroup
+		start := time.Now()
+		b.ResetTimer()
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.Dial("udp", "127.0.0.1:11110")
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer conn.Close()
+				msg := []byte("TEST")
+				for j := 0; j < b.N/clients+1; j++ {
+					conn.Write(msg)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// wait until the backend has everything it will get
+		for last := int64(-1); ; time.Sleep(10 * time.Millisecond) {
+			n := atomic.LoadInt64(received)
+			if n >= int64(b.N) || n == last {
+				break
+			}
+			last = n
+		}
+		b.StopTimer()
+
+		elapsed := time.Since(start).Seconds()
+		b.ReportMetric(float64(atomic.LoadInt64(received))/elapsed, "datagrams/s")
+	}
+
+	b.Run("single", func(b *testing.B) {
+		run(b, 1, 1)
+	})
+	b.Run("batched", func(b *testing.B) {
+		run(b, runtime.GOMAXPROCS(0), udpBatchSize)
+	})
+}
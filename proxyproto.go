@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var (
+	ErrInvalidProxyProtocol = fmt.Errorf("invalid proxy protocol")
+	ErrProxyHeader          = fmt.Errorf("invalid PROXY protocol header")
+)
+
+const (
+	// The longest v1 header, including the CRLF, from the spec
+	maxProxyV1Len = 107
+	// The time a client has to send its whole header
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+// The signature that starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Check the SendProxyProtocol setting of a service config. The header
+// describes the client of one connection, so it can't be sent on connections
+// that are shared by mux, and there's no connection to send it on for UDP.
+func validProxyProtocol(cfg client.ServiceConfig) error {
+	switch cfg.SendProxyProtocol {
+	case "":
+		return nil
+	case client.ProxyProtocolV1, client.ProxyProtocolV2:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidProxyProtocol, cfg.SendProxyProtocol)
+	}
+	if cfg.Network != "" && networkFamily(cfg.Network) != "tcp" {
+		return fmt.Errorf("%w: requires a tcp service", ErrInvalidProxyProtocol)
+	}
+	if cfg.MuxConns > 0 {
+		return fmt.Errorf("%w: can't be sent over mux connections", ErrInvalidProxyProtocol)
+	}
+	return nil
+}
+
+// Check the AcceptProxyProtocol setting, which only a tcp service can use.
+func validAcceptProxyProtocol(cfg client.ServiceConfig) error {
+	if cfg.AcceptProxyProtocol && cfg.Network != "" && networkFamily(cfg.Network) != "tcp" {
+		return fmt.Errorf("%w: accepting requires a tcp service", ErrInvalidProxyProtocol)
+	}
+	return nil
+}
+
+// The client connection a PROXY header describes: the client's address, and
+// the address it connected to.
+type proxyClient struct {
+	src, dst clientAddr
+}
+
+type proxyClientKey struct{}
+
+// Return a request context carrying the addresses of the client connection,
+// for the header written by DialContext.
+func withProxyClient(r *http.Request) context.Context {
+	pc := proxyClient{src: normalizeClientAddr(r.RemoteAddr)}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		pc.dst = normalizeClientAddr(addr.String())
+	}
+	return context.WithValue(r.Context(), proxyClientKey{}, pc)
+}
+
+// Build the PROXY protocol header for a client connection. The header is
+// "UNKNOWN" when either address isn't an IP and port, such as a client on a
+// unix socket, and the backend uses the connection's own addresses.
+func proxyHeader(version string, pc proxyClient) []byte {
+	src, dst := pc.src.IP, pc.dst.IP
+	sport, serr := strconv.ParseUint(pc.src.Port, 10, 16)
+	dport, derr := strconv.ParseUint(pc.dst.Port, 10, 16)
+	known := src != nil && dst != nil && serr == nil && derr == nil
+
+	// both addresses have to be in the same family, so an IPv4 address is
+	// mapped if the other is IPv6
+	v4 := known && src.To4() != nil && dst.To4() != nil
+	if v4 {
+		src, dst = src.To4(), dst.To4()
+	} else if known {
+		src, dst = src.To16(), dst.To16()
+	}
+
+	if version == client.ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		proto := "TCP6"
+		if v4 {
+			proto = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			proto, proxyV1Addr(src, v4), proxyV1Addr(dst, v4), sport, dport))
+	}
+
+	hdr := make([]byte, 16, 16+36)
+	copy(hdr, proxyV2Signature)
+	// version 2, PROXY command
+	hdr[12] = 0x21
+	switch {
+	case !known:
+		// AF_UNSPEC, with no addresses
+		hdr[13] = 0x00
+	case v4:
+		// TCP over IPv4
+		hdr[13] = 0x11
+		hdr = append(hdr, src...)
+		hdr = append(hdr, dst...)
+	default:
+		// TCP over IPv6
+		hdr[13] = 0x21
+		hdr = append(hdr, src...)
+		hdr = append(hdr, dst...)
+	}
+	if known {
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(sport))
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(dport))
+	}
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(hdr)-16))
+	return hdr
+}
+
+// Format an address for a v1 header. IPv6 addresses are written without
+// brackets or a zone, and an IPv4 address in a TCP6 header is written in its
+// mapped form, which net.IP would print as plain IPv4.
+func proxyV1Addr(ip net.IP, v4 bool) string {
+	if !v4 {
+		if ip4 := ip.To4(); ip4 != nil {
+			return "::ffff:" + ip4.String()
+		}
+	}
+	return ip.String()
+}
+
+// Write the PROXY header for a client to a new backend connection, before
+// anything else is sent on it. The write is bounded by the dial timeout.
+func writeProxyHeader(conn net.Conn, version string, pc proxyClient, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	_, err := conn.Write(proxyHeader(version, pc))
+	return err
+}
+
+// A client connection that arrived through a load balancer sending the PROXY
+// protocol. The header has been read, and the addresses it gave replace the
+// connection's own. Data read past the header is kept in br.
+type proxiedConn struct {
+	net.Conn
+	br     *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if c.br != nil {
+		if c.br.Buffered() > 0 {
+			return c.br.Read(b)
+		}
+		c.br = nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxiedConn) CloseRead() error {
+	if cr, ok := c.Conn.(closeReader); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+// Read the v1 or v2 PROXY header a client connection starts with, and return
+// the connection with the addresses it gave. Headers for a LOCAL connection,
+// or with addresses that aren't TCP, keep the connection's own addresses.
+func acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		// a v1 header may be shorter than the v2 signature, but never
+		// shorter than "PROXY UNKNOWN\r\n"
+		return nil, fmt.Errorf("%w: %s", ErrProxyHeader, err)
+	}
+
+	pc := &proxiedConn{Conn: conn, br: br}
+	if bytes.Equal(sig, proxyV2Signature) {
+		pc.remote, pc.local, err = readProxyV2(br)
+	} else {
+		pc.remote, pc.local, err = readProxyV1(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func readProxyV1(br *bufio.Reader) (src, dst net.Addr, err error) {
+	line := make([]byte, 0, maxProxyV1Len)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrProxyHeader, err)
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+		if len(line) == maxProxyV1Len {
+			return nil, nil, fmt.Errorf("%w: no CRLF in %d bytes", ErrProxyHeader, maxProxyV1Len)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("%w: no CRLF", ErrProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	if fields[1] == "UNKNOWN" {
+		// the rest of the line is ignored
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, serr := strconv.ParseUint(fields[4], 10, 16)
+	dport, derr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || serr != nil || derr != nil {
+		return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	// TCP4 addresses must be dotted quads, and TCP6 addresses can't be
+	v4 := fields[1] == "TCP4"
+	for _, addr := range fields[2:4] {
+		if strings.Contains(addr, ":") == v4 {
+			return nil, nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+		}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(sport)}, &net.TCPAddr{IP: dstIP, Port: int(dport)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (src, dst net.Addr, err error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrProxyHeader, err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: version %d", ErrProxyHeader, hdr[12]>>4)
+	}
+	cmd, family := hdr[12]&0x0f, hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrProxyHeader, err)
+	}
+
+	switch cmd {
+	case 0x0:
+		// LOCAL, such as the load balancer's own health checks
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("%w: command %d", ErrProxyHeader, cmd)
+	}
+
+	var ipLen int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// anything else keeps the connection's addresses, and any
+		// addresses given are skipped
+		return nil, nil, nil
+	}
+
+	// the addresses may be followed by TLVs, which are skipped
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("%w: %d bytes of addresses for family %#x", ErrProxyHeader, len(body), family)
+	}
+	srcIP := net.IP(body[:ipLen])
+	dstIP := net.IP(body[ipLen : 2*ipLen])
+	ports := body[2*ipLen:]
+	src = &net.TCPAddr{IP: srcIP, Port: int(binary.BigEndian.Uint16(ports[0:2]))}
+	dst = &net.TCPAddr{IP: dstIP, Port: int(binary.BigEndian.Uint16(ports[2:4]))}
+	return src, dst, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidRateLimit = fmt.Errorf("invalid rate limit")
+
+// The most client IPs each service tracks for MaxConnsPerClient. The least
+// recently seen client is forgotten to make room for a new one, and starts
+// with a full bucket if it returns.
+var rateLimitClients = 4096
+
+// A token bucket holding up to a second's worth of tokens at its rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Add the tokens earned since the last refill, up to the rate.
+func (b *tokenBucket) refill(rate int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+}
+
+type clientBucket struct {
+	ip string
+	tokenBucket
+}
+
+// rateLimiter limits the rate of a service's new connections and HTTP
+// requests, in total and from each client IP.
+type rateLimiter struct {
+	sync.Mutex
+	perSecond int
+	perClient int
+
+	service tokenBucket
+
+	// an LRU of the buckets of recent clients
+	size    int
+	lru     *list.List
+	clients map[string]*list.Element
+}
+
+func newRateLimiter(size int) *rateLimiter {
+	return &rateLimiter{
+		size:    size,
+		lru:     list.New(),
+		clients: make(map[string]*list.Element),
+	}
+}
+
+// Check the limits of a service config, which are off when 0.
+func validRateLimits(cfg client.ServiceConfig) error {
+	if cfg.MaxConnsPerSecond < 0 || cfg.MaxConnsPerClient < 0 {
+		return fmt.Errorf("%w: negative value", ErrInvalidRateLimit)
+	}
+	if (cfg.MaxConnsPerSecond > 0 || cfg.MaxConnsPerClient > 0) && networkFamily(cfg.Network) == "udp" {
+		return fmt.Errorf("%w: %q service", ErrInvalidRateLimit, cfg.Network)
+	}
+	return nil
+}
+
+// Change the limits. The buckets are kept, so clients that have used up
+// their tokens don't get a fresh burst from an update.
+func (l *rateLimiter) set(perSecond, perClient int) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.perSecond, l.perClient = perSecond, perClient
+	if perClient == 0 {
+		l.lru.Init()
+		l.clients = make(map[string]*list.Element)
+	}
+}
+
+func (l *rateLimiter) limits() (int, int) {
+	l.Lock()
+	defer l.Unlock()
+	return l.perSecond, l.perClient
+}
+
+// Report whether a new connection or request from ip is within the limits,
+// and take a token from the service's and the client's buckets if it is.
+// A client without an IP, like one on a unix socket, is only limited by the
+// service's rate.
+func (l *rateLimiter) allow(ip net.IP) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.perSecond == 0 && (l.perClient == 0 || ip == nil) {
+		return true
+	}
+	now := time.Now()
+
+	if l.perSecond > 0 {
+		l.service.refill(l.perSecond, now)
+		if l.service.tokens < 1 {
+			return false
+		}
+	}
+
+	var cb *clientBucket
+	if l.perClient > 0 && ip != nil {
+		cb = l.client(ip.String())
+		cb.refill(l.perClient, now)
+		if cb.tokens < 1 {
+			return false
+		}
+		cb.tokens--
+	}
+	if l.perSecond > 0 {
+		l.service.tokens--
+	}
+	return true
+}
+
+// Return the bucket for a client, adding it if it's new.
+// rateLimiter *must* be locked.
+func (l *rateLimiter) client(ip string) *clientBucket {
+	if el := l.clients[ip]; el != nil {
+		l.lru.MoveToFront(el)
+		return el.Value.(*clientBucket)
+	}
+
+	cb := &clientBucket{ip: ip}
+	l.clients[ip] = l.lru.PushFront(cb)
+	for l.lru.Len() > l.size {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.clients, oldest.Value.(*clientBucket).ip)
+	}
+	return cb
+}
+
+// The number of clients being tracked.
+func (l *rateLimiter) tracked() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.lru.Len()
+}
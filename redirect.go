@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidRedirect = fmt.Errorf("invalid redirect")
+
+// placeholders allowed in a redirect target
+var redirectVars = map[string]bool{
+	"host":  true,
+	"path":  true,
+	"query": true,
+}
+
+// A redirectRule is a validated client.RedirectConfig, with a count of the
+// requests it has redirected.
+type redirectRule struct {
+	client.RedirectConfig
+	Count int64
+}
+
+func newRedirectRules(cfgs []client.RedirectConfig) ([]*redirectRule, error) {
+	rules := []*redirectRule{}
+	for i, cfg := range cfgs {
+		if err := validRedirect(cfg); err != nil {
+			return nil, fmt.Errorf("%w %d: %s", ErrInvalidRedirect, i, err)
+		}
+		if cfg.Status == 0 {
+			cfg.Status = http.StatusMovedPermanently
+		}
+		rules = append(rules, &redirectRule{RedirectConfig: cfg})
+	}
+	return rules, nil
+}
+
+// Check the status code, and that every {placeholder} in the target is
+// known and closed.
+func validRedirect(cfg client.RedirectConfig) error {
+	switch cfg.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, 308:
+	default:
+		return fmt.Errorf("status %d is not a redirect", cfg.Status)
+	}
+
+	if cfg.Target == "" {
+		return fmt.Errorf("no target")
+	}
+
+	target := cfg.Target
+	for {
+		open := strings.IndexAny(target, "{}")
+		if open < 0 {
+			return nil
+		}
+		if target[open] == '}' {
+			return fmt.Errorf("unmatched '}' in target")
+		}
+
+		end := strings.IndexAny(target[open+1:], "{}")
+		if end < 0 || target[open+1+end] == '{' {
+			return fmt.Errorf("unclosed '{' in target")
+		}
+
+		name := target[open+1 : open+1+end]
+		if !redirectVars[name] {
+			return fmt.Errorf("unknown placeholder {%s} in target", name)
+		}
+		target = target[open+end+2:]
+	}
+}
+
+// Report whether the service only redirects, having redirect rules but no
+// backends. It doesn't need any backends to be healthy.
+func (s *Service) redirectOnly() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.Backends) == 0 && len(s.redirects) > 0
+}
+
+// Check if the rule applies to the request.
+func (r *redirectRule) match(req *http.Request) bool {
+	if r.Host != "" {
+		host := requestHost(req)
+		if strings.HasPrefix(r.Host, "*.") {
+			if !strings.HasSuffix(host, strings.ToLower(r.Host[1:])) {
+				return false
+			}
+		} else if host != strings.ToLower(r.Host) {
+			return false
+		}
+	}
+
+	return strings.HasPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// Build the redirect location for the request.
+func (r *redirectRule) location(req *http.Request) string {
+	loc := strings.NewReplacer(
+		"{host}", requestHost(req),
+		"{path}", req.URL.Path,
+		"{query}", req.URL.RawQuery,
+	).Replace(r.Target)
+
+	if r.PreserveQuery && req.URL.RawQuery != "" {
+		if strings.Contains(loc, "?") {
+			loc += "&" + req.URL.RawQuery
+		} else {
+			loc += "?" + req.URL.RawQuery
+		}
+	}
+	return loc
+}
+
+func (r *redirectRule) stat() RedirectStat {
+	return RedirectStat{
+		RedirectConfig: r.RedirectConfig,
+		Count:          atomic.LoadInt64(&r.Count),
+	}
+}
+
+// The lowercase request host, without the port.
+func requestHost(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
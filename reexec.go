@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// A re-exec upgrades the shuttle binary in place. On SIGUSR2 the running
+// shuttle (the parent) starts the binary again with the same arguments,
+// passing it every listener as an inherited descriptor. The child adopts
+// them as it loads the state config, and once it's accepting on all of them
+// it writes to a pipe it also inherits, and the parent stops accepting,
+// drains and exits. If the child exits or never becomes ready, the parent
+// keeps running with all of its listeners.
+
+// The environment of the child, describing the descriptors it inherits.
+const (
+	reexecListenersEnv = "SHUTTLE_LISTENER_FDS"
+	reexecReadyEnv     = "SHUTTLE_READY_FD"
+)
+
+// The first descriptor after stdin, stdout and stderr.
+const firstExtraFD = 3
+
+// How long the parent waits for the child to be ready.
+var reexecTimeout = 60 * time.Second
+
+var ErrReexecNotReady = fmt.Errorf("new shuttle exited before it was ready")
+
+// A listener passed to the child, and its descriptor there.
+type reexecListener struct {
+	TakeoverListener
+	FD int `json:"fd"`
+}
+
+// Start the binary again with the listeners of source, and hand it over if
+// the new shuttle becomes ready.
+func reexec(source *takeoverSource) error {
+	if err := startTakeover(source.state); err != nil {
+		return err
+	}
+
+	err := source.reexec()
+	// anything not released stays ours
+	source.state.finish(err, HandoffSent, HandoffKept)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("New shuttle is ready, draining and exiting")
+	if source.exit != nil {
+		source.exit()
+	}
+	return nil
+}
+
+func (t *takeoverSource) reexec() error {
+	// the child loads its services from the state config
+	writeStateConfig()
+	logFiles.flush()
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	listeners := t.inventory()
+	if t.admin != nil {
+		if addr := t.admin.ListenAddr(); addr != nil {
+			listeners = append(listeners, TakeoverListener{
+				Kind:    "admin",
+				Name:    addr.Network(),
+				Network: addr.Network(),
+				Addr:    t.admin.Addr,
+			})
+		}
+	}
+
+	var passed []reexecListener
+	for _, l := range listeners {
+		f, err := t.listenerFile(l)
+		if err != nil {
+			log.Warnf("WARN: not passing %s to the new shuttle: %s", l.key(), err)
+			t.state.set(l, HandoffKept)
+			continue
+		}
+		passed = append(passed, reexecListener{TakeoverListener: l, FD: firstExtraFD + len(files)})
+		files = append(files, f)
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	readyFD := firstExtraFD + len(files)
+	files = append(files, readyW)
+
+	spec, err := json.Marshal(passed)
+	if err != nil {
+		return err
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		path = os.Args[0]
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		reexecListenersEnv+"="+string(spec),
+		reexecReadyEnv+"="+strconv.Itoa(readyFD),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Started new shuttle %s as pid %d with %d listeners", path, cmd.Process.Pid, len(passed))
+	for _, l := range passed {
+		t.state.set(l.TakeoverListener, HandoffSent)
+	}
+
+	// only the child holds the write end now, so its exit ends the read
+	readyW.Close()
+	files = files[:len(files)-1]
+
+	if err := awaitReady(ready, reexecTimeout); err != nil {
+		cmd.Process.Kill()
+		goTask("reexec_wait", "", func() { cmd.Wait() })
+		return err
+	}
+	goTask("reexec_wait", "", func() { cmd.Wait() })
+
+	for _, l := range passed {
+		t.release(l.TakeoverListener)
+		t.state.set(l.TakeoverListener, HandoffReleased)
+	}
+	return nil
+}
+
+// Wait for the byte a new shuttle writes once it's ready.
+func awaitReady(ready *os.File, timeout time.Duration) error {
+	ready.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1)
+	_, err := ready.Read(buf)
+	if err == io.EOF {
+		return ErrReexecNotReady
+	}
+	return err
+}
+
+var reexecOnSignal sync.Once
+
+// Re-exec the binary on SIGUSR2.
+func handleReexecSignal() {
+	reexecOnSignal.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR2)
+		goTask("signals", "", func() {
+			for sig := range sigs {
+				if shutdown.Stage() != "" {
+					continue
+				}
+				log.Printf("Received %s, starting a new shuttle", sig)
+				source := newTakeoverSource(&Registry, currentRouters(), takeoverExit)
+				source.admin = adminServer
+				if err := reexec(source); err != nil {
+					log.Errorf("ERROR: re-exec: %s", err)
+				}
+			}
+		})
+	})
+}
+
+// reexecTarget adopts the listeners inherited from the shuttle that started
+// this one. Its factory is the default from when it's created, so the
+// services and routers find their listeners as they start, and its finisher
+// is started after them to tell the parent this shuttle is ready.
+type reexecTarget struct {
+	factory   *inheritedListeners
+	listeners []TakeoverListener
+	ready     *os.File
+	state     *takeoverState
+	err       error
+	finished  chan struct{}
+}
+
+// Adopt the descriptors described by the environment, returning nil if this
+// shuttle wasn't started by another.
+func newReexecTarget() (*reexecTarget, error) {
+	spec := os.Getenv(reexecListenersEnv)
+	if spec == "" {
+		return nil, nil
+	}
+	readyFD, err := strconv.Atoi(os.Getenv(reexecReadyEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", reexecReadyEnv, err)
+	}
+	// the grandchildren of a later re-exec get their own
+	os.Unsetenv(reexecListenersEnv)
+	os.Unsetenv(reexecReadyEnv)
+	return adoptListeners(spec, readyFD)
+}
+
+func adoptListeners(spec string, readyFD int) (*reexecTarget, error) {
+	var passed []reexecListener
+	if err := json.Unmarshal([]byte(spec), &passed); err != nil {
+		return nil, fmt.Errorf("%s: %s", reexecListenersEnv, err)
+	}
+
+	t := &reexecTarget{
+		factory:  newInheritedListeners(defaultListenerFactory),
+		ready:    os.NewFile(uintptr(readyFD), "ready"),
+		state:    newTakeoverState("target"),
+		finished: make(chan struct{}),
+	}
+	if err := startTakeover(t.state); err != nil {
+		return nil, err
+	}
+	defaultListenerFactory = t.factory
+
+	for _, l := range passed {
+		t.listeners = append(t.listeners, l.TakeoverListener)
+		if err := t.factory.add(l.TakeoverListener, os.NewFile(uintptr(l.FD), l.key())); err != nil {
+			t.state.set(l.TakeoverListener, HandoffFailed)
+			continue
+		}
+		t.state.set(l.TakeoverListener, HandoffSent)
+	}
+	log.Printf("Inherited %d listeners", len(passed))
+	return t, nil
+}
+
+// Check that every inherited listener is in use, and tell the parent to
+// drain and exit if they are. Otherwise the parent keeps them, and this
+// shuttle should exit.
+func (t *reexecTarget) finish() error {
+	defer close(t.finished)
+	defer t.ready.Close()
+
+	for _, l := range t.listeners {
+		if t.state.get(l) != HandoffSent {
+			t.err = fmt.Errorf("%s: listener couldn't be inherited", l.key())
+			continue
+		}
+		if !t.factory.taken(l.Addr) {
+			t.state.set(l, HandoffFailed)
+			if t.err == nil {
+				t.err = fmt.Errorf("%s: not listening on %s", l.key(), l.Addr)
+			}
+			continue
+		}
+		t.state.set(l, HandoffAdopted)
+	}
+
+	if t.err == nil {
+		_, t.err = t.ready.Write([]byte{1})
+	}
+	t.state.finish(t.err, HandoffSent, HandoffFailed)
+	return t.err
+}
+
+// The Runner that finishes the re-exec, started after the http routers.
+func (t *reexecTarget) finisher() Runner {
+	return reexecFinisher{t}
+}
+
+type reexecFinisher struct {
+	t *reexecTarget
+}
+
+func (f reexecFinisher) Start(ctx context.Context) error {
+	return f.t.finish()
+}
+
+func (f reexecFinisher) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (f reexecFinisher) Ready() <-chan struct{} {
+	return f.t.finished
+}
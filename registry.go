@@ -1,23 +1,91 @@
 package main
 
 import (
+	"crypto/sha1"
 	"fmt"
+	"net"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
 var (
-	ErrNoService        = fmt.Errorf("service does not exist")
-	ErrNoBackend        = fmt.Errorf("backend does not exist")
-	ErrDuplicateService = fmt.Errorf("service already exists")
-	ErrDuplicateBackend = fmt.Errorf("backend already exists")
+	ErrNoService         = fmt.Errorf("service does not exist")
+	ErrNoBackend         = fmt.Errorf("backend does not exist")
+	ErrDuplicateService  = fmt.Errorf("service already exists")
+	ErrDuplicateBackend  = fmt.Errorf("backend already exists")
+	ErrNoCheckAddr       = fmt.Errorf("backend has no check address")
+	ErrInvalidBackend    = fmt.Errorf("invalid backend")
+	ErrBackendModified   = fmt.Errorf("backend was modified")
+	ErrInvalidHeaderMax  = fmt.Errorf("invalid max_header_bytes")
+	ErrInvalidWeight     = fmt.Errorf("invalid weight")
+	ErrInvalidCheck      = fmt.Errorf("invalid health check")
+	ErrInvalidAdminState = fmt.Errorf("invalid admin state")
 )
 
+// Check that a service or backend name can be used in the admin API.
+// Names are case sensitive, and may contain anything other than a slash,
+// whitespace or control characters. Names starting with "_" are reserved for
+// API endpoints.
+func validName(name string) error {
+	if name == "" {
+		return fmt.Errorf("invalid name: name is empty")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	if strings.HasPrefix(name, "_") {
+		return fmt.Errorf("invalid name %q: names starting with '_' are reserved", name)
+	}
+	for _, r := range name {
+		if r == '/' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return fmt.Errorf("invalid name %q: contains %q", name, r)
+		}
+	}
+	return nil
+}
+
+// Check the service name, and the names of any backends.
+// Backends from a config may be unnamed, so only the names that are set are
+// checked.
+func validServiceNames(svcCfg client.ServiceConfig) error {
+	if err := validName(svcCfg.Name); err != nil {
+		return err
+	}
+	for _, b := range svcCfg.Backends {
+		if b.Name == "" {
+			continue
+		}
+		if err := validName(b.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the names which are close to name, either differing only in case,
+// or by a couple of characters.
+func similarNames(name string, names []string) []string {
+	var similar []string
+	for _, n := range names {
+		if n == name {
+			continue
+		}
+		if strings.EqualFold(n, name) || editDistance(strings.ToLower(n), strings.ToLower(name)) <= 2 {
+			similar = append(similar, n)
+		}
+	}
+	sort.Strings(similar)
+	return similar
+}
+
 type multiError struct {
 	errors []error
 }
@@ -42,6 +110,30 @@ func (e multiError) String() string {
 	return e.Error()
 }
 
+func (e multiError) Unwrap() []error {
+	return e.errors
+}
+
+// ServiceError is the failure to add or update one of the services in a
+// config.
+type ServiceError struct {
+	Service string
+	// the config field at fault, if it's known
+	Field string
+	Err   error
+}
+
+func (e *ServiceError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Service, e.Field, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Service, e.Err)
+}
+
+func (e *ServiceError) Unwrap() error {
+	return e.Err
+}
+
 type VirtualHost struct {
 	sync.Mutex
 	Name string
@@ -102,7 +194,14 @@ func (v *VirtualHost) Remove(svc *Service) {
 		log.Printf("Removing backend http://%s from VirtualHost %s", backend.Addr, v.Name)
 	}
 
-	v.services = append(v.services[:found], v.services[found+1:]...)
+	// clear the last slot, so the removed service isn't kept reachable
+	last := len(v.services) - 1
+	copy(v.services[found:], v.services[found+1:])
+	v.services[last] = nil
+	v.services = v.services[:last]
+	if v.last >= last {
+		v.last = 0
+	}
 }
 
 // Return a *Service for this VirtualHost
@@ -129,6 +228,13 @@ func (v *VirtualHost) Service() *Service {
 	return v.services[v.last]
 }
 
+// Return all services registered for this VirtualHost
+func (v *VirtualHost) Services() []*Service {
+	v.Lock()
+	defer v.Unlock()
+	return append([]*Service(nil), v.services...)
+}
+
 //TODO: notify or prevent vhost name conflicts between services.
 // ServiceRegistry is a global container for all configured services.
 type ServiceRegistry struct {
@@ -139,17 +245,75 @@ type ServiceRegistry struct {
 
 	// Global config to apply to new services.
 	cfg client.Config
+
+	// old names of renamed services
+	renamed map[string]serviceRename
+
+	// changed each time a vhost is added or removed, used atomically
+	vhostGen uint64
+
+	// the latest snapshot of the services /_health finds unhealthy
+	healthMu sync.Mutex
+	health   *healthSnapshot
 }
 
 // Update the global config state, including services and backends.
 // This does not remove any Services, but will add or update any provided in
-// the config.
+// the config. The whole config is validated before any of it is applied, and
+// if a service then fails to apply, the changes already made are rolled back
+// and the error names that service.
 func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
+	if err := s.ValidateConfig(cfg); err != nil {
+		return err
+	}
 
-	// Set globals
 	// TODO: we might need to unset something
 	// TODO: this should remove services and backends to match the submitted config
 
+	// the access log is only replaced once the services are applied
+	var globalLog *accessLog
+	if cfg.AccessLog != nil {
+		l, err := newAccessLog(cfg.AccessLog)
+		if err != nil {
+			return err
+		}
+		globalLog = l
+	}
+
+	s.Lock()
+	prev := s.cfg
+	s.setGlobals(cfg, globalLog != nil)
+	s.Unlock()
+
+	undo := configUndo{func() {
+		s.Lock()
+		s.cfg = prev
+		s.updateHeaderLimits()
+		s.updateTaskThresholds()
+		s.Unlock()
+	}}
+
+	for _, svc := range cfg.Services {
+		if err := s.applyService(svc, &undo); err != nil {
+			log.Errorf("ERROR: Unable to apply service %s, rolling back the config: %s", svc.Name, err)
+			undo.run()
+			globalLog.close()
+			return &ServiceError{Service: svc.Name, Field: serviceErrorField(err), Err: err}
+		}
+	}
+
+	if cfg.AccessLog != nil {
+		setGlobalAccessLog(globalLog)
+	}
+	goTask("state_write", "", writeStateConfig)
+	return nil
+}
+
+// Set the global settings of a validated config. Settings that aren't set
+// keep their current values. opened is whether the config's access log was
+// opened, rather than turned off.
+// Registry *must* be locked.
+func (s *ServiceRegistry) setGlobals(cfg client.Config, opened bool) {
 	if cfg.Balance != "" {
 		s.cfg.Balance = cfg.Balance
 	}
@@ -171,50 +335,59 @@ func (s *ServiceRegistry) UpdateConfig(cfg client.Config) error {
 	if cfg.DialTimeout != 0 {
 		s.cfg.DialTimeout = cfg.DialTimeout
 	}
-
-	// apply the https rediect flag
-	if httpsRedirect {
-		s.cfg.HTTPSRedirect = true
+	if cfg.TimeoutPolicy != "" {
+		s.cfg.TimeoutPolicy = cfg.TimeoutPolicy
 	}
-
-	invalidPorts := []string{
-		// FIXME: lookup bound addresses some other way.  We may have multiple
-		//        http listeners, as well as all listening Services.
-		// listenAddr[strings.Index(listenAddr, ":")+1:],
-		adminListenAddr[strings.Index(adminListenAddr, ":")+1:],
+	if cfg.ShutdownTimeout != 0 {
+		s.cfg.ShutdownTimeout = cfg.ShutdownTimeout
 	}
-
-	errors := &multiError{}
-
-	for _, svc := range cfg.Services {
-		for _, port := range invalidPorts {
-			if strings.HasSuffix(svc.Addr, port) {
-				// TODO: report conflicts between service listeners
-				errors.Add(fmt.Errorf("Port conflict: %s port %s already bound by shuttle", svc.Name, port))
-				continue
-			}
+	if cfg.ShadowBalance != "" {
+		s.cfg.ShadowBalance = cfg.ShadowBalance
+	}
+	if cfg.AccessLog != nil {
+		// an empty path turns the global access log off
+		s.cfg.AccessLog = nil
+		if opened {
+			s.cfg.AccessLog = cfg.AccessLog
 		}
-
-		// Add a new service, or update an existing one.
-		if Registry.GetService(svc.Name) == nil {
-			if err := Registry.AddService(svc); err != nil {
-				log.Errorln("Unable to add service %s: %s", svc.Name, err.Error())
-				errors.Add(err)
-				continue
-			}
-		} else if err := Registry.UpdateService(svc); err != nil {
-			log.Errorln("Unable to update service %s: %s", svc.Name, err.Error())
-			errors.Add(err)
-			continue
+	}
+	if cfg.UnknownSNI != "" {
+		s.cfg.UnknownSNI = cfg.UnknownSNI
+	}
+	if cfg.Overlays != nil {
+		s.cfg.Overlays = cfg.Overlays
+	}
+	if cfg.HealthServices != nil {
+		s.cfg.HealthServices = cfg.HealthServices
+	}
+	if cfg.HealthMinUpPercent != 0 {
+		s.cfg.HealthMinUpPercent = cfg.HealthMinUpPercent
+	}
+	if cfg.MaxHeaderBytes != 0 {
+		s.cfg.MaxHeaderBytes = cfg.MaxHeaderBytes
+		s.updateHeaderLimits()
+	}
+	if cfg.TaskWarnThreshold != 0 || cfg.TaskWarnThresholds != nil {
+		if cfg.TaskWarnThreshold != 0 {
+			s.cfg.TaskWarnThreshold = cfg.TaskWarnThreshold
 		}
+		if cfg.TaskWarnThresholds != nil {
+			s.cfg.TaskWarnThresholds = cfg.TaskWarnThresholds
+		}
+		s.updateTaskThresholds()
 	}
 
-	go writeStateConfig()
-
-	if errors.Len() == 0 {
-		return nil
+	// apply the https rediect flag
+	if httpsRedirect {
+		s.cfg.HTTPSRedirect = true
 	}
-	return errors
+}
+
+// Return a copy of the scheduled overlays.
+func (s *ServiceRegistry) Overlays() []client.OverlayConfig {
+	s.Lock()
+	defer s.Unlock()
+	return append([]client.OverlayConfig(nil), s.cfg.Overlays...)
 }
 
 // Return a service by name.
@@ -226,15 +399,38 @@ func (s *ServiceRegistry) GetService(name string) *Service {
 
 // Return a service that handles a particular vhost by name.
 func (s *ServiceRegistry) GetVHostService(name string) *Service {
+	name = requestVHost(name)
+
 	s.Lock()
 	defer s.Unlock()
 
-	if vhost := s.vhosts[name]; vhost != nil {
+	if vhost := s.lookupVHost(name); vhost != nil {
 		return vhost.Service()
 	}
 	return nil
 }
 
+// Return the vhost routing a canonical request host, which may be a
+// wildcard, or nil if none does.
+// Registry *must* be locked.
+func (s *ServiceRegistry) lookupVHost(host string) *VirtualHost {
+	name := matchVHost(host, func(name string) bool {
+		return s.vhosts[name] != nil
+	})
+	return s.vhosts[name]
+}
+
+// VHostGeneration returns a value that changes whenever a vhost is added or
+// removed, to tell if a failed lookup is still current.
+func (s *ServiceRegistry) VHostGeneration() uint64 {
+	return atomic.LoadUint64(&s.vhostGen)
+}
+
+// Registry *must* be locked.
+func (s *ServiceRegistry) vhostsChanged() {
+	atomic.AddUint64(&s.vhostGen, 1)
+}
+
 func (s *ServiceRegistry) VHostsLen() int {
 	s.Lock()
 	defer s.Unlock()
@@ -248,6 +444,132 @@ func (s *ServiceRegistry) AddService(svcCfg client.ServiceConfig) error {
 	defer s.Unlock()
 
 	log.Debug("Adding service:", svcCfg.Name)
+	if err := validServiceNames(svcCfg); err != nil {
+		return err
+	}
+	if _, err := parsePortRange(svcCfg.CheckSourcePorts); err != nil {
+		return err
+	}
+	if _, err := newRedirectRules(svcCfg.Redirects); err != nil {
+		return err
+	}
+	if _, err := newRouteRules(svcCfg.Routes); err != nil {
+		return err
+	}
+	if _, err := newHeaderRewriter(svcCfg); err != nil {
+		return err
+	}
+	if _, err := newHTTPSRedirects(svcCfg); err != nil {
+		return err
+	}
+	if _, err := newErrorConditions(svcCfg.ErrorPageConditions); err != nil {
+		return err
+	}
+	if err := validMux(svcCfg); err != nil {
+		return err
+	}
+	if err := validNetworks(&svcCfg); err != nil {
+		return err
+	}
+	if err := validSocketMode(svcCfg); err != nil {
+		return err
+	}
+	if err := validRateLimits(svcCfg); err != nil {
+		return err
+	}
+	if err := validProxyProtocol(svcCfg); err != nil {
+		return err
+	}
+	if err := validAcceptProxyProtocol(svcCfg); err != nil {
+		return err
+	}
+	if _, err := loadServiceCert(svcCfg); err != nil {
+		return err
+	}
+	if svcCfg.MaxHeaderBytes < 0 {
+		return ErrInvalidHeaderMax
+	}
+	if err := validBalance(svcCfg.Balance); err != nil {
+		return err
+	}
+	if err := validBalance(svcCfg.ShadowBalance); err != nil {
+		return err
+	}
+	if _, err := parseTrustedNets(svcCfg.TrustedNetworks); err != nil {
+		return err
+	}
+	if _, err := newClientACL(svcCfg); err != nil {
+		return err
+	}
+	if _, err := newRequestIDPolicy(svcCfg); err != nil {
+		return err
+	}
+	if svcCfg.RequestTimeout < 0 || svcCfg.MaxRequestTime < 0 {
+		return ErrInvalidReqTimeout
+	}
+	if err := validDeferListen(svcCfg); err != nil {
+		return err
+	}
+	if err := validNoBackend(svcCfg); err != nil {
+		return err
+	}
+	if err := validBackendLimits(svcCfg); err != nil {
+		return err
+	}
+	if err := validBackendsTLS(svcCfg); err != nil {
+		return err
+	}
+	if err := validForwarded(svcCfg); err != nil {
+		return err
+	}
+	if err := validAccessLog(svcCfg.AccessLog); err != nil {
+		return err
+	}
+	if err := validRetry(svcCfg); err != nil {
+		return err
+	}
+	if err := validStickyCookie(svcCfg); err != nil {
+		return err
+	}
+	if svcCfg.DrainTimeout < 0 {
+		return ErrInvalidDrainTimeout
+	}
+	if svcCfg.CheckJitter < -1 || svcCfg.CheckJitter > maxCheckJitter {
+		return ErrInvalidCheckJitter
+	}
+	if err := validIdleConns(svcCfg); err != nil {
+		return err
+	}
+	if svcCfg.UDPIdleTimeout < 0 || svcCfg.UDPMaxSessions < 0 {
+		return ErrInvalidUDPSessions
+	}
+	if svcCfg.UDPWorkers < 0 {
+		return ErrInvalidUDPWorkers
+	}
+	if err := validServiceTags(svcCfg); err != nil {
+		return err
+	}
+	if err := validWeights(svcCfg); err != nil {
+		return err
+	}
+	if err := validSlowStarts(svcCfg); err != nil {
+		return err
+	}
+	if err := validChecks(svcCfg); err != nil {
+		return err
+	}
+	if err := validAdminStates(svcCfg); err != nil {
+		return err
+	}
+	hosts, err := canonicalVHosts(svcCfg.VirtualHosts)
+	if err != nil {
+		return err
+	}
+	svcCfg.VirtualHosts = hosts
+	if _, err := loadVHostCerts(svcCfg); err != nil {
+		return err
+	}
+
 	if _, ok := s.svcs[svcCfg.Name]; ok {
 		log.Debug("Service already exists:", svcCfg.Name)
 		return ErrDuplicateService
@@ -256,31 +578,34 @@ func (s *ServiceRegistry) AddService(svcCfg client.ServiceConfig) error {
 	s.setServiceDefaults(&svcCfg)
 	svcCfg = svcCfg.SetDefaults()
 
+	// a new service's backends are added along with it
+	events.service(client.EventServiceAdded, svcCfg.Name, svcCfg.Tags)
 	service := NewService(svcCfg)
-	err := service.start()
+	err = service.start()
 	if err != nil {
+		events.service(client.EventServiceRemoved, svcCfg.Name, svcCfg.Tags)
 		return err
 	}
 
 	s.svcs[service.Name] = service
+	delete(s.renamed, service.Name)
 
-	svcCfg.VirtualHosts = filterEmpty(svcCfg.VirtualHosts)
 	for _, name := range svcCfg.VirtualHosts {
 		vhost := s.vhosts[name]
 		if vhost == nil {
 			vhost = &VirtualHost{Name: name}
 			s.vhosts[name] = vhost
+			s.vhostsChanged()
 		}
 		vhost.Add(service)
 	}
 
+	s.updateHeaderLimits()
 	return nil
 }
 
-// Replace the service's configuration, or update its list of backends.
-// Replacing a configuration will shutdown the existing service, and start a
-// new one, which will cause the listening socket to be temporarily
-// unavailable.
+// Replace the service's configuration, or update its list of backends. A new
+// address moves the listener, which is bound before the old one is closed.
 func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 	s.Lock()
 	defer s.Unlock()
@@ -292,12 +617,53 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 		return ErrNoService
 	}
 
+	if err := validServiceNames(newCfg); err != nil {
+		return err
+	}
+
 	currentCfg := service.Config()
 	newCfg = currentCfg.Merge(newCfg)
+	// the global redirect can only be turned off for a virtual host
+	if s.cfg.HTTPSRedirect {
+		newCfg.HTTPSRedirect = true
+	}
+	if err := validNetworks(&newCfg); err != nil {
+		return err
+	}
+	if newCfg.MaxHeaderBytes < 0 {
+		return ErrInvalidHeaderMax
+	}
+	if err := validBalance(newCfg.Balance); err != nil {
+		return err
+	}
+	if err := validBalance(newCfg.ShadowBalance); err != nil {
+		return err
+	}
+	if err := validServiceTags(newCfg); err != nil {
+		return err
+	}
+	if err := validWeights(newCfg); err != nil {
+		return err
+	}
+	if err := validSlowStarts(newCfg); err != nil {
+		return err
+	}
+	if err := validChecks(newCfg); err != nil {
+		return err
+	}
+	if err := validAdminStates(newCfg); err != nil {
+		return err
+	}
+	hosts, err := canonicalVHosts(newCfg.VirtualHosts)
+	if err != nil {
+		return err
+	}
+	newCfg.VirtualHosts = hosts
 
 	if err := service.UpdateConfig(newCfg); err != nil {
 		return err
 	}
+	s.updateHeaderLimits()
 
 	// Lots of looping here (including fetching the Config, but the cardinality
 	// of Backends shouldn't be very large, and the default RoundRobin balancing
@@ -314,17 +680,31 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 	// Update changed backends, and add new ones.
 	for _, newBackend := range newCfg.Backends {
 		current, ok := currentBackends[newBackend.Name]
+		// an admin state that isn't set is kept
+		if newBackend.AdminState == "" {
+			newBackend.AdminState = current.AdminState
+		}
+		// tags and the admin state are updated in place, so they don't
+		// replace the backend
+		current.Tags = newBackend.Tags
+		current.AdminState = newBackend.AdminState
 		if ok && current.Equal(newBackend) {
 			log.Debugf("Backend %s/%s unchanged", service.Name, current.Name)
 			// no change for this one
+			service.setBackendTags(current.Name, current.Tags)
+			if b := service.get(current.Name); b != nil {
+				b.SetAdminDown(current.AdminState == client.AdminStateDown)
+			}
 			delete(currentBackends, current.Name)
 			continue
 		}
 
 		// we need to remove and re-add this backend
 		log.Debugf("Updating Backend %s/%s", service.Name, newBackend.Name)
-		service.remove(newBackend.Name)
-		service.add(NewBackend(newBackend))
+		service.remove(newBackend.Name, service.DrainTimeout)
+		if err := service.add(NewBackend(newBackend)); err != nil {
+			return err
+		}
 
 		delete(currentBackends, newBackend.Name)
 	}
@@ -332,7 +712,7 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 	// remove any left over backends
 	for name := range currentBackends {
 		log.Debugf("Removing Backend %s/%s", service.Name, name)
-		service.remove(name)
+		service.remove(name, service.DrainTimeout)
 	}
 
 	if currentCfg.Equal(newCfg) {
@@ -347,7 +727,7 @@ func (s *ServiceRegistry) UpdateService(newCfg client.ServiceConfig) error {
 		service.errorPages.Update(newCfg.ErrorPages)
 	}
 
-	s.updateVHosts(service, filterEmpty(newCfg.VirtualHosts))
+	s.updateVHosts(service, newCfg.VirtualHosts)
 
 	return nil
 }
@@ -395,12 +775,14 @@ func (s *ServiceRegistry) updateVHosts(service *Service, newHosts []string) {
 	// remove existing vhost entries for this service, and add new ones
 	for _, name := range remove {
 		vhost := s.vhosts[name]
-		if vhost != nil {
-			vhost.Remove(service)
+		if vhost == nil {
+			continue
 		}
+		vhost.Remove(service)
 		if vhost.Len() == 0 {
 			log.Println("Removing empty VirtualHost", name)
 			delete(s.vhosts, name)
+			s.vhostsChanged()
 		}
 	}
 
@@ -409,107 +791,610 @@ func (s *ServiceRegistry) updateVHosts(service *Service, newHosts []string) {
 		if vhost == nil {
 			vhost = &VirtualHost{Name: name}
 			s.vhosts[name] = vhost
+			s.vhostsChanged()
 		}
 		vhost.Add(service)
 	}
 
 	// and replace the list
 	service.VirtualHosts = newHosts
+	service.setVHostCounters(newHosts)
 }
 
 func (s *ServiceRegistry) RemoveService(name string) error {
 	s.Lock()
 	defer s.Unlock()
 
-	svc, ok := s.svcs[name]
-	if ok {
-		log.Debugf("Removing Service %s", svc.Name)
-		delete(s.svcs, name)
-		svc.stop()
-
-		for host, vhost := range s.vhosts {
-			vhost.Remove(svc)
-
-			removeVhost := true
-			for _, service := range s.svcs {
-				for _, h := range service.VirtualHosts {
-					if host == h {
-						// FIXME: is this still correct? NOT TESTED!
-						// vhost exists in another service, so leave it
-						removeVhost = false
-						break
-					}
-				}
-			}
-			if removeVhost {
-				log.Debugf("Removing VirtualHost %s", host)
-				delete(s.vhosts, host)
-
-			}
-		}
-
-		return nil
+	svc, err := s.remove(name)
+	if err != nil {
+		return err
 	}
-	return ErrNoService
+	svc.stop()
+	events.service(client.EventServiceRemoved, name, svc.Tags)
+	return nil
 }
 
-func (s *ServiceRegistry) ServiceStats(serviceName string) (ServiceStat, error) {
+// RemoveServices stops and removes every service, along with their vhosts,
+// and returns the names of those removed. The Registry stays locked
+// throughout, so a service added concurrently is either removed too, or
+// added once the registry is empty.
+func (s *ServiceRegistry) RemoveServices() []string {
 	s.Lock()
 	defer s.Unlock()
 
-	service, ok := s.svcs[serviceName]
-	if !ok {
-		return ServiceStat{}, ErrNoService
+	names := make([]string, 0, len(s.svcs))
+	for name := range s.svcs {
+		names = append(names, name)
 	}
-	return service.Stats(), nil
+	sort.Strings(names)
+
+	for _, name := range names {
+		svc, _ := s.remove(name)
+		svc.stop()
+		events.service(client.EventServiceRemoved, name, svc.Tags)
+	}
+	s.updateHeaderLimits()
+	return names
 }
 
-func (s *ServiceRegistry) ServiceConfig(serviceName string) (client.ServiceConfig, error) {
+// DrainService removes a service from the registry, and stops it once its
+// open connections have finished, or its DrainTimeout has passed. New
+// connections are refused at once. The returned channel is closed once the
+// service has stopped.
+func (s *ServiceRegistry) DrainService(name string) (<-chan struct{}, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	service, ok := s.svcs[serviceName]
-	if !ok {
-		return client.ServiceConfig{}, ErrNoService
+	svc, err := s.remove(name)
+	if err != nil {
+		return nil, err
 	}
-	return service.Config(), nil
+	svc.CloseListener()
+	log.Printf("EVENT: draining %s for up to %s", name, svc.DrainTimeout)
+
+	done := make(chan struct{})
+	goTask("service_drain", name, func() {
+		defer close(done)
+		closed := svc.drain()
+		log.Printf("EVENT: %s drained, %d connections closed", name, closed)
+		events.service(client.EventServiceRemoved, name, svc.Tags)
+	})
+	return done, nil
 }
 
-func (s *ServiceRegistry) BackendStats(serviceName, backendName string) (BackendStat, error) {
-	s.Lock()
-	defer s.Unlock()
-
-	service, ok := s.svcs[serviceName]
+// Remove a service and the vhosts only it claims, without stopping it.
+// Registry *must* be locked.
+func (s *ServiceRegistry) remove(name string) (*Service, error) {
+	svc, ok := s.svcs[name]
 	if !ok {
-		return BackendStat{}, ErrNoService
+		return nil, ErrNoService
 	}
 
-	for _, backend := range service.Backends {
-		if backendName == backend.Name {
-			return backend.Stats(), nil
+	log.Debugf("Removing Service %s", svc.Name)
+	delete(s.svcs, name)
+
+	// drop the vhosts no other service claims
+	for _, host := range svc.VirtualHosts {
+		vhost := s.vhosts[host]
+		if vhost == nil {
+			continue
+		}
+		vhost.Remove(svc)
+		if vhost.Len() == 0 {
+			log.Debugf("Removing VirtualHost %s", host)
+			delete(s.vhosts, host)
+			s.vhostsChanged()
 		}
 	}
-	return BackendStat{}, ErrNoBackend
+
+	s.updateHeaderLimits()
+	return svc, nil
 }
 
-// Add or update a Backend on an existing Service.
-func (s *ServiceRegistry) AddBackend(svcName string, backendCfg client.BackendConfig) error {
+// The global limit for request headers to virtual hosts.
+func (s *ServiceRegistry) MaxHeaderBytes() int {
 	s.Lock()
 	defer s.Unlock()
+	return s.maxHeaderBytes()
+}
 
-	service, ok := s.svcs[svcName]
-	if !ok {
-		return ErrNoService
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) maxHeaderBytes() int {
+	if s.cfg.MaxHeaderBytes > 0 {
+		return s.cfg.MaxHeaderBytes
 	}
-
-	log.Debugf("Adding Backend %s/%s", service.Name, backendCfg.Name)
-	service.add(NewBackend(backendCfg))
-	return nil
+	return client.DefaultMaxHeaderBytes
 }
 
-// Remove a Backend from an existing Service.
-func (s *ServiceRegistry) RemoveBackend(svcName, backendName string) error {
-	s.Lock()
+// Raise or lower the header limit of the HTTP routers to the largest limit
+// of any service, since the http.Server can only enforce one limit. The
+// services' own limits are enforced by the router as each request arrives.
+// ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) updateHeaderLimits() {
+	max := s.maxHeaderBytes()
+	for _, svc := range s.svcs {
+		if n := int(atomic.LoadInt64(&svc.MaxHeaderBytes)); n > max {
+			max = n
+		}
+	}
+
+	for _, r := range []*HostRouter{httpRouter, httpsRouter} {
+		if r != nil {
+			r.SetMaxHeaderBytes(max)
+		}
+	}
+}
+
+// The header limits used by the HTTP routers.
+type RouterConfig struct {
+	// the global limit
+	MaxHeaderBytes int `json:"max_header_bytes"`
+	// the limit applied by the http.Server, the largest of all the limits
+	ServerMaxHeaderBytes int `json:"server_max_header_bytes"`
+	// the limit for each virtual host. A vhost shared by several services
+	// reports the lowest of their limits.
+	VirtualHosts map[string]int `json:"virtual_hosts"`
+}
+
+func (s *ServiceRegistry) RouterConfig() RouterConfig {
+	s.Lock()
+	defer s.Unlock()
+
+	cfg := RouterConfig{
+		MaxHeaderBytes:       s.maxHeaderBytes(),
+		ServerMaxHeaderBytes: s.maxHeaderBytes(),
+		VirtualHosts:         make(map[string]int),
+	}
+
+	for _, svc := range s.svcs {
+		limit := int(atomic.LoadInt64(&svc.MaxHeaderBytes))
+		if limit <= 0 {
+			limit = cfg.MaxHeaderBytes
+		}
+		if limit > cfg.ServerMaxHeaderBytes {
+			cfg.ServerMaxHeaderBytes = limit
+		}
+
+		for _, host := range svc.VirtualHosts {
+			if host == "" {
+				continue
+			}
+			if current, ok := cfg.VirtualHosts[host]; !ok || limit < current {
+				cfg.VirtualHosts[host] = limit
+			}
+		}
+	}
+	return cfg
+}
+
+func (s *ServiceRegistry) ServiceStats(serviceName string) (ServiceStat, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[serviceName]
+	if !ok {
+		return ServiceStat{}, ErrNoService
+	}
+	return service.Stats(), nil
+}
+
+func (s *ServiceRegistry) ServiceConfig(serviceName string) (client.ServiceConfig, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[serviceName]
+	if !ok {
+		return client.ServiceConfig{}, ErrNoService
+	}
+	return service.Config(), nil
+}
+
+// Set the weights of a service's backends in a single update. See
+// Service.SetWeights.
+func (s *ServiceRegistry) SetWeights(svcName string, weights map[string]int) (map[string]int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return nil, ErrNoService
+	}
+	return service.SetWeights(weights)
+}
+
+func (s *ServiceRegistry) BalanceCompare(serviceName string) (BalanceCompare, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[serviceName]
+	if !ok {
+		return BalanceCompare{}, ErrNoService
+	}
+	return service.BalanceCompare()
+}
+
+func (s *ServiceRegistry) BackendStats(serviceName, backendName string) (BackendStat, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[serviceName]
+	if !ok {
+		return BackendStat{}, ErrNoService
+	}
+
+	for _, backend := range service.Backends {
+		if backendName == backend.Name {
+			return backend.Stats(), nil
+		}
+	}
+	return BackendStat{}, ErrNoBackend
+}
+
+// Return the health check state and recent results for a backend.
+func (s *ServiceRegistry) BackendChecks(serviceName, backendName string) (BackendChecks, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[serviceName]
+	if !ok {
+		return BackendChecks{}, ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return BackendChecks{}, ErrNoBackend
+	}
+	return backend.Checks(), nil
+}
+
+// Run a health check on a backend immediately. The result only affects the
+// backend's state if count is true.
+func (s *ServiceRegistry) CheckBackend(serviceName, backendName string, count bool) (CheckResult, error) {
+	s.Lock()
+	service, ok := s.svcs[serviceName]
+	s.Unlock()
+
+	if !ok {
+		return CheckResult{}, ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return CheckResult{}, ErrNoBackend
+	}
+
+	if backend.CheckAddr == "" {
+		return CheckResult{}, ErrNoCheckAddr
+	}
+
+	result := backend.runCheck(count)
+	backend.ResetBackoff()
+	return result, nil
+}
+
+// Record the readiness published by a backend.
+func (s *ServiceRegistry) SetBackendReady(serviceName, backendName string, ready client.ReadyConfig, source string) error {
+	s.Lock()
+	service, ok := s.svcs[serviceName]
+	s.Unlock()
+
+	if !ok {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	backend.SetReady(ready.Ready, source, time.Duration(ready.Drain)*time.Millisecond)
+	return nil
+}
+
+// Take a backend out of rotation for maintenance, or return it, without
+// changing the rest of its config.
+func (s *ServiceRegistry) SetBackendAdminState(serviceName, backendName, state string) error {
+	s.Lock()
+	service, ok := s.svcs[serviceName]
+	s.Unlock()
+
+	if !ok {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	switch state {
+	case client.AdminStateUp, client.AdminStateDown:
+	default:
+		return fmt.Errorf("%w for %s: %q", ErrInvalidAdminState, backendName, state)
+	}
+
+	backend.SetAdminDown(state == client.AdminStateDown)
+	return nil
+}
+
+// The config, stats and health check state of a single backend.
+type BackendInfo struct {
+	Config  client.BackendConfig `json:"config"`
+	Stats   BackendStat          `json:"stats"`
+	Checks  BackendChecks        `json:"checks"`
+	History BackendHistory       `json:"history"`
+}
+
+// An opaque tag for a backend config, so concurrent changes can be detected.
+func backendETag(cfg client.BackendConfig) string {
+	cfg = cfg.SetDefaults()
+	sum := sha1.Sum(cfg.Marshal())
+	return fmt.Sprintf(`"%x"`, sum[:8])
+}
+
+// Return the BackendInfo for a backend, and the ETag of its config.
+func (s *ServiceRegistry) BackendInfo(serviceName, backendName string) (BackendInfo, string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[serviceName]
+	if !ok {
+		return BackendInfo{}, "", ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return BackendInfo{}, "", ErrNoBackend
+	}
+
+	info := BackendInfo{
+		Config:  backend.Config(),
+		Stats:   backend.Stats(),
+		Checks:  backend.Checks(),
+		History: backend.History(),
+	}
+	return info, backendETag(info.Config), nil
+}
+
+// Apply a partial config to a backend. If ifMatch is set, it must be the ETag
+// of the backend's current config, or ErrBackendModified is returned.
+func (s *ServiceRegistry) PatchBackend(svcName, backendName string, patch client.BackendPatch, ifMatch string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	cfg := backend.Config()
+	if ifMatch != "" && ifMatch != "*" && ifMatch != backendETag(cfg) {
+		return ErrBackendModified
+	}
+
+	patched := patch.Apply(cfg)
+	if patched.Network == "" {
+		patched.Network = defaultBackendNetwork(service.Network)
+	}
+	if err := validBackend(service, patched); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidBackend, err)
+	}
+
+	if patched.Equal(cfg) {
+		return nil
+	}
+
+	log.Debugf("Patching Backend %s/%s", service.Name, backendName)
+	if !backend.patchable(patched) {
+		return service.add(NewBackend(patched))
+	}
+	service.patchBackend(backend, patched)
+	return nil
+}
+
+// Check the fields of a backend config that can be patched.
+func validBackend(service *Service, cfg client.BackendConfig) error {
+	if err := checkNetworks(service.Network, cfg.Network, bridgeUnix); err != nil {
+		return err
+	}
+	if cfg.Network != "unix" {
+		if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+			return err
+		}
+	}
+	if cfg.CheckAddr != "" && cfg.Network != "unix" {
+		if _, _, err := net.SplitHostPort(cfg.CheckAddr); err != nil {
+			return err
+		}
+	}
+	if cfg.Weight < 1 {
+		return fmt.Errorf("weight must be at least 1")
+	}
+	if err := validCheck(cfg); err != nil {
+		return err
+	}
+	if err := validMaxConns(cfg); err != nil {
+		return err
+	}
+	if _, err := backendTLSConfig(cfg); err != nil {
+		return err
+	}
+	return validTags(cfg.Tags)
+}
+
+// Check a backend's health check type, and the path and timeout of an http
+// check, or the timeout of a udp check. A tcp check ignores the path and
+// timeout.
+func validCheck(cfg client.BackendConfig) error {
+	switch cfg.CheckType {
+	case "", client.CheckTCP:
+	case client.CheckHTTP, client.CheckUDP:
+		if cfg.CheckType == client.CheckHTTP && cfg.CheckPath != "" && !strings.HasPrefix(cfg.CheckPath, "/") {
+			return fmt.Errorf("%w for %s: path %q must start with /", ErrInvalidCheck, cfg.Name, cfg.CheckPath)
+		}
+		if cfg.CheckTimeout < 0 {
+			return fmt.Errorf("%w for %s: negative timeout", ErrInvalidCheck, cfg.Name)
+		}
+	default:
+		return fmt.Errorf("%w for %s: unknown type %q", ErrInvalidCheck, cfg.Name, cfg.CheckType)
+	}
+	return nil
+}
+
+func validChecks(cfg client.ServiceConfig) error {
+	for _, b := range cfg.Backends {
+		if err := validCheck(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check a backend's admin state, which is up if it isn't set.
+func validAdminState(cfg client.BackendConfig) error {
+	switch cfg.AdminState {
+	case "", client.AdminStateUp, client.AdminStateDown:
+		return nil
+	}
+	return fmt.Errorf("%w for %s: %q", ErrInvalidAdminState, cfg.Name, cfg.AdminState)
+}
+
+func validAdminStates(cfg client.ServiceConfig) error {
+	for _, b := range cfg.Backends {
+		if err := validAdminState(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add or update a Backend on an existing Service.
+func (s *ServiceRegistry) AddBackend(svcName string, backendCfg client.BackendConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return ErrNoService
+	}
+
+	if err := validName(backendCfg.Name); err != nil {
+		return err
+	}
+
+	if backendCfg.Network == "" {
+		backendCfg.Network = defaultBackendNetwork(service.Network)
+	}
+	if err := checkNetworks(service.Network, backendCfg.Network, bridgeUnix); err != nil {
+		return err
+	}
+	if err := validTags(backendCfg.Tags); err != nil {
+		return err
+	}
+	if err := validWeight(backendCfg); err != nil {
+		return err
+	}
+	if err := validSlowStart(backendCfg); err != nil {
+		return err
+	}
+	if err := validCheck(backendCfg); err != nil {
+		return err
+	}
+	if err := validMaxConns(backendCfg); err != nil {
+		return err
+	}
+	if _, err := backendTLSConfig(backendCfg); err != nil {
+		return err
+	}
+	if err := validAdminState(backendCfg); err != nil {
+		return err
+	}
+	// a replaced backend keeps its admin state unless it's set
+	if current := service.get(backendCfg.Name); current != nil && backendCfg.AdminState == "" {
+		backendCfg.AdminState = current.Config().AdminState
+	}
+
+	log.Debugf("Adding Backend %s/%s", service.Name, backendCfg.Name)
+	return service.add(NewBackend(backendCfg))
+}
+
+// Start a payload capture on a single backend.
+func (s *ServiceRegistry) StartCapture(svcName, backendName string, cfg client.CaptureConfig) error {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	if err := validCapture(cfg); err != nil {
+		return err
+	}
+
+	return backend.StartCapture(service.Name, cfg.SetDefaults())
+}
+
+// Stop a running payload capture, keeping the data.
+func (s *ServiceRegistry) StopCapture(svcName, backendName string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return ErrNoBackend
+	}
+
+	return backend.StopCapture()
+}
+
+// Return the data from the current or last capture on a backend.
+func (s *ServiceRegistry) Capture(svcName, backendName string) (CaptureDump, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return CaptureDump{}, ErrNoService
+	}
+
+	backend := service.get(backendName)
+	if backend == nil {
+		return CaptureDump{}, ErrNoBackend
+	}
+
+	return backend.Capture()
+}
+
+// Remove a Backend from an existing Service, closing its open connections.
+func (s *ServiceRegistry) RemoveBackend(svcName, backendName string) error {
+	return s.removeBackend(svcName, backendName, false)
+}
+
+// DrainBackend removes a backend from rotation at once, but lets its open
+// connections finish for up to the service's DrainTimeout before they're
+// closed.
+func (s *ServiceRegistry) DrainBackend(svcName, backendName string) error {
+	return s.removeBackend(svcName, backendName, true)
+}
+
+func (s *ServiceRegistry) removeBackend(svcName, backendName string, drain bool) error {
+	s.Lock()
 	defer s.Unlock()
 
 	log.Debugf("Removing Backend %s/%s", svcName, backendName)
@@ -518,12 +1403,115 @@ func (s *ServiceRegistry) RemoveBackend(svcName, backendName string) error {
 		return ErrNoService
 	}
 
-	if !service.remove(backendName) {
+	var timeout time.Duration
+	if drain {
+		service.Lock()
+		timeout = service.DrainTimeout
+		service.Unlock()
+	}
+	if !service.remove(backendName, timeout) {
 		return ErrNoBackend
 	}
 	return nil
 }
 
+// Close the listeners for all services, without stopping existing
+// connections.
+func (s *ServiceRegistry) CloseListeners() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, service := range s.svcs {
+		service.CloseListener()
+	}
+}
+
+// ActiveConns returns the total number of client connections and HTTP
+// requests in progress for all services.
+func (s *ServiceRegistry) ActiveConns() int {
+	s.Lock()
+	defer s.Unlock()
+
+	active := 0
+	for _, service := range s.svcs {
+		active += service.ActiveConns()
+	}
+	return active
+}
+
+// ListenStates returns the listener state of each service that defers
+// listening until its backends are healthy.
+func (s *ServiceRegistry) ListenStates() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+
+	states := make(map[string]string)
+	for _, service := range s.svcs {
+		if state := service.ListenState(); state != "" {
+			states[service.Name] = state
+		}
+	}
+	return states
+}
+
+// The names of the services with no backends, other than those that only
+// redirect.
+func (s *ServiceRegistry) EmptyServices() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	var names []string
+	for _, service := range s.svcs {
+		if service.Empty() && !service.redirectOnly() {
+			names = append(names, service.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close all client connections for all services.
+// Returns the number of connections closed.
+func (s *ServiceRegistry) CloseConns() int {
+	s.Lock()
+	defer s.Unlock()
+
+	closed := 0
+	for _, service := range s.svcs {
+		closed += service.CloseConns()
+	}
+	return closed
+}
+
+// Return the names of any services similar to name.
+func (s *ServiceRegistry) SimilarServices(name string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	var names []string
+	for n := range s.svcs {
+		names = append(names, n)
+	}
+	return similarNames(name, names)
+}
+
+// Return the names of any backends similar to backendName in the service.
+func (s *ServiceRegistry) SimilarBackends(svcName, backendName string) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	service, ok := s.svcs[svcName]
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	for _, b := range service.Config().Backends {
+		names = append(names, b.Name)
+	}
+	return similarNames(backendName, names)
+}
+
 func (s *ServiceRegistry) Stats() []ServiceStat {
 	s.Lock()
 	defer s.Unlock()
@@ -536,6 +1524,77 @@ func (s *ServiceRegistry) Stats() []ServiceStat {
 	return stats
 }
 
+// CheckInfo describes where a service's health checks come from, and how
+// they're marked, so backend firewalls can allow them.
+type CheckInfo struct {
+	Service     string   `json:"service"`
+	SourceIPs   []string `json:"source_ips"`
+	SourcePorts string   `json:"source_ports,omitempty"`
+	Preamble    bool     `json:"preamble"`
+	UserAgent   string   `json:"user_agent,omitempty"`
+}
+
+// CheckSources is the set of all source IPs used for health checks, along
+// with the details for each service.
+type CheckSources struct {
+	SourceIPs []string    `json:"source_ips"`
+	Services  []CheckInfo `json:"services"`
+}
+
+// CheckSources returns the local IPs health checks are sent from. These are
+// found from the route to each backend's check address.
+func (s *ServiceRegistry) CheckSources() CheckSources {
+	cfg := s.Config()
+
+	sources := CheckSources{
+		SourceIPs: []string{},
+		Services:  []CheckInfo{},
+	}
+	all := make(map[string]bool)
+
+	for _, svcCfg := range cfg.Services {
+		info := CheckInfo{
+			Service:     svcCfg.Name,
+			SourceIPs:   []string{},
+			SourcePorts: svcCfg.CheckSourcePorts,
+			Preamble:    svcCfg.CheckPreamble != "",
+			UserAgent:   svcCfg.CheckUserAgent,
+		}
+
+		ips := make(map[string]bool)
+		for _, b := range svcCfg.Backends {
+			if b.CheckAddr == "" {
+				continue
+			}
+			ip, err := routeSourceIP(b.CheckAddr)
+			if err != nil {
+				log.Warnf("no route to check %s/%s: %s", svcCfg.Name, b.Name, err)
+				continue
+			}
+			if !ips[ip] {
+				ips[ip] = true
+				info.SourceIPs = append(info.SourceIPs, ip)
+			}
+			if !all[ip] {
+				all[ip] = true
+				sources.SourceIPs = append(sources.SourceIPs, ip)
+			}
+		}
+		sort.Strings(info.SourceIPs)
+		sources.Services = append(sources.Services, info)
+	}
+	sort.Strings(sources.SourceIPs)
+	sort.Sort(checkInfos(sources.Services))
+
+	return sources
+}
+
+type checkInfos []CheckInfo
+
+func (c checkInfos) Len() int           { return len(c) }
+func (c checkInfos) Less(i, j int) bool { return c[i].Service < c[j].Service }
+func (c checkInfos) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
 func (s *ServiceRegistry) Config() client.Config {
 	s.Lock()
 	defer s.Unlock()
@@ -579,7 +1638,13 @@ func (s *ServiceRegistry) setServiceDefaults(svc *client.ServiceConfig) {
 	if svc.DialTimeout == 0 && s.cfg.DialTimeout != 0 {
 		svc.DialTimeout = s.cfg.DialTimeout
 	}
+	if svc.TimeoutPolicy == "" && s.cfg.TimeoutPolicy != "" {
+		svc.TimeoutPolicy = s.cfg.TimeoutPolicy
+	}
 	if s.cfg.HTTPSRedirect {
 		svc.HTTPSRedirect = true
 	}
+	if svc.ShadowBalance == "" && s.cfg.ShadowBalance != "" {
+		svc.ShadowBalance = s.cfg.ShadowBalance
+	}
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// How long the old name of a renamed service reports the new name.
+var renameGrace = time.Hour
+
+// The new name of a renamed service, until the grace period expires.
+type serviceRename struct {
+	to      string
+	expires time.Time
+}
+
+// Rename a service. The same Service is kept under the new name, so its
+// listener, backends, stats and health state are unaffected, and the virtual
+// hosts and routers that refer to it keep doing so.
+func (s *ServiceRegistry) RenameService(name, newName string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	svc, ok := s.svcs[name]
+	if !ok {
+		return ErrNoService
+	}
+	if err := validName(newName); err != nil {
+		return err
+	}
+	if newName == name {
+		return nil
+	}
+	if _, ok := s.svcs[newName]; ok {
+		return ErrDuplicateService
+	}
+
+	log.Printf("Renaming service %s to %s", name, newName)
+	delete(s.svcs, name)
+	s.svcs[newName] = svc
+	svc.rename(newName)
+
+	if billing != nil {
+		billing.rename(name, newName)
+	}
+
+	// older names follow the service to its new name, and a name that's in
+	// use again no longer points anywhere
+	now := time.Now()
+	for old, r := range s.renamed {
+		if now.After(r.expires) {
+			delete(s.renamed, old)
+			continue
+		}
+		if r.to == name {
+			r.to = newName
+			s.renamed[old] = r
+		}
+	}
+	delete(s.renamed, newName)
+
+	if renameGrace > 0 {
+		if s.renamed == nil {
+			s.renamed = make(map[string]serviceRename)
+		}
+		s.renamed[name] = serviceRename{to: newName, expires: now.Add(renameGrace)}
+	}
+	return nil
+}
+
+// Return the current name of a service that was renamed from name within the
+// grace period, or an empty string.
+func (s *ServiceRegistry) RenamedTo(name string) string {
+	s.Lock()
+	defer s.Unlock()
+
+	r, ok := s.renamed[name]
+	if !ok {
+		return ""
+	}
+	if time.Now().After(r.expires) {
+		delete(s.renamed, name)
+		return ""
+	}
+	return r.to
+}
+
+func (s *Service) rename(name string) {
+	s.Lock()
+	defer s.Unlock()
+	s.Name = name
+
+	for _, b := range s.Backends {
+		b.Lock()
+		b.service = name
+		b.Unlock()
+	}
+}
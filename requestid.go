@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidRequestID = fmt.Errorf("invalid request id config")
+
+// The longest request ID accepted as-is from a trusted client.
+const maxInboundRequestID = 128
+
+// requestIDPolicy is how a service reads, generates and sends request IDs.
+type requestIDPolicy struct {
+	header     string
+	copyHeader string
+	inbound    string
+	format     string
+}
+
+// The policy for requests that don't match a service.
+var defaultRequestIDs = requestIDPolicy{
+	header:  client.DefaultRequestIDHeader,
+	inbound: client.RequestIDChain,
+	format:  client.RequestIDHex,
+}
+
+func newRequestIDPolicy(cfg client.ServiceConfig) (requestIDPolicy, error) {
+	p := defaultRequestIDs
+	if cfg.RequestIDHeader != "" {
+		p.header = http.CanonicalHeaderKey(cfg.RequestIDHeader)
+	}
+	if cfg.RequestIDCopyHeader != "" {
+		p.copyHeader = http.CanonicalHeaderKey(cfg.RequestIDCopyHeader)
+	}
+	if cfg.RequestIDInbound != "" {
+		p.inbound = cfg.RequestIDInbound
+	}
+	if cfg.RequestIDFormat != "" {
+		p.format = cfg.RequestIDFormat
+	}
+
+	for _, h := range []string{p.header, p.copyHeader} {
+		if !validHeaderName(h) {
+			return p, fmt.Errorf("%w: header %q", ErrInvalidRequestID, h)
+		}
+	}
+	switch p.inbound {
+	case client.RequestIDChain, client.RequestIDTrust, client.RequestIDGenerate:
+	default:
+		return p, fmt.Errorf("%w: inbound %q", ErrInvalidRequestID, p.inbound)
+	}
+	switch p.format {
+	case client.RequestIDHex, client.RequestIDUUIDv7, client.RequestIDULID:
+	default:
+		return p, fmt.Errorf("%w: format %q", ErrInvalidRequestID, p.format)
+	}
+	return p, nil
+}
+
+// Set the policy's fields of a service config, leaving out the defaults.
+func (p requestIDPolicy) config(cfg *client.ServiceConfig) {
+	if p.header != defaultRequestIDs.header {
+		cfg.RequestIDHeader = p.header
+	}
+	cfg.RequestIDCopyHeader = p.copyHeader
+	if p.inbound != defaultRequestIDs.inbound {
+		cfg.RequestIDInbound = p.inbound
+	}
+	if p.format != defaultRequestIDs.format {
+		cfg.RequestIDFormat = p.format
+	}
+}
+
+// Header names are HTTP tokens. An empty name is valid, for no header.
+func validHeaderName(name string) bool {
+	for _, c := range name {
+		if c > '~' || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Generate a new ID in the policy's format.
+func (p requestIDPolicy) generate(now time.Time) string {
+	switch p.format {
+	case client.RequestIDUUIDv7:
+		return genUUIDv7(now)
+	case client.RequestIDULID:
+		return genULID(now)
+	}
+	return genId()
+}
+
+// Choose the ID for a request from a client at addr, given the ID it sent,
+// if any.
+func (p requestIDPolicy) choose(inbound string, addr clientAddr, trusted []*net.IPNet) string {
+	if inbound == "" || p.inbound == client.RequestIDGenerate {
+		return p.generate(time.Now())
+	}
+	if p.inbound == client.RequestIDTrust && addr.In(trusted) && validInboundID(inbound) {
+		return inbound
+	}
+	return p.generate(time.Now()) + "." + inbound
+}
+
+// An ID from a trusted client is still only used if it's short, and has no
+// spaces or control characters to corrupt the access log.
+func validInboundID(id string) bool {
+	if len(id) > maxInboundRequestID {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+type requestIDKey struct{}
+
+// Assign a request its ID, using the policy of the service it's for, if any.
+// The ID is set in the request's headers for the backend, and the response's
+// for the client, and kept with the request so the access log, log streams
+// and error pages all report the same ID.
+func assignRequestID(svc *Service, w http.ResponseWriter, req *http.Request) *http.Request {
+	p, trusted := defaultRequestIDs, []*net.IPNet(nil)
+	if svc != nil {
+		svc.Lock()
+		p, trusted = svc.requestIDs, svc.trustedNets
+		svc.Unlock()
+	}
+
+	id := p.choose(req.Header.Get(p.header), normalizeClientAddr(req.RemoteAddr), trusted)
+	req.Header.Set(p.header, id)
+	if p.copyHeader != "" {
+		req.Header.Set(p.copyHeader, id)
+	}
+	w.Header().Set(p.header, id)
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+}
+
+// The ID assigned to a request.
+func requestID(req *http.Request) string {
+	if id, ok := req.Context().Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return req.Header.Get(client.DefaultRequestIDHeader)
+}
+
+// Generate a UUIDv7: 48 bits of the Unix time in milliseconds, followed by
+// random bits, with the version and variant set.
+func genUUIDv7(now time.Time) string {
+	var b [16]byte
+	rand.Read(b[6:])
+	putMillis(b[:], now)
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Crockford's base32, as used by ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generate a ULID: 48 bits of the Unix time in milliseconds, followed by 80
+// random bits, as 26 characters of Crockford's base32.
+func genULID(now time.Time) string {
+	var b [16]byte
+	rand.Read(b[6:])
+	putMillis(b[:], now)
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// Put the Unix time in milliseconds into the first 6 bytes of b.
+func putMillis(b []byte, now time.Time) {
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+}
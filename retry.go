@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidRetry = fmt.Errorf("invalid retry policy")
+
+func validRetry(cfg client.ServiceConfig) error {
+	switch cfg.RetryPolicy {
+	case "", client.RetryAlways, client.RetryIdempotent, client.RetryNever:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidRetry, cfg.RetryPolicy)
+	}
+	if cfg.RetryCount < 0 {
+		return fmt.Errorf("%w: negative retry count", ErrInvalidRetry)
+	}
+	return nil
+}
+
+// Set which requests are retried on another backend, and how many times.
+// Service *must* be locked, or not yet started.
+func (s *Service) setRetryPolicy(cfg client.ServiceConfig) {
+	s.RetryPolicy = cfg.RetryPolicy
+	if s.RetryPolicy == "" {
+		s.RetryPolicy = client.DefaultRetryPolicy
+	}
+	s.RetryCount = cfg.RetryCount
+}
+
+// Report whether a request that failed to connect to a backend may be tried
+// on the next one.
+func (pr *ProxyRequest) mayRetry() bool {
+	if pr.RetryCount > 0 && pr.Attempts > pr.RetryCount {
+		return false
+	}
+	switch pr.RetryPolicy {
+	case client.RetryNever:
+		return false
+	case client.RetryIdempotent:
+		return idempotent(pr.Request)
+	}
+	return true
+}
+
+// Report whether a request can safely be sent again: its method is
+// idempotent, and none of its body has been sent.
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+	default:
+		return false
+	}
+	if body, ok := r.Body.(*countingBody); ok {
+		return body.n == 0
+	}
+	return true
+}
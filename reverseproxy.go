@@ -5,15 +5,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
 )
 
@@ -23,6 +27,30 @@ var onExitFlushLoop func()
 
 type ProxyCallback func(*ProxyRequest) bool
 
+// CallbackChain holds the callbacks run for each request. A chain is never
+// modified once it's in use by the proxy, it's only replaced as a whole, so
+// each request runs either all of the old callbacks or all of the new.
+type CallbackChain struct {
+	// These are called in order on before any request is made to the backend server.
+	// Each Callback must return true to continue processing.
+	OnRequest []ProxyCallback
+
+	// These are called in order after the response is obtained from the remote
+	// server. The http.Response will be valid even on error. Callbacks may
+	// write directly to the client, or modify the response which will be
+	// written to the client if all callbacks complete with True. If any
+	// callback returns false to stop the chain, the response is discarded.
+	OnResponse []ProxyCallback
+}
+
+// Return a copy of the chain that can be modified.
+func (c *CallbackChain) copy() *CallbackChain {
+	return &CallbackChain{
+		OnRequest:  append([]ProxyCallback(nil), c.OnRequest...),
+		OnResponse: append([]ProxyCallback(nil), c.OnResponse...),
+	}
+}
+
 // A Dialer can return an error wrapped in DialError to notify the ReverseProxy
 // that an error occured during the initial TCP connection, and it's safe to
 // try again.
@@ -43,6 +71,10 @@ type ReverseProxy struct {
 	// back to the original client unmodified.
 	Director func(*http.Request)
 
+	// BackendScheme returns the scheme of requests to the backend at addr,
+	// overriding the Director's. It's left to the Director if nil.
+	BackendScheme func(addr string) string
+
 	// The transport used to perform proxy requests.
 	// If nil, http.DefaultTransport is used.
 	Transport http.RoundTripper
@@ -53,16 +85,17 @@ type ReverseProxy struct {
 	// If zero, no periodic flushing is done.
 	FlushInterval time.Duration
 
-	// These are called in order on before any request is made to the backend server.
-	// Each Callback must return true to continue processing.
-	OnRequest []ProxyCallback
-
-	// These are called in order after the response is obtained from the remote
-	// server. The http.Response will be valid even on error. Callbacks may
-	// write directly to the client, or modify the response which will be
-	// written to the client if all callbacks complete with True. If any
-	// callback returns false to stop the chain, the response is discarded.
-	OnResponse []ProxyCallback
+	// Dial connects to a backend for requests to switch protocols, which
+	// are relayed over the connection rather than through the Transport.
+	// Upgrades aren't proxied if it's nil. ClientTimeout is the idle timeout
+	// for the client's side of an upgraded connection, or nil for none.
+	Dial          func(ctx context.Context, network, addr string) (net.Conn, error)
+	ClientTimeout *liveTimeout
+
+	// The current *CallbackChain, loaded once at the start of each request.
+	callbacks atomic.Value
+	// serializes changes to the callbacks
+	callbackMu sync.Mutex
 }
 
 // Create a new ReverseProxy
@@ -72,9 +105,35 @@ func NewReverseProxy(t *http.Transport) *ReverseProxy {
 		Transport:     t,
 		FlushInterval: 1109 * time.Millisecond,
 	}
+	p.callbacks.Store(&CallbackChain{})
 	return p
 }
 
+// Callbacks returns the current callback chain, which must not be modified.
+func (p *ReverseProxy) Callbacks() *CallbackChain {
+	return p.callbacks.Load().(*CallbackChain)
+}
+
+// ReplaceCallbacks swaps in a new callback chain. Requests already in
+// progress finish with the chain they started with.
+func (p *ReverseProxy) ReplaceCallbacks(chain CallbackChain) {
+	p.callbackMu.Lock()
+	defer p.callbackMu.Unlock()
+	p.callbacks.Store(chain.copy())
+}
+
+// AmendCallbacks calls amend with a copy of the current chain, and swaps in
+// the result. Concurrent amendments are applied one at a time, so none are
+// lost.
+func (p *ReverseProxy) AmendCallbacks(amend func(*CallbackChain)) {
+	p.callbackMu.Lock()
+	defer p.callbackMu.Unlock()
+
+	chain := p.Callbacks().copy()
+	amend(chain)
+	p.callbacks.Store(chain.copy())
+}
+
 func singleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
 	bslash := strings.HasPrefix(b, "/")
@@ -110,20 +169,60 @@ var hopHeaders = []string{
 
 // This probably shouldn't be called ServeHTTP anymore
 func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addrs []string) {
-
-	pr := &ProxyRequest{
+	p.Serve(&ProxyRequest{
 		ResponseWriter: rw,
 		Request:        req,
 		Backends:       addrs,
-	}
+	})
+}
 
-	for _, f := range p.OnRequest {
+// Serve proxies a request that has already been set up by the caller.
+func (p *ReverseProxy) Serve(pr *ProxyRequest) {
+	rw := pr.ResponseWriter
+	req := pr.Request
+
+	// the whole request uses the chain in place when it started
+	chain := p.Callbacks()
+
+	for _, f := range chain.OnRequest {
 		cont := f(pr)
 		if !cont {
 			return
 		}
 	}
 
+	if p.Dial != nil && isUpgrade(req) {
+		p.serveUpgrade(pr, chain)
+		return
+	}
+
+	// the deadline covers every backend attempt and the response body
+	if pr.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), pr.Timeout)
+		defer cancel()
+		pr.Request = req.WithContext(ctx)
+	}
+
+	// and so does the time limit, unless the response turns out to be a
+	// stream that's allowed
+	var limit *time.Timer
+	if pr.MaxTime > 0 {
+		ctx, cancel := context.WithCancel(pr.Request.Context())
+		defer cancel()
+		pr.Request = pr.Request.WithContext(ctx)
+		limit = time.AfterFunc(pr.MaxTime, func() {
+			atomic.StoreInt32(&pr.maxTimeExceeded, 1)
+			cancel()
+		})
+		defer limit.Stop()
+	}
+
+	if body := pr.Request.Body; body != nil && body != http.NoBody {
+		counted := &countingBody{ReadCloser: body}
+		pr.Request.Body = counted
+		defer func() { pr.RequestBytes = counted.n }()
+	}
+
 	pr.StartTime = time.Now()
 	res, err := p.doRequest(pr)
 
@@ -133,18 +232,10 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 
 	if err != nil {
 		log.Printf("http: proxy error: %v", err)
-
-		// We want to ensure that we have a non-nil response even on error for
-		// the OnResponse callbacks. If the Callback chain completes, this will
-		// be written to the client.
-		res = &http.Response{
-			Header:     make(map[string][]string),
-			StatusCode: http.StatusBadGateway,
-			Status:     http.StatusText(http.StatusBadGateway),
-			// this ensures Body isn't nil
-			Body: ioutil.NopCloser(bytes.NewReader(nil)),
-		}
+		res = errorResponse(pr)
 		pr.Response = res
+	} else if limit != nil && pr.AllowStreaming && isEventStream(res) {
+		limit.Stop()
 	}
 
 	for _, h := range hopHeaders {
@@ -153,7 +244,7 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 
 	copyHeader(rw.Header(), res.Header)
 
-	for _, f := range p.OnResponse {
+	for _, f := range chain.OnResponse {
 		cont := f(pr)
 		if !cont {
 			return
@@ -163,20 +254,89 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request, addr
 	// calls all completed with true, write the Response back to the client.
 	defer res.Body.Close()
 	rw.WriteHeader(res.StatusCode)
-	_, err = p.copyResponse(rw, res.Body)
+	pr.ResponseBytes, err = p.copyResponse(rw, res.Body)
 	if err != nil {
-		log.Warnf("id=%s transfer error: %s", req.Header.Get("X-Request-Id"), err)
+		log.Warnf("id=%s transfer error: %s", requestID(req), err)
 	}
 }
 
+// We want to ensure that we have a non-nil response even on error for the
+// OnResponse callbacks. If the Callback chain completes, this will be written
+// to the client.
+func errorResponse(pr *ProxyRequest) *http.Response {
+	status := http.StatusBadGateway
+	if pr.Request.Context().Err() == context.DeadlineExceeded || pr.MaxTimeExceeded() {
+		status = http.StatusGatewayTimeout
+	}
+
+	return &http.Response{
+		Header:     make(map[string][]string),
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		// this ensures Body isn't nil
+		Body: ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+}
+
+// The X-Forwarded-For header for a request, with the client's address added
+// to any the request already had.
+func forwardedFor(r *http.Request) string {
+	addr := normalizeClientAddr(r.RemoteAddr)
+	if addr.IP == nil {
+		return ""
+	}
+	clientIP := addr.Host()
+	// If we aren't the first proxy retain prior
+	// X-Forwarded-For information as a comma+space
+	// separated list and fold multiple headers into one.
+	if prior, ok := r.Header["X-Forwarded-For"]; ok {
+		clientIP = normalizeAddrList(strings.Join(prior, ",")) + ", " + clientIP
+	}
+	return clientIP
+}
+
+// MaxTimeExceeded reports whether the request was cut off at its MaxTime.
+func (pr *ProxyRequest) MaxTimeExceeded() bool {
+	return atomic.LoadInt32(&pr.maxTimeExceeded) == 1
+}
+
+// Return the next backend to try for a request, and false once there are
+// none left, or no more may be tried. The attempt is recorded in the
+// request.
+func (pr *ProxyRequest) nextAttempt(picker BackendPicker) (string, bool) {
+	addr, ok := picker.Next()
+	if !ok {
+		return "", false
+	}
+	if pr.Attempts > 0 && !pr.mayRetry() {
+		pr.RetryRefused = true
+		return "", false
+	}
+	if pr.MaxAttempts > 0 && pr.Attempts >= pr.MaxAttempts {
+		// the client's budget ran out before the backends did
+		pr.BudgetExhausted = true
+		return "", false
+	}
+
+	pr.Attempts++
+	pr.Attempted = append(pr.Attempted, addr)
+	return addr, true
+}
+
 func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 	transport := p.Transport
+	if pr.Transport != nil {
+		transport = pr.Transport
+	}
 	if transport == nil {
 		transport = http.DefaultTransport
 	}
 
 	outreq := new(http.Request)
 	*outreq = *pr.Request // includes shallow copies of maps, but okay
+	// the Director adds headers, which mustn't change the client's request
+	outreq.Header = make(http.Header)
+	copyHeader(outreq.Header, pr.Request.Header)
 
 	p.Director(outreq)
 	outreq.Proto = "HTTP/1.1"
@@ -186,40 +346,49 @@ func (p *ReverseProxy) doRequest(pr *ProxyRequest) (*http.Response, error) {
 
 	// Remove hop-by-hop headers to the backend.  Especially
 	// important is "Connection" because we want a persistent
-	// connection, regardless of what the client sent to us.  This
-	// is modifying the same underlying map from req (shallow
-	// copied above) so we only copy it if necessary.
-	copiedHeaders := false
+	// connection, regardless of what the client sent to us.
 	for _, h := range hopHeaders {
-		if outreq.Header.Get(h) != "" {
-			if !copiedHeaders {
-				outreq.Header = make(http.Header)
-				copyHeader(outreq.Header, pr.Request.Header)
-				copiedHeaders = true
-			}
+		outreq.Header.Del(h)
+	}
+	outreq = traceIdleConns(outreq)
 
-			outreq.Header.Del(h)
-		}
+	var err error
+	var resp *http.Response
+
+	if pr.EchoLimits {
+		defer func() {
+			pr.ResponseWriter.Header().Set(AttemptsHeader, strconv.Itoa(pr.Attempts))
+		}()
 	}
 
-	if clientIP, _, err := net.SplitHostPort(pr.Request.RemoteAddr); err == nil {
-		// If we aren't the first proxy retain prior
-		// X-Forwarded-For information as a comma+space
-		// separated list and fold multiple headers into one.
-		if prior, ok := outreq.Header["X-Forwarded-For"]; ok {
-			clientIP = strings.Join(prior, ", ") + ", " + clientIP
-		}
-		outreq.Header.Set("X-Forwarded-For", clientIP)
+	picker := pr.Picker
+	if picker == nil {
+		picker = &addrPicker{addrs: pr.Backends}
 	}
 
-	var err error
-	var resp *http.Response
+	body := outreq.Body
+	for {
+		addr, ok := pr.nextAttempt(picker)
+		if !ok {
+			break
+		}
 
-	for _, addr := range pr.Backends {
 		outreq.URL.Host = addr
+		if p.BackendScheme != nil {
+			outreq.URL.Scheme = p.BackendScheme(addr)
+		}
+
+		outreq.Body = body
+		session := pickerCapture(picker, pr.Request.RemoteAddr)
+		if session != nil {
+			session.recordRequest(outreq)
+		}
 		resp, err = transport.RoundTrip(outreq)
 
 		if err == nil {
+			if session != nil {
+				session.recordResponse(resp)
+			}
 			pr.ResponseWriter.Header().Set("X-Backend", addr)
 			return resp, nil
 		}
@@ -250,7 +419,7 @@ func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) (int64, error)
 				latency: p.FlushInterval,
 				done:    make(chan bool),
 			}
-			go mlw.flushLoop()
+			flushTasks.goTask(mlw.flushLoop)
 			defer mlw.stop()
 			dst = mlw
 		}
@@ -300,6 +469,13 @@ func (m *maxLatencyWriter) stop() { m.done <- true }
 
 // Proxy Request stores a client request, backend response, error, and any
 // stats needed to complete a round trip.
+// A BackendPicker returns the address of the next backend to try for a
+// request, and false when there are none left. It never returns an address
+// twice.
+type BackendPicker interface {
+	Next() (string, bool)
+}
+
 type ProxyRequest struct {
 	// The incoming request from the client
 	Request *http.Request
@@ -313,10 +489,88 @@ type ProxyRequest struct {
 	// The error, if any, from the http request to the backend server
 	ProxyError error
 
-	// backend hosts we can use
+	// backend hosts we can use, in order, if there's no Picker
 	Backends []string
 
+	// Picker chooses the backends to try, one at a time, and Attempted is
+	// the addresses it returned, in the order they were tried.
+	Picker    BackendPicker
+	Attempted []string
+
 	// Duration of the backend request
 	StartTime  time.Time
 	FinishTime time.Time
+
+	// Signed overrides for this request only, if any
+	Directive *client.Directive
+
+	// The deadline for the request, and the number of backends that may be
+	// tried, if they're limited. Attempts is the number of backends tried,
+	// and BudgetExhausted is set if MaxAttempts stopped the request from
+	// trying the rest. EchoLimits reports them in the response headers.
+	Timeout         time.Duration
+	MaxAttempts     int
+	Attempts        int
+	BudgetExhausted bool
+	EchoLimits      bool
+
+	// The longest the request may last, including its response and any
+	// upgraded connection, unless it's streaming and AllowStreaming is set.
+	// maxTimeExceeded is set once the request is cut off, atomically.
+	MaxTime         time.Duration
+	AllowStreaming  bool
+	maxTimeExceeded int32
+
+	// The service's retry policy and limit, and whether the policy stopped
+	// the request from trying another backend after one failed.
+	RetryPolicy  string
+	RetryCount   int
+	RetryRefused bool
+
+	// The service's name and tags, for the access log
+	Service string
+	Tags    string
+
+	// The canonical name of the virtual host the request was sent to, and
+	// the body bytes read from the client and written back to it.
+	VirtualHost   string
+	RequestBytes  int64
+	ResponseBytes int64
+
+	// The transport for this request, if not the proxy's own
+	Transport http.RoundTripper
+}
+
+// AccessEntry returns the access log entry for the finished request.
+func (pr *ProxyRequest) AccessEntry() *AccessEntry {
+	e := newAccessEntry(pr.Request)
+	e.Service = pr.Service
+	e.Tags = pr.Tags
+	e.Status = pr.Response.StatusCode
+	e.Duration = pr.FinishTime.Sub(pr.StartTime)
+	e.BytesSent = pr.ResponseBytes
+	e.BytesReceived = pr.RequestBytes
+	e.Attempted = pr.Attempted
+	if pr.Directive != nil {
+		e.Directive = pr.Directive.ID
+	}
+
+	if pr.Response.Request != nil && pr.Response.Request.URL != nil {
+		e.Backend = pr.Response.Request.URL.Host
+	}
+
+	// the status of a failed request is ours, not the backend's
+	e.Origin = originBackend
+	if pr.ProxyError != nil {
+		e.Origin, e.Reason = originShuttle, reasonProxyError
+		e.Error = pr.ProxyError.Error()
+		if pr.RetryRefused {
+			e.Reason = reasonRetryRefused
+		}
+		// the backend that failed last
+		if e.Backend == "" && len(pr.Attempted) > 0 {
+			e.Backend = pr.Attempted[len(pr.Attempted)-1]
+		}
+	}
+	return e
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidRoute = fmt.Errorf("invalid route")
+
+// A routeRule is a validated client.RouteConfig, with counts of the requests
+// it matched, and those it couldn't restrict because none of its backends
+// were up.
+type routeRule struct {
+	client.RouteConfig
+	backends  map[string]bool
+	Count     int64
+	Fallbacks int64
+}
+
+func newRouteRules(cfgs []client.RouteConfig) ([]*routeRule, error) {
+	rules := []*routeRule{}
+	for i, cfg := range cfgs {
+		if err := validRoute(cfg); err != nil {
+			return nil, fmt.Errorf("%w %d: %s", ErrInvalidRoute, i, err)
+		}
+		rule := &routeRule{RouteConfig: cfg, backends: make(map[string]bool)}
+		for _, name := range cfg.Backends {
+			rule.backends[name] = true
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Check that a route has a condition, and backends to restrict requests to.
+func validRoute(cfg client.RouteConfig) error {
+	if cfg.Header == "" && cfg.Cookie == "" && cfg.PathPrefix == "" && cfg.Method == "" {
+		return fmt.Errorf("no header, cookie, path_prefix or method to match")
+	}
+	if cfg.Header != "" && !validHeaderName(cfg.Header) {
+		return fmt.Errorf("invalid header %q", cfg.Header)
+	}
+	if cfg.Header == "" && cfg.HeaderValue != "" {
+		return fmt.Errorf("header_value without a header")
+	}
+	if cfg.Cookie != "" && !validHeaderName(cfg.Cookie) {
+		return fmt.Errorf("invalid cookie %q", cfg.Cookie)
+	}
+	if cfg.Cookie == "" && cfg.CookieValue != "" {
+		return fmt.Errorf("cookie_value without a cookie")
+	}
+	if cfg.PathPrefix != "" && !strings.HasPrefix(cfg.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix %q must start with /", cfg.PathPrefix)
+	}
+	if cfg.Method != "" && !validHeaderName(cfg.Method) {
+		return fmt.Errorf("invalid method %q", cfg.Method)
+	}
+	if len(cfg.Backends) == 0 {
+		return fmt.Errorf("no backends")
+	}
+	return nil
+}
+
+// Check if the rule applies to the request.
+func (r *routeRule) match(req *http.Request) bool {
+	if r.Method != "" && req.Method != r.Method {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+
+	if r.Header != "" {
+		values, ok := req.Header[http.CanonicalHeaderKey(r.Header)]
+		if !ok {
+			return false
+		}
+		if r.HeaderValue != "" && !containsString(values, r.HeaderValue) {
+			return false
+		}
+	}
+
+	if r.Cookie != "" {
+		cookie, err := req.Cookie(r.Cookie)
+		if err != nil {
+			return false
+		}
+		if r.CookieValue != "" && cookie.Value != r.CookieValue {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *routeRule) stat() RouteStat {
+	return RouteStat{
+		RouteConfig: r.RouteConfig,
+		Count:       atomic.LoadInt64(&r.Count),
+		Fallbacks:   atomic.LoadInt64(&r.Fallbacks),
+	}
+}
+
+// Return the names of the backends the request is restricted to by the
+// first route it matches, or nil if it can go to any backend. A route whose
+// backends are all down or missing doesn't restrict the request.
+func (s *Service) route(r *http.Request) map[string]bool {
+	s.Lock()
+	routes := s.routes
+	s.Unlock()
+
+	for _, rule := range routes {
+		if !rule.match(r) {
+			continue
+		}
+		atomic.AddInt64(&rule.Count, 1)
+		if !s.anyUp(rule.backends) {
+			atomic.AddInt64(&rule.Fallbacks, 1)
+			return nil
+		}
+		return rule.backends
+	}
+	return nil
+}
+
+// Report whether any of the named backends can take a request.
+func (s *Service) anyUp(names map[string]bool) bool {
+	s.Lock()
+	backends := append([]*Backend(nil), s.Backends...)
+	s.Unlock()
+
+	for _, b := range backends {
+		if names[b.Name] && s.usable(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
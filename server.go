@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/litl/shuttle/log"
+)
+
+// What to do when a component fails to start
+const (
+	// Stop everything, and exit
+	StartupExit = "exit"
+	// Keep running without the component, and report degraded health
+	StartupDegrade = "degrade"
+)
+
+var (
+	ErrStartupPolicy = fmt.Errorf("startup policy must be exit or degrade")
+
+	// the Server for the running process, used to report health
+	mainServer *Server
+)
+
+// A Runner is a component of the server with its own lifecycle.
+//
+// Start returns once the component is ready, or has failed to start, and the
+// component keeps running in the background until Stop is called. Stop waits
+// for the component's goroutines to exit, or for ctx to be done.
+type Runner interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Ready() <-chan struct{}
+}
+
+type namedRunner struct {
+	name string
+	Runner
+}
+
+// Server supervises shuttle's components. Components are started in the
+// order they were added, and stopped in reverse once the Shutdown sequence
+// has run. The Server is itself a Runner, so a complete shuttle can be
+// embedded in another process.
+type Server struct {
+	sync.Mutex
+
+	// Policy is StartupExit or StartupDegrade
+	Policy string
+
+	// The sequence run when the server is stopped. Its Routers are set to the
+	// server's HTTP routers if they're nil.
+	Shutdown *Shutdown
+
+	runners []namedRunner
+	started []namedRunner
+	failed  []string
+
+	cancel  context.CancelFunc
+	ready   chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func NewServer(policy string) *Server {
+	return &Server{
+		Policy:   policy,
+		Shutdown: NewShutdown(),
+		ready:    make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Add a component to be started with the server.
+func (s *Server) Add(name string, r Runner) {
+	s.Lock()
+	defer s.Unlock()
+	s.runners = append(s.runners, namedRunner{name, r})
+}
+
+// Start each component in order. If a component fails to start, the
+// components already started are stopped and the error is returned, unless
+// the Policy is StartupDegrade. Cancelling ctx stops the server.
+func (s *Server) Start(ctx context.Context) error {
+	if s.Policy != StartupExit && s.Policy != StartupDegrade {
+		return ErrStartupPolicy
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	s.Lock()
+	s.cancel = cancel
+	runners := s.runners
+	s.Unlock()
+
+	for _, r := range runners {
+		log.Debugf("Starting %s", r.name)
+		if err := r.Start(ctx); err != nil {
+			err = fmt.Errorf("%s: %s", r.name, err)
+			if s.Policy == StartupExit {
+				s.Stop(context.Background())
+				return err
+			}
+
+			log.Errorf("ERROR: %s", err)
+			s.Lock()
+			s.failed = append(s.failed, r.name)
+			s.Unlock()
+			continue
+		}
+
+		s.Lock()
+		s.started = append(s.started, r)
+		s.Unlock()
+	}
+
+	goTask("server_ready", "", func() { s.waitReady(ctx) })
+	goTask("server_stop", "", func() {
+		select {
+		case <-ctx.Done():
+			s.Stop(context.Background())
+		case <-s.stopped:
+		}
+	})
+
+	return nil
+}
+
+// Close the ready channel once every started component is ready.
+func (s *Server) waitReady(ctx context.Context) {
+	s.Lock()
+	started := s.started
+	s.Unlock()
+
+	for _, r := range started {
+		select {
+		case <-r.Ready():
+		case <-ctx.Done():
+			return
+		}
+	}
+	close(s.ready)
+}
+
+// Run the Shutdown sequence, then stop every started component in reverse
+// order, and return the first error.
+func (s *Server) Stop(ctx context.Context) error {
+	var err error
+	s.once.Do(func() {
+		defer close(s.stopped)
+
+		s.Lock()
+		routers := []*HostRouter{}
+		for _, r := range s.started {
+			if router, ok := r.Runner.(*HostRouter); ok {
+				routers = append(routers, router)
+			}
+		}
+		s.Unlock()
+
+		s.Shutdown.Lock()
+		if s.Shutdown.Routers == nil {
+			s.Shutdown.Routers = routers
+		}
+		s.Shutdown.Unlock()
+		s.Shutdown.Run()
+
+		s.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		started := s.started
+		s.started = nil
+		s.Unlock()
+
+		for i := len(started) - 1; i >= 0; i-- {
+			r := started[i]
+			log.Debugf("Stopping %s", r.name)
+			if e := r.Stop(ctx); e != nil {
+				log.Errorf("ERROR: stopping %s: %s", r.name, e)
+				if err == nil {
+					err = fmt.Errorf("%s: %s", r.name, e)
+				}
+			}
+		}
+	})
+	return err
+}
+
+// Ready is closed once all the started components are ready.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Done is closed once the server has stopped.
+func (s *Server) Done() <-chan struct{} {
+	return s.stopped
+}
+
+// Failed returns the names of the components that failed to start.
+func (s *Server) Failed() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.failed...)
+}
+
+// registryRunner loads the config into the Registry when started, and
+// removes all the services when stopped.
+type registryRunner struct {
+	load  func() error
+	ready chan struct{}
+}
+
+func newRegistryRunner(load func() error) *registryRunner {
+	return &registryRunner{
+		load:  load,
+		ready: make(chan struct{}),
+	}
+}
+
+func (r *registryRunner) Start(ctx context.Context) error {
+	if err := r.load(); err != nil {
+		return err
+	}
+	close(r.ready)
+	return nil
+}
+
+func (r *registryRunner) Stop(ctx context.Context) error {
+	for _, svc := range Registry.Config().Services {
+		Registry.RemoveService(svc.Name)
+	}
+	return nil
+}
+
+func (r *registryRunner) Ready() <-chan struct{} {
+	return r.ready
+}
@@ -1,19 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+	"github.com/litl/shuttle/testnet"
 	. "gopkg.in/check.v1"
 )
 
@@ -46,6 +60,43 @@ func NewTestServer(addr string, c Tester) (*testServer, error) {
 		return nil, err
 	}
 
+	s.serve(c)
+	return s, nil
+}
+
+// Start a server on the in-memory network which responds with it's addr
+// after every read.
+func NewMemTestServer(n *testnet.Network, addr string, c Tester) (*testServer, error) {
+	s := &testServer{}
+	s.wg = new(sync.WaitGroup)
+
+	var err error
+	s.listener, err = n.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.serve(c)
+	return s, nil
+}
+
+// Start a server on a unix socket which responds with its path after every
+// read.
+func NewUnixTestServer(path string, c Tester) (*testServer, error) {
+	s := &testServer{}
+	s.wg = new(sync.WaitGroup)
+
+	var err error
+	s.listener, err = net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.serve(c)
+	return s, nil
+}
+
+func (s *testServer) serve(c Tester) {
 	s.addr = s.listener.Addr().String()
 	c.Log("listening on ", s.addr)
 
@@ -81,7 +132,6 @@ func NewTestServer(addr string, c Tester) (*testServer, error) {
 			}()
 		}
 	}()
-	return s, nil
 }
 
 func (s *testServer) Stop() {
@@ -94,7 +144,7 @@ func (s *testServer) Stop() {
 type udpTestServer struct {
 	sync.Mutex
 	addr    string
-	conn    *net.UDPConn
+	conn    net.PacketConn
 	count   int
 	packets [][]byte
 	wg      *sync.WaitGroup
@@ -126,6 +176,27 @@ func NewUDPTestServer(addr string, c Tester) (*udpTestServer, error) {
 	}
 
 	s.addr = addr
+	s.serve(c)
+	return s, nil
+}
+
+// Start a UDP server on the in-memory network, which records all packets.
+func NewMemUDPTestServer(n *testnet.Network, addr string, c Tester) (*udpTestServer, error) {
+	s := &udpTestServer{}
+	s.wg = new(sync.WaitGroup)
+
+	var err error
+	s.conn, err = n.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.addr = addr
+	s.serve(c)
+	return s, nil
+}
+
+func (s *udpTestServer) serve(c Tester) {
 	c.Log("listening on UDP:", s.addr)
 
 	s.wg.Add(1)
@@ -135,7 +206,7 @@ func NewUDPTestServer(addr string, c Tester) (*udpTestServer, error) {
 		buff := make([]byte, 1048576)
 		pos := 0
 		for {
-			n, _, err := s.conn.ReadFromUDP(buff[pos:])
+			n, _, err := s.conn.ReadFrom(buff[pos:])
 			if err != nil {
 				return
 			}
@@ -148,7 +219,6 @@ func NewUDPTestServer(addr string, c Tester) (*udpTestServer, error) {
 			pos += n
 		}
 	}()
-	return s, nil
 }
 
 func (s *udpTestServer) Stop() {
@@ -158,6 +228,26 @@ func (s *udpTestServer) Stop() {
 	s.wg.Wait()
 }
 
+// Start a UDP server which answers every datagram with "pong", for udp
+// health checks. Closing it stops the answers.
+func NewUDPResponder(c Tester) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	go func() {
+		buff := make([]byte, 512)
+		for {
+			_, addr, err := conn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte("pong"), addr)
+		}
+	}()
+	return conn
+}
+
 // Backend server for testing HTTP proxies
 type testHTTPServer struct {
 	*httptest.Server
@@ -170,6 +260,12 @@ func (s *testHTTPServer) addrHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, s.addr)
 }
 
+// return the request headers as json
+func (s *testHTTPServer) headersHandler(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(r.Header)
+	w.Write(js)
+}
+
 func (s *testHTTPServer) errorHandler(w http.ResponseWriter, r *http.Request) {
 	code, _ := strconv.Atoi(r.FormValue("code"))
 	if code > 0 {
@@ -204,6 +300,7 @@ func NewHTTPTestServer(addr string, c fataler) (*testHTTPServer, error) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/addr", s.addrHandler)
 	mux.HandleFunc("/error", s.errorHandler)
+	mux.HandleFunc("/headers", s.headersHandler)
 
 	s.Config.Handler = mux
 	s.Start()
@@ -278,3 +375,225 @@ func checkHTTP(url, host, expected string, status int, c Tester) {
 	}
 	c.Assert(string(body), Equals, expected)
 }
+
+// Create a self-signed certificate for host, valid for the given duration.
+func testCert(host string, valid time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(valid),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Create a self-signed certificate for host, PEM encoded with its key.
+func testCertPEM(c Tester, host string) (certPEM, keyPEM []byte) {
+	cert, err := testCert(host, time.Hour)
+	if err != nil {
+		c.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		c.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return certPEM, keyPEM
+}
+
+// Wait for the number of goroutines to drop back to baseline, and fail with
+// a dump of all the stacks if it doesn't.
+func checkGoroutines(c Tester, baseline int) {
+	n := 0
+	for i := 0; i < 50; i++ {
+		n = runtime.NumGoroutine()
+		if n <= baseline {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	c.Fatalf("leaked %d goroutines:\n%s", n-baseline, buf)
+}
+
+// A backend speaking the shuttle-mux framing. Each response is the request
+// prefixed with the server's address. If gate is set, requests wait for it
+// to be closed.
+type muxTestServer struct {
+	addr     string
+	listener net.Listener
+	gate     chan struct{}
+
+	// connections accepted, and requests in progress, accessed atomically
+	accepted int64
+	inflight int64
+}
+
+func NewMemMuxTestServer(n *testnet.Network, addr string, gate chan struct{}) (*muxTestServer, error) {
+	l, err := n.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &muxTestServer{
+		addr:     l.Addr().String(),
+		listener: l,
+		gate:     gate,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&s.accepted, 1)
+
+			go func() {
+				defer conn.Close()
+				client.ServeMuxConn(conn, s.handle, client.DefaultMuxMaxMessage)
+			}()
+		}
+	}()
+	return s, nil
+}
+
+func (s *muxTestServer) handle(req []byte) []byte {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	return append([]byte(s.addr+":"), req...)
+}
+
+func (s *muxTestServer) Stop() {
+	s.listener.Close()
+}
+
+// A backend that reads the PROXY protocol header at the start of each
+// connection, then answers HTTP requests with "ok". The headers are sent on
+// headers in the order the connections arrive.
+type proxyHeaderServer struct {
+	addr     string
+	listener net.Listener
+	headers  chan []byte
+}
+
+func NewProxyHeaderServer(addr string) (*proxyHeaderServer, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &proxyHeaderServer{
+		addr:     l.Addr().String(),
+		listener: l,
+		headers:  make(chan []byte, 16),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				br := bufio.NewReader(conn)
+				hdr, err := readProxyHeader(br)
+				if err != nil {
+					return
+				}
+				s.headers <- hdr
+				for {
+					if _, err := http.ReadRequest(br); err != nil {
+						return
+					}
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+				}
+			}()
+		}
+	}()
+	return s, nil
+}
+
+// Read a v1 or v2 header, whichever the connection starts with.
+func readProxyHeader(br *bufio.Reader) ([]byte, error) {
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if string(sig) != string(proxyV2Signature) {
+		return br.ReadBytes('\n')
+	}
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	addrs := make([]byte, int(hdr[14])<<8|int(hdr[15]))
+	if _, err := io.ReadFull(br, addrs); err != nil {
+		return nil, err
+	}
+	return append(hdr, addrs...), nil
+}
+
+// Wait for the header of the next connection to the server.
+func (s *proxyHeaderServer) next(c Tester) []byte {
+	select {
+	case hdr := <-s.headers:
+		return hdr
+	case <-time.After(5 * time.Second):
+		c.Fatal("no connection to", s.addr)
+	}
+	return nil
+}
+
+func (s *proxyHeaderServer) Stop() {
+	s.listener.Close()
+}
+
+// logCapture collects the lines of the default logger, which other goroutines
+// may still be writing to, until it's stopped.
+type logCapture struct {
+	sync.Mutex
+	buf  bytes.Buffer
+	prev io.Writer
+}
+
+func captureLogs() *logCapture {
+	l := &logCapture{prev: log.DefaultLogger.Writer()}
+	log.DefaultLogger.SetOutput(l)
+	return l
+}
+
+func (l *logCapture) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logCapture) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.buf.String()
+}
+
+// Restore the logger's previous output.
+func (l *logCapture) stop() {
+	log.DefaultLogger.SetOutput(l.prev)
+}
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"reflect"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,6 +41,11 @@ type Service struct {
 	ClientTimeout   time.Duration
 	ServerTimeout   time.Duration
 	DialTimeout     time.Duration
+	TimeoutPolicy   string
+	ReadinessTTL    time.Duration
+	CheckBackoff    time.Duration
+	CheckBackoffMax time.Duration
+	CheckJitter     int
 	Sent            int64
 	Rcvd            int64
 	Errors          int64
@@ -44,53 +55,271 @@ type Service struct {
 	Network         string
 	MaintenanceMode bool
 
-	// Next returns the backends in priority order.
-	next func() []*Backend
-
-	// the last backend we used and the number of times we used it
-	lastBackend int
-	lastCount   int
+	// The client side of the service's listeners, which Sent and Rcvd count
+	// at the backends
+	clientStats listenerStats
+
+	// Secrets for validating signed request directives. More than one may be
+	// set while a secret is being rotated.
+	DirectiveSecrets []string
+	// Directives applied, and invalid directives ignored
+	Directives      int64
+	DirectiveErrors int64
+
+	// Markers for health checks, so backends can tell them apart from
+	// proxied traffic. All are off when empty.
+	CheckSourcePorts string
+	CheckPreamble    string
+	CheckUserAgent   string
+	checkPorts       portRange
+
+	// The interface backends' connections are bound to, unless they set
+	// their own.
+	BindInterface string
+
+	// Redirects are checked before a backend is chosen for HTTP requests.
+	// The rules are replaced as a whole when the config changes.
+	redirects   []*redirectRule
+	redirectCfg []client.RedirectConfig
+
+	// Routes restrict matching HTTP requests to some of the backends, and
+	// are replaced as a whole like the redirects.
+	routes   []*routeRule
+	routeCfg []client.RouteConfig
+
+	// The virtual hosts whose HTTPSRedirect differs from the service's, and
+	// the paths that are never redirected
+	httpsRedirects *httpsRedirects
+
+	// The header rules for HTTP requests and responses, also replaced as a
+	// whole.
+	headers *headerRewriter
+
+	// Requests answered without a backend, by reason. The map is never
+	// modified after the service is created.
+	localCounts map[string]*int64
+
+	// UDP datagram handling. The sizes are read atomically by the UDP loop.
+	UDPBufferSize   int64
+	MaxDatagramSize int64
+	UDPDontFragment bool
+	// the DF bit is actually set on the listener
+	dontFragment bool
+	// datagrams truncated by the buffer, dropped for being larger than
+	// MaxDatagramSize, and failed to send for being larger than the MTU
+	UDPTruncated  int64
+	UDPOversize   int64
+	UDPMsgTooLong int64
+	// datagrams dropped while every backend was down, and those not yet
+	// reported in the log
+	UDPBackendsDown   int64
+	udpDownUnreported int64
+	udpDownReported   time.Time
+	// datagrams received from clients, and sent to backends
+	UDPDatagramsIn  int64
+	UDPDatagramsOut int64
+	// Unique clients and active flows, for UDP services. A client's flow is
+	// active until it has sent nothing for FlowIdleTimeout.
+	FlowIdleTimeout time.Duration
+	udpClients      *udpClients
+	// the number of datagrams queued for each backend before more are
+	// dropped
+	UDPQueueSize int
+	// the number of workers reading the listener, used atomically, and the
+	// workers reading the current listener
+	UDPWorkers int64
+	udpReaders *udpReaders
+	// Sessions relay the backends' replies to clients, until they've been
+	// idle for UDPIdleTimeout. No more than UDPMaxSessions are open at once.
+	UDPIdleTimeout time.Duration
+	UDPMaxSessions int
+	udpSessions    *udpSessions
+	// closed when the UDP listener is shut down
+	udpClosed chan struct{}
+
+	// Multiplexing client requests over a pool of connections to each
+	// backend. Clients are proxied 1:1 if MuxConns is 0.
+	MuxConns      int
+	MuxMaxStreams int
+	MuxMaxMessage int
+
+	// The PROXY protocol version written on new backend connections, or
+	// empty for none, and whether client connections start with a header.
+	SendProxyProtocol   string
+	AcceptProxyProtocol bool
+
+	// The certificate client connections are decrypted with, swapped
+	// atomically when the config changes, or nil for plain TCP.
+	// TLSHandshakeErrors counts the clients that failed the handshake, which
+	// are also counted in Errors.
+	tls                serviceTLS
+	tlsCert            atomic.Value
+	tlsConfig          *tls.Config
+	TLSHandshakeErrors int64
+
+	// The request counters for each virtual host, a
+	// map[string]*vhostCounters replaced whenever the vhosts change.
+	vhostCounts atomic.Value
+
+	// The certificates the HTTPS router presents for the virtual hosts, by
+	// canonical name, and their config.
+	vhostCerts   map[string]*tls.Certificate
+	vhostCertCfg map[string]client.VirtualHostCert
+
+	// The limit for request headers to the service's virtual hosts, or 0 for
+	// the global limit. Read atomically by the HTTP router.
+	MaxHeaderBytes int64
+
+	// The deadline for HTTP requests, and the clients allowed to shorten it
+	// or limit the backends tried. RetryBudgetExhausted counts the requests
+	// that failed because the client's budget ran out before the backends
+	// did.
+	RequestTimeout       time.Duration
+	TrustedNetworks      []string
+	trustedNets          []*net.IPNet
+	ForwardedHeaders     string
+	requestIDs           requestIDPolicy
+	RetryBudgetExhausted int64
+
+	// The longest any request or connection may last, unless it's streaming
+	// and that's allowed. MaxRequestTimeExceeded counts those cut off, and
+	// is used atomically.
+	MaxRequestTime         time.Duration
+	AllowStreaming         bool
+	MaxRequestTimeExceeded int64
+
+	// Which requests are retried on another backend after failing to
+	// connect, and the most retries for each, or 0 for no limit.
+	RetryPolicy string
+	RetryCount  int
+
+	// Orders the backends for each connection or request. The shadow
+	// balancer, if ShadowBalance is set, only records what it would have
+	// chosen.
+	balancer      balancer
+	ShadowBalance string
+	shadow        *shadowBalancer
+
+	// The cookie that keeps HTTP clients on one backend, or empty for none
+	StickyCookie string
+
+	// Limits the rate of new connections and HTTP requests. RateLimited
+	// counts those refused, and is used atomically.
+	rateLimit   *rateLimiter
+	RateLimited int64
+
+	// The clients allowed and denied, a *clientACL. ClientDenied counts the
+	// connections, requests and datagrams refused, and is used atomically.
+	// Those not yet reported in the log are counted for LogDenied.
+	clientACL        atomic.Value
+	ClientDenied     int64
+	deniedUnreported int64
+	deniedReported   time.Time
 
 	// Each Service owns it's own netowrk listener
 	tcpListener net.Listener
-	udpListener *net.UDPConn
+	udpListener net.PacketConn
+	// the listener hasn't been closed yet
+	listening bool
+
+	// The permissions of a unix service's socket, and whether the socket is
+	// still ours to remove when the service stops.
+	SocketMode  string
+	socketOwned bool
+
+	// Bind the listener only while MinAvailable backends are up, and withdraw
+	// it once availability has been below that for WithdrawGrace. Backends
+	// signal availableChanged when their state changes, and listenState is
+	// waiting, listening or withdrawn. Listeners closed while connections
+	// are still open are kept in draining.
+	DeferListen      bool
+	MinAvailable     int
+	WithdrawGrace    time.Duration
+	listenState      string
+	availableChanged chan struct{}
+	stopWatch        chan struct{}
+	draining         []*timeoutListener
+
+	// What happens to connections and requests while there are no backends.
+	// refusing is set while the listener is closed for lack of backends,
+	// and backendAdded is closed to wake those held once one is added.
+	// NoBackends counts the connections, requests and datagrams that found
+	// no backends, and is used atomically.
+	NoBackendAction string
+	HoldTimeout     time.Duration
+	HoldQueue       int
+	refusing        bool
+	backendAdded    chan struct{}
+	holding         int
+	holdDropped     int64
+	NoBackends      int64
+
+	// What happens to connections and requests once every backend is at its
+	// connection limit.
+	BackendFullAction string
+	QueueTimeout      time.Duration
+
+	// The time open connections have to finish when the service is removed
+	// with draining, or one of its backends is removed or replaced.
+	// drainingBackends are those removed while their connections finish.
+	DrainTimeout     time.Duration
+	drainingBackends []*Backend
+
+	// Operator defined tags, reported in the stats, access logs and events
+	Tags map[string]string
 
 	// reverse proxy for vhost routing
 	httpProxy *ReverseProxy
+	// changed whenever a backend is added, replaced or removed, so a
+	// request's picker knows to balance its remaining backends again
+	backendsVer uint64
+	// the transport for requests, replaced when its idle connection limits
+	// change
+	proxyTransport *http.Transport
+	// the transport for requests while SendProxyProtocol is set, which
+	// doesn't keep connections, since each one carries a client's header
+	proxyProtoTransport *http.Transport
 
 	// Custom Pages to backend error responses
 	errorPages *ErrorResponse
 
 	// the original map of errors as loaded in by a config
 	errPagesCfg map[string][]int
+	errCondCfg  map[int]client.ErrorPageCondition
+
+	// the service's own access log, if it has one, and its config
+	accessLog    *accessLog
+	accessLogCfg *client.AccessLogConfig
 
-	// net.Dialer so we don't need to allocate one every time
-	dialer *net.Dialer
-}
-
-// Stats returned about a service
-type ServiceStat struct {
-	Name          string        `json:"name"`
-	Addr          string        `json:"address"`
-	VirtualHosts  []string      `json:"virtual_hosts"`
-	Backends      []BackendStat `json:"backends"`
-	Balance       string        `json:"balance"`
-	CheckInterval int           `json:"check_interval"`
-	Fall          int           `json:"fall"`
-	Rise          int           `json:"rise"`
-	ClientTimeout int           `json:"client_timeout"`
-	ServerTimeout int           `json:"server_timeout"`
-	DialTimeout   int           `json:"connect_timeout"`
-	Sent          int64         `json:"sent"`
-	Rcvd          int64         `json:"received"`
-	Errors        int64         `json:"errors"`
-	Conns         int64         `json:"connections"`
-	Active        int64         `json:"active"`
-	HTTPActive    int64         `json:"http_active"`
-	HTTPConns     int64         `json:"http_connections"`
-	HTTPErrors    int64         `json:"http_errors"`
+	// The network used for listeners and backend connections. These default
+	// to real sockets, and can be replaced before the service is started.
+	ListenerFactory ListenerFactory
+	DialerFactory   DialerFactory
+
+	// Live copies of ClientTimeout and ServerTimeout, shared with the
+	// listener and connections so that updates take effect immediately.
+	clientTimeout *liveTimeout
+	serverTimeout *liveTimeout
 }
 
+// The json stats we return are defined in the client package, which decodes
+// them, so the two can't drift apart.
+type (
+	ServiceStat        = client.ServiceStat
+	BackendStat        = client.BackendStat
+	VHostStat          = client.VHostStat
+	RedirectStat       = client.RedirectStat
+	RouteStat          = client.RouteStat
+	ErrorConditionStat = client.ErrorConditionStat
+	MuxStat            = client.MuxStat
+	InterfaceStat      = client.InterfaceStat
+	HistogramStat      = client.HistogramStat
+	HistogramBucket    = client.HistogramBucket
+	LatencyStat        = client.LatencyStat
+	UDPStat            = client.UDPStat
+	UDPQueueStat       = client.UDPQueueStat
+)
+
 // Create a Service from a config struct
 func NewService(cfg client.ServiceConfig) *Service {
 	s := &Service{
@@ -106,102 +335,555 @@ func NewService(cfg client.ServiceConfig) *Service {
 		ServerTimeout:   time.Duration(cfg.ServerTimeout) * time.Millisecond,
 		DialTimeout:     time.Duration(cfg.DialTimeout) * time.Millisecond,
 		errorPages:      NewErrorResponse(cfg.ErrorPages),
+		localCounts:     newLocalCounts(),
 		errPagesCfg:     cfg.ErrorPages,
 		Network:         cfg.Network,
 		MaintenanceMode: cfg.MaintenanceMode,
+		TimeoutPolicy:   cfg.TimeoutPolicy,
+		ReadinessTTL:    time.Duration(cfg.ReadinessTTL) * time.Millisecond,
+		CheckBackoff:    time.Duration(cfg.CheckBackoff) * time.Millisecond,
+		CheckBackoffMax: time.Duration(cfg.CheckBackoffMax) * time.Millisecond,
+		CheckJitter:     cfg.CheckJitter,
+
+		DirectiveSecrets: unredactSecrets(cfg.DirectiveSecrets, nil),
+
+		CheckSourcePorts: cfg.CheckSourcePorts,
+		CheckPreamble:    cfg.CheckPreamble,
+		CheckUserAgent:   cfg.CheckUserAgent,
+		BindInterface:    cfg.BindInterface,
+
+		UDPBufferSize:   int64(cfg.UDPBufferSize),
+		MaxDatagramSize: int64(cfg.MaxDatagramSize),
+		UDPDontFragment: cfg.UDPDontFragment,
+		FlowIdleTimeout: time.Duration(cfg.FlowIdleTimeout) * time.Millisecond,
+		UDPQueueSize:    cfg.UDPQueueSize,
+		UDPWorkers:      int64(cfg.UDPWorkers),
+		UDPIdleTimeout:  time.Duration(cfg.UDPIdleTimeout) * time.Millisecond,
+		UDPMaxSessions:  cfg.UDPMaxSessions,
+
+		SocketMode: cfg.SocketMode,
+
+		MuxConns:      cfg.MuxConns,
+		MuxMaxStreams: cfg.MuxMaxStreams,
+		MuxMaxMessage: cfg.MuxMaxMessage,
+
+		SendProxyProtocol:   cfg.SendProxyProtocol,
+		AcceptProxyProtocol: cfg.AcceptProxyProtocol,
+
+		MaxHeaderBytes: int64(cfg.MaxHeaderBytes),
+
+		RequestTimeout:   time.Duration(cfg.RequestTimeout) * time.Millisecond,
+		MaxRequestTime:   time.Duration(cfg.MaxRequestTime) * time.Millisecond,
+		AllowStreaming:   cfg.AllowStreaming,
+		TrustedNetworks:  cfg.TrustedNetworks,
+		ForwardedHeaders: forwardedMode(cfg),
+
+		DeferListen:      cfg.DeferListenUntilHealthy,
+		MinAvailable:     cfg.MinAvailable,
+		WithdrawGrace:    time.Duration(cfg.WithdrawGrace) * time.Millisecond,
+		availableChanged: make(chan struct{}, 1),
+
+		Tags: cfg.Tags,
 	}
 
-	// TODO: insert this into the backends too
-	s.dialer = &net.Dialer{
-		Timeout:   s.DialTimeout,
-		KeepAlive: 30 * time.Second,
+	// the registry has already validated the range, redirects, routes,
+	// header rules and networks
+	s.checkPorts, _ = parsePortRange(s.CheckSourcePorts)
+	s.redirects, _ = newRedirectRules(cfg.Redirects)
+	s.routes, _ = newRouteRules(cfg.Routes)
+	s.routeCfg = cfg.Routes
+	s.headers, _ = newHeaderRewriter(cfg)
+	s.httpsRedirects, _ = newHTTPSRedirects(cfg)
+	s.trustedNets, _ = parseTrustedNets(cfg.TrustedNetworks)
+	acl, _ := newClientACL(cfg)
+	s.setClientACL(acl)
+	s.requestIDs, _ = newRequestIDPolicy(cfg)
+	s.redirectCfg = cfg.Redirects
+	cert, _ := loadServiceCert(cfg)
+	s.setCert(newServiceTLS(cfg), cert)
+	s.vhostCerts, _ = loadVHostCerts(cfg)
+	s.vhostCertCfg = cfg.VirtualHostCerts
+	s.setVHostCounters(cfg.VirtualHosts)
+
+	conds, _ := newErrorConditions(cfg.ErrorPageConditions)
+	s.errorPages.SetConditions(conds)
+	s.errCondCfg = cfg.ErrorPageConditions
+
+	s.clientTimeout = newLiveTimeout(s.ClientTimeout)
+	s.serverTimeout = newLiveTimeout(s.ServerTimeout)
+	s.setTimeoutPolicy(s.TimeoutPolicy)
+	s.setNoBackendAction(cfg)
+	s.setBackendFullAction(cfg)
+	s.setRetryPolicy(cfg)
+	s.setDrainTimeout(cfg)
+	s.StickyCookie = cfg.StickyCookie
+	s.rateLimit = newRateLimiter(rateLimitClients)
+	if err := s.setAccessLog(cfg.AccessLog); err != nil {
+		log.With(log.Fields{"service": s.Name, "err": err}).Errorf("ERROR: %s: %s", s.Name, err)
 	}
+	s.rateLimit.set(cfg.MaxConnsPerSecond, cfg.MaxConnsPerClient)
+
+	s.ListenerFactory = defaultListenerFactory
+	s.DialerFactory = defaultDialerFactory
 
 	// create our reverse proxy, using our load-balancing Dial method
-	proxyTransport := &http.Transport{
-		Dial:                s.Dial,
-		MaxIdleConnsPerHost: 10,
+	s.setIdleConns(cfg)
+	s.proxyProtoTransport = &http.Transport{
+		DialContext:       s.DialContext,
+		DialTLSContext:    s.DialContext,
+		DisableKeepAlives: true,
 	}
-	s.httpProxy = NewReverseProxy(proxyTransport)
+	s.httpProxy = NewReverseProxy(s.proxyTransport)
 	s.httpProxy.FlushInterval = time.Second
+	s.httpProxy.Dial = s.DialContext
+	s.httpProxy.ClientTimeout = s.clientTimeout
+	s.httpProxy.BackendScheme = s.backendScheme
 	s.httpProxy.Director = func(req *http.Request) {
 		req.URL.Scheme = "http"
+		setForwardedHeaders(req)
+		s.rewriteRequest(req)
 	}
 
-	s.httpProxy.OnResponse = []ProxyCallback{logProxyRequest, s.errStats, s.errorPages.CheckResponse}
+	s.httpProxy.ReplaceCallbacks(CallbackChain{
+		OnResponse: []ProxyCallback{s.errStats, s.vhostResponse, s.stickyResponse, s.rewriteResponse, s.errorPages.CheckResponse},
+	})
 
 	if s.CheckInterval == 0 {
 		s.CheckInterval = client.DefaultCheckInterval
 	}
+	if s.CheckJitter == 0 {
+		s.CheckJitter = client.DefaultCheckJitter
+	}
 	if s.Rise == 0 {
 		s.Rise = client.DefaultRise
 	}
 	if s.Fall == 0 {
 		s.Fall = client.DefaultFall
 	}
+	if s.ReadinessTTL == 0 {
+		s.ReadinessTTL = client.DefaultReadinessTTL * time.Millisecond
+	}
+	if s.CheckBackoffMax == 0 {
+		s.CheckBackoffMax = client.DefaultCheckBackoffMax * time.Millisecond
+	}
+	if s.UDPBufferSize <= 0 {
+		s.UDPBufferSize = client.DefaultUDPBufferSize
+	}
+	s.setMuxDefaults()
+	s.setDeferListenDefaults()
 
 	if s.Network == "" {
 		s.Network = client.DefaultNet
 	}
+	if networkFamily(s.Network) == "udp" {
+		if s.FlowIdleTimeout <= 0 {
+			s.FlowIdleTimeout = client.DefaultFlowIdleTimeout * time.Millisecond
+		}
+		if s.UDPQueueSize <= 0 {
+			s.UDPQueueSize = client.DefaultUDPQueueSize
+		}
+		if s.UDPWorkers <= 0 {
+			s.UDPWorkers = client.DefaultUDPWorkers
+		}
+		if s.UDPIdleTimeout <= 0 {
+			s.UDPIdleTimeout = client.DefaultUDPIdleTimeout * time.Millisecond
+		}
+		if s.UDPMaxSessions <= 0 {
+			s.UDPMaxSessions = client.DefaultUDPMaxSessions
+		}
+		s.udpClients = newUDPClients(s.FlowIdleTimeout)
+		s.udpSessions = newUDPSessions(s.UDPIdleTimeout, s.UDPMaxSessions)
+	}
 
 	for _, b := range cfg.Backends {
+		if b.Network == "" {
+			b.Network = defaultBackendNetwork(s.Network)
+		}
 		s.add(NewBackend(b))
 	}
 
-	switch cfg.Balance {
-	case client.RoundRobin:
-		s.next = s.roundRobin
-	case client.LeastConn:
-		s.next = s.leastConn
-	default:
-		if cfg.Balance != "" {
-			log.Warnf("invalid balancing algorithm '%s'", cfg.Balance)
-		}
-		s.next = s.roundRobin
-	}
+	s.balancer = newBalancer(cfg.Balance)
+	s.setShadowBalance(cfg.ShadowBalance)
 
 	return s
 }
 
+// Start or stop the shadow balancer. Changing the algorithm resets the
+// comparison.
+// Service *must* be locked, or not yet started.
+func (s *Service) setShadowBalance(name string) {
+	if name == s.ShadowBalance && (s.shadow != nil || name == "") {
+		return
+	}
+
+	s.ShadowBalance = name
+	s.shadow = nil
+	if name != "" {
+		log.With(log.Fields{"service": s.Name}).Printf("Shadowing %s balancing for %s", name, s.Name)
+		s.shadow = newShadowBalancer(name)
+	}
+}
+
 // Update the running configuration.
 func (s *Service) UpdateConfig(cfg client.ServiceConfig) error {
 	s.Lock()
 	defer s.Unlock()
 
-	if s.ClientTimeout != time.Duration(cfg.ClientTimeout)*time.Millisecond {
-		return ErrInvalidServiceUpdate
+	if err := validBalance(cfg.Balance); err != nil {
+		return err
 	}
 
-	if s.Addr != "" && s.Addr != cfg.Addr {
-		return ErrInvalidServiceUpdate
+	// the listener can move to another address, but not to another family
+	network := cfg.Network
+	if network != "" && networkFamily(network) != networkFamily(s.Network) {
+		return fmt.Errorf("%w: can't change from %s to %s", ErrInvalidServiceUpdate, s.Network, network)
+	}
+
+	checkPorts, err := parsePortRange(cfg.CheckSourcePorts)
+	if err != nil {
+		return err
+	}
+
+	trustedNets, err := parseTrustedNets(cfg.TrustedNetworks)
+	if err != nil {
+		return err
+	}
+	acl, err := newClientACL(cfg)
+	if err != nil {
+		return err
+	}
+	requestIDs, err := newRequestIDPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.RequestTimeout < 0 || cfg.MaxRequestTime < 0 {
+		return ErrInvalidReqTimeout
+	}
+	if err := validDeferListen(cfg); err != nil {
+		return err
+	}
+	if err := validNoBackend(cfg); err != nil {
+		return err
+	}
+	if err := validBackendLimits(cfg); err != nil {
+		return err
+	}
+	if err := validBackendsTLS(cfg); err != nil {
+		return err
+	}
+	if _, err := newRouteRules(cfg.Routes); err != nil {
+		return err
+	}
+	headers, err := newHeaderRewriter(cfg)
+	if err != nil {
+		return err
+	}
+	httpsRedirects, err := newHTTPSRedirects(cfg)
+	if err != nil {
+		return err
+	}
+	if err := validForwarded(cfg); err != nil {
+		return err
+	}
+	if err := validAccessLog(cfg.AccessLog); err != nil {
+		return err
+	}
+	if err := validRetry(cfg); err != nil {
+		return err
+	}
+	if err := validStickyCookie(cfg); err != nil {
+		return err
+	}
+	if cfg.DrainTimeout < 0 {
+		return ErrInvalidDrainTimeout
+	}
+	if cfg.CheckJitter < -1 || cfg.CheckJitter > maxCheckJitter {
+		return ErrInvalidCheckJitter
+	}
+	if err := validIdleConns(cfg); err != nil {
+		return err
+	}
+	if cfg.UDPIdleTimeout < 0 || cfg.UDPMaxSessions < 0 {
+		return ErrInvalidUDPSessions
+	}
+	if cfg.UDPWorkers < 0 {
+		return ErrInvalidUDPWorkers
+	}
+
+	cfg.Network = s.Network
+	if err := validMux(cfg); err != nil {
+		return err
+	}
+	if err := validSocketMode(cfg); err != nil {
+		return err
+	}
+	if err := validRateLimits(cfg); err != nil {
+		return err
+	}
+	if err := validProxyProtocol(cfg); err != nil {
+		return err
+	}
+	if err := validAcceptProxyProtocol(cfg); err != nil {
+		return err
+	}
+	// the certificate is only loaded again if the settings changed
+	tlsSettings, tlsChanged := newServiceTLS(cfg), false
+	var cert *tls.Certificate
+	if tlsSettings != s.tls {
+		if cert, err = loadServiceCert(cfg); err != nil {
+			return err
+		}
+		tlsChanged = true
+	}
+	// the virtual hosts may have changed even if their certificates haven't
+	vhostCerts, err := loadVHostCerts(cfg)
+	if err != nil {
+		return err
+	}
+
+	// build the rules and open the access log before anything changes, so a
+	// bad rule leaves the service as it was. The counts are kept for those
+	// that haven't changed, and the access log is kept open.
+	redirectsChanged := !reflect.DeepEqual(s.redirectCfg, cfg.Redirects)
+	var redirects []*redirectRule
+	if redirectsChanged {
+		if redirects, err = newRedirectRules(cfg.Redirects); err != nil {
+			return err
+		}
+	}
+	routesChanged := !reflect.DeepEqual(s.routeCfg, cfg.Routes)
+	var routes []*routeRule
+	if routesChanged {
+		if routes, err = newRouteRules(cfg.Routes); err != nil {
+			return err
+		}
+	}
+	condsChanged := !reflect.DeepEqual(s.errCondCfg, cfg.ErrorPageConditions)
+	var conds map[int]*errorCondition
+	if condsChanged {
+		if conds, err = newErrorConditions(cfg.ErrorPageConditions); err != nil {
+			return err
+		}
+	}
+	accessLogChanged := !reflect.DeepEqual(s.accessLogCfg, cfg.AccessLog)
+	var accessLogger *accessLog
+	if accessLogChanged {
+		if accessLogger, err = newAccessLog(cfg.AccessLog); err != nil {
+			return err
+		}
+	}
+
+	// and move last, so a failed bind leaves the service as it was too
+	if s.Addr != "" && (s.Addr != cfg.Addr || network != "" && network != s.Network) {
+		if err := s.moveListener(network, cfg.Addr); err != nil {
+			accessLogger.close()
+			return err
+		}
+	}
+
+	if redirectsChanged {
+		s.redirects = redirects
+		s.redirectCfg = cfg.Redirects
+	}
+	if routesChanged {
+		s.routes = routes
+		s.routeCfg = cfg.Routes
+	}
+	s.headers = headers
+	if condsChanged {
+		s.errorPages.SetConditions(conds)
+		s.errCondCfg = cfg.ErrorPageConditions
+	}
+	if accessLogChanged {
+		s.accessLog.close()
+		s.accessLog, s.accessLogCfg = accessLogger, cfg.AccessLog
 	}
 
 	s.CheckInterval = cfg.CheckInterval
 	s.Fall = cfg.Fall
 	s.Rise = cfg.Rise
+
+	// The policy needs to be in place before the new timeouts are visible to
+	// any connections.
+	s.setTimeoutPolicy(cfg.TimeoutPolicy)
+	s.ClientTimeout = time.Duration(cfg.ClientTimeout) * time.Millisecond
+	s.clientTimeout.Set(s.ClientTimeout)
 	s.ServerTimeout = time.Duration(cfg.ServerTimeout) * time.Millisecond
+	s.serverTimeout.Set(s.ServerTimeout)
+
 	s.DialTimeout = time.Duration(cfg.DialTimeout) * time.Millisecond
 	s.HTTPSRedirect = cfg.HTTPSRedirect
+	s.httpsRedirects = httpsRedirects
+	// toggling maintenance is an intervention, so checks shouldn't be
+	// backing off
+	maintenanceChanged := s.MaintenanceMode != cfg.MaintenanceMode
 	s.MaintenanceMode = cfg.MaintenanceMode
+	s.DirectiveSecrets = unredactSecrets(cfg.DirectiveSecrets, s.DirectiveSecrets)
+	s.Tags = cfg.Tags
 
-	if s.Balance != cfg.Balance {
-		s.Balance = cfg.Balance
-		switch s.Balance {
-		case client.RoundRobin:
-			s.next = s.roundRobin
-		case client.LeastConn:
-			s.next = s.leastConn
-		default:
-			if cfg.Balance != "" {
-				log.Warnf("invalid balancing algorithm '%s'", cfg.Balance)
+	s.ReadinessTTL = time.Duration(cfg.ReadinessTTL) * time.Millisecond
+	if s.ReadinessTTL == 0 {
+		s.ReadinessTTL = client.DefaultReadinessTTL * time.Millisecond
+	}
+	s.CheckBackoff = time.Duration(cfg.CheckBackoff) * time.Millisecond
+	s.CheckBackoffMax = time.Duration(cfg.CheckBackoffMax) * time.Millisecond
+	if s.CheckBackoffMax == 0 {
+		s.CheckBackoffMax = client.DefaultCheckBackoffMax * time.Millisecond
+	}
+	s.CheckJitter = cfg.CheckJitter
+	if s.CheckJitter == 0 {
+		s.CheckJitter = client.DefaultCheckJitter
+	}
+
+	bufferSize := int64(cfg.UDPBufferSize)
+	if bufferSize <= 0 {
+		bufferSize = client.DefaultUDPBufferSize
+	}
+	atomic.StoreInt64(&s.UDPBufferSize, bufferSize)
+	atomic.StoreInt64(&s.MaxDatagramSize, int64(cfg.MaxDatagramSize))
+	if s.udpClients != nil {
+		s.FlowIdleTimeout = time.Duration(cfg.FlowIdleTimeout) * time.Millisecond
+		if s.FlowIdleTimeout <= 0 {
+			s.FlowIdleTimeout = client.DefaultFlowIdleTimeout * time.Millisecond
+		}
+		s.udpClients.setIdle(s.FlowIdleTimeout)
+
+		queueSize := cfg.UDPQueueSize
+		if queueSize <= 0 {
+			queueSize = client.DefaultUDPQueueSize
+		}
+		if queueSize != s.UDPQueueSize {
+			s.UDPQueueSize = queueSize
+			for _, b := range s.Backends {
+				s.startUDPQueue(b, queueSize)
 			}
-			s.next = s.roundRobin
 		}
+
+		s.UDPIdleTimeout = time.Duration(cfg.UDPIdleTimeout) * time.Millisecond
+		if s.UDPIdleTimeout <= 0 {
+			s.UDPIdleTimeout = client.DefaultUDPIdleTimeout * time.Millisecond
+		}
+		s.UDPMaxSessions = cfg.UDPMaxSessions
+		if s.UDPMaxSessions <= 0 {
+			s.UDPMaxSessions = client.DefaultUDPMaxSessions
+		}
+		s.udpSessions.setLimits(s.UDPIdleTimeout, s.UDPMaxSessions)
+
+		workers := int64(cfg.UDPWorkers)
+		if workers <= 0 {
+			workers = client.DefaultUDPWorkers
+		}
+		atomic.StoreInt64(&s.UDPWorkers, workers)
+		if s.udpReaders != nil {
+			s.startUDPReaders(s.udpReaders)
+		}
+	}
+	if s.UDPDontFragment != cfg.UDPDontFragment {
+		s.UDPDontFragment = cfg.UDPDontFragment
+		s.setDontFragment()
+	}
+
+	s.CheckSourcePorts = cfg.CheckSourcePorts
+	s.CheckPreamble = cfg.CheckPreamble
+	s.CheckUserAgent = cfg.CheckUserAgent
+	s.checkPorts = checkPorts
+	s.BindInterface = cfg.BindInterface
+	atomic.StoreInt64(&s.MaxHeaderBytes, int64(cfg.MaxHeaderBytes))
+	s.RequestTimeout = time.Duration(cfg.RequestTimeout) * time.Millisecond
+	s.MaxRequestTime = time.Duration(cfg.MaxRequestTime) * time.Millisecond
+	s.AllowStreaming = cfg.AllowStreaming
+	s.TrustedNetworks = cfg.TrustedNetworks
+	s.trustedNets = trustedNets
+	s.setClientACL(acl)
+	s.requestIDs = requestIDs
+
+	s.MinAvailable = cfg.MinAvailable
+	s.WithdrawGrace = time.Duration(cfg.WithdrawGrace) * time.Millisecond
+	if s.DeferListen != cfg.DeferListenUntilHealthy {
+		s.DeferListen = cfg.DeferListenUntilHealthy
+		s.setDeferListen()
+	}
+	s.setDeferListenDefaults()
+	s.notifyAvailable()
+	s.setNoBackendAction(cfg)
+	s.setBackendFullAction(cfg)
+	s.setRetryPolicy(cfg)
+	s.ForwardedHeaders = forwardedMode(cfg)
+	s.StickyCookie = cfg.StickyCookie
+	s.rateLimit.set(cfg.MaxConnsPerSecond, cfg.MaxConnsPerClient)
+	if s.SocketMode != cfg.SocketMode {
+		s.SocketMode = cfg.SocketMode
+		if s.listening {
+			s.setSocketMode()
+		}
+	}
+	s.backendsChanged()
+	s.setDrainTimeout(cfg)
+	s.setIdleConns(cfg)
+
+	muxConns, muxStreams, muxMessage := s.MuxConns, s.MuxMaxStreams, s.MuxMaxMessage
+	s.MuxConns = cfg.MuxConns
+	s.MuxMaxStreams = cfg.MuxMaxStreams
+	s.MuxMaxMessage = cfg.MuxMaxMessage
+	s.setMuxDefaults()
+	s.SendProxyProtocol = cfg.SendProxyProtocol
+	s.AcceptProxyProtocol = cfg.AcceptProxyProtocol
+	if tlsChanged {
+		log.With(log.Fields{"service": s.Name}).Printf("Updating TLS certificate for %s", s.Name)
+		s.setCert(tlsSettings, cert)
+	}
+	s.vhostCerts = vhostCerts
+	s.vhostCertCfg = cfg.VirtualHostCerts
+	muxChanged := muxConns != s.MuxConns || muxStreams != s.MuxMaxStreams || muxMessage != s.MuxMaxMessage
+
+	for _, b := range s.Backends {
+		b.Lock()
+		b.readinessTTL = s.ReadinessTTL
+		b.checkPorts = s.checkPorts
+		b.checkPreamble = []byte(s.CheckPreamble)
+		b.checkUserAgent = s.CheckUserAgent
+		b.serviceTags = s.Tags
+		b.backoffAfter = s.CheckBackoff
+		b.backoffMax = s.CheckBackoffMax
+		b.checkJitter = s.checkJitter()
+		b.setBindInterface(b.interfaceFor(s.BindInterface))
+		if maintenanceChanged {
+			b.resetBackoff()
+			b.setMaintenance(s.MaintenanceMode)
+		}
+		if muxChanged {
+			b.setMuxPool(s.newMuxPool(b))
+		}
+		b.Unlock()
+	}
+
+	if s.Balance != cfg.Balance {
+		s.Balance = cfg.Balance
+		s.balancer = newBalancer(s.Balance)
 	}
+	s.setShadowBalance(cfg.ShadowBalance)
 
 	return nil
 }
 
+// Set how timeout changes are applied to existing connections.
+// Service *must* be locked, or not yet started.
+func (s *Service) setTimeoutPolicy(policy string) {
+	switch policy {
+	case client.TimeoutRearm:
+	case client.TimeoutKeep, "":
+		policy = client.TimeoutKeep
+	default:
+		log.Warnf("invalid timeout policy '%s'", policy)
+		policy = client.TimeoutKeep
+	}
+
+	s.TimeoutPolicy = policy
+	rearm := policy == client.TimeoutRearm
+	s.clientTimeout.SetRearm(rearm)
+	s.serverTimeout.SetRearm(rearm)
+}
+
 func (s *Service) Stats() ServiceStat {
 	s.Lock()
 	defer s.Unlock()
@@ -214,25 +896,120 @@ func (s *Service) Stats() ServiceStat {
 		CheckInterval: s.CheckInterval,
 		Fall:          s.Fall,
 		Rise:          s.Rise,
-		ClientTimeout: int(s.ClientTimeout / time.Millisecond),
-		ServerTimeout: int(s.ServerTimeout / time.Millisecond),
+		ClientTimeout: int(s.clientTimeout.Get() / time.Millisecond),
+		ServerTimeout: int(s.serverTimeout.Get() / time.Millisecond),
 		DialTimeout:   int(s.DialTimeout / time.Millisecond),
 		HTTPConns:     s.HTTPConns,
 		HTTPErrors:    s.HTTPErrors,
 		HTTPActive:    atomic.LoadInt64(&s.HTTPActive),
 		Rcvd:          atomic.LoadInt64(&s.Rcvd),
 		Sent:          atomic.LoadInt64(&s.Sent),
+		Errors:        atomic.LoadInt64(&s.Errors),
+
+		ClientBytesIn:  atomic.LoadInt64(&s.clientStats.read),
+		ClientBytesOut: atomic.LoadInt64(&s.clientStats.written),
+		Accepted:       atomic.LoadInt64(&s.clientStats.accepted),
+		AcceptErrors:   atomic.LoadInt64(&s.clientStats.acceptErrors),
+
+		Directives:      atomic.LoadInt64(&s.Directives),
+		DirectiveErrors: atomic.LoadInt64(&s.DirectiveErrors),
+
+		RetryBudgetExhausted: atomic.LoadInt64(&s.RetryBudgetExhausted),
+		RateLimited:          atomic.LoadInt64(&s.RateLimited),
+		ClientDenied:         atomic.LoadInt64(&s.ClientDenied),
+		LocalResponses:       s.localStats(),
+		VHostStats:           s.vhostStats(),
+
+		MaxRequestTimeExceeded: atomic.LoadInt64(&s.MaxRequestTimeExceeded),
+
+		TLS:                s.terminatesTLS(),
+		TLSHandshakeErrors: atomic.LoadInt64(&s.TLSHandshakeErrors),
+
+		UDPTruncated:    atomic.LoadInt64(&s.UDPTruncated),
+		UDPOversize:     atomic.LoadInt64(&s.UDPOversize),
+		UDPMsgTooLong:   atomic.LoadInt64(&s.UDPMsgTooLong),
+		UDPBackendsDown: atomic.LoadInt64(&s.UDPBackendsDown),
+		UDPDontFragment: s.dontFragment,
+
+		Empty:       len(s.Backends) == 0,
+		NoBackends:  atomic.LoadInt64(&s.NoBackends),
+		Holding:     s.holding,
+		HoldDropped: s.holdDropped,
+
+		Tags: s.Tags,
+	}
+
+	if s.DeferListen {
+		stats.ListenState = s.listenState
+	}
+
+	for _, r := range s.redirects {
+		stats.Redirects = append(stats.Redirects, r.stat())
+	}
+	for _, r := range s.routes {
+		stats.Routes = append(stats.Routes, r.stat())
 	}
+	stats.ErrorConditions = s.errorPages.conditionStats()
 
+	stats.BackendStates = make(map[string]int)
 	for _, b := range s.Backends {
-		stats.Backends = append(stats.Backends, b.Stats())
-		stats.Sent += b.Sent
-		stats.Rcvd += b.Rcvd
+		stat := b.Stats()
+		stats.Backends = append(stats.Backends, stat)
+		stats.BackendStates[stat.State]++
+		// a UDP service counts its clients' traffic itself, and the
+		// backends count theirs
+		if s.udpClients == nil {
+			stats.Sent += b.Sent
+			stats.Rcvd += b.Rcvd
+		}
 		stats.Errors += b.Errors
 		stats.Conns += b.Conns
 		stats.Active += b.Active
 	}
+	for _, b := range s.drainingBackends {
+		stat := b.Stats()
+		stats.Backends = append(stats.Backends, stat)
+		stats.BackendStates[stat.State]++
+		stats.Active += stat.Active
+	}
 
+	stats.Network = s.Network
+	if s.udpClients != nil {
+		stats.Conns, stats.Active = 0, 0
+		stats.UDP = s.udpStats()
+	}
+
+	return stats
+}
+
+// Must be called with the service locked.
+func (s *Service) udpStats() *UDPStat {
+	stats := &UDPStat{
+		DatagramsIn:      atomic.LoadInt64(&s.UDPDatagramsIn),
+		DatagramsOut:     atomic.LoadInt64(&s.UDPDatagramsOut),
+		ClientWindow:     int(s.udpClients.window / time.Millisecond),
+		FlowIdleTimeout:  int(s.FlowIdleTimeout / time.Millisecond),
+		BackendDatagrams: make(map[string]int64),
+		QueueSize:        s.UDPQueueSize,
+		BackendQueues:    make(map[string]UDPQueueStat),
+		Sessions:         s.udpSessions.len(),
+		MaxSessions:      s.UDPMaxSessions,
+		SessionsOpened:   atomic.LoadInt64(&s.udpSessions.opened),
+		SessionsExpired:  atomic.LoadInt64(&s.udpSessions.expired),
+		SessionsFull:     atomic.LoadInt64(&s.udpSessions.full),
+		UDPIdleTimeout:   int(s.UDPIdleTimeout / time.Millisecond),
+		Replies:          atomic.LoadInt64(&s.udpSessions.replies),
+	}
+	stats.UniqueClients, stats.LastUniqueClients, stats.ActiveFlows = s.udpClients.counts()
+
+	for _, b := range s.Backends {
+		stats.BackendDatagrams[b.Name] = atomic.LoadInt64(&b.Datagrams)
+		if q := b.sendQueue(); q != nil {
+			qs := q.stats()
+			stats.BackendQueues[b.Name] = qs
+			stats.QueueDropped += qs.Dropped
+		}
+	}
 	return stats
 }
 
@@ -243,6 +1020,8 @@ func (s *Service) Config() client.ServiceConfig {
 }
 
 func (s *Service) config() client.ServiceConfig {
+	perSecond, perClient := s.rateLimit.limits()
+	acl := s.getClientACL()
 
 	config := client.ServiceConfig{
 		Name:            s.Name,
@@ -253,13 +1032,102 @@ func (s *Service) config() client.ServiceConfig {
 		CheckInterval:   s.CheckInterval,
 		Fall:            s.Fall,
 		Rise:            s.Rise,
-		ClientTimeout:   int(s.ClientTimeout / time.Millisecond),
-		ServerTimeout:   int(s.ServerTimeout / time.Millisecond),
+		ClientTimeout:   int(s.clientTimeout.Get() / time.Millisecond),
+		ServerTimeout:   int(s.serverTimeout.Get() / time.Millisecond),
 		DialTimeout:     int(s.DialTimeout / time.Millisecond),
+		TimeoutPolicy:   s.TimeoutPolicy,
+		ReadinessTTL:    int(s.ReadinessTTL / time.Millisecond),
+		CheckBackoff:    int(s.CheckBackoff / time.Millisecond),
+		CheckBackoffMax: int(s.CheckBackoffMax / time.Millisecond),
+		CheckJitter:     s.CheckJitter,
 		ErrorPages:      s.errPagesCfg,
 		Network:         s.Network,
+
+		ErrorPageConditions: s.errCondCfg,
+
 		MaintenanceMode: s.MaintenanceMode,
+
+		DirectiveSecrets: s.DirectiveSecrets,
+
+		CheckSourcePorts: s.CheckSourcePorts,
+		CheckPreamble:    s.CheckPreamble,
+		CheckUserAgent:   s.CheckUserAgent,
+		BindInterface:    s.BindInterface,
+
+		Redirects: s.redirectCfg,
+		Routes:    s.routeCfg,
+
+		Headers:            s.headers.cfg,
+		VirtualHostHeaders: s.headers.vhostCfg,
+
+		VirtualHostHTTPSRedirect: s.httpsRedirects.vhostCfg,
+		HTTPSRedirectExempt:      s.httpsRedirects.exempt,
+
+		UDPBufferSize:   int(atomic.LoadInt64(&s.UDPBufferSize)),
+		MaxDatagramSize: int(atomic.LoadInt64(&s.MaxDatagramSize)),
+		UDPDontFragment: s.UDPDontFragment,
+		FlowIdleTimeout: int(s.FlowIdleTimeout / time.Millisecond),
+		UDPQueueSize:    s.UDPQueueSize,
+		UDPWorkers:      int(atomic.LoadInt64(&s.UDPWorkers)),
+		UDPIdleTimeout:  int(s.UDPIdleTimeout / time.Millisecond),
+		UDPMaxSessions:  s.UDPMaxSessions,
+
+		SocketMode: s.SocketMode,
+
+		MuxConns:      s.MuxConns,
+		MuxMaxStreams: s.MuxMaxStreams,
+		MuxMaxMessage: s.MuxMaxMessage,
+
+		SendProxyProtocol:   s.SendProxyProtocol,
+		AcceptProxyProtocol: s.AcceptProxyProtocol,
+
+		TLSCert:    s.tls.cert,
+		TLSKey:     s.tls.key,
+		TLSCertPEM: s.tls.certPEM,
+		TLSKeyPEM:  s.tls.keyPEM,
+
+		VirtualHostCerts: s.vhostCertCfg,
+
+		MaxHeaderBytes: int(atomic.LoadInt64(&s.MaxHeaderBytes)),
+
+		ShadowBalance: s.ShadowBalance,
+		StickyCookie:  s.StickyCookie,
+
+		MaxConnsPerSecond: perSecond,
+		MaxConnsPerClient: perClient,
+
+		RequestTimeout:   int(s.RequestTimeout / time.Millisecond),
+		MaxRequestTime:   int(s.MaxRequestTime / time.Millisecond),
+		AllowStreaming:   s.AllowStreaming,
+		TrustedNetworks:  s.TrustedNetworks,
+		ForwardedHeaders: s.ForwardedHeaders,
+		AllowedCIDRs:     acl.allowCfg,
+		DeniedCIDRs:      acl.denyCfg,
+		LogDenied:        acl.log,
+		AccessLog:        s.accessLogCfg,
+		RetryPolicy:      s.RetryPolicy,
+		RetryCount:       s.RetryCount,
+
+		DeferListenUntilHealthy: s.DeferListen,
+		MinAvailable:            s.MinAvailable,
+		WithdrawGrace:           int(s.WithdrawGrace / time.Millisecond),
+
+		NoBackendAction: s.NoBackendAction,
+		HoldTimeout:     int(s.HoldTimeout / time.Millisecond),
+		HoldQueue:       s.HoldQueue,
+
+		BackendFullAction: s.BackendFullAction,
+		QueueTimeout:      int(s.QueueTimeout / time.Millisecond),
+
+		DrainTimeout: int(s.DrainTimeout / time.Millisecond),
+
+		MaxIdleConnsPerHost: s.proxyTransport.MaxIdleConnsPerHost,
+		MaxIdleConns:        s.proxyTransport.MaxIdleConns,
+		IdleConnTimeout:     int(s.proxyTransport.IdleConnTimeout / time.Millisecond),
+
+		Tags: s.Tags,
 	}
+	s.requestIDs.config(&config)
 	for _, b := range s.Backends {
 		config.Backends = append(config.Backends, b.Config())
 	}
@@ -283,50 +1151,117 @@ func (s *Service) get(name string) *Backend {
 	return nil
 }
 
+// Return the backend at an address, or nil if there isn't one.
+func (s *Service) backendAt(addr string) *Backend {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+// Replace the tags of a backend, without disturbing its connections or
+// counters.
+func (s *Service) setBackendTags(name string, tags map[string]string) {
+	if b := s.get(name); b != nil {
+		b.Lock()
+		b.Tags = tags
+		b.Unlock()
+	}
+}
+
+// Apply a patched config to one of the backends in place. The balancing
+// starts again from the beginning, in case the weight changed.
+func (s *Service) patchBackend(b *Backend, cfg client.BackendConfig) {
+	b.patch(cfg)
+
+	s.Lock()
+	s.balancer = newBalancer(s.Balance)
+	s.Unlock()
+}
+
 // Add or replace a Backend in this service
-func (s *Service) add(backend *Backend) {
+func (s *Service) add(backend *Backend) error {
 	s.Lock()
 	defer s.Unlock()
 
-	log.Printf("Adding %s backend %s{%s} for %s at %s", backend.Network, backend.Name, backend.Addr, s.Name, s.Addr)
-	backend.up = true
-	backend.rwTimeout = s.ServerTimeout
+	// The registry has already checked the networks, but never add a backend
+	// that can't be used.
+	if err := checkNetworks(s.Network, backend.Network, bridgeUnix); err != nil {
+		log.With(log.Fields{"service": s.Name, "backend": backend.Name, "err": err}).Errorf("ERROR: backend %s: %s", backend.Name, err)
+		return err
+	}
+
+	log.With(log.Fields{"service": s.Name, "backend": backend.Name, "addr": backend.Addr}).Printf("Adding %s backend %s{%s} for %s at %s", backend.Network, backend.Name, backend.Addr, s.Name, s.Addr)
+	// a service waiting for healthy backends doesn't assume they're up
+	backend.up = !s.DeferListen || backend.CheckAddr == ""
+	backend.availableChanged = s.availableChanged
+	backend.rwTimeout = s.serverTimeout
 	backend.dialTimeout = s.DialTimeout
 	backend.checkInterval = time.Duration(s.CheckInterval) * time.Millisecond
-
-	// We may add some allowed protocol bridging in the future, but for now just fail
-	if s.Network[:3] != backend.Network[:3] {
-		log.Errorf("ERROR: backend %s cannot use network '%s'", backend.Name, backend.Network)
+	backend.rise = s.Rise
+	backend.fall = s.Fall
+	backend.readinessTTL = s.ReadinessTTL
+	backend.dialer = s.DialerFactory
+	backend.checkPorts = s.checkPorts
+	backend.checkPreamble = []byte(s.CheckPreamble)
+	backend.checkUserAgent = s.CheckUserAgent
+	backend.backoffAfter = s.CheckBackoff
+	backend.backoffMax = s.CheckBackoffMax
+	backend.checkJitter = s.checkJitter()
+	backend.mux = s.newMuxPool(backend)
+	backend.setMaintenance(s.MaintenanceMode)
+	backend.setBindInterface(backend.interfaceFor(s.BindInterface))
+	if s.udpClients != nil {
+		s.startUDPQueue(backend, s.UDPQueueSize)
 	}
 
+	backend.service = s.Name
+	backend.serviceTags = s.Tags
+
 	// replace an existing backend if we have it.
 	for i, b := range s.Backends {
 		if b.Name == backend.Name {
-			b.Stop()
 			s.Backends[i] = backend
+			s.backendsVer++
+			s.retire(b, s.DrainTimeout)
 			backend.Start()
-			return
+			return nil
 		}
 	}
 
 	s.Backends = append(s.Backends, backend)
+	s.backendsVer++
 
 	backend.Start()
+	s.notifyAvailable()
+	s.backendsChanged()
+	return nil
 }
 
-// Remove a Backend by name
-func (s *Service) remove(name string) bool {
+// Remove a Backend by name, leaving its connections up to drain to finish.
+func (s *Service) remove(name string, drain time.Duration) bool {
 	s.Lock()
 	defer s.Unlock()
 
 	for i, b := range s.Backends {
 		if b.Name == name {
-			log.Printf("Removing %s backend %s{%s} for %s at %s", b.Network, b.Name, b.Addr, s.Name, s.Addr)
+			log.With(log.Fields{"service": s.Name, "backend": b.Name, "addr": b.Addr}).Printf("Removing %s backend %s{%s} for %s at %s", b.Network, b.Name, b.Addr, s.Name, s.Addr)
 			last := len(s.Backends) - 1
 			deleted := b
 			s.Backends[i], s.Backends[last] = s.Backends[last], nil
 			s.Backends = s.Backends[:last]
-			deleted.Stop()
+			s.backendsVer++
+			if s.shadow != nil {
+				s.shadow.forget(name)
+			}
+			s.retire(deleted, drain)
+			s.notifyAvailable()
+			s.backendsChanged()
 			return true
 		}
 	}
@@ -342,107 +1277,175 @@ func (s *Service) start() (err error) {
 		s.Backends = make([]*Backend, 0)
 	}
 
+	if s.DeferListen {
+		if family := networkFamily(s.Network); family != "tcp" && family != "udp" {
+			return fmt.Errorf("%w: %q service", ErrInvalidNetwork, s.Network)
+		}
+		s.setDeferListen()
+		return nil
+	}
+	if err := s.listen(); err != nil {
+		return err
+	}
+	// bound first even if it's refusing connections, so a bad address is
+	// still an error
+	s.backendsChanged()
+	return nil
+}
+
+// Bind the client listener, and start serving it.
+// Service *must* be locked.
+func (s *Service) listen() error {
 	switch s.Network {
-	case "tcp", "tcp4", "tcp6":
-		log.Printf("Starting TCP listener for %s on %s", s.Name, s.Addr)
+	case "tcp", "tcp4", "tcp6", "unix":
+		if s.Network == "unix" {
+			log.With(log.Fields{"service": s.Name, "addr": s.Addr}).Printf("Starting unix listener for %s on %s", s.Name, s.Addr)
+		} else {
+			log.With(log.Fields{"service": s.Name, "addr": s.Addr}).Printf("Starting TCP listener for %s on %s", s.Name, s.Addr)
+		}
 
-		s.tcpListener, err = newTimeoutListener(s.Network, s.Addr, s.ClientTimeout)
+		l, err := newTimeoutListener(s.ListenerFactory, s.Network, s.Addr, s.clientTimeout, &s.clientStats)
 		if err != nil {
-			return err
+			return &ListenError{Service: s.Name, Addr: s.Addr, Err: err}
+		}
+		if s.Network == "unix" {
+			s.socketOwned = true
+			if err := s.setSocketMode(); err != nil {
+				l.Close()
+				s.removeSocket()
+				return &ListenError{Service: s.Name, Addr: s.Addr, Err: err}
+			}
 		}
 
-		go s.runTCP()
+		s.retireListener()
+		s.tcpListener = l
+		s.listening = true
+		goTask("tcp_accept", s.Name, func() { s.runTCP(l) })
 	case "udp", "udp4", "udp6":
-		log.Printf("Starting UDP listener for %s on %s", s.Name, s.Addr)
+		log.With(log.Fields{"service": s.Name, "addr": s.Addr}).Printf("Starting UDP listener for %s on %s", s.Name, s.Addr)
 
-		laddr, err := net.ResolveUDPAddr(s.Network, s.Addr)
-		if err != nil {
-			return err
-		}
-		s.udpListener, err = net.ListenUDP(s.Network, laddr)
+		l, err := s.ListenerFactory.ListenPacket(s.Network, s.Addr)
 		if err != nil {
-			return err
+			return &ListenError{Service: s.Name, Addr: s.Addr, Err: err}
 		}
+		s.udpListener = l
+		s.udpClosed = make(chan struct{})
+		s.setDontFragment()
 
-		go s.runUDP()
+		s.listening = true
+		s.udpReaders = &udpReaders{conn: l, closed: s.udpClosed}
+		s.startUDPReaders(s.udpReaders)
 	default:
-		return fmt.Errorf("Error: unknown network '%s'", s.Network)
+		return fmt.Errorf("%w: %q service", ErrInvalidNetwork, s.Network)
 	}
 
 	return nil
 }
 
-// Start the Service's Accept loop
-func (s *Service) runTCP() {
-	for {
-		conn, err := s.tcpListener.Accept()
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Warnln("WARN:", err)
-				continue
-			}
-			// we must be getting shut down
-			return
-		}
+// ListenError is returned when a service can't bind its listener, wrapping
+// the error from the network.
+type ListenError struct {
+	Service string
+	Addr    string
+	Err     error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("cannot listen for %s on %s: %s", e.Service, e.Addr, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
 
-		go s.connectTCP(conn)
+// Set the permissions of a unix service's socket, if they're configured.
+// Service *must* be locked.
+func (s *Service) setSocketMode() error {
+	mode, err := parseSocketMode(s.SocketMode)
+	if err != nil || mode == 0 {
+		return err
+	}
+	if err := os.Chmod(s.Addr, mode); err != nil {
+		log.With(log.Fields{"service": s.Name, "addr": s.Addr, "err": err}).Errorf("ERROR: setting the mode of %s's socket: %s", s.Name, err)
+		return err
 	}
+	return nil
 }
 
-func (s *Service) runUDP() {
-	buff := make([]byte, 65536)
-	conn := s.udpListener
+// Remove a unix service's socket, unless it's been handed to another
+// process.
+// Service *must* be locked.
+func (s *Service) removeSocket() {
+	if !s.socketOwned {
+		return
+	}
+	s.socketOwned = false
+	if err := os.Remove(s.Addr); err != nil && !os.IsNotExist(err) {
+		log.With(log.Fields{"service": s.Name, "addr": s.Addr, "err": err}).Warnf("WARN: removing %s's socket: %s", s.Name, err)
+	}
+}
 
-	// for UDP, we can proxy the data right here.
+// Keep the current listener while its connections drain, so they're still
+// counted and closed on shutdown, and forget any that have finished.
+// Service *must* be locked.
+func (s *Service) retireListener() {
+	draining := s.draining[:0]
+	for _, l := range s.draining {
+		if l.ActiveConns() > 0 {
+			draining = append(draining, l)
+		}
+	}
+	if l, ok := s.tcpListener.(*timeoutListener); ok && l.ActiveConns() > 0 {
+		draining = append(draining, l)
+	}
+	s.draining = draining
+}
+
+// Start the Service's Accept loop
+func (s *Service) runTCP(l net.Listener) {
 	for {
-		n, _, err := conn.ReadFromUDP(buff)
+		conn, err := l.Accept()
 		if err != nil {
-			// we can't cleanly signal the Read to stop, so we have to
-			// string-match this error.
-			if err.Error() == "use of closed network connection" {
-				// normal shutdown
-				return
-			} else if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Warnf("WARN: %s", err.Error())
-			} else {
-				// unexpected error, log it before exiting
-				log.Errorf("ERROR: %s", err.Error())
-				atomic.AddInt64(&s.Errors, 1)
-				return
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				log.With(log.Fields{"service": s.Name, "err": err}).Warnln("WARN:", err)
+				continue
 			}
+			// we must be getting shut down
+			return
 		}
 
-		if n == 0 {
+		if !s.rateLimit.allow(normalizeClientAddr(conn.RemoteAddr().String()).IP) {
+			log.With(log.Fields{"service": s.Name, "client": conn.RemoteAddr().String()}).Debugf("Rate limited connection from %s to %s", conn.RemoteAddr(), s.Name)
+			atomic.AddInt64(&s.RateLimited, 1)
+			conn.Close()
 			continue
 		}
 
-		atomic.AddInt64(&s.Rcvd, int64(n))
-
-		backend := s.udpRoundRobin()
-		if backend == nil {
-			// this could produce a lot of message
-			// TODO: log some %, or max rate of messages
-			continue
-		}
+		tcpConnTasks.goTask(func() { s.connectTCP(conn) })
+	}
+}
 
-		n, err = conn.WriteTo(buff[:n], backend.udpAddr)
-		if err != nil {
-			if err, ok := err.(net.Error); ok && err.Temporary() {
-				log.Warnf("WARN: %s", err.Error())
-				continue
-			}
+// Set the DF bit on the UDP listener to match the config.
+// Service *must* be locked.
+func (s *Service) setDontFragment() {
+	if s.udpListener == nil || (!s.UDPDontFragment && !s.dontFragment) {
+		return
+	}
 
-			log.Errorf("ERROR: %s", err.Error())
-			atomic.AddInt64(&s.Errors, 1)
-		} else {
-			atomic.AddInt64(&s.Sent, int64(n))
-		}
+	if err := setDontFragment(s.udpListener, s.UDPDontFragment); err != nil {
+		log.With(log.Fields{"service": s.Name, "err": err}).Warnf("WARN: cannot set don't fragment for %s: %s", s.Name, err)
+		s.dontFragment = false
+		s.udpSessions.setDontFragment(false)
+		return
 	}
+	s.dontFragment = s.UDPDontFragment
+	s.udpSessions.setDontFragment(s.dontFragment)
 }
 
-// Return the addresses of the current backends in the order they would be balanced
-func (s *Service) NextAddrs() []string {
-	backends := s.next()
+// Return the addresses of the current backends in the order they would be
+// balanced for a client, whose IP may be nil.
+func (s *Service) NextAddrs(clientIP net.IP) []string {
+	backends := s.next(clientIP)
 
 	addrs := make([]string, len(backends))
 	for i, b := range backends {
@@ -476,36 +1479,60 @@ func (s *Service) Available() int {
 // If Dial returns an error, we wrap it in DialError, so that a ReverseProxy
 // can determine if it's safe to call RoundTrip again on a new host.
 func (s *Service) Dial(nw, addr string) (net.Conn, error) {
-	s.Lock()
+	return s.DialContext(context.Background(), nw, addr)
+}
 
-	var backend *Backend
-	for _, b := range s.Backends {
-		if b.Addr == addr {
-			backend = b
-			break
-		}
-	}
+// DialContext is Dial for the HTTP transport. If the service sends the PROXY
+// protocol and ctx carries the client's addresses, the header is written
+// before the connection is returned. A backend connected over TLS has
+// completed the handshake, so this is also the transport's DialTLSContext.
+func (s *Service) DialContext(ctx context.Context, nw, addr string) (net.Conn, error) {
+	s.Lock()
+	proxyProto := s.SendProxyProtocol
 	s.Unlock()
 
+	backend := s.backendAt(addr)
 	if backend == nil {
 		return nil, DialError{fmt.Errorf("no backend matching %s", addr)}
 	}
 
-	srvConn, err := s.dialer.Dial(nw, backend.Addr)
+	start := time.Now()
+	srvConn, err := backend.dial(s.DialerFactory, nw, backend.Addr, s.DialTimeout)
+	backend.observeDial(time.Since(start))
+	if err != nil {
+		log.With(log.Fields{"service": s.Name, "backend": backend.Name, "addr": backend.Addr, "err": err}).Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, backend.Name, err)
+		atomic.AddInt64(&backend.Errors, 1)
+		return nil, DialError{err}
+	}
+
+	if pc, ok := ctx.Value(proxyClientKey{}).(proxyClient); ok && proxyProto != "" {
+		if err := writeProxyHeader(srvConn, proxyProto, pc, s.DialTimeout); err != nil {
+			log.With(log.Fields{"service": s.Name, "backend": backend.Name, "addr": backend.Addr, "err": err}).Errorf("ERROR: sending proxy header to backend %s/%s: %s", s.Name, backend.Name, err)
+			atomic.AddInt64(&backend.Errors, 1)
+			srvConn.Close()
+			return nil, DialError{err}
+		}
+	}
+
+	tlsConn, err := backend.startTLS(srvConn, s.DialTimeout)
 	if err != nil {
-		log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, backend.Name, err)
 		atomic.AddInt64(&backend.Errors, 1)
+		srvConn.Close()
 		return nil, DialError{err}
 	}
 
 	conn := &shuttleConn{
-		TCPConn:   srvConn.(*net.TCPConn),
-		rwTimeout: s.ServerTimeout,
-		written:   &backend.Sent,
-		read:      &backend.Rcvd,
-		connected: &backend.HTTPActive,
+		Conn:        tlsConn,
+		rwTimeout:   s.serverTimeout.Get(),
+		liveTimeout: s.serverTimeout,
+		written:     &backend.Sent,
+		read:        &backend.Rcvd,
+		connected:   &backend.HTTPActive,
+		idle:        &backend.HTTPIdle,
 	}
 
+	backend.track(conn)
+
 	atomic.AddInt64(&backend.Conns, 1)
 
 	// NOTE: this relies on conn.Close being called, which *should* happen in
@@ -516,23 +1543,107 @@ func (s *Service) Dial(nw, addr string) (net.Conn, error) {
 }
 
 func (s *Service) connectTCP(cliConn net.Conn) {
-	backends := s.next()
+	s.Lock()
+	mux, maxMessage := s.MuxConns > 0, s.MuxMaxMessage
+	proxyProto, acceptProxy := s.SendProxyProtocol, s.AcceptProxyProtocol
+	maxTime := s.MaxRequestTime
+	s.Unlock()
+
+	if acceptProxy {
+		conn, err := acceptProxyHeader(cliConn)
+		if err != nil {
+			log.With(log.Fields{"service": s.Name, "client": cliConn.RemoteAddr().String(), "err": err}).Errorf("ERROR: %s from %s to %s", err, cliConn.RemoteAddr(), s.Name)
+			atomic.AddInt64(&s.Errors, 1)
+			cliConn.Close()
+			return
+		}
+		cliConn = conn
+	}
+
+	// checked after the PROXY header, which has the client's real address
+	if !s.clientAllowed(normalizeClientAddr(cliConn.RemoteAddr().String())) {
+		cliConn.Close()
+		return
+	}
+
+	if s.terminatesTLS() {
+		conn, err := s.serverHandshake(cliConn)
+		if err != nil {
+			log.With(log.Fields{"service": s.Name, "client": cliConn.RemoteAddr().String(), "err": err}).Warnf("WARN: TLS handshake from %s to %s: %s", cliConn.RemoteAddr(), s.Name, err)
+			atomic.AddInt64(&s.Errors, 1)
+			cliConn.Close()
+			return
+		}
+		cliConn = conn
+	}
+
+	// nothing to try if there are no backends at all
+	if s.awaitBackend() != "" {
+		cliConn.Close()
+		return
+	}
+
+	if mux {
+		s.serveMux(cliConn, maxMessage)
+		return
+	}
+
+	if !s.awaitCapacity() {
+		log.With(log.Fields{"service": s.Name}).Warnf("WARN: all backends for %s are at their connection limit", s.Name)
+		cliConn.Close()
+		return
+	}
+
+	backends := s.next(normalizeClientAddr(cliConn.RemoteAddr().String()).IP)
 
 	// Try the first backend given, but if that fails, cycle through them all
-	// to make a best effort to connect the client.
+	// to make a best effort to connect the client. Backends at their
+	// connection limit are skipped.
 	for _, b := range backends {
-		srvConn, err := s.dialer.Dial(b.Network, b.Addr)
+		if !b.acquire() {
+			continue
+		}
+
+		start := time.Now()
+		srvConn, err := b.dial(s.DialerFactory, b.Network, b.Addr, s.DialTimeout)
+		b.observeDial(time.Since(start))
+		if err != nil {
+			log.With(log.Fields{"service": s.Name, "backend": b.Name, "addr": b.Addr, "err": err}).Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, b.Name, err)
+			atomic.AddInt64(&b.Errors, 1)
+			b.release()
+			continue
+		}
+
+		if proxyProto != "" {
+			pc := proxyClient{
+				src: normalizeClientAddr(cliConn.RemoteAddr().String()),
+				dst: normalizeClientAddr(cliConn.LocalAddr().String()),
+			}
+			if err := writeProxyHeader(srvConn, proxyProto, pc, s.DialTimeout); err != nil {
+				log.With(log.Fields{"service": s.Name, "backend": b.Name, "addr": b.Addr, "err": err}).Errorf("ERROR: sending proxy header to backend %s/%s: %s", s.Name, b.Name, err)
+				atomic.AddInt64(&b.Errors, 1)
+				srvConn.Close()
+				b.release()
+				continue
+			}
+		}
+
+		tlsConn, err := b.startTLS(srvConn, s.DialTimeout)
 		if err != nil {
-			log.Errorf("ERROR: connecting to backend %s/%s: %s", s.Name, b.Name, err)
 			atomic.AddInt64(&b.Errors, 1)
+			srvConn.Close()
+			b.release()
 			continue
 		}
 
-		b.Proxy(srvConn, cliConn)
+		stop := s.limitConn(maxTime, tlsConn, cliConn)
+		b.Proxy(tlsConn, cliConn)
+		stop()
+		b.release()
 		return
 	}
 
-	log.Errorf("ERROR: no backend for %s", s.Name)
+	log.With(log.Fields{"service": s.Name}).Errorf("ERROR: no backend for %s", s.Name)
 	cliConn.Close()
 }
 
@@ -542,13 +1653,62 @@ func (s *Service) stop() {
 	s.Lock()
 	defer s.Unlock()
 
-	log.Printf("Stopping Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
 	for _, backend := range s.Backends {
 		backend.Stop()
 	}
+	// draining backends stop once they see their connections closed
+	for _, backend := range s.drainingBackends {
+		backend.closeConns()
+	}
+
+	if s.stopWatch != nil {
+		close(s.stopWatch)
+		s.stopWatch = nil
+	}
+
+	s.refusing = false
+	s.closeListener()
+	s.removeSocket()
+	s.accessLog.close()
+	s.accessLog = nil
+
+	// drop the idle proxy connections to the backends
+	s.closeIdleConns()
+}
+
+// Stop accepting new connections, but leave existing connections and backends
+// running. A service that defers listening won't listen again.
+func (s *Service) CloseListener() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stopWatch != nil {
+		close(s.stopWatch)
+		s.stopWatch = nil
+	}
+	s.refusing = false
+	s.closeListener()
+}
+
+// Close the listener once another process has taken it over. A unix socket
+// is left in place, since it's now the other process's.
+func (s *Service) handOffListener() {
+	s.Lock()
+	s.socketOwned = false
+	s.Unlock()
+	s.CloseListener()
+}
+
+// Service *must* be locked.
+func (s *Service) closeListener() {
+	if !s.listening {
+		return
+	}
+	s.listening = false
 
+	log.With(log.Fields{"service": s.Name, "addr": s.Addr}).Printf("Stopping Listener for %s on %s:%s", s.Name, s.Network, s.Addr)
 	switch s.Network {
-	case "tcp", "tcp4", "tcp6":
+	case "tcp", "tcp4", "tcp6", "unix":
 		// the service may have been bad, and the listener failed
 		if s.tcpListener == nil {
 			return
@@ -556,19 +1716,69 @@ func (s *Service) stop() {
 
 		err := s.tcpListener.Close()
 		if err != nil {
-			log.Println(err)
+			log.With(log.Fields{"service": s.Name, "err": err}).Println(err)
 		}
 
 	case "udp", "udp4", "udp6":
 		if s.udpListener == nil {
 			return
 		}
+		close(s.udpClosed)
 		err := s.udpListener.Close()
 		if err != nil {
-			log.Println(err)
+			log.With(log.Fields{"service": s.Name, "err": err}).Println(err)
 		}
+		s.udpSessions.closeAll()
+	}
+}
+
+// ActiveConns returns the number of open client connections, and HTTP
+// requests in progress.
+func (s *Service) ActiveConns() int {
+	active := int(atomic.LoadInt64(&s.HTTPActive))
+
+	s.Lock()
+	defer s.Unlock()
+	if l, ok := s.tcpListener.(*timeoutListener); ok {
+		active += l.ActiveConns()
 	}
+	for _, l := range s.draining {
+		active += l.ActiveConns()
+	}
+	return active
+}
+
+// Close all open client connections.
+// Returns the number of connections closed.
+func (s *Service) CloseConns() int {
+	s.Lock()
+	defer s.Unlock()
+
+	closed := 0
+	if l, ok := s.tcpListener.(*timeoutListener); ok {
+		closed += l.CloseConns()
+	}
+	for _, l := range s.draining {
+		closed += l.CloseConns()
+	}
+	return closed
+}
+
+// Callbacks returns the HTTP callback chain currently in use. The chain
+// must not be modified; use ReplaceCallbacks or AmendCallbacks.
+func (s *Service) Callbacks() *CallbackChain {
+	return s.httpProxy.Callbacks()
+}
+
+// ReplaceCallbacks swaps the HTTP callback chain. Each request runs the
+// complete chain that was in place when it started.
+func (s *Service) ReplaceCallbacks(chain CallbackChain) {
+	s.httpProxy.ReplaceCallbacks(chain)
+}
 
+// AmendCallbacks modifies a copy of the HTTP callback chain, and swaps it in.
+func (s *Service) AmendCallbacks(amend func(*CallbackChain)) {
+	s.httpProxy.AmendCallbacks(amend)
 }
 
 // Provide a ServeHTTP method for out ReverseProxy
@@ -577,85 +1787,318 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	atomic.AddInt64(&s.HTTPActive, 1)
 	defer atomic.AddInt64(&s.HTTPActive, -1)
 
-	if s.HTTPSRedirect {
-		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") != "https" {
-			//TODO: verify RequestURI
-			redirLoc := "https://" + r.Host + r.RequestURI
-			http.Redirect(w, r, redirLoc, http.StatusMovedPermanently)
-			return
-		}
+	vhost := s.vhostName(requestVHost(requestHost(r)))
+	if c := s.vhostCounters(vhost); c != nil {
+		atomic.AddInt64(&c.Active, 1)
+		defer atomic.AddInt64(&c.Active, -1)
+	}
+
+	s.filterForwarded(r)
+
+	if !s.clientAllowed(s.requestClientAddr(r)) {
+		s.serveError(w, r, http.StatusForbidden, reasonClientDenied, nil)
+		return
+	}
+
+	if !s.rateLimit.allow(normalizeClientAddr(r.RemoteAddr).IP) {
+		atomic.AddInt64(&s.RateLimited, 1)
+		s.serveError(w, r, http.StatusTooManyRequests, reasonRateLimited, nil)
+		return
+	}
+
+	directive := s.directive(r)
+
+	if s.redirectHTTPS(r) {
+		//TODO: verify RequestURI
+		redirLoc := "https://" + r.Host + r.RequestURI
+		answeredLocally(s, r, http.StatusMovedPermanently, reasonHTTPSRedirect, directive)
+		http.Redirect(w, r, redirLoc, http.StatusMovedPermanently)
+		return
 	}
 
 	if s.MaintenanceMode {
-		// TODO: Should we increment HTTPErrors here as well?
-		logRequest(r, http.StatusServiceUnavailable, "", nil, 0)
-		errPage := s.errorPages.Get(http.StatusServiceUnavailable)
-		if errPage != nil {
-			headers := w.Header()
-			for key, val := range errPage.Header() {
-				headers[key] = val
-			}
-		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-		if errPage != nil {
-			w.Write(errPage.Body())
+		s.serveError(w, r, http.StatusServiceUnavailable, reasonMaintenance, directive)
+		return
+	}
+
+	if s.redirect(w, r, directive) {
+		return
+	}
+
+	if s.awaitBackend() == client.NoBackendRefuse {
+		s.serveError(w, r, http.StatusServiceUnavailable, reasonNoBackends, directive)
+		return
+	}
+
+	if !s.awaitCapacity() {
+		s.serveError(w, r, http.StatusServiceUnavailable, reasonBackendsFull, directive)
+		return
+	}
+
+	// the picker holds a connection slot on the backend it last returned
+	picker := s.requestPicker(r, normalizeClientAddr(r.RemoteAddr).IP)
+	picker.only = s.route(r)
+	defer picker.release()
+
+	pr := &ProxyRequest{
+		ResponseWriter: w,
+		Request:        r,
+		Picker:         picker,
+		Directive:      directive,
+		Service:        s.Name,
+		Tags:           s.tagLabels(),
+		VirtualHost:    vhost,
+	}
+	defer s.vhostBytes(pr)
+	// logged once the response is written, so its size is known
+	defer s.logProxyRequest(pr)
+
+	s.Lock()
+	proxyProto := s.SendProxyProtocol
+	pr.Transport = s.proxyTransport
+	pr.RetryPolicy, pr.RetryCount = s.RetryPolicy, s.RetryCount
+	pr.MaxTime, pr.AllowStreaming = s.MaxRequestTime, s.AllowStreaming
+	s.Unlock()
+	defer func() {
+		if pr.MaxTimeExceeded() {
+			atomic.AddInt64(&s.MaxRequestTimeExceeded, 1)
 		}
+	}()
+	if proxyProto != "" {
+		pr.Request = r.WithContext(withProxyClient(r))
+		pr.Transport = s.proxyProtoTransport
+	}
+
+	pr.Timeout, pr.MaxAttempts, pr.EchoLimits = s.requestLimits(r)
+	if pr.EchoLimits && pr.Timeout > 0 {
+		w.Header().Set(DeadlineHeader, strconv.Itoa(int(pr.Timeout/time.Millisecond)))
+	}
+
+	if directive == nil {
+		s.httpProxy.Serve(pr)
 		return
 	}
 
-	s.httpProxy.ServeHTTP(w, r, s.NextAddrs())
+	if directive.Backend != "" {
+		if b := s.get(directive.Backend); b != nil {
+			pr.Picker = nil
+			pr.Backends = []string{b.Addr}
+		} else {
+			log.With(log.Fields{"service": s.Name, "backend": directive.Backend}).Warnf("directive=%s backend %s not found in %s", directive.ID, directive.Backend, s.Name)
+		}
+	}
+
+	if directive.NoCache {
+		r.Header.Set("Cache-Control", "no-cache")
+		r.Header.Set("Pragma", "no-cache")
+	}
+	if directive.Trace {
+		r.Header.Set("X-Shuttle-Trace", directive.ID)
+	}
+
+	s.httpProxy.Serve(pr)
+}
+
+// Respond with an error status without proxying the request, using the
+// service's error page for the status if there is one.
+func (s *Service) serveError(w http.ResponseWriter, r *http.Request, code int, reason string, directive *client.Directive) {
+	answeredLocally(s, r, code, reason, directive)
+	errPage := s.errorPages.Get(code)
+	if errPage != nil {
+		headers := w.Header()
+		for key, val := range errPage.Header() {
+			headers[key] = val
+		}
+	}
+	w.WriteHeader(code)
+	if errPage != nil {
+		w.Write(errPage.Body())
+	}
+}
+
+// The limit in bytes for the request line and headers of requests to the
+// service's virtual hosts.
+func (s *Service) headerLimit() int {
+	if n := atomic.LoadInt64(&s.MaxHeaderBytes); n > 0 {
+		return int(n)
+	}
+	return Registry.MaxHeaderBytes()
+}
+
+// Redirect the request if it matches one of the redirect rules.
+func (s *Service) redirect(w http.ResponseWriter, r *http.Request, directive *client.Directive) bool {
+	s.Lock()
+	redirects := s.redirects
+	s.Unlock()
+
+	for _, rule := range redirects {
+		if !rule.match(r) {
+			continue
+		}
+		atomic.AddInt64(&rule.Count, 1)
+		answeredLocally(s, r, rule.Status, reasonRedirect, directive)
+		http.Redirect(w, r, rule.location(r), rule.Status)
+		return true
+	}
+	return false
+}
+
+// Replace the secrets redacted in a config read from the API with the
+// current secrets in the same place, so the config can be applied again.
+// Any that can't be replaced are dropped.
+func unredactSecrets(secrets, current []string) []string {
+	if secrets == nil {
+		return nil
+	}
+	kept := make([]string, 0, len(secrets))
+	for i, secret := range secrets {
+		if secret == redactedSecret {
+			if i >= len(current) {
+				continue
+			}
+			secret = current[i]
+		}
+		kept = append(kept, secret)
+	}
+	return kept
+}
+
+// Validate any signed directive on the request. The header is always removed,
+// so it's never passed on to a backend. Invalid directives are counted, and
+// otherwise ignored.
+func (s *Service) directive(r *http.Request) *client.Directive {
+	token := r.Header.Get(client.DirectiveHeader)
+	if token == "" {
+		return nil
+	}
+	r.Header.Del(client.DirectiveHeader)
+
+	s.Lock()
+	secrets := s.DirectiveSecrets
+	s.Unlock()
+
+	d, err := client.VerifyDirective(secrets, token, time.Now())
+	if err == nil && d.Service != "" && d.Service != s.Name {
+		err = fmt.Errorf("directive is for service %s", d.Service)
+	}
+
+	if err != nil {
+		atomic.AddInt64(&s.DirectiveErrors, 1)
+		log.With(log.Fields{"service": s.Name, "err": err}).Debugf("Ignoring directive for %s: %s", s.Name, err)
+		return nil
+	}
+
+	atomic.AddInt64(&s.Directives, 1)
+	return d
 }
 
 func (s *Service) errStats(pr *ProxyRequest) bool {
 	if pr.ProxyError != nil {
 		atomic.AddInt64(&s.HTTPErrors, 1)
 	}
+	if pr.BudgetExhausted {
+		atomic.AddInt64(&s.RetryBudgetExhausted, 1)
+	}
 	return true
 }
 
-// A net.Listener that provides a read/write timeout
+// listenerStats counts the client side of a listener's connections: the
+// bytes read from and written to clients, the connections accepted, and the
+// accepts that failed. A service keeps its own, so they carry on across the
+// listeners it binds. Used atomically.
+type listenerStats struct {
+	read         int64
+	written      int64
+	accepted     int64
+	acceptErrors int64
+}
+
+// A net.Listener that provides a read/write timeout.
+// The timeout is read as each connection is accepted, so changes apply to all
+// new connections.
 type timeoutListener struct {
-	*net.TCPListener
-	rwTimeout time.Duration
+	net.Listener
+	rwTimeout *liveTimeout
+	stats     *listenerStats
 
-	// these aren't reported yet, but our new counting connections need to
-	// update something
-	read    int64
-	written int64
+	// open connections, so they can be closed on shutdown
+	connsMu sync.Mutex
+	conns   map[*shuttleConn]bool
 }
 
-func newTimeoutListener(netw, addr string, timeout time.Duration) (net.Listener, error) {
-	lAddr, err := net.ResolveTCPAddr(netw, addr)
-	if err != nil {
-		return nil, err
-	}
-
-	l, err := net.ListenTCP(netw, lAddr)
+func newTimeoutListener(factory ListenerFactory, netw, addr string, timeout *liveTimeout, stats *listenerStats) (net.Listener, error) {
+	l, err := factory.Listen(netw, addr)
 	if err != nil {
 		return nil, err
 	}
 
 	tl := &timeoutListener{
-		TCPListener: l,
-		rwTimeout:   timeout,
+		Listener:  l,
+		rwTimeout: timeout,
+		stats:     stats,
+		conns:     make(map[*shuttleConn]bool),
 	}
 	return tl, nil
 }
 
 func (l *timeoutListener) Accept() (net.Conn, error) {
-	conn, err := l.TCPListener.AcceptTCP()
+	conn, err := l.Listener.Accept()
 	if err != nil {
+		// closing the listener isn't a failure
+		if !errors.Is(err, net.ErrClosed) {
+			atomic.AddInt64(&l.stats.acceptErrors, 1)
+		}
 		return nil, err
 	}
+	atomic.AddInt64(&l.stats.accepted, 1)
 
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(3 * time.Minute)
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(3 * time.Minute)
+	}
 
 	sc := &shuttleConn{
-		TCPConn:   conn,
-		rwTimeout: l.rwTimeout,
-		read:      &l.read,
-		written:   &l.written,
+		Conn:        conn,
+		rwTimeout:   l.rwTimeout.Get(),
+		liveTimeout: l.rwTimeout,
+		read:        &l.stats.read,
+		written:     &l.stats.written,
+		listener:    l,
 	}
+
+	l.connsMu.Lock()
+	l.conns[sc] = true
+	l.connsMu.Unlock()
+
 	return sc, nil
 }
+
+// called when a connection is closed
+func (l *timeoutListener) remove(c *shuttleConn) {
+	l.connsMu.Lock()
+	delete(l.conns, c)
+	l.connsMu.Unlock()
+}
+
+// ActiveConns returns the number of accepted connections still open.
+func (l *timeoutListener) ActiveConns() int {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	return len(l.conns)
+}
+
+// Close all accepted connections that are still open.
+// Returns the number of connections closed.
+func (l *timeoutListener) CloseConns() int {
+	l.connsMu.Lock()
+	conns := make([]*shuttleConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.connsMu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
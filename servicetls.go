@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidTLS = fmt.Errorf("invalid tls config")
+
+// The time a client has to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Check the TLS settings of a service config, and load its certificate. The
+// certificate is nil if TLS isn't configured.
+func loadServiceCert(cfg client.ServiceConfig) (*tls.Certificate, error) {
+	if cfg.TLSCert == "" && cfg.TLSCertPEM == "" && cfg.TLSKey == "" && cfg.TLSKeyPEM == "" {
+		return nil, nil
+	}
+	if cfg.Network != "" && networkFamily(cfg.Network) != "tcp" {
+		return nil, fmt.Errorf("%w: requires a tcp service", ErrInvalidTLS)
+	}
+	return loadCertPair(cfg.TLSCert, cfg.TLSKey, cfg.TLSCertPEM, cfg.TLSKeyPEM)
+}
+
+// Load a certificate and its key. Each may come from a file or be inline PEM,
+// but not both.
+func loadCertPair(certFile, keyFile, certPEM, keyPEM string) (*tls.Certificate, error) {
+	if certFile != "" && certPEM != "" {
+		return nil, fmt.Errorf("%w: certificate file and PEM are both set", ErrInvalidTLS)
+	}
+	if keyFile != "" && keyPEM != "" {
+		return nil, fmt.Errorf("%w: key file and PEM are both set", ErrInvalidTLS)
+	}
+
+	var certData, keyData []byte
+	switch {
+	case certFile != "":
+		data, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTLS, err)
+		}
+		certData = data
+	case certPEM != "":
+		certData = []byte(certPEM)
+	default:
+		return nil, fmt.Errorf("%w: missing certificate", ErrInvalidTLS)
+	}
+	switch {
+	case keyFile != "":
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidTLS, err)
+		}
+		keyData = data
+	case keyPEM != "":
+		keyData = []byte(keyPEM)
+	default:
+		return nil, fmt.Errorf("%w: missing key", ErrInvalidTLS)
+	}
+
+	cert, err := tls.X509KeyPair(certData, keyData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTLS, err)
+	}
+	return &cert, nil
+}
+
+// The TLS settings of a service, which are replaced whenever any of them
+// change.
+type serviceTLS struct {
+	cert, key, certPEM, keyPEM string
+}
+
+func newServiceTLS(cfg client.ServiceConfig) serviceTLS {
+	return serviceTLS{
+		cert:    cfg.TLSCert,
+		key:     cfg.TLSKey,
+		certPEM: cfg.TLSCertPEM,
+		keyPEM:  cfg.TLSKeyPEM,
+	}
+}
+
+// Replace the service's certificate, which may be nil to stop terminating
+// TLS. Connections already open keep the certificate they were given.
+// Service *must* be locked, or not yet started.
+func (s *Service) setCert(settings serviceTLS, cert *tls.Certificate) {
+	s.tls = settings
+	s.tlsCert.Store(cert)
+	if s.tlsConfig == nil {
+		s.tlsConfig = &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if cert, _ := s.tlsCert.Load().(*tls.Certificate); cert != nil {
+					return cert, nil
+				}
+				return nil, fmt.Errorf("no certificate for %s", s.Name)
+			},
+		}
+	}
+}
+
+// Whether new client connections are TLS.
+func (s *Service) terminatesTLS() bool {
+	cert, _ := s.tlsCert.Load().(*tls.Certificate)
+	return cert != nil
+}
+
+// Complete the TLS handshake with a client, returning the decrypted
+// connection.
+func (s *Service) serverHandshake(conn net.Conn) (net.Conn, error) {
+	tc := tls.Server(conn, s.tlsConfig)
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		atomic.AddInt64(&s.TLSHandshakeErrors, 1)
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return &tlsConn{Conn: tc, raw: conn}, nil
+}
+
+// A client connection that shuttle terminates TLS for. The proxy shuts down
+// the reading side of the connection underneath, since TLS has no half-close
+// for reads.
+type tlsConn struct {
+	*tls.Conn
+	raw net.Conn
+}
+
+func (c *tlsConn) CloseRead() error {
+	if cr, ok := c.raw.(closeReader); ok {
+		return cr.CloseRead()
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+const (
+	// Exit codes for the shutdown sequence
+	exitOK          = 0
+	exitForced      = 2
+	exitInterrupted = 3
+)
+
+var (
+	ErrShuttingDown = fmt.Errorf("shutting down")
+
+	// The process wide shutdown sequence
+	shutdown = NewShutdown()
+)
+
+// A ShutdownStep is one stage of the shutdown sequence.
+type ShutdownStep struct {
+	Name string
+	Run  func(*Shutdown)
+}
+
+// Shutdown coordinates stopping shuttle: the admin API is made read-only,
+// listeners are closed, connections are given time to drain, and the state
+// config is written one last time, before a shutdown event is published. The
+// Steps are run in order, and may be replaced before the sequence is started.
+type Shutdown struct {
+	sync.Mutex
+
+	// Maximum time to wait for connections to drain. If this is zero, the
+	// global ShutdownTimeout is used.
+	Timeout time.Duration
+
+	Steps []ShutdownStep
+
+	// The HTTP routers to close and drain. If this is nil, the global
+	// httpRouter and httpsRouter are used.
+	Routers []*HostRouter
+
+	// held by admin API calls that modify the config
+	mutations sync.RWMutex
+	readOnly  bool
+
+	once   sync.Once
+	done   chan struct{}
+	stage  string
+	forced bool
+	code   int
+
+	// the steps that have completed, in order
+	completed []string
+}
+
+// Return a new Shutdown with the default steps.
+func NewShutdown() *Shutdown {
+	return &Shutdown{
+		done: make(chan struct{}),
+		Steps: []ShutdownStep{
+			{"admin", shutdownAdmin},
+			{"listeners", shutdownListeners},
+			{"drain", shutdownDrain},
+			{"flush", shutdownFlush},
+		},
+	}
+}
+
+// Run the shutdown sequence, returning the process exit code.
+// Only the first call runs the sequence; any other calls wait for it to
+// finish and return the same code.
+func (s *Shutdown) Run() int {
+	s.once.Do(s.run)
+	<-s.done
+
+	s.Lock()
+	defer s.Unlock()
+	return s.code
+}
+
+func (s *Shutdown) run() {
+	defer close(s.done)
+
+	if s.Timeout == 0 {
+		s.Timeout = time.Duration(Registry.Config().ShutdownTimeout) * time.Millisecond
+	}
+	if s.Timeout == 0 {
+		s.Timeout = client.DefaultShutdownTimeout * time.Millisecond
+	}
+
+	log.Printf("Shutting down, waiting up to %s for connections to drain", s.Timeout)
+
+	for _, step := range s.Steps {
+		s.setStage(step.Name)
+		log.Debugf("Shutdown step: %s", step.Name)
+		step.Run(s)
+
+		s.Lock()
+		s.completed = append(s.completed, step.Name)
+		s.Unlock()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.stage = "stopped"
+	if s.forced {
+		s.code = exitForced
+	}
+	log.Printf("Shutdown complete: forced=%t exit=%d", s.forced, s.code)
+	events.publish(&client.Event{Type: client.EventShutdown, Time: time.Now(), Forced: s.forced})
+}
+
+func (s *Shutdown) setStage(stage string) {
+	s.Lock()
+	defer s.Unlock()
+	s.stage = stage
+}
+
+// Stage returns the current step of the shutdown sequence, or "" if it hasn't
+// been started.
+func (s *Shutdown) Stage() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.stage
+}
+
+// The HTTP routers the sequence closes.
+func (s *Shutdown) routers() []*HostRouter {
+	s.Lock()
+	defer s.Unlock()
+	if s.Routers != nil {
+		return s.Routers
+	}
+	return []*HostRouter{httpRouter, httpsRouter}
+}
+
+// Completed returns the names of the steps that have finished, in order.
+func (s *Shutdown) Completed() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.completed...)
+}
+
+// Begin an admin API call that modifies the config. Returns false if we're
+// shutting down and no more changes are allowed. If true is returned,
+// EndMutation must be called when the change is complete.
+func (s *Shutdown) BeginMutation() bool {
+	s.mutations.RLock()
+	if s.readOnly {
+		s.mutations.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (s *Shutdown) EndMutation() {
+	s.mutations.RUnlock()
+}
+
+// Wait for any config changes in progress, and reject all new ones.
+func shutdownAdmin(s *Shutdown) {
+	s.mutations.Lock()
+	s.readOnly = true
+	s.mutations.Unlock()
+}
+
+func shutdownListeners(s *Shutdown) {
+	Registry.CloseListeners()
+	for _, r := range s.routers() {
+		if r != nil {
+			r.CloseListener()
+		}
+	}
+}
+
+// Wait for client connections to finish, closing any that are left after the
+// timeout.
+func shutdownDrain(s *Shutdown) {
+	deadline := time.Now().Add(s.Timeout)
+	for Registry.ActiveConns() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if active := Registry.ActiveConns(); active > 0 {
+		log.Warnf("Shutdown timeout with %d active connections", active)
+		s.Lock()
+		s.forced = true
+		s.Unlock()
+		Registry.CloseConns()
+	}
+
+	// anything left on the http routers is idle
+	for _, r := range s.routers() {
+		if r != nil {
+			r.CloseConns()
+		}
+	}
+}
+
+func shutdownFlush(s *Shutdown) {
+	writeStateConfig()
+	if billing != nil {
+		billing.Stop()
+	}
+	if late := persistence.flush(); len(late) > 0 {
+		log.Warnf("Shutdown with unwritten %s records", strings.Join(late, ", "))
+	}
+	logFiles.flush()
+}
+
+// Run the shutdown sequence on SIGTERM or SIGINT, and exit.
+// A second signal exits immediately.
+func handleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	goTask("signals", "", func() {
+		sig := <-sigs
+		log.Printf("Received %s", sig)
+
+		goTask("signals", "", func() {
+			sig := <-sigs
+			log.Warnf("Received %s during shutdown, exiting", sig)
+			os.Exit(exitInterrupted)
+		})
+
+		os.Exit(shutdown.Run())
+	})
+}
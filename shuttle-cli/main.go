@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,12 +9,15 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	shuttle "github.com/litl/shuttle/client"
 )
 
 var (
 	shuttleAddr string
+	adminToken  string
+	basicAuth   string
 	configData  string
 	configFile  string
 
@@ -31,10 +35,17 @@ var (
 
 	backendCfg = &shuttle.BackendConfig{}
 	backendFS  = flag.NewFlagSet("backend", flag.ExitOnError)
+
+	logFilter = shuttle.LogFilter{}
+	logFollow bool
+	logsFS    = flag.NewFlagSet("logs", flag.ExitOnError)
+
+	removeDrain bool
+	removeFS    = flag.NewFlagSet("remove", flag.ExitOnError)
 )
 
 func init() {
-	configFS.StringVar(&cfg.Balance, "balance", "", "balance algorithm, {RR|LC}")
+	configFS.StringVar(&cfg.Balance, "balance", "", "balance algorithm, {RR|LC|HASH}")
 	configFS.IntVar(&cfg.CheckInterval, "check-interval", 0, "interval between health checks in milliseconds")
 	configFS.IntVar(&cfg.Fall, "fall", 0, "number of failed healthchecks before a backend is marked down")
 	configFS.IntVar(&cfg.Rise, "rise", 0, "number of successful health checks before a down service is marked up")
@@ -45,7 +56,7 @@ func init() {
 
 	serviceFS.StringVar(&serviceCfg.Addr, "address", "", "service listening address")
 	serviceFS.StringVar(&serviceCfg.Network, "network", "", "service network type")
-	serviceFS.StringVar(&serviceCfg.Balance, "balance", "", "balancing algorithm, {RR|LC}")
+	serviceFS.StringVar(&serviceCfg.Balance, "balance", "", "balancing algorithm, {RR|LC|HASH}")
 	serviceFS.IntVar(&serviceCfg.CheckInterval, "check-interval", 0, "interval between health checks in milliseconds")
 	serviceFS.IntVar(&serviceCfg.Fall, "fall", 0, "number of failed healthchecks before a backend is marked down")
 	serviceFS.IntVar(&serviceCfg.Rise, "rise", 0, "number of successful health checks before a down service is marked up")
@@ -53,18 +64,31 @@ func init() {
 	serviceFS.IntVar(&serviceCfg.ServerTimeout, "server-timeout", 0, "innactivity timeout for server connections")
 	serviceFS.IntVar(&serviceCfg.DialTimeout, "dial-timeout", 0, "timeout for dialing new connections connections")
 	serviceFS.BoolVar(&serviceCfg.HTTPSRedirect, "https-redirect", false, "rediect all http requests to https")
+	serviceFS.IntVar(&serviceCfg.DrainTimeout, "drain-timeout", 0, "time allowed for connections to finish when the service or a backend is removed with draining, in milliseconds")
 	serviceFS.Var(&vhosts, "vhost", "virtual host name. may be set multiple times")
 	serviceFS.Var(&errorPages, "error-page", "location for http error code formatted as 'http://example.com/|500,503'. may be set multiple times")
 
 	backendFS.StringVar(&backendCfg.Addr, "address", "", "service listening address")
 	backendFS.StringVar(&backendCfg.Network, "network", "", "backend network type")
 	backendFS.StringVar(&backendCfg.CheckAddr, "check-address", "", "health check address")
+	backendFS.StringVar(&backendCfg.CheckType, "check-type", "", "health check type, {tcp|http|udp}")
+	backendFS.StringVar(&backendCfg.CheckPath, "check-path", "", "path requested by http health checks")
+	backendFS.IntVar(&backendCfg.CheckTimeout, "check-timeout", 0, "time allowed for an http or udp health check response in milliseconds")
+	backendFS.StringVar(&backendCfg.CheckPayload, "check-payload", "", "datagram sent by udp health checks, which must be answered")
 	backendFS.IntVar(&backendCfg.Weight, "weight", 0, "balance weight")
+
+	logsFS.StringVar(&logFilter.Service, "service", "", "only show entries for this service")
+	logsFS.StringVar(&logFilter.Backend, "backend", "", "only show entries for this backend name or address")
+	logsFS.StringVar(&logFilter.Level, "level", "", "least severe level to show, {error|warn|info}")
+	logsFS.StringVar(&logFilter.Status, "status", "", "only show requests with this class of status, e.g. 5xx")
+	logsFS.BoolVar(&logFollow, "follow", false, "reconnect when the stream is lost or evicted")
+
+	removeFS.BoolVar(&removeDrain, "drain", false, "refuse new connections, and let open ones finish before removing the service or backend")
 }
 
 func usage() {
 	flag.PrintDefaults()
-	fmt.Println(`shuttle-cli {config|update|remove} [options]
+	fmt.Println(`shuttle-cli {config|update|remove|logs} [options]
 
 config [options]
          set or print global config
@@ -91,8 +115,18 @@ options:`)
 
 	fmt.Println(`
 remove: remove services or backends
-        remove service
-        remove service/backend`)
+        remove service [options]
+        remove service/backend [options]
+options:`)
+	removeFS.PrintDefaults()
+
+	fmt.Println(`
+logs [options]
+         stream the access log, errors, and warnings
+example: follow the server errors of "servicename"
+         $ shuttle-cli logs -service servicename -status 5xx -follow
+options:`)
+	logsFS.PrintDefaults()
 
 	os.Exit(1)
 }
@@ -102,6 +136,8 @@ func main() {
 	log.SetFlags(0)
 
 	flag.StringVar(&shuttleAddr, "addr", "127.0.0.1:9090", "shuttle admin address")
+	flag.StringVar(&adminToken, "token", os.Getenv("SHUTTLE_TOKEN"), "shuttle admin token")
+	flag.StringVar(&basicAuth, "basic-auth", os.Getenv("SHUTTLE_BASIC_AUTH"), "shuttle admin user:password")
 	flag.Usage = usage
 
 	flag.Parse()
@@ -112,6 +148,16 @@ func main() {
 	}
 
 	client = shuttle.NewClient(shuttleAddr)
+	if adminToken != "" {
+		client.SetToken(adminToken)
+	}
+	if basicAuth != "" {
+		parts := strings.SplitN(basicAuth, ":", 2)
+		if len(parts) != 2 {
+			log.Fatal("-basic-auth must be user:password")
+		}
+		client.SetBasicAuth(parts[0], parts[1])
+	}
 
 	switch flag.Args()[0] {
 	case "version":
@@ -123,6 +169,8 @@ func main() {
 		update(flag.Args()[1:])
 	case "remove":
 		remove(flag.Args()[1:])
+	case "logs":
+		logs(flag.Args()[1:])
 	default:
 		usage()
 	}
@@ -235,18 +283,77 @@ func remove(args []string) {
 		usage()
 	}
 
+	removeFS.Parse(args[1:])
+
 	target := strings.SplitN(args[0], "/", 1)
 	if len(target) == 1 {
-		err := client.RemoveService(target[0])
+		var err error
+		if removeDrain {
+			err = client.DrainService(target[0])
+		} else {
+			err = client.RemoveService(target[0])
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
-	err := client.RemoveBackend(target[0], target[1])
+	var err error
+	if removeDrain {
+		err = client.DrainBackend(target[0], target[1])
+	} else {
+		err = client.RemoveBackend(target[0], target[1])
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
 }
+
+func logs(args []string) {
+	logsFS.Parse(args)
+
+	for {
+		entries, err := client.TailLogs(context.Background(), logFilter)
+		if err != nil {
+			if !logFollow {
+				log.Fatal(err)
+			}
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for e := range entries {
+			printLogEntry(e)
+		}
+		if !logFollow {
+			return
+		}
+	}
+}
+
+func printLogEntry(e shuttle.LogEntry) {
+	ts := e.Time.Format(time.RFC3339)
+	switch e.Type {
+	case shuttle.LogAccess:
+		backend := e.Backend
+		if backend == "" {
+			backend = e.BackendAddr
+		}
+		line := fmt.Sprintf("%s %s %s %s %d %.1fms backend=%s origin=%s",
+			ts, e.Service, e.Method, e.URL, e.Status, e.Duration, backend, e.Origin)
+		if e.Reason != "" {
+			line += " reason=" + e.Reason
+		}
+		if e.Error != "" {
+			line += " err=" + e.Error
+		}
+		fmt.Println(line)
+	case shuttle.LogEvicted:
+		log.Println("log stream evicted for falling behind")
+	default:
+		fmt.Printf("%s %s %s\n", ts, strings.ToUpper(e.Level), e.Message)
+	}
+}
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/litl/shuttle/client"
 	"github.com/litl/shuttle/log"
+	"github.com/litl/shuttle/testnet"
 	. "gopkg.in/check.v1"
 )
 
@@ -87,6 +105,7 @@ func myTearDown(s *BasicSuite, t Tester) {
 	Registry.cfg.ClientTimeout = 0
 	Registry.cfg.ServerTimeout = 0
 	Registry.cfg.DialTimeout = 0
+	Registry.cfg.TimeoutPolicy = ""
 
 	err := Registry.RemoveService(s.service.Name)
 	if err != nil {
@@ -127,6 +146,19 @@ func checkResp(addr, expected string, c Tester) {
 	if err != nil {
 		c.Fatal(err)
 	}
+	checkConnResp(conn, expected, c)
+}
+
+// Connect to address on the in-memory network, and check response after write.
+func checkMemResp(n *testnet.Network, addr, expected string, c Tester) {
+	conn, err := n.Dial("tcp", addr, time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+	checkConnResp(conn, expected, c)
+}
+
+func checkConnResp(conn net.Conn, expected string, c Tester) {
 	defer conn.Close()
 
 	if _, err := io.WriteString(conn, "testing\n"); err != nil {
@@ -178,16 +210,16 @@ func (s *BasicSuite) TestWeightedRoundRobin(c *C) {
 	// so skip the tcp connection this time.
 
 	// one from the first server
-	c.Assert(s.service.next()[0].Name, Equals, "backend_0")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_0")
 	// A weight of 2 should return twice
-	c.Assert(s.service.next()[0].Name, Equals, "backend_1")
-	c.Assert(s.service.next()[0].Name, Equals, "backend_1")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_1")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_1")
 	// And a weight of 3 should return thrice
-	c.Assert(s.service.next()[0].Name, Equals, "backend_2")
-	c.Assert(s.service.next()[0].Name, Equals, "backend_2")
-	c.Assert(s.service.next()[0].Name, Equals, "backend_2")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_2")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_2")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_2")
 	// and once around or good measure
-	c.Assert(s.service.next()[0].Name, Equals, "backend_0")
+	c.Assert(s.service.next(nil)[0].Name, Equals, "backend_0")
 }
 
 func (s *BasicSuite) TestLeastConn(c *C) {
@@ -234,10 +266,283 @@ func (s *BasicSuite) TestLeastConn(c *C) {
 	checkResp(s.service.Addr, s.servers[2].addr, c)
 }
 
+func (s *BasicSuite) TestIPHash(c *C) {
+	Registry.RemoveService("testService")
+	svcCfg := client.ServiceConfig{
+		Name:    "testService",
+		Addr:    "127.0.0.1:2223",
+		Balance: client.IPHash,
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	s.service = Registry.GetService("testService")
+
+	s.AddBackend(c)
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	// every connection from the same client goes to the same backend
+	first := s.service.NextAddrs(net.ParseIP("127.0.0.1"))[0]
+	for i := 0; i < 6; i++ {
+		checkResp(s.service.Addr, first, c)
+	}
+
+	stats := s.service.Stats()
+	for _, b := range stats.Backends {
+		if b.Addr == first {
+			c.Assert(b.Conns, Equals, int64(6))
+		} else {
+			c.Assert(b.Conns, Equals, int64(0))
+		}
+	}
+}
+
+// Losing or adding a backend only moves the clients on the ring next to it.
+func (s *BasicSuite) TestIPHashRing(c *C) {
+	var backends []*Backend
+	for i := 0; i < 5; i++ {
+		backends = append(backends, &Backend{Name: fmt.Sprintf("backend_%d", i), Weight: 1})
+	}
+	up := []bool{true, true, true, true, true}
+
+	clients := make([]net.IP, 2000)
+	for i := range clients {
+		clients[i] = net.IPv4(10, 0, byte(i/256), byte(i%256)).To4()
+	}
+
+	h := &ipHash{}
+	before := make(map[int][]*Backend)
+	counts := make(map[string]int)
+	for i, ip := range clients {
+		before[i] = h.balance(backends, up, ip)
+		c.Assert(before[i], HasLen, 5)
+		c.Assert(h.balance(backends, up, ip)[0], Equals, before[i][0])
+		counts[before[i][0].Name]++
+	}
+
+	// close to an even share each
+	for name, n := range counts {
+		c.Assert(n > 250 && n < 550, Equals, true, Commentf("%s has %d clients", name, n))
+	}
+
+	// only backend_2's clients move, to the next backend in their order
+	up[2] = false
+	moved := 0
+	for i, ip := range clients {
+		balanced := h.balance(backends, up, ip)
+		c.Assert(balanced, HasLen, 4)
+		if before[i][0].Name == "backend_2" {
+			c.Assert(balanced[0], Equals, before[i][1])
+			moved++
+			continue
+		}
+		c.Assert(balanced[0], Equals, before[i][0])
+	}
+	c.Assert(moved, Equals, counts["backend_2"])
+
+	// a new backend only takes clients, without moving any between the others
+	up[2] = true
+	backends = append(backends, &Backend{Name: "backend_5", Weight: 1})
+	up = append(up, true)
+	taken := 0
+	for i, ip := range clients {
+		balanced := h.balance(backends, up, ip)
+		if balanced[0].Name == "backend_5" {
+			taken++
+			continue
+		}
+		c.Assert(balanced[0], Equals, before[i][0])
+	}
+	c.Assert(taken > 0 && taken < len(clients)/3, Equals, true, Commentf("%d", taken))
+
+	// a client without an IP is balanced round robin
+	c.Assert(h.balance(backends, up, nil)[0], Not(Equals), h.balance(backends, up, nil)[0])
+
+	c.Assert(h.balance(backends, make([]bool, len(backends)), clients[0]), IsNil)
+}
+
+// A backend that comes back up is sent a share of connections that ramps up
+// over its slow start, by each balancer.
+func (s *BasicSuite) TestSlowStart(c *C) {
+	now := time.Now()
+	var backends []*Backend
+	for i := 0; i < 2; i++ {
+		b := NewBackend(client.BackendConfig{Name: fmt.Sprintf("backend_%d", i), Addr: "127.0.0.1:9999", SlowStart: 10000})
+		b.now = func() time.Time { return now }
+		b.Lock()
+		b.up = true
+		b.updateState(now)
+		b.Unlock()
+		backends = append(backends, b)
+	}
+	warm, cold := backends[0], backends[1]
+	up := []bool{true, true}
+
+	// up from the start, so not warmed up
+	c.Assert(warm.Stats().EffectiveWeight, Equals, 1.0)
+	c.Assert(cold.Stats().EffectiveWeight, Equals, 1.0)
+
+	cold.SetAdminDown(true)
+	cold.SetAdminDown(false)
+	c.Assert(cold.Stats().EffectiveWeight, Equals, slowStartFloor)
+
+	share := func(next func() *Backend) float64 {
+		n := 0
+		for i := 0; i < 1100; i++ {
+			if next() == cold {
+				n++
+			}
+		}
+		return float64(n) / 1100
+	}
+	rr := &roundRobin{}
+	rrShare := func() float64 {
+		return share(func() *Backend { return rr.balance(backends, up, nil)[0] })
+	}
+	rrUDP := &roundRobin{}
+	udpShare := func() float64 {
+		return share(func() *Backend { return rrUDP.balanceUDP(backends, 1, nil) })
+	}
+
+	// a tenth of the warm backend's share at first, half way there after half
+	// the slow start, and an even share once it's over
+	for _, step := range []struct {
+		elapsed time.Duration
+		share   float64
+	}{
+		{0, 0.1 / 1.1},
+		{5 * time.Second, 0.55 / 1.55},
+		{10 * time.Second, 0.5},
+	} {
+		now = cold.rampStart.Add(step.elapsed)
+		if step.elapsed == 10*time.Second {
+			now = now.Add(time.Millisecond)
+		}
+		for _, got := range []float64{rrShare(), udpShare()} {
+			c.Assert(got > step.share-0.01 && got < step.share+0.01, Equals, true,
+				Commentf("share %.3f after %s, expected %.3f", got, step.elapsed, step.share))
+		}
+	}
+	c.Assert(cold.Stats().EffectiveWeight, Equals, 1.0)
+
+	// least connections treats the warming backend as busier than it is
+	atomic.StoreInt64(&warm.Active, 3)
+	cold.SetAdminDown(true)
+	cold.SetAdminDown(false)
+	lc := &leastConn{}
+	c.Assert(lc.balance(backends, up, nil)[0], Equals, warm)
+	c.Assert(lc.balanceUDP(backends, 1, nil), Equals, warm)
+
+	now = now.Add(10 * time.Second)
+	c.Assert(lc.balance(backends, up, nil)[0], Equals, cold)
+
+	// a negative slow start is invalid
+	err := Registry.AddBackend(s.service.Name, client.BackendConfig{Name: "bad", Addr: "127.0.0.1:9999", SlowStart: -1})
+	c.Assert(err, ErrorMatches, ErrInvalidSlowStart.Error()+".*")
+}
+
+// An http health check needs a 2xx or 3xx response, with the same rise and
+// fall counts as a TCP check, and the backend's stats show why it's down.
+func (s *BasicSuite) TestHTTPCheck(c *C) {
+	var status int32 = 200
+	hang := make(chan struct{})
+	headers := make(chan http.Header, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			headers <- r.Header
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+		case "/hang":
+			<-hang
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	// a hanging handler must return before the server can close
+	defer close(hang)
+	addr := srv.Listener.Addr().String()
+
+	b := NewBackend(client.BackendConfig{
+		Name:      "web",
+		Addr:      addr,
+		CheckAddr: addr,
+		CheckType: client.CheckHTTP,
+		CheckPath: "/health",
+	})
+	b.up = true
+	b.rise = 2
+	b.fall = 2
+	b.dialTimeout = time.Second
+
+	result := b.runCheck(true)
+	c.Assert(result.OK, Equals, true)
+	c.Assert(result.Status, Equals, 200)
+
+	// the check isn't marked unless the service asks for it
+	header := <-headers
+	c.Assert(header["User-Agent"], IsNil)
+	c.Assert(header["X-Shuttle-Service"], IsNil)
+
+	b.service = "webService"
+	b.checkUserAgent = "shuttle-check"
+	b.runCheck(false)
+	header = <-headers
+	c.Assert(header.Get("User-Agent"), Equals, "shuttle-check")
+	c.Assert(header.Get("X-Shuttle-Service"), Equals, "webService")
+
+	atomic.StoreInt32(&status, 500)
+	b.runCheck(true)
+	c.Assert(b.Up(), Equals, true)
+	result = b.runCheck(true)
+	c.Assert(result.OK, Equals, false)
+	c.Assert(b.Up(), Equals, false)
+
+	stat := b.Stats()
+	c.Assert(stat.LastCheckStatus, Equals, 500)
+	c.Assert(stat.LastCheckError, Equals, "check returned 500 Internal Server Error")
+
+	// a redirect is a success
+	atomic.StoreInt32(&status, 302)
+	b.runCheck(true)
+	c.Assert(b.Up(), Equals, false)
+	b.runCheck(true)
+	c.Assert(b.Up(), Equals, true)
+	stat = b.Stats()
+	c.Assert(stat.LastCheckStatus, Equals, 302)
+	c.Assert(stat.LastCheckError, Equals, "")
+
+	// a response that doesn't arrive within the check timeout fails
+	b.CheckPath = "/hang"
+	b.checkTimeout = 50 * time.Millisecond
+	b.dialTimeout = 50 * time.Millisecond
+	result = b.runCheck(false)
+	c.Assert(result.OK, Equals, false)
+	c.Assert(result.Status, Equals, 0)
+	c.Assert(result.Duration < time.Second, Equals, true)
+
+	c.Assert(b.Config().CheckTimeout, Equals, 50)
+	c.Assert(NewBackend(client.BackendConfig{Name: "tcp", CheckAddr: addr}).Config().CheckType, Equals, "")
+}
+
+func (s *BasicSuite) TestCheckValidation(c *C) {
+	for _, cfg := range []client.BackendConfig{
+		{Name: "b", CheckType: "icmp"},
+		{Name: "b", CheckType: client.CheckHTTP, CheckPath: "health"},
+		{Name: "b", CheckType: client.CheckHTTP, CheckTimeout: -1},
+	} {
+		c.Assert(validCheck(cfg), ErrorMatches, "invalid health check for b: .*")
+	}
+	c.Assert(validCheck(client.BackendConfig{Name: "b"}), IsNil)
+	c.Assert(validCheck(client.BackendConfig{Name: "b", CheckType: client.CheckHTTP}), IsNil)
+}
+
 // Test health check by taking down a server from a configured backend
 func (s *BasicSuite) TestFailedCheck(c *C) {
 	s.service.CheckInterval = 500
-	s.service.Fall = 1
+	s.service.Rise, s.service.Fall = 1, 1
 	s.AddBackend(c)
 
 	stats := s.service.Stats()
@@ -277,6 +582,82 @@ func (s *BasicSuite) TestFailedCheck(c *C) {
 	c.Assert(stats.Backends[0].Up, Equals, true)
 }
 
+// Flap a server, and check the recorded health check history
+func (s *BasicSuite) TestCheckHistory(c *C) {
+	// keep the scheduled checks out of the way, and let one check change
+	// the backend state
+	s.service.CheckInterval = 60000
+	s.service.Rise, s.service.Fall = 1, 1
+	s.AddBackend(c)
+
+	result, err := Registry.CheckBackend("testService", "backend_0", true)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(result.OK, Equals, true)
+	c.Assert(result.Counted, Equals, true)
+
+	addr := s.servers[0].addr
+	s.servers[0].Stop()
+
+	// an uncounted failure is recorded, but doesn't change the backend state
+	result, err = Registry.CheckBackend("testService", "backend_0", false)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(result.OK, Equals, false)
+	c.Assert(result.Error, Not(Equals), "")
+
+	checks, err := Registry.BackendChecks("testService", "backend_0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(checks.Up, Equals, true)
+	c.Assert(checks.FallCount, Equals, 0)
+	c.Assert(checks.RiseCount, Equals, 1)
+
+	// a counted failure takes it down
+	Registry.CheckBackend("testService", "backend_0", true)
+	checks, _ = Registry.BackendChecks("testService", "backend_0")
+	c.Assert(checks.Up, Equals, false)
+	c.Assert(checks.FallCount, Equals, 1)
+	c.Assert(checks.RiseCount, Equals, 0)
+
+	server, err := NewTestServer(addr, c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	s.servers[0] = server
+
+	Registry.CheckBackend("testService", "backend_0", true)
+	checks, _ = Registry.BackendChecks("testService", "backend_0")
+	c.Assert(checks.Up, Equals, true)
+	c.Assert(checks.NextCheck.After(time.Now()), Equals, true)
+
+	c.Assert(len(checks.History), Equals, 4)
+	for i, expected := range []struct{ ok, counted bool }{
+		{true, true}, {false, false}, {false, true}, {true, true},
+	} {
+		check := checks.History[i]
+		c.Assert(check.OK, Equals, expected.ok)
+		c.Assert(check.Counted, Equals, expected.counted)
+		c.Assert(check.Duration > 0, Equals, true)
+		if i > 0 {
+			c.Assert(check.Time.Before(checks.History[i-1].Time), Equals, false)
+		}
+	}
+
+	// the history only keeps the latest results
+	for i := 0; i < checkHistoryLen+10; i++ {
+		Registry.CheckBackend("testService", "backend_0", false)
+	}
+	checks, _ = Registry.BackendChecks("testService", "backend_0")
+	c.Assert(len(checks.History), Equals, checkHistoryLen)
+	for _, check := range checks.History {
+		c.Assert(check.Counted, Equals, false)
+	}
+}
+
 // Make sure the connection is re-dispatched when Dialing a backend fails
 func (s *BasicSuite) TestConnectAny(c *C) {
 	s.service.CheckInterval = 2000
@@ -354,6 +735,620 @@ func (s *BasicSuite) TestRemoveBackend(c *C) {
 	c.Assert(err, Equals, ErrNoBackend)
 }
 
+// Networks in the same family interoperate, and unix backends can only serve
+// tcp services when bridging is enabled. Unix services can use tcp or unix
+// backends.
+func (s *BasicSuite) TestNetworkMatrix(c *C) {
+	for _, t := range []struct {
+		service, backend string
+		bridging         bool
+		err              error
+	}{
+		{"tcp", "tcp", false, nil},
+		{"tcp", "tcp4", false, nil},
+		{"tcp", "tcp6", false, nil},
+		{"tcp4", "tcp", false, nil},
+		{"tcp4", "tcp6", false, nil},
+		{"tcp6", "tcp4", false, nil},
+		{"udp", "udp", false, nil},
+		{"udp", "udp4", false, nil},
+		{"udp4", "udp6", false, nil},
+		{"udp6", "udp", false, nil},
+		{"tcp", "udp", false, ErrNetworkMismatch},
+		{"tcp4", "udp6", false, ErrNetworkMismatch},
+		{"udp", "tcp", false, ErrNetworkMismatch},
+		{"udp6", "tcp4", false, ErrNetworkMismatch},
+		{"tcp", "unix", false, ErrNetworkMismatch},
+		{"tcp4", "unix", false, ErrNetworkMismatch},
+		{"udp", "unix", false, ErrNetworkMismatch},
+		{"tcp", "unix", true, nil},
+		{"tcp6", "unix", true, nil},
+		{"udp", "unix", true, ErrNetworkMismatch},
+		{"udp", "tcp", true, ErrNetworkMismatch},
+		{"unix", "unix", false, nil},
+		{"unix", "tcp", false, nil},
+		{"unix", "tcp6", false, nil},
+		{"unix", "udp", true, ErrNetworkMismatch},
+		{"tcp", "ipx", false, ErrInvalidNetwork},
+		{"tcp", "tc", false, ErrInvalidNetwork},
+		{"tcp", "", false, ErrInvalidNetwork},
+		{"u", "udp", false, ErrInvalidNetwork},
+		{"", "tcp", false, ErrInvalidNetwork},
+	} {
+		comment := Commentf("%q service, %q backend, bridging %t", t.service, t.backend, t.bridging)
+		err := checkNetworks(t.service, t.backend, t.bridging)
+		if t.err == nil {
+			c.Assert(err, IsNil, comment)
+			continue
+		}
+
+		c.Assert(err, NotNil, comment)
+		c.Assert(strings.HasPrefix(err.Error(), t.err.Error()), Equals, true, comment)
+		if t.err == ErrNetworkMismatch {
+			c.Assert(strings.Contains(err.Error(), fmt.Sprintf("%q", t.service)), Equals, true, comment)
+			c.Assert(strings.Contains(err.Error(), fmt.Sprintf("%q", t.backend)), Equals, true, comment)
+		}
+	}
+}
+
+// Virtual hosts are lowercase, without trailing dots, and with international
+// labels in punycode. Names that can't be hosts are rejected with the reason.
+func (s *BasicSuite) TestCanonicalVHost(c *C) {
+	for _, t := range []struct {
+		name, host, err string
+	}{
+		{"example.com", "example.com", ""},
+		{"Example.COM", "example.com", ""},
+		{"example.com.", "example.com", ""},
+		{"BÜcher.example", "xn--bcher-kva.example", ""},
+		{"xn--BCHER-kva.example.", "xn--bcher-kva.example", ""},
+		{"münchen.de", "xn--mnchen-3ya.de", ""},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah", ""},
+		{"*.Example.com", "*.example.com", ""},
+		{"**.Example.com.", "**.example.com", ""},
+		{"test-vhost", "test-vhost", ""},
+		{"_srv.example.com", "_srv.example.com", ""},
+		{"", "", "empty name"},
+		{"..", "", "empty name"},
+		{"example.com:8080", "", "names can't include a port"},
+		{"example.com/path", "", "names can't include a path"},
+		{"a..example.com", "", "empty label"},
+		{"-a.example.com", "", `label "-a" starts or ends with a hyphen`},
+		{"a b.example.com", "", `invalid character ' '`},
+		{"a.*.example.com", "", `invalid character '\*'`},
+		{"***.example.com", "", `invalid character '\*'`},
+		{strings.Repeat("a", 64) + ".com", "", `label "a+" is longer than 63 characters`},
+		{strings.Repeat("a.", 127) + "com", "", "longer than 253 characters"},
+	} {
+		comment := Commentf("%q", t.name)
+		host, err := canonicalVHost(t.name)
+		if t.err == "" {
+			c.Assert(err, IsNil, comment)
+			c.Assert(host, Equals, t.host, comment)
+			continue
+		}
+		c.Assert(err, ErrorMatches, fmt.Sprintf(`%s ".*": %s`, ErrInvalidVHost, t.err), comment)
+	}
+
+	// request hosts that aren't valid names are only lowercased
+	c.Assert(requestVHost("Bad Host"), Equals, "bad host")
+	c.Assert(requestVHost("BÜcher.example."), Equals, "xn--bcher-kva.example")
+
+	// two names for the same host conflict
+	_, err := canonicalVHosts([]string{"a.example.com", "", "A.Example.com."})
+	c.Assert(err, ErrorMatches, ErrDuplicateVHost.Error()+`.*"a.example.com" and "A.Example.com." are the same host`)
+	c.Assert(errorStatus(err), Equals, http.StatusConflict)
+}
+
+// Exact hosts match before wildcards, and longer suffixes before shorter
+// ones, with "*" matching a single label and "**" any number.
+func (s *BasicSuite) TestMatchVHost(c *C) {
+	vhosts := map[string]bool{
+		"a.example.com":      true,
+		"*.example.com":      true,
+		"**.example.com":     true,
+		"*.b.example.com":    true,
+		"**.c.example.com":   true,
+		"*.xn--bcher-kva.de": true,
+	}
+	has := func(name string) bool { return vhosts[name] }
+
+	for _, t := range []struct {
+		host, match string
+	}{
+		{"a.example.com", "a.example.com"},
+		{"x.example.com", "*.example.com"},
+		{"x.y.example.com", "**.example.com"},
+		{"x.b.example.com", "*.b.example.com"},
+		{"x.y.b.example.com", "**.example.com"},
+		{"x.c.example.com", "**.c.example.com"},
+		{"x.y.c.example.com", "**.c.example.com"},
+		{"example.com", ""},
+		{"example.org", ""},
+		{"x.example.org", ""},
+		{"*.other.example.com", ""},
+		{requestVHost("WWW.Bücher.DE."), "*.xn--bcher-kva.de"},
+		{requestVHost("A.EXAMPLE.COM"), "a.example.com"},
+	} {
+		c.Assert(matchVHost(t.host, has), Equals, t.match, Commentf("%q", t.host))
+	}
+}
+
+// Client addresses are normalized the same way for logging and matching.
+func (s *BasicSuite) TestNormalizeClientAddr(c *C) {
+	for _, t := range []struct {
+		addr, normalized, host string
+	}{
+		{"10.0.0.5:1234", "10.0.0.5:1234", "10.0.0.5"},
+		{"10.0.0.5", "10.0.0.5", "10.0.0.5"},
+		{"[::ffff:10.0.0.5]:1234", "10.0.0.5:1234", "10.0.0.5"},
+		{"::ffff:10.0.0.5", "10.0.0.5", "10.0.0.5"},
+		{"[::ffff:10.0.0.5%eth0]:80", "10.0.0.5:80", "10.0.0.5"},
+		{"[2001:DB8::1]:443", "[2001:db8::1]:443", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::1"},
+		{"[::1]", "::1", "::1"},
+		{"[fe80::1%eth0]:80", "[fe80::1%eth0]:80", "fe80::1%eth0"},
+		{"fe80::1%eth0", "fe80::1%eth0", "fe80::1%eth0"},
+		{"unknown", "unknown", "unknown"},
+		{"client.example:80", "client.example:80", "client.example"},
+		{"@", "@", "@"},
+		{"", "", ""},
+	} {
+		addr := normalizeClientAddr(t.addr)
+		c.Assert(addr.String(), Equals, t.normalized, Commentf("%q", t.addr))
+		c.Assert(addr.Host(), Equals, t.host, Commentf("%q", t.addr))
+	}
+
+	c.Assert(normalizeAddrList("::ffff:10.0.0.5,  192.168.0.1 ,fe80::1%eth0"), Equals, "10.0.0.5, 192.168.0.1, fe80::1%eth0")
+
+	// v4 and v6 networks match normalized addresses in either form
+	for _, t := range []struct {
+		network, addr string
+		match         bool
+	}{
+		{"10.0.0.0/8", "10.0.0.5:1234", true},
+		{"10.0.0.0/8", "[::ffff:10.0.0.5]:1234", true},
+		{"10.0.0.0/8", "[::ffff:11.0.0.5]:1234", false},
+		{"::ffff:10.0.0.0/104", "10.0.0.5:1234", true},
+		{"::ffff:10.0.0.0/104", "[::ffff:10.0.0.5]:1234", true},
+		{"::ffff:10.0.0.0/104", "11.0.0.5:1234", false},
+		{"10.0.0.5", "[::ffff:10.0.0.5]:1234", true},
+		{"::ffff:10.0.0.5", "10.0.0.5:1234", true},
+		{"fe80::/10", "[fe80::1%eth0]:80", true},
+		{"fe80::1%eth0", "[fe80::1%eth0]:80", true},
+		{"2001:db8::/32", "[2001:db8::1]:443", true},
+		{"2001:db8::/32", "10.0.0.5:1234", false},
+		{"10.0.0.0/8", "[2001:db8::1]:443", false},
+		{"::/0", "10.0.0.5:1234", false},
+		{"0.0.0.0/0", "[2001:db8::1]:443", false},
+		{"10.0.0.0/8", "unknown", false},
+	} {
+		nets, err := parseTrustedNets([]string{t.network})
+		c.Assert(err, IsNil, Commentf("%q", t.network))
+		c.Assert(normalizeClientAddr(t.addr).In(nets), Equals, t.match, Commentf("%q in %q", t.addr, t.network))
+	}
+
+	for _, network := range []string{"10.0.0.5:80", "[::1]:80", "10.0.0.0/33", "host"} {
+		_, err := parseTrustedNets([]string{network})
+		c.Assert(err, NotNil, Commentf("%q", network))
+	}
+}
+
+func (s *BasicSuite) TestValidTags(c *C) {
+	c.Assert(validTags(nil), IsNil)
+	c.Assert(validTags(map[string]string{"team": "payments", "cost.center": "eu-west:1/a"}), IsNil)
+
+	tooMany := make(map[string]string)
+	for i := 0; i <= MaxTags; i++ {
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	for _, tags := range []map[string]string{
+		tooMany,
+		{"": "v"},
+		{"k": ""},
+		{strings.Repeat("k", MaxTagKeyLen+1): "v"},
+		{"k": strings.Repeat("v", MaxTagValueLen+1)},
+		{"team name": "v"},
+		{"team:name": "v"},
+		{"k": "a=b"},
+	} {
+		c.Assert(validTags(tags), NotNil, Commentf("%v", tags))
+	}
+
+	svcCfg := client.ServiceConfig{
+		Name: "TagSvc",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Tags: map[string]string{"k": "a b"}},
+		},
+	}
+	c.Assert(validServiceTags(svcCfg), NotNil)
+
+	tags := map[string]string{"team": "payments", "env": "prod"}
+	c.Assert(formatTags(tags), Equals, "env:prod,team:payments")
+
+	for _, t := range []struct {
+		filter []string
+		match  bool
+	}{
+		{nil, true},
+		{[]string{"team:payments"}, true},
+		{[]string{"team"}, true},
+		{[]string{"team:payments", "env:prod"}, true},
+		{[]string{"team:payments", "env:dev"}, false},
+		{[]string{"owner"}, false},
+	} {
+		filter, err := parseTagFilter(t.filter)
+		c.Assert(err, IsNil)
+		c.Assert(filter.match(tags), Equals, t.match, Commentf("%v", t.filter))
+	}
+
+	_, err := parseTagFilter([]string{":payments"})
+	c.Assert(err, NotNil)
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+// Checking an error page condition reads no more than its limit of the body,
+// and the body is still read whole afterwards.
+func (s *BasicSuite) TestErrorConditionPeek(c *C) {
+	body := strings.Repeat("x", 100) + "nginx" + strings.Repeat("x", 1<<20)
+
+	for _, t := range []struct {
+		cond client.ErrorPageCondition
+		met  bool
+		read int
+	}{
+		{client.ErrorPageCondition{Body: client.ErrorBodyEmpty}, false, 1},
+		{client.ErrorPageCondition{Body: client.ErrorBodySmaller, Bytes: 64}, false, 64},
+		{client.ErrorPageCondition{Body: client.ErrorBodyMatches, Pattern: "nginx", Bytes: 100}, false, 100},
+		{client.ErrorPageCondition{Body: client.ErrorBodyMatches, Pattern: "nginx", Bytes: 105}, true, 105},
+		{client.ErrorPageCondition{Body: client.ErrorBodyMatches, Pattern: "nginx"}, true, client.DefaultErrorPeekBytes},
+	} {
+		cond, err := newErrorCondition(t.cond)
+		c.Assert(err, IsNil)
+
+		src := &countingReader{Reader: strings.NewReader(body)}
+		resp := &http.Response{StatusCode: 500, ContentLength: -1, Body: ioutil.NopCloser(src)}
+		c.Assert(cond.check(resp), Equals, t.met, Commentf("%v", t.cond))
+		c.Assert(src.n <= t.read, Equals, true, Commentf("%v read %d", t.cond, src.n))
+
+		all, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, IsNil)
+		c.Assert(string(all), Equals, body)
+	}
+}
+
+// The entries a log stream has been sent, by ID.
+func drainLogStream(c *C, stream *logStream) []string {
+	var ids []string
+	for {
+		select {
+		case js := <-stream.entries:
+			var e client.LogEntry
+			c.Assert(json.Unmarshal(js, &e), IsNil)
+			ids = append(ids, e.ID)
+		default:
+			sort.Strings(ids)
+			return ids
+		}
+	}
+}
+
+func (s *BasicSuite) TestLogStreamFilter(c *C) {
+	entries := []*client.LogEntry{
+		{ID: "a", Type: client.LogAccess, Level: client.LevelInfo, Service: "Alpha", Backend: "b0", BackendAddr: "127.0.0.1:1", Status: 200},
+		{ID: "b", Type: client.LogAccess, Level: client.LevelInfo, Service: "Alpha", Backend: "b1", BackendAddr: "127.0.0.1:2", Status: 502},
+		{ID: "c", Type: client.LogAccess, Level: client.LevelInfo, Service: "Beta", Status: 503},
+		{ID: "d", Type: client.LogError, Level: client.LevelError, Message: "ERROR: Alpha: dial failed"},
+		{ID: "e", Type: client.LogError, Level: client.LevelWarn, Message: "WARN: backend b1 is down"},
+	}
+
+	for _, t := range []struct {
+		query string
+		scope *AdminToken
+		ids   []string
+	}{
+		{"", nil, []string{"a", "b", "c", "d", "e"}},
+		{"service=Alpha", nil, []string{"a", "b", "d"}},
+		{"backend=b1", nil, []string{"b", "e"}},
+		{"backend=127.0.0.1:1", nil, []string{"a"}},
+		{"status=5xx", nil, []string{"b", "c"}},
+		{"status=2XX", nil, []string{"a"}},
+		{"level=warn", nil, []string{"d", "e"}},
+		{"level=error", nil, []string{"d"}},
+		{"service=Alpha&status=5xx", nil, []string{"b"}},
+		{"", &AdminToken{Name: "b", Permission: PermReadStats, Services: []string{"Beta"}}, []string{"c"}},
+	} {
+		q, _ := url.ParseQuery(t.query)
+		filter, err := parseLogFilter(q)
+		c.Assert(err, IsNil)
+		stream, err := logTap.subscribe(filter, t.scope)
+		c.Assert(err, IsNil)
+
+		for _, e := range entries {
+			logTap.publish(e)
+		}
+		logTap.unsubscribe(stream)
+		c.Assert(drainLogStream(c, stream), DeepEquals, t.ids, Commentf("%q", t.query))
+	}
+
+	for _, query := range []string{"level=debug", "status=6xx", "status=500x"} {
+		q, _ := url.ParseQuery(query)
+		_, err := parseLogFilter(q)
+		c.Assert(err, ErrorMatches, ErrInvalidLogFilter.Error()+".*", Commentf("%q", query))
+	}
+}
+
+// A stream that falls a full buffer behind is evicted, without holding up the
+// others, and no more than maxLogStreams are served.
+func (s *BasicSuite) TestLogStreamEviction(c *C) {
+	defer func(n, buf int) { maxLogStreams, logStreamBuffer = n, buf }(maxLogStreams, logStreamBuffer)
+	maxLogStreams, logStreamBuffer = 2, 4
+
+	stalled, err := logTap.subscribe(logFilter{level: logLevels[client.LevelInfo]}, nil)
+	c.Assert(err, IsNil)
+	reading, err := logTap.subscribe(logFilter{level: logLevels[client.LevelInfo]}, nil)
+	c.Assert(err, IsNil)
+	defer logTap.unsubscribe(reading)
+
+	_, err = logTap.subscribe(logFilter{}, nil)
+	c.Assert(err, Equals, ErrTooManyStreams)
+
+	evicted := atomic.LoadInt64(&logTap.evicted)
+	for i := 0; i < 10; i++ {
+		logTap.publish(&client.LogEntry{ID: strconv.Itoa(i), Type: client.LogAccess, Level: client.LevelInfo})
+		<-reading.entries
+	}
+
+	select {
+	case <-stalled.evicted:
+	default:
+		c.Fatal("stalled stream wasn't evicted")
+	}
+	c.Assert(len(stalled.entries), Equals, 4)
+	c.Assert(atomic.LoadInt64(&logTap.evicted), Equals, evicted+1)
+
+	// the evicted stream's place is free, and unsubscribing it again is safe
+	logTap.unsubscribe(stalled)
+	another, err := logTap.subscribe(logFilter{}, nil)
+	c.Assert(err, IsNil)
+	logTap.unsubscribe(another)
+}
+
+// A subscriber that stops reading is evicted without holding up the others,
+// or whatever published the event.
+func (s *BasicSuite) TestEventEviction(c *C) {
+	defer func(n, buf int) { maxEventSubscribers, eventBuffer = n, buf }(maxEventSubscribers, eventBuffer)
+	maxEventSubscribers, eventBuffer = 2, 4
+
+	stalled, err := events.subscribe("", nil)
+	c.Assert(err, IsNil)
+	reading, err := events.subscribe("", nil)
+	c.Assert(err, IsNil)
+	defer events.unsubscribe(reading)
+
+	_, err = events.subscribe("", nil)
+	c.Assert(err, Equals, ErrTooManySubscribers)
+
+	evicted := atomic.LoadInt64(&events.evicted)
+	for i := 0; i < 10; i++ {
+		events.service(client.EventServiceAdded, strconv.Itoa(i), nil)
+		<-reading.events
+	}
+
+	select {
+	case <-stalled.evicted:
+	default:
+		c.Fatal("stalled subscriber wasn't evicted")
+	}
+	c.Assert(len(stalled.events), Equals, 4)
+	c.Assert(atomic.LoadInt64(&events.evicted), Equals, evicted+1)
+
+	events.unsubscribe(stalled)
+	another, err := events.subscribe("", nil)
+	c.Assert(err, IsNil)
+	events.unsubscribe(another)
+}
+
+// Each ID format has its shape, and the time-ordered formats sort by the
+// millisecond they were generated in.
+func (s *BasicSuite) TestRequestIDFormats(c *C) {
+	c.Assert(genId(), Matches, "[0-9a-f]{16}")
+
+	now := time.Unix(1700000000, 0)
+	later := now.Add(time.Millisecond)
+
+	uuid := genUUIDv7(now)
+	c.Assert(uuid, Matches, "[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}")
+	c.Assert(uuid[:13], Equals, "018bcfe5-6800")
+	c.Assert(genUUIDv7(later) > uuid, Equals, true)
+
+	ulid := genULID(now)
+	c.Assert(ulid, Matches, "[0-9A-HJKMNP-TV-Z]{26}")
+	c.Assert(ulid[:10], Equals, "01HF7YAT00")
+	c.Assert(genULID(later) > ulid, Equals, true)
+	c.Assert(genULID(now), Not(Equals), ulid)
+
+	for _, cfg := range []client.ServiceConfig{
+		{RequestIDHeader: "X Request"},
+		{RequestIDCopyHeader: "X-Trace:"},
+		{RequestIDInbound: "sometimes"},
+		{RequestIDFormat: "uuidv4"},
+	} {
+		_, err := newRequestIDPolicy(cfg)
+		c.Assert(err, ErrorMatches, ErrInvalidRequestID.Error()+": .*")
+	}
+}
+
+// Nothing is built or sent for the log streams while none are open.
+func (s *BasicSuite) TestLogStreamUnsubscribed(c *C) {
+	c.Assert(logTap.active(), Equals, false)
+
+	stream, err := logTap.subscribe(logFilter{level: logLevels[client.LevelInfo]}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(logTap.active(), Equals, true)
+	log.Warnf("WARN: streamed")
+	c.Assert(len(stream.entries), Equals, 1)
+
+	logTap.unsubscribe(stream)
+	c.Assert(logTap.active(), Equals, false)
+
+	sent := atomic.LoadInt64(&logTap.sent)
+	log.Warnf("WARN: not streamed")
+	log.Errorf("ERROR: not streamed")
+	logRequest(&AccessEntry{Method: "GET", ClientIP: "127.0.0.1", Service: "A", Status: 200, Origin: originBackend}, nil)
+	c.Assert(atomic.LoadInt64(&logTap.sent), Equals, sent)
+	c.Assert(len(stream.entries), Equals, 1)
+}
+
+// Each access log format renders an entry as one line.
+func (s *BasicSuite) TestAccessLogFormats(c *C) {
+	e := &AccessEntry{
+		Time:      time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+		Host:      "www.test",
+		Method:    "GET",
+		URI:       "/path?q=1",
+		Proto:     "HTTP/1.1",
+		Referer:   "http://ref.test/",
+		UserAgent: "agent/1.0",
+		ClientIP:  "10.0.0.1",
+		Status:    200,
+		Duration:  15 * time.Millisecond,
+		BytesSent: 1234,
+		Backend:   "127.0.0.1:8000",
+	}
+
+	for _, t := range []struct {
+		format, expected string
+	}{
+		{"", `10.0.0.1 - - [04/Mar/2020:05:06:07 +0000] "GET /path?q=1 HTTP/1.1" 200 1234` + "\n"},
+		{client.AccessLogCommon, `10.0.0.1 - - [04/Mar/2020:05:06:07 +0000] "GET /path?q=1 HTTP/1.1" 200 1234` + "\n"},
+		{client.AccessLogCombined, `10.0.0.1 - - [04/Mar/2020:05:06:07 +0000] "GET /path?q=1 HTTP/1.1" 200 1234 "http://ref.test/" "agent/1.0"` + "\n"},
+		{"{{.Host}} {{.Status}} {{.Duration}} {{.Backend}} {{.BytesSent}}", "www.test 200 15ms 127.0.0.1:8000 1234\n"},
+		{"{{.Status}}\n", "200\n"},
+	} {
+		tmpl, err := parseAccessFormat(t.format)
+		c.Assert(err, IsNil)
+		l := &accessLog{format: t.format, tmpl: tmpl}
+		if l.format == "" {
+			l.format = client.DefaultAccessLogFormat
+		}
+		line, err := l.render(e)
+		c.Assert(err, IsNil)
+		c.Assert(string(line), Equals, t.expected, Commentf("%q", t.format))
+	}
+
+	// an empty response has no size
+	e.BytesSent = 0
+	line, _ := (&accessLog{format: client.AccessLogCommon}).render(e)
+	c.Assert(strings.HasSuffix(string(line), " 200 -\n"), Equals, true)
+
+	for _, format := range []string{"{{.Status", "{{.NoSuchField}}"} {
+		_, err := parseAccessFormat(format)
+		c.Assert(err, ErrorMatches, ErrInvalidAccessLog.Error()+".*")
+	}
+}
+
+// Access log files are reopened on SIGUSR1, so they can be rotated.
+func (s *BasicSuite) TestAccessLogReopen(c *C) {
+	handleReopenSignal()
+
+	path := filepath.Join(c.MkDir(), "access.log")
+	l, err := newAccessLog(&client.AccessLogConfig{Path: path, Format: "{{.URI}}"})
+	c.Assert(err, IsNil)
+	defer l.close()
+
+	// a second log for the same path shares the file
+	shared, err := newAccessLog(&client.AccessLogConfig{Path: path})
+	c.Assert(err, IsNil)
+	c.Assert(shared.out, Equals, l.out)
+	shared.close()
+
+	l.write(&AccessEntry{URI: "/before"})
+	// lines are buffered until they're flushed
+	data, _ := ioutil.ReadFile(path)
+	c.Assert(string(data), Equals, "")
+	logFiles.flush()
+	data, _ = ioutil.ReadFile(path)
+	c.Assert(string(data), Equals, "/before\n")
+
+	rotated := path + ".1"
+	c.Assert(os.Rename(path, rotated), IsNil)
+	l.write(&AccessEntry{URI: "/during"})
+	c.Assert(syscall.Kill(os.Getpid(), syscall.SIGUSR1), IsNil)
+
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if i > 100 {
+			c.Fatal("log wasn't reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	l.write(&AccessEntry{URI: "/after"})
+	logFiles.flush()
+
+	// what was buffered before the signal went to the rotated file
+	data, _ = ioutil.ReadFile(rotated)
+	c.Assert(string(data), Equals, "/before\n/during\n")
+	data, _ = ioutil.ReadFile(path)
+	c.Assert(string(data), Equals, "/after\n")
+}
+
+// Backends without a network use the service's family, and mismatched
+// backends are rejected before anything is added.
+func (s *BasicSuite) TestNormalizeNetworks(c *C) {
+	for _, t := range []struct {
+		service, backend string
+		expected         string
+	}{
+		{"", "", "tcp"},
+		{"tcp4", "", "tcp"},
+		{"", "tcp4", "tcp4"},
+		{"udp", "", "udp"},
+		{"udp6", "", "udp"},
+		{"udp", "udp4", "udp4"},
+	} {
+		cfg := client.ServiceConfig{
+			Name:     "net",
+			Network:  t.service,
+			Backends: []client.BackendConfig{{Name: "b", Network: t.backend}},
+		}
+		c.Assert(validNetworks(&cfg), IsNil)
+		c.Assert(cfg.Backends[0].Network, Equals, t.expected)
+	}
+
+	// the caller's backends aren't modified
+	backends := []client.BackendConfig{{Name: "b"}}
+	cfg := client.ServiceConfig{Name: "net", Network: "udp", Backends: backends}
+	c.Assert(validNetworks(&cfg), IsNil)
+	c.Assert(backends[0].Network, Equals, "")
+
+	cfg = client.ServiceConfig{
+		Name:    "Mismatch",
+		Addr:    "127.0.0.1:9324",
+		Network: "udp",
+		Backends: []client.BackendConfig{
+			{Name: "ok", Addr: "127.0.0.1:9325"},
+			{Name: "bad", Addr: "127.0.0.1:9326", Network: "tcp"},
+		},
+	}
+	err := Registry.AddService(cfg)
+	c.Assert(err, ErrorMatches, `backend bad: .*"tcp" backend on a "udp" service`)
+	c.Assert(Registry.GetService("Mismatch"), IsNil)
+}
+
 func (s *BasicSuite) TestInvalidUpdateService(c *C) {
 	svcCfg := client.ServiceConfig{
 		Name: "Update",
@@ -376,19 +1371,25 @@ func (s *BasicSuite) TestInvalidUpdateService(c *C) {
 		c.Fatal(err)
 	}
 
-	// the update should fail, because it would require a new listener
-	if err := Registry.UpdateService(svcCfg); err == nil {
+	// a new address moves the service to a new listener
+	if err := Registry.UpdateService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
+	c.Assert(Registry.GetService("Update").Addr, Equals, "127.0.0.1:9425")
 
-	// change the addres back, and try to update ClientTimeout
-	svcCfg.Addr = "127.0.0.1:9324"
-	svcCfg.ClientTimeout = 1234
+	conn, err := net.Dial("tcp", "127.0.0.1:9425")
+	c.Assert(err, IsNil)
+	conn.Close()
 
-	// the update should fail, because it would require a new listener
-	if err := Registry.UpdateService(svcCfg); err == nil {
-		c.Fatal(err)
-	}
+	// and the old one is released
+	l, err := net.Listen("tcp", "127.0.0.1:9324")
+	c.Assert(err, IsNil)
+	l.Close()
+
+	// but a service can't change to another network
+	svcCfg.Network = "udp"
+	err = Registry.UpdateService(svcCfg)
+	c.Assert(errors.Is(err, ErrInvalidServiceUpdate), Equals, true, Commentf("%v", err))
 
 	if err := Registry.RemoveService("Update"); err != nil {
 		c.Fatal(err)
@@ -411,6 +1412,7 @@ func (s *BasicSuite) TestUpdateService(c *C) {
 		c.Fatal(ErrNoService)
 	}
 
+	svcCfg.ClientTimeout = 4321
 	svcCfg.ServerTimeout = 1234
 	svcCfg.HTTPSRedirect = true
 	svcCfg.Fall = 5
@@ -426,7 +1428,10 @@ func (s *BasicSuite) TestUpdateService(c *C) {
 	if svc == nil {
 		c.Fatal(ErrNoService)
 	}
+	c.Assert(svc.ClientTimeout, Equals, 4321*time.Millisecond)
+	c.Assert(svc.clientTimeout.Get(), Equals, 4321*time.Millisecond)
 	c.Assert(svc.ServerTimeout, Equals, 1234*time.Millisecond)
+	c.Assert(svc.serverTimeout.Get(), Equals, 1234*time.Millisecond)
 	c.Assert(svc.HTTPSRedirect, Equals, true)
 	c.Assert(svc.Fall, Equals, 5)
 	c.Assert(svc.Rise, Equals, 6)
@@ -480,31 +1485,3648 @@ func (s *BasicSuite) TestParallel(c *C) {
 	wg.Wait()
 }
 
-type UDPSuite struct {
-	servers []*udpTestServer
-	service *Service
-}
-
-var _ = Suite(&UDPSuite{})
-
-func (s *UDPSuite) SetUpTest(c *C) {
-	svcCfg := client.ServiceConfig{
-		Name:    "testService",
-		Addr:    "127.0.0.1:11110",
-		Network: "udp",
-	}
+// Capture the payload of connections to a single backend
+func (s *BasicSuite) TestCapture(c *C) {
+	s.AddBackend(c)
 
-	if err := Registry.AddService(svcCfg); err != nil {
+	err := Registry.StartCapture("testService", "backend_0", client.CaptureConfig{MaxSessions: 2})
+	if err != nil {
 		c.Fatal(err)
 	}
 
-	s.service = Registry.GetService(svcCfg.Name)
-}
+	// a second capture can't be started while this one is running
+	err = Registry.StartCapture("testService", "backend_0", client.CaptureConfig{})
+	c.Assert(err, Equals, ErrCaptureActive)
 
-func (s *UDPSuite) TearDownTest(c *C) {
-	for _, s := range s.servers {
-		s.Stop()
-	}
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	// we've reached MaxSessions, so this one isn't recorded
+	c.Assert(s.service.Backends[0].activeCapture(), IsNil)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	dump, err := Registry.Capture("testService", "backend_0")
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(dump.Active, Equals, true)
+	c.Assert(len(dump.Sessions), Equals, 2)
+	for _, session := range dump.Sessions {
+		c.Assert(len(session.Records), Equals, 2)
+		c.Assert(session.Records[0].Direction, Equals, client.CaptureRequest)
+		c.Assert(string(session.Records[0].Data), Equals, "testing\n")
+		c.Assert(session.Records[1].Direction, Equals, client.CaptureResponse)
+		c.Assert(string(session.Records[1].Data), Equals, s.servers[0].addr)
+	}
+
+	if err := Registry.StopCapture("testService", "backend_0"); err != nil {
+		c.Fatal(err)
+	}
+
+	dump, _ = Registry.Capture("testService", "backend_0")
+	c.Assert(dump.Active, Equals, false)
+	c.Assert(dump.Reason, Equals, "stopped")
+}
+
+// A capture stops as soon as it reaches MaxBytes
+func (s *BasicSuite) TestCaptureMaxBytes(c *C) {
+	s.AddBackend(c)
+
+	err := Registry.StartCapture("testService", "backend_0", client.CaptureConfig{MaxBytes: 10})
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	dump, err := Registry.Capture("testService", "backend_0")
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	c.Assert(dump.Active, Equals, false)
+	c.Assert(dump.Reason, Equals, "max bytes")
+	c.Assert(dump.Bytes, Equals, 10)
+	c.Assert(len(dump.Sessions), Equals, 1)
+
+	records := dump.Sessions[0].Records
+	c.Assert(len(records), Equals, 2)
+	c.Assert(string(records[0].Data), Equals, "testing\n")
+	c.Assert(string(records[1].Data), Equals, s.servers[0].addr[:2])
+	c.Assert(s.service.Backends[0].activeCapture(), IsNil)
+}
+
+// Return the shutdown event already sent to sub.
+func shutdownEvent(c *C, sub *eventSub) client.Event {
+	var e client.Event
+	for e.Type != client.EventShutdown {
+		select {
+		case js := <-sub.events:
+			c.Assert(json.Unmarshal(js, &e), IsNil)
+		default:
+			c.Fatal("no shutdown event")
+		}
+	}
+	return e
+}
+
+// Run the shutdown sequence with an open connection that has to be closed
+// after the timeout.
+func (s *BasicSuite) TestShutdownForced(c *C) {
+	// leave the http routers out of this
+	defer func(h, hs *HostRouter) {
+		httpRouter, httpsRouter = h, hs
+	}(httpRouter, httpsRouter)
+	httpRouter, httpsRouter = nil, nil
+
+	s.AddBackend(c)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	// make sure the proxy connection is established
+	buff := make([]byte, 1024)
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(buff); err != nil {
+		c.Fatal(err)
+	}
+
+	sub, err := events.subscribe("", nil)
+	c.Assert(err, IsNil)
+	defer events.unsubscribe(sub)
+
+	sd := NewShutdown()
+	sd.Timeout = 200 * time.Millisecond
+
+	start := time.Now()
+	c.Assert(sd.Run(), Equals, exitForced)
+	c.Assert(time.Since(start) >= sd.Timeout, Equals, true)
+	c.Assert(sd.Completed(), DeepEquals, []string{"admin", "listeners", "drain", "flush"})
+	c.Assert(sd.Stage(), Equals, "stopped")
+
+	// the last event says connections were closed
+	c.Assert(shutdownEvent(c, sub).Forced, Equals, true)
+
+	// config changes are rejected after shutdown
+	c.Assert(sd.BeginMutation(), Equals, false)
+
+	// our connection was closed after the timeout
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buff)
+	c.Assert(err, Equals, io.EOF)
+
+	// and the listener is closed
+	_, err = net.Dial("tcp", s.service.Addr)
+	c.Assert(err, NotNil)
+
+	// running it again returns the same result
+	c.Assert(sd.Run(), Equals, exitForced)
+}
+
+// Run the shutdown sequence with no active connections.
+func (s *BasicSuite) TestShutdownClean(c *C) {
+	defer func(h, hs *HostRouter) {
+		httpRouter, httpsRouter = h, hs
+	}(httpRouter, httpsRouter)
+	httpRouter, httpsRouter = nil, nil
+
+	s.AddBackend(c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	sub, err := events.subscribe("", nil)
+	c.Assert(err, IsNil)
+	defer events.unsubscribe(sub)
+
+	sd := NewShutdown()
+	sd.Timeout = time.Second
+	c.Assert(sd.Run(), Equals, exitOK)
+	c.Assert(sd.Completed(), DeepEquals, []string{"admin", "listeners", "drain", "flush"})
+
+	c.Assert(shutdownEvent(c, sub).Forced, Equals, false)
+}
+
+// A backend that isn't ready is removed from rotation until its readiness
+// expires, and then the health checks are back in control.
+func (s *BasicSuite) TestBackendReady(c *C) {
+	s.service.CheckInterval = 60000
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	backend := s.service.get("backend_0")
+	backend.readinessTTL = 500 * time.Millisecond
+	backend.SetReady(false, "test", 0)
+
+	c.Assert(backend.Up(), Equals, false)
+	stats := backend.Stats()
+	c.Assert(stats.Ready, Equals, false)
+	c.Assert(stats.ReadySource, Equals, "test")
+	c.Assert(stats.ReadyTTL > 0, Equals, true)
+
+	// every connection goes to the ready backend
+	checkResp(s.service.Addr, s.servers[1].addr, c)
+	checkResp(s.service.Addr, s.servers[1].addr, c)
+
+	// passing checks can't bring it back
+	backend.Lock()
+	backend.countCheck(true)
+	backend.countCheck(true)
+	backend.Unlock()
+	c.Assert(backend.Up(), Equals, false)
+
+	time.Sleep(600 * time.Millisecond)
+	c.Assert(backend.Up(), Equals, true)
+	c.Assert(backend.Stats().ReadyTTL, Equals, 0)
+
+	// once expired, failing checks take it down again
+	backend.Lock()
+	backend.countCheck(false)
+	backend.countCheck(false)
+	backend.Unlock()
+	c.Assert(backend.Up(), Equals, false)
+
+	// and being ready doesn't override the checks
+	backend.SetReady(true, "test", 0)
+	c.Assert(backend.Up(), Equals, false)
+}
+
+// Draining closes connections to a backend that isn't ready.
+func (s *BasicSuite) TestBackendReadyDrain(c *C) {
+	s.AddBackend(c)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "testing\n"); err != nil {
+		c.Fatal(err)
+	}
+	buff := make([]byte, 1024)
+	if _, err := conn.Read(buff); err != nil {
+		c.Fatal(err)
+	}
+
+	err = Registry.SetBackendReady("testService", "backend_0", client.ReadyConfig{Ready: false, Drain: 100}, "test")
+	c.Assert(err, IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(buff)
+	c.Assert(err, Equals, io.EOF)
+}
+
+// A backend set down takes no new connections, while those already open keep
+// flowing. Setting it up again waits for its health checks to rise.
+func (s *BasicSuite) TestBackendAdminDown(c *C) {
+	s.service.CheckInterval = 60000
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 1024)
+	if _, err := io.WriteString(conn, "testing\n"); err != nil {
+		c.Fatal(err)
+	}
+	n, err := conn.Read(buff)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	err = Registry.SetBackendAdminState("testService", "backend_0", client.AdminStateDown)
+	c.Assert(err, IsNil)
+
+	backend := s.service.get("backend_0")
+	c.Assert(backend.Up(), Equals, false)
+	stats := backend.Stats()
+	c.Assert(stats.State, Equals, StateDown)
+	c.Assert(stats.AdminState, Equals, client.AdminStateDown)
+	c.Assert(stats.DownReason, Equals, DownAdmin)
+	c.Assert(backend.Config().AdminState, Equals, client.AdminStateDown)
+
+	// new connections go to the other backend
+	checkResp(s.service.Addr, s.servers[1].addr, c)
+	checkResp(s.service.Addr, s.servers[1].addr, c)
+
+	// the open connection still reaches the backend set down
+	if _, err := io.WriteString(conn, "testing\n"); err != nil {
+		c.Fatal(err)
+	}
+	n, err = conn.Read(buff)
+	if err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	// passing checks can't bring it back
+	backend.Lock()
+	backend.countCheck(true)
+	backend.countCheck(true)
+	backend.Unlock()
+	c.Assert(backend.Up(), Equals, false)
+
+	err = Registry.SetBackendAdminState("testService", "backend_0", "sideways")
+	c.Assert(err, ErrorMatches, ErrInvalidAdminState.Error()+".*")
+
+	// once set up, it needs rise passing checks
+	backend.Lock()
+	backend.rise = 2
+	backend.Unlock()
+	err = Registry.SetBackendAdminState("testService", "backend_0", client.AdminStateUp)
+	c.Assert(err, IsNil)
+	c.Assert(backend.Up(), Equals, false)
+	c.Assert(backend.Stats().AdminState, Equals, client.AdminStateUp)
+	c.Assert(backend.Stats().DownReason, Equals, DownCheckFailed)
+
+	backend.Lock()
+	backend.countCheck(true)
+	backend.Unlock()
+	c.Assert(backend.Up(), Equals, false)
+
+	backend.Lock()
+	backend.countCheck(true)
+	backend.Unlock()
+	c.Assert(backend.Up(), Equals, true)
+	c.Assert(backend.Config().AdminState, Equals, "")
+}
+
+// Draining a service refuses new connections at once, but lets those already
+// open finish before the service stops.
+func (s *BasicSuite) TestDrainService(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "drainService",
+		Addr:         "127.0.0.1:2003",
+		DrainTimeout: 5000,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc.Config().DrainTimeout, Equals, 5000)
+
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 1024)
+	transfer := func() {
+		if _, err := io.WriteString(conn, "testing\n"); err != nil {
+			c.Fatal(err)
+		}
+		n, err := conn.Read(buff)
+		c.Assert(err, IsNil)
+		c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+	}
+	transfer()
+
+	start := time.Now()
+	done, err := Registry.DrainService(svcCfg.Name)
+	c.Assert(err, IsNil)
+	c.Assert(Registry.GetService(svcCfg.Name), IsNil)
+
+	// new connections are refused
+	_, err = net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, NotNil)
+
+	// while the open one keeps going
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		transfer()
+	}
+	c.Assert(svc.ActiveConns(), Equals, 1)
+
+	select {
+	case <-done:
+		c.Fatal("service stopped with a connection open")
+	default:
+	}
+
+	// and the service stops as soon as it's done
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("service didn't stop after draining")
+	}
+	c.Assert(time.Since(start) < svc.DrainTimeout, Equals, true)
+
+	_, err = Registry.DrainService(svcCfg.Name)
+	c.Assert(err, Equals, ErrNoService)
+}
+
+// Connections still open at the drain timeout are closed.
+func (s *BasicSuite) TestDrainServiceTimeout(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "drainService",
+		Addr:         "127.0.0.1:2003",
+		DrainTimeout: 200,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	buff := make([]byte, 1024)
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(buff); err != nil {
+		c.Fatal(err)
+	}
+
+	done, err := Registry.DrainService(svcCfg.Name)
+	c.Assert(err, IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(buff)
+	c.Assert(err, Equals, io.EOF)
+	<-done
+
+	c.Assert(Registry.AddService(client.ServiceConfig{Name: "negative", DrainTimeout: -1}), Equals, ErrInvalidDrainTimeout)
+}
+
+// A replaced backend is out of rotation at once, but its open connections
+// drain, and those still open at the drain timeout are closed.
+func (s *BasicSuite) TestDrainBackend(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:         "drainBackend",
+		Addr:         "127.0.0.1:2003",
+		DrainTimeout: 5000,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService(svcCfg.Name)
+	svc := Registry.GetService(svcCfg.Name)
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", svcCfg.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return conn
+	}
+	buff := make([]byte, 1024)
+	transfer := func(conn net.Conn, expected string) {
+		if _, err := io.WriteString(conn, "testing\n"); err != nil {
+			c.Fatal(err)
+		}
+		n, err := conn.Read(buff)
+		c.Assert(err, IsNil)
+		c.Assert(string(buff[:n]), Equals, expected)
+	}
+	waitStopped := func(backends int) {
+		for i := 0; len(svc.Stats().Backends) > backends; i++ {
+			if i == 100 {
+				c.Fatal("drained backend wasn't stopped")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	conn := dial()
+	defer conn.Close()
+	transfer(conn, s.servers[0].addr)
+
+	svcCfg.Backends[0].Addr = s.servers[1].addr
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	// the old backend is reported until it stops
+	stats := svc.Stats()
+	c.Assert(stats.Backends, HasLen, 2)
+	c.Assert(stats.Backends[0].Addr, Equals, s.servers[1].addr)
+	c.Assert(stats.Backends[1].Addr, Equals, s.servers[0].addr)
+	c.Assert(stats.Backends[1].State, Equals, StateDraining)
+	c.Assert(stats.Backends[1].Removed, Equals, true)
+	c.Assert(stats.Backends[1].Up, Equals, false)
+	c.Assert(stats.BackendStates[StateDraining], Equals, 1)
+
+	// new connections go to the new backend, while the open one keeps going
+	checkResp(svcCfg.Addr, s.servers[1].addr, c)
+	transfer(conn, s.servers[0].addr)
+
+	// and it stops as soon as it's done
+	conn.Close()
+	waitStopped(1)
+	c.Assert(svc.Stats().Backends[0].Removed, Equals, false)
+
+	// a connection still open at the timeout is closed
+	svcCfg.DrainTimeout = 100
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	conn = dial()
+	defer conn.Close()
+	transfer(conn, s.servers[1].addr)
+
+	c.Assert(Registry.DrainBackend(svcCfg.Name, "backend_0"), IsNil)
+	c.Assert(svc.Stats().Backends[0].State, Equals, StateDraining)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := conn.Read(buff)
+	c.Assert(err, Equals, io.EOF)
+	waitStopped(0)
+
+	c.Assert(Registry.DrainBackend(svcCfg.Name, "backend_0"), Equals, ErrNoBackend)
+}
+
+// A TCP connection is closed at the service's MaxRequestTime, even while
+// it's active.
+func (s *BasicSuite) TestMaxRequestTimeTCP(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:           "maxTime",
+		Addr:           "127.0.0.1:2003",
+		MaxRequestTime: 300,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+	c.Assert(svc.Config().MaxRequestTime, Equals, 300)
+
+	conn, err := net.Dial("tcp", svcCfg.Addr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a byte at a time never lets the idle timeouts expire
+	start := time.Now()
+	buff := make([]byte, 1024)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err = io.WriteString(conn, "testing\n"); err != nil {
+			break
+		}
+		if _, err = conn.Read(buff); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	c.Assert(elapsed >= 300*time.Millisecond, Equals, true)
+	c.Assert(elapsed < time.Second, Equals, true, Commentf("closed after %s: %v", elapsed, err))
+	c.Assert(svc.Stats().MaxRequestTimeExceeded, Equals, int64(1))
+
+	svcCfg.MaxRequestTime = -1
+	c.Assert(Registry.UpdateService(svcCfg), Equals, ErrInvalidReqTimeout)
+}
+
+// The unknown host cache holds the most recently missed hosts until they
+// expire or the vhosts change, and counts only the busiest hosts.
+func (s *BasicSuite) TestUnknownHostCache(c *C) {
+	defer func(ttl time.Duration) { unknownHostTTL = ttl }(unknownHostTTL)
+	unknownHostTTL = 100 * time.Millisecond
+
+	u := newUnknownHosts(2, 2)
+	c.Assert(u.cached("a", 1), Equals, false)
+	u.miss("a", 1)
+	u.miss("b", 1)
+	c.Assert(u.cached("a", 1), Equals, true)
+
+	// c evicts b, the least recently used
+	u.miss("c", 1)
+	c.Assert(u.cached("b", 1), Equals, false)
+	c.Assert(u.cached("a", 1), Equals, true)
+	c.Assert(u.cached("c", 1), Equals, true)
+
+	// a change to the vhosts drops an entry
+	c.Assert(u.cached("c", 2), Equals, false)
+	c.Assert(u.stats(0).Cached, Equals, 1)
+
+	// as does expiry
+	time.Sleep(150 * time.Millisecond)
+	c.Assert(u.cached("a", 1), Equals, false)
+	c.Assert(u.stats(0).Cached, Equals, 0)
+
+	// a: 3, b: 1, then c replaced b as the least requested, taking its
+	// count, and the counts stay bounded
+	c.Assert(u.stats(0).Hosts, DeepEquals, []UnknownHost{{"a", 3}, {"c", 3}})
+}
+
+// Accumulate billing records across hour boundaries, a counter reset, and a
+// restart.
+func (s *BasicSuite) TestBilling(c *C) {
+	path := c.MkDir() + "/billing"
+	start := time.Date(2015, 6, 1, 10, 58, 0, 0, time.UTC)
+
+	now := start
+	var in, out int64
+	newAccumulator := func() *billingAccumulator {
+		b, err := newBillingAccumulator(path, 0)
+		c.Assert(err, IsNil)
+		b.now = func() time.Time { return now }
+		b.source = func() []billingSample {
+			return []billingSample{{Service: "web", Key: "web/b1", In: in, Out: out}}
+		}
+		return b
+	}
+
+	b := newAccumulator()
+
+	// 10:58 - 11:01, crossing an hour
+	for i := 0; i < 4; i++ {
+		in += 100
+		out += 1000
+		b.sample()
+		now = now.Add(time.Minute)
+	}
+
+	// the counters were reset
+	in, out = 10, 20
+	b.sample()
+	b.Stop()
+
+	// restart three hours later, leaving a gap
+	now = now.Add(3 * time.Hour)
+	in, out = 5, 50
+	b = newAccumulator()
+	b.sample()
+
+	report, err := b.Report("", start, now.Add(time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(report.Services, DeepEquals, []BillingTotal{
+		{Service: "web", In: 415, Out: 4070, Hours: 3},
+	})
+	c.Assert(report.Gaps, DeepEquals, []BillingGap{
+		{Start: start.Truncate(time.Hour), End: start},
+		{Start: start.Add(4 * time.Minute), End: now},
+	})
+
+	// only the first hour
+	report, err = b.Report("web", start, start.Add(2*time.Minute))
+	c.Assert(err, IsNil)
+	c.Assert(report.Services, DeepEquals, []BillingTotal{
+		{Service: "web", In: 200, Out: 2000, Hours: 1},
+	})
+
+	// an unclean exit, once the checkpoint is written, is recovered from it
+	in, out = 15, 60
+	now = now.Add(time.Minute)
+	b.sample()
+	c.Assert(b.writes.flush(), IsNil)
+	b = newAccumulator()
+
+	report, err = b.Report("web", now.Add(-time.Hour), now)
+	c.Assert(err, IsNil)
+	c.Assert(report.Services, DeepEquals, []BillingTotal{
+		{Service: "web", In: 15, Out: 60, Hours: 1},
+	})
+
+	// compact everything but the last hour
+	b.retention = time.Hour
+	c.Assert(b.compact(), IsNil)
+	records, err := b.readRecords()
+	c.Assert(err, IsNil)
+	for _, r := range records {
+		c.Assert(r.Hour, Equals, now.Truncate(time.Hour))
+	}
+}
+
+// A renamed service's counters continue under the new name, rather than
+// being counted again as new traffic.
+func (s *BasicSuite) TestBillingRename(c *C) {
+	now := time.Date(2015, 6, 1, 10, 30, 0, 0, time.UTC)
+	b, err := newBillingAccumulator(c.MkDir()+"/billing", 0)
+	c.Assert(err, IsNil)
+	b.now = func() time.Time { return now }
+
+	name := "web"
+	var in int64
+	b.source = func() []billingSample {
+		return []billingSample{
+			{Service: name, Key: name + "/b1", In: in},
+			{Service: name, Key: name, In: in},
+		}
+	}
+
+	in = 100
+	b.sample()
+	b.rename("web", "www")
+	name = "www"
+	in = 150
+	now = now.Add(time.Minute)
+	b.sample()
+	b.Stop()
+
+	report, err := b.Report("", now.Add(-time.Hour), now.Add(time.Hour))
+	c.Assert(err, IsNil)
+	c.Assert(report.Services, DeepEquals, []BillingTotal{
+		{Service: "web", In: 200, Hours: 1},
+		{Service: "www", In: 100, Hours: 1},
+	})
+}
+
+// stallWriter blocks every write until it's released, like a disk that has
+// run out of burst credits.
+type stallWriter struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newStallWriter() *stallWriter {
+	return &stallWriter{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	select {
+	case w.started <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+// Queue a write that stalls, and wait until the stream is blocked on it.
+func stallStream(c *C, s *persistStream) *stallWriter {
+	w := newStallWriter()
+	c.Assert(s.enqueue(func() error {
+		_, err := io.WriteString(w, "stalled")
+		return err
+	}), IsNil)
+	select {
+	case <-w.started:
+	case <-time.After(time.Second):
+		c.Fatal("stalled write never started")
+	}
+	return w
+}
+
+// A stalled stream never blocks the writes queued on it. Once the queue is
+// full, a drop stream drops and counts the writes, and an alarm stream
+// refuses them and raises its alarm until it drains. Flushing gives up at
+// the deadline.
+func (s *BasicSuite) TestPersistStream(c *C) {
+	noop := func() error { return nil }
+
+	for _, policy := range []string{PersistDrop, PersistAlarm} {
+		ps := newPersistStream("test-"+policy, policy, 2, 50*time.Millisecond)
+		w := stallStream(c, ps)
+
+		c.Assert(ps.enqueue(noop), IsNil)
+		c.Assert(ps.enqueue(noop), IsNil)
+
+		start := time.Now()
+		err := ps.enqueue(noop)
+		c.Assert(time.Since(start) < 50*time.Millisecond, Equals, true)
+
+		status := ps.status()
+		c.Assert(status.Depth, Equals, 2)
+		c.Assert(status.Capacity, Equals, 2)
+		switch policy {
+		case PersistDrop:
+			c.Assert(err, Equals, ErrPersistDropped)
+			c.Assert(status.Dropped, Equals, int64(1))
+			c.Assert(status.Alarm, Equals, false)
+		case PersistAlarm:
+			c.Assert(err, Equals, ErrPersistRefused)
+			c.Assert(status.Refused, Equals, int64(1))
+			c.Assert(status.Dropped, Equals, int64(0))
+			c.Assert(status.Alarm, Equals, true)
+		}
+
+		start = time.Now()
+		c.Assert(ps.flush(), Equals, ErrPersistDeadline)
+		c.Assert(time.Since(start) < time.Second, Equals, true)
+
+		close(w.release)
+		ps.deadline = time.Second
+		c.Assert(ps.flush(), IsNil)
+
+		status = ps.status()
+		c.Assert(status.Depth, Equals, 0)
+		c.Assert(status.Written, Equals, int64(3))
+		c.Assert(status.Alarm, Equals, false)
+		c.Assert(status.LastFlush, NotNil)
+		c.Assert(status.LastLatency > 0, Equals, true)
+	}
+}
+
+// Sampling carries on while the billing file can't be written, holding the
+// records in memory until the disk recovers, and never dropping any.
+func (s *BasicSuite) TestBillingStall(c *C) {
+	path := c.MkDir() + "/billing"
+	now := time.Date(2015, 6, 1, 10, 0, 0, 0, time.UTC)
+	var in int64
+
+	b, err := newBillingAccumulator(path, 0)
+	c.Assert(err, IsNil)
+	b.now = func() time.Time { return now }
+	b.source = func() []billingSample {
+		return []billingSample{{Service: "web", Key: "web/b1", In: in}}
+	}
+	// the accumulator's stream is reported in the state status
+	c.Assert(stateWriteStatus().Persistence["billing"].Policy, Equals, PersistAlarm)
+	b.writes = newPersistStream("billing-stall", PersistAlarm, 1, time.Second)
+	w := stallStream(c, b.writes)
+
+	// six hours of samples, with nothing written
+	for i := 0; i < 6*60; i += 30 {
+		in += 10
+		start := time.Now()
+		b.sample()
+		c.Assert(time.Since(start) < 100*time.Millisecond, Equals, true)
+		now = now.Add(30 * time.Minute)
+	}
+
+	status := b.writes.status()
+	c.Assert(status.Alarm, Equals, true)
+	c.Assert(status.Refused > 0, Equals, true)
+	records, err := b.readRecords()
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 0)
+
+	// reports include the records still in memory
+	report, err := b.Report("web", now.Add(-24*time.Hour), now)
+	c.Assert(err, IsNil)
+	c.Assert(report.Services, DeepEquals, []BillingTotal{{Service: "web", In: 120, Hours: 6}})
+
+	close(w.release)
+	b.Stop()
+	c.Assert(b.writes.status().Alarm, Equals, false)
+
+	records, err = b.readRecords()
+	c.Assert(err, IsNil)
+	var total int64
+	for _, r := range records {
+		if r.Service == "web" {
+			total += r.In
+		}
+	}
+	c.Assert(total, Equals, int64(120))
+	_, err = os.Stat(b.checkpointPath())
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+// fakeEtcd serves a single key with the etcd v2 keys API.
+type fakeEtcd struct {
+	sync.Mutex
+	index   uint64
+	node    *etcdNode
+	changed chan struct{}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, password, _ := r.BasicAuth(); user != "shuttle" || password != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errorCode":110,"message":"The request requires user authentication"}`))
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	write := func(code int, v interface{}) {
+		w.Header().Set("X-Etcd-Index", strconv.FormatUint(f.index, 10))
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(v)
+	}
+
+	if r.Method == "PUT" {
+		f.index++
+		f.node = &etcdNode{Key: strings.TrimPrefix(r.URL.Path, "/v2/keys"), Value: r.FormValue("value"), ModifiedIndex: f.index}
+		close(f.changed)
+		f.changed = make(chan struct{})
+		write(http.StatusOK, etcdResponse{Action: "set", Node: f.node})
+		return
+	}
+
+	action := "get"
+	if r.FormValue("wait") == "true" {
+		action = "set"
+	}
+	waitIndex, _ := strconv.ParseUint(r.FormValue("waitIndex"), 10, 64)
+	for action == "set" && (f.node == nil || f.node.ModifiedIndex < waitIndex) {
+		changed := f.changed
+		f.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+		}
+		f.Lock()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+
+	if f.node == nil {
+		write(http.StatusNotFound, etcdResponse{ErrorCode: etcdKeyNotFound, Message: "Key not found"})
+		return
+	}
+	write(http.StatusOK, etcdResponse{Action: action, Node: f.node})
+}
+
+// Save, load and watch the state config through the etcd v2 API.
+func (s *BasicSuite) TestEtcdStore(c *C) {
+	srv := httptest.NewServer(&fakeEtcd{changed: make(chan struct{})})
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := newEtcdStore("ftp://"+host, "/shuttle/state", "host1")
+	c.Assert(err, ErrorMatches, "invalid etcd endpoint.*")
+
+	store, err := newEtcdStore("http://shuttle:secret@"+host, "/shuttle/state", "host1")
+	c.Assert(err, IsNil)
+	c.Assert(store.String(), Equals, srv.URL+"/v2/keys/shuttle/state/host1")
+
+	_, err = store.Load()
+	c.Assert(err, ErrorMatches, `etcd: Key not found \(100\)`)
+
+	c.Assert(store.Save([]byte(`{"services":[]}`)), IsNil)
+	cfg, err := store.Load()
+	c.Assert(err, IsNil)
+	c.Assert(string(cfg), Equals, `{"services":[]}`)
+
+	bad, _ := newEtcdStore("http://shuttle:wrong@"+host, "/shuttle/state", "host1")
+	c.Assert(bad.Save([]byte(`{}`)), ErrorMatches, `etcd: The request requires user authentication \(110\)`)
+
+	// only values saved by others are applied
+	applied := make(chan string, 10)
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	defer stopOnce.Do(func() { close(stop) })
+	watching := make(chan error)
+	go func() {
+		watching <- store.Watch(stop, func(cfg []byte) { applied <- string(cfg) })
+	}()
+
+	other, _ := newEtcdStore("http://shuttle:secret@"+host, "/shuttle/state", "host1")
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(store.Save([]byte(`{"services":[{"name":"ours"}]}`)), IsNil)
+	c.Assert(other.Save([]byte(`{"services":[{"name":"theirs"}]}`)), IsNil)
+
+	select {
+	case cfg := <-applied:
+		c.Assert(cfg, Equals, `{"services":[{"name":"theirs"}]}`)
+	case <-time.After(time.Second):
+		c.Fatal("external change wasn't applied")
+	}
+
+	stopOnce.Do(func() { close(stop) })
+	c.Assert(<-watching, IsNil)
+	c.Assert(len(applied), Equals, 0)
+}
+
+// State configs are upgraded one schema version at a time, and configs from a
+// newer shuttle are refused or loaded as well as possible.
+func (s *BasicSuite) TestStateMigration(c *C) {
+	// written before backend networks were saved
+	v0 := []byte(`{"services": [
+		{"name": "udp", "address": "127.0.0.1:9000", "network": "udp", "client_timeout": 2000,
+			"backends": [{"name": "b0", "address": "127.0.0.1:9001"}]},
+		{"name": "tcp", "address": "127.0.0.1:9002",
+			"backends": [{"name": "b0", "address": "127.0.0.1:9003"}, {"name": "b1", "address": "127.0.0.1:9004", "network": "tcp6"}]}
+	]}`)
+
+	migrated, err := migrateState(v0, StateNewerRefuse)
+	c.Assert(err, IsNil)
+
+	var cfg client.Config
+	c.Assert(json.Unmarshal(migrated, &cfg), IsNil)
+	c.Assert(cfg.SchemaVersion, Equals, stateSchema())
+	c.Assert(cfg.Services[0].ClientTimeout, Equals, 2000)
+	c.Assert(cfg.Services[0].Backends[0].Network, Equals, "udp")
+	c.Assert(cfg.Services[1].Backends[0].Network, Equals, "tcp")
+	c.Assert(cfg.Services[1].Backends[1].Network, Equals, "tcp6")
+
+	// a migrated config is left alone, and so is one migrated again
+	again, err := migrateState(migrated, StateNewerRefuse)
+	c.Assert(err, IsNil)
+	c.Assert(string(again), Equals, string(migrated))
+
+	raw, err := decodeState(migrated)
+	c.Assert(err, IsNil)
+	for _, m := range stateMigrations {
+		c.Assert(m.migrate(raw), IsNil)
+	}
+	c.Assert(string(marshal(raw)), Equals, string(migrated))
+
+	// each step runs in order, starting after the config's version
+	defer func(m []stateMigration) { stateMigrations = m }(stateMigrations)
+	step := func(n int) stateMigration {
+		return stateMigration{fmt.Sprintf("step %d", n), func(cfg map[string]interface{}) error {
+			steps, _ := cfg["steps"].(string)
+			cfg["steps"] = steps + strconv.Itoa(n)
+			return nil
+		}}
+	}
+	stateMigrations = []stateMigration{step(1), step(2), step(3)}
+
+	steps := func(data string) string {
+		out, err := migrateState([]byte(data), StateNewerRefuse)
+		c.Assert(err, IsNil)
+		raw, err := decodeState(out)
+		c.Assert(err, IsNil)
+		c.Assert(raw["schema_version"], Equals, json.Number("3"))
+		steps, _ := raw["steps"].(string)
+		return steps
+	}
+	c.Assert(steps(`{}`), Equals, "123")
+	c.Assert(steps(`{"schema_version": 1}`), Equals, "23")
+	c.Assert(steps(`{"schema_version": 3}`), Equals, "")
+
+	stateMigrations = append(stateMigrations, stateMigration{"broken", func(cfg map[string]interface{}) error {
+		return fmt.Errorf("broken")
+	}})
+	_, err = migrateState([]byte(`{"schema_version": 2}`), StateNewerRefuse)
+	c.Assert(err, ErrorMatches, "migrating state config to schema version 4: broken")
+
+	_, err = migrateState([]byte(`{"schema_version": "1"}`), StateNewerRefuse)
+	c.Assert(err, ErrorMatches, "invalid schema_version 1")
+
+	// a newer config is refused, or loaded as it is
+	newer := []byte(`{"schema_version": 9, "pools": [], "services": [{"name": "a", "address": "127.0.0.1:9000", "tier": "gold"}]}`)
+	_, err = migrateState(newer, StateNewerRefuse)
+	c.Assert(err, ErrorMatches, ErrStateNewer.Error()+": version 9, this shuttle knows up to 4")
+
+	out, err := migrateState(newer, StateNewerBestEffort)
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, string(newer))
+
+	raw, err = decodeState(newer)
+	c.Assert(err, IsNil)
+	c.Assert(unknownFields(raw, reflect.TypeOf(client.Config{}), ""), DeepEquals, []string{"pools", "services[0].tier"})
+}
+
+// The migrate-state command writes the upgraded config for checking before a
+// deploy.
+func (s *BasicSuite) TestMigrateStateFile(c *C) {
+	dir, err := ioutil.TempDir("", "shuttle-migrate")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	from := filepath.Join(dir, "old.json")
+	to := filepath.Join(dir, "new.json")
+	c.Assert(ioutil.WriteFile(from, []byte(`{"services": [{"name": "a", "address": "127.0.0.1:9000",
+		"backends": [{"name": "b0", "address": "127.0.0.1:9001"}]}]}`), 0644), IsNil)
+
+	c.Assert(migrateStateCommand([]string{"--from", from}), Equals, 2)
+	c.Assert(migrateStateCommand([]string{"--from", from, "--to", to}), Equals, 0)
+
+	data, err := ioutil.ReadFile(to)
+	c.Assert(err, IsNil)
+	var cfg client.Config
+	c.Assert(json.Unmarshal(data, &cfg), IsNil)
+	c.Assert(cfg.SchemaVersion, Equals, stateSchema())
+	c.Assert(cfg.Services[0].Backends[0].Network, Equals, "tcp")
+
+	// the output is already current
+	c.Assert(migrateStateCommand([]string{"--from", to, "--to", to}), Equals, 0)
+	again, err := ioutil.ReadFile(to)
+	c.Assert(err, IsNil)
+	c.Assert(string(again), Equals, string(data))
+
+	c.Assert(ioutil.WriteFile(from, []byte(`{"schema_version": 99}`), 0644), IsNil)
+	c.Assert(migrateStateCommand([]string{"--from", from, "--to", to}), Equals, 1)
+}
+
+// Unique clients and active flows are estimated without allocating per
+// datagram, and flows expire once they've been idle.
+func (s *BasicSuite) TestUDPClients(c *C) {
+	var clock sync.Mutex
+	now := time.Unix(1700000040, 0)
+	u := newUDPClients(8 * time.Second)
+	u.now = func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return now
+	}
+	u.windowStart = now
+	advance := func(d time.Duration) {
+		clock.Lock()
+		now = now.Add(d)
+		clock.Unlock()
+	}
+	// send from clients first to first+n, some several times
+	send := func(first, n int) {
+		for i := first; i < first+n; i++ {
+			addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 5000 + i%7}
+			for j := 0; j <= i%3; j++ {
+				u.add(addr)
+			}
+		}
+	}
+	within := func(got int64, want int, pct float64) {
+		diff := float64(got) - float64(want)
+		if diff < 0 {
+			diff = -diff
+		}
+		c.Assert(diff <= float64(want)*pct/100, Equals, true, Commentf("estimated %d, want %d", got, want))
+	}
+
+	send(0, 100)
+	unique, _, active := u.counts()
+	within(unique, 100, 10)
+	within(active, 100, 10)
+
+	advance(5 * time.Second)
+	send(100, 20000)
+	unique, _, active = u.counts()
+	within(unique, 20100, 5)
+	within(active, 20100, 5)
+
+	// the first clients have been idle too long, and then the rest
+	advance(4 * time.Second)
+	_, _, active = u.counts()
+	within(active, 20000, 5)
+	advance(5 * time.Second)
+	_, _, active = u.counts()
+	c.Assert(active, Equals, int64(0))
+
+	// unique clients are counted per window
+	advance(time.Minute)
+	unique, last, _ := u.counts()
+	c.Assert(unique, Equals, int64(0))
+	within(last, 20100, 5)
+	advance(2 * time.Minute)
+	_, last, _ = u.counts()
+	c.Assert(last, Equals, int64(0))
+
+	// changing the idle timeout forgets the flows
+	send(0, 10)
+	u.setIdle(time.Second)
+	_, _, active = u.counts()
+	c.Assert(active, Equals, int64(0))
+
+	addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}
+	c.Assert(testing.AllocsPerRun(100, func() { u.add(addr) }), Equals, float64(0))
+}
+
+// Connect a takeover target to a source over a unix socketpair, as if the
+// target had dialled the source's admin socket. The source's result is sent
+// on the returned channel.
+func takeoverPair(c *C, source *takeoverSource, target *takeoverTarget) <-chan error {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		c.Fatal(err)
+	}
+	conn := func(fd int) *net.UnixConn {
+		f := os.NewFile(uintptr(fd), "takeover")
+		defer f.Close()
+		conn, err := net.FileConn(f)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return conn.(*net.UnixConn)
+	}
+
+	target.conn = conn(fds[0])
+	done := make(chan error, 1)
+	go func() {
+		done <- source.serve(conn(fds[1]))
+	}()
+	return done
+}
+
+// Dial addr until stopped, and count the connections that weren't answered
+// by a backend.
+func takeoverLoad(addr string) (stop func() (ok, failed int64)) {
+	var okCount, failCount int64
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		buf := make([]byte, 64)
+		for {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				conn.SetDeadline(time.Now().Add(time.Second))
+				_, err = io.WriteString(conn, "testing\n")
+				if err == nil {
+					_, err = conn.Read(buf)
+				}
+				conn.Close()
+			}
+			if err != nil {
+				atomic.AddInt64(&failCount, 1)
+				continue
+			}
+			atomic.AddInt64(&okCount, 1)
+		}
+	}()
+
+	return func() (int64, int64) {
+		close(quit)
+		<-done
+		return atomic.LoadInt64(&okCount), atomic.LoadInt64(&failCount)
+	}
+}
+
+func resetTakeover() {
+	defaultListenerFactory = netListenerFactory{}
+	takeovers.Lock()
+	takeovers.current = nil
+	takeovers.Unlock()
+}
+
+func (s *BasicSuite) TestTakeover(c *C) {
+	defer resetTakeover()
+	s.AddBackend(c)
+
+	udpCfg := client.ServiceConfig{Name: "udpService", Addr: "127.0.0.1:2001", Network: "udp"}
+	if err := Registry.AddService(udpCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService(udpCfg.Name)
+
+	oldRouter := NewHostRouter(&http.Server{Addr: "127.0.0.1:0"})
+	if err := oldRouter.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
+	defer oldRouter.Stop(context.Background())
+	routerAddr := oldRouter.Addr().String()
+
+	exited := make(chan struct{})
+	source := newTakeoverSource(&Registry, map[string]*HostRouter{"http": oldRouter}, func() { close(exited) })
+
+	reg := &ServiceRegistry{
+		svcs:   make(map[string]*Service),
+		vhosts: make(map[string]*VirtualHost),
+	}
+	target := newTakeoverTarget("", reg)
+	served := takeoverPair(c, source, target)
+
+	stop := takeoverLoad(s.service.Addr)
+	time.Sleep(50 * time.Millisecond)
+
+	// the new instance, with the takeover in place of loading its config
+	newRouter := NewHostRouter(&http.Server{Addr: "127.0.0.1:0"})
+	srv := NewServer(StartupExit)
+	srv.Add("takeover", target)
+	srv.Add("http", newRouter)
+	srv.Add("takeover-finish", target.finisher())
+	if err := srv.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+
+	c.Assert(<-served, IsNil)
+	<-exited
+
+	time.Sleep(50 * time.Millisecond)
+	ok, failed := stop()
+	c.Assert(failed, Equals, int64(0))
+	c.Assert(ok > 0, Equals, true)
+
+	// only the new instance is accepting
+	c.Assert(s.service.isListening(), Equals, false)
+	c.Assert(Registry.GetService(udpCfg.Name).isListening(), Equals, false)
+	c.Assert(reg.GetService(s.service.Name).isListening(), Equals, true)
+	c.Assert(reg.GetService(udpCfg.Name).isListening(), Equals, true)
+	c.Assert(newRouter.Addr().String(), Equals, routerAddr)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	resp, err := http.Get("http://" + routerAddr + "/")
+	c.Assert(err, IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, Equals, http.StatusNotFound)
+
+	sourceStatus := source.state.Status()
+	c.Assert(sourceStatus.State, Equals, TakeoverDone)
+	c.Assert(sourceStatus.Listeners, DeepEquals, map[string]string{
+		"router:http":         HandoffReleased,
+		"service:testService": HandoffReleased,
+		"service:udpService":  HandoffReleased,
+	})
+
+	targetStatus := takeoverStatus()
+	c.Assert(targetStatus.Role, Equals, "target")
+	c.Assert(targetStatus.State, Equals, TakeoverDone)
+	c.Assert(targetStatus.Listeners, DeepEquals, map[string]string{
+		"router:http":         HandoffAdopted,
+		"service:testService": HandoffAdopted,
+		"service:udpService":  HandoffAdopted,
+	})
+}
+
+// A takeover interrupted after a listener was sent leaves it with the source.
+func (s *BasicSuite) TestTakeoverInterrupted(c *C) {
+	defer resetTakeover()
+	s.AddBackend(c)
+
+	source := newTakeoverSource(&Registry, nil, func() { c.Error("source exited") })
+	target := newTakeoverTarget("", &ServiceRegistry{})
+	served := takeoverPair(c, source, target)
+
+	msg, _, err := takeoverCall(target.conn, takeoverMsg{Op: "hello"})
+	c.Assert(err, IsNil)
+	c.Assert(msg.Listeners, HasLen, 1)
+
+	_, f, err := takeoverCall(target.conn, takeoverMsg{Op: "fd", Listener: &msg.Listeners[0]})
+	c.Assert(err, IsNil)
+	c.Assert(f, NotNil)
+	f.Close()
+	c.Assert(source.state.Status().Listeners["service:testService"], Equals, HandoffSent)
+
+	target.conn.Close()
+	c.Assert(<-served, NotNil)
+
+	status := source.state.Status()
+	c.Assert(status.State, Equals, TakeoverFailed)
+	c.Assert(status.Listeners["service:testService"], Equals, HandoffKept)
+	c.Assert(s.service.isListening(), Equals, true)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+}
+
+// A copy of f's descriptor, as a child would inherit it, leaving f
+// non-blocking.
+func inheritFD(c *C, f *os.File) int {
+	defer f.Close()
+	rc, err := f.SyscallConn()
+	if err != nil {
+		c.Fatal(err)
+	}
+	fd := -1
+	rc.Control(func(raw uintptr) {
+		fd, err = syscall.Dup(int(raw))
+	})
+	if err != nil {
+		c.Fatal(err)
+	}
+	return fd
+}
+
+// A re-executed shuttle adopts the listeners it inherits, and tells its parent
+// it's ready only once all of them are in use.
+func (s *BasicSuite) TestReexecAdopt(c *C) {
+	defer resetTakeover()
+	s.AddBackend(c)
+
+	l := TakeoverListener{Kind: "service", Name: s.service.Name, Network: "tcp", Addr: s.service.Addr}
+	adopt := func() (*reexecTarget, *os.File) {
+		f, err := s.service.listenerFile()
+		c.Assert(err, IsNil)
+		ready, readyW, err := os.Pipe()
+		c.Assert(err, IsNil)
+		spec, _ := json.Marshal([]reexecListener{{TakeoverListener: l, FD: inheritFD(c, f)}})
+
+		t, err := adoptListeners(string(spec), inheritFD(c, readyW))
+		c.Assert(err, IsNil)
+		return t, ready
+	}
+
+	// nothing listens on the inherited listener
+	t, ready := adopt()
+	c.Assert(t.finish(), NotNil)
+	c.Assert(awaitReady(ready, time.Second), Equals, ErrReexecNotReady)
+	ready.Close()
+	c.Assert(takeoverStatus().Listeners[l.key()], Equals, HandoffFailed)
+	resetTakeover()
+
+	t, ready = adopt()
+	defer ready.Close()
+	reg := &ServiceRegistry{
+		svcs:   make(map[string]*Service),
+		vhosts: make(map[string]*VirtualHost),
+	}
+	c.Assert(reg.AddService(s.service.Config()), IsNil)
+	defer reg.RemoveService(s.service.Name)
+
+	srv := NewServer(StartupExit)
+	srv.Add("reexec-finish", t.finisher())
+	c.Assert(srv.Start(context.Background()), IsNil)
+	c.Assert(awaitReady(ready, time.Second), IsNil)
+	c.Assert(reg.GetService(s.service.Name).isListening(), Equals, true)
+
+	status := takeoverStatus()
+	c.Assert(status.State, Equals, TakeoverDone)
+	c.Assert(status.Listeners[l.key()], Equals, HandoffAdopted)
+
+	// once the parent stops accepting, the new registry answers
+	newTakeoverSource(&Registry, nil, nil).release(l)
+	c.Assert(s.service.isListening(), Equals, false)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+}
+
+// An interface's addresses are chosen by the family of the destination,
+// skipping those that can't be bound to.
+func (s *BasicSuite) TestResolveInterface(c *C) {
+	list := func(addrs ...string) interfaceLister {
+		return func(name string) ([]net.Addr, error) {
+			var ips []net.Addr
+			for _, a := range addrs {
+				_, n, _ := net.ParseCIDR(a)
+				n.IP, _, _ = net.ParseCIDR(a)
+				ips = append(ips, n)
+			}
+			return ips, nil
+		}
+	}
+
+	a := resolveInterface(list("fe80::1/64", "10.1.2.3/16", "2001:db8::5/64", "10.1.2.4/16"), "wg0")
+	c.Assert(a.err, IsNil)
+	c.Assert(a.v4.String(), Equals, "10.1.2.3")
+	c.Assert(a.v6.String(), Equals, "2001:db8::5")
+
+	for dest, expected := range map[string]string{
+		"10.9.9.9:80":      "10.1.2.3",
+		"[2001:db8::9]:80": "2001:db8::5",
+		"backend:80":       "10.1.2.3",
+	} {
+		ip, err := a.forDest(dest)
+		c.Assert(err, IsNil)
+		c.Assert(ip.String(), Equals, expected)
+	}
+
+	a = resolveInterface(list("10.1.2.3/16"), "wg0")
+	_, err := a.forDest("[2001:db8::9]:80")
+	c.Assert(err, ErrorMatches, ".*no usable address.*")
+
+	a = resolveInterface(list("fe80::1/64"), "wg0")
+	c.Assert(a.err, ErrorMatches, "wg0: .*no usable address")
+
+	// the loopback interface is up on any test host that has one
+	if _, err := net.InterfaceByName("lo"); err == nil {
+		a = resolveInterface(netInterfaceAddrs, "lo")
+		c.Assert(a.err, IsNil)
+		c.Assert(a.v4.String(), Equals, "127.0.0.1")
+	}
+	a = resolveInterface(netInterfaceAddrs, "no-such-iface0")
+	c.Assert(a.err, NotNil)
+}
+
+func (s *BasicSuite) TestCronSchedule(c *C) {
+	at := func(value string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return t
+	}
+
+	for _, tc := range []struct {
+		spec, at string
+		match    bool
+	}{
+		{"* * * * *", "2026-10-15 12:34", true},
+		{"0 22 * * *", "2026-10-15 22:00", true},
+		{"0 22 * * *", "2026-10-15 22:01", false},
+		{"*/15 * * * *", "2026-10-15 10:45", true},
+		{"*/15 * * * *", "2026-10-15 10:46", false},
+		{"5/20 * * * *", "2026-10-15 10:25", true},
+		{"0 9-17 * * 1-5", "2026-10-15 12:00", true},
+		{"0 9-17 * * 1-5", "2026-10-17 12:00", false},
+		{"0 0 * * 7", "2026-10-18 00:00", true},
+		{"0 0 1,15 * *", "2026-10-15 00:00", true},
+		// either day matches when both are restricted
+		{"0 0 1 * 4", "2026-10-15 00:00", true},
+		{"0 0 1 * 5", "2026-10-15 00:00", false},
+		{"30 2 * 3,10 *", "2026-10-15 02:30", true},
+	} {
+		sched, err := parseCron(tc.spec)
+		c.Assert(err, IsNil)
+		c.Assert(sched.matches(at(tc.at)), Equals, tc.match, Commentf("%s at %s", tc.spec, tc.at))
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := parseCron(spec)
+		c.Assert(err, NotNil, Commentf("%q", spec))
+	}
+
+	sched, _ := parseCron("0 22 * * *")
+	since, ok := sched.activeSince(at("2026-10-16 05:59"), 8*time.Hour)
+	c.Assert(ok, Equals, true)
+	c.Assert(since, Equals, at("2026-10-15 22:00"))
+	_, ok = sched.activeSince(at("2026-10-16 06:00"), 8*time.Hour)
+	c.Assert(ok, Equals, false)
+}
+
+// Run an overlay scheduler on the registry with a fake clock.
+func overlayTest(c *C, overlays ...client.OverlayConfig) (*overlayScheduler, func(string)) {
+	if err := Registry.UpdateConfig(client.Config{Overlays: overlays}); err != nil {
+		c.Fatal(err)
+	}
+
+	o := newOverlayScheduler(&Registry)
+	var now time.Time
+	o.now = func() time.Time { return now }
+	evaluateAt := func(value string) {
+		t, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			c.Fatal(err)
+		}
+		now = t
+		o.evaluate()
+	}
+	return o, evaluateAt
+}
+
+func (s *BasicSuite) weight(c *C, backend string) int {
+	cfg, err := Registry.ServiceConfig(s.service.Name)
+	c.Assert(err, IsNil)
+	for _, b := range cfg.Backends {
+		if b.Name == backend {
+			return b.Weight
+		}
+	}
+	c.Fatalf("no backend %s", backend)
+	return 0
+}
+
+func (s *BasicSuite) TestOverlays(c *C) {
+	defer func() { Registry.cfg.Overlays = nil }()
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	on := true
+	o, evaluateAt := overlayTest(c,
+		client.OverlayConfig{
+			Name:     "night",
+			Schedule: "0 22 * * *",
+			Duration: 8 * 3600 * 1000,
+			Priority: 1,
+			Services: []client.ServiceOverlay{
+				{Service: s.service.Name, Weights: map[string]int{"backend_0": 5}},
+			},
+		},
+		client.OverlayConfig{
+			Name:     "batch",
+			Schedule: "0 23 * * *",
+			Duration: 3600 * 1000,
+			Priority: 2,
+			Services: []client.ServiceOverlay{
+				{Service: s.service.Name, Weights: map[string]int{"backend_0": 10}, MaintenanceMode: &on},
+			},
+		},
+	)
+	maintenance := func() bool {
+		cfg, _ := Registry.ServiceConfig(s.service.Name)
+		return cfg.MaintenanceMode
+	}
+
+	evaluateAt("2026-10-15 21:59")
+	c.Assert(s.weight(c, "backend_0"), Equals, 1)
+	c.Assert(o.Status()[1].Active, Equals, false)
+
+	evaluateAt("2026-10-15 22:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 5)
+	c.Assert(s.weight(c, "backend_1"), Equals, 1)
+
+	// the state config keeps the values from before the overlay
+	cfg := Registry.Config()
+	o.baseline(&cfg)
+	c.Assert(cfg.Services[0].Backends[0].Weight, Equals, 1)
+
+	// the higher priority overlay sets the weight while they overlap
+	evaluateAt("2026-10-15 23:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 10)
+	c.Assert(maintenance(), Equals, true)
+
+	status := o.Status()
+	c.Assert(status, HasLen, 2)
+	c.Assert(status[0].Name, Equals, "batch")
+	c.Assert(status[0].Active, Equals, true)
+	c.Assert(status[0].Until.Format("15:04"), Equals, "00:00")
+	c.Assert(status[0].Fields[s.service.Name]["weights/backend_0"], Equals, OverlayField{Overlay: "batch", Value: 10, Baseline: 1})
+	c.Assert(status[0].Fields[s.service.Name]["maintenance_mode"], Equals, OverlayField{Overlay: "batch", Value: 1})
+	c.Assert(status[1].Name, Equals, "night")
+	c.Assert(status[1].Active, Equals, true)
+	c.Assert(status[1].Fields, IsNil)
+
+	evaluateAt("2026-10-16 00:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 5)
+	c.Assert(maintenance(), Equals, false)
+
+	evaluateAt("2026-10-16 06:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 1)
+	for _, st := range o.Status() {
+		c.Assert(st.Active, Equals, false)
+		c.Assert(st.Fields, IsNil)
+	}
+}
+
+func (s *BasicSuite) TestOverlayEdits(c *C) {
+	defer func(policy string) {
+		Registry.cfg.Overlays = nil
+		overlayEdits = policy
+	}(overlayEdits)
+	s.AddBackend(c)
+
+	night := client.OverlayConfig{
+		Name:     "night",
+		Schedule: "0 22 * * *",
+		Duration: 8 * 3600 * 1000,
+		Services: []client.ServiceOverlay{
+			{Service: s.service.Name, Weights: map[string]int{"backend_0": 5}},
+		},
+	}
+
+	// a manual change wins, and is kept when the overlay ends
+	overlayEdits = OverlayEditsWin
+	o, evaluateAt := overlayTest(c, night)
+	evaluateAt("2026-10-15 22:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 5)
+
+	_, err := Registry.SetWeights(s.service.Name, map[string]int{"backend_0": 3})
+	c.Assert(err, IsNil)
+	evaluateAt("2026-10-15 23:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 3)
+	c.Assert(o.Status()[0].Fields[s.service.Name]["weights/backend_0"], Equals,
+		OverlayField{Overlay: "night", Value: 5, Baseline: 3, Released: true})
+
+	evaluateAt("2026-10-16 06:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 3)
+
+	// a manual change is deferred until the overlay ends
+	overlayEdits = OverlayEditsDefer
+	o, evaluateAt = overlayTest(c, night)
+	evaluateAt("2026-10-16 22:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 5)
+
+	_, err = Registry.SetWeights(s.service.Name, map[string]int{"backend_0": 2})
+	c.Assert(err, IsNil)
+	evaluateAt("2026-10-16 22:01")
+	c.Assert(s.weight(c, "backend_0"), Equals, 5)
+	c.Assert(o.Status()[0].Fields[s.service.Name]["weights/backend_0"], Equals,
+		OverlayField{Overlay: "night", Value: 5, Baseline: 2, Deferred: true})
+
+	evaluateAt("2026-10-17 06:00")
+	c.Assert(s.weight(c, "backend_0"), Equals, 2)
+}
+
+func (s *BasicSuite) TestOverlayValidation(c *C) {
+	defer func() { Registry.cfg.Overlays = nil }()
+
+	valid := client.OverlayConfig{
+		Name:     "night",
+		Schedule: "0 22 * * *",
+		Duration: 60000,
+		Services: []client.ServiceOverlay{{Service: "a", Weights: map[string]int{"b": 1}}},
+	}
+	c.Assert(Registry.UpdateConfig(client.Config{Overlays: []client.OverlayConfig{valid}}), IsNil)
+	c.Assert(Registry.Overlays(), HasLen, 1)
+
+	for _, change := range []func(*client.OverlayConfig){
+		func(o *client.OverlayConfig) { o.Name = "" },
+		func(o *client.OverlayConfig) { o.Schedule = "0 25 * * *" },
+		func(o *client.OverlayConfig) { o.Duration = 1000 },
+		func(o *client.OverlayConfig) { o.Duration = 8 * 24 * 3600 * 1000 },
+		func(o *client.OverlayConfig) { o.Services = []client.ServiceOverlay{{Service: "a"}} },
+		func(o *client.OverlayConfig) {
+			o.Services = []client.ServiceOverlay{{Service: "a", Weights: map[string]int{"b": 0}}}
+		},
+	} {
+		ov := valid
+		change(&ov)
+		err := Registry.UpdateConfig(client.Config{Overlays: []client.OverlayConfig{ov}})
+		c.Assert(err, ErrorMatches, "invalid overlay.*")
+	}
+	err := Registry.UpdateConfig(client.Config{Overlays: []client.OverlayConfig{valid, valid}})
+	c.Assert(err, ErrorMatches, "invalid overlay night: duplicate name")
+
+	// an empty list removes them
+	c.Assert(Registry.UpdateConfig(client.Config{Overlays: []client.OverlayConfig{}}), IsNil)
+	c.Assert(Registry.Overlays(), HasLen, 0)
+}
+
+// Registry changes return errors that tell why they failed, rather than
+// logging them and carrying on.
+func (s *BasicSuite) TestMutationErrors(c *C) {
+	// the address is already bound by testService
+	err := Registry.AddService(client.ServiceConfig{Name: "Taken", Addr: s.service.Addr})
+	listenErr, ok := err.(*ListenError)
+	c.Assert(ok, Equals, true)
+	c.Assert(listenErr.Service, Equals, "Taken")
+	c.Assert(errors.Is(err, syscall.EADDRINUSE), Equals, true)
+	c.Assert(Registry.GetService("Taken"), IsNil)
+	c.Assert(errorStatus(err), Equals, http.StatusInternalServerError)
+
+	// an unknown balancing algorithm is rejected everywhere it can be set
+	err = Registry.AddService(client.ServiceConfig{Name: "Bad", Addr: "127.0.0.1:2003", Balance: "RANDOM"})
+	c.Assert(err, ErrorMatches, ErrInvalidBalance.Error()+".*")
+	svcCfg := s.service.Config()
+	svcCfg.Balance = "RANDOM"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidBalance.Error()+".*")
+	c.Assert(s.service.UpdateConfig(svcCfg), ErrorMatches, ErrInvalidBalance.Error()+".*")
+	c.Assert(Registry.UpdateConfig(client.Config{Balance: "RANDOM"}), ErrorMatches, ErrInvalidBalance.Error()+".*")
+	c.Assert(Registry.cfg.Balance, Equals, "")
+
+	// a backend on the wrong network isn't added
+	err = s.service.add(NewBackend(client.BackendConfig{Name: "udp", Addr: "127.0.0.1:2004", Network: "udp"}))
+	c.Assert(err, ErrorMatches, ErrNetworkMismatch.Error()+".*")
+	c.Assert(s.service.get("udp"), IsNil)
+
+	// each service in a config keeps its own error, and none are applied
+	err = Registry.UpdateConfig(client.Config{Services: []client.ServiceConfig{
+		{Name: "Valid", Addr: "127.0.0.1:2007"},
+		{Name: "BadAddr", Addr: "127.0.0.1"},
+		{Name: s.service.Name, Addr: "127.0.0.1:2005", Network: "udp"},
+	}})
+	multi, ok := err.(*multiError)
+	c.Assert(ok, Equals, true)
+	c.Assert(multi.Len(), Equals, 2)
+	c.Assert(errors.Is(multi.errors[0], ErrInvalidAddr), Equals, true)
+	c.Assert(errors.Is(multi.errors[1], ErrInvalidServiceUpdate), Equals, true)
+	c.Assert(errorStatus(multi.errors[0]), Equals, 0)
+	c.Assert(errorStatus(multi.errors[1]), Equals, http.StatusConflict)
+	// they don't agree on a status
+	c.Assert(errorStatus(err), Equals, 0)
+	c.Assert(Registry.GetService("Valid"), IsNil)
+
+	// a service that fails to apply names itself
+	err = Registry.UpdateConfig(client.Config{Services: []client.ServiceConfig{
+		{Name: "Taken", Addr: s.service.Addr},
+	}})
+	svcErr, ok := err.(*ServiceError)
+	c.Assert(ok, Equals, true)
+	c.Assert(svcErr.Service, Equals, "Taken")
+	c.Assert(svcErr.Field, Equals, "address")
+	c.Assert(errors.As(err, &listenErr), Equals, true)
+	c.Assert(errorStatus(err), Equals, http.StatusInternalServerError)
+
+	c.Assert(errorStatus(Registry.RemoveService("Missing")), Equals, http.StatusNotFound)
+	c.Assert(errorStatus(Registry.RemoveBackend(s.service.Name, "missing")), Equals, http.StatusNotFound)
+	c.Assert(errorStatus(Registry.AddService(client.ServiceConfig{Name: s.service.Name, Addr: "127.0.0.1:2006"})), Equals, http.StatusConflict)
+}
+
+// A config that fails part way through is rolled back, leaving the global
+// settings and every service as they were.
+func (s *BasicSuite) TestConfigRollback(c *C) {
+	s.AddBackend(c)
+	defer func() { Registry.cfg.Balance = "" }()
+
+	before := s.service.Config()
+	changed := s.service.Config()
+	changed.ClientTimeout++
+	changed.Backends = append(changed.Backends, client.BackendConfig{Name: "extra", Addr: "127.0.0.1:2009"})
+
+	err := Registry.UpdateConfig(client.Config{
+		Balance: client.LeastConn,
+		Services: []client.ServiceConfig{
+			changed,
+			{Name: "Added", Addr: "127.0.0.1:2007"},
+			{Name: "Taken", Addr: s.service.Addr},
+		},
+	})
+	c.Assert(err, ErrorMatches, "Taken: address: cannot listen.*")
+
+	c.Assert(Registry.cfg.Balance, Equals, "")
+	c.Assert(Registry.GetService("Added"), IsNil)
+	c.Assert(Registry.GetService("Taken"), IsNil)
+	after := s.service.Config()
+	c.Assert(after.ClientTimeout, Equals, before.ClientTimeout)
+	c.Assert(after.Backends, DeepEquals, before.Backends)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	// the address of the service that was added is free again
+	l, err := net.Listen("tcp", "127.0.0.1:2007")
+	c.Assert(err, IsNil)
+	l.Close()
+
+	// a valid config only needs to be checked
+	c.Assert(Registry.ValidateConfig(client.Config{Services: []client.ServiceConfig{changed}}), IsNil)
+	c.Assert(s.service.Config().Backends, HasLen, 1)
+}
+
+// A service moved to another address keeps its backends and stats, and only
+// the new address is accepting afterward.
+func (s *BasicSuite) TestMoveListener(c *C) {
+	s.AddBackend(c)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	oldAddr := s.service.Addr
+	svcCfg := s.service.Config()
+	svcCfg.Addr = "127.0.0.1:2005"
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(Registry.GetService(s.service.Name), Equals, s.service)
+
+	checkResp("127.0.0.1:2005", s.servers[0].addr, c)
+	_, err := net.Dial("tcp", oldAddr)
+	c.Assert(err, NotNil)
+	stats := s.service.Stats()
+	c.Assert(stats.Conns, Equals, int64(2))
+	c.Assert(stats.Backends, HasLen, 1)
+
+	// an address that's taken leaves the service where it was
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer taken.Close()
+	svcCfg.Addr = taken.Addr().String()
+	err = Registry.UpdateService(svcCfg)
+	c.Assert(errors.Is(err, ErrMoveListener), Equals, true)
+	c.Assert(errors.Is(err, syscall.EADDRINUSE), Equals, false)
+	c.Assert(errorStatus(err), Equals, http.StatusConflict)
+	c.Assert(s.service.Config().Addr, Equals, "127.0.0.1:2005")
+	checkResp("127.0.0.1:2005", s.servers[0].addr, c)
+
+	// so does a bad rule in the same update
+	svcCfg.Addr = "127.0.0.1:2006"
+	svcCfg.Redirects = []client.RedirectConfig{{Target: ""}}
+	c.Assert(Registry.UpdateService(svcCfg), NotNil)
+	c.Assert(s.service.Config().Addr, Equals, "127.0.0.1:2005")
+	checkResp("127.0.0.1:2005", s.servers[0].addr, c)
+	_, err = net.Dial("tcp", "127.0.0.1:2006")
+	c.Assert(err, NotNil)
+}
+
+func (s *BasicSuite) TestProxyHeader(c *C) {
+	v2 := string(proxyV2Signature)
+	for _, t := range []struct {
+		version, src, dst string
+		header            string
+	}{
+		{"v1", "10.0.0.1:5555", "10.0.0.2:80", "PROXY TCP4 10.0.0.1 10.0.0.2 5555 80\r\n"},
+		{"v1", "[::ffff:10.0.0.1]:5555", "10.0.0.2:80", "PROXY TCP4 10.0.0.1 10.0.0.2 5555 80\r\n"},
+		{"v1", "[2001:db8::1]:5555", "[2001:db8::2]:443", "PROXY TCP6 2001:db8::1 2001:db8::2 5555 443\r\n"},
+		{"v1", "10.0.0.1:5555", "[2001:db8::2]:443", "PROXY TCP6 ::ffff:10.0.0.1 2001:db8::2 5555 443\r\n"},
+		{"v1", "[fe80::1%eth0]:5555", "[fe80::2%eth0]:80", "PROXY TCP6 fe80::1 fe80::2 5555 80\r\n"},
+		{"v1", "@", "/tmp/shuttle.sock", "PROXY UNKNOWN\r\n"},
+		{"v2", "10.0.0.1:5555", "10.0.0.2:80",
+			v2 + "\x21\x11\x00\x0c" + "\x0a\x00\x00\x01" + "\x0a\x00\x00\x02" + "\x15\xb3\x00\x50"},
+		{"v2", "[2001:db8::1]:5555", "[2001:db8::2]:443",
+			v2 + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\x15\xb3\x01\xbb"},
+		{"v2", "@", "/tmp/shuttle.sock", v2 + "\x21\x00\x00\x00"},
+	} {
+		pc := proxyClient{src: normalizeClientAddr(t.src), dst: normalizeClientAddr(t.dst)}
+		c.Assert(string(proxyHeader(t.version, pc)), Equals, t.header, Commentf("%s %s %s", t.version, t.src, t.dst))
+	}
+}
+
+func (s *BasicSuite) TestSendProxyProtocol(c *C) {
+	backend, err := NewProxyHeaderServer("127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer backend.Stop()
+
+	// only tcp services without mux can send the header
+	for _, cfg := range []client.ServiceConfig{
+		{Name: "Bad", Addr: "127.0.0.1:2007", SendProxyProtocol: "v3"},
+		{Name: "Bad", Addr: "127.0.0.1:2007", Network: "udp", SendProxyProtocol: "v1"},
+		{Name: "Bad", Addr: "127.0.0.1:2007", MuxConns: 2, SendProxyProtocol: "v1"},
+	} {
+		err := Registry.AddService(cfg)
+		c.Assert(errors.Is(err, ErrInvalidProxyProtocol), Equals, true, Commentf("%v", err))
+	}
+
+	svcCfg := s.service.Config()
+	svcCfg.SendProxyProtocol = "v1"
+	svcCfg.Backends = []client.BackendConfig{{Name: "pp", Addr: backend.addr}}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().SendProxyProtocol, Equals, "v1")
+
+	// the header describes the client's connection to the service
+	proxyGet := func(addr string) net.Addr {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: pp\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			c.Fatal(err)
+		}
+		resp.Body.Close()
+		return conn.LocalAddr()
+	}
+
+	local := proxyGet(s.service.Addr).(*net.TCPAddr)
+	c.Assert(string(backend.next(c)), Equals,
+		fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d 2000\r\n", local.Port))
+
+	svcCfg.SendProxyProtocol = "v2"
+	if err := s.service.UpdateConfig(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	local = proxyGet(s.service.Addr).(*net.TCPAddr)
+	c.Assert(string(backend.next(c)), Equals, string(proxyV2Signature)+"\x21\x11\x00\x0c"+
+		"\x7f\x00\x00\x01\x7f\x00\x00\x01"+string([]byte{byte(local.Port >> 8), byte(local.Port)})+"\x07\xd0")
+
+	// IPv6 clients, if the host has IPv6
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		c.Log("no IPv6:", err)
+		return
+	}
+	l.Close()
+
+	v6Cfg := client.ServiceConfig{
+		Name:              "ProxyV6",
+		Addr:              "[::1]:2008",
+		SendProxyProtocol: "v1",
+		Backends:          []client.BackendConfig{{Name: "pp", Addr: backend.addr}},
+	}
+	if err := Registry.AddService(v6Cfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService(v6Cfg.Name)
+
+	local = proxyGet(v6Cfg.Addr).(*net.TCPAddr)
+	c.Assert(string(backend.next(c)), Equals,
+		fmt.Sprintf("PROXY TCP6 ::1 ::1 %d 2008\r\n", local.Port))
+}
+
+func (s *BasicSuite) TestAcceptProxyProtocol(c *C) {
+	backend, err := NewProxyHeaderServer("127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer backend.Stop()
+
+	err = Registry.AddService(client.ServiceConfig{Name: "Bad", Addr: "127.0.0.1:2007", Network: "udp", AcceptProxyProtocol: true})
+	c.Assert(errors.Is(err, ErrInvalidProxyProtocol), Equals, true, Commentf("%v", err))
+
+	// the addresses from the client's header are passed on in ours
+	svcCfg := s.service.Config()
+	svcCfg.AcceptProxyProtocol = true
+	svcCfg.SendProxyProtocol = "v1"
+	svcCfg.Backends = []client.BackendConfig{{Name: "pp", Addr: backend.addr}}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().AcceptProxyProtocol, Equals, true)
+
+	// send a header and a request in one write, and return the response
+	proxyGet := func(header string) (*http.Response, error) {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, header+"GET / HTTP/1.1\r\nHost: pp\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	v2 := string(proxyV2Signature)
+	for _, t := range []struct {
+		header, forwarded string
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 5555 443\r\n", "PROXY TCP4 192.0.2.1 198.51.100.1 5555 443\r\n"},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 5555 443\r\n", "PROXY TCP6 2001:db8::1 2001:db8::2 5555 443\r\n"},
+		{v2 + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\x15\xb3\x01\xbb",
+			"PROXY TCP4 192.0.2.1 198.51.100.1 5555 443\r\n"},
+		// TLVs after the addresses are skipped
+		{v2 + "\x21\x21\x00\x28" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+			"\x15\xb3\x01\xbb" + "\x04\x00\x01\x00",
+			"PROXY TCP6 2001:db8::1 2001:db8::2 5555 443\r\n"},
+	} {
+		comment := Commentf("%q", t.header)
+		resp, err := proxyGet(t.header)
+		c.Assert(err, IsNil, comment)
+		c.Assert(resp.StatusCode, Equals, http.StatusOK, comment)
+		c.Assert(string(backend.next(c)), Equals, t.forwarded, comment)
+	}
+
+	// an UNKNOWN or LOCAL header keeps the connection's own addresses
+	for _, header := range []string{"PROXY UNKNOWN\r\n", v2 + "\x20\x00\x00\x00"} {
+		_, err := proxyGet(header)
+		c.Assert(err, IsNil)
+		c.Assert(string(backend.next(c)), Matches, `PROXY TCP4 127\.0\.0\.1 127\.0\.0\.1 \d+ 2000\r\n`)
+	}
+
+	// connections without a valid header are closed, and counted
+	for _, header := range []string{
+		"",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 5555\r\n",
+		"PROXY TCP4 2001:db8::1 2001:db8::2 5555 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 5555 443\n",
+		"PROXY TCP6 192.0.2.1 198.51.100.1 5555 70000\r\n",
+		v2 + "\x21\x11\x00\x04" + "\xc0\x00\x02\x01",
+		v2 + "\x11\x11\x00\x0c" + "\xc0\x00\x02\x01" + "\xc6\x33\x64\x01" + "\x15\xb3\x01\xbb",
+	} {
+		errs := s.service.Stats().Errors
+		_, err := proxyGet(header)
+		c.Assert(err, NotNil, Commentf("%q", header))
+		c.Assert(s.service.Stats().Errors, Equals, errs+1, Commentf("%q", header))
+	}
+	select {
+	case hdr := <-backend.headers:
+		c.Fatalf("backend connected with %q", hdr)
+	default:
+	}
+
+	// balancing uses the client's address from the header
+	svcCfg.SendProxyProtocol = ""
+	svcCfg.Balance = client.IPHash
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "b0", Addr: s.servers[0].addr},
+		{Name: "b1", Addr: s.servers[1].addr},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	hashed := func(ip string) string {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "PROXY TCP4 %s 127.0.0.1 5555 2000\r\nhello", ip)
+		buf := make([]byte, 64)
+		n, err := conn.Read(buf)
+		if err != nil {
+			c.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	chosen := make(map[string]bool)
+	for i := 1; i <= 16; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		addr := hashed(ip)
+		c.Assert(hashed(ip), Equals, addr)
+		chosen[addr] = true
+	}
+	c.Assert(len(chosen), Equals, 2)
+}
+
+// Wait for cond to hold, failing after a second.
+func waitFor(c *C, what string, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("timed out waiting for %s", what)
+}
+
+// A service's tasks, and those of its connections, are all gone once it's
+// removed.
+func (s *BasicSuite) TestTaskLifecycle(c *C) {
+	connsRunning := func() (n int64) {
+		for _, tc := range taskCounters {
+			n += atomic.LoadInt64(&tc.running)
+		}
+		return n
+	}
+	baseline := connsRunning()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "taskService",
+		Addr:          "127.0.0.1:2009",
+		CheckInterval: 10,
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr, CheckAddr: s.servers[0].addr},
+			{Name: "backend_1", Addr: s.servers[1].addr, CheckAddr: s.servers[1].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+
+	// the accept loop, and a health check per backend
+	c.Assert(tasks.owned(svcCfg.Name), Equals, 3)
+	rep := tasks.report()
+	found := 0
+	for _, g := range rep.Tasks {
+		if g.Owner == svcCfg.Name && g.Name == "tcp_accept" ||
+			strings.HasPrefix(g.Owner, svcCfg.Name+"/") && g.Name == "health_check" {
+			found += g.Count
+		}
+	}
+	c.Assert(found, Equals, 3)
+
+	started := atomic.LoadInt64(&tcpConnTasks.started)
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", svcCfg.Addr)
+		c.Assert(err, IsNil)
+		_, err = io.WriteString(conn, "testing\n")
+		c.Assert(err, IsNil)
+		_, err = conn.Read(make([]byte, 1024))
+		c.Assert(err, IsNil)
+		conn.Close()
+	}
+	c.Assert(atomic.LoadInt64(&tcpConnTasks.started), Equals, started+4)
+
+	c.Assert(Registry.RemoveService(svcCfg.Name), IsNil)
+	waitFor(c, "service tasks to stop", func() bool {
+		return tasks.owned(svcCfg.Name) == 0
+	})
+	waitFor(c, "connection tasks to stop", func() bool {
+		return connsRunning() == baseline
+	})
+}
+
+// A task that panics is recovered and counted, and a task count over its
+// threshold is warned about once.
+func (s *BasicSuite) TestTaskPanic(c *C) {
+	defer tasks.setThresholds(client.DefaultTaskWarnThreshold, nil)
+
+	panicked := tasks.panicked()
+	done := make(chan struct{})
+	goTask("test_panic", "testService", func() {
+		defer close(done)
+		panic("deliberately")
+	})
+	<-done
+	waitFor(c, "the task to finish", func() bool { return runningTasks("test_panic") == 0 })
+	c.Assert(tasks.panicked(), Equals, panicked+1)
+	c.Assert(tasks.report().Panics["test_panic"] > 0, Equals, true)
+
+	sub, err := events.subscribe("", nil)
+	c.Assert(err, IsNil)
+	defer events.unsubscribe(sub)
+
+	tasks.setThresholds(0, map[string]int{"test_block": 2})
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		goTask("test_block", "", func() { <-stop })
+	}
+	close(stop)
+
+	var e client.Event
+	select {
+	case js := <-sub.events:
+		c.Assert(json.Unmarshal(js, &e), IsNil)
+	case <-time.After(time.Second):
+		c.Fatal("no tasks_high event")
+	}
+	c.Assert(e.Type, Equals, client.EventTasksHigh)
+	c.Assert(e.Task, Equals, "test_block")
+	c.Assert(e.Tasks, Equals, 3)
+	c.Assert(e.Threshold, Equals, 2)
+
+	// only once
+	select {
+	case js := <-sub.events:
+		c.Fatalf("unexpected event %s", js)
+	default:
+	}
+	waitFor(c, "the tasks to finish", func() bool { return runningTasks("test_block") == 0 })
+}
+
+// The running long-lived tasks named name.
+func runningTasks(name string) int {
+	n := 0
+	for _, g := range tasks.report().Tasks {
+		if g.Name == name {
+			n += g.Count
+		}
+	}
+	return n
+}
+
+// A service with a certificate terminates TLS for its clients, and a new
+// certificate is used for new connections without closing the listener.
+func (s *BasicSuite) TestServiceTLS(c *C) {
+	dir := c.MkDir()
+	certPEM, keyPEM := testCertPEM(c, "a.test")
+	c.Assert(ioutil.WriteFile(dir+"/a.pem", certPEM, 0600), IsNil)
+	c.Assert(ioutil.WriteFile(dir+"/a.key", keyPEM, 0600), IsNil)
+
+	svcCfg := client.ServiceConfig{
+		Name:    "tlsService",
+		Addr:    "127.0.0.1:2010",
+		TLSCert: dir + "/a.pem",
+		TLSKey:  dir + "/a.key",
+		Backends: []client.BackendConfig{
+			{Name: "backend_0", Addr: s.servers[0].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+	defer Registry.RemoveService(svcCfg.Name)
+	svc := Registry.GetService(svcCfg.Name)
+
+	roots := func(pemData []byte) *tls.Config {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pemData)
+		return &tls.Config{RootCAs: pool, ServerName: "a.test"}
+	}
+	transfer := func(conn net.Conn) {
+		_, err := io.WriteString(conn, "testing\n")
+		c.Assert(err, IsNil)
+		buff := make([]byte, 1024)
+		n, err := conn.Read(buff)
+		c.Assert(err, IsNil)
+		c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+	}
+
+	conn, err := tls.Dial("tcp", svcCfg.Addr, roots(certPEM))
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	transfer(conn)
+	c.Assert(svc.Stats().TLS, Equals, true)
+
+	// a plain TCP client fails the handshake
+	plain, err := net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	_, err = io.WriteString(plain, "testing\n")
+	c.Assert(err, IsNil)
+	_, err = plain.Read(make([]byte, 1024))
+	c.Assert(err, NotNil)
+	plain.Close()
+	waitFor(c, "the handshake error", func() bool {
+		return svc.Stats().TLSHandshakeErrors == 1
+	})
+	c.Assert(svc.Stats().Errors >= 1, Equals, true)
+
+	// an invalid certificate is rejected, and the current one kept
+	badCfg := svc.Config()
+	badCfg.TLSCert = ""
+	badCfg.TLSCertPEM = "not a certificate"
+	err = Registry.UpdateService(badCfg)
+	c.Assert(errors.Is(err, ErrInvalidTLS), Equals, true)
+	c.Assert(svc.Config().TLSCert, Equals, svcCfg.TLSCert)
+
+	// swap in an inline certificate
+	newCertPEM, newKeyPEM := testCertPEM(c, "a.test")
+	updateCfg := svc.Config()
+	updateCfg.TLSCert, updateCfg.TLSKey = "", ""
+	updateCfg.TLSCertPEM, updateCfg.TLSKeyPEM = string(newCertPEM), string(newKeyPEM)
+	c.Assert(Registry.UpdateService(updateCfg), IsNil)
+	c.Assert(svc.Config().TLSCertPEM, Equals, string(newCertPEM))
+
+	// the open connection carries on
+	transfer(conn)
+
+	// and new connections get the new certificate
+	_, err = tls.Dial("tcp", svcCfg.Addr, roots(certPEM))
+	c.Assert(err, NotNil)
+	swapped, err := tls.Dial("tcp", svcCfg.Addr, roots(newCertPEM))
+	c.Assert(err, IsNil)
+	defer swapped.Close()
+	transfer(swapped)
+	c.Assert(svc.Stats().TLSHandshakeErrors, Equals, int64(2))
+
+	// removing the certificate goes back to plain TCP
+	updateCfg.TLSCertPEM, updateCfg.TLSKeyPEM = "", ""
+	c.Assert(Registry.UpdateService(updateCfg), IsNil)
+	plain, err = net.Dial("tcp", svcCfg.Addr)
+	c.Assert(err, IsNil)
+	defer plain.Close()
+	transfer(plain)
+	c.Assert(svc.Stats().TLS, Equals, false)
+}
+
+func (s *BasicSuite) TestServiceTLSValidation(c *C) {
+	certPEM, keyPEM := testCertPEM(c, "a.test")
+
+	for _, cfg := range []client.ServiceConfig{
+		{Name: "tlsUDP", Addr: "127.0.0.1:2010", Network: "udp", TLSCertPEM: string(certPEM), TLSKeyPEM: string(keyPEM)},
+		{Name: "tlsNoKey", Addr: "127.0.0.1:2010", TLSCertPEM: string(certPEM)},
+		{Name: "tlsBoth", Addr: "127.0.0.1:2010", TLSCert: "a.pem", TLSCertPEM: string(certPEM), TLSKeyPEM: string(keyPEM)},
+		{Name: "tlsMissing", Addr: "127.0.0.1:2010", TLSCert: "testdata/missing.pem", TLSKeyPEM: string(keyPEM)},
+		{Name: "tlsMismatch", Addr: "127.0.0.1:2010", TLSCert: "testdata/vhost1.pem", TLSKeyPEM: string(keyPEM)},
+	} {
+		err := Registry.AddService(cfg)
+		c.Assert(errors.Is(err, ErrInvalidTLS), Equals, true, Commentf("%s: %v", cfg.Name, err))
+		c.Assert(Registry.GetService(cfg.Name), IsNil)
+	}
+}
+
+// MemSuite runs services on the in-memory network, so no real sockets are
+// used for listeners, backends, or health checks.
+type MemSuite struct {
+	network *testnet.Network
+	servers []*testServer
+	service *Service
+}
+
+var _ = Suite(&MemSuite{})
+
+func (s *MemSuite) SetUpTest(c *C) {
+	s.network = testnet.New()
+	defaultListenerFactory = s.network
+	defaultDialerFactory = s.network
+
+	for i := 0; i < 4; i++ {
+		server, err := NewMemTestServer(s.network, "127.0.0.1:0", c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		s.servers = append(s.servers, server)
+	}
+
+	svcCfg := client.ServiceConfig{
+		Name:          "testService",
+		Addr:          "127.0.0.1:2000",
+		ClientTimeout: 1000,
+		ServerTimeout: 1000,
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	s.service = Registry.GetService(svcCfg.Name)
+}
+
+func (s *MemSuite) TearDownTest(c *C) {
+	for _, s := range s.servers {
+		s.Stop()
+	}
+	s.servers = nil
+
+	if err := Registry.RemoveService(s.service.Name); err != nil {
+		c.Fatalf("could not remove service '%s': %s", s.service.Name, err)
+	}
+
+	defaultListenerFactory = netListenerFactory{}
+	defaultDialerFactory = netDialerFactory{}
+}
+
+func (s *MemSuite) AddBackend(c *C) {
+	next := len(s.service.Config().Backends)
+	if next >= len(s.servers) {
+		c.Fatal("no more servers")
+	}
+
+	cfg := client.BackendConfig{
+		Name:      fmt.Sprintf("backend_%d", next),
+		Addr:      s.servers[next].addr,
+		CheckAddr: s.servers[next].addr,
+	}
+
+	s.service.add(NewBackend(cfg))
+}
+
+func (s *MemSuite) TestSingleBackend(c *C) {
+	s.AddBackend(c)
+
+	checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+}
+
+func (s *MemSuite) TestRoundRobin(c *C) {
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+	checkMemResp(s.network, s.service.Addr, s.servers[1].addr, c)
+	checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+	checkMemResp(s.network, s.service.Addr, s.servers[1].addr, c)
+}
+
+// Connections are spread across backends in proportion to their weights,
+// and a weight changed through the registry applies to the next connection.
+func (s *MemSuite) TestWeightedDistribution(c *C) {
+	for i, weight := range []int{1, 3} {
+		err := Registry.AddBackend("testService", client.BackendConfig{
+			Name:   fmt.Sprintf("backend_%d", i),
+			Addr:   s.servers[i].addr,
+			Weight: weight,
+		})
+		c.Assert(err, IsNil)
+	}
+
+	// count the backends that answer n connections
+	distribution := func(n int) map[string]int {
+		counts := make(map[string]int)
+		buff := make([]byte, 1024)
+		for i := 0; i < n; i++ {
+			conn, err := s.network.Dial("tcp", s.service.Addr, time.Second)
+			if err != nil {
+				c.Fatal(err)
+			}
+			io.WriteString(conn, "testing\n")
+			n, err := conn.Read(buff)
+			conn.Close()
+			if err != nil {
+				c.Fatal(err)
+			}
+			counts[string(buff[:n])]++
+		}
+		return counts
+	}
+
+	a, b := s.servers[0].addr, s.servers[1].addr
+	c.Assert(distribution(40), DeepEquals, map[string]int{a: 10, b: 30})
+
+	// HTTP requests are ordered the same way
+	first := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		first[s.service.NextAddrs(nil)[0]]++
+	}
+	c.Assert(first, DeepEquals, map[string]int{a: 2, b: 6})
+
+	err := Registry.AddBackend("testService", client.BackendConfig{Name: "backend_0", Addr: a, Weight: 3})
+	c.Assert(err, IsNil)
+	c.Assert(distribution(24), DeepEquals, map[string]int{a: 12, b: 12})
+
+	// a weight of 0 is 1
+	err = Registry.AddBackend("testService", client.BackendConfig{Name: "backend_0", Addr: a})
+	c.Assert(err, IsNil)
+	c.Assert(s.service.get("backend_0").Config().Weight, Equals, 1)
+
+	err = Registry.AddBackend("testService", client.BackendConfig{Name: "backend_0", Addr: a, Weight: -1})
+	c.Assert(err, ErrorMatches, "invalid weight for backend_0: -1")
+
+	svcCfg := s.service.Config()
+	svcCfg.Backends[0].Weight = -2
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, "invalid weight for .*: -2")
+	c.Assert(s.service.get("backend_0").Config().Weight, Equals, 1)
+
+	err = Registry.AddService(client.ServiceConfig{
+		Name:     "negative",
+		Addr:     "127.0.0.1:2001",
+		Backends: []client.BackendConfig{{Name: "n0", Addr: a, Weight: -3}},
+	})
+	c.Assert(err, ErrorMatches, "invalid weight for n0: -3")
+	c.Assert(Registry.GetService("negative"), IsNil)
+}
+
+// Check a backend through the in-memory network, with an injected failure.
+func (s *MemSuite) TestFailedCheck(c *C) {
+	s.service.CheckInterval = 60000
+	s.service.Fall = 1
+	s.service.Rise = 1
+	s.AddBackend(c)
+
+	result, err := Registry.CheckBackend("testService", "backend_0", true)
+	c.Assert(err, IsNil)
+	c.Assert(result.OK, Equals, true)
+
+	s.network.Fail(s.servers[0].addr, testnet.ErrRefused)
+	result, err = Registry.CheckBackend("testService", "backend_0", true)
+	c.Assert(err, IsNil)
+	c.Assert(result.OK, Equals, false)
+	c.Assert(s.service.Stats().Backends[0].Up, Equals, false)
+
+	s.network.Fail(s.servers[0].addr, nil)
+	result, err = Registry.CheckBackend("testService", "backend_0", true)
+	c.Assert(err, IsNil)
+	c.Assert(result.OK, Equals, true)
+	c.Assert(s.service.Stats().Backends[0].Up, Equals, true)
+}
+
+// A failed dial moves on to the next backend.
+func (s *MemSuite) TestDialFailure(c *C) {
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	s.network.Fail(s.servers[0].addr, testnet.ErrRefused)
+	checkMemResp(s.network, s.service.Addr, s.servers[1].addr, c)
+	checkMemResp(s.network, s.service.Addr, s.servers[1].addr, c)
+	c.Assert(s.service.Stats().Backends[0].Errors > 0, Equals, true)
+}
+
+// A backend slower than the DialTimeout is skipped.
+func (s *MemSuite) TestDialLatency(c *C) {
+	s.service.DialTimeout = 10 * time.Millisecond
+	s.AddBackend(c)
+
+	s.network.SetLatency(50 * time.Millisecond)
+	conn, err := s.network.Dial("tcp", s.service.Addr, time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the connection is dropped, since no backend could be reached
+	n, err := conn.Read(make([]byte, 1024))
+	c.Assert(n, Equals, 0)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(s.service.Stats().Backends[0].Errors, Equals, int64(1))
+
+	s.network.SetLatency(0)
+
+	checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+}
+
+// The recent dial and health check latency of a backend follow it as it slows
+// down.
+func (s *MemSuite) TestBackendLatencyStats(c *C) {
+	s.AddBackend(c)
+
+	checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+	stat := s.service.Stats().Backends[0]
+	c.Assert(stat.DialLatency.Samples, Equals, 1)
+	c.Assert(stat.DialLatency.Max < 30, Equals, true)
+	c.Assert(stat.CheckLatency, IsNil)
+
+	s.network.SetLatency(30 * time.Millisecond)
+	defer s.network.SetLatency(0)
+	for i := 0; i < 3; i++ {
+		checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+	}
+	_, err := Registry.CheckBackend("testService", "backend_0", false)
+	c.Assert(err, IsNil)
+
+	stat = s.service.Stats().Backends[0]
+	c.Assert(stat.DialLatency.Samples, Equals, 4)
+	c.Assert(stat.DialLatency.Avg >= 22.5, Equals, true)
+	c.Assert(stat.DialLatency.P95 >= 30, Equals, true)
+	c.Assert(stat.DialLatency.Max >= 30, Equals, true)
+	c.Assert(stat.CheckLatency.Samples, Equals, 1)
+	c.Assert(stat.CheckLatency.Max >= 30, Equals, true)
+
+	// only the most recent samples are kept
+	var w latencyWindow
+	for i := 1; i <= 200; i++ {
+		w.observe(time.Duration(i) * time.Millisecond)
+	}
+	c.Assert(*w.stat(), Equals, LatencyStat{Avg: 136.5, P95: 194, Max: 200, Samples: latencySamples})
+}
+
+// Register, check, proxy, drain, and stop a service without any real sockets.
+func (s *MemSuite) TestLifecycle(c *C) {
+	s.AddBackend(c)
+
+	result, err := Registry.CheckBackend("testService", "backend_0", false)
+	c.Assert(err, IsNil)
+	c.Assert(result.OK, Equals, true)
+
+	conn, err := s.network.Dial("tcp", s.service.Addr, time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	buff := make([]byte, 1024)
+	io.WriteString(conn, "testing\n")
+	n, err := conn.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	// stop accepting, but keep the open connection
+	s.service.CloseListener()
+	_, err = s.network.Dial("tcp", s.service.Addr, time.Second)
+	c.Assert(err, NotNil)
+	c.Assert(s.service.ActiveConns(), Equals, 1)
+
+	io.WriteString(conn, "still here\n")
+	n, err = conn.Read(buff)
+	c.Assert(err, IsNil)
+	c.Assert(string(buff[:n]), Equals, s.servers[0].addr)
+
+	// drain
+	conn.Close()
+	for i := 0; i < 100 && s.service.ActiveConns() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.service.ActiveConns(), Equals, 0)
+	c.Assert(s.service.Stats().Backends[0].Active, Equals, int64(0))
+}
+
+// Health checks come from the check source ports and send the preamble,
+// while proxied connections don't.
+func (s *MemSuite) TestCheckMarkers(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:             "testService",
+		Addr:             s.service.Addr,
+		CheckInterval:    60000,
+		CheckSourcePorts: "40000-40009",
+		CheckPreamble:    "SHUTTLE-CHECK\n",
+		CheckUserAgent:   "shuttle-check",
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	cfg := s.service.Config()
+	c.Assert(cfg.CheckSourcePorts, Equals, "40000-40009")
+	c.Assert(cfg.CheckPreamble, Equals, "SHUTTLE-CHECK\n")
+	c.Assert(cfg.CheckUserAgent, Equals, "shuttle-check")
+
+	// record the source port and first read of every connection
+	type accepted struct {
+		port int
+		data string
+	}
+	conns := make(chan accepted, 10)
+
+	l, err := s.network.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				buff := make([]byte, 1024)
+				n, _ := conn.Read(buff)
+
+				_, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				p, _ := strconv.Atoi(port)
+				conns <- accepted{port: p, data: string(buff[:n])}
+				io.WriteString(conn, "OK")
+			}()
+		}
+	}()
+
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:      "marked",
+		Addr:      l.Addr().String(),
+		CheckAddr: l.Addr().String(),
+	}))
+
+	result, err := Registry.CheckBackend("testService", "marked", false)
+	c.Assert(err, IsNil)
+	c.Assert(result.OK, Equals, true)
+
+	checkMemResp(s.network, s.service.Addr, "OK", c)
+
+	checks, proxied := 0, 0
+	for checks == 0 || proxied == 0 {
+		select {
+		case a := <-conns:
+			if a.data == "testing\n" {
+				proxied++
+				c.Assert(a.port >= 40000 && a.port <= 40009, Equals, false)
+				continue
+			}
+			checks++
+			c.Assert(a.data, Equals, "SHUTTLE-CHECK\n")
+			c.Assert(a.port >= 40000 && a.port <= 40009, Equals, true)
+		case <-time.After(time.Second):
+			c.Fatalf("missing connections, %d checks and %d proxied", checks, proxied)
+		}
+	}
+
+	svcCfg.CheckSourcePorts = "40010-40000"
+	c.Assert(Registry.UpdateService(svcCfg), Equals, ErrInvalidPortRange)
+}
+
+// Connections to backends bound to an interface come from its address, and
+// follow it when it changes. A backend is down while its interface is gone.
+func (s *MemSuite) TestBindInterface(c *C) {
+	var mu sync.Mutex
+	ifaces := map[string][]net.Addr{
+		"wg0": {&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)}},
+	}
+	defer func(w *interfaceWatcher) { interfaces = w }(interfaces)
+	interfaces = newInterfaceWatcher(func(name string) ([]net.Addr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		addrs, ok := ifaces[name]
+		if !ok {
+			return nil, fmt.Errorf("no such interface %s", name)
+		}
+		return addrs, nil
+	})
+	setAddr := func(addrs ...net.Addr) {
+		mu.Lock()
+		if addrs == nil {
+			delete(ifaces, "wg0")
+		} else {
+			ifaces["wg0"] = addrs
+		}
+		mu.Unlock()
+		interfaces.refresh()
+	}
+
+	svcCfg := client.ServiceConfig{
+		Name:          "testService",
+		Addr:          s.service.Addr,
+		CheckInterval: 60000,
+		BindInterface: "wg0",
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().BindInterface, Equals, "wg0")
+
+	// reply with the source address of every connection
+	sources := make(chan string, 10)
+	l, err := s.network.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+				sources <- host
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				conn.Read(make([]byte, 1024))
+				io.WriteString(conn, host)
+			}()
+		}
+	}()
+
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:      "bound",
+		Addr:      l.Addr().String(),
+		CheckAddr: l.Addr().String(),
+	}))
+
+	checkMemResp(s.network, s.service.Addr, "10.0.0.5", c)
+	c.Assert(<-sources, Equals, "10.0.0.5")
+	result, err := Registry.CheckBackend("testService", "bound", false)
+	c.Assert(err, IsNil)
+	c.Assert(result.OK, Equals, true)
+	c.Assert(<-sources, Equals, "10.0.0.5")
+
+	stats := s.service.Stats().Backends[0]
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.Interface.Name, Equals, "wg0")
+	c.Assert(stats.Interface.IPv4, Equals, "10.0.0.5")
+
+	setAddr(&net.IPNet{IP: net.ParseIP("10.0.0.6"), Mask: net.CIDRMask(24, 32)})
+	checkMemResp(s.network, s.service.Addr, "10.0.0.6", c)
+	<-sources
+
+	setAddr()
+	stats = s.service.Stats().Backends[0]
+	c.Assert(stats.Up, Equals, false)
+	c.Assert(stats.State, Equals, StateDown)
+	c.Assert(stats.DownReason, Equals, DownInterfaceUnavailable)
+	c.Assert(stats.Interface.Error, Matches, ".*no such interface wg0")
+	_, err = s.service.Dial("tcp", l.Addr().String())
+	c.Assert(err, ErrorMatches, "interface_unavailable: .*")
+
+	setAddr(&net.IPNet{IP: net.ParseIP("10.0.0.5"), Mask: net.CIDRMask(24, 32)})
+	stats = s.service.Stats().Backends[0]
+	c.Assert(stats.Up, Equals, true)
+	c.Assert(stats.DownReason, Equals, "")
+
+	// a backend's own interface overrides the service's
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:          "other",
+		Addr:          l.Addr().String(),
+		BindInterface: "wg1",
+	}))
+	other := s.service.get("other")
+	c.Assert(other.Up(), Equals, false)
+	c.Assert(other.Stats().DownReason, Equals, DownInterfaceUnavailable)
+	c.Assert(other.Config().BindInterface, Equals, "wg1")
+
+	// an empty interface in an update is merged away, so unbind directly
+	cfg := s.service.Config()
+	cfg.BindInterface = ""
+	if err := s.service.UpdateConfig(cfg); err != nil {
+		c.Fatal(err)
+	}
+	checkMemResp(s.network, s.service.Addr, "127.0.0.1", c)
+	c.Assert(s.service.Stats().Backends[0].Interface, IsNil)
+}
+
+// Connections to a service with no backends are closed, refused or held,
+// according to its NoBackendAction.
+func (s *MemSuite) TestNoBackendActions(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name: "testService",
+		Addr: s.service.Addr,
+	}
+
+	// read from a new connection to the service, returning the error if it
+	// was closed
+	read := func() (string, error) {
+		conn, err := s.network.Dial("tcp", s.service.Addr, time.Second)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		io.WriteString(conn, "testing\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buff := make([]byte, 1024)
+		n, err := conn.Read(buff)
+		return string(buff[:n]), err
+	}
+
+	// the default closes the connection, and only counts it
+	_, err := read()
+	c.Assert(err, Equals, io.EOF)
+	stats := s.service.Stats()
+	c.Assert(stats.Empty, Equals, true)
+	c.Assert(stats.NoBackends, Equals, int64(1))
+
+	svcCfg.NoBackendAction = client.NoBackendRefuse
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	_, err = read()
+	c.Assert(err, ErrorMatches, ".*refused.*")
+
+	s.AddBackend(c)
+	checkMemResp(s.network, s.service.Addr, s.servers[0].addr, c)
+	c.Assert(s.service.Stats().Empty, Equals, false)
+
+	s.service.remove("backend_0", 0)
+	_, err = read()
+	c.Assert(err, ErrorMatches, ".*refused.*")
+
+	// hold two connections, and close a third beyond the queue
+	svcCfg.NoBackendAction = client.NoBackendHold
+	svcCfg.HoldTimeout = 5000
+	svcCfg.HoldQueue = 2
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().HoldQueue, Equals, 2)
+
+	held := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			resp, err := read()
+			if err != nil {
+				resp = err.Error()
+			}
+			held <- resp
+		}()
+	}
+	for s.service.Stats().Holding < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = read()
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(s.service.Stats().HoldDropped, Equals, int64(1))
+
+	// both are passed on once a backend arrives
+	s.AddBackend(c)
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-held:
+			c.Assert(resp, Equals, s.servers[0].addr)
+		case <-time.After(time.Second):
+			c.Fatal("held connection wasn't passed on")
+		}
+	}
+	c.Assert(s.service.Stats().Holding, Equals, 0)
+
+	// and closed if none arrives in time
+	s.service.remove("backend_0", 0)
+	svcCfg.HoldTimeout = 50
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	start := time.Now()
+	_, err = read()
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	stats = s.service.Stats()
+	c.Assert(stats.HoldDropped, Equals, int64(2))
+	// refused connections never reached the service
+	c.Assert(stats.NoBackends, Equals, int64(5))
+
+	svcCfg.HoldQueue = -1
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidNoBackend.Error()+".*")
+}
+
+// Checks of a backend that stays down back off up to the limit, and return
+// to the normal interval as soon as it recovers.
+func (s *MemSuite) TestCheckBackoff(c *C) {
+	now := time.Unix(1000, 0)
+	addr := s.servers[0].addr
+
+	b := NewBackend(client.BackendConfig{Name: "backoff", Addr: addr, CheckAddr: addr})
+	b.now = func() time.Time { return now }
+	b.dialer = s.network
+	b.up = true
+	b.rise = 2
+	b.fall = 1
+	b.checkInterval = 2 * time.Second
+	b.backoffAfter = 10 * time.Second
+	b.backoffMax = 60 * time.Second
+
+	// run the check that's due, and advance the clock to the next one
+	check := func() time.Duration {
+		b.runCheck(true)
+		d := b.scheduleCheck()
+		now = now.Add(d)
+		return d
+	}
+
+	s.network.Fail(addr, testnet.ErrRefused)
+	var schedule []time.Duration
+	for i := 0; i < 12; i++ {
+		schedule = append(schedule, check()/time.Second)
+	}
+	c.Assert(b.Up(), Equals, false)
+	c.Assert(schedule, DeepEquals, []time.Duration{2, 2, 2, 2, 2, 4, 8, 16, 32, 60, 60, 60})
+	c.Assert(b.Checks().EffectiveInterval, Equals, 60000)
+
+	// The backend recovers just after a check, which is the worst case.
+	// The next check resets the backoff, and the rest of the rise count
+	// runs at the normal interval.
+	s.network.Fail(addr, nil)
+	recovered := now.Add(-60 * time.Second)
+	for i := 0; i < 2; i++ {
+		c.Assert(check(), Equals, 2*time.Second)
+	}
+	c.Assert(b.Up(), Equals, true)
+	c.Assert(b.Checks().EffectiveInterval, Equals, 2000)
+
+	// marked up on the last check, before the clock advanced
+	upAfter := now.Add(-2 * time.Second).Sub(recovered)
+	c.Assert(upAfter <= b.backoffMax+time.Duration(b.rise-1)*b.checkInterval, Equals, true)
+
+	// An intervention through the API resets the backoff, which starts
+	// again once the backend has been down for the threshold.
+	s.network.Fail(addr, testnet.ErrRefused)
+	for i := 0; i < 8; i++ {
+		check()
+	}
+	c.Assert(b.Checks().EffectiveInterval > 2000, Equals, true)
+
+	b.ResetBackoff()
+	c.Assert(b.Checks().EffectiveInterval, Equals, 2000)
+	schedule = nil
+	for i := 0; i < 7; i++ {
+		schedule = append(schedule, check()/time.Second)
+	}
+	c.Assert(schedule, DeepEquals, []time.Duration{2, 2, 2, 2, 2, 4, 8})
+}
+
+// Jitter spreads a backend's checks either side of its interval, without
+// changing the interval itself.
+func (s *MemSuite) TestCheckJitter(c *C) {
+	b := NewBackend(client.BackendConfig{Name: "jitter", Addr: s.servers[0].addr})
+	b.checkInterval = time.Second
+	b.checkJitter = 0.2
+
+	min, max := time.Hour, time.Duration(0)
+	for i := 0; i < 100; i++ {
+		d := b.scheduleCheck()
+		if d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+	c.Assert(min >= 800*time.Millisecond, Equals, true, Commentf("%s", min))
+	c.Assert(max <= 1200*time.Millisecond, Equals, true, Commentf("%s", max))
+	c.Assert(min < 900*time.Millisecond, Equals, true, Commentf("%s", min))
+	c.Assert(max > 1100*time.Millisecond, Equals, true, Commentf("%s", max))
+	c.Assert(b.Checks().EffectiveInterval, Equals, 1000)
+
+	b.checkJitter = 0
+	c.Assert(b.scheduleCheck(), Equals, time.Second)
+
+	// services pass their jitter on to their backends
+	c.Assert(s.service.Config().CheckJitter, Equals, client.DefaultCheckJitter)
+	svcCfg := client.ServiceConfig{
+		Name: "testService",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr},
+		},
+	}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	svc := s.service
+	c.Assert(svc.get("b0").checkJitter, Equals, 0.1)
+
+	svcCfg.CheckJitter = -1
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(svc.Config().CheckJitter, Equals, -1)
+	c.Assert(svc.get("b0").checkJitter, Equals, 0.0)
+
+	svcCfg.CheckJitter = 51
+	c.Assert(Registry.UpdateService(svcCfg), Equals, ErrInvalidCheckJitter)
+}
+
+// Checks are spaced to stay within the host and destination budgets, even
+// when every backend is due at once, and each backend is still checked within
+// two intervals.
+func (s *MemSuite) TestCheckBudget(c *C) {
+	start := time.Unix(1000, 0)
+	now := start
+	budget := newCheckBudget(func() time.Time { return now })
+	c.Assert(budget.configure(10, 2, 0), IsNil)
+
+	interval := 5 * time.Second
+	type checked struct {
+		dest string
+		due  time.Time
+		sent []time.Time
+	}
+	var backends []*checked
+	for i := 0; i < 40; i++ {
+		backends = append(backends, &checked{dest: fmt.Sprintf("10.0.0.%d:80", i%5), due: start})
+	}
+
+	// send every check that's due, in order, for a minute
+	var sent []time.Time
+	perDest := make(map[string][]time.Time)
+	for now.Before(start.Add(time.Minute)) {
+		next := backends[0]
+		for _, b := range backends {
+			if b.due.Before(next.due) {
+				next = b
+			}
+		}
+		now = next.due
+
+		at := now.Add(budget.reserve(next.dest, interval))
+		next.sent = append(next.sent, at)
+		next.due = at.Add(interval)
+		sent = append(sent, at)
+		perDest[next.dest] = append(perDest[next.dest], at)
+	}
+
+	// no more than the limit in any second
+	within := func(times []time.Time, limit int) bool {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for i := 0; i+limit < len(times); i++ {
+			if times[i+limit].Sub(times[i]) < time.Second {
+				return false
+			}
+		}
+		return true
+	}
+	c.Assert(within(sent, 10), Equals, true)
+	for dest, times := range perDest {
+		c.Assert(within(times, 2), Equals, true, Commentf("%s", dest))
+	}
+
+	for i, b := range backends {
+		c.Assert(b.sent[0].Sub(start) <= interval, Equals, true, Commentf("backend %d", i))
+		for j := 1; j < len(b.sent); j++ {
+			c.Assert(b.sent[j].Sub(b.sent[j-1]) <= 2*interval, Equals, true, Commentf("backend %d", i))
+		}
+	}
+
+	status := budget.Status()
+	c.Assert(status.Overruns, Equals, int64(0))
+	c.Assert(status.Delayed > 0, Equals, true)
+	c.Assert(status.MaxDelay > 0 && status.MaxDelay <= int64(interval/time.Millisecond), Equals, true)
+	c.Assert(status.Utilization <= 100, Equals, true)
+	c.Assert(status.DestUtilization <= 100, Equals, true)
+	c.Assert(status.Dispatched, Equals, int64(len(sent)))
+
+	// a budget too small for the checks delays each by no more than its
+	// interval, and counts the overruns
+	now = start.Add(time.Hour)
+	overloaded := newCheckBudget(func() time.Time { return now })
+	c.Assert(overloaded.configure(1, 0, 0), IsNil)
+	for i := 0; i < 10; i++ {
+		c.Assert(overloaded.reserve("10.0.0.1:80", 2*time.Second) <= 2*time.Second, Equals, true)
+	}
+	c.Assert(overloaded.Status().Overruns, Equals, int64(7))
+
+	// jitter alone spreads the checks without counting them as delayed
+	jittered := newCheckBudget(func() time.Time { return now })
+	jittered.random = func() float64 { return 0.5 }
+	c.Assert(jittered.configure(0, 0, 0.2), IsNil)
+	c.Assert(jittered.reserve("10.0.0.1:80", 10*time.Second), Equals, time.Second)
+	c.Assert(jittered.Status().Delayed, Equals, int64(0))
+
+	c.Assert(budget.configure(-1, 0, 0), ErrorMatches, ErrInvalidCheckBudget.Error()+".*")
+	c.Assert(budget.configure(0, 0, 2), ErrorMatches, ErrInvalidCheckBudget.Error()+".*")
+
+	// reported by the admin API
+	defer func(b *checkBudget) { checks = b }(checks)
+	checks = budget
+	w := httptest.NewRecorder()
+	getChecks(w, httptest.NewRequest("GET", "/_checks", nil))
+	var reported CheckBudgetStatus
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &reported), IsNil)
+	c.Assert(reported.Dispatched, Equals, status.Dispatched)
+	c.Assert(reported.Rate, Equals, 10.0)
+}
+
+// The state fields change together with the backend's health, readiness and
+// maintenance mode, and are never seen out of step by concurrent readers.
+func (s *MemSuite) TestBackendState(c *C) {
+	now := time.Unix(1000, 0)
+	var clock sync.Mutex
+	addr := s.servers[0].addr
+
+	b := NewBackend(client.BackendConfig{Name: "state", Addr: addr, CheckAddr: addr})
+	b.Lock()
+	b.now = func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		return now
+	}
+	b.dialer = s.network
+	b.up = true
+	b.rise = 1
+	b.fall = 2
+	b.updateState(b.now())
+	b.Unlock()
+
+	advance := func() time.Time {
+		clock.Lock()
+		defer clock.Unlock()
+		now = now.Add(time.Second)
+		return now
+	}
+
+	svc := NewService(client.ServiceConfig{Name: "stateService"})
+	svc.Backends = []*Backend{b}
+
+	consistent := func(stat BackendStat) bool {
+		up := stat.State == StateUp || stat.State == StateMaintenance
+		return stat.Up == up && stat.CheckPassing == (stat.CheckFailingSince == nil)
+	}
+
+	// read the stats concurrently with all the transitions
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	var inconsistent int64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, stat := range svc.Stats().Backends {
+					if !consistent(stat) {
+						atomic.AddInt64(&inconsistent, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	expect := func(state string, up, checkOK bool, changed time.Time) {
+		stat := b.Stats()
+		c.Assert(consistent(stat), Equals, true)
+		c.Assert(stat.State, Equals, state)
+		c.Assert(stat.Up, Equals, up)
+		c.Assert(stat.CheckPassing, Equals, checkOK)
+		c.Assert(stat.StateChangedAt.Equal(changed), Equals, true)
+		c.Assert(stat.StateDuration, Equals, int64(now.Sub(changed)/time.Millisecond))
+		c.Assert(svc.Stats().BackendStates, DeepEquals, map[string]int{state: 1})
+	}
+
+	start := now
+	expect(StateUp, true, true, start)
+
+	// the first failure shows in the checks before the backend is down
+	s.network.Fail(addr, testnet.ErrRefused)
+	failed := advance()
+	b.runCheck(true)
+	expect(StateUp, true, false, start)
+	c.Assert(b.Stats().CheckFailingSince.Equal(failed), Equals, true)
+
+	down := advance()
+	b.runCheck(true)
+	expect(StateDown, false, false, down)
+	c.Assert(b.Stats().CheckFailingSince.Equal(failed), Equals, true)
+
+	// not ready while down stays down, and drains once the checks pass
+	advance()
+	b.SetReady(false, "test", 0)
+	expect(StateDown, false, false, down)
+
+	s.network.Fail(addr, nil)
+	draining := advance()
+	b.runCheck(true)
+	expect(StateDraining, false, true, draining)
+	c.Assert(b.Stats().CheckFailingSince, IsNil)
+
+	up := advance()
+	b.SetReady(true, "test", 0)
+	expect(StateUp, true, true, up)
+
+	maintenance := advance()
+	b.Lock()
+	b.setMaintenance(true)
+	b.Unlock()
+	expect(StateMaintenance, true, true, maintenance)
+
+	// setting the same state again doesn't reset the time
+	advance()
+	b.Lock()
+	b.setMaintenance(true)
+	b.Unlock()
+	expect(StateMaintenance, true, true, maintenance)
+
+	up = advance()
+	b.Lock()
+	b.setMaintenance(false)
+	b.Unlock()
+	expect(StateUp, true, true, up)
+
+	close(done)
+	wg.Wait()
+	c.Assert(atomic.LoadInt64(&inconsistent), Equals, int64(0))
+}
+
+// With RR active and LC shadowed, long connections to one backend make LC
+// choose the other backend half the time.
+func (s *MemSuite) TestShadowBalance(c *C) {
+	s.AddBackend(c)
+	s.AddBackend(c)
+
+	_, err := Registry.BalanceCompare("testService")
+	c.Assert(err, Equals, ErrNoShadowBalance)
+
+	svcCfg := client.ServiceConfig{Name: "testService", ShadowBalance: "XX"}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, `invalid balancing algorithm: "XX"`)
+	svcCfg.ShadowBalance = client.LeastConn
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	long := s.service.get("backend_0")
+	short := s.service.get("backend_1")
+
+	// connections to backend_0 stay open, and those to backend_1 are closed
+	// as soon as they've been answered
+	var open []net.Conn
+	defer func() {
+		for _, conn := range open {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		conn, err := s.network.Dial("tcp", s.service.Addr, time.Second)
+		if err != nil {
+			c.Fatal(err)
+		}
+		if _, err := io.WriteString(conn, "testing\n"); err != nil {
+			c.Fatal(err)
+		}
+		buff := make([]byte, 1024)
+		n, err := conn.Read(buff)
+		if err != nil {
+			c.Fatal(err)
+		}
+
+		if string(buff[:n]) == long.Addr {
+			open = append(open, conn)
+			continue
+		}
+		conn.Close()
+		for j := 0; atomic.LoadInt64(&short.Active) > 0; j++ {
+			if j > 100 {
+				c.Fatal("connection to backend_1 still active")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// LC agrees with RR on the first connection to backend_0, and on every
+	// connection to backend_1
+	cmp, err := Registry.BalanceCompare("testService")
+	c.Assert(err, IsNil)
+	c.Assert(cmp.Active, Equals, client.RoundRobin)
+	c.Assert(cmp.Shadow, Equals, client.LeastConn)
+	c.Assert(cmp.Total, Equals, int64(20))
+	c.Assert(cmp.Diverged, Equals, int64(9))
+	c.Assert(cmp.Divergence, Equals, 45.0)
+	c.Assert(cmp.Backends, DeepEquals, []BalanceCompareBackend{
+		{Name: "backend_0", Actual: 10, Shadow: 1},
+		{Name: "backend_1", Actual: 10, Shadow: 19},
+	})
+
+	// disabling the shadow stops the comparison
+	svcCfg.ShadowBalance = ""
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	_, err = Registry.BalanceCompare("testService")
+	c.Assert(err, Equals, ErrNoShadowBalance)
+}
+
+// A service that defers listening binds once enough backends pass their
+// checks, and withdraws its listener when they fail.
+func (s *MemSuite) TestDeferListen(c *C) {
+	baseline := runtime.NumGoroutine()
+
+	b0, b1 := s.servers[0].addr, s.servers[1].addr
+	s.network.Fail(b0, testnet.ErrRefused)
+	s.network.Fail(b1, testnet.ErrRefused)
+
+	svcCfg := client.ServiceConfig{
+		Name:                    "deferService",
+		Addr:                    "127.0.0.1:2001",
+		CheckInterval:           10,
+		Rise:                    1,
+		Fall:                    1,
+		DeferListenUntilHealthy: true,
+		MinAvailable:            2,
+		WithdrawGrace:           50,
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: b0, CheckAddr: b0},
+			{Name: "b1", Addr: b1, CheckAddr: b1},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService(svcCfg.Name)
+
+	waitState := func(state string) {
+		for i := 0; svc.Stats().ListenState != state; i++ {
+			if i > 200 {
+				c.Fatalf("listener is %s, expected %s", svc.Stats().ListenState, state)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		c.Assert(Registry.ListenStates()[svcCfg.Name], Equals, state)
+	}
+	listening := func() bool {
+		conn, err := s.network.Dial("tcp", svcCfg.Addr, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	waitState(ListenWaiting)
+	c.Assert(listening(), Equals, false)
+
+	// one healthy backend isn't enough
+	s.network.Fail(b0, nil)
+	for i := 0; svc.Available() < 1; i++ {
+		if i > 200 {
+			c.Fatal("b0 never came up")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(svc.Stats().ListenState, Equals, ListenWaiting)
+	c.Assert(listening(), Equals, false)
+
+	s.network.Fail(b1, nil)
+	waitState(ListenListening)
+
+	conn, err := s.network.Dial("tcp", svcCfg.Addr, time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	buff := make([]byte, 1024)
+	io.WriteString(conn, "testing\n")
+	if _, err := conn.Read(buff); err != nil {
+		c.Fatal(err)
+	}
+
+	// withdrawn after the grace period, while the open connection drains
+	s.network.Fail(b1, testnet.ErrRefused)
+	waitState(ListenWithdrawn)
+	c.Assert(listening(), Equals, false)
+	c.Assert(svc.ActiveConns(), Equals, 1)
+
+	io.WriteString(conn, "still here\n")
+	_, err = conn.Read(buff)
+	c.Assert(err, IsNil)
+
+	// and bound again once the backend recovers
+	s.network.Fail(b1, nil)
+	waitState(ListenListening)
+	c.Assert(listening(), Equals, true)
+
+	// a short failure within the grace period keeps the listener
+	s.network.Fail(b1, testnet.ErrRefused)
+	for i := 0; svc.Available() > 1; i++ {
+		if i > 200 {
+			c.Fatal("b1 never went down")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.network.Fail(b1, nil)
+	time.Sleep(60 * time.Millisecond)
+	c.Assert(svc.Stats().ListenState, Equals, ListenListening)
+
+	conn.Close()
+	if err := Registry.RemoveService(svcCfg.Name); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(listening(), Equals, false)
+	checkGoroutines(c, baseline)
+}
+
+// Proxy UDP through the in-memory network.
+func (s *MemSuite) TestUDP(c *C) {
+	server, err := NewMemUDPTestServer(s.network, "127.0.0.1:11111", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:    "udpService",
+		Addr:    "127.0.0.1:11110",
+		Network: "udp",
+		Backends: []client.BackendConfig{
+			{Name: "udp", Addr: server.addr, Network: "udp"},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("udpService")
+
+	conn, err := s.network.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	dst := testnet.Addr{Net: "udp", Address: svcCfg.Addr}
+	for i := 0; i < 10; i++ {
+		conn.WriteTo([]byte("TEST"), dst)
+	}
+
+	for i := 0; i < 100; i++ {
+		server.Lock()
+		count := len(server.packets)
+		server.Unlock()
+		if count == 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Lock()
+	defer server.Unlock()
+	c.Assert(len(server.packets), Equals, 10)
+}
+
+// Datagrams around the buffer size, MaxDatagramSize, and MTU are truncated,
+// dropped, and counted.
+func (s *MemSuite) TestUDPDatagramSizes(c *C) {
+	server, err := NewMemUDPTestServer(s.network, "127.0.0.1:11111", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "udpService",
+		Addr:          "127.0.0.1:11110",
+		Network:       "udp",
+		UDPBufferSize: 100,
+		Backends: []client.BackendConfig{
+			{Name: "udp", Addr: server.addr, Network: "udp"},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("udpService")
+	svc := Registry.GetService("udpService")
+
+	conn, err := s.network.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	dst := testnet.Addr{Net: "udp", Address: svcCfg.Addr}
+	send := func(sizes ...int) {
+		for _, size := range sizes {
+			conn.WriteTo(make([]byte, size), dst)
+		}
+	}
+
+	// wait for the service to read everything sent, and return the sizes
+	// of the packets received by the backend
+	received := func(count int) []int {
+		for i := 0; i < 100; i++ {
+			server.Lock()
+			n := len(server.packets)
+			server.Unlock()
+			if n >= count {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		// allow any extra packets to arrive
+		time.Sleep(10 * time.Millisecond)
+
+		server.Lock()
+		defer server.Unlock()
+		var sizes []int
+		for _, p := range server.packets {
+			sizes = append(sizes, len(p))
+		}
+		server.packets = nil
+		return sizes
+	}
+
+	// only datagrams larger than the buffer are truncated
+	send(99, 100, 101, 200)
+	c.Assert(received(4), DeepEquals, []int{99, 100, 100, 100})
+	stats := svc.Stats()
+	c.Assert(stats.UDPTruncated, Equals, int64(2))
+	c.Assert(stats.Rcvd, Equals, int64(399))
+
+	// with a limit, oversized and truncated datagrams are dropped
+	svcCfg.MaxDatagramSize = 50
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(svc.Config().MaxDatagramSize, Equals, 50)
+
+	send(50, 51, 200)
+	c.Assert(received(1), DeepEquals, []int{50})
+	stats = svc.Stats()
+	c.Assert(stats.UDPOversize, Equals, int64(2))
+	c.Assert(stats.UDPTruncated, Equals, int64(3))
+
+	// writes larger than the path MTU are counted separately from errors
+	s.network.SetMTU(server.addr, 40)
+	send(45, 40)
+	c.Assert(received(1), DeepEquals, []int{40})
+	stats = svc.Stats()
+	c.Assert(stats.UDPMsgTooLong, Equals, int64(1))
+	c.Assert(stats.Errors, Equals, int64(0))
+}
+
+// A slow backend fills its own send queue and drops, without holding up the
+// datagrams for a fast one.
+func (s *MemSuite) TestUDPSlowBackend(c *C) {
+	var servers []*udpTestServer
+	for _, addr := range []string{"127.0.0.1:11111", "127.0.0.1:11112"} {
+		server, err := NewMemUDPTestServer(s.network, addr, c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer server.Stop()
+		servers = append(servers, server)
+	}
+	slow, fast := servers[0], servers[1]
+	s.network.SetWriteDelay(slow.addr, 50*time.Millisecond)
+
+	svcCfg := client.ServiceConfig{
+		Name:         "udpService",
+		Addr:         "127.0.0.1:11110",
+		Network:      "udp",
+		UDPQueueSize: 10,
+		Backends: []client.BackendConfig{
+			{Name: "slow", Addr: slow.addr, Network: "udp"},
+			{Name: "fast", Addr: fast.addr, Network: "udp"},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	svc := Registry.GetService("udpService")
+
+	conn, err := s.network.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	// in bursts the fast backend's queue can hold
+	dst := testnet.Addr{Net: "udp", Address: svcCfg.Addr}
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			conn.WriteTo([]byte("TEST"), dst)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// sending these one at a time to the slow backend would take 2.5s
+	for i := 0; ; i++ {
+		fast.Lock()
+		n := len(fast.packets)
+		fast.Unlock()
+		if n == 50 {
+			break
+		}
+		if i > 50 {
+			c.Fatalf("fast backend only received %d datagrams", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the stall is only added once each write to the slow backend returns
+	stats := svc.Stats().UDP
+	for deadline := time.Now().Add(time.Second); stats.BackendQueues["slow"].Stall < 50; {
+		if time.Now().After(deadline) {
+			c.Fatalf("slow backend only stalled for %dms", stats.BackendQueues["slow"].Stall)
+		}
+		time.Sleep(10 * time.Millisecond)
+		stats = svc.Stats().UDP
+	}
+	c.Assert(stats.QueueSize, Equals, 10)
+	c.Assert(stats.BackendQueues["fast"].Dropped, Equals, int64(0))
+	c.Assert(stats.BackendQueues["slow"].Dropped > 30, Equals, true)
+	c.Assert(stats.QueueDropped, Equals, stats.BackendQueues["slow"].Dropped)
+
+	// a new size replaces the queues, and the totals are kept
+	svcCfg.UDPQueueSize = 20
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	stats = svc.Stats().UDP
+	c.Assert(stats.BackendQueues["slow"].Size, Equals, 20)
+	c.Assert(stats.BackendQueues["slow"].Dropped > 30, Equals, true)
+
+	// shutting down discards what's left for the slow backend
+	q := svc.get("slow").sendQueue()
+	if err := Registry.RemoveService("udpService"); err != nil {
+		c.Fatal(err)
+	}
+	select {
+	case <-q.done:
+	case <-time.After(time.Second):
+		c.Fatal("slow backend's writer didn't stop")
+	}
+}
+
+type UDPSuite struct {
+	servers []*udpTestServer
+	service *Service
+}
+
+var _ = Suite(&UDPSuite{})
+
+func (s *UDPSuite) SetUpTest(c *C) {
+	svcCfg := client.ServiceConfig{
+		Name:    "testService",
+		Addr:    "127.0.0.1:11110",
+		Network: "udp",
+	}
+
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	s.service = Registry.GetService(svcCfg.Name)
+}
+
+func (s *UDPSuite) TearDownTest(c *C) {
+	for _, s := range s.servers {
+		s.Stop()
+	}
 
 	// get rid of the servers refs too!
 	s.servers = nil
@@ -517,6 +5139,7 @@ func (s *UDPSuite) TearDownTest(c *C) {
 	Registry.cfg.ClientTimeout = 0
 	Registry.cfg.ServerTimeout = 0
 	Registry.cfg.DialTimeout = 0
+	Registry.cfg.TimeoutPolicy = ""
 
 	err := Registry.RemoveService(s.service.Name)
 	if err != nil {
@@ -524,6 +5147,62 @@ func (s *UDPSuite) TearDownTest(c *C) {
 	}
 }
 
+// Datagrams larger than the buffer are truncated on real sockets, and the DF
+// bit can be set on linux.
+func (s *UDPSuite) TestTruncateDontFragment(c *C) {
+	server, err := NewUDPTestServer("127.0.0.1:11111", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := s.service.Config()
+	svcCfg.UDPBufferSize = 1000
+	svcCfg.UDPDontFragment = true
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "UDPServer", Addr: server.addr, Network: "udp"},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	stats := s.service.Stats()
+	c.Assert(stats.UDPDontFragment, Equals, runtime.GOOS == "linux")
+
+	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	conn, err := net.ListenUDP("udp", lAddr)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.WriteToUDP(make([]byte, 1000), rAddr)
+	conn.WriteToUDP(make([]byte, 1001), rAddr)
+
+	for i := 0; i < 100; i++ {
+		server.Lock()
+		n := len(server.packets)
+		server.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.Lock()
+	c.Assert(len(server.packets), Equals, 2)
+	c.Assert(len(server.packets[1]), Equals, 1000)
+	server.Unlock()
+	c.Assert(s.service.Stats().UDPTruncated, Equals, int64(1))
+
+	svcCfg.UDPDontFragment = false
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Stats().UDPDontFragment, Equals, false)
+}
+
 // Add a UDP service, make sure it works, and remove it
 func (s *UDPSuite) TestAddRemove(c *C) {
 	bckCfg := client.BackendConfig{
@@ -552,7 +5231,7 @@ func (s *UDPSuite) TestAddRemove(c *C) {
 	stats := s.service.Stats()
 	c.Assert(stats.Rcvd, Equals, int64(n))
 
-	ok := s.service.remove("UDPServer")
+	ok := s.service.remove("UDPServer", 0)
 	c.Assert(ok, Equals, true)
 
 	stats = s.service.Stats()
@@ -560,65 +5239,557 @@ func (s *UDPSuite) TestAddRemove(c *C) {
 
 }
 
-// Make sure UDP Services work, and check our WeightedRoundRobin since we're
-// already testing it.
-func (s *UDPSuite) TestWeightedRoundRobin(c *C) {
-	servers := make([]*udpTestServer, 3)
+// Make sure UDP Services work, and check our WeightedRoundRobin since we're
+// already testing it.
+func (s *UDPSuite) TestWeightedRoundRobin(c *C) {
+	servers := make([]*udpTestServer, 3)
+
+	var err error
+	for i, _ := range servers {
+		servers[i], err = NewUDPTestServer(fmt.Sprintf("127.0.0.1:1111%d", i+1), c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		bckCfg := client.BackendConfig{
+			Name:    fmt.Sprintf("UDPServer%d", i+1),
+			Addr:    servers[i].addr,
+			Weight:  i + 1,
+			Network: "udp",
+		}
+		s.service.add(NewBackend(bckCfg))
+	}
+
+	defer func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+	}()
+
+	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+
+	conn, err := net.ListenUDP("udp", lAddr)
+	if err != nil {
+		c.Fatal(err)
+	}
+
+	for i := 0; i < 12; i++ {
+		msg := fmt.Sprintf("TEST_%d", i)
+		_, err := conn.WriteToUDP([]byte(msg), rAddr)
+		if err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	// The order that packets are delivered to the 3 servers
+	time.Sleep(100 * time.Millisecond)
+	rcvOrder := []int{
+		0, 6, //               servers[0]
+		1, 2, 7, 8, //         servers[1]
+		3, 4, 5, 9, 10, 11, // servers[2]
+	}
+
+	packetNum := 0
+	for _, srv := range servers {
+		srv.Lock()
+		for _, p := range srv.packets {
+			c.Assert(string(p), Equals, fmt.Sprintf("TEST_%d", rcvOrder[packetNum]))
+			packetNum++
+		}
+		srv.Unlock()
+	}
+}
+
+// LC sends datagrams to the backend with the least recent load for its
+// weight, and HASH keeps a client's datagrams on one backend.
+func (s *UDPSuite) TestUDPBalance(c *C) {
+	servers := make([]*udpTestServer, 2)
+	svcCfg := s.service.Config()
+	svcCfg.Balance = client.LeastConn
+	for i := range servers {
+		var err error
+		servers[i], err = NewUDPTestServer(fmt.Sprintf("127.0.0.1:1111%d", i+1), c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer servers[i].Stop()
+		svcCfg.Backends = append(svcCfg.Backends, client.BackendConfig{
+			Name:    fmt.Sprintf("UDPServer%d", i+1),
+			Addr:    servers[i].addr,
+			Weight:  i + 1,
+			Network: "udp",
+		})
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+
+	send := func(n int, total int64) map[string]BackendStat {
+		for i := 0; i < n; i++ {
+			if _, err := conn.WriteToUDP([]byte("TEST"), rAddr); err != nil {
+				c.Fatal(err)
+			}
+		}
+		var stats ServiceStat
+		for i := 0; i < 100; i++ {
+			stats = s.service.Stats()
+			if stats.UDP.DatagramsOut == total {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(stats.UDP.DatagramsOut, Equals, total)
+		backends := make(map[string]BackendStat)
+		for _, b := range stats.Backends {
+			backends[b.Name] = b
+		}
+		return backends
+	}
+
+	backends := send(30, 30)
+	c.Assert(backends["UDPServer1"].Datagrams, Equals, int64(10))
+	c.Assert(backends["UDPServer2"].Datagrams, Equals, int64(20))
+	c.Assert(backends["UDPServer2"].Sent, Equals, int64(20*len("TEST")))
+
+	svcCfg.Balance = client.IPHash
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	backends = send(10, 40)
+	first, second := backends["UDPServer1"].Datagrams, backends["UDPServer2"].Datagrams
+	c.Assert(first == 20 || second == 30, Equals, true, Commentf("datagrams: %d, %d", first, second))
+}
+
+// Several workers read a UDP listener, and the count can be changed while
+// it's running without losing the accounting.
+func (s *UDPSuite) TestUDPWorkers(c *C) {
+	server, err := NewUDPTestServer("127.0.0.1:11111", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := s.service.Config()
+	c.Assert(svcCfg.UDPWorkers, Equals, client.DefaultUDPWorkers)
+	svcCfg.UDPWorkers = 4
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "UDPServer", Addr: server.addr, Network: "udp"},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().UDPWorkers, Equals, 4)
+
+	readers := func() int64 {
+		s.service.Lock()
+		defer s.service.Unlock()
+		return atomic.LoadInt64(&s.service.udpReaders.running)
+	}
+	c.Assert(readers(), Equals, int64(4))
+
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	total := int64(0)
+	send := func() {
+		total += 100
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn, err := net.DialUDP("udp", nil, rAddr)
+				if err != nil {
+					c.Error(err)
+					return
+				}
+				defer conn.Close()
+				for j := 0; j < 25; j++ {
+					conn.Write([]byte("TEST"))
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+		wg.Wait()
+
+		var stats ServiceStat
+		for i := 0; i < 100; i++ {
+			stats = s.service.Stats()
+			if stats.UDP.DatagramsOut == total {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(stats.UDP.DatagramsIn, Equals, total)
+		c.Assert(stats.UDP.DatagramsOut, Equals, total)
+		c.Assert(stats.Rcvd, Equals, total*int64(len("TEST")))
+		c.Assert(stats.Backends[0].Sent, Equals, total*int64(len("TEST")))
+	}
+	send()
+
+	// the extra workers stop once they've read another datagram
+	svcCfg.UDPWorkers = 1
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	for i := 0; i < 10 && readers() > 1; i++ {
+		send()
+	}
+	c.Assert(readers(), Equals, int64(1))
+	send()
+
+	svcCfg.UDPWorkers = -1
+	c.Assert(Registry.UpdateService(svcCfg), Equals, ErrInvalidUDPWorkers)
+}
+
+// UDP services report datagrams, clients and flows instead of connections.
+func (s *UDPSuite) TestUDPStats(c *C) {
+	servers := make([]*udpTestServer, 2)
+	for i := range servers {
+		var err error
+		servers[i], err = NewUDPTestServer(fmt.Sprintf("127.0.0.1:1111%d", i+1), c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer servers[i].Stop()
+		s.service.add(NewBackend(client.BackendConfig{
+			Name:    fmt.Sprintf("UDPServer%d", i+1),
+			Addr:    servers[i].addr,
+			Network: "udp",
+		}))
+	}
+
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer conn.Close()
+		for j := 0; j < 5; j++ {
+			if _, err := conn.WriteToUDP([]byte("TEST"), rAddr); err != nil {
+				c.Fatal(err)
+			}
+		}
+	}
+
+	var stats ServiceStat
+	for i := 0; i < 100; i++ {
+		stats = s.service.Stats()
+		if stats.UDP.DatagramsOut == 10 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(stats.Network, Equals, "udp")
+	c.Assert(stats.Conns, Equals, int64(0))
+	c.Assert(stats.Active, Equals, int64(0))
+	c.Assert(stats.UDP.DatagramsIn, Equals, int64(10))
+	c.Assert(stats.UDP.DatagramsOut, Equals, int64(10))
+	c.Assert(stats.UDP.UniqueClients, Equals, int64(2))
+	c.Assert(stats.UDP.ActiveFlows, Equals, int64(2))
+	c.Assert(stats.UDP.FlowIdleTimeout, Equals, client.DefaultFlowIdleTimeout)
+	c.Assert(stats.UDP.BackendDatagrams, DeepEquals, map[string]int64{"UDPServer1": 5, "UDPServer2": 5})
+
+	// TCP services have no UDP stats
+	tcp := NewService(client.ServiceConfig{Name: "tcp", Addr: "127.0.0.1:0"})
+	c.Assert(tcp.Stats().Network, Equals, "tcp")
+	c.Assert(tcp.Stats().UDP, IsNil)
+}
+
+// Datagrams from denied clients are dropped before a backend is chosen, and
+// logged at a limited rate.
+func (s *UDPSuite) TestUDPClientACL(c *C) {
+	server, err := NewUDPTestServer("127.0.0.1:11111", c)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := s.service.Config()
+	svcCfg.DeniedCIDRs = []string{"127.0.0.0/8"}
+	svcCfg.LogDenied = true
+	svcCfg.Backends = []client.BackendConfig{
+		{Name: "UDPServer", Addr: server.addr, Network: "udp"},
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+
+	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := conn.WriteToUDP([]byte("TEST"), rAddr); err != nil {
+				c.Fatal(err)
+			}
+		}
+	}
+
+	send(3)
+	for i := 0; s.service.Stats().ClientDenied < 3; i++ {
+		if i > 100 {
+			c.Fatal("datagrams weren't denied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := s.service.Stats()
+	c.Assert(stats.UDP.DatagramsIn, Equals, int64(3))
+	c.Assert(stats.UDP.DatagramsOut, Equals, int64(0))
+	c.Assert(stats.UDP.UniqueClients, Equals, int64(0))
+	// only the first was logged
+	s.service.Lock()
+	c.Assert(s.service.deniedUnreported, Equals, int64(2))
+	s.service.Unlock()
+
+	svcCfg.DeniedCIDRs = []string{}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	send(1)
+	for i := 0; s.service.Stats().UDP.DatagramsOut < 1; i++ {
+		if i > 100 {
+			c.Fatal("datagram wasn't sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(s.service.Stats().ClientDenied, Equals, int64(3))
+}
+
+// A udp check takes a backend that stops answering its probes out of
+// rotation, and datagrams go to the other. Once every backend is down,
+// datagrams are dropped, with errors counted at a limited rate.
+func (s *UDPSuite) TestUDPCheckFailover(c *C) {
+	servers := make([]*udpTestServer, 2)
+	responders := make([]net.PacketConn, 2)
+	svcCfg := s.service.Config()
+	svcCfg.CheckInterval = 50
+	svcCfg.Fall = 1
+	svcCfg.Rise = 1
+	for i := range servers {
+		var err error
+		servers[i], err = NewUDPTestServer(fmt.Sprintf("127.0.0.1:1111%d", i+1), c)
+		if err != nil {
+			c.Fatal(err)
+		}
+		defer servers[i].Stop()
+		responders[i] = NewUDPResponder(c)
+		defer responders[i].Close()
+
+		svcCfg.Backends = append(svcCfg.Backends, client.BackendConfig{
+			Name:         fmt.Sprintf("UDPServer%d", i+1),
+			Addr:         servers[i].addr,
+			Network:      "udp",
+			CheckAddr:    responders[i].LocalAddr().String(),
+			CheckType:    client.CheckUDP,
+			CheckPayload: "ping",
+			CheckTimeout: 100,
+		})
+	}
+	if err := Registry.UpdateService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	c.Assert(s.service.Config().Backends[0].CheckPayload, Equals, "ping")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	rAddr, _ := net.ResolveUDPAddr("udp", s.service.Addr)
+
+	received := func(srv *udpTestServer) int {
+		srv.Lock()
+		defer srv.Unlock()
+		return len(srv.packets)
+	}
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := conn.WriteTo([]byte("TEST"), rAddr); err != nil {
+				c.Fatal(err)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	waitDown := func(name string) {
+		backend := s.service.get(name)
+		for i := 0; i < 100 && backend.Up(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(backend.Up(), Equals, false)
+	}
+
+	send(4)
+	c.Assert(received(servers[0]), Equals, 2)
+	c.Assert(received(servers[1]), Equals, 2)
+
+	// the first backend stops answering its checks
+	responders[0].Close()
+	waitDown("UDPServer1")
+	send(4)
+	c.Assert(received(servers[0]), Equals, 2)
+	c.Assert(received(servers[1]), Equals, 6)
+
+	errors := atomic.LoadInt64(&s.service.Errors)
+	responders[1].Close()
+	waitDown("UDPServer2")
+	send(5)
+	c.Assert(received(servers[1]), Equals, 6)
+	stats := s.service.Stats()
+	c.Assert(stats.UDPBackendsDown, Equals, int64(5))
+	c.Assert(stats.Errors-errors, Equals, int64(1))
+}
+
+// Without a payload, a udp check only fails when the address is reported
+// unreachable.
+func (s *UDPSuite) TestUDPCheckUnreachable(c *C) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer silent.Close()
+
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	check := func(addr, payload string) CheckResult {
+		b := NewBackend(client.BackendConfig{
+			Name:         "udp",
+			Addr:         addr,
+			Network:      "udp",
+			CheckAddr:    addr,
+			CheckType:    client.CheckUDP,
+			CheckPayload: payload,
+			CheckTimeout: 100,
+		})
+		return b.runCheck(false)
+	}
+
+	c.Assert(check(silent.LocalAddr().String(), "").OK, Equals, true)
+	c.Assert(check(closedAddr, "").OK, Equals, false)
+
+	// with a payload, silence is a failure
+	result := check(silent.LocalAddr().String(), "ping")
+	c.Assert(result.OK, Equals, false)
+	c.Assert(result.Error, Matches, ".*timeout.*")
+}
+
+// A backend's replies are relayed to the client through the service's
+// address, and counted in both directions.
+func (s *UDPSuite) TestUDPReplies(c *C) {
+	responder := NewUDPResponder(c)
+	defer responder.Close()
+	s.service.add(NewBackend(client.BackendConfig{
+		Name:    "UDPServer1",
+		Addr:    responder.LocalAddr().String(),
+		Network: "udp",
+	}))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	rAddr, _ := net.ResolveUDPAddr("udp", s.service.Addr)
 
-	var err error
-	for i, _ := range servers {
-		servers[i], err = NewUDPTestServer(fmt.Sprintf("127.0.0.1:1111%d", i+1), c)
-		if err != nil {
+	buf := make([]byte, 512)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteTo([]byte("ping!"), rAddr); err != nil {
 			c.Fatal(err)
 		}
-		bckCfg := client.BackendConfig{
-			Name:    fmt.Sprintf("UDPServer%d", i+1),
-			Addr:    servers[i].addr,
-			Weight:  i + 1,
-			Network: "udp",
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			c.Fatal(err)
 		}
-		s.service.add(NewBackend(bckCfg))
+		c.Assert(string(buf[:n]), Equals, "pong")
+		c.Assert(addr.String(), Equals, rAddr.String())
 	}
 
-	defer func() {
-		for _, s := range servers {
-			s.Stop()
-		}
-	}()
+	stats := s.service.Stats()
+	c.Assert(stats.Rcvd, Equals, int64(10))
+	c.Assert(stats.Sent, Equals, int64(8))
+	c.Assert(stats.Backends[0].Sent, Equals, int64(10))
+	c.Assert(stats.Backends[0].Rcvd, Equals, int64(8))
+	c.Assert(stats.UDP.Replies, Equals, int64(2))
+	c.Assert(stats.UDP.Sessions, Equals, 1)
+	c.Assert(stats.UDP.SessionsOpened, Equals, int64(1))
+	c.Assert(stats.UDP.UDPIdleTimeout, Equals, client.DefaultUDPIdleTimeout)
+}
 
-	lAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
-	rAddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:11110")
+// Sessions are closed once idle, and datagrams that would open a session
+// beyond the limit are dropped.
+func (s *UDPSuite) TestUDPSessionLimits(c *C) {
+	responder := NewUDPResponder(c)
+	defer responder.Close()
 
-	conn, err := net.ListenUDP("udp", lAddr)
-	if err != nil {
+	svcCfg := s.service.Config()
+	svcCfg.UDPIdleTimeout = 200
+	svcCfg.UDPMaxSessions = 1
+	svcCfg.Backends = []client.BackendConfig{{
+		Name:    "UDPServer1",
+		Addr:    responder.LocalAddr().String(),
+		Network: "udp",
+	}}
+	if err := Registry.UpdateService(svcCfg); err != nil {
 		c.Fatal(err)
 	}
+	c.Assert(s.service.Config().UDPIdleTimeout, Equals, 200)
+	c.Assert(s.service.Config().UDPMaxSessions, Equals, 1)
 
-	for i := 0; i < 12; i++ {
-		msg := fmt.Sprintf("TEST_%d", i)
-		_, err := conn.WriteToUDP([]byte(msg), rAddr)
+	rAddr, _ := net.ResolveUDPAddr("udp", s.service.Addr)
+	clients := make([]net.PacketConn, 2)
+	for i := range clients {
+		var err error
+		clients[i], err = net.ListenPacket("udp", "127.0.0.1:0")
 		if err != nil {
 			c.Fatal(err)
 		}
+		defer clients[i].Close()
 	}
-
-	// The order that packets are delivered to the 3 servers
-	time.Sleep(100 * time.Millisecond)
-	rcvOrder := []int{
-		0, 6, //               servers[0]
-		1, 2, 7, 8, //         servers[1]
-		3, 4, 5, 9, 10, 11, // servers[2]
+	// report whether the client's datagram was answered
+	ping := func(conn net.PacketConn) bool {
+		if _, err := conn.WriteTo([]byte("ping"), rAddr); err != nil {
+			c.Fatal(err)
+		}
+		buf := make([]byte, 512)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err := conn.ReadFrom(buf)
+		return err == nil
 	}
 
-	packetNum := 0
-	for _, srv := range servers {
-		srv.Lock()
-		for _, p := range srv.packets {
-			c.Assert(string(p), Equals, fmt.Sprintf("TEST_%d", rcvOrder[packetNum]))
-			packetNum++
-		}
-		srv.Unlock()
+	c.Assert(ping(clients[0]), Equals, true)
+	c.Assert(ping(clients[1]), Equals, false)
+	stats := s.service.Stats()
+	c.Assert(stats.UDP.Sessions, Equals, 1)
+	c.Assert(stats.UDP.SessionsFull, Equals, int64(1))
+
+	for i := 0; i < 100 && s.service.Stats().UDP.Sessions > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
 	}
+	stats = s.service.Stats()
+	c.Assert(stats.UDP.Sessions, Equals, 0)
+	c.Assert(stats.UDP.SessionsExpired, Equals, int64(1))
+
+	c.Assert(ping(clients[1]), Equals, true)
+
+	svcCfg.UDPMaxSessions = -1
+	c.Assert(Registry.UpdateService(svcCfg), Equals, ErrInvalidUDPSessions)
 }
 
 // Throw a lot of packets at the proxy then count what went through
@@ -661,3 +5832,633 @@ func (s *UDPSuite) TestSpew(c *C) {
 	c.Logf("Proxied %d packets", stats.Rcvd/10)
 	c.Logf("Received %d packets", server.count)
 }
+
+// Send one request over a mux client connection, and return the response.
+func muxRequest(conn net.Conn, req string) (string, error) {
+	if err := client.WriteMessage(conn, []byte(req)); err != nil {
+		return "", err
+	}
+	resp, err := client.ReadMessage(conn, client.DefaultMuxMaxMessage)
+	return string(resp), err
+}
+
+// Thousands of clients share a handful of mux connections, and every
+// response gets back to the client that sent the request.
+func (s *MemSuite) TestMuxDemux(c *C) {
+	server, err := NewMemMuxTestServer(s.network, "127.0.0.1:12001", nil)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "muxService",
+		Addr:          "127.0.0.1:12000",
+		ClientTimeout: 5000,
+		ServerTimeout: 5000,
+		MuxConns:      4,
+		MuxMaxMessage: 64,
+		Backends: []client.BackendConfig{
+			{Name: "mux", Addr: server.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("muxService")
+	svc := Registry.GetService("muxService")
+
+	const clients, requests = 2000, 5
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := s.network.Dial("tcp", svcCfg.Addr, time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			for j := 0; j < requests; j++ {
+				req := fmt.Sprintf("client-%d-%d", i, j)
+				resp, err := muxRequest(conn, req)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if resp != server.addr+":"+req {
+					errs <- fmt.Errorf("%s got response %q", req, resp)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Fatal(err)
+	}
+
+	c.Assert(atomic.LoadInt64(&server.accepted) <= 4, Equals, true)
+
+	stats := svc.Stats().Backends[0]
+	c.Assert(len(stats.Mux) <= 4, Equals, true)
+	total := int64(0)
+	for _, m := range stats.Mux {
+		c.Assert(m.Streams, Equals, int64(0))
+		c.Assert(m.Queued, Equals, int64(0))
+		total += m.Requests
+	}
+	c.Assert(total, Equals, int64(clients*requests))
+	c.Assert(stats.Conns, Equals, int64(len(stats.Mux)))
+
+	// a request over the size limit closes the client
+	conn, err := s.network.Dial("tcp", svcCfg.Addr, time.Second)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = muxRequest(conn, strings.Repeat("x", 65))
+	c.Assert(err, NotNil)
+	c.Assert(svc.Stats().Errors, Equals, int64(1))
+}
+
+// Requests wait for a free stream once every mux connection is full, and the
+// queue is visible in the stats.
+func (s *MemSuite) TestMuxBackpressure(c *C) {
+	gate := make(chan struct{})
+	server, err := NewMemMuxTestServer(s.network, "127.0.0.1:12001", gate)
+	if err != nil {
+		c.Fatal(err)
+	}
+	defer server.Stop()
+
+	svcCfg := client.ServiceConfig{
+		Name:          "muxService",
+		Addr:          "127.0.0.1:12000",
+		ClientTimeout: 5000,
+		ServerTimeout: 5000,
+		MuxConns:      2,
+		MuxMaxStreams: 4,
+		Backends: []client.BackendConfig{
+			{Name: "mux", Addr: server.addr},
+		},
+	}
+	if err := Registry.AddService(svcCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService("muxService")
+	svc := Registry.GetService("muxService")
+
+	const clients = 40
+	errs := make(chan error, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := s.network.Dial("tcp", svcCfg.Addr, time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+
+			req := fmt.Sprintf("client-%d", i)
+			resp, err := muxRequest(conn, req)
+			if err != nil {
+				errs <- err
+			} else if resp != server.addr+":"+req {
+				errs <- fmt.Errorf("%s got response %q", req, resp)
+			}
+		}(i)
+	}
+
+	// only 2 connections with 4 streams each reach the backend
+	var stats []MuxStat
+	for i := 0; i < 100; i++ {
+		stats = svc.Stats().Backends[0].Mux
+		if len(stats) == 2 && stats[0].Queued+stats[1].Queued == clients-8 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.Assert(len(stats), Equals, 2)
+	for _, m := range stats {
+		c.Assert(m.Streams, Equals, int64(4))
+	}
+	c.Assert(stats[0].Queued+stats[1].Queued, Equals, int64(clients-8))
+	c.Assert(atomic.LoadInt64(&server.inflight), Equals, int64(8))
+
+	time.Sleep(20 * time.Millisecond)
+	close(gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Fatal(err)
+	}
+
+	stats = svc.Stats().Backends[0].Mux
+	total := int64(0)
+	for _, m := range stats {
+		c.Assert(m.Streams, Equals, int64(0))
+		c.Assert(m.Queued, Equals, int64(0))
+		total += m.Requests
+	}
+	c.Assert(total, Equals, int64(clients))
+	c.Assert(stats[0].MaxWait+stats[1].MaxWait > 0, Equals, true)
+}
+
+// Adding and removing thousands of vhosts and backends leaves nothing behind.
+func (s *MemSuite) TestChurn(c *C) {
+	if err := Registry.UpdateService(client.ServiceConfig{
+		Name:          s.service.Name,
+		ShadowBalance: client.LeastConn,
+	}); err != nil {
+		c.Fatal(err)
+	}
+
+	churn := func(n int) {
+		for i := 0; i < n; i++ {
+			name := fmt.Sprintf("preview-%d", i)
+			svcCfg := client.ServiceConfig{
+				Name:          name,
+				Addr:          "127.0.0.1:2100",
+				VirtualHosts:  []string{name + ".example.com", "shared.example.com"},
+				ShadowBalance: client.LeastConn,
+				Backends: []client.BackendConfig{
+					{Name: "b0", Addr: s.servers[0].addr},
+					{Name: "b1", Addr: s.servers[1].addr},
+				},
+			}
+			if err := Registry.AddService(svcCfg); err != nil {
+				c.Fatal(err)
+			}
+
+			// churn the backends and vhosts of the long lived service too
+			if err := Registry.AddBackend(s.service.Name, client.BackendConfig{Name: name, Addr: s.servers[2].addr}); err != nil {
+				c.Fatal(err)
+			}
+			if err := Registry.UpdateService(client.ServiceConfig{
+				Name:         s.service.Name,
+				VirtualHosts: []string{name + ".test", "shared.example.com"},
+			}); err != nil {
+				c.Fatal(err)
+			}
+			if i%100 == 0 {
+				checkMemResp(s.network, s.service.Addr, s.servers[2].addr, c)
+			}
+
+			if err := Registry.RemoveBackend(s.service.Name, name); err != nil {
+				c.Fatal(err)
+			}
+			if err := Registry.RemoveService(name); err != nil {
+				c.Fatal(err)
+			}
+		}
+		if err := Registry.UpdateService(client.ServiceConfig{
+			Name:         s.service.Name,
+			VirtualHosts: []string{},
+		}); err != nil {
+			c.Fatal(err)
+		}
+	}
+
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	// Warm up at the same scale before taking the baseline, since the
+	// runtime keeps the goroutines it allocated for the churn's peak.
+	const cycles = 3000
+	churn(cycles)
+	goroutines := runtime.NumGoroutine()
+	baseline := Registry.ObjectCounts()
+	before := heap()
+
+	churn(cycles)
+
+	// the last connection is untracked once the proxy finishes with it
+	for i := 0; Registry.ObjectCounts().BackendConns > 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	checkGoroutines(c, goroutines)
+
+	c.Assert(Registry.ObjectCounts(), DeepEquals, baseline)
+	c.Assert(baseline.VirtualHosts, Equals, 0)
+	c.Assert(baseline.ShadowEntries, Equals, 0)
+
+	after := heap()
+	if after > before {
+		c.Assert(after-before < 1<<20, Equals, true, Commentf("heap grew from %d to %d bytes", before, after))
+	}
+}
+
+// A service that can't be taken stays with the source, which keeps running,
+// while those taken before it stay with the target.
+func (s *MemSuite) TestTakeoverFailure(c *C) {
+	defer func() {
+		resetTakeover()
+		defaultListenerFactory = s.network
+	}()
+
+	// a real listener, which can be handed over
+	defaultListenerFactory = netListenerFactory{}
+	tcpCfg := client.ServiceConfig{Name: "aService", Addr: "127.0.0.1:2002"}
+	if err := Registry.AddService(tcpCfg); err != nil {
+		c.Fatal(err)
+	}
+	defer Registry.RemoveService(tcpCfg.Name)
+	defaultListenerFactory = s.network
+
+	exited := false
+	source := newTakeoverSource(&Registry, nil, func() { exited = true })
+	reg := &ServiceRegistry{
+		svcs:   make(map[string]*Service),
+		vhosts: make(map[string]*VirtualHost),
+	}
+	target := newTakeoverTarget("", reg)
+	served := takeoverPair(c, source, target)
+
+	srv := NewServer(StartupExit)
+	srv.Add("takeover", target)
+	srv.Add("takeover-finish", target.finisher())
+	if err := srv.Start(context.Background()); err != nil {
+		c.Fatal(err)
+	}
+	defer srv.Stop(context.Background())
+	c.Assert(<-served, NotNil)
+	c.Assert(exited, Equals, false)
+
+	// the in-memory listener has no descriptor to send
+	c.Assert(s.service.isListening(), Equals, true)
+	c.Assert(reg.GetService(s.service.Name), IsNil)
+	conn, err := s.network.Dial("tcp", s.service.Addr, time.Second)
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	c.Assert(Registry.GetService(tcpCfg.Name).isListening(), Equals, false)
+	c.Assert(reg.GetService(tcpCfg.Name).isListening(), Equals, true)
+
+	c.Assert(source.state.Status().Listeners, DeepEquals, map[string]string{
+		"service:aService":    HandoffReleased,
+		"service:testService": HandoffKept,
+	})
+	status := takeoverStatus()
+	c.Assert(status.State, Equals, TakeoverFailed)
+	c.Assert(status.Listeners, DeepEquals, map[string]string{
+		"service:aService":    HandoffAdopted,
+		"service:testService": HandoffFailed,
+	})
+}
+
+// The config hash doesn't depend on the order of services or backends.
+func (s *BasicSuite) TestConfigHash(c *C) {
+	svc := func(name string, backends ...string) client.ServiceConfig {
+		cfg := client.ServiceConfig{Name: name, Addr: "127.0.0.1:9000"}
+		for _, b := range backends {
+			cfg.Backends = append(cfg.Backends, client.BackendConfig{Name: b, Addr: "127.0.0.1:9001"})
+		}
+		return cfg
+	}
+
+	cfg := client.Config{
+		Services: []client.ServiceConfig{svc("a", "b0", "b1"), svc("b", "b2")},
+	}
+	reordered := client.Config{
+		Services: []client.ServiceConfig{svc("b", "b2"), svc("a", "b1", "b0")},
+	}
+	c.Assert(configHash(cfg), Equals, configHash(reordered))
+	c.Assert(reordered.Services[1].Backends[0].Name, Equals, "b1")
+
+	cfg.Services[0].Backends[1].Weight = 2
+	c.Assert(configHash(cfg), Not(Equals), configHash(reordered))
+}
+
+// A unix socket service replaces a stale socket, sets its permissions, and
+// removes the socket when it's removed.
+func (s *BasicSuite) TestUnixService(c *C) {
+	sock := filepath.Join(c.MkDir(), "svc.sock")
+
+	// a socket left behind by a process that didn't clean up
+	stale, err := net.Listen("unix", sock)
+	c.Assert(err, IsNil)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	svcCfg := client.ServiceConfig{
+		Name:       "UnixService",
+		Network:    "unix",
+		Addr:       sock,
+		SocketMode: "0600",
+		Backends: []client.BackendConfig{
+			{Name: "b0", Addr: s.servers[0].addr},
+		},
+	}
+	c.Assert(Registry.AddService(svcCfg), IsNil)
+
+	fi, err := os.Stat(sock)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode()&os.ModeSocket, Not(Equals), os.FileMode(0))
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	conn, err := net.Dial("unix", sock)
+	c.Assert(err, IsNil)
+	checkConnResp(conn, s.servers[0].addr, c)
+
+	stats, err := Registry.ServiceStats("UnixService")
+	c.Assert(err, IsNil)
+	c.Assert(stats.Addr, Equals, sock)
+	c.Assert(stats.Network, Equals, "unix")
+	c.Assert(Registry.GetService("UnixService").Config().Addr, Equals, sock)
+
+	// the mode is changed on the bound socket
+	svcCfg.SocketMode = "0660"
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	fi, err = os.Stat(sock)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0660))
+
+	svcCfg.SocketMode = "0999"
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, ErrInvalidSocketMode.Error()+".*")
+
+	c.Assert(Registry.RemoveService("UnixService"), IsNil)
+	_, err = os.Stat(sock)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	// only unix services have a socket mode
+	tcpCfg := client.ServiceConfig{Name: "TCPMode", Addr: "127.0.0.1:9002", SocketMode: "0600"}
+	c.Assert(Registry.AddService(tcpCfg), ErrorMatches, ErrInvalidSocketMode.Error()+".*")
+}
+
+// A tcp service proxies to a unix socket backend, which is health checked
+// on its socket path.
+func (s *BasicSuite) TestUnixBackend(c *C) {
+	defer func(b bool) { bridgeUnix = b }(bridgeUnix)
+	bridgeUnix = true
+
+	sock := filepath.Join(c.MkDir(), "backend.sock")
+	srv, err := NewUnixTestServer(sock, c)
+	c.Assert(err, IsNil)
+	defer srv.Stop()
+
+	cfg := client.BackendConfig{
+		Name:      "unix_backend",
+		Network:   "unix",
+		Addr:      sock,
+		CheckAddr: sock,
+	}
+	c.Assert(Registry.AddBackend(s.service.Name, cfg), IsNil)
+
+	checkResp(s.service.Addr, sock, c)
+	b := s.service.get("unix_backend")
+	c.Assert(atomic.LoadInt64(&b.Sent) > 0, Equals, true)
+	c.Assert(atomic.LoadInt64(&b.Rcvd) > 0, Equals, true)
+
+	stats, err := Registry.ServiceStats(s.service.Name)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Backends[0].Addr, Equals, sock)
+
+	c.Assert(b.runCheck(false).OK, Equals, true)
+	srv.Stop()
+	result := b.runCheck(false)
+	c.Assert(result.OK, Equals, false)
+}
+
+// Connections over the service's rate are closed at once, and the limit is
+// changed without replacing the listener.
+func (s *BasicSuite) TestRateLimitTCP(c *C) {
+	s.AddBackend(c)
+	listener := s.service.tcpListener
+
+	svcCfg := s.service.Config()
+	svcCfg.MaxConnsPerSecond = 1
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(s.service.tcpListener, Equals, listener)
+
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "testing\n")
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, NotNil)
+	c.Assert(s.service.Stats().RateLimited, Equals, int64(1))
+
+	svcCfg.MaxConnsPerSecond = 0
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+}
+
+// Denied clients are disconnected before a backend is dialed, and the lists
+// are replaced without replacing the listener.
+func (s *BasicSuite) TestClientACLTCP(c *C) {
+	s.AddBackend(c)
+	listener := s.service.tcpListener
+
+	svcCfg := s.service.Config()
+	svcCfg.AllowedCIDRs = []string{"10.0.0.0/8"}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	c.Assert(s.service.tcpListener, Equals, listener)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "testing\n")
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, NotNil)
+	c.Assert(s.service.Stats().ClientDenied, Equals, int64(1))
+	c.Assert(s.service.get("backend_0").Stats().Conns, Equals, int64(0))
+
+	svcCfg.AllowedCIDRs = []string{"10.0.0.0/8", "127.0.0.0/8"}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+
+	svcCfg.DeniedCIDRs = []string{"::1", "bogus"}
+	c.Assert(Registry.UpdateService(svcCfg), ErrorMatches, `invalid client network: "bogus"`)
+	checkResp(s.service.Addr, s.servers[0].addr, c)
+}
+
+// The listener counts the bytes exchanged with clients apart from those the
+// backends count, along with every connection it accepts.
+func (s *BasicSuite) TestClientBytes(c *C) {
+	s.AddBackend(c)
+	payload := "testing\n"
+	reply := s.servers[0].addr
+
+	checkResp(s.service.Addr, reply, c)
+
+	var stats ServiceStat
+	for i := 0; ; i++ {
+		stats = s.service.Stats()
+		if stats.ClientBytesOut == int64(len(reply)) && stats.Rcvd == int64(len(reply)) {
+			break
+		}
+		if i > 100 {
+			c.Fatalf("client bytes out %d, received %d", stats.ClientBytesOut, stats.Rcvd)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(stats.ClientBytesIn, Equals, int64(len(payload)))
+	c.Assert(stats.Sent, Equals, int64(len(payload)))
+	c.Assert(stats.Accepted, Equals, int64(1))
+	c.Assert(stats.AcceptErrors, Equals, int64(0))
+
+	// a refused client is accepted, but nothing it sends is read
+	svcCfg := s.service.Config()
+	svcCfg.DeniedCIDRs = []string{"127.0.0.0/8"}
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, payload)
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, NotNil)
+
+	stats = s.service.Stats()
+	c.Assert(stats.Accepted, Equals, int64(2))
+	c.Assert(stats.ClientBytesIn, Equals, int64(len(payload)))
+	c.Assert(stats.Sent, Equals, int64(len(payload)))
+	c.Assert(stats.ClientBytesOut, Equals, int64(len(reply)))
+}
+
+func (s *BasicSuite) TestBackendMaxConnsTCP(c *C) {
+	backendCfg := client.BackendConfig{Name: "limited", Addr: s.servers[0].addr, MaxConns: 1}
+	c.Assert(Registry.AddBackend(s.service.Name, backendCfg), IsNil)
+	b := s.service.get("limited")
+
+	hold := func() net.Conn {
+		conn, err := net.Dial("tcp", s.service.Addr)
+		c.Assert(err, IsNil)
+		io.WriteString(conn, "testing\n")
+		_, err = conn.Read(make([]byte, 1024))
+		c.Assert(err, IsNil)
+		return conn
+	}
+	released := func() {
+		for i := 0; atomic.LoadInt64(&b.inUse) > 0; i++ {
+			if i > 100 {
+				c.Fatal("connection wasn't released")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// a second connection is closed while the first is open
+	first := hold()
+	conn, err := net.Dial("tcp", s.service.Addr)
+	c.Assert(err, IsNil)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	io.WriteString(conn, "testing\n")
+	_, err = conn.Read(make([]byte, 1024))
+	c.Assert(err, NotNil)
+	conn.Close()
+	c.Assert(b.Stats().LimitRejected, Equals, int64(1))
+	first.Close()
+	released()
+
+	// or queued until the first closes
+	svcCfg := s.service.Config()
+	svcCfg.BackendFullAction = client.BackendFullQueue
+	svcCfg.QueueTimeout = 2000
+	c.Assert(Registry.UpdateService(svcCfg), IsNil)
+
+	first = hold()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		checkResp(s.service.Addr, s.servers[0].addr, c)
+	}()
+	for i := 0; atomic.LoadInt64(&b.LimitQueued) == 0; i++ {
+		if i > 100 {
+			c.Fatal("connection wasn't queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	first.Close()
+	<-done
+	c.Assert(b.Stats().LimitQueued, Equals, int64(1))
+}
+
+// Clients are tracked in an LRU, and a forgotten client starts again with a
+// full bucket.
+func (s *BasicSuite) TestRateLimitClients(c *C) {
+	l := newRateLimiter(2)
+	l.set(0, 1)
+
+	ip := func(s string) net.IP { return net.ParseIP(s) }
+	c.Assert(l.allow(ip("10.0.0.1")), Equals, true)
+	c.Assert(l.allow(ip("10.0.0.1")), Equals, false)
+	c.Assert(l.allow(ip("10.0.0.2")), Equals, true)
+	c.Assert(l.allow(ip("10.0.0.3")), Equals, true)
+	c.Assert(l.tracked(), Equals, 2)
+
+	// 10.0.0.1 was the least recently seen
+	c.Assert(l.allow(ip("10.0.0.1")), Equals, true)
+	c.Assert(l.allow(ip("10.0.0.3")), Equals, false)
+
+	// clients without an IP are only limited by the service's rate
+	c.Assert(l.allow(nil), Equals, true)
+	c.Assert(l.allow(nil), Equals, true)
+
+	// a client over its own limit doesn't use the service's tokens
+	l.set(1, 1)
+	c.Assert(l.allow(ip("10.0.0.3")), Equals, false)
+	c.Assert(l.allow(ip("10.0.0.4")), Equals, true)
+	c.Assert(l.allow(ip("10.0.0.5")), Equals, false)
+
+	l.set(1, 0)
+	c.Assert(l.tracked(), Equals, 0)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidSlowStart = fmt.Errorf("invalid slow start")
+
+// The fraction of its weight a backend is balanced by when it comes back up,
+// before ramping up to all of it over its slow start.
+const slowStartFloor = 0.1
+
+func validSlowStart(cfg client.BackendConfig) error {
+	if cfg.SlowStart < 0 {
+		return fmt.Errorf("%w for %s: %d", ErrInvalidSlowStart, cfg.Name, cfg.SlowStart)
+	}
+	return nil
+}
+
+func validSlowStarts(cfg client.ServiceConfig) error {
+	for _, b := range cfg.Backends {
+		if err := validSlowStart(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start warming the backend up as it comes back up after being down. A
+// backend that's up from the start isn't warmed up, nor is one that comes up
+// for the first time.
+// Backend *must* be locked.
+func (b *Backend) rampUp(from string, at time.Time) {
+	if b.wasUp && from == StateDown && b.slowStart > 0 {
+		b.rampStart = at
+		b.rampCredit = 0
+	}
+	b.wasUp = true
+}
+
+// The fraction of its weight the backend is balanced by. It's 1 unless the
+// backend is warming up, when it rises linearly from slowStartFloor.
+func (b *Backend) slowStartFactor() float64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.slowStartFactorLocked()
+}
+
+// Backend *must* be locked.
+func (b *Backend) slowStartFactorLocked() float64 {
+	if b.rampStart.IsZero() {
+		return 1
+	}
+	elapsed := b.now().Sub(b.rampStart)
+	if elapsed >= b.slowStart || elapsed < 0 {
+		b.rampStart = time.Time{}
+		return 1
+	}
+	return slowStartFloor + (1-slowStartFloor)*float64(elapsed)/float64(b.slowStart)
+}
+
+// The number of n turns a warming backend takes, at factor. The fractions of
+// turns left over are carried to the next call, so over many calls the
+// backend takes its share even when n is 1.
+func (b *Backend) slowStartTurns(n int, factor float64) int {
+	b.Lock()
+	defer b.Unlock()
+
+	b.rampCredit += float64(n) * factor
+	turns := math.Floor(b.rampCredit)
+	b.rampCredit -= turns
+	return int(turns)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/litl/shuttle/client"
+)
+
+var (
+	ErrInvalidUnknownSNI = fmt.Errorf("invalid unknown_sni")
+	ErrUnknownSNI        = fmt.Errorf("no certificate for server name")
+)
+
+// Load the certificates of a service's virtual hosts, by canonical name. Each
+// must be for one of the service's virtual hosts, which have already been
+// canonicalized.
+func loadVHostCerts(cfg client.ServiceConfig) (map[string]*tls.Certificate, error) {
+	if len(cfg.VirtualHostCerts) == 0 {
+		return nil, nil
+	}
+
+	hosts := make(map[string]bool, len(cfg.VirtualHosts))
+	for _, host := range cfg.VirtualHosts {
+		hosts[host] = true
+	}
+
+	certs := make(map[string]*tls.Certificate, len(cfg.VirtualHostCerts))
+	for name, vc := range cfg.VirtualHostCerts {
+		host, err := canonicalVHost(name)
+		if err != nil {
+			return nil, err
+		}
+		if !hosts[host] {
+			return nil, fmt.Errorf("%w: %s isn't a virtual host of %s", ErrInvalidTLS, name, cfg.Name)
+		}
+		if _, ok := certs[host]; ok {
+			return nil, fmt.Errorf("%w: more than one certificate for %s", ErrInvalidTLS, host)
+		}
+		cert, err := loadCertPair(vc.Cert, vc.Key, vc.CertPEM, vc.KeyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		certs[host] = cert
+	}
+	return certs, nil
+}
+
+// The certificate for one of the service's virtual hosts, or nil if it has
+// none.
+func (s *Service) vhostCert(host string) *tls.Certificate {
+	s.Lock()
+	defer s.Unlock()
+	return s.vhostCerts[host]
+}
+
+// The certificate of the first service registered for the vhost that has
+// one.
+func (v *VirtualHost) certificate() *tls.Certificate {
+	v.Lock()
+	defer v.Unlock()
+	for _, svc := range v.services {
+		if cert := svc.vhostCert(v.Name); cert != nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+// Return the certificate configured for a virtual host, or nil if there
+// isn't one.
+func (s *ServiceRegistry) VHostCertificate(name string) *tls.Certificate {
+	name = requestVHost(name)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if vhost := s.lookupVHost(name); vhost != nil {
+		return vhost.certificate()
+	}
+	return nil
+}
+
+// What the HTTPS router does for unknown server names.
+func (s *ServiceRegistry) UnknownSNI() string {
+	s.Lock()
+	defer s.Unlock()
+	if s.cfg.UnknownSNI == "" {
+		return client.UnknownSNIDefault
+	}
+	return s.cfg.UnknownSNI
+}
+
+func validUnknownSNI(policy string) error {
+	switch policy {
+	case "", client.UnknownSNIDefault, client.UnknownSNIReject:
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidUnknownSNI, policy)
+}
+
+// Choose the certificate for a TLS client by the name it asked for. A virtual
+// host's own certificate comes first, then those loaded from CertDir. The
+// tls package only asks when the client sent a name, and presents the first
+// certificate when we return none.
+func (r *HostRouter) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := Registry.VHostCertificate(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if Registry.UnknownSNI() != client.UnknownSNIReject {
+		return nil, nil
+	}
+
+	r.Lock()
+	certs := r.server.TLSConfig.Certificates
+	r.Unlock()
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownSNI, hello.ServerName)
+}
+
+// The parsed leaf of a certificate, or nil if it can't be parsed.
+func certLeaf(c *tls.Certificate) *x509.Certificate {
+	if c.Leaf != nil {
+		return c.Leaf
+	}
+	if len(c.Certificate) == 0 {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+var ErrWatchUnsupported = fmt.Errorf("state store can't be watched")
+
+// A StateStore persists the state config.
+type StateStore interface {
+	// Load returns the saved config.
+	Load() ([]byte, error)
+	// Save replaces the saved config.
+	Save(cfg []byte) error
+	// Watch calls apply with each config saved by anyone other than this
+	// store, until stop is closed or the store fails.
+	Watch(stop <-chan struct{}, apply func([]byte)) error
+	// String describes where the config is saved, without any credentials.
+	String() string
+}
+
+// fileStore saves the state config to a local file, in the format of its
+// extension. The config is loaded and saved as JSON whatever the format.
+type fileStore string
+
+func (f fileStore) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return configToJSON(f.format(), data)
+}
+
+// Save replaces the state file without ever leaving it partly written, and
+// keeps the config it replaced as the backup.
+func (f fileStore) Save(cfg []byte) error {
+	data, err := configFromJSON(f.format(), cfg)
+	if err != nil {
+		return err
+	}
+	f.keepBackup()
+	return writeFileAtomic(string(f), data, 0644)
+}
+
+// The format of the file, which for a backup is the format of the file it
+// backs up.
+func (f fileStore) format() string {
+	return configFormat(strings.TrimSuffix(string(f), ".bak"))
+}
+
+// The backup of a state file, holding the config before the last save.
+func (f fileStore) backup() fileStore {
+	return f + ".bak"
+}
+
+// Copy the state file to its backup before it's replaced. A file that can't
+// be parsed doesn't replace the backup, which may be all that's left of the
+// config.
+func (f fileStore) keepBackup() {
+	current, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return
+	}
+	if _, err := configToJSON(f.format(), current); err != nil {
+		return
+	}
+	if err := writeFileAtomic(string(f.backup()), current, 0644); err != nil {
+		log.Warnf("WARN: saving state backup %s: %s", f.backup(), err)
+	}
+}
+
+// Write a file by way of a temp file in the same directory, synced and then
+// renamed over the path, so a crash leaves either the old file or the new
+// one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	// nothing to remove once it's renamed
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename survives a crash. Not every platform
+	// can sync a directory, and the file itself is already complete.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (f fileStore) Watch(stop <-chan struct{}, apply func([]byte)) error {
+	return ErrWatchUnsupported
+}
+
+func (f fileStore) String() string {
+	return string(f)
+}
+
+// Apply a config written to the state store by someone else, the same way as
+// a config posted to the admin API.
+func applyStateConfig(data []byte) {
+	data, err := migrateState(data, stateNewer)
+	if err != nil {
+		log.Warnf("WARN: ignoring state config: %s", err)
+		return
+	}
+
+	var cfg client.Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Warnf("WARN: ignoring invalid state config: %s", err)
+		return
+	}
+	warnUnknownFields(stateStore(), data)
+
+	if !shutdown.BeginMutation() {
+		return
+	}
+	defer shutdown.EndMutation()
+
+	log.Printf("AUDIT: applying state config written to %s", stateStore())
+	// this saves what the registry ends up with, which our watch skips
+	if err := Registry.UpdateConfig(cfg); err != nil {
+		log.Errorf("ERROR: applying state config: %s", err)
+	}
+	configChanges.notify()
+}
+
+// stateWatcher applies changes written to the state store by others, such as
+// another tool updating the config in etcd. The watch is restarted after the
+// retry interval if it fails.
+type stateWatcher struct {
+	store StateStore
+	apply func([]byte)
+
+	stop  chan struct{}
+	done  chan struct{}
+	ready chan struct{}
+}
+
+func newStateWatcher(store StateStore) *stateWatcher {
+	return &stateWatcher{
+		store: store,
+		apply: applyStateConfig,
+		ready: make(chan struct{}),
+	}
+}
+
+func (w *stateWatcher) Start(ctx context.Context) error {
+	w.stop = make(chan struct{})
+	w.done = make(chan struct{})
+
+	goTask("state_watch", "", func() {
+		defer close(w.done)
+		for {
+			stateWatchStarted()
+			err := w.store.Watch(w.stop, w.apply)
+
+			select {
+			case <-w.stop:
+				return
+			default:
+			}
+			retry := stateWatchFailed(err)
+
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(retry):
+			}
+		}
+	})
+
+	close(w.ready)
+	return nil
+}
+
+func (w *stateWatcher) Stop(ctx context.Context) error {
+	close(w.stop)
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	configMutex.Lock()
+	stateWatching = false
+	configMutex.Unlock()
+	return nil
+}
+
+func (w *stateWatcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+func stateWatchStarted() {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	stateWatching = true
+}
+
+// Record a failed watch of the state store, and return how long to wait
+// before watching again.
+func stateWatchFailed(err error) time.Duration {
+	if err == nil {
+		err = fmt.Errorf("watch ended")
+	}
+	log.Errorf("ERROR: watching state config: %s", err)
+
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	stateWatching = false
+	stateWatchFailures++
+	stateWatchErr = err
+	return stateRetryInterval
+}
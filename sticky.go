@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/litl/shuttle/client"
+)
+
+var ErrInvalidStickyCookie = fmt.Errorf("invalid sticky cookie")
+
+// Cookie names are HTTP tokens, and an empty name turns sticky sessions off.
+func validStickyCookie(cfg client.ServiceConfig) error {
+	if !validHeaderName(cfg.StickyCookie) {
+		return fmt.Errorf("%w: %q", ErrInvalidStickyCookie, cfg.StickyCookie)
+	}
+	return nil
+}
+
+// The sticky cookie value for a backend, a hash of its name, so clients
+// can't learn the backend's address from it.
+func stickyID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Return the picker for a request. A request with the sticky cookie of one
+// of the service's backends tries that backend first, and the others are
+// only balanced if it can't be used.
+func (s *Service) requestPicker(r *http.Request, clientIP net.IP) *backendPicker {
+	if b := s.stickyBackend(r); b != nil {
+		return &backendPicker{
+			s:          s,
+			clientIP:   clientIP,
+			preferred:  b,
+			unbalanced: true,
+		}
+	}
+	return s.NewPicker(clientIP)
+}
+
+// The backend named by the request's sticky cookie, if the service has one.
+func (s *Service) stickyBackend(r *http.Request) *Backend {
+	s.Lock()
+	name := s.StickyCookie
+	s.Unlock()
+	if name == "" {
+		return nil
+	}
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, b := range s.Backends {
+		if b.stickyID == cookie.Value {
+			return b
+		}
+	}
+	return nil
+}
+
+// Set the sticky cookie for the backend that answered, unless the request
+// already had it. A request whose backend was removed or down is balanced
+// like any other, and gets the cookie of its new backend.
+func (s *Service) stickyResponse(pr *ProxyRequest) bool {
+	if pr.ProxyError != nil || len(pr.Attempted) == 0 {
+		return true
+	}
+	addr := pr.Attempted[len(pr.Attempted)-1]
+
+	s.Lock()
+	name := s.StickyCookie
+	var id string
+	for _, b := range s.Backends {
+		if b.Addr == addr {
+			id = b.stickyID
+			break
+		}
+	}
+	s.Unlock()
+
+	if name == "" || id == "" {
+		return true
+	}
+	if cookie, err := pr.Request.Cookie(name); err == nil && cookie.Value == id {
+		return true
+	}
+
+	http.SetCookie(pr.ResponseWriter, &http.Cookie{
+		Name:     name,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+	})
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/litl/shuttle/client"
+)
+
+// Limits on the tags of a service or backend. Keys may contain letters,
+// digits, '_', '-' and '.', and values may also contain ':' and '/'.
+const (
+	MaxTags        = 32
+	MaxTagKeyLen   = 64
+	MaxTagValueLen = 128
+)
+
+var (
+	ErrInvalidTags      = fmt.Errorf("invalid tags")
+	ErrInvalidTagFilter = fmt.Errorf("invalid tag filter")
+)
+
+func validTagChars(s string, extra string) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("_-."+extra, r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Check the number of tags, and the length and characters of each key and
+// value.
+func validTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%w: more than %d tags", ErrInvalidTags, MaxTags)
+	}
+	for k, v := range tags {
+		if k == "" || len(k) > MaxTagKeyLen || !validTagChars(k, "") {
+			return fmt.Errorf("%w: key %q", ErrInvalidTags, k)
+		}
+		if v == "" || len(v) > MaxTagValueLen || !validTagChars(v, ":/") {
+			return fmt.Errorf("%w: %s value %q", ErrInvalidTags, k, v)
+		}
+	}
+	return nil
+}
+
+// Check the tags of a service and all of its backends.
+func validServiceTags(cfg client.ServiceConfig) error {
+	if err := validTags(cfg.Tags); err != nil {
+		return err
+	}
+	for _, b := range cfg.Backends {
+		if err := validTags(b.Tags); err != nil {
+			return fmt.Errorf("backend %s: %s", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// Format tags as sorted key:value pairs, separated by commas, for logs.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+":"+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// The service's tags formatted for logs.
+func (s *Service) tagLabels() string {
+	s.Lock()
+	defer s.Unlock()
+	return formatTags(s.Tags)
+}
+
+// A tagFilter matches tags which have every key, and the value if it's set.
+type tagFilter map[string]string
+
+// Parse a tag filter from "key:value" or "key" strings.
+func parseTagFilter(vals []string) (tagFilter, error) {
+	filter := tagFilter{}
+	for _, val := range vals {
+		parts := strings.SplitN(val, ":", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTagFilter, val)
+		}
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+		filter[parts[0]] = parts[1]
+	}
+	return filter, nil
+}
+
+func (f tagFilter) match(tags map[string]string) bool {
+	for k, v := range f {
+		tag, ok := tags[k]
+		if !ok || (v != "" && v != tag) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,998 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// A takeover hands the listeners of a running shuttle (the source) to a new
+// shuttle on the same host (the target), so one can replace the other
+// without refusing connections. The target connects to the source's admin
+// unix socket, and upgrades the connection to a lockstep exchange of
+// messages:
+//
+//	hello    -> inventory, with the config and the listeners
+//	fd       -> fd, with the listener's descriptor attached
+//	release  -> released, once the target is accepting on it
+//	done     -> done, and the source drains and exits
+//
+// Until a listener is released both instances accept on it, and if the
+// takeover stops partway each listener is left with the instance that
+// was last confirmed to own it.
+
+// Handoff states of each listener
+const (
+	HandoffPending   = "pending"
+	HandoffSent      = "sent"
+	HandoffAccepting = "accepting"
+	HandoffReleased  = "released"
+	HandoffAdopted   = "adopted"
+	// the source kept the listener
+	HandoffKept   = "kept"
+	HandoffFailed = "failed"
+	// the release was sent but never confirmed, so both may own the listener
+	HandoffUnconfirmed = "unconfirmed"
+)
+
+// Takeover states
+const (
+	TakeoverRunning = "running"
+	TakeoverDone    = "done"
+	TakeoverFailed  = "failed"
+	// this instance hasn't taken part in a takeover
+	TakeoverNone = "none"
+)
+
+const (
+	takeoverUpgrade = "shuttle-takeover"
+	// the largest message accepted, which is mostly the config
+	maxTakeoverMsg = 64 << 20
+)
+
+var (
+	ErrTakeoverBusy    = fmt.Errorf("a takeover is already running")
+	ErrTakeoverUnix    = fmt.Errorf("takeover requires the admin unix socket")
+	ErrNoListenerFile  = fmt.Errorf("listener has no file descriptor")
+	ErrTakeoverRelease = fmt.Errorf("listener was not sent")
+)
+
+// A listener offered by the source. Kind is "service" or "router".
+type TakeoverListener struct {
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Network string `json:"network"`
+	Addr    string `json:"address"`
+}
+
+func (l TakeoverListener) key() string {
+	return l.Kind + ":" + l.Name
+}
+
+type takeoverMsg struct {
+	Op        string             `json:"op"`
+	Listener  *TakeoverListener  `json:"listener,omitempty"`
+	Config    *client.Config     `json:"config,omitempty"`
+	Listeners []TakeoverListener `json:"listeners,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// Write a message, with f's descriptor attached if f isn't nil.
+func writeTakeoverMsg(conn *net.UnixConn, msg takeoverMsg, f *os.File) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+
+	var oob []byte
+	if f != nil {
+		// File.Fd would put the listener's socket in blocking mode, which
+		// the source is still accepting on
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		rc.Control(func(fd uintptr) {
+			oob = syscall.UnixRights(int(fd))
+		})
+	}
+
+	// the descriptor is delivered with the first byte
+	n, _, err := conn.WriteMsgUnix(buf, oob, nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf[n:])
+	return err
+}
+
+// Read a message, and the descriptor attached to it if there was one.
+func readTakeoverMsg(conn *net.UnixConn) (takeoverMsg, *os.File, error) {
+	var msg takeoverMsg
+
+	head := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(head, oob)
+	if err != nil {
+		return msg, nil, err
+	}
+	if n == 0 {
+		return msg, nil, io.EOF
+	}
+
+	var f *os.File
+	if oobn > 0 {
+		f, err = parseRights(oob[:oobn])
+		if err != nil {
+			return msg, nil, err
+		}
+	}
+
+	fail := func(err error) (takeoverMsg, *os.File, error) {
+		if f != nil {
+			f.Close()
+		}
+		return msg, nil, err
+	}
+
+	if _, err := io.ReadFull(conn, head[n:]); err != nil {
+		return fail(err)
+	}
+	size := binary.BigEndian.Uint32(head)
+	if size > maxTakeoverMsg {
+		return fail(fmt.Errorf("takeover message of %d bytes is too large", size))
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return fail(err)
+	}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return fail(err)
+	}
+	if msg.Op == "error" {
+		return fail(fmt.Errorf("%s", msg.Error))
+	}
+	return msg, f, nil
+}
+
+func parseRights(oob []byte) (*os.File, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for _, m := range msgs {
+		rights, err := syscall.ParseUnixRights(&m)
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return nil, fmt.Errorf("expected 1 descriptor, received %d", len(fds))
+	}
+	return os.NewFile(uintptr(fds[0]), "takeover"), nil
+}
+
+// Send a message, and read the reply.
+func takeoverCall(conn *net.UnixConn, msg takeoverMsg) (takeoverMsg, *os.File, error) {
+	if err := writeTakeoverMsg(conn, msg, nil); err != nil {
+		return takeoverMsg{}, nil, err
+	}
+	return readTakeoverMsg(conn)
+}
+
+// TakeoverStatus reports the progress of a takeover, from either side.
+type TakeoverStatus struct {
+	// source or target
+	Role     string    `json:"role"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished,omitempty"`
+	// the handoff state of each listener, by kind:name
+	Listeners map[string]string `json:"listeners"`
+}
+
+type takeoverState struct {
+	sync.Mutex
+	status TakeoverStatus
+}
+
+func newTakeoverState(role string) *takeoverState {
+	return &takeoverState{
+		status: TakeoverStatus{
+			Role:      role,
+			State:     TakeoverRunning,
+			Started:   time.Now(),
+			Listeners: make(map[string]string),
+		},
+	}
+}
+
+func (t *takeoverState) set(l TakeoverListener, state string) {
+	t.Lock()
+	defer t.Unlock()
+	t.status.Listeners[l.key()] = state
+	log.Printf("EVENT: takeover %s %s %s", t.status.Role, l.key(), state)
+}
+
+func (t *takeoverState) get(l TakeoverListener) string {
+	t.Lock()
+	defer t.Unlock()
+	return t.status.Listeners[l.key()]
+}
+
+// Finish the takeover, failed if err isn't nil. Listeners in the from state
+// are moved to the to state, and if it failed those never sent were kept by
+// the source.
+func (t *takeoverState) finish(err error, from, to string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.status.State != TakeoverRunning {
+		return
+	}
+	t.status.State = TakeoverDone
+	if err != nil {
+		t.status.State = TakeoverFailed
+		t.status.Error = err.Error()
+		log.Errorf("ERROR: takeover %s failed: %s", t.status.Role, err)
+	}
+	t.status.Finished = time.Now()
+
+	for key, state := range t.status.Listeners {
+		switch {
+		case state == from:
+			t.status.Listeners[key] = to
+		case state == HandoffPending && err != nil:
+			t.status.Listeners[key] = HandoffKept
+		}
+	}
+}
+
+func (t *takeoverState) Status() TakeoverStatus {
+	t.Lock()
+	defer t.Unlock()
+
+	status := t.status
+	status.Listeners = make(map[string]string, len(t.status.Listeners))
+	for k, v := range t.status.Listeners {
+		status.Listeners[k] = v
+	}
+	return status
+}
+
+// The takeover this process is taking part in, if any.
+var takeovers struct {
+	sync.Mutex
+	current *takeoverState
+}
+
+// Record the takeover for the admin API, unless another is still running.
+func startTakeover(t *takeoverState) error {
+	takeovers.Lock()
+	defer takeovers.Unlock()
+
+	if c := takeovers.current; c != nil && c.Status().State == TakeoverRunning {
+		return ErrTakeoverBusy
+	}
+	takeovers.current = t
+	return nil
+}
+
+func takeoverStatus() TakeoverStatus {
+	takeovers.Lock()
+	defer takeovers.Unlock()
+
+	if takeovers.current == nil {
+		return TakeoverStatus{State: TakeoverNone, Listeners: map[string]string{}}
+	}
+	return takeovers.current.Status()
+}
+
+// takeoverSource hands its listeners to a target.
+type takeoverSource struct {
+	reg     *ServiceRegistry
+	routers map[string]*HostRouter
+	// only passed in a re-exec, since a target has its own admin server
+	admin *AdminServer
+	// called once the target has everything, to drain and exit
+	exit  func()
+	state *takeoverState
+}
+
+func newTakeoverSource(reg *ServiceRegistry, routers map[string]*HostRouter, exit func()) *takeoverSource {
+	return &takeoverSource{
+		reg:     reg,
+		routers: routers,
+		exit:    exit,
+		state:   newTakeoverState("source"),
+	}
+}
+
+// The listeners that can be handed over.
+func (t *takeoverSource) inventory() []TakeoverListener {
+	var listeners []TakeoverListener
+
+	t.reg.Lock()
+	for _, svc := range t.reg.svcs {
+		if svc.isListening() {
+			listeners = append(listeners, TakeoverListener{
+				Kind:    "service",
+				Name:    svc.Name,
+				Network: svc.Network,
+				Addr:    svc.Addr,
+			})
+		}
+	}
+	t.reg.Unlock()
+
+	for scheme, r := range t.routers {
+		r.Lock()
+		if r.listener != nil {
+			listeners = append(listeners, TakeoverListener{
+				Kind:    "router",
+				Name:    scheme,
+				Network: "tcp",
+				Addr:    r.server.Addr,
+			})
+		}
+		r.Unlock()
+	}
+
+	sort.Slice(listeners, func(i, j int) bool {
+		return listeners[i].key() < listeners[j].key()
+	})
+	return listeners
+}
+
+func (t *takeoverSource) listenerFile(l TakeoverListener) (*os.File, error) {
+	switch l.Kind {
+	case "service":
+		if svc := t.reg.GetService(l.Name); svc != nil {
+			return svc.listenerFile()
+		}
+		return nil, ErrNoService
+	case "router":
+		if r := t.routers[l.Name]; r != nil {
+			return r.listenerFile()
+		}
+	case "admin":
+		if t.admin != nil {
+			return t.admin.listenerFile()
+		}
+	}
+	return nil, fmt.Errorf("unknown listener %s", l.key())
+}
+
+// Stop accepting on a listener the target has taken. Open connections are
+// left to finish.
+func (t *takeoverSource) release(l TakeoverListener) {
+	switch l.Kind {
+	case "service":
+		if svc := t.reg.GetService(l.Name); svc != nil {
+			svc.handOffListener()
+		}
+	case "router":
+		if r := t.routers[l.Name]; r != nil {
+			// the accept loop's error is expected
+			r.Lock()
+			r.stopping = true
+			r.Unlock()
+			r.CloseListener()
+		}
+	case "admin":
+		if t.admin != nil {
+			t.admin.handOffListener()
+		}
+	}
+}
+
+// Serve a takeover on conn until the target is done or goes away.
+func (t *takeoverSource) serve(conn *net.UnixConn) error {
+	defer conn.Close()
+
+	err := t.handle(conn)
+	// anything sent and not released is still ours
+	t.state.finish(err, HandoffSent, HandoffKept)
+	return err
+}
+
+func (t *takeoverSource) handle(conn *net.UnixConn) error {
+	for {
+		msg, f, err := readTakeoverMsg(conn)
+		if f != nil {
+			// the target never sends descriptors
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		switch msg.Op {
+		case "hello":
+			cfg := t.reg.Config()
+			listeners := t.inventory()
+			for _, l := range listeners {
+				t.state.set(l, HandoffPending)
+			}
+			err = writeTakeoverMsg(conn, takeoverMsg{Op: "inventory", Config: &cfg, Listeners: listeners}, nil)
+
+		case "fd":
+			if msg.Listener == nil {
+				return fmt.Errorf("no listener requested")
+			}
+			l := *msg.Listener
+			f, ferr := t.listenerFile(l)
+			if ferr != nil {
+				t.state.set(l, HandoffKept)
+				err = writeTakeoverMsg(conn, takeoverMsg{Op: "error", Error: ferr.Error()}, nil)
+				break
+			}
+			err = writeTakeoverMsg(conn, takeoverMsg{Op: "fd", Listener: &l}, f)
+			f.Close()
+			if err == nil {
+				t.state.set(l, HandoffSent)
+			}
+
+		case "release":
+			if msg.Listener == nil || t.state.get(*msg.Listener) != HandoffSent {
+				err = writeTakeoverMsg(conn, takeoverMsg{Op: "error", Error: ErrTakeoverRelease.Error()}, nil)
+				break
+			}
+			l := *msg.Listener
+			// only stop accepting once the target knows it owns the listener
+			if err = writeTakeoverMsg(conn, takeoverMsg{Op: "released", Listener: &l}, nil); err != nil {
+				break
+			}
+			t.release(l)
+			t.state.set(l, HandoffReleased)
+
+		case "done":
+			if err := writeTakeoverMsg(conn, takeoverMsg{Op: "done"}, nil); err != nil {
+				return err
+			}
+			t.state.finish(nil, HandoffSent, HandoffKept)
+			log.Printf("Takeover complete, draining and exiting")
+			if t.exit != nil {
+				t.exit()
+			}
+			return nil
+
+		default:
+			err = writeTakeoverMsg(conn, takeoverMsg{Op: "error", Error: "unknown op " + msg.Op}, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// inheritedListeners returns the listeners received in a takeover for their
+// addresses, and creates the rest with next.
+type inheritedListeners struct {
+	sync.Mutex
+	next    ListenerFactory
+	streams map[string]net.Listener
+	packets map[string]net.PacketConn
+}
+
+func newInheritedListeners(next ListenerFactory) *inheritedListeners {
+	return &inheritedListeners{
+		next:    next,
+		streams: make(map[string]net.Listener),
+		packets: make(map[string]net.PacketConn),
+	}
+}
+
+func (f *inheritedListeners) Listen(network, addr string) (net.Listener, error) {
+	if l := f.stream(addr); l != nil {
+		return l, nil
+	}
+	return f.next.Listen(network, addr)
+}
+
+// Take the stream listener inherited for addr, if there is one.
+func (f *inheritedListeners) stream(addr string) net.Listener {
+	f.Lock()
+	defer f.Unlock()
+
+	l := f.streams[addr]
+	delete(f.streams, addr)
+	return l
+}
+
+func (f *inheritedListeners) ListenPacket(network, addr string) (net.PacketConn, error) {
+	f.Lock()
+	c, ok := f.packets[addr]
+	delete(f.packets, addr)
+	f.Unlock()
+
+	if ok {
+		return c, nil
+	}
+	return f.next.ListenPacket(network, addr)
+}
+
+// Add the listener for l from its descriptor.
+func (f *inheritedListeners) add(l TakeoverListener, file *os.File) error {
+	defer file.Close()
+
+	f.Lock()
+	defer f.Unlock()
+
+	if networkFamily(l.Network) == "udp" {
+		c, err := net.FilePacketConn(file)
+		if err != nil {
+			return err
+		}
+		f.packets[l.Addr] = c
+		return nil
+	}
+
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return err
+	}
+	f.streams[l.Addr] = ln
+	return nil
+}
+
+// Report whether the listener for addr has been used, and close it if it
+// hasn't.
+func (f *inheritedListeners) taken(addr string) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if l, ok := f.streams[addr]; ok {
+		l.Close()
+		delete(f.streams, addr)
+		return false
+	}
+	if c, ok := f.packets[addr]; ok {
+		c.Close()
+		delete(f.packets, addr)
+		return false
+	}
+	return true
+}
+
+// takeoverTarget takes the config and listeners of the shuttle at addr. It's
+// started in place of loading the config, and its finisher is started after
+// the http routers, which adopt their listeners as they start.
+type takeoverTarget struct {
+	addr    string
+	reg     *ServiceRegistry
+	factory *inheritedListeners
+	conn    *net.UnixConn
+	state   *takeoverState
+
+	// the source's config, and its listeners
+	cfg      client.Config
+	services map[string]TakeoverListener
+	routers  []TakeoverListener
+	// the first service or router that couldn't be taken
+	err error
+
+	ready    chan struct{}
+	finished chan struct{}
+}
+
+func newTakeoverTarget(addr string, reg *ServiceRegistry) *takeoverTarget {
+	return &takeoverTarget{
+		addr:     addr,
+		reg:      reg,
+		factory:  newInheritedListeners(defaultListenerFactory),
+		state:    newTakeoverState("target"),
+		ready:    make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// Connect to the source's admin socket, and upgrade to the takeover protocol.
+func dialTakeover(addr string) (*net.UnixConn, error) {
+	c, err := net.Dial("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.UnixConn)
+
+	req, _ := http.NewRequest("POST", "http://shuttle/_takeover", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", takeoverUpgrade)
+	if token := os.Getenv("SHUTTLE_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the source says nothing more until it's sent hello, so nothing past
+	// the response is buffered
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		conn.Close()
+		return nil, fmt.Errorf("takeover refused: %s: %s", resp.Status, body)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected data after takeover upgrade")
+	}
+	return conn, nil
+}
+
+// Take the config, and the listeners of each service in turn. If nothing
+// could be taken the error is returned, and otherwise a failure leaves the
+// listeners taken so far with this instance and the rest with the source,
+// which keeps running.
+func (t *takeoverTarget) Start(ctx context.Context) error {
+	if err := startTakeover(t.state); err != nil {
+		return err
+	}
+	defaultListenerFactory = t.factory
+	defer close(t.ready)
+
+	if err := t.begin(); err != nil {
+		t.fail(err)
+		return err
+	}
+
+	// the routers' listeners are fetched first, so they're adopted even if a
+	// service fails
+	for _, l := range t.routers {
+		if err := t.fetch(l); err != nil {
+			err = fmt.Errorf("%s: %s", l.key(), err)
+			t.fail(err)
+			return err
+		}
+	}
+
+	for _, svcCfg := range t.cfg.Services {
+		if err := t.takeService(svcCfg); err != nil {
+			t.err = fmt.Errorf("%s: %s", svcCfg.Name, err)
+			log.Errorf("ERROR: takeover of %s failed: %s", svcCfg.Name, err)
+			break
+		}
+	}
+	return nil
+}
+
+// Connect to the source, and apply its global config.
+func (t *takeoverTarget) begin() error {
+	if t.conn == nil {
+		conn, err := dialTakeover(t.addr)
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+
+	msg, _, err := takeoverCall(t.conn, takeoverMsg{Op: "hello"})
+	if err != nil {
+		return err
+	}
+	if msg.Op != "inventory" || msg.Config == nil {
+		return fmt.Errorf("unexpected takeover reply %q", msg.Op)
+	}
+	log.Printf("Taking over %d listeners from %s", len(msg.Listeners), t.addr)
+
+	t.cfg = *msg.Config
+	sort.Slice(t.cfg.Services, func(i, j int) bool {
+		return t.cfg.Services[i].Name < t.cfg.Services[j].Name
+	})
+	t.services = make(map[string]TakeoverListener)
+	for _, l := range msg.Listeners {
+		t.state.set(l, HandoffPending)
+		switch l.Kind {
+		case "service":
+			t.services[l.Name] = l
+		case "router":
+			t.routers = append(t.routers, l)
+		}
+	}
+
+	globals := t.cfg
+	globals.Services = nil
+	return t.reg.UpdateConfig(globals)
+}
+
+// Receive the descriptor for l, ready to be used by the factory.
+func (t *takeoverTarget) fetch(l TakeoverListener) error {
+	_, f, err := takeoverCall(t.conn, takeoverMsg{Op: "fd", Listener: &l})
+	if err == nil && f == nil {
+		err = fmt.Errorf("no descriptor received")
+	}
+	if err != nil {
+		t.state.set(l, HandoffFailed)
+		return err
+	}
+	if err := t.factory.add(l, f); err != nil {
+		t.state.set(l, HandoffFailed)
+		return err
+	}
+	t.state.set(l, HandoffSent)
+	return nil
+}
+
+// Start a service on its inherited listener, and have the source release it
+// once it's accepting.
+func (t *takeoverTarget) takeService(svcCfg client.ServiceConfig) error {
+	l, ok := t.services[svcCfg.Name]
+	if !ok {
+		// not listening, so there's nothing to take
+		return t.reg.AddService(svcCfg)
+	}
+
+	if err := t.fetch(l); err != nil {
+		return err
+	}
+
+	err := t.reg.AddService(svcCfg)
+	if err == nil {
+		if svc := t.reg.GetService(svcCfg.Name); svc == nil || !svc.isListening() {
+			err = fmt.Errorf("service isn't listening")
+		}
+	}
+	if !t.factory.taken(l.Addr) && err == nil {
+		err = fmt.Errorf("service didn't use the inherited listener")
+	}
+	if err != nil {
+		// our copy of the listener is closed, and the source still has it
+		t.reg.RemoveService(svcCfg.Name)
+		t.state.set(l, HandoffFailed)
+		return err
+	}
+	t.state.set(l, HandoffAccepting)
+	return t.release(l)
+}
+
+// Have the source release a listener this instance is accepting on.
+func (t *takeoverTarget) release(l TakeoverListener) error {
+	msg, _, err := takeoverCall(t.conn, takeoverMsg{Op: "release", Listener: &l})
+	if err == nil && msg.Op != "released" {
+		err = fmt.Errorf("unexpected takeover reply %q", msg.Op)
+	}
+	if err != nil {
+		// The source may have released it, so it's kept here too. If it didn't
+		// the source keeps running, and both accept on it.
+		t.state.set(l, HandoffUnconfirmed)
+		return err
+	}
+	t.state.set(l, HandoffAdopted)
+	return nil
+}
+
+// Release the routers' listeners, and tell the source to drain and exit if
+// everything was taken.
+func (t *takeoverTarget) finish() error {
+	<-t.ready
+	defer close(t.finished)
+
+	if t.state.Status().State != TakeoverRunning {
+		return nil
+	}
+
+	for _, l := range t.routers {
+		if !t.factory.taken(l.Addr) {
+			t.state.set(l, HandoffFailed)
+			if t.err == nil {
+				t.err = fmt.Errorf("%s: no router started on %s", l.key(), l.Addr)
+			}
+			continue
+		}
+		t.state.set(l, HandoffAccepting)
+		if err := t.release(l); err != nil && t.err == nil {
+			t.err = fmt.Errorf("%s: %s", l.key(), err)
+		}
+	}
+
+	if t.err != nil {
+		t.fail(t.err)
+		return nil
+	}
+
+	if _, _, err := takeoverCall(t.conn, takeoverMsg{Op: "done"}); err != nil {
+		t.fail(err)
+		return nil
+	}
+	t.conn.Close()
+	t.state.finish(nil, "", "")
+	log.Printf("Takeover from %s complete", t.addr)
+	goTask("state_write", "", writeStateConfig)
+	return nil
+}
+
+// Stop the takeover. The listeners that weren't adopted are left with the
+// source.
+func (t *takeoverTarget) fail(err error) {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	for _, l := range t.routers {
+		if t.state.get(l) == HandoffSent {
+			t.factory.taken(l.Addr)
+		}
+	}
+	t.state.finish(err, HandoffSent, HandoffFailed)
+}
+
+func (t *takeoverTarget) Stop(ctx context.Context) error {
+	for _, svc := range t.reg.Config().Services {
+		t.reg.RemoveService(svc.Name)
+	}
+	return nil
+}
+
+func (t *takeoverTarget) Ready() <-chan struct{} {
+	return t.ready
+}
+
+// The Runner that finishes the takeover, started after the http routers.
+func (t *takeoverTarget) finisher() Runner {
+	return takeoverFinisher{t}
+}
+
+type takeoverFinisher struct {
+	t *takeoverTarget
+}
+
+func (f takeoverFinisher) Start(ctx context.Context) error {
+	return f.t.finish()
+}
+
+func (f takeoverFinisher) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (f takeoverFinisher) Ready() <-chan struct{} {
+	return f.t.finished
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// A duplicate of the service's listening socket.
+func (s *Service) listenerFile() (*os.File, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.listening {
+		return nil, ErrNoListenerFile
+	}
+
+	var l interface{}
+	switch networkFamily(s.Network) {
+	case "tcp", "unix":
+		l = s.tcpListener
+		if tl, ok := l.(*timeoutListener); ok {
+			l = tl.Listener
+		}
+	case "udp":
+		l = s.udpListener
+	}
+
+	if f, ok := l.(filer); ok {
+		return f.File()
+	}
+	return nil, ErrNoListenerFile
+}
+
+func (s *Service) isListening() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.listening
+}
+
+// A duplicate of the router's listening socket.
+func (r *HostRouter) listenerFile() (*os.File, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	l := r.listener
+	if tl, ok := l.(*timeoutListener); ok {
+		l = tl.Listener
+	}
+	if f, ok := l.(filer); ok {
+		return f.File()
+	}
+	return nil, ErrNoListenerFile
+}
+
+// Called once this instance has handed everything over in a takeover, to
+// drain and exit. Replaced in tests.
+var takeoverExit = func() {
+	goTask("takeover_exit", "", func() {
+		os.Exit(shutdown.Run())
+	})
+}
+
+// The running http routers, by scheme.
+func currentRouters() map[string]*HostRouter {
+	routers := make(map[string]*HostRouter)
+	if httpRouter != nil {
+		routers["http"] = httpRouter
+	}
+	if httpsRouter != nil {
+		routers["https"] = httpsRouter
+	}
+	return routers
+}
+
+// Hand this instance's listeners to a new shuttle on the admin unix socket.
+func postTakeover(w http.ResponseWriter, r *http.Request) {
+	if shutdown.Stage() != "" {
+		http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Upgrade") != takeoverUpgrade {
+		http.Error(w, "expected Upgrade: "+takeoverUpgrade, http.StatusBadRequest)
+		return
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); !ok || addr.Network() != "unix" {
+		http.Error(w, ErrTakeoverUnix.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := newTakeoverSource(&Registry, currentRouters(), takeoverExit)
+	if err := startTakeover(source.state); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		source.state.finish(ErrTakeoverUnix, "", "")
+		http.Error(w, ErrTakeoverUnix.Error(), http.StatusBadRequest)
+		return
+	}
+	c, buf, err := hj.Hijack()
+	if err != nil {
+		source.state.finish(err, "", "")
+		return
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok || buf.Reader.Buffered() > 0 {
+		source.state.finish(ErrTakeoverUnix, "", "")
+		c.Close()
+		return
+	}
+
+	log.Printf("AUDIT: takeover started from %s", normalizeClientAddr(r.RemoteAddr))
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+takeoverUpgrade+"\r\n\r\n")
+	source.serve(conn)
+}
+
+// Report the last takeover this instance took part in.
+func getTakeover(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(takeoverStatus()))
+}
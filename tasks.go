@@ -0,0 +1,342 @@
+package main
+
+import (
+	"runtime"
+	runtimedebug "runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/client"
+	"github.com/litl/shuttle/log"
+)
+
+// Every background goroutine shuttle starts is a task, so a growing goroutine
+// count can be attributed. Long-lived tasks, like accept loops and health
+// checks, are started with goTask, and recorded with a name, an owner, and
+// the time they started, until they return. Goroutines started for each
+// connection or request are only counted, by a taskCounter, to keep the
+// cost of a connection the same. A task that panics is recovered, logged and
+// counted, rather than taking down the process.
+type task struct {
+	name  string
+	owner string
+	start time.Time
+}
+
+// A taskCounter counts the running goroutines of one kind started for
+// connections or requests.
+type taskCounter struct {
+	name string
+	// running, and started in total. Used atomically.
+	running int64
+	started int64
+}
+
+// The per-connection tasks.
+var (
+	tcpConnTasks   = &taskCounter{name: "tcp_conn"}
+	tcpBrokerTasks = &taskCounter{name: "tcp_broker"}
+	udpRelayTasks  = &taskCounter{name: "udp_relay"}
+	flushTasks     = &taskCounter{name: "flush_loop"}
+
+	taskCounters = []*taskCounter{tcpConnTasks, tcpBrokerTasks, udpRelayTasks, flushTasks}
+)
+
+// The thresholds above which running tasks are warned about, in total and by
+// name. A threshold of 0 is off.
+type taskThresholds struct {
+	total  int
+	byName map[string]int
+}
+
+type taskRegistry struct {
+	sync.Mutex
+	tasks  map[*task]bool
+	byName map[string]int
+	// the long-lived tasks running, for the total without locking. Used
+	// atomically.
+	running int64
+
+	// tasks that panicked, by name, and in total, used atomically
+	panics     map[string]int64
+	panicCount int64
+
+	thresholds atomic.Value
+	// the thresholds that have been warned about, by task name, or "" for
+	// the total. A warning isn't repeated until the count has fallen back
+	// well below the threshold. warnedAny is set atomically while any are.
+	warnMu    sync.Mutex
+	warned    map[string]bool
+	warnedAny int32
+	// warnings given, used atomically
+	warnings int64
+}
+
+var tasks = newTaskRegistry()
+
+func newTaskRegistry() *taskRegistry {
+	r := &taskRegistry{
+		tasks:  make(map[*task]bool),
+		byName: make(map[string]int),
+		panics: make(map[string]int64),
+		warned: make(map[string]bool),
+	}
+	r.thresholds.Store(taskThresholds{total: client.DefaultTaskWarnThreshold})
+	return r
+}
+
+// Start a long-lived background task. owner is the service or backend the
+// task belongs to, if any.
+func goTask(name, owner string, f func()) {
+	tasks.start(name, owner, f)
+}
+
+func (r *taskRegistry) start(name, owner string, f func()) {
+	t := &task{name: name, owner: owner, start: time.Now()}
+
+	r.Lock()
+	r.tasks[t] = true
+	r.byName[name]++
+	n := r.byName[name]
+	r.Unlock()
+	atomic.AddInt64(&r.running, 1)
+	r.check(name, int64(n))
+
+	go func() {
+		defer r.finish(t)
+		r.run(name, owner, f)
+	}()
+}
+
+func (r *taskRegistry) finish(t *task) {
+	r.Lock()
+	delete(r.tasks, t)
+	if r.byName[t.name]--; r.byName[t.name] == 0 {
+		delete(r.byName, t.name)
+	}
+	r.Unlock()
+	atomic.AddInt64(&r.running, -1)
+}
+
+// Start a goroutine for a connection or request.
+func (c *taskCounter) goTask(f func()) {
+	n := atomic.AddInt64(&c.running, 1)
+	atomic.AddInt64(&c.started, 1)
+	tasks.check(c.name, n)
+
+	go func() {
+		defer atomic.AddInt64(&c.running, -1)
+		tasks.run(c.name, "", f)
+	}()
+}
+
+// Run a task's function, recovering a panic.
+func (r *taskRegistry) run(name, owner string, f func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.Lock()
+			r.panics[name]++
+			r.Unlock()
+			atomic.AddInt64(&r.panicCount, 1)
+			log.Errorf("ERROR: task %s owner=%s panicked: %v\n%s", name, owner, p, runtimedebug.Stack())
+		}
+	}()
+	f()
+}
+
+// The running tasks, long-lived and per-connection.
+func (r *taskRegistry) total() int64 {
+	n := atomic.LoadInt64(&r.running)
+	for _, c := range taskCounters {
+		n += atomic.LoadInt64(&c.running)
+	}
+	return n
+}
+
+// The tasks that have panicked.
+func (r *taskRegistry) panicked() int64 {
+	return atomic.LoadInt64(&r.panicCount)
+}
+
+func (r *taskRegistry) setThresholds(total int, byName map[string]int) {
+	r.thresholds.Store(taskThresholds{total: total, byName: byName})
+}
+
+func (r *taskRegistry) limits() taskThresholds {
+	return r.thresholds.Load().(taskThresholds)
+}
+
+// Check the count of a task that's just started, and the total, against
+// their thresholds.
+func (r *taskRegistry) check(name string, n int64) {
+	t := r.limits()
+	if limit := t.byName[name]; limit > 0 {
+		r.checkLimit(name, n, limit)
+	}
+	if t.total > 0 {
+		r.checkLimit("", r.total(), t.total)
+	}
+}
+
+// Warn once when n goes over limit, and again only after it's fallen below
+// 90% of it.
+func (r *taskRegistry) checkLimit(name string, n int64, limit int) {
+	over := n > int64(limit)
+	if !over && atomic.LoadInt32(&r.warnedAny) == 0 {
+		return
+	}
+
+	r.warnMu.Lock()
+	defer r.warnMu.Unlock()
+
+	switch {
+	case over && !r.warned[name]:
+		r.warned[name] = true
+		atomic.StoreInt32(&r.warnedAny, 1)
+		atomic.AddInt64(&r.warnings, 1)
+	case !over && r.warned[name] && n < int64(limit)*9/10:
+		delete(r.warned, name)
+		if len(r.warned) == 0 {
+			atomic.StoreInt32(&r.warnedAny, 0)
+		}
+		return
+	default:
+		return
+	}
+
+	what := name + " tasks"
+	if name == "" {
+		what = "tasks"
+	}
+	log.Warnf("WARN: %d %s running, over the threshold of %d", n, what, limit)
+	events.publish(&client.Event{
+		Type:      client.EventTasksHigh,
+		Time:      time.Now(),
+		Task:      name,
+		Tasks:     int(n),
+		Threshold: limit,
+	})
+}
+
+// The json report of the running tasks, grouped by name and owner. Oldest is
+// the start of the longest running task in the group.
+type TaskGroup struct {
+	Name   string    `json:"name"`
+	Owner  string    `json:"owner,omitempty"`
+	Count  int       `json:"count"`
+	Oldest time.Time `json:"oldest"`
+}
+
+type TaskCount struct {
+	Name    string `json:"name"`
+	Running int64  `json:"running"`
+	Started int64  `json:"started"`
+}
+
+type TaskReport struct {
+	// the long-lived and per-connection tasks running
+	Total int64 `json:"total"`
+	// the goroutines in the process, including those of the runtime and
+	// the http servers
+	Goroutines int `json:"goroutines"`
+
+	Tasks       []TaskGroup      `json:"tasks"`
+	Connections []TaskCount      `json:"connections"`
+	Panics      map[string]int64 `json:"panics,omitempty"`
+	Warnings    int64            `json:"warnings"`
+
+	Threshold  int            `json:"threshold,omitempty"`
+	Thresholds map[string]int `json:"thresholds,omitempty"`
+}
+
+func (r *taskRegistry) report() TaskReport {
+	type key struct{ name, owner string }
+	groups := make(map[key]*TaskGroup)
+	panics := make(map[string]int64)
+
+	r.Lock()
+	for t := range r.tasks {
+		g := groups[key{t.name, t.owner}]
+		if g == nil {
+			g = &TaskGroup{Name: t.name, Owner: t.owner, Oldest: t.start}
+			groups[key{t.name, t.owner}] = g
+		}
+		g.Count++
+		if t.start.Before(g.Oldest) {
+			g.Oldest = t.start
+		}
+	}
+	for name, n := range r.panics {
+		panics[name] = n
+	}
+	r.Unlock()
+
+	limits := r.limits()
+	rep := TaskReport{
+		Total:      r.total(),
+		Goroutines: runtime.NumGoroutine(),
+		Tasks:      make([]TaskGroup, 0, len(groups)),
+		Warnings:   atomic.LoadInt64(&r.warnings),
+		Threshold:  limits.total,
+	}
+	if len(panics) > 0 {
+		rep.Panics = panics
+	}
+	if len(limits.byName) > 0 {
+		rep.Thresholds = limits.byName
+	}
+	for _, g := range groups {
+		rep.Tasks = append(rep.Tasks, *g)
+	}
+	sort.Slice(rep.Tasks, func(i, j int) bool {
+		if rep.Tasks[i].Name != rep.Tasks[j].Name {
+			return rep.Tasks[i].Name < rep.Tasks[j].Name
+		}
+		return rep.Tasks[i].Owner < rep.Tasks[j].Owner
+	})
+	for _, c := range taskCounters {
+		rep.Connections = append(rep.Connections, TaskCount{
+			Name:    c.name,
+			Running: atomic.LoadInt64(&c.running),
+			Started: atomic.LoadInt64(&c.started),
+		})
+	}
+	return rep
+}
+
+// The number of long-lived tasks belonging to owner. A service's tasks are
+// owned by its name, and its backends' by "service/backend", which are
+// included.
+func (r *taskRegistry) owned(owner string) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for t := range r.tasks {
+		if t.owner == owner || strings.HasPrefix(t.owner, owner+"/") {
+			n++
+		}
+	}
+	return n
+}
+
+// Apply the task thresholds of the global config. A negative threshold is
+// off. ServiceRegistry *must* be locked.
+func (s *ServiceRegistry) updateTaskThresholds() {
+	total := s.cfg.TaskWarnThreshold
+	if total == 0 {
+		total = client.DefaultTaskWarnThreshold
+	}
+	byName := make(map[string]int, len(s.cfg.TaskWarnThresholds))
+	for name, n := range s.cfg.TaskWarnThresholds {
+		if n > 0 {
+			byName[name] = n
+		}
+	}
+	if total < 0 {
+		total = 0
+	}
+	tasks.setThresholds(total, byName)
+}
@@ -0,0 +1,607 @@
+// Package testnet provides an in-memory network for testing shuttle without
+// real sockets. Listeners and dials are matched by their address string, and
+// connect immediately.
+package testnet
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// The same text as the net package, since callers may match on it.
+	ErrClosed = errors.New("use of closed network connection")
+
+	ErrRefused   = errors.New("connection refused")
+	ErrAddrInUse = errors.New("address already in use")
+)
+
+// The error returned when a deadline is reached.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Addr is an address on the in-memory network.
+type Addr struct {
+	Net     string
+	Address string
+}
+
+func (a Addr) Network() string { return a.Net }
+func (a Addr) String() string  { return a.Address }
+
+// Network is an in-memory network. The zero value is not usable; create one
+// with New.
+type Network struct {
+	sync.Mutex
+
+	listeners map[string]*Listener
+	packets   map[string]*PacketConn
+	failures  map[string]error
+	nextPort  int
+
+	latency  time.Duration
+	dialHook func(network, addr string) error
+	mtus     map[string]int
+	delays   map[string]time.Duration
+}
+
+func New() *Network {
+	return &Network{
+		listeners: make(map[string]*Listener),
+		packets:   make(map[string]*PacketConn),
+		failures:  make(map[string]error),
+		mtus:      make(map[string]int),
+		delays:    make(map[string]time.Duration),
+		nextPort:  10000,
+	}
+}
+
+// SetMTU makes writes of datagrams larger than mtu bytes to addr fail with
+// EMSGSIZE, as they would with the DF bit set. Zero removes the limit.
+func (n *Network) SetMTU(addr string, mtu int) {
+	n.Lock()
+	defer n.Unlock()
+	if mtu == 0 {
+		delete(n.mtus, addr)
+		return
+	}
+	n.mtus[addr] = mtu
+}
+
+// SetWriteDelay makes every datagram write to addr block for d, like a
+// backend that can't keep up. Zero removes the delay.
+func (n *Network) SetWriteDelay(addr string, d time.Duration) {
+	n.Lock()
+	defer n.Unlock()
+	if d == 0 {
+		delete(n.delays, addr)
+		return
+	}
+	n.delays[addr] = d
+}
+
+// Fail makes every dial to addr return err, until Fail is called again with
+// a nil error.
+func (n *Network) Fail(addr string, err error) {
+	n.Lock()
+	defer n.Unlock()
+	if err == nil {
+		delete(n.failures, addr)
+		return
+	}
+	n.failures[addr] = err
+}
+
+// SetLatency adds a delay to every dial.
+func (n *Network) SetLatency(d time.Duration) {
+	n.Lock()
+	n.latency = d
+	n.Unlock()
+}
+
+// SetDialHook sets a function to be called before every dial, which can fail
+// the dial by returning an error.
+func (n *Network) SetDialHook(hook func(network, addr string) error) {
+	n.Lock()
+	n.dialHook = hook
+	n.Unlock()
+}
+
+// assign a port to an address ending in :0.
+// Network *must* be locked.
+func (n *Network) resolve(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if port == "0" {
+		n.nextPort++
+		port = strconv.Itoa(n.nextPort)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Listen returns a stream listener on the in-memory network.
+func (n *Network) Listen(network, addr string) (net.Listener, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	addr, err := n.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: ErrAddrInUse}
+	}
+
+	l := &Listener{
+		network: n,
+		addr:    Addr{network, addr},
+		accept:  make(chan net.Conn, 128),
+		done:    make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// ListenPacket returns a datagram connection on the in-memory network.
+func (n *Network) ListenPacket(network, addr string) (net.PacketConn, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	addr, err := n.resolve(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := n.packets[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: ErrAddrInUse}
+	}
+
+	c := &PacketConn{
+		network: n,
+		addr:    Addr{network, addr},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	n.packets[addr] = c
+	return c, nil
+}
+
+// Dial connects to a listener on the in-memory network. The timeout applies
+// to the simulated latency, and to waiting for the listener to accept.
+func (n *Network) Dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	return n.DialFrom(network, "", addr, timeout)
+}
+
+// DialFrom connects to a listener from the local address laddr. An empty
+// host in laddr is 127.0.0.1, and an empty laddr or port 0 picks a port.
+func (n *Network) DialFrom(network, laddr, addr string, timeout time.Duration) (net.Conn, error) {
+	n.Lock()
+	hook := n.dialHook
+	latency := n.latency
+	n.Unlock()
+
+	if hook != nil {
+		if err := hook(network, addr); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+	}
+
+	if latency > 0 {
+		if timeout > 0 && latency >= timeout {
+			time.Sleep(timeout)
+			return nil, &net.OpError{Op: "dial", Net: network, Err: timeoutError{}}
+		}
+		time.Sleep(latency)
+	}
+
+	n.Lock()
+	l := n.listeners[addr]
+	failure := n.failures[addr]
+	host, port := "127.0.0.1", ""
+	if laddr != "" {
+		h, p, err := net.SplitHostPort(laddr)
+		if err != nil {
+			n.Unlock()
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		if h != "" {
+			host = h
+		}
+		if p != "0" {
+			port = p
+		}
+	}
+	if port == "" {
+		n.nextPort++
+		port = strconv.Itoa(n.nextPort)
+	}
+	local := Addr{network, net.JoinHostPort(host, port)}
+	n.Unlock()
+
+	if failure != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: failure}
+	}
+	if l == nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrRefused}
+	}
+
+	client, server := Pipe(local, l.addr)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case l.accept <- server:
+		return client, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrRefused}
+	case <-expired:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: timeoutError{}}
+	}
+}
+
+// Listener is a stream listener on the in-memory network.
+type Listener struct {
+	network *Network
+	addr    Addr
+	accept  chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: l.addr.Net, Err: ErrClosed}
+	}
+}
+
+// Close stops the listener. Connections that haven't been accepted are
+// closed.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		l.network.Lock()
+		delete(l.network.listeners, l.addr.Address)
+		l.network.Unlock()
+		close(l.done)
+
+		for {
+			select {
+			case c := <-l.accept:
+				c.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr { return l.addr }
+
+// Pipe returns both ends of an in-memory stream connection. Unlike net.Pipe,
+// writes are buffered, and each half can be closed independently.
+func Pipe(local, remote Addr) (*Conn, *Conn) {
+	a := newPipe()
+	b := newPipe()
+
+	c1 := &Conn{r: a, w: b, local: local, remote: remote}
+	c2 := &Conn{r: b, w: a, local: remote, remote: local}
+	return c1, c2
+}
+
+// A buffered, one way stream.
+type pipe struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+
+	// no more data will be written
+	writeClosed bool
+	// the reader has gone away
+	readClosed bool
+}
+
+func newPipe() *pipe {
+	p := &pipe{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+func (p *pipe) read(b []byte, deadline time.Time) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for len(p.buf) == 0 {
+		switch {
+		case p.readClosed:
+			return 0, io.EOF
+		case p.writeClosed:
+			return 0, io.EOF
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return 0, timeoutError{}
+		}
+
+		if !deadline.IsZero() && timer == nil {
+			timer = time.AfterFunc(deadline.Sub(time.Now()), func() {
+				p.mu.Lock()
+				p.cond.Broadcast()
+				p.mu.Unlock()
+			})
+		}
+		p.cond.Wait()
+	}
+
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *pipe) write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.writeClosed {
+		return 0, ErrClosed
+	}
+	if p.readClosed {
+		return 0, io.ErrClosedPipe
+	}
+
+	p.buf = append(p.buf, b...)
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	p.readClosed = true
+	p.buf = nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	p.writeClosed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// Conn is one end of an in-memory stream connection.
+type Conn struct {
+	r, w          *pipe
+	local, remote Addr
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	return c.r.read(b, deadline)
+}
+
+// Writes never block, so the write deadline is only checked before writing.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, timeoutError{}
+	}
+	return c.w.write(b)
+}
+
+func (c *Conn) Close() error {
+	c.r.closeRead()
+	c.w.closeWrite()
+	return nil
+}
+
+// CloseRead shuts down the reading side of the connection.
+func (c *Conn) CloseRead() error {
+	c.r.closeRead()
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (c *Conn) CloseWrite() error {
+	c.w.closeWrite()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.r.wake()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.r.wake()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// wake any blocked reader to check a new deadline
+func (p *pipe) wake() {
+	p.mu.Lock()
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// A single datagram
+type packet struct {
+	data []byte
+	from net.Addr
+}
+
+// PacketConn is a datagram connection on the in-memory network. Packets
+// sent to an address with no PacketConn are dropped.
+type PacketConn struct {
+	network *Network
+	addr    Addr
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	queue        []packet
+	closed       bool
+	readDeadline time.Time
+}
+
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for len(c.queue) == 0 {
+		switch {
+		case c.closed:
+			return 0, nil, ErrClosed
+		case !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline):
+			return 0, nil, timeoutError{}
+		}
+
+		if !c.readDeadline.IsZero() && timer == nil {
+			timer = time.AfterFunc(c.readDeadline.Sub(time.Now()), func() {
+				c.mu.Lock()
+				c.cond.Broadcast()
+				c.mu.Unlock()
+			})
+		}
+		c.cond.Wait()
+	}
+
+	p := c.queue[0]
+	c.queue = c.queue[1:]
+	n := copy(b, p.data)
+	return n, p.from, nil
+}
+
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return 0, ErrClosed
+	}
+
+	c.network.Lock()
+	dst := c.network.packets[addr.String()]
+	mtu := c.network.mtus[addr.String()]
+	delay := c.network.delays[addr.String()]
+	c.network.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	if mtu > 0 && len(b) > mtu {
+		return 0, &net.OpError{
+			Op:  "write",
+			Net: c.addr.Net,
+			Err: os.NewSyscallError("sendto", syscall.EMSGSIZE),
+		}
+	}
+
+	if dst == nil {
+		return len(b), nil
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	if !dst.closed {
+		dst.queue = append(dst.queue, packet{data: data, from: c.addr})
+		dst.cond.Broadcast()
+	}
+	return len(b), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.network.Lock()
+	if c.network.packets[c.addr.Address] == c {
+		delete(c.network.packets, c.addr.Address)
+	}
+	c.network.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	return nil
+}
+
+// Writes never block, so there's no write deadline.
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Read datagrams from a UDP socket in batches with recvmmsg, or one at a time
+// from any other listener.
+func newUDPBatchReader(conn net.PacketConn, size int) udpBatchReader {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok || size <= 1 {
+		return udpSingleReader{conn: conn}
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return udpSingleReader{conn: conn}
+	}
+
+	return &udpMmsgReader{
+		raw:   raw,
+		msgs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrAny, size),
+	}
+}
+
+// The kernel's struct mmsghdr. Go pads it to the msghdr's alignment, as C
+// does.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// udpMmsgReader reads batches of datagrams with recvmmsg. The headers are
+// allocated once, and pointed at each read's packets.
+type udpMmsgReader struct {
+	raw   syscall.RawConn
+	msgs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrAny
+}
+
+func (u *udpMmsgReader) size() int {
+	return len(u.msgs)
+}
+
+func (u *udpMmsgReader) read(packets []*udpPacket) (int, error) {
+	count := len(packets)
+	if count > len(u.msgs) {
+		count = len(u.msgs)
+	}
+	for i := 0; i < count; i++ {
+		buf := packets[i].buf
+		u.iovs[i].Base = &buf[0]
+		u.iovs[i].SetLen(len(buf))
+		u.msgs[i] = mmsghdr{}
+		u.msgs[i].hdr.Name = (*byte)(unsafe.Pointer(&u.names[i]))
+		u.msgs[i].hdr.Namelen = syscall.SizeofSockaddrAny
+		u.msgs[i].hdr.Iov = &u.iovs[i]
+		u.msgs[i].hdr.Iovlen = 1
+	}
+
+	var n int
+	var errno syscall.Errno
+	err := u.raw.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&u.msgs[0])), uintptr(count), 0, 0, 0)
+		if e == syscall.EAGAIN {
+			// wait for the socket to be readable
+			return false
+		}
+		n, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "read", Net: "udp", Err: errno}
+	}
+
+	for i := 0; i < n; i++ {
+		packets[i].n = int(u.msgs[i].len)
+		packets[i].addr = sockaddrToUDP(&u.names[i])
+	}
+	return n, nil
+}
+
+// Convert a client's address from recvmmsg.
+func sockaddrToUDP(sa *syscall.RawSockaddrAny) net.Addr {
+	switch sa.Addr.Family {
+	case syscall.AF_INET:
+		sa4 := (*syscall.RawSockaddrInet4)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&sa4.Port))
+		return &net.UDPAddr{
+			IP:   net.IPv4(sa4.Addr[0], sa4.Addr[1], sa4.Addr[2], sa4.Addr[3]),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+	case syscall.AF_INET6:
+		sa6 := (*syscall.RawSockaddrInet6)(unsafe.Pointer(sa))
+		port := (*[2]byte)(unsafe.Pointer(&sa6.Port))
+		addr := &net.UDPAddr{
+			IP:   append(net.IP(nil), sa6.Addr[:]...),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+		if sa6.Scope_id != 0 {
+			addr.Zone = strconv.Itoa(int(sa6.Scope_id))
+		}
+		return addr
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// Datagrams are read one at a time where recvmmsg isn't available.
+func newUDPBatchReader(conn net.PacketConn, size int) udpBatchReader {
+	return udpSingleReader{conn: conn}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// A datagram waiting to be sent to a backend, from the client at addr. closed
+// is closed when the listener it was read from is shut down, so a failed
+// write can be told apart from a closed listener.
+type udpPacket struct {
+	buf    []byte
+	n      int
+	addr   net.Addr
+	conn   net.PacketConn
+	closed <-chan struct{}
+}
+
+// Reuse packet buffers between the read loop and the writers.
+var udpPackets sync.Pool
+
+// Get a packet with a buffer of at least size bytes.
+func getUDPPacket(size int) *udpPacket {
+	p, _ := udpPackets.Get().(*udpPacket)
+	if p == nil {
+		p = &udpPacket{}
+	}
+	if cap(p.buf) < size {
+		p.buf = make([]byte, size)
+	}
+	p.buf = p.buf[:size]
+	return p
+}
+
+func putUDPPacket(p *udpPacket) {
+	p.addr = nil
+	p.conn = nil
+	p.closed = nil
+	udpPackets.Put(p)
+}
+
+// udpQueue is a bounded queue of datagrams for one backend, sent by its own
+// writer goroutine. The read loop never waits on a backend: a datagram for a
+// full queue is dropped and counted, so a slow backend only loses its own
+// traffic.
+type udpQueue struct {
+	packets chan *udpPacket
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	// closed once the writer has returned
+	done chan struct{}
+
+	// datagrams dropped because the queue was full, and the total time in
+	// nanoseconds the writer spent blocked sending. Used atomically.
+	dropped int64
+	stall   int64
+}
+
+func newUDPQueue(size int) *udpQueue {
+	return &udpQueue{
+		packets: make(chan *udpPacket, size),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Queue p to be sent, or drop it if the queue is full. The queue owns p if
+// it's accepted.
+func (q *udpQueue) enqueue(p *udpPacket) bool {
+	select {
+	case q.packets <- p:
+		return true
+	default:
+		atomic.AddInt64(&q.dropped, 1)
+		return false
+	}
+}
+
+// Stop the writer once it has sent the datagrams already queued. Datagrams
+// for a listener that's been closed are discarded.
+func (q *udpQueue) close() {
+	q.stopOnce.Do(func() { close(q.stop) })
+}
+
+func (q *udpQueue) stats() UDPQueueStat {
+	return UDPQueueStat{
+		Queued:  len(q.packets),
+		Size:    cap(q.packets),
+		Dropped: atomic.LoadInt64(&q.dropped),
+		Stall:   atomic.LoadInt64(&q.stall) / int64(time.Millisecond),
+	}
+}
+
+// The send queue of a UDP backend, or nil.
+func (b *Backend) sendQueue() *udpQueue {
+	q, _ := b.udpQueue.Load().(*udpQueue)
+	return q
+}
+
+// Start a send queue of size datagrams for the backend, replacing any it
+// already has. The old queue's writer finishes sending what it holds.
+// Service *must* be locked.
+func (s *Service) startUDPQueue(b *Backend, size int) {
+	q := newUDPQueue(size)
+	old := b.sendQueue()
+	if old != nil {
+		// keep the backend's totals
+		q.dropped = atomic.LoadInt64(&old.dropped)
+		q.stall = atomic.LoadInt64(&old.stall)
+	}
+	b.udpQueue.Store(q)
+	goTask("udp_writer", s.Name+"/"+b.Name, func() { s.runUDPWriter(b, q) })
+	if old != nil {
+		old.close()
+	}
+}
+
+// Send the datagrams queued for a backend until the queue is stopped.
+func (s *Service) runUDPWriter(b *Backend, q *udpQueue) {
+	defer close(q.done)
+	for {
+		select {
+		case p := <-q.packets:
+			s.sendUDP(b, q, p)
+		case <-q.stop:
+			for {
+				select {
+				case p := <-q.packets:
+					s.sendUDP(b, q, p)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Service) sendUDP(b *Backend, q *udpQueue, p *udpPacket) {
+	defer putUDPPacket(p)
+
+	sess, err := s.udpSession(b, p)
+	if err != nil {
+		log.Debugf("Dropping datagram for %s: %s", b.Name, err)
+		atomic.AddInt64(&s.Errors, 1)
+		return
+	}
+	if sess == nil {
+		// the session table is full, and the datagram was counted
+		return
+	}
+
+	start := time.Now()
+	n, err := sess.conn.WriteTo(p.buf[:p.n], b.udpAddr)
+	atomic.AddInt64(&q.stall, int64(time.Since(start)))
+
+	if err == nil {
+		atomic.AddInt64(&b.Sent, int64(n))
+		atomic.AddInt64(&s.UDPDatagramsOut, 1)
+		atomic.AddInt64(&b.Datagrams, 1)
+		return
+	}
+
+	select {
+	case <-p.closed:
+		// the listener was shut down, and the rest of the queue is discarded
+		// the same way
+		return
+	default:
+	}
+
+	// the socket may be bound to an address that's gone, so the next
+	// datagram opens another session
+	s.udpSessions.remove(sess)
+
+	if msgTooLong(err) {
+		log.Debugf("Datagram too long for %s: %s", b.Name, err)
+		atomic.AddInt64(&s.UDPMsgTooLong, 1)
+		return
+	}
+	if err, ok := err.(net.Error); ok && err.Temporary() {
+		log.Warnf("WARN: %s", err.Error())
+		return
+	}
+
+	log.Errorf("ERROR: %s", err.Error())
+	atomic.AddInt64(&s.Errors, 1)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/litl/shuttle/log"
+)
+
+var ErrInvalidUDPWorkers = fmt.Errorf("invalid udp_workers")
+
+// The most datagrams a worker reads with one call, where the platform can
+// read more than one.
+var udpBatchSize = 32
+
+// udpReaders are the workers reading datagrams from one UDP listener. Each
+// has its own packets, so they share nothing but the service and the
+// backends' queues.
+type udpReaders struct {
+	conn   net.PacketConn
+	closed chan struct{}
+	// the workers running, used atomically
+	running int64
+}
+
+// Start workers reading the service's UDP listener until there are
+// UDPWorkers.
+// Service *must* be locked.
+func (s *Service) startUDPReaders(r *udpReaders) {
+	for atomic.LoadInt64(&r.running) < atomic.LoadInt64(&s.UDPWorkers) {
+		atomic.AddInt64(&r.running, 1)
+		goTask("udp_reader", s.Name, func() { s.runUDP(r) })
+	}
+}
+
+// Report whether a worker should stop, because there are more than
+// UDPWorkers. A worker that should stop is no longer counted as running.
+func (s *Service) udpReaderDone(r *udpReaders) bool {
+	for {
+		running := atomic.LoadInt64(&r.running)
+		if running <= atomic.LoadInt64(&s.UDPWorkers) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&r.running, running, running-1) {
+			return true
+		}
+	}
+}
+
+// Read datagrams from clients, and queue each for a backend. The workers
+// never send, so a slow backend can't hold up the others.
+func (s *Service) runUDP(r *udpReaders) {
+	batch := newUDPBatchReader(r.conn, udpBatchSize)
+	packets := make([]*udpPacket, batch.size())
+	defer func() {
+		for _, p := range packets {
+			if p != nil {
+				putUDPPacket(p)
+			}
+		}
+	}()
+
+	for {
+		// The extra byte is only filled by a datagram larger than the buffer
+		// size, which we treat as truncated.
+		size := int(atomic.LoadInt64(&s.UDPBufferSize))
+		for i, p := range packets {
+			if p != nil && len(p.buf) == size+1 {
+				continue
+			}
+			if p != nil {
+				putUDPPacket(p)
+			}
+			packets[i] = getUDPPacket(size + 1)
+		}
+
+		n, err := batch.read(packets)
+		if err != nil {
+			select {
+			case <-r.closed:
+				// normal shutdown
+				atomic.AddInt64(&r.running, -1)
+				return
+			default:
+			}
+
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				log.Warnf("WARN: %s", err.Error())
+				continue
+			}
+			// unexpected error, log it before exiting
+			log.Errorf("ERROR: %s", err.Error())
+			atomic.AddInt64(&s.Errors, 1)
+			atomic.AddInt64(&r.running, -1)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			s.forwardUDP(packets[i], size, r)
+			packets[i] = nil
+		}
+
+		if s.udpReaderDone(r) {
+			return
+		}
+	}
+}
+
+// Queue a datagram read from a client for a backend, or drop it. The packet
+// is owned by the backend's queue if it's accepted, and returned to the pool
+// otherwise.
+func (s *Service) forwardUDP(p *udpPacket, size int, r *udpReaders) {
+	if p.n == 0 {
+		putUDPPacket(p)
+		return
+	}
+
+	atomic.AddInt64(&s.UDPDatagramsIn, 1)
+
+	var clientIP net.IP
+	if udpAddr, ok := p.addr.(*net.UDPAddr); ok {
+		clientIP = udpAddr.IP
+	}
+	if !s.clientAllowed(clientAddr{IP: clientIP}) {
+		putUDPPacket(p)
+		return
+	}
+	s.udpClients.add(p.addr)
+
+	n := p.n
+	truncated := n > size
+	if truncated {
+		atomic.AddInt64(&s.UDPTruncated, 1)
+		n = size
+	}
+	atomic.AddInt64(&s.Rcvd, int64(n))
+
+	max := atomic.LoadInt64(&s.MaxDatagramSize)
+	if max > 0 && (truncated || int64(n) > max) {
+		atomic.AddInt64(&s.UDPOversize, 1)
+		putUDPPacket(p)
+		return
+	}
+
+	backend := s.udpNext(clientIP)
+	if backend == nil {
+		// already counted, and logged at a limited rate
+		putUDPPacket(p)
+		return
+	}
+
+	q := backend.sendQueue()
+	if q == nil {
+		putUDPPacket(p)
+		return
+	}
+
+	p.n = n
+	p.conn = r.conn
+	p.closed = r.closed
+	if !q.enqueue(p) {
+		putUDPPacket(p)
+	}
+}
+
+// A udpBatchReader reads as many datagrams as are waiting, up to its size,
+// setting the length and client address of each packet. It blocks until at
+// least one arrives.
+type udpBatchReader interface {
+	size() int
+	read(packets []*udpPacket) (int, error)
+}
+
+// udpSingleReader reads one datagram at a time, for listeners that can't
+// read batches.
+type udpSingleReader struct {
+	conn net.PacketConn
+}
+
+func (u udpSingleReader) size() int {
+	return 1
+}
+
+func (u udpSingleReader) read(packets []*udpPacket) (int, error) {
+	p := packets[0]
+	n, addr, err := u.conn.ReadFrom(p.buf)
+	if err != nil {
+		return 0, err
+	}
+	p.n = n
+	p.addr = addr
+	return 1, nil
+}
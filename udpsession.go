@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+var (
+	ErrInvalidUDPSessions = fmt.Errorf("invalid UDP session config")
+	ErrNoUDPAddr          = fmt.Errorf("backend has no UDP address")
+)
+
+// A UDP session carries a client's datagrams to one backend, and relays the
+// backend's replies back to the client through the listener it sent to. Each
+// session has a socket of its own, so a reply is matched to its client
+// without looking inside it. A session is closed once nothing has passed in
+// either direction for the service's UDPIdleTimeout.
+type udpSessionKey struct {
+	client  string
+	backend *Backend
+}
+
+type udpSession struct {
+	key      udpSessionKey
+	client   net.Addr
+	conn     net.PacketConn
+	listener net.PacketConn
+	closed   <-chan struct{}
+	// the interface address the socket is bound to, if any
+	ip net.IP
+
+	// the time of the last datagram either way, in unix nanoseconds. Used
+	// atomically.
+	last int64
+}
+
+func (u *udpSession) touch() {
+	atomic.StoreInt64(&u.last, time.Now().UnixNano())
+}
+
+func (u *udpSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&u.last))
+}
+
+// udpSessions is the table of a service's UDP sessions. It's bounded, so a
+// flood of spoofed client addresses can't open sockets without limit.
+type udpSessions struct {
+	sync.Mutex
+	sessions     map[udpSessionKey]*udpSession
+	idle         time.Duration
+	max          int
+	dontFragment bool
+
+	// sessions opened and expired, datagrams dropped because the table was
+	// full, and replies relayed to clients. Used atomically.
+	opened  int64
+	expired int64
+	full    int64
+	replies int64
+}
+
+func newUDPSessions(idle time.Duration, max int) *udpSessions {
+	return &udpSessions{
+		sessions: make(map[udpSessionKey]*udpSession),
+		idle:     idle,
+		max:      max,
+	}
+}
+
+// Change the limits for the table. Sessions over a lowered maximum are left
+// to expire.
+func (t *udpSessions) setLimits(idle time.Duration, max int) {
+	t.Lock()
+	defer t.Unlock()
+	t.idle = idle
+	t.max = max
+}
+
+// Set the DF bit on the sockets of sessions opened from now on.
+func (t *udpSessions) setDontFragment(df bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.dontFragment = df
+}
+
+func (t *udpSessions) idleTimeout() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.idle
+}
+
+// Forget a session and close its socket.
+func (t *udpSessions) remove(sess *udpSession) {
+	t.Lock()
+	if t.sessions[sess.key] == sess {
+		delete(t.sessions, sess.key)
+	}
+	t.Unlock()
+	sess.conn.Close()
+}
+
+// Close every session, when the listener their replies go through is closed.
+func (t *udpSessions) closeAll() {
+	t.Lock()
+	defer t.Unlock()
+	for key, sess := range t.sessions {
+		sess.conn.Close()
+		delete(t.sessions, key)
+	}
+}
+
+func (t *udpSessions) len() int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.sessions)
+}
+
+// Return the session for a datagram to b, opening one if there's room. The
+// session is nil if the table is full, and the datagram is counted as
+// dropped.
+func (s *Service) udpSession(b *Backend, p *udpPacket) (*udpSession, error) {
+	ip, err := b.bindIP(b.Network, b.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	t := s.udpSessions
+	key := udpSessionKey{client: p.addr.String(), backend: b}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if sess := t.sessions[key]; sess != nil && sess.listener == p.conn && sess.ip.Equal(ip) {
+		sess.touch()
+		return sess, nil
+	} else if sess != nil {
+		// the client sent to a listener that's since been replaced, or the
+		// backend's interface address changed
+		delete(t.sessions, key)
+		sess.conn.Close()
+	}
+
+	if len(t.sessions) >= t.max {
+		atomic.AddInt64(&t.full, 1)
+		return nil, nil
+	}
+
+	conn, ip, err := s.sessionConn(b, ip, t.dontFragment)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &udpSession{
+		key:      key,
+		client:   p.addr,
+		conn:     conn,
+		listener: p.conn,
+		closed:   p.closed,
+		ip:       ip,
+	}
+	sess.touch()
+	t.sessions[key] = sess
+	atomic.AddInt64(&t.opened, 1)
+
+	udpRelayTasks.goTask(func() { s.relayUDP(sess) })
+	return sess, nil
+}
+
+// Open a socket to send a session's datagrams to b from, bound to ip if the
+// backend has an interface. If the interface's address has just gone, it's
+// looked up again. Returns the address the socket was bound to.
+func (s *Service) sessionConn(b *Backend, ip net.IP, df bool) (net.PacketConn, net.IP, error) {
+	if b.udpAddr == nil {
+		return nil, nil, ErrNoUDPAddr
+	}
+
+	conn, err := s.listenSession(b, ip)
+	if err != nil && addrNotAvail(err) && ip != nil {
+		interfaces.refresh(b.binding().name)
+		if ip, err = b.bindIP(b.Network, b.Addr); err != nil {
+			return nil, nil, err
+		}
+		conn, err = s.listenSession(b, ip)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if df {
+		if err := setDontFragment(conn, true); err != nil {
+			log.Debugf("cannot set don't fragment for %s: %s", b.Name, err)
+		}
+	}
+	return conn, ip, nil
+}
+
+func (s *Service) listenSession(b *Backend, ip net.IP) (net.PacketConn, error) {
+	host := ""
+	if ip != nil {
+		host = ip.String()
+	}
+	return s.ListenerFactory.ListenPacket(b.Network, net.JoinHostPort(host, "0"))
+}
+
+// Relay the backend's replies to the session's client, until the session has
+// been idle for the timeout or is closed.
+func (s *Service) relayUDP(sess *udpSession) {
+	t := s.udpSessions
+	defer t.remove(sess)
+
+	b := sess.key.backend
+	buf := make([]byte, atomic.LoadInt64(&s.UDPBufferSize))
+	for {
+		sess.conn.SetReadDeadline(sess.idleSince().Add(t.idleTimeout()))
+
+		n, addr, err := sess.conn.ReadFrom(buf)
+		if err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				if time.Since(sess.idleSince()) < t.idleTimeout() {
+					// the client sent something since the deadline was set
+					continue
+				}
+				atomic.AddInt64(&t.expired, 1)
+				return
+			}
+			select {
+			case <-sess.closed:
+				return
+			default:
+			}
+			if err, ok := err.(net.Error); ok && err.Temporary() {
+				continue
+			}
+			// closed with the rest of the table, or replaced
+			return
+		}
+
+		// anything but the backend's replies is dropped
+		if !sameAddr(addr, b.udpAddr) {
+			continue
+		}
+		sess.touch()
+		atomic.AddInt64(&b.Rcvd, int64(n))
+
+		n, err = sess.listener.WriteTo(buf[:n], sess.client)
+		if err != nil {
+			select {
+			case <-sess.closed:
+				return
+			default:
+			}
+			log.Debugf("Dropping reply from %s to %s: %s", b.Name, sess.client, err)
+			atomic.AddInt64(&s.Errors, 1)
+			continue
+		}
+		atomic.AddInt64(&s.Sent, int64(n))
+		atomic.AddInt64(&t.replies, 1)
+	}
+}
+
+// Compare two addresses, treating an IPv4 address and its IPv6 mapping as the
+// same.
+func sameAddr(a, b net.Addr) bool {
+	ua, aok := a.(*net.UDPAddr)
+	ub, bok := b.(*net.UDPAddr)
+	if aok && bok {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP)
+	}
+	return a.String() == b.String()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// HyperLogLog precision: 2^12 registers of one byte each, for a standard
+	// error of about 1.6%.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+
+	// the number of sketches covering the flow idle timeout, which is the
+	// resolution of flow expiry
+	flowSlots = 8
+)
+
+// How long unique UDP clients are counted for before the count starts again.
+var udpClientWindow = time.Minute
+
+// hll estimates the number of distinct hashes added to it, in a fixed amount
+// of memory.
+type hll [hllRegisters]uint8
+
+func (h *hll) add(hash uint64) {
+	idx := hash >> (64 - hllPrecision)
+	// the position of the first set bit in the remaining bits
+	rank := uint8(1)
+	for w := hash << hllPrecision; w&(1<<63) == 0 && rank <= 64-hllPrecision; w <<= 1 {
+		rank++
+	}
+	if rank > h[idx] {
+		h[idx] = rank
+	}
+}
+
+// Add the hashes counted by other.
+func (h *hll) merge(other *hll) {
+	for i, r := range other {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+func (h *hll) reset() {
+	*h = hll{}
+}
+
+func (h *hll) estimate() int64 {
+	m := float64(hllRegisters)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	est := alpha * m * m / sum
+	// small cardinalities are more accurate by counting the empty registers
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(est + 0.5)
+}
+
+// Hash a client address without allocating for UDP addresses.
+func hashAddr(addr net.Addr) uint64 {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	mix := func(b byte) {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+
+	if ua, ok := addr.(*net.UDPAddr); ok {
+		ip := ua.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		for _, b := range ip {
+			mix(b)
+		}
+		mix(byte(ua.Port >> 8))
+		mix(byte(ua.Port))
+	} else {
+		for _, b := range []byte(addr.String()) {
+			mix(b)
+		}
+	}
+
+	// FNV's high bits are poorly distributed for short inputs, and the sketch
+	// uses them for the register index
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// udpClients counts the distinct client addresses sending to a UDP service in
+// the current window, and the active flows: the clients that have sent a
+// datagram within the idle timeout. Both are estimated in fixed memory, so a
+// flood of spoofed addresses can't grow it.
+type udpClients struct {
+	sync.Mutex
+
+	window      time.Duration
+	windowStart time.Time
+	unique      hll
+	// the count for the last complete window
+	lastUnique int64
+
+	// Each slot covers idle/flowSlots, and a flow is active while a slot it
+	// was seen in is within the last flowSlots slots.
+	idle      time.Duration
+	slots     [flowSlots]hll
+	slotEpoch [flowSlots]int64
+
+	// the clock, replaced in tests
+	now func() time.Time
+}
+
+func newUDPClients(idle time.Duration) *udpClients {
+	u := &udpClients{
+		window: udpClientWindow,
+		idle:   idle,
+		now:    time.Now,
+	}
+	u.windowStart = u.now().Truncate(u.window)
+	return u
+}
+
+// Record a datagram from addr.
+func (u *udpClients) add(addr net.Addr) {
+	hash := hashAddr(addr)
+
+	u.Lock()
+	defer u.Unlock()
+
+	now := u.now()
+	u.rotate(now)
+	u.unique.add(hash)
+
+	epoch := u.epoch(now)
+	slot := &u.slots[epoch%flowSlots]
+	if u.slotEpoch[epoch%flowSlots] != epoch {
+		slot.reset()
+		u.slotEpoch[epoch%flowSlots] = epoch
+	}
+	slot.add(hash)
+}
+
+// Start a new window for unique clients if the current one is over. Must be
+// called with the lock held.
+func (u *udpClients) rotate(now time.Time) {
+	if now.Sub(u.windowStart) < u.window {
+		return
+	}
+	// an idle service may have skipped whole windows
+	if now.Sub(u.windowStart) < 2*u.window {
+		u.lastUnique = u.unique.estimate()
+	} else {
+		u.lastUnique = 0
+	}
+	u.unique.reset()
+	u.windowStart = now.Truncate(u.window)
+}
+
+// The slot number for t.
+func (u *udpClients) epoch(t time.Time) int64 {
+	return t.UnixNano() / int64(u.idle/flowSlots)
+}
+
+// Change the flow idle timeout. The active flows are forgotten, since the
+// slots no longer cover the right times.
+func (u *udpClients) setIdle(idle time.Duration) {
+	u.Lock()
+	defer u.Unlock()
+	if idle == u.idle {
+		return
+	}
+	u.idle = idle
+	u.slots = [flowSlots]hll{}
+	u.slotEpoch = [flowSlots]int64{}
+}
+
+// Return the estimated unique clients in the current and last windows, and
+// the active flows.
+func (u *udpClients) counts() (unique, lastUnique, active int64) {
+	u.Lock()
+	defer u.Unlock()
+
+	now := u.now()
+	u.rotate(now)
+
+	var flows hll
+	epoch := u.epoch(now)
+	for i := range u.slots {
+		if epoch-u.slotEpoch[i] < flowSlots {
+			flows.merge(&u.slots[i])
+		}
+	}
+	return u.unique.estimate(), u.lastUnique, flows.estimate()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Requests for a Host that isn't registered are remembered for a while, so a
+// client retrying a retired hostname is answered without a registry lookup.
+// The cache is dropped whenever a vhost is registered or removed.
+var (
+	unknownHostTTL    = 10 * time.Second
+	unknownHostCache  = 1024
+	unknownHostCounts = 100
+)
+
+// The number of unknown hosts reported by default.
+const defaultUnknownHostsTop = 20
+
+var unknownVHosts = newUnknownHosts(unknownHostCache, unknownHostCounts)
+
+type unknownHostEntry struct {
+	host    string
+	gen     uint64
+	expires time.Time
+}
+
+// unknownHosts is an LRU cache of hosts that matched no vhost, with the
+// number of requests for each of the busiest of them.
+type unknownHosts struct {
+	sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// request counts, bounded to the busiest maxCounts hosts. A host replacing
+	// the least requested takes over its count, so a count may overstate the
+	// requests for a host, but never understates them.
+	maxCounts int
+	counts    map[string]int64
+}
+
+func newUnknownHosts(size, maxCounts int) *unknownHosts {
+	return &unknownHosts{
+		size:      size,
+		lru:       list.New(),
+		entries:   make(map[string]*list.Element),
+		maxCounts: maxCounts,
+		counts:    make(map[string]int64),
+	}
+}
+
+// Report whether host was recently found unknown, while the vhosts were at
+// generation gen, and count the request if so.
+func (u *unknownHosts) cached(host string, gen uint64) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	el := u.entries[host]
+	if el == nil {
+		return false
+	}
+	e := el.Value.(*unknownHostEntry)
+	if e.gen != gen || time.Now().After(e.expires) {
+		u.lru.Remove(el)
+		delete(u.entries, host)
+		return false
+	}
+	u.lru.MoveToFront(el)
+	u.count(host)
+	return true
+}
+
+// Remember a host that matched no vhost at generation gen, and count the
+// request.
+func (u *unknownHosts) miss(host string, gen uint64) {
+	u.Lock()
+	defer u.Unlock()
+
+	u.count(host)
+	if u.size <= 0 {
+		return
+	}
+
+	expires := time.Now().Add(unknownHostTTL)
+	if el := u.entries[host]; el != nil {
+		e := el.Value.(*unknownHostEntry)
+		e.gen, e.expires = gen, expires
+		u.lru.MoveToFront(el)
+		return
+	}
+
+	u.entries[host] = u.lru.PushFront(&unknownHostEntry{host: host, gen: gen, expires: expires})
+	for u.lru.Len() > u.size {
+		oldest := u.lru.Back()
+		u.lru.Remove(oldest)
+		delete(u.entries, oldest.Value.(*unknownHostEntry).host)
+	}
+}
+
+// unknownHosts *must* be locked.
+func (u *unknownHosts) count(host string) {
+	if _, ok := u.counts[host]; ok || len(u.counts) < u.maxCounts {
+		u.counts[host]++
+		return
+	}
+	if u.maxCounts <= 0 {
+		return
+	}
+
+	least, min := "", int64(-1)
+	for h, n := range u.counts {
+		if min < 0 || n < min {
+			least, min = h, n
+		}
+	}
+	delete(u.counts, least)
+	u.counts[host] = min + 1
+}
+
+// UnknownHost is the number of requests for a Host that matched no vhost.
+type UnknownHost struct {
+	Host     string `json:"host"`
+	Requests int64  `json:"requests"`
+}
+
+// UnknownHostStats reports the hosts cached as unknown, and the busiest
+// unknown hosts.
+type UnknownHostStats struct {
+	Cached int           `json:"cached"`
+	Hosts  []UnknownHost `json:"hosts"`
+}
+
+// Return up to n of the busiest unknown hosts, busiest first.
+func (u *unknownHosts) stats(n int) UnknownHostStats {
+	u.Lock()
+	defer u.Unlock()
+
+	hosts := make([]UnknownHost, 0, len(u.counts))
+	for h, c := range u.counts {
+		hosts = append(hosts, UnknownHost{Host: h, Requests: c})
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if hosts[i].Requests != hosts[j].Requests {
+			return hosts[i].Requests > hosts[j].Requests
+		}
+		return hosts[i].Host < hosts[j].Host
+	})
+	if n > 0 && len(hosts) > n {
+		hosts = hosts[:n]
+	}
+	return UnknownHostStats{Cached: u.lru.Len(), Hosts: hosts}
+}
+
+// Answer a request for a host already known to be unknown, without a lookup,
+// request ID, or access log entry.
+func serveUnknownHost(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintln(w, "Not found")
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/litl/shuttle/log"
+)
+
+// Report whether a request asks to switch protocols, such as a WebSocket
+// handshake.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Report whether a response is a stream of server-sent events, which may
+// stay open indefinitely like an upgraded connection.
+func isEventStream(res *http.Response) bool {
+	mediaType := strings.TrimSpace(strings.Split(res.Header.Get("Content-Type"), ";")[0])
+	return strings.EqualFold(mediaType, "text/event-stream")
+}
+
+// Proxy a request to switch protocols. The request is written to a
+// connection from Dial, so the backend's stats and the server timeout apply
+// as they do to other requests. The response goes through the OnResponse
+// callbacks like any other, and if the backend switched protocols, the
+// client's connection is hijacked and relayed to the backend's until either
+// closes.
+func (p *ReverseProxy) serveUpgrade(pr *ProxyRequest, chain *CallbackChain) {
+	rw := pr.ResponseWriter
+
+	pr.StartTime = time.Now()
+	srvConn, srvBuf, res, err := p.upgradeRequest(pr)
+	pr.FinishTime = time.Now()
+
+	pr.Response = res
+	pr.ProxyError = err
+	if err != nil {
+		log.Printf("http: proxy error: %v", err)
+		res = errorResponse(pr)
+		pr.Response = res
+	}
+	defer res.Body.Close()
+
+	// the connections are closed by the relay once it starts
+	relayed := false
+	defer func() {
+		if srvConn != nil && !relayed {
+			srvConn.Close()
+		}
+	}()
+
+	upgrade := res.Header.Get("Upgrade")
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+	copyHeader(rw.Header(), res.Header)
+
+	for _, f := range chain.OnResponse {
+		cont := f(pr)
+		if !cont {
+			return
+		}
+	}
+
+	// the backend refused to switch, so this is an ordinary response
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		rw.WriteHeader(res.StatusCode)
+		pr.ResponseBytes, err = io.Copy(rw, res.Body)
+		if err != nil {
+			log.Warnf("id=%s transfer error: %s", requestID(pr.Request), err)
+		}
+		return
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		log.Errorf("ERROR: id=%s can't switch protocols: connection can't be hijacked", requestID(pr.Request))
+		rw.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	cliConn, cliBuf, err := hj.Hijack()
+	if err != nil {
+		log.Errorf("ERROR: id=%s can't switch protocols: %s", requestID(pr.Request), err)
+		return
+	}
+	defer func() {
+		if !relayed {
+			cliConn.Close()
+		}
+	}()
+
+	// the server's deadlines for the request don't apply to the stream
+	cliConn.SetDeadline(time.Time{})
+
+	header := rw.Header()
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", upgrade)
+	fmt.Fprintf(cliBuf, "HTTP/1.1 %s\r\n", res.Status)
+	header.Write(cliBuf)
+	cliBuf.WriteString("\r\n")
+	if err := cliBuf.Flush(); err != nil {
+		log.Warnf("id=%s transfer error: %s", requestID(pr.Request), err)
+		return
+	}
+
+	// pass on anything either side sent along with the handshake
+	if err := flushBuffered(cliConn, srvBuf); err != nil {
+		return
+	}
+	if err := flushBuffered(srvConn, cliBuf.Reader); err != nil {
+		return
+	}
+
+	// the time limit covers the stream, unless streams are allowed
+	if pr.MaxTime > 0 && !pr.AllowStreaming {
+		limit := time.AfterFunc(pr.MaxTime-time.Since(pr.StartTime), func() {
+			atomic.StoreInt32(&pr.maxTimeExceeded, 1)
+			srvConn.Close()
+			cliConn.Close()
+		})
+		defer limit.Stop()
+	}
+
+	relayed = true
+	p.relay(srvConn, cliConn)
+}
+
+// Dial a backend for the request, write the request to it, and read the
+// backend's response.
+func (p *ReverseProxy) upgradeRequest(pr *ProxyRequest) (*shuttleConn, *bufio.Reader, *http.Response, error) {
+	picker := pr.Picker
+	if picker == nil {
+		picker = &addrPicker{addrs: pr.Backends}
+	}
+
+	var conn net.Conn
+	var err error
+	for {
+		addr, ok := pr.nextAttempt(picker)
+		if !ok {
+			break
+		}
+
+		conn, err = p.Dial(pr.Request.Context(), "tcp", addr)
+		if err == nil {
+			break
+		}
+		if _, ok := err.(DialError); !ok {
+			return nil, nil, nil, err
+		}
+	}
+	if conn == nil {
+		if err == nil {
+			err = fmt.Errorf("no http backends available")
+		}
+		return nil, nil, nil, err
+	}
+	srvConn, ok := conn.(*shuttleConn)
+	if !ok {
+		srvConn = &shuttleConn{Conn: conn, read: new(int64), written: new(int64)}
+	}
+	// the upgraded connection is captured as a stream, like a TCP service
+	srvConn.capture = pickerCapture(picker, pr.Request.RemoteAddr)
+
+	outreq := pr.Request.Clone(pr.Request.Context())
+	for _, h := range hopHeaders {
+		outreq.Header.Del(h)
+	}
+	outreq.Header.Set("Connection", "Upgrade")
+	outreq.Header.Set("Upgrade", pr.Request.Header.Get("Upgrade"))
+	p.Director(outreq)
+	// don't add a User-Agent the client didn't send
+	if _, ok := outreq.Header["User-Agent"]; !ok {
+		outreq.Header.Set("User-Agent", "")
+	}
+
+	if err := outreq.Write(srvConn); err != nil {
+		srvConn.Close()
+		return nil, nil, nil, err
+	}
+
+	srvBuf := bufio.NewReader(srvConn)
+	res, err := http.ReadResponse(srvBuf, outreq)
+	if err != nil {
+		srvConn.Close()
+		return nil, nil, nil, err
+	}
+	pr.ResponseWriter.Header().Set("X-Backend", pr.Attempted[len(pr.Attempted)-1])
+	return srvConn, srvBuf, res, nil
+}
+
+// Write the bytes already read into r to dst.
+func flushBuffered(dst net.Conn, r *bufio.Reader) error {
+	n := r.Buffered()
+	if n == 0 {
+		return nil
+	}
+	buffered, _ := r.Peek(n)
+	_, err := dst.Write(buffered)
+	return err
+}
+
+// Copy between the client and backend connections until one of them closes,
+// as Backend.Proxy does for TCP services. The backend connection already
+// counts the bytes and applies the server timeout. The client's connection
+// is given the client timeout.
+func (p *ReverseProxy) relay(srvConn *shuttleConn, cliConn net.Conn) {
+	var cliRead, cliWritten, errors int64
+	client := &shuttleConn{
+		Conn:        cliConn,
+		rwTimeout:   p.ClientTimeout.Get(),
+		liveTimeout: p.ClientTimeout,
+		read:        &cliRead,
+		written:     &cliWritten,
+	}
+
+	errCount := &errors
+	if srvConn.backend != nil {
+		errCount = &srvConn.backend.Errors
+	}
+
+	backendClosed := make(chan bool, 1)
+	clientClosed := make(chan bool, 1)
+
+	tcpBrokerTasks.goTask(func() { broker(srvConn, client, clientClosed, srvConn.written, errCount) })
+	tcpBrokerTasks.goTask(func() { broker(client, srvConn, backendClosed, srvConn.read, errCount) })
+
+	// once one side closes, stop reading from the other
+	var waitFor chan bool
+	select {
+	case <-clientClosed:
+		srvConn.CloseRead()
+		waitFor = backendClosed
+	case <-backendClosed:
+		client.CloseRead()
+		waitFor = clientClosed
+	}
+	<-waitFor
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strings"
 )
 
 // marshal whatever we've got with out default indentation
@@ -25,17 +24,36 @@ func genId() string {
 	return fmt.Sprintf("%x", b)
 }
 
-// remove empty strings from a []string
-func filterEmpty(a []string) []string {
-	removed := 0
-	for i := 0; i < len(a); i++ {
-		if removed > 0 {
-			a[i-removed] = a[i]
-		}
-		if len(strings.TrimSpace(a[i])) == 0 {
-			removed++
+// The Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
 		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
 
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
 	}
-	return a[:len(a)-removed]
+	return a
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+// When this shuttle process started.
+var startTime = time.Now()
+
+// VersionInfo describes the running shuttle, as returned by /_version.
+type VersionInfo struct {
+	Version    string    `json:"version"`
+	Commit     string    `json:"commit"`
+	GoVersion  string    `json:"go_version"`
+	Started    time.Time `json:"started"`
+	Uptime     int64     `json:"uptime"` // in seconds
+	Goroutines int       `json:"goroutines"`
+	ConfigHash string    `json:"config_hash"`
+}
+
+func uptime() int64 {
+	return int64(time.Since(startTime) / time.Second)
+}
+
+// Return a hash of the config, so two shuttles, or one before and after a
+// config change, can be compared without diffing the full config. The
+// services and their backends are sorted by name first, and json sorts the
+// map keys, so the hash doesn't depend on the order things were added in.
+func configHash(cfg client.Config) string {
+	services := make([]client.ServiceConfig, len(cfg.Services))
+	for i, svc := range cfg.Services {
+		backends := append([]client.BackendConfig(nil), svc.Backends...)
+		sort.Slice(backends, func(i, j int) bool { return backends[i].Name < backends[j].Name })
+		svc.Backends = backends
+		services[i] = svc
+	}
+	cfg.Services = services
+
+	sum := sha256.Sum256(cfg.Marshal())
+	return fmt.Sprintf("%x", sum)
+}
+
+func versionInfo() VersionInfo {
+	return VersionInfo{
+		Version:    buildVersion,
+		Commit:     buildCommit,
+		GoVersion:  runtime.Version(),
+		Started:    startTime,
+		Uptime:     uptime(),
+		Goroutines: runtime.NumGoroutine(),
+		ConfigHash: configHash(Registry.Config()),
+	}
+}
+
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	w.Write(marshal(versionInfo()))
+}
+
+// Add the uptime and config hash to a stats response. The stats body is a
+// list of services, so they're sent as headers.
+func setStatsHeaders(w http.ResponseWriter, cfg client.Config) {
+	w.Header().Set("X-Shuttle-Uptime", strconv.FormatInt(uptime(), 10))
+	w.Header().Set(client.ConfigHashHeader, configHash(cfg))
+}
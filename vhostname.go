@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidVHost   = fmt.Errorf("invalid virtual host")
+	ErrDuplicateVHost = fmt.Errorf("duplicate virtual host")
+)
+
+// The longest host name, and label, in the canonical form.
+const (
+	maxVHostLen = 253
+	maxLabelLen = 63
+)
+
+func invalidVHost(name, why string) error {
+	return fmt.Errorf("%w %q: %s", ErrInvalidVHost, name, why)
+}
+
+// Return the canonical form of a virtual host name, which is what's stored,
+// matched and reported: lowercase, without trailing dots, and with any
+// internationalized labels converted to punycode, so "BÜcher.example." is
+// "xn--bcher-kva.example". A leading "*" or "**" label is kept as it is.
+func canonicalVHost(name string) (string, error) {
+	host := strings.TrimRight(name, ".")
+	if host == "" {
+		return "", invalidVHost(name, "empty name")
+	}
+	if i := strings.IndexAny(host, ":/?#@\\"); i >= 0 {
+		if host[i] == ':' {
+			return "", invalidVHost(name, "names can't include a port")
+		}
+		return "", invalidVHost(name, "names can't include a path")
+	}
+
+	ascii, upper := true, false
+	for i := 0; i < len(host); i++ {
+		c := host[i]
+		if c >= utf8.RuneSelf {
+			ascii = false
+		} else if 'A' <= c && c <= 'Z' {
+			upper = true
+		}
+	}
+	if upper || !ascii {
+		host = strings.ToLower(host)
+	}
+
+	// names that are already canonical are checked without allocating
+	if ascii {
+		if err := checkLabels(name, host); err != nil {
+			return "", err
+		}
+		return host, nil
+	}
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		for _, r := range label {
+			if unicode.IsSpace(r) || unicode.IsControl(r) || r == utf8.RuneError {
+				return "", invalidVHost(name, fmt.Sprintf("invalid character %q", r))
+			}
+		}
+		labels[i] = "xn--" + punycode(label)
+	}
+	host = strings.Join(labels, ".")
+	if err := checkLabels(name, host); err != nil {
+		return "", err
+	}
+	return host, nil
+}
+
+// Check the labels of an ASCII host name.
+func checkLabels(name, host string) error {
+	if len(host) > maxVHostLen {
+		return invalidVHost(name, fmt.Sprintf("longer than %d characters", maxVHostLen))
+	}
+	for start, i := 0, 0; i <= len(host); i++ {
+		if i < len(host) && host[i] != '.' {
+			continue
+		}
+		label := host[start:i]
+		switch {
+		case label == "":
+			return invalidVHost(name, "empty label")
+		case (label == "*" || label == "**") && start == 0:
+		case len(label) > maxLabelLen:
+			return invalidVHost(name, fmt.Sprintf("label %q is longer than %d characters", label, maxLabelLen))
+		case label[0] == '-' || label[len(label)-1] == '-':
+			return invalidVHost(name, fmt.Sprintf("label %q starts or ends with a hyphen", label))
+		default:
+			for j := 0; j < len(label); j++ {
+				c := label[j]
+				if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+					return invalidVHost(name, fmt.Sprintf("invalid character %q", c))
+				}
+			}
+		}
+		start = i + 1
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Canonicalize the virtual hosts of a service, dropping empty names. Two
+// names for the same host are a conflict.
+func canonicalVHosts(names []string) ([]string, error) {
+	var hosts []string
+	seen := make(map[string]string, len(names))
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		host, err := canonicalVHost(name)
+		if err != nil {
+			return nil, err
+		}
+		if first, ok := seen[host]; ok {
+			return nil, fmt.Errorf("%w %q: %q and %q are the same host", ErrDuplicateVHost, host, first, name)
+		}
+		seen[host] = name
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// The canonical form of a request's Host, to look up its vhost. A host that
+// isn't a valid name can't match one, and is only lowercased.
+func requestVHost(host string) string {
+	if canonical, err := canonicalVHost(host); err == nil {
+		return canonical
+	}
+	return strings.ToLower(host)
+}
+
+// Match a request's canonical host against the virtual hosts that has finds.
+// The host itself comes first, then the wildcards for each of its suffixes,
+// longest first, where "*.example.com" matches one more label and
+// "**.example.com" any number. Returns the name matched, or "" if none is.
+func matchVHost(host string, has func(name string) bool) string {
+	if has(host) {
+		return host
+	}
+	if strings.HasPrefix(host, "*") {
+		return ""
+	}
+	for i, first := strings.IndexByte(host, '.'), true; i > 0; first = false {
+		suffix := host[i+1:]
+		if first && has("*."+suffix) {
+			return "*." + suffix
+		}
+		if has("**." + suffix) {
+			return "**." + suffix
+		}
+		j := strings.IndexByte(suffix, '.')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return ""
+}
+
+// Punycode, from RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// Encode a label as punycode, without the "xn--" prefix.
+func punycode(label string) string {
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := basic; h < len(runes); {
+		// the smallest code point not yet encoded
+		m := int(unicode.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+				continue
+			}
+			if int(r) > n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/litl/shuttle/client"
+)
+
+// ProbeHeader marks the request a vhost readiness check sends through the
+// router. The router answers it as soon as the vhost is resolved, naming the
+// service in the same header, so the probe never reaches a backend, the
+// service stats, the access log or billing. A probe without this process's
+// token is removed and the request is proxied as usual.
+const ProbeHeader = "X-Shuttle-Probe"
+
+var (
+	probeToken = genId() + genId()
+
+	// time allowed for the readiness self-request
+	selfRequestTimeout = time.Second
+)
+
+// Answer a readiness probe for svc. Returns false if req isn't one.
+func serveProbe(w http.ResponseWriter, req *http.Request, svc *Service) bool {
+	token := req.Header.Get(ProbeHeader)
+	if token == "" {
+		return false
+	}
+	req.Header.Del(ProbeHeader)
+	if token != probeToken {
+		return false
+	}
+
+	w.Header().Set(ProbeHeader, svc.Name)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// Check whether a virtual host is ready to receive traffic: it's routed to a
+// single service with a backend up, a TLS certificate for it remains valid for
+// at least minValidity if HTTPS is configured, and a request for it through
+// the router reaches the service.
+func (s *ServiceRegistry) VHostReady(host string, minValidity time.Duration) client.VHostReadiness {
+	host = requestVHost(host)
+
+	s.Lock()
+	var services []*Service
+	if vhost := s.lookupVHost(host); vhost != nil {
+		services = vhost.Services()
+	}
+	s.Unlock()
+
+	names := []string{}
+	up, total := 0, 0
+	for _, svc := range services {
+		names = append(names, svc.Name)
+		up += svc.Available()
+		total += len(svc.Config().Backends)
+	}
+
+	routing := client.ReadinessCheck{Name: client.ReadyRouting, OK: len(services) > 0}
+	if routing.OK {
+		routing.Detail = "routed to " + strings.Join(names, ", ")
+	} else {
+		routing.Detail = "no service registered"
+	}
+
+	backends := client.ReadinessCheck{
+		Name:   client.ReadyBackends,
+		OK:     up > 0,
+		Detail: fmt.Sprintf("%d of %d backends up", up, total),
+	}
+
+	owner := client.ReadinessCheck{Name: client.ReadyOwner, OK: len(services) <= 1}
+	if !owner.OK {
+		owner.Detail = "claimed by " + strings.Join(names, ", ")
+	}
+
+	report := client.VHostReadiness{
+		Host: host,
+		Checks: []client.ReadinessCheck{
+			routing,
+			backends,
+			certCheck(host, minValidity),
+			owner,
+			selfRequest(host),
+		},
+	}
+
+	report.Ready = true
+	for _, check := range report.Checks {
+		report.Ready = report.Ready && check.OK
+	}
+	return report
+}
+
+// Check the certificate the HTTPS router would present for host.
+func certCheck(host string, minValidity time.Duration) client.ReadinessCheck {
+	check := client.ReadinessCheck{Name: client.ReadyCertificate}
+	if httpsRouter == nil {
+		check.OK = true
+		check.Detail = "HTTPS not configured"
+		return check
+	}
+
+	cert := httpsRouter.Certificate(host)
+	if cert == nil {
+		check.Detail = "no certificate for " + host
+		return check
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		check.Detail = fmt.Sprintf("not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		check.Detail = fmt.Sprintf("expired %s", cert.NotAfter.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < minValidity:
+		check.Detail = fmt.Sprintf("expires %s, within %s", cert.NotAfter.Format(time.RFC3339), minValidity)
+	default:
+		check.OK = true
+		check.Detail = fmt.Sprintf("expires %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	return check
+}
+
+// Return the certificate that is valid for host, with the latest expiry, or
+// nil if there isn't one.
+func (r *HostRouter) Certificate(host string) *x509.Certificate {
+	// the virtual host's own certificate is always presented
+	vhostCert := Registry.VHostCertificate(host)
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.server.TLSConfig == nil {
+		return nil
+	}
+	if vhostCert != nil {
+		return certLeaf(vhostCert)
+	}
+
+	var found *x509.Certificate
+	for i := range r.server.TLSConfig.Certificates {
+		leaf := certLeaf(&r.server.TLSConfig.Certificates[i])
+		if leaf == nil || leaf.VerifyHostname(host) != nil {
+			continue
+		}
+		if found == nil || leaf.NotAfter.After(found.NotAfter) {
+			found = leaf
+		}
+	}
+	return found
+}
+
+// Send a probe for host through the HTTP router, or the HTTPS router if
+// there's no HTTP router, and check that it reaches a service.
+func selfRequest(host string) client.ReadinessCheck {
+	check := client.ReadinessCheck{Name: client.ReadySelfRequest}
+
+	router := httpRouter
+	if router == nil {
+		router = httpsRouter
+	}
+
+	var addr *net.TCPAddr
+	if router != nil {
+		addr, _ = router.Addr().(*net.TCPAddr)
+	}
+	if addr == nil {
+		check.Detail = "no HTTP listener"
+		return check
+	}
+
+	// dial the listener directly, rather than whatever DNS says for host
+	dial := *addr
+	if dial.IP == nil || dial.IP.IsUnspecified() {
+		dial.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s://%s/", router.Scheme, dial.String()), nil)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	req.Host = host
+	req.Header.Set(ProbeHeader, probeToken)
+
+	// the certificate is reported on its own, so don't verify it here
+	httpClient := &http.Client{
+		Timeout: selfRequestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{ServerName: host, InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	resp.Body.Close()
+
+	svc := resp.Header.Get(ProbeHeader)
+	if resp.StatusCode != http.StatusNoContent || svc == "" {
+		check.Detail = fmt.Sprintf("router returned %s", resp.Status)
+		return check
+	}
+
+	check.OK = true
+	check.Detail = "reached " + svc
+	return check
+}
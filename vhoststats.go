@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// The request counters for one of a service's virtual hosts, updated
+// atomically.
+type vhostCounters struct {
+	Requests int64
+	Active   int64
+	// responses by status class, 2xx to 5xx
+	Status [4]int64
+	// request and response body bytes
+	Rcvd int64
+	Sent int64
+}
+
+// Count a finished request by the status of its response.
+func (c *vhostCounters) finish(code int) {
+	atomic.AddInt64(&c.Requests, 1)
+	if class := code/100 - 2; class >= 0 && class < len(c.Status) {
+		atomic.AddInt64(&c.Status[class], 1)
+	}
+}
+
+func (c *vhostCounters) stat() VHostStat {
+	return VHostStat{
+		Requests:  atomic.LoadInt64(&c.Requests),
+		Active:    atomic.LoadInt64(&c.Active),
+		Status2xx: atomic.LoadInt64(&c.Status[0]),
+		Status3xx: atomic.LoadInt64(&c.Status[1]),
+		Status4xx: atomic.LoadInt64(&c.Status[2]),
+		Status5xx: atomic.LoadInt64(&c.Status[3]),
+		Rcvd:      atomic.LoadInt64(&c.Rcvd),
+		Sent:      atomic.LoadInt64(&c.Sent),
+	}
+}
+
+// Replace the service's virtual host counters for a new list of vhosts,
+// keeping the counts of those it still has. Requests look the counters up
+// without locking, so the map is never modified once it's stored.
+func (s *Service) setVHostCounters(hosts []string) {
+	old := s.vhostCounterMap()
+	counters := make(map[string]*vhostCounters, len(hosts))
+	for _, host := range hosts {
+		if c := old[host]; c != nil {
+			counters[host] = c
+			continue
+		}
+		counters[host] = &vhostCounters{}
+	}
+	s.vhostCounts.Store(counters)
+}
+
+func (s *Service) vhostCounterMap() map[string]*vhostCounters {
+	counters, _ := s.vhostCounts.Load().(map[string]*vhostCounters)
+	return counters
+}
+
+// Return the counters for one of the service's virtual hosts, or nil if the
+// service doesn't have it.
+func (s *Service) vhostCounters(host string) *vhostCounters {
+	return s.vhostCounterMap()[host]
+}
+
+// The name of the service's virtual host matching a request's canonical host,
+// which may be a wildcard, or the host itself if none matches.
+func (s *Service) vhostName(host string) string {
+	counters := s.vhostCounterMap()
+	if len(counters) == 0 {
+		return host
+	}
+	if name := matchVHost(host, func(name string) bool { return counters[name] != nil }); name != "" {
+		return name
+	}
+	return host
+}
+
+// The requests to each of the service's virtual hosts.
+func (s *Service) vhostStats() map[string]VHostStat {
+	counters := s.vhostCounterMap()
+	stats := make(map[string]VHostStat, len(counters))
+	for host, c := range counters {
+		stats[host] = c.stat()
+	}
+	return stats
+}
+
+// Count the status of a proxied response for the request's virtual
+// host.
+func (s *Service) vhostResponse(pr *ProxyRequest) bool {
+	if c := s.vhostCounters(pr.VirtualHost); c != nil {
+		c.finish(pr.Response.StatusCode)
+	}
+	return true
+}
+
+// Count the body bytes of a proxied request for its virtual host, once the
+// response has been written.
+func (s *Service) vhostBytes(pr *ProxyRequest) {
+	if c := s.vhostCounters(pr.VirtualHost); c != nil {
+		atomic.AddInt64(&c.Rcvd, pr.RequestBytes)
+		atomic.AddInt64(&c.Sent, pr.ResponseBytes)
+	}
+}
+
+// A request body that counts the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// The transport closes the body when a backend can't be reached, but a
+// request may still be sent to the next one. The server closes the client's
+// body itself once the request is finished.
+func (b *countingBody) Close() error {
+	return nil
+}